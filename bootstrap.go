@@ -0,0 +1,213 @@
+package ctrld
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// bootstrapResolverStagger is the delay before querying the next bootstrap resolver of an
+// upstream, if the previous ones have not answered yet. A failed resolver makes the next one
+// queried immediately, so a dead resolver does not delay bootstrapping by a full timeout.
+const bootstrapResolverStagger = 300 * time.Millisecond
+
+// preferredBootstrapResolvers remembers the bootstrap resolver which last answered for each upstream.
+var preferredBootstrapResolvers = &bootstrapState{preferred: make(map[string]string)}
+
+// LoadBootstrapState loads the bootstrap resolvers which worked in previous runs of ctrld
+// from file at path, and keeps the file updated when they change.
+func LoadBootstrapState(path string) error {
+	return preferredBootstrapResolvers.setPath(path)
+}
+
+// bootstrapState maps upstream endpoints to their preferred bootstrap resolvers.
+type bootstrapState struct {
+	mu        sync.Mutex
+	path      string
+	preferred map[string]string
+}
+
+// setPath enables persistence of the state to file at path, loading the state saved in it.
+func (s *bootstrapState) setPath(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(buf, &s.preferred)
+}
+
+// get returns the preferred bootstrap resolver of given upstream endpoint.
+func (s *bootstrapState) get(endpoint string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.preferred[endpoint]
+}
+
+// set records server as the preferred bootstrap resolver of given upstream endpoint.
+func (s *bootstrapState) set(endpoint, server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.preferred[endpoint] == server {
+		return
+	}
+	s.preferred[endpoint] = server
+	if err := s.flushLocked(); err != nil {
+		ProxyLogger.Load().Warn().Err(err).Msg("could not persist bootstrap resolvers")
+	}
+}
+
+// flushLocked writes the state to file, if persistence is enabled. The caller must hold s.mu.
+func (s *bootstrapState) flushLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	buf, err := json.Marshal(s.preferred)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0750); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// bootstrapResolverAddrs returns addresses of the upstream bootstrap resolvers, the one which
+// last answered first, then the others in configured order.
+func (uc *UpstreamConfig) bootstrapResolverAddrs() []string {
+	preferred := preferredBootstrapResolvers.get(uc.Endpoint)
+	addrs := make([]string, 0, len(uc.BootstrapResolvers))
+	for _, ns := range uc.BootstrapResolvers {
+		addr := net.JoinHostPort(ns, "53")
+		if addr == preferred {
+			addrs = append([]string{addr}, addrs...)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// bootstrapDialer returns the dialer used for connecting to the upstream, which resolves the
+// upstream domain using its bootstrap resolvers, or the default bootstrap DNS if there's none.
+//
+// Queries of the dialer resolver are answered by bootstrapResolver, through an in-memory
+// connection, so all bootstrap resolvers are tried, not only the first one.
+func (uc *UpstreamConfig) bootstrapDialer() *net.Dialer {
+	if len(uc.BootstrapResolvers) == 0 {
+		return newDialer(net.JoinHostPort(bootstrapDNS, "53"))
+	}
+	r := &bootstrapResolver{uc: uc}
+	return &net.Dialer{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				go serveResolverConn(ctx, server, r)
+				return client, nil
+			},
+		},
+	}
+}
+
+// serveResolverConn answers DNS queries read from conn using r, until conn is closed.
+// Messages are framed like over TCP, since conn is not a net.PacketConn.
+func serveResolverConn(ctx context.Context, conn net.Conn, r Resolver) {
+	defer conn.Close()
+	dc := &dns.Conn{Conn: conn}
+	for {
+		msg, err := dc.ReadMsg()
+		if err != nil {
+			return
+		}
+		answer, err := r.Resolve(ctx, msg)
+		if err != nil {
+			answer = new(dns.Msg)
+			answer.SetRcode(msg, dns.RcodeServerFailure)
+		}
+		if err := dc.WriteMsg(answer); err != nil {
+			return
+		}
+	}
+}
+
+// bootstrapResolver resolves queries using the bootstrap resolvers of an upstream.
+type bootstrapResolver struct {
+	uc *UpstreamConfig
+}
+
+type bootstrapResolverResult struct {
+	server string
+	answer *dns.Msg
+	err    error
+}
+
+// Resolve sends msg to the bootstrap resolvers in order, starting the next one if the
+// previous ones failed or did not answer in bootstrapResolverStagger. The first successful
+// answer is returned, and its resolver is tried first next time.
+func (r *bootstrapResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	servers := r.uc.bootstrapResolverAddrs()
+	if len(servers) == 0 {
+		return nil, errors.New("no bootstrap resolvers available")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dnsClient := &dns.Client{Net: "udp"}
+	ch := make(chan *bootstrapResolverResult, len(servers))
+	next, pending := 0, 0
+	var stagger <-chan time.Time
+	start := func() {
+		server := servers[next]
+		go func() {
+			answer, _, err := dnsClient.ExchangeContext(ctx, msg.Copy(), server)
+			if err == nil && answer.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("%s: %s", server, dns.RcodeToString[answer.Rcode])
+			}
+			ch <- &bootstrapResolverResult{server: server, answer: answer, err: err}
+		}()
+		next++
+		pending++
+		stagger = time.After(bootstrapResolverStagger)
+	}
+
+	start()
+	errs := make([]error, 0, len(servers))
+	for {
+		select {
+		case <-stagger:
+		case res := <-ch:
+			pending--
+			if res.err == nil {
+				preferredBootstrapResolvers.set(r.uc.Endpoint, res.server)
+				return res.answer, nil
+			}
+			ProxyLogger.Load().Debug().Err(res.err).Msgf("bootstrap resolver %s failed", res.server)
+			errs = append(errs, res.err)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if next < len(servers) {
+			start()
+		} else if pending == 0 {
+			return nil, errors.Join(errs...)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ctrld
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_bootstrapState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bootstrap.json")
+	s := &bootstrapState{preferred: make(map[string]string)}
+	if err := s.setPath(path); err != nil {
+		t.Fatal(err)
+	}
+	s.set("dns.example.com:853", "192.0.2.2:53")
+
+	loaded := &bootstrapState{preferred: make(map[string]string)}
+	if err := loaded.setPath(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.get("dns.example.com:853"); got != "192.0.2.2:53" {
+		t.Errorf("unexpected preferred bootstrap resolver: %q", got)
+	}
+}
+
+func TestUpstreamConfig_bootstrapResolverAddrs(t *testing.T) {
+	uc := &UpstreamConfig{
+		Endpoint:           "https://bootstrap-resolvers.example.com/dns-query",
+		BootstrapResolvers: []string{"192.0.2.1", "192.0.2.2", "2001:db8::3"},
+	}
+	t.Cleanup(func() { preferredBootstrapResolvers.set(uc.Endpoint, "") })
+
+	want := []string{"192.0.2.1:53", "192.0.2.2:53", "[2001:db8::3]:53"}
+	if got := uc.bootstrapResolverAddrs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected addresses, want: %v, got: %v", want, got)
+	}
+
+	// The resolver which last answered is tried first.
+	preferredBootstrapResolvers.set(uc.Endpoint, "[2001:db8::3]:53")
+	want = []string{"[2001:db8::3]:53", "192.0.2.1:53", "192.0.2.2:53"}
+	if got := uc.bootstrapResolverAddrs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected addresses, want: %v, got: %v", want, got)
+	}
+
+	// A preferred resolver which is no longer configured is ignored.
+	preferredBootstrapResolvers.set(uc.Endpoint, "192.0.2.9:53")
+	want = []string{"192.0.2.1:53", "192.0.2.2:53", "[2001:db8::3]:53"}
+	if got := uc.bootstrapResolverAddrs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected addresses, want: %v, got: %v", want, got)
+	}
+}
+
+// staticResolver answers all queries with an A record of ip.
+type staticResolver struct {
+	ip string
+}
+
+func (r *staticResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	rr, err := dns.NewRR(msg.Question[0].Name + " 60 IN A " + r.ip)
+	if err != nil {
+		return nil, err
+	}
+	answer.Answer = append(answer.Answer, rr)
+	return answer, nil
+}
+
+func Test_serveResolverConn(t *testing.T) {
+	client, server := net.Pipe()
+	go serveResolverConn(context.Background(), server, &staticResolver{ip: "192.0.2.1"})
+	dc := &dns.Conn{Conn: client}
+	defer dc.Close()
+
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if err := dc.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+		answer, err := dc.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer.Id != msg.Id || len(answer.Answer) != 1 {
+			t.Fatalf("unexpected answer: %v", answer)
+		}
+		if a, ok := answer.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+			t.Errorf("unexpected answer record: %v", answer.Answer[0])
+		}
+	}
+}
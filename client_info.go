@@ -19,4 +19,5 @@ const (
 	Dnsmasq  LeaseFileFormat = "dnsmasq"
 	IscDhcpd LeaseFileFormat = "isc-dhcpd"
 	KeaDHCP4 LeaseFileFormat = "kea-dhcp4"
+	Udhcpd   LeaseFileFormat = "udhcpd"
 )
@@ -0,0 +1,22 @@
+package ctrld
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// clockOffset is the offset of local clock, learned from NTP servers.
+var clockOffset atomic.Int64
+
+// SetClockOffset sets the offset which is added to local clock by Now. It is used when
+// local clock is known to be wrong, but could not be corrected, for example, on routers
+// without RTC which boot with a clock in the past, that makes TLS certificates invalid.
+func SetClockOffset(d time.Duration) {
+	clockOffset.Store(int64(d))
+}
+
+// Now returns the current local time, adjusted by offset set via SetClockOffset.
+// It is used as time source for verifying TLS certificates of upstreams.
+func Now() time.Time {
+	return time.Now().Add(time.Duration(clockOffset.Load()))
+}
@@ -0,0 +1,427 @@
+package cli
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	// acmeDir is the directory, in ctrld home dir, where ACME account key and certificates are stored.
+	acmeDir = "acme"
+	// acmeAccountKeyFile is the file, in acmeDir, of the ACME account private key.
+	acmeAccountKeyFile = "account.key"
+	// acmeTimeout is the time allowed for obtaining a certificate.
+	acmeTimeout = 5 * time.Minute
+	// acmeRetryInterval is the time to wait before retrying a failed renewal.
+	acmeRetryInterval = time.Hour
+	// acmeHTTP01Addr is the address HTTP-01 challenges are served on while obtaining certificates.
+	acmeHTTP01Addr = ":80"
+)
+
+// acmeDNSProvider creates and removes TXT records for ACME DNS-01 challenges.
+type acmeDNSProvider interface {
+	present(domain, record, value string) error
+	cleanup(domain, record, value string) error
+}
+
+// hookDNSProvider fulfills DNS-01 challenges by running hook_acme_dns script, so any DNS
+// provider API could be used. The action, "present" or "cleanup", the domain, the TXT record
+// name and value are passed to the script via CTRLD_ACME_ACTION, CTRLD_ACME_DOMAIN,
+// CTRLD_ACME_RECORD and CTRLD_ACME_VALUE environment variables.
+type hookDNSProvider struct {
+	p *prog
+}
+
+func (h *hookDNSProvider) present(domain, record, value string) error {
+	return h.run("present", domain, record, value)
+}
+
+func (h *hookDNSProvider) cleanup(domain, record, value string) error {
+	return h.run("cleanup", domain, record, value)
+}
+
+func (h *hookDNSProvider) run(action, domain, record, value string) error {
+	return h.p.runHook(hookACMEDNS,
+		"CTRLD_ACME_ACTION="+action,
+		"CTRLD_ACME_DOMAIN="+domain,
+		"CTRLD_ACME_RECORD="+record,
+		"CTRLD_ACME_VALUE="+value,
+	)
+}
+
+// acmeManager obtains certificates of encrypted listeners using ACME, and renews them
+// before they expire. Certificates are stored in dir, so they are reused after ctrld restarts.
+type acmeManager struct {
+	dir          string
+	email        string
+	directoryURL string
+	challenge    string
+	dnsProvider  acmeDNSProvider
+	httpAddr     string
+
+	obtainMu sync.Mutex // Serializes obtaining certificates, HTTP-01 challenges share the same port.
+	client   *acme.Client
+	group    singleflight.Group // Deduplicates loading or obtaining certificates of the same domain.
+
+	mu       sync.Mutex
+	certs    map[string]*tls.Certificate
+	renewing map[string]bool
+	retryAt  map[string]time.Time
+}
+
+// newACMEManager returns an acmeManager using ACME settings of cfg, storing certificates in dir.
+func newACMEManager(cfg *ctrld.Config, dir string, dnsProvider acmeDNSProvider) *acmeManager {
+	m := &acmeManager{
+		dir:          dir,
+		email:        cfg.Service.ACMEEmail,
+		directoryURL: cfg.Service.ACMEDirectory,
+		challenge:    cfg.Service.ACMEChallenge,
+		dnsProvider:  dnsProvider,
+		httpAddr:     acmeHTTP01Addr,
+		certs:        make(map[string]*tls.Certificate),
+		renewing:     make(map[string]bool),
+		retryAt:      make(map[string]time.Time),
+	}
+	if m.directoryURL == "" {
+		m.directoryURL = acme.LetsEncryptURL
+	}
+	if m.challenge == "" {
+		m.challenge = ctrld.ACMEChallengeHTTP01
+	}
+	return m
+}
+
+// tlsConfig returns the TLS config of an encrypted listener serving the certificate of domain.
+//
+// A valid certificate stored by previous runs is served right away. Otherwise, the certificate
+// is obtained in background, so the listener starts without waiting for the ACME server, and
+// TLS handshakes fail until the certificate is available.
+func (m *acmeManager) tlsConfig(domain string) (*tls.Config, error) {
+	if cert, err := m.load(domain); err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+		m.mu.Lock()
+		if m.certs[domain] == nil {
+			m.certs[domain] = cert
+		}
+		m.mu.Unlock()
+	} else {
+		m.group.DoChan(domain, func() (any, error) { return m.loadOrObtain(domain) })
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.certificate(domain)
+		},
+	}, nil
+}
+
+// certificate returns the current certificate of domain. If there is none, it is loaded or
+// obtained in background, and an error is returned until then, so TLS handshakes never wait
+// for the ACME server. When the certificate is due for renewal, it is renewed in background
+// while the current one is still served.
+func (m *acmeManager) certificate(domain string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	cert := m.certs[domain]
+	now := time.Now()
+	retry := now.After(m.retryAt[domain])
+	if cert != nil && now.After(acmeRenewAt(cert.Leaf)) && !m.renewing[domain] && retry {
+		m.renewing[domain] = true
+		go m.renew(domain)
+	}
+	m.mu.Unlock()
+	if cert != nil {
+		return cert, nil
+	}
+	if retry {
+		m.group.DoChan(domain, func() (any, error) { return m.loadOrObtain(domain) })
+	}
+	return nil, fmt.Errorf("ACME certificate of %s is not available yet", domain)
+}
+
+// loadOrObtain loads the certificate of domain from disk, or obtains a new one if there is none
+// or it is expired, then makes it the current certificate of domain.
+func (m *acmeManager) loadOrObtain(domain string) (*tls.Certificate, error) {
+	cert, err := m.load(domain)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		mainLog.Load().Warn().Err(err).Msgf("could not load ACME certificate of %s", domain)
+	}
+	if cert == nil || time.Now().After(cert.Leaf.NotAfter) {
+		mainLog.Load().Info().Msgf("obtaining ACME certificate of %s", domain)
+		if cert, err = m.obtain(domain); err != nil {
+			mainLog.Load().Error().Err(err).Msgf("could not obtain ACME certificate of %s, retrying in %s", domain, acmeRetryInterval)
+			m.mu.Lock()
+			m.retryAt[domain] = time.Now().Add(acmeRetryInterval)
+			m.mu.Unlock()
+			return nil, err
+		}
+		mainLog.Load().Info().Msgf("obtained ACME certificate of %s, valid until %s", domain, cert.Leaf.NotAfter)
+	}
+	m.mu.Lock()
+	m.certs[domain] = cert
+	m.mu.Unlock()
+	return cert, nil
+}
+
+// renew obtains a new certificate of domain, replacing the current one if succeeded.
+func (m *acmeManager) renew(domain string) {
+	mainLog.Load().Info().Msgf("renewing ACME certificate of %s", domain)
+	cert, err := m.obtain(domain)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.renewing[domain] = false
+	if err != nil {
+		mainLog.Load().Error().Err(err).Msgf("could not renew ACME certificate of %s, retrying in %s", domain, acmeRetryInterval)
+		m.retryAt[domain] = time.Now().Add(acmeRetryInterval)
+		return
+	}
+	m.certs[domain] = cert
+	mainLog.Load().Info().Msgf("renewed ACME certificate of %s, valid until %s", domain, cert.Leaf.NotAfter)
+}
+
+// acmeRenewAt returns the time the certificate should be renewed, when a third of its lifetime
+// is left, that's 30 days for Let's Encrypt certificates.
+func acmeRenewAt(leaf *x509.Certificate) time.Time {
+	return leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 3)
+}
+
+// obtain requests a new certificate of domain from the ACME server, then stores it.
+func (m *acmeManager) obtain(domain string) (*tls.Certificate, error) {
+	m.obtainMu.Lock()
+	defer m.obtainMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		if err := m.authorize(ctx, client, z); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	return m.store(domain, der, key)
+}
+
+// authorize proves control of the domain of z to the ACME server, using the configured challenge.
+func (m *acmeManager) authorize(ctx context.Context, client *acme.Client, z *acme.Authorization) error {
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == m.challenge {
+			chal = c
+			break
+		}
+	}
+	domain := z.Identifier.Value
+	if chal == nil {
+		return fmt.Errorf("%s challenge is not offered for %s", m.challenge, domain)
+	}
+	switch m.challenge {
+	case ctrld.ACMEChallengeDNS01:
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		record := "_acme-challenge." + domain
+		if err := m.dnsProvider.present(domain, record, value); err != nil {
+			return fmt.Errorf("could not create TXT record %s: %w", record, err)
+		}
+		defer func() {
+			if err := m.dnsProvider.cleanup(domain, record, value); err != nil {
+				mainLog.Load().Warn().Err(err).Msgf("could not remove TXT record %s", record)
+			}
+		}()
+	default:
+		resp, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		stop, err := serveHTTP01Challenge(m.httpAddr, client.HTTP01ChallengePath(chal.Token), resp)
+		if err != nil {
+			return fmt.Errorf("could not serve HTTP-01 challenge: %w", err)
+		}
+		defer stop()
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err := client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// serveHTTP01Challenge serves resp on path over HTTP on addr, until the returned function is called.
+func serveHTTP01Challenge(addr, path, resp string) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(resp))
+	})
+	s := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = s.Serve(ln) }()
+	return func() { _ = s.Close() }, nil
+}
+
+// acmeClient returns the ACME client, registering the account on first use. The account
+// key is created in m.dir if it does not exist.
+func (m *acmeManager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateACMEKey(filepath.Join(m.dir, acmeAccountKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not load ACME account key: %w", err)
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.directoryURL, UserAgent: "ctrld"}
+	acct := &acme.Account{}
+	if m.email != "" {
+		acct.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("could not register ACME account: %w", err)
+	}
+	m.client = client
+	return client, nil
+}
+
+// loadOrCreateACMEKey loads the PEM encoded EC private key from path, or creates a new one.
+func loadOrCreateACMEKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid key file: %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// certFiles returns paths of the certificate and key files of domain.
+func (m *acmeManager) certFiles(domain string) (certFile, keyFile string) {
+	return filepath.Join(m.dir, domain+".crt"), filepath.Join(m.dir, domain+".key")
+}
+
+// store writes the certificate chain der and its key to disk, returning the certificate.
+func (m *acmeManager) store(domain string, der [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	var certPEM []byte
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return nil, err
+	}
+	// Files are replaced atomically, so a crash never leaves a truncated key or certificate.
+	certFile, keyFile := m.certFiles(domain)
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	return parseACMECert(certPEM, keyPEM)
+}
+
+// load reads the certificate of domain from disk.
+func (m *acmeManager) load(domain string) (*tls.Certificate, error) {
+	certFile, keyFile := m.certFiles(domain)
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseACMECert(certPEM, keyPEM)
+}
+
+// parseACMECert parses the PEM encoded certificate chain and key, with Leaf populated.
+func parseACMECert(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// listenerTLSConfig returns the TLS config of an encrypted listener, serving the certificate
+// obtained using ACME if acme_domain is set, or tls_cert and tls_key otherwise.
+func (p *prog) listenerTLSConfig(lc *ctrld.ListenerConfig) (*tls.Config, error) {
+	if lc.ACMEDomain != "" {
+		return p.acme.tlsConfig(lc.ACMEDomain)
+	}
+	return lc.ServerTLSConfig()
+}
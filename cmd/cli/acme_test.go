@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func newTestACMECert(t *testing.T, domain string, notBefore, notAfter time.Time) ([][]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return [][]byte{der}, key
+}
+
+func Test_acmeManager_certificate(t *testing.T) {
+	m := newACMEManager(&ctrld.Config{}, t.TempDir(), nil)
+	assert.Equal(t, ctrld.ACMEChallengeHTTP01, m.challenge)
+
+	// Certificate stored by previous runs is served without contacting the ACME server.
+	now := time.Now()
+	der, key := newTestACMECert(t, "dns.example.com", now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	_, err := m.store("dns.example.com", der, key)
+	require.NoError(t, err)
+
+	tlsConfig, err := m.tlsConfig("dns.example.com")
+	require.NoError(t, err)
+	cert, err := tlsConfig.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "dns.example.com", cert.Leaf.Subject.CommonName)
+	assert.False(t, m.renewing["dns.example.com"])
+}
+
+func Test_acmeManager_certificateNotObtained(t *testing.T) {
+	// An ACME server which could not be reached.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := &ctrld.Config{Service: ctrld.ServiceConfig{ACMEDirectory: "http://" + addr + "/directory"}}
+	m := newACMEManager(cfg, t.TempDir(), nil)
+	tlsConfig, err := m.tlsConfig("dns.example.com")
+	require.NoError(t, err)
+	// Handshakes fail without waiting for the certificate to be obtained.
+	_, err = tlsConfig.GetCertificate(nil)
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return !m.retryAt["dns.example.com"].IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_acmeRenewAt(t *testing.T) {
+	notBefore := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(90 * 24 * time.Hour)}
+	assert.Equal(t, notBefore.Add(60*24*time.Hour), acmeRenewAt(leaf))
+}
+
+func Test_loadOrCreateACMEKey(t *testing.T) {
+	path := t.TempDir() + "/" + acmeAccountKeyFile
+	key, err := loadOrCreateACMEKey(path)
+	require.NoError(t, err)
+	loaded, err := loadOrCreateACMEKey(path)
+	require.NoError(t, err)
+	assert.True(t, key.(*ecdsa.PrivateKey).Equal(loaded))
+}
+
+func Test_serveHTTP01Challenge(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	stop, err := serveHTTP01Challenge(addr, "/.well-known/acme-challenge/token", "token.thumbprint")
+	require.NoError(t, err)
+	defer stop()
+
+	resp, err := http.Get("http://" + addr + "/.well-known/acme-challenge/token")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "token.thumbprint", string(body))
+
+	resp, err = http.Get("http://" + addr + "/.well-known/acme-challenge/other")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
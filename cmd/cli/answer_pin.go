@@ -0,0 +1,296 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxPinDuration is the maximum duration an answer could be pinned for.
+const maxPinDuration = 7 * 24 * time.Hour
+
+// answerPinKey identifies pinned answers by question, and the upstreams the question is routed to.
+type answerPinKey struct {
+	name      string
+	qtype     uint16
+	upstreams string
+}
+
+func newAnswerPinKey(name string, qtype uint16, upstreams []string) answerPinKey {
+	return answerPinKey{name: dns.CanonicalName(name), qtype: qtype, upstreams: strings.Join(upstreams, ",")}
+}
+
+// answerPin is an answer pinned until expire.
+type answerPin struct {
+	answer *dns.Msg
+	expire time.Time
+}
+
+// answerPins holds answers pinned by users, which are served instead of resolving their
+// questions, ignoring upstream changes, until they expire or are unpinned.
+//
+// Pins are scoped to the upstreams, which policies routed the pinned question to. Clients
+// whose queries are routed elsewhere, by other rules of the policy, keep being resolved.
+type answerPins struct {
+	mu   sync.RWMutex
+	pins map[answerPinKey]*answerPin
+}
+
+// add pins answer of name and qtype routed to upstreams until expire, replacing the existing one.
+func (ap *answerPins) add(name string, qtype uint16, upstreams []string, answer *dns.Msg, expire time.Time) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	if ap.pins == nil {
+		ap.pins = make(map[answerPinKey]*answerPin)
+	}
+	ap.pins[newAnswerPinKey(name, qtype, upstreams)] = &answerPin{answer: answer.Copy(), expire: expire}
+}
+
+// get returns the pinned answer for msg question routed to upstreams, or nil if there's none.
+// The answer is a copy, with TTLs capped to the remaining pin duration.
+func (ap *answerPins) get(msg *dns.Msg, upstreams []string, now time.Time) *dns.Msg {
+	q := msg.Question[0]
+	key := newAnswerPinKey(q.Name, q.Qtype, upstreams)
+	ap.mu.RLock()
+	pin := ap.pins[key]
+	ap.mu.RUnlock()
+	if pin == nil {
+		return nil
+	}
+	if !pin.expire.After(now) {
+		ap.mu.Lock()
+		if ap.pins[key] == pin {
+			delete(ap.pins, key)
+		}
+		ap.mu.Unlock()
+		return nil
+	}
+	answer := pin.answer.Copy()
+	answer.SetRcode(msg, answer.Rcode)
+	ttl := uint32(pin.expire.Sub(now).Seconds())
+	for _, rrs := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	return answer
+}
+
+// remove unpins answers of domain and its subdomains, or all answers if domain is empty,
+// returning the number of removed pins.
+func (ap *answerPins) remove(domain string) int {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	n := 0
+	for key := range ap.pins {
+		if domain == "" || dns.IsSubDomain(dns.CanonicalName(domain), key.name) {
+			delete(ap.pins, key)
+			n++
+		}
+	}
+	return n
+}
+
+// list returns all pins which have not expired at now, sorted by domain, type and upstreams.
+func (ap *answerPins) list(now time.Time) []*cachePin {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	pins := make([]*cachePin, 0, len(ap.pins))
+	for key, pin := range ap.pins {
+		if !pin.expire.After(now) {
+			continue
+		}
+		pins = append(pins, newCachePin(key, pin))
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].Domain != pins[j].Domain {
+			return pins[i].Domain < pins[j].Domain
+		}
+		if pins[i].Type != pins[j].Type {
+			return pins[i].Type < pins[j].Type
+		}
+		return strings.Join(pins[i].Upstreams, ",") < strings.Join(pins[j].Upstreams, ",")
+	})
+	return pins
+}
+
+// cachePinRequest represents request for pinning answers of a domain in running ctrld.
+type cachePinRequest struct {
+	// Domain is the name, which answers are pinned. If empty, current pins are listed.
+	Domain string `json:"domain,omitempty"`
+	// Types are the query types to pin answers for, A and AAAA if empty.
+	Types []string `json:"types,omitempty"`
+	// Duration is the number of seconds answers are pinned for.
+	Duration int `json:"duration,omitempty"`
+	// Listener is the listener number, which policies are used for resolving the answers.
+	// Answers are served to queries, which the listener routes to the same upstreams.
+	Listener string `json:"listener,omitempty"`
+	// ClientIP and Mac identify the client which the answers are resolved for, so client
+	// scoped policies apply. If not set, the answers are resolved for 127.0.0.1.
+	ClientIP string `json:"client_ip,omitempty"`
+	Mac      string `json:"mac,omitempty"`
+}
+
+// cachePin represents an answer pinned until Expire.
+type cachePin struct {
+	Domain    string    `json:"domain"`
+	Type      string    `json:"type"`
+	Upstreams []string  `json:"upstreams"`
+	Rcode     string    `json:"rcode"`
+	Answers   []string  `json:"answers,omitempty"`
+	Expire    time.Time `json:"expire"`
+}
+
+func newCachePin(key answerPinKey, pin *answerPin) *cachePin {
+	cp := &cachePin{
+		Domain:    strings.TrimSuffix(key.name, "."),
+		Type:      dns.TypeToString[key.qtype],
+		Upstreams: strings.Split(key.upstreams, ","),
+		Rcode:     dns.RcodeToString[pin.answer.Rcode],
+		Expire:    pin.expire,
+	}
+	for _, rr := range pin.answer.Answer {
+		cp.Answers = append(cp.Answers, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	return cp
+}
+
+// cachePinResponse represents result of pinning answers, or the list of current pins.
+type cachePinResponse struct {
+	Pins  []*cachePin `json:"pins,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// cacheUnpinRequest represents request for unpinning answers of running ctrld.
+type cacheUnpinRequest struct {
+	// Domain is the name, which answers, and answers of its subdomains, are unpinned.
+	// If empty, all answers are unpinned.
+	Domain string `json:"domain,omitempty"`
+}
+
+// cacheUnpinResponse represents result of unpinning answers.
+type cacheUnpinResponse struct {
+	Unpinned int    `json:"unpinned"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleCachePin is the control server handler for pinning answers, and listing pins.
+func (p *prog) handleCachePin(w http.ResponseWriter, request *http.Request) {
+	var req cachePinRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&cachePinResponse{Error: err.Error()})
+		return
+	}
+	if req.Domain == "" {
+		_ = json.NewEncoder(w).Encode(&cachePinResponse{Pins: p.pins.list(time.Now())})
+		return
+	}
+	pins, err := p.pinAnswers(request.Context(), &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&cachePinResponse{Error: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&cachePinResponse{Pins: pins})
+}
+
+// handleCacheUnpin is the control server handler for unpinning answers.
+func (p *prog) handleCacheUnpin(w http.ResponseWriter, request *http.Request) {
+	var req cacheUnpinRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&cacheUnpinResponse{Error: err.Error()})
+		return
+	}
+	n := p.pins.remove(req.Domain)
+	if req.Domain == "" {
+		mainLog.Load().Info().Msgf("unpinned %d answers", n)
+	} else {
+		mainLog.Load().Info().Msgf("unpinned %d answers of %s", n, req.Domain)
+	}
+	_ = json.NewEncoder(w).Encode(&cacheUnpinResponse{Unpinned: n})
+}
+
+// pinAnswers resolves the current answers of req.Domain, the same as a query sent to req.Listener
+// from req.ClientIP would be, then pins them for req.Duration to the upstreams the query was routed to.
+func (p *prog) pinAnswers(ctx context.Context, req *cachePinRequest) ([]*cachePin, error) {
+	if _, ok := dns.IsDomainName(req.Domain); !ok {
+		return nil, fmt.Errorf("invalid domain: %q", req.Domain)
+	}
+	d := time.Duration(req.Duration) * time.Second
+	if d <= 0 || d > maxPinDuration {
+		return nil, fmt.Errorf("duration must be between 1s and %s", maxPinDuration)
+	}
+	listener := req.Listener
+	if listener == "" {
+		listener = "0"
+	}
+	lc := p.cfg.Listener[listener]
+	if lc == nil {
+		return nil, fmt.Errorf("listener.%s not found", listener)
+	}
+	types := req.Types
+	if len(types) == 0 {
+		types = []string{"A", "AAAA"}
+	}
+	qtypes := make([]uint16, len(types))
+	for i, t := range types {
+		qtype, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return nil, fmt.Errorf("invalid query type: %q", t)
+		}
+		qtypes[i] = qtype
+	}
+	clientIP := req.ClientIP
+	if clientIP == "" {
+		clientIP = "127.0.0.1"
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client ip: %q", req.ClientIP)
+	}
+
+	addr := &net.UDPAddr{IP: ip}
+	answers := make([]*dns.Msg, len(qtypes))
+	upstreams := make([][]string, len(qtypes))
+	for i, qtype := range qtypes {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(req.Domain), qtype)
+		ci := p.getClientInfo(clientIP, msg)
+		if req.Mac != "" {
+			ci.Mac = req.Mac
+		}
+		ur := p.upstreamFor(ctx, listener, lc, addr, ci.Mac, canonicalName(msg.Question[0].Name))
+		pReq := &proxyRequest{msg: msg, ci: ci, ufr: ur}
+		if policy := ur.policyConfig; policy != nil {
+			pReq.failoverRcodes = policy.FailoverRcodeNumbers
+			pReq.loadBalance = policy.LoadBalance
+		}
+		answer := p.proxy(ctx, pReq).answer
+		// Pinning a failure would make an outage permanent, rather than preventing it.
+		if answer == nil || (answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError) {
+			return nil, fmt.Errorf("could not resolve %s answer of %s", dns.TypeToString[qtype], req.Domain)
+		}
+		answers[i] = answer
+		upstreams[i] = ur.upstreams
+	}
+	expire := time.Now().Add(d)
+	pins := make([]*cachePin, len(qtypes))
+	for i, qtype := range qtypes {
+		p.pins.add(req.Domain, qtype, upstreams[i], answers[i], expire)
+		pins[i] = newCachePin(newAnswerPinKey(req.Domain, qtype, upstreams[i]), &answerPin{answer: answers[i], expire: expire})
+	}
+	mainLog.Load().Info().Msgf("pinned %s answers of %s for %s", strings.Join(types, ", "), req.Domain, d)
+	return pins, nil
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_answerPins(t *testing.T) {
+	var ap answerPins
+	now := time.Now()
+	upstreams := []string{"upstream.0"}
+	for _, name := range []string{"example.com.", "www.example.com.", "example.net."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		answer := new(dns.Msg)
+		answer.SetReply(msg)
+		answer.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.ParseIP("192.0.2.1"),
+		}}
+		ap.add(name, dns.TypeA, upstreams, answer, now.Add(time.Minute))
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("WWW.Example.com.", dns.TypeA)
+	answer := ap.get(msg, upstreams, now)
+	require.NotNil(t, answer)
+	assert.Equal(t, msg.Id, answer.Id)
+	assert.Equal(t, uint32(60), answer.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(30), ap.get(msg, upstreams, now.Add(30*time.Second)).Answer[0].Header().Ttl)
+	// Queries routed to other upstreams are not answered with the pin.
+	assert.Nil(t, ap.get(msg, []string{"upstream.1"}, now))
+	assert.Nil(t, ap.get(msg, []string{"upstream.0", "upstream.1"}, now))
+
+	msg.SetQuestion("www.example.com.", dns.TypeAAAA)
+	assert.Nil(t, ap.get(msg, upstreams, now))
+
+	pins := ap.list(now)
+	require.Len(t, pins, 3)
+	assert.Equal(t, "example.com", pins[0].Domain)
+	assert.Equal(t, "A", pins[0].Type)
+	assert.Equal(t, upstreams, pins[0].Upstreams)
+	assert.Equal(t, []string{"192.0.2.1"}, pins[0].Answers)
+
+	msg.SetQuestion("example.net.", dns.TypeA)
+	assert.Nil(t, ap.get(msg, upstreams, now.Add(time.Minute)))
+	assert.Len(t, ap.list(now), 2)
+
+	assert.Equal(t, 2, ap.remove("example.com"))
+	assert.Equal(t, 0, ap.remove(""))
+}
+
+func Test_prog_pinAnswers_invalid(t *testing.T) {
+	p := &prog{}
+	for _, req := range []*cachePinRequest{
+		{Domain: "invalid..domain", Duration: 60},
+		{Domain: "example.com"},
+		{Domain: "example.com", Duration: int(maxPinDuration.Seconds()) + 1},
+	} {
+		_, err := p.pinAnswers(context.Background(), req)
+		assert.Error(t, err, req)
+	}
+
+	p = &prog{cfg: &ctrld.Config{Listener: map[string]*ctrld.ListenerConfig{"0": {}}}}
+	_, err := p.pinAnswers(context.Background(), &cachePinRequest{Domain: "example.com", Duration: 60, ClientIP: "invalid"})
+	assert.Error(t, err)
+}
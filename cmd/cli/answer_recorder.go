@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// answerRecorder is the dns.ResponseWriter of queries received by DoH and DoQ listeners,
+// keeping the answer, so it could be sent back in the listener protocol.
+type answerRecorder struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	answer     *dns.Msg
+}
+
+var _ dns.ResponseWriter = (*answerRecorder)(nil)
+
+func (w *answerRecorder) LocalAddr() net.Addr {
+	if w.localAddr == nil {
+		return &net.TCPAddr{}
+	}
+	return w.localAddr
+}
+
+func (w *answerRecorder) RemoteAddr() net.Addr { return w.remoteAddr }
+
+func (w *answerRecorder) WriteMsg(m *dns.Msg) error {
+	w.answer = m
+	return nil
+}
+
+func (w *answerRecorder) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.answer = m
+	return len(buf), nil
+}
+
+func (w *answerRecorder) Close() error { return nil }
+
+func (w *answerRecorder) TsigStatus() error { return errors.New("tsig is not supported") }
+
+func (w *answerRecorder) TsigTimersOnly(bool) {}
+
+func (w *answerRecorder) Hijack() {}
@@ -0,0 +1,177 @@
+package cli
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// bindRefreshInterval is the interval bind addresses of listeners are re-evaluated on,
+// so listeners follow interfaces coming and going, or changing their addresses.
+const bindRefreshInterval = 10 * time.Second
+
+// bindKey identifies the DNS server of a bind address.
+type bindKey struct {
+	proto string
+	addr  string
+}
+
+// bindServer is a DNS server of a bind address.
+type bindServer struct {
+	s     *listenerServer
+	errCh <-chan error
+}
+
+// serveBind serves plain DNS over UDP and TCP on bind addresses of the listener, until ctrld stops.
+// Addresses are re-evaluated every bindRefreshInterval, servers are started for new addresses,
+// and stopped for addresses which are gone.
+func (p *prog) serveBind(lc *ctrld.ListenerConfig, handler dns.Handler) error {
+	servers := make(map[bindKey]*bindServer)
+	refresh := func() {
+		want := make(map[bindKey]bool)
+		for _, addr := range resolveBindAddrs(lc.Bind, lc.Port, interfaceAddrs) {
+			for _, proto := range []string{"udp", "tcp"} {
+				want[bindKey{proto: proto, addr: addr}] = true
+			}
+		}
+		for key, bs := range servers {
+			if want[key] && !bindServerDone(bs) {
+				continue
+			}
+			_ = bs.s.Shutdown()
+			delete(servers, key)
+			if !want[key] {
+				mainLog.Load().Info().Msgf("stopped listening on %s: %s", key.proto, key.addr)
+			}
+		}
+		for key := range want {
+			if servers[key] != nil {
+				continue
+			}
+			s, errCh := runListenerDNSServer(lc, key.addr, key.proto, handler)
+			bs := &bindServer{s: s, errCh: errCh}
+			if bindServerDone(bs) {
+				// Retried on next refresh, the address may not be ready yet.
+				continue
+			}
+			servers[key] = bs
+			mainLog.Load().Info().Msgf("listening on %s: %s", key.proto, key.addr)
+		}
+	}
+	refresh()
+	p.started <- struct{}{}
+	ticker := time.NewTicker(bindRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			for _, bs := range servers {
+				_ = bs.s.Shutdown()
+			}
+			return nil
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
+
+// bindServerDone reports whether the server of bs stopped serving.
+func bindServerDone(bs *bindServer) bool {
+	select {
+	case <-bs.errCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolveBindAddrs returns listen addresses of bind entries. An entry is either an "ip:port",
+// an IP address, or an interface name, whose addresses are used. The listener port is used for
+// entries without port. Link-local IPv6 addresses of interfaces are scoped to the interface,
+// like "[fe80::1%br-lan]:53", so IPv6-only segments without global addresses are served too.
+func resolveBindAddrs(bind []string, port int, ifaceAddrs func(name string) ([]netip.Addr, error)) []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, b := range bind {
+		if ap, err := netip.ParseAddrPort(b); err == nil {
+			add(ap.String())
+			continue
+		}
+		if ip, err := netip.ParseAddr(b); err == nil {
+			add(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			continue
+		}
+		ips, err := ifaceAddrs(b)
+		if err != nil {
+			mainLog.Load().Debug().Err(err).Msgf("could not get addresses of interface: %s", b)
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Is6() && ip.IsLinkLocalUnicast() {
+				ip = ip.WithZone(b)
+			}
+			add(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		}
+	}
+	return addrs
+}
+
+// listenerAddr returns the IP and port which queries to the listener could be sent to. Listeners
+// with bind addresses do not listen on their IP, so a bound loopback address is used if any, or
+// the first bound address which is not link-local otherwise.
+func listenerAddr(lc *ctrld.ListenerConfig, ifaceAddrs func(name string) ([]netip.Addr, error)) (string, int) {
+	if len(lc.Bind) == 0 {
+		return lc.IP, lc.Port
+	}
+	var best netip.AddrPort
+	for _, addr := range resolveBindAddrs(lc.Bind, lc.Port, ifaceAddrs) {
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			continue
+		}
+		switch {
+		case ap.Addr().IsLoopback():
+			return ap.Addr().String(), int(ap.Port())
+		case !best.IsValid(), best.Addr().IsLinkLocalUnicast() && !ap.Addr().IsLinkLocalUnicast():
+			best = ap
+		}
+	}
+	if !best.IsValid() {
+		return lc.IP, lc.Port
+	}
+	return best.Addr().String(), int(best.Port())
+}
+
+// interfaceAddrs returns IP addresses of the interface with the given name.
+func interfaceAddrs(name string) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_resolveBindAddrs(t *testing.T) {
+	ifaceAddrs := func(name string) ([]netip.Addr, error) {
+		switch name {
+		case "br-lan":
+			return []netip.Addr{
+				netip.MustParseAddr("192.168.1.1"),
+				netip.MustParseAddr("fd00::1"),
+				netip.MustParseAddr("fe80::1"),
+			}, nil
+		case "wg0":
+			return []netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil
+		}
+		return nil, errors.New("no such interface")
+	}
+	tests := []struct {
+		name string
+		bind []string
+		want []string
+	}{
+		{"ip port", []string{"192.168.1.1:5353"}, []string{"192.168.1.1:5353"}},
+		{"ip", []string{"192.168.1.1"}, []string{"192.168.1.1:53"}},
+		{"ipv6 port", []string{"[fd00::1]:53"}, []string{"[fd00::1]:53"}},
+		{"interface", []string{"br-lan"}, []string{"192.168.1.1:53", "[fd00::1]:53", "[fe80::1%br-lan]:53"}},
+		{"link-local", []string{"[fe80::1%br-lan]:53", "fe80::2%br-lan"}, []string{"[fe80::1%br-lan]:53", "[fe80::2%br-lan]:53"}},
+		{"missing interface", []string{"br-guest", "wg0"}, []string{"10.0.0.1:53"}},
+		{"duplicated", []string{"192.168.1.1", "br-lan"}, []string{"192.168.1.1:53", "[fd00::1]:53", "[fe80::1%br-lan]:53"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := resolveBindAddrs(tc.bind, 53, ifaceAddrs); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected addresses, want: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_listenerAddr(t *testing.T) {
+	ifaceAddrs := func(name string) ([]netip.Addr, error) {
+		switch name {
+		case "br-lan":
+			return []netip.Addr{netip.MustParseAddr("fe80::1"), netip.MustParseAddr("192.168.1.1")}, nil
+		case "lo":
+			return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+		}
+		return nil, errors.New("no such interface")
+	}
+	tests := []struct {
+		name     string
+		lc       *ctrld.ListenerConfig
+		wantIP   string
+		wantPort int
+	}{
+		{"no bind", &ctrld.ListenerConfig{IP: "127.0.0.1", Port: 53}, "127.0.0.1", 53},
+		{"bind", &ctrld.ListenerConfig{Port: 53, Bind: []string{"br-lan"}}, "192.168.1.1", 53},
+		{"bind loopback", &ctrld.ListenerConfig{Port: 53, Bind: []string{"br-lan", "lo"}}, "127.0.0.1", 53},
+		{"bind port", &ctrld.ListenerConfig{Port: 53, Bind: []string{"10.0.0.1:5353"}}, "10.0.0.1", 5353},
+		{"bind link-local only", &ctrld.ListenerConfig{Port: 53, Bind: []string{"fe80::2%br-lan"}}, "fe80::2%br-lan", 53},
+		{"bind missing interface", &ctrld.ListenerConfig{Port: 53, Bind: []string{"wg0"}}, "", 53},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ip, port := listenerAddr(tc.lc, ifaceAddrs)
+			if ip != tc.wantIP || port != tc.wantPort {
+				t.Errorf("unexpected address, want: %s:%d, got: %s:%d", tc.wantIP, tc.wantPort, ip, port)
+			}
+		})
+	}
+}
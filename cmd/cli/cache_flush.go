@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+var errCacheDisabled = errors.New("cache is not enabled")
+
+// cacheFlushRequest represents request for flushing the cache of running ctrld.
+type cacheFlushRequest struct {
+	// Domain is the name, which answers, and answers of its subdomains, are flushed.
+	// If empty, the entire cache is flushed.
+	Domain string `json:"domain,omitempty"`
+}
+
+// cacheFlushResponse represents result of flushing the cache.
+type cacheFlushResponse struct {
+	Flushed int    `json:"flushed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleCacheFlush is the control server handler for flushing the cache.
+func (p *prog) handleCacheFlush(w http.ResponseWriter, request *http.Request) {
+	var req cacheFlushRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&cacheFlushResponse{Error: err.Error()})
+		return
+	}
+	n, err := p.flushCache(req.Domain)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&cacheFlushResponse{Error: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&cacheFlushResponse{Flushed: n})
+}
+
+// flushCache removes cached answers of domain and its subdomains, or all cached answers
+// if domain is empty, returning the number of removed entries.
+func (p *prog) flushCache(domain string) (int, error) {
+	c, ok := p.cache.(*dnscache.LRUCache)
+	if !ok {
+		return 0, errCacheDisabled
+	}
+	if domain != "" {
+		if _, ok := dns.IsDomainName(domain); !ok {
+			return 0, fmt.Errorf("invalid domain: %q", domain)
+		}
+	}
+	n := c.Purge(domain)
+	if domain == "" {
+		mainLog.Load().Info().Msgf("flushed %d cached answers", n)
+	} else {
+		mainLog.Load().Info().Msgf("flushed %d cached answers of %s", n, domain)
+	}
+	return n, nil
+}
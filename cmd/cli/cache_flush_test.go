@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+func Test_prog_flushCache(t *testing.T) {
+	p := &prog{cfg: &ctrld.Config{}}
+	_, err := p.flushCache("")
+	assert.ErrorIs(t, err, errCacheDisabled)
+
+	cache, err := dnscache.NewLRUCache(16)
+	require.NoError(t, err)
+	p.cache = cache
+	for _, name := range []string{"example.com.", "www.example.com.", "example.net."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		dnscache.Add(cache, msg, msg, "upstream.0", time.Now().Add(time.Minute))
+	}
+
+	_, err = p.flushCache("invalid..domain")
+	assert.Error(t, err)
+	n, err := p.flushCache("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = p.flushCache("")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
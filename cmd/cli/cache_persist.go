@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"os"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+// defaultCacheFileInterval is the default interval the cache is saved to cache file on.
+const defaultCacheFileInterval = 5 * time.Minute
+
+// loadCacheFile loads answers saved by previous runs of ctrld to c, so popular names are answered
+// from cache right after ctrld (re)started, without waiting for upstreams, which may be slow to
+// bootstrap, like after a router reboot.
+func (p *prog) loadCacheFile(c *dnscache.LRUCache) {
+	path := p.cfg.Service.CacheFile
+	if path == "" {
+		return
+	}
+	// Expired answers are only useful if they could be served.
+	var maxStale time.Duration
+	if p.cfg.Service.CacheServeStale || p.cfg.Service.CacheServeOffline {
+		maxStale = p.offlineMaxStale()
+	}
+	n, err := c.Load(path, maxStale)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			mainLog.Load().Warn().Err(err).Msgf("could not load cache file: %s", path)
+		}
+		return
+	}
+	mainLog.Load().Info().Msgf("loaded %d cached answers from: %s", n, path)
+}
+
+// saveCacheFile saves the cache to cache file, if set.
+func (p *prog) saveCacheFile() {
+	path := p.cfg.Service.CacheFile
+	c, ok := p.cache.(*dnscache.LRUCache)
+	if path == "" || !ok {
+		return
+	}
+	if err := c.Save(path); err != nil {
+		mainLog.Load().Warn().Err(err).Msgf("could not save cache file: %s", path)
+	}
+}
+
+// persistCache saves the cache to cache file every cache_file_interval, until ctrld stops.
+func (p *prog) persistCache() {
+	interval := defaultCacheFileInterval
+	if n := p.cfg.Service.CacheFileInterval; n > 0 {
+		interval = time.Duration(n) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			p.saveCacheFile()
+		}
+	}
+}
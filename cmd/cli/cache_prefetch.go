@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"context"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+const (
+	// defaultCachePrefetchHits is the default number of cache hits for an answer to be prefetched.
+	defaultCachePrefetchHits = 3
+	// defaultCachePrefetchPercent is the default percentage of the TTL remaining, under which
+	// a popular answer is prefetched.
+	defaultCachePrefetchPercent = 10
+)
+
+// prefetchIfPopular records a cache hit of v, the cached answer of req. If prefetching is enabled,
+// and v is popular and about to expire, it is refreshed in background, so next clients do not wait
+// for upstreams when it expires.
+func (p *prog) prefetchIfPopular(ctx context.Context, req *proxyRequest, v *dnscache.Value, now time.Time) {
+	hits := v.Hit()
+	if !p.cfg.Service.CachePrefetch {
+		return
+	}
+	minHits := uint32(defaultCachePrefetchHits)
+	if n := p.cfg.Service.CachePrefetchHits; n > 0 {
+		minHits = uint32(n)
+	}
+	percent := time.Duration(defaultCachePrefetchPercent)
+	if n := p.cfg.Service.CachePrefetchPercent; n > 0 {
+		percent = time.Duration(n)
+	}
+	ttl := time.Duration(ttlFromMsg(v.Msg)) * time.Second
+	if hits < minHits || ttl == 0 || v.Expire.Sub(now)*100 > ttl*percent {
+		return
+	}
+	if !v.StartPrefetch() {
+		return
+	}
+	prefetchReq := *req
+	prefetchReq.msg = req.msg.Copy()
+	prefetchReq.prefetch = true
+	go func() {
+		// The prefetch must complete even if the client request is done.
+		p.proxy(context.WithoutCancel(ctx), &prefetchReq)
+	}()
+}
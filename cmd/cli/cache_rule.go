@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// cacheRules finds the cache rule matching a domain. It is built once from config, so
+// matching a query does not scan and normalize all rule domains.
+//
+// Cache rules are a separate [cache_rule] table, instead of options of policy rules, because
+// cache entries are shared by all listeners and clients. If the options came from the policy
+// matched by the client, TTLs of an entry would depend on which client queried it first.
+type cacheRules struct {
+	exact     map[string]*ctrld.CacheRuleConfig
+	wildcards []cacheRuleWildcard // Ordered by specificity, the most specific first.
+}
+
+// cacheRuleWildcard is a wildcard pattern of a cache rule.
+type cacheRuleWildcard struct {
+	pattern string
+	rule    *ctrld.CacheRuleConfig
+}
+
+// newCacheRules returns cacheRules for cache rules of cfg. Exact domains are preferred to
+// wildcard ones, and longer wildcard patterns to shorter ones. If the same domain, or wildcard
+// patterns of the same length, are in multiple rules, the rule with the lowest number wins.
+func newCacheRules(cfg *ctrld.Config) *cacheRules {
+	keys := make([]string, 0, len(cfg.CacheRule))
+	for key, rule := range cfg.CacheRule {
+		if rule != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return ruleKeyLess(keys[i], keys[j])
+	})
+	cr := &cacheRules{exact: make(map[string]*ctrld.CacheRuleConfig)}
+	for _, key := range keys {
+		rule := cfg.CacheRule[key]
+		for _, pattern := range rule.Domains {
+			pattern = canonicalName(pattern)
+			if strings.Contains(pattern, "*") {
+				cr.wildcards = append(cr.wildcards, cacheRuleWildcard{pattern: pattern, rule: rule})
+				continue
+			}
+			if _, ok := cr.exact[pattern]; !ok {
+				cr.exact[pattern] = rule
+			}
+		}
+	}
+	sort.SliceStable(cr.wildcards, func(i, j int) bool {
+		return len(cr.wildcards[i].pattern) > len(cr.wildcards[j].pattern)
+	})
+	return cr
+}
+
+// match returns the cache rule matching domain, or nil if there is none.
+func (cr *cacheRules) match(domain string) *ctrld.CacheRuleConfig {
+	if cr == nil {
+		return nil
+	}
+	if rule := cr.exact[domain]; rule != nil {
+		return rule
+	}
+	for _, w := range cr.wildcards {
+		if wildcardMatches(w.pattern, domain) {
+			return w.rule
+		}
+	}
+	return nil
+}
+
+// ruleKeyLess reports whether rule key a sorts before b, numerically if both are numbers.
+func ruleKeyLess(a, b string) bool {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return na < nb
+	}
+	return a < b
+}
+
+// cacheRule returns the cache rule matching domain, or nil if there is none.
+func (p *prog) cacheRule(domain string) *ctrld.CacheRuleConfig {
+	return p.cacheRules.match(domain)
+}
+
+// bypassCache reports whether msg must always be forwarded to upstreams, because the cache rule
+// matching its name has no_cache set. Answers of such queries are neither looked up nor cached.
+func (p *prog) bypassCache(msg *dns.Msg) bool {
+	rule := p.cacheRule(canonicalName(msg.Question[0].Name))
+	return rule != nil && rule.NoCache
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_prog_bypassCache(t *testing.T) {
+	p := &prog{cfg: &ctrld.Config{}}
+	p.cfg.CacheRule = map[string]*ctrld.CacheRuleConfig{
+		"0": {Domains: []string{"*.corp.example.com", "DDNS.Example.com."}, NoCache: true},
+		"1": {Domains: []string{"www.corp.example.com"}, MinTTL: 60},
+	}
+	p.cacheRules = newCacheRules(p.cfg)
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"host.corp.example.com.", true},
+		{"ddns.example.com.", true},
+		{"www.corp.example.com.", false},
+		{"example.com.", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			msg := new(dns.Msg)
+			msg.SetQuestion(tc.name, dns.TypeA)
+			assert.Equal(t, tc.want, p.bypassCache(msg))
+		})
+	}
+}
+
+func Test_newCacheRules_order(t *testing.T) {
+	cfg := &ctrld.Config{CacheRule: map[string]*ctrld.CacheRuleConfig{
+		"10": {Domains: []string{"*.example.com", "www.example.com"}, MinTTL: 10},
+		"2":  {Domains: []string{"*.example.com", "WWW.example.com"}, MinTTL: 2},
+		"3":  {Domains: []string{"*.cdn.example.com"}, MinTTL: 3},
+	}}
+	tests := []struct {
+		domain string
+		want   int
+	}{
+		{"www.example.com", 2},
+		{"api.example.com", 2},
+		{"img.cdn.example.com", 3},
+	}
+	// The winner must not depend on map iteration order.
+	for i := 0; i < 10; i++ {
+		cr := newCacheRules(cfg)
+		for _, tc := range tests {
+			rule := cr.match(tc.domain)
+			if assert.NotNil(t, rule, tc.domain) {
+				assert.Equal(t, tc.want, rule.MinTTL, tc.domain)
+			}
+		}
+	}
+	assert.Nil(t, newCacheRules(cfg).match("example.net"))
+}
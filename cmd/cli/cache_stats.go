@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+// cacheStatsRequest represents request for statistics of the cache of running ctrld.
+type cacheStatsRequest struct {
+	// Top is the number of most hit entries to report, none if zero.
+	Top int `json:"top,omitempty"`
+}
+
+// cacheStatsResponse represents statistics of the cache.
+type cacheStatsResponse struct {
+	Stats *dnscache.Stats      `json:"stats,omitempty"`
+	Top   []*dnscache.TopEntry `json:"top,omitempty"`
+	Error string               `json:"error,omitempty"`
+}
+
+// handleCacheStats is the control server handler for reporting cache statistics.
+func (p *prog) handleCacheStats(w http.ResponseWriter, request *http.Request) {
+	var req cacheStatsRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&cacheStatsResponse{Error: err.Error()})
+		return
+	}
+	c, ok := p.cache.(*dnscache.LRUCache)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&cacheStatsResponse{Error: errCacheDisabled.Error()})
+		return
+	}
+	res := &cacheStatsResponse{Stats: c.Stats()}
+	if req.Top > 0 {
+		res.Top = c.Top(req.Top)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// recordCacheLookup records the cache lookup of msg, hit reports whether it was answered from cache.
+func (p *prog) recordCacheLookup(msg *dns.Msg, hit bool) {
+	if c, ok := p.cache.(*dnscache.LRUCache); ok {
+		c.RecordLookup(msg.Question[0].Qtype, hit)
+	}
+}
+
+var (
+	cacheEntriesDesc = prometheus.NewDesc(
+		"ctrld_cache_entries",
+		"Number of cached entries.",
+		[]string{metricsLabelRRType}, nil,
+	)
+	cacheCapacityDesc = prometheus.NewDesc(
+		"ctrld_cache_capacity",
+		"Maximum number of cached entries.",
+		nil, nil,
+	)
+	cacheHitsDesc = prometheus.NewDesc(
+		"ctrld_cache_hits_count",
+		"Total number of queries answered from cache.",
+		[]string{metricsLabelRRType}, nil,
+	)
+	cacheMissesDesc = prometheus.NewDesc(
+		"ctrld_cache_misses_count",
+		"Total number of queries not answered from cache.",
+		[]string{metricsLabelRRType}, nil,
+	)
+	cacheEvictionsDesc = prometheus.NewDesc(
+		"ctrld_cache_evictions_count",
+		"Total number of cached entries removed to make room for new ones.",
+		nil, nil,
+	)
+	cacheBytesDesc = prometheus.NewDesc(
+		"ctrld_cache_bytes",
+		"Estimated memory used by cached entries in bytes.",
+		nil, nil,
+	)
+)
+
+// cacheCollector is a prometheus.Collector reporting statistics of the cache.
+// Statistics are reset when the cache is re-created on reload.
+type cacheCollector struct {
+	p *prog
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheEntriesDesc
+	ch <- cacheCapacityDesc
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheBytesDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	cache, ok := c.p.cache.(*dnscache.LRUCache)
+	if !ok {
+		return
+	}
+	s := cache.Stats()
+	ch <- prometheus.MustNewConstMetric(cacheCapacityDesc, prometheus.GaugeValue, float64(s.Capacity))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(s.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(s.Bytes))
+	for qtype, qs := range s.Qtypes {
+		ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(qs.Entries), qtype)
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(qs.Hits), qtype)
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(qs.Misses), qtype)
+	}
+}
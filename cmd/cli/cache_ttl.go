@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// setCacheHitTTL sets TTLs of answer served from cache, which expires at expiredTime.
+//
+// TTLs are always decremented by the time the answer was cached, and rounded down, so downstream
+// resolvers, which cache the answer again, never keep records longer than the upstream allows.
+// In strict mode, each record keeps its own remaining TTL, and the minimum serve TTL is not applied.
+func (p *prog) setCacheHitTTL(answer *dns.Msg, now, expiredTime time.Time) {
+	if p.cfg.Service.CacheStrictTTL {
+		setStrictCachedAnswerTTL(answer, now, expiredTime)
+		return
+	}
+	if floor := time.Duration(p.cfg.Service.CacheMinServeTTL) * time.Second; expiredTime.Before(now.Add(floor)) {
+		expiredTime = now.Add(floor)
+	}
+	setCachedAnswerTTL(answer, now, expiredTime)
+}
+
+// setStrictCachedAnswerTTL sets TTLs of answer, which was cached with its original TTLs
+// until expiredTime, to their remaining time. Unlike setCachedAnswerTTL, records are not
+// set to the same TTL, each of them is decremented by the time elapsed since caching.
+func setStrictCachedAnswerTTL(answer *dns.Msg, now, expiredTime time.Time) {
+	remaining := max(int64(expiredTime.Sub(now)/time.Second), 0)
+	elapsed := max(int64(ttlFromMsg(answer))-remaining, 0)
+	forEachTTLRecord(answer, func(rr dns.RR) {
+		rr.Header().Ttl = uint32(max(int64(rr.Header().Ttl)-elapsed, 0))
+	})
+}
+
+// capAnswerTTL lowers TTLs of answer which are greater than maxTTL.
+func capAnswerTTL(answer *dns.Msg, maxTTL time.Duration) {
+	limit := uint32(maxTTL.Seconds())
+	forEachTTLRecord(answer, func(rr dns.RR) {
+		rr.Header().Ttl = min(rr.Header().Ttl, limit)
+	})
+}
+
+// forEachTTLRecord calls f for all records of answer, except OPT, whose TTL field is not a TTL.
+func forEachTTLRecord(answer *dns.Msg, f func(rr dns.RR)) {
+	for _, rrs := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				f(rr)
+			}
+		}
+	}
+}
+
+// isNegativeAnswer reports whether answer is a negative answer, NXDOMAIN or NODATA, see RFC 2308.
+func isNegativeAnswer(answer *dns.Msg) bool {
+	switch answer.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(answer.Answer) == 0
+	}
+	return false
+}
+
+// negativeTTL returns the TTL of negative answer, which is the minimum of the SOA record TTL
+// and its MINIMUM field, see RFC 2308, section 5. Without SOA record, it is the minimum TTL
+// of records in authority section.
+func negativeTTL(answer *dns.Msg) uint32 {
+	for _, rr := range answer.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	ttl, _ := minTTL(answer.Ns)
+	return ttl
+}
+
+// cacheNegativeAnswer reports whether negative answer of query could be cached, and if so,
+// caps its TTLs to cache_max_negative_ttl, so the cached answer and the one sent to the
+// client agree. Names matching cache_no_negative_domains are never negatively cached,
+// for records which are created right after the first lookup.
+func (p *prog) cacheNegativeAnswer(query, answer *dns.Msg) bool {
+	if !isNegativeAnswer(answer) {
+		return true
+	}
+	domain := canonicalName(query.Question[0].Name)
+	for _, pattern := range p.cfg.Service.CacheNoNegativeDomains {
+		pattern = canonicalName(pattern)
+		if pattern == domain || wildcardMatches(pattern, domain) {
+			return false
+		}
+	}
+	if n := p.cfg.Service.CacheMaxNegativeTTL; n > 0 {
+		capAnswerTTL(answer, time.Duration(n)*time.Second)
+	}
+	return true
+}
+
+// clampAnswerTTL raises TTLs of positive answer of query lower than cache_min_ttl, and lowers
+// those greater than cache_max_ttl, or the limits of the cache rule matching query name.
+// The answer is clamped before caching, so the cached answer and the one sent to the client
+// agree. Negative answers are left to cacheNegativeAnswer.
+func (p *prog) clampAnswerTTL(query, answer *dns.Msg) {
+	if isNegativeAnswer(answer) {
+		return
+	}
+	floor, ceiling := p.ttlLimits(query)
+	if floor == 0 && ceiling == 0 {
+		return
+	}
+	forEachTTLRecord(answer, func(rr dns.RR) {
+		rr.Header().Ttl = clampTTL(rr.Header().Ttl, floor, ceiling)
+	})
+}
+
+// cacheTTLOverride returns cache_ttl_override for answer of query, clamped to the TTL limits
+// of clampAnswerTTL, so cache_min_ttl, cache_max_ttl and cache rules still apply to it.
+// It returns 0 if cache_ttl_override is not set.
+func (p *prog) cacheTTLOverride(query, answer *dns.Msg) int {
+	ttl := p.cfg.Service.CacheTTLOverride
+	if ttl <= 0 || isNegativeAnswer(answer) {
+		return max(ttl, 0)
+	}
+	floor, ceiling := p.ttlLimits(query)
+	return int(clampTTL(uint32(ttl), floor, ceiling))
+}
+
+// ttlLimits returns the minimum and maximum TTLs of positive answers of query, from the cache
+// rule matching query name, or cache_min_ttl and cache_max_ttl. Zero means no limit.
+func (p *prog) ttlLimits(query *dns.Msg) (floor, ceiling int) {
+	floor, ceiling = p.cfg.Service.CacheMinTTL, p.cfg.Service.CacheMaxTTL
+	if rule := p.cacheRule(canonicalName(query.Question[0].Name)); rule != nil {
+		if rule.MinTTL > 0 {
+			floor = rule.MinTTL
+		}
+		if rule.MaxTTL > 0 {
+			ceiling = rule.MaxTTL
+		}
+	}
+	return floor, ceiling
+}
+
+// clampTTL raises ttl to floor, then lowers it to ceiling if ceiling is positive.
+func clampTTL(ttl uint32, floor, ceiling int) uint32 {
+	ttl = max(ttl, uint32(floor))
+	if ceiling > 0 {
+		ttl = min(ttl, uint32(ceiling))
+	}
+	return ttl
+}
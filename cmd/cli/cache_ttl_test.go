@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func newTTLAnswer(t *testing.T, rrs ...string) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		answer.Answer = append(answer.Answer, rr)
+	}
+	answer.SetEdns0(4096, false)
+	return answer
+}
+
+func answerTTLs(answer *dns.Msg) []uint32 {
+	var ttls []uint32
+	for _, rr := range answer.Answer {
+		ttls = append(ttls, rr.Header().Ttl)
+	}
+	return ttls
+}
+
+func Test_setStrictCachedAnswerTTL(t *testing.T) {
+	answer := newTTLAnswer(t,
+		"www.example.com. 300 IN CNAME example.com.",
+		"example.com. 100 IN A 192.0.2.1",
+	)
+	cachedAt := time.Now()
+	expired := cachedAt.Add(100 * time.Second)
+	setStrictCachedAnswerTTL(answer, cachedAt.Add(30500*time.Millisecond), expired)
+	// Partial seconds are counted as elapsed, so TTLs are never extended.
+	assert.Equal(t, []uint32{269, 69}, answerTTLs(answer))
+	assert.Equal(t, uint32(0), answer.IsEdns0().Hdr.Ttl)
+
+	answer = newTTLAnswer(t, "example.com. 100 IN A 192.0.2.1")
+	setStrictCachedAnswerTTL(answer, expired.Add(time.Second), expired)
+	assert.Equal(t, []uint32{0}, answerTTLs(answer))
+}
+
+func Test_prog_setCacheHitTTL(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		minTTL   int
+		strict   bool
+		remained time.Duration
+		want     []uint32
+	}{
+		{"decremented", 0, false, 2500 * time.Millisecond, []uint32{2, 2}},
+		{"expired", 0, false, -time.Second, []uint32{0, 0}},
+		{"min serve ttl", 5, false, 2500 * time.Millisecond, []uint32{5, 5}},
+		{"min serve ttl not applied", 5, false, 60 * time.Second, []uint32{60, 60}},
+		{"strict ignores min serve ttl", 5, true, 2500 * time.Millisecond, []uint32{202, 2}},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := &prog{cfg: &ctrld.Config{}}
+			p.cfg.Service.CacheMinServeTTL = tc.minTTL
+			p.cfg.Service.CacheStrictTTL = tc.strict
+			answer := newTTLAnswer(t,
+				"www.example.com. 300 IN CNAME example.com.",
+				"example.com. 100 IN A 192.0.2.1",
+			)
+			p.setCacheHitTTL(answer, now, now.Add(tc.remained))
+			assert.Equal(t, tc.want, answerTTLs(answer))
+		})
+	}
+}
+
+func Test_capAnswerTTL(t *testing.T) {
+	answer := newTTLAnswer(t,
+		"www.example.com. 300 IN CNAME example.com.",
+		"example.com. 5 IN A 192.0.2.1",
+	)
+	capAnswerTTL(answer, outageTTL)
+	assert.Equal(t, []uint32{10, 5}, answerTTLs(answer))
+}
+
+func newNegativeAnswer(t *testing.T, rcode int, soa string) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion("new.example.com.", dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetRcode(msg, rcode)
+	if soa != "" {
+		rr, err := dns.NewRR(soa)
+		require.NoError(t, err)
+		answer.Ns = append(answer.Ns, rr)
+	}
+	return answer
+}
+
+func Test_negativeTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		soa  string
+		want uint32
+	}{
+		{"soa minimum", "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300", 300},
+		{"soa ttl", "example.com. 60 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300", 60},
+		{"no soa", "", 0},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			answer := newNegativeAnswer(t, dns.RcodeNameError, tc.soa)
+			assert.Equal(t, tc.want, negativeTTL(answer))
+		})
+	}
+}
+
+func Test_prog_cacheNegativeAnswer(t *testing.T) {
+	const soa = "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300"
+	p := &prog{cfg: &ctrld.Config{}}
+	p.cfg.Service.CacheMaxNegativeTTL = 30
+	p.cfg.Service.CacheNoNegativeDomains = []string{"*.dyn.example.com", "Fresh.Example.com."}
+
+	nxdomain := newNegativeAnswer(t, dns.RcodeNameError, soa)
+	query := new(dns.Msg)
+	query.SetQuestion("new.example.com.", dns.TypeA)
+	assert.True(t, p.cacheNegativeAnswer(query, nxdomain))
+	assert.Equal(t, uint32(30), ttlFromMsg(nxdomain))
+
+	nodata := newNegativeAnswer(t, dns.RcodeSuccess, soa)
+	for _, name := range []string{"host.dyn.example.com.", "fresh.example.com."} {
+		query.SetQuestion(name, dns.TypeAAAA)
+		assert.False(t, p.cacheNegativeAnswer(query, nodata), name)
+	}
+
+	positive := newTTLAnswer(t, "example.com. 3600 IN A 192.0.2.1")
+	query.SetQuestion("fresh.example.com.", dns.TypeA)
+	assert.True(t, p.cacheNegativeAnswer(query, positive))
+	assert.Equal(t, []uint32{3600}, answerTTLs(positive))
+}
+
+func Test_prog_clampAnswerTTL(t *testing.T) {
+	p := &prog{cfg: &ctrld.Config{}}
+	p.cfg.Service.CacheMinTTL = 30
+	p.cfg.Service.CacheMaxTTL = 3600
+	p.cfg.CacheRule = map[string]*ctrld.CacheRuleConfig{
+		"0": {Domains: []string{"*.example.com"}, MaxTTL: 600},
+		"1": {Domains: []string{"*.cdn.example.com", "Static.Example.com."}, MinTTL: 300},
+	}
+	p.cacheRules = newCacheRules(p.cfg)
+	tests := []struct {
+		name  string
+		qname string
+		rrs   []string
+		want  []uint32
+	}{
+		{"global", "example.net.", []string{"example.net. 5 IN A 192.0.2.1", "example.net. 86400 IN A 192.0.2.2"}, []uint32{30, 3600}},
+		{"rule max ttl", "www.example.com.", []string{"www.example.com. 5 IN A 192.0.2.1", "www.example.com. 86400 IN A 192.0.2.2"}, []uint32{30, 600}},
+		{"longest wildcard", "img.cdn.example.com.", []string{"img.cdn.example.com. 20 IN A 192.0.2.1"}, []uint32{300}},
+		{"exact match", "static.example.com.", []string{"static.example.com. 86400 IN A 192.0.2.1"}, []uint32{3600}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			query := new(dns.Msg)
+			query.SetQuestion(tc.qname, dns.TypeA)
+			answer := newTTLAnswer(t, tc.rrs...)
+			p.clampAnswerTTL(query, answer)
+			assert.Equal(t, tc.want, answerTTLs(answer))
+			assert.Equal(t, uint32(0), answer.IsEdns0().Hdr.Ttl)
+		})
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("new.example.com.", dns.TypeA)
+	nxdomain := newNegativeAnswer(t, dns.RcodeNameError, "example.com. 5 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 5")
+	p.clampAnswerTTL(query, nxdomain)
+	assert.Equal(t, uint32(5), ttlFromMsg(nxdomain))
+}
+
+func Test_prog_cacheTTLOverride(t *testing.T) {
+	p := &prog{cfg: &ctrld.Config{}}
+	p.cfg.Service.CacheMinTTL = 30
+	p.cfg.Service.CacheMaxTTL = 3600
+	p.cfg.CacheRule = map[string]*ctrld.CacheRuleConfig{
+		"0": {Domains: []string{"*.example.com"}, MaxTTL: 600},
+	}
+	p.cacheRules = newCacheRules(p.cfg)
+	tests := []struct {
+		name     string
+		override int
+		qname    string
+		want     int
+	}{
+		{"not set", 0, "example.net.", 0},
+		{"within limits", 300, "example.net.", 300},
+		{"below min ttl", 10, "example.net.", 30},
+		{"above max ttl", 86400, "example.net.", 3600},
+		{"above rule max ttl", 3600, "www.example.com.", 600},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p.cfg.Service.CacheTTLOverride = tc.override
+			query := new(dns.Msg)
+			query.SetQuestion(tc.qname, dns.TypeA)
+			answer := newTTLAnswer(t, tc.qname+" 5 IN A 192.0.2.1")
+			assert.Equal(t, tc.want, p.cacheTTLOverride(query, answer))
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultCircuitBreakerCooldown is the time a circuit stays open, if not configured.
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops queries to an upstream after consecutive failures, so clients do not
+// wait for the upstream timeout on every query while it is down.
+//
+// The circuit opens after maxFailures consecutive failed queries. While open, queries are
+// not sent to the upstream. After cooldown, the circuit becomes half-open, and a single query
+// is let through as probe: the circuit closes if it succeeds, or opens again if it fails.
+// If the probe result is never recorded, another probe is let through after cooldown.
+type circuitBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time // Time of opening the circuit, or letting the last probe through.
+}
+
+func newCircuitBreaker(maxFailures int, cooldown time.Duration) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{maxFailures: maxFailures, cooldown: cooldown}
+}
+
+// currentState returns the circuit state.
+func (cb *circuitBreaker) currentState() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// allow reports whether a query could be sent to the upstream at the given time.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitClosed {
+		return true
+	}
+	if now.Sub(cb.openedAt) < cb.cooldown {
+		return false
+	}
+	cb.state = circuitHalfOpen
+	cb.openedAt = now
+	return true
+}
+
+// isOpen reports whether queries to the upstream are stopped at the given time. Unlike allow,
+// it does not let a probe through, so it could be used for choosing upstreams to query.
+func (cb *circuitBreaker) isOpen(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state != circuitClosed && now.Sub(cb.openedAt) < cb.cooldown
+}
+
+// record records the result of a query sent to the upstream at the given time,
+// and reports the new circuit state, and whether it was changed.
+func (cb *circuitBreaker) record(succeeded bool, now time.Time) (circuitState, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	old := cb.state
+	switch {
+	case succeeded:
+		cb.failures = 0
+		cb.state = circuitClosed
+	case cb.state == circuitHalfOpen:
+		cb.state = circuitOpen
+		cb.openedAt = now
+	case cb.state == circuitClosed:
+		cb.failures++
+		if cb.failures >= cb.maxFailures {
+			cb.state = circuitOpen
+			cb.openedAt = now
+		}
+	}
+	return cb.state, cb.state != old
+}
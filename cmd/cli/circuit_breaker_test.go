@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_circuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker(3, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		cb.record(false, now)
+	}
+	cb.record(true, now)
+	if state, _ := cb.record(false, now); state != circuitClosed {
+		t.Fatalf("success must reset failures count, got state: %s", state)
+	}
+	cb.record(false, now)
+	if state, changed := cb.record(false, now); state != circuitOpen || !changed {
+		t.Fatalf("circuit must be opened after 3 consecutive failures, got state: %s", state)
+	}
+	if cb.allow(now.Add(time.Second)) {
+		t.Fatal("query must not be allowed while circuit is open")
+	}
+
+	// Half-open, only one probe is allowed per cooldown.
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if cb.isOpen(now) {
+			t.Fatal("circuit must not be reported open after cooldown")
+		}
+	}
+	if !cb.allow(now) {
+		t.Fatal("probe must be allowed after cooldown")
+	}
+	if cb.allow(now.Add(time.Second)) {
+		t.Fatal("only one probe must be allowed")
+	}
+	if state, _ := cb.record(false, now); state != circuitOpen {
+		t.Fatalf("failed probe must open the circuit, got state: %s", state)
+	}
+	if cb.allow(now.Add(time.Second)) {
+		t.Fatal("query must not be allowed before next cooldown")
+	}
+	if !cb.isOpen(now.Add(time.Second)) {
+		t.Fatal("circuit must be reported open before next cooldown")
+	}
+
+	now = now.Add(time.Minute)
+	if !cb.allow(now) {
+		t.Fatal("probe must be allowed after cooldown")
+	}
+	if state, changed := cb.record(true, now); state != circuitClosed || !changed {
+		t.Fatalf("successful probe must close the circuit, got state: %s", state)
+	}
+	if !cb.allow(now) {
+		t.Fatal("query must be allowed when circuit is closed")
+	}
+}
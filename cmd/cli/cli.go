@@ -485,6 +485,9 @@ func initCLI() {
 				mainLog.Load().Fatal().Err(err).Msg("failed to send reload signal to ctrld")
 			}
 			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+				printReloadDiff(resp.Body)
+			}
 			switch resp.StatusCode {
 			case http.StatusOK:
 				mainLog.Load().Notice().Msg("Service reloaded")
@@ -534,6 +537,7 @@ func initCLI() {
 				os.Exit(2)
 			case service.StatusRunning:
 				mainLog.Load().Notice().Msg("Service is running")
+				printUpstreamsStatus()
 				os.Exit(0)
 			case service.StatusStopped:
 				mainLog.Load().Notice().Msg("Service is stopped")
@@ -743,6 +747,7 @@ NOTE: Uninstalling will set DNS to values provided by DHCP.`,
 	uninstallCmdAlias.Flags().AddFlagSet(stopCmd.Flags())
 	rootCmd.AddCommand(uninstallCmdAlias)
 
+	var listClientsJSON bool
 	listClientsCmd := &cobra.Command{
 		Use:   "list",
 		Short: "List clients that ctrld discovered",
@@ -767,6 +772,12 @@ NOTE: Uninstalling will set DNS to values provided by DHCP.`,
 			if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
 				mainLog.Load().Fatal().Err(err).Msg("failed to decode clients list result")
 			}
+			if listClientsJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				_ = enc.Encode(clients)
+				return
+			}
 			map2Slice := func(m map[string]struct{}) []string {
 				s := make([]string, 0, len(m))
 				for k := range m {
@@ -788,7 +799,11 @@ NOTE: Uninstalling will set DNS to values provided by DHCP.`,
 					c.IP.String(),
 					c.Hostname,
 					c.Mac,
+					c.DeviceClass,
 					strings.Join(map2Slice(c.Source), ","),
+					fmtLastQuery(c.LastQuery),
+					c.Listener,
+					c.Policy,
 				}
 				if withQueryCount {
 					row = append(row, strconv.FormatInt(c.QueryCount, 10))
@@ -796,7 +811,7 @@ NOTE: Uninstalling will set DNS to values provided by DHCP.`,
 				data[i] = row
 			}
 			table := tablewriter.NewWriter(os.Stdout)
-			headers := []string{"IP", "Hostname", "Mac", "Discovered"}
+			headers := []string{"IP", "Hostname", "Mac", "Device", "Discovered", "Last Query", "Listener", "Policy"}
 			if withQueryCount {
 				headers = append(headers, "Queries")
 			}
@@ -806,6 +821,7 @@ NOTE: Uninstalling will set DNS to values provided by DHCP.`,
 			table.Render()
 		},
 	}
+	listClientsCmd.Flags().BoolVarP(&listClientsJSON, "json", "", false, "Print clients in JSON format")
 	clientsCmd := &cobra.Command{
 		Use:   "clients",
 		Short: "Manage clients",
@@ -816,6 +832,601 @@ NOTE: Uninstalling will set DNS to values provided by DHCP.`,
 	}
 	clientsCmd.AddCommand(listClientsCmd)
 	rootCmd.AddCommand(clientsCmd)
+
+	useProfileCmd := &cobra.Command{
+		Use:   "use <resolver_id>",
+		Short: "Switch the active Control D profile",
+		Long: `Switch the active Control D profile of running ctrld to the one with given resolver id.
+
+The resolver id is validated against Control D API first. Without --cd mode, all Control D
+upstreams in config file are updated to use the new profile. In --cd mode, the new profile
+is only used until ctrld is restarted.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			data, _ := json.Marshal(&profileRequest{ID: args[0]})
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(profilePath, bytes.NewReader(data))
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to send profile request to ctrld")
+			}
+			defer resp.Body.Close()
+			var res profileResponse
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				mainLog.Load().Fatal().Err(err).Msgf("failed to decode profile response, status: %s", resp.Status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				mainLog.Load().Fatal().Msgf("failed to switch profile: %s", res.Error)
+			}
+			mainLog.Load().Notice().Msgf("Switched to profile %s, upstreams: %s", args[0], strings.Join(res.Upstreams, ", "))
+			if !res.Persistent {
+				mainLog.Load().Warn().Msg("Profile will be reverted after ctrld restarted, re-install ctrld with new --cd value to make it permanent")
+			}
+		},
+	}
+	profileCmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Manage Control D profile",
+		Args:  cobra.OnlyValidArgs,
+		ValidArgs: []string{
+			useProfileCmd.Use,
+		},
+	}
+	profileCmd.AddCommand(useProfileCmd)
+	rootCmd.AddCommand(profileCmd)
+
+	var rulesDryRun bool
+	applyRulesCmd := &cobra.Command{
+		Use:   "apply <file>",
+		Short: "Apply a batch of policy rule edits",
+		Long: `Apply a batch of policy rule edits to running ctrld, all-or-nothing.
+
+The file is a JSON object with list of operations, use "-" to read from stdin:
+
+  {"ops": [
+    {"op": "set", "listener": "0", "kind": "rules", "key": "*.example.com", "upstreams": ["upstream.1"]},
+    {"op": "delete", "listener": "0", "kind": "macs", "key": "14:54:4a:8e:08:2d"}
+  ]}
+
+The kind is one of "rules", "networks", "macs", "tags". If any operation is invalid,
+or the resulting config is invalid, nothing is applied.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			r := os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					mainLog.Load().Fatal().Err(err).Msg("failed to open rules file")
+				}
+				defer f.Close()
+				r = f
+			}
+			var req rulesRequest
+			if err := json.NewDecoder(r).Decode(&req); err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to decode rules file")
+			}
+			req.DryRun = rulesDryRun
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			data, _ := json.Marshal(&req)
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(rulesPath, bytes.NewReader(data))
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to send rules request to ctrld")
+			}
+			defer resp.Body.Close()
+			var res rulesResponse
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				mainLog.Load().Fatal().Err(err).Msgf("failed to decode rules response, status: %s", resp.Status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				mainLog.Load().Fatal().Msgf("failed to apply rules, nothing changed: %s", res.Error)
+			}
+			if res.Diff != nil {
+				for _, line := range res.Diff.lines() {
+					mainLog.Load().Notice().Msg(line)
+				}
+			}
+			if rulesDryRun {
+				mainLog.Load().Notice().Msg("Rules are valid, nothing applied (dry run)")
+				return
+			}
+			mainLog.Load().Notice().Msgf("Applied %d rule operations", len(req.Ops))
+		},
+	}
+	applyRulesCmd.Flags().BoolVarP(&rulesDryRun, "dry-run", "", false, "Only validate the edits and show the changes")
+	rulesCmd := &cobra.Command{
+		Use:   "rules",
+		Short: "Manage policy rules",
+		Args:  cobra.OnlyValidArgs,
+		ValidArgs: []string{
+			applyRulesCmd.Use,
+		},
+	}
+	rulesCmd.AddCommand(applyRulesCmd)
+	rootCmd.AddCommand(rulesCmd)
+
+	renderConfigCmd := &cobra.Command{
+		Use:   "render",
+		Short: "Print the effective config",
+		Long: `Print the effective config in canonical TOML form.
+
+By default, the config which running ctrld is using is printed, including config fetched
+from Control D API in --cd mode, and changes applied by reloads. With --config, the given
+config file is rendered instead, without running ctrld.
+
+The output is deterministic: tables are sorted by keys, fields are always in the same order,
+and options which are not set are omitted, so it could be diffed against the intended state.`,
+		Example: `  ctrld config render > live.toml && ctrld config render --config intended.toml | diff live.toml -`,
+		Args:    cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if configPath != "" {
+				newCfg, _, err := loadConfigFile()
+				if err != nil {
+					mainLog.Load().Fatal().Err(err).Msg("failed to load config file")
+				}
+				if err := validateConfig(newCfg); err != nil {
+					mainLog.Load().Fatal().Err(err).Msg("invalid config file")
+				}
+				data, err := renderConfig(newCfg)
+				if err != nil {
+					mainLog.Load().Fatal().Err(err).Msg("failed to render config")
+				}
+				_, _ = os.Stdout.Write(data)
+				return
+			}
+			checkHasElevatedPrivilege()
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(configRenderPath, nil)
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to send config render request to ctrld")
+			}
+			defer resp.Body.Close()
+			var res configRenderResponse
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				mainLog.Load().Fatal().Err(err).Msgf("failed to decode config render response, status: %s", resp.Status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				mainLog.Load().Fatal().Msgf("failed to render config: %s", res.Error)
+			}
+			_, _ = os.Stdout.WriteString(res.Config)
+		},
+	}
+	renderConfigCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file to render instead of the running config")
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage config",
+		Args:  cobra.OnlyValidArgs,
+		ValidArgs: []string{
+			renderConfigCmd.Use,
+		},
+	}
+	configCmd.AddCommand(renderConfigCmd)
+	rootCmd.AddCommand(configCmd)
+
+	flushCacheCmd := &cobra.Command{
+		Use:   "flush [domain]",
+		Short: "Flush cached answers",
+		Long: `Flush cached answers of running ctrld.
+
+Without domain, the entire cache is flushed. Otherwise, only answers of the domain
+and its subdomains are flushed, e.g: "example.com" flushes "www.example.com" too.`,
+		Args: cobra.MaximumNArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var req cacheFlushRequest
+			if len(args) > 0 {
+				req.Domain = args[0]
+			}
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			data, _ := json.Marshal(&req)
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(cacheFlushPath, bytes.NewReader(data))
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to send cache flush request to ctrld")
+			}
+			defer resp.Body.Close()
+			var res cacheFlushResponse
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				mainLog.Load().Fatal().Err(err).Msgf("failed to decode cache flush response, status: %s", resp.Status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				mainLog.Load().Fatal().Msgf("failed to flush cache: %s", res.Error)
+			}
+			mainLog.Load().Notice().Msgf("Flushed %d cached answers", res.Flushed)
+		},
+	}
+	var (
+		cacheStatsJSON bool
+		cacheStatsReq  cacheStatsRequest
+	)
+	statsCacheCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show cache statistics",
+		Long: `Show statistics of the cache of running ctrld: number of entries, hit ratio,
+evictions and estimated memory usage, per query type. Use --top to also list the
+most hit entries, for sizing the cache on memory constrained routers.
+
+Statistics are reset when ctrld restarts or reloads its config.`,
+		Example: `  ctrld cache stats --top 20`,
+		Args:    cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			data, _ := json.Marshal(&cacheStatsReq)
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(cacheStatsPath, bytes.NewReader(data))
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to send cache stats request to ctrld")
+			}
+			defer resp.Body.Close()
+			var res cacheStatsResponse
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				mainLog.Load().Fatal().Err(err).Msgf("failed to decode cache stats response, status: %s", resp.Status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				mainLog.Load().Fatal().Msgf("failed to get cache stats: %s", res.Error)
+			}
+			if cacheStatsJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				_ = enc.Encode(&res)
+				return
+			}
+			s := res.Stats
+			fmt.Printf("Entries:   %d/%d\n", s.Entries, s.Capacity)
+			fmt.Printf("Hit ratio: %.2f%% (%d hits, %d misses)\n", s.HitRatio()*100, s.Hits, s.Misses)
+			fmt.Printf("Evictions: %d\n", s.Evictions)
+			fmt.Printf("Memory:    ~%d KiB\n", s.Bytes/1024)
+			qtypes := make([]string, 0, len(s.Qtypes))
+			for qtype := range s.Qtypes {
+				qtypes = append(qtypes, qtype)
+			}
+			sort.Strings(qtypes)
+			rows := make([][]string, len(qtypes))
+			for i, qtype := range qtypes {
+				qs := s.Qtypes[qtype]
+				rows[i] = []string{qtype, strconv.Itoa(qs.Entries), strconv.FormatUint(qs.Hits, 10), strconv.FormatUint(qs.Misses, 10)}
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Type", "Entries", "Hits", "Misses"})
+			table.SetAutoFormatHeaders(false)
+			table.AppendBulk(rows)
+			table.Render()
+			if len(res.Top) == 0 {
+				return
+			}
+			rows = make([][]string, len(res.Top))
+			for i, e := range res.Top {
+				rows[i] = []string{e.Name, e.Qtype, e.Upstream, e.Subnet, strconv.FormatUint(uint64(e.Hits), 10), strconv.FormatInt(e.TTL, 10)}
+			}
+			table = tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Name", "Type", "Upstream", "Subnet", "Hits", "TTL"})
+			table.SetAutoFormatHeaders(false)
+			table.AppendBulk(rows)
+			table.Render()
+		},
+	}
+	statsCacheCmd.Flags().IntVarP(&cacheStatsReq.Top, "top", "", 0, "Number of most hit entries to list")
+	statsCacheCmd.Flags().BoolVarP(&cacheStatsJSON, "json", "", false, "Print statistics in JSON format")
+	var (
+		cachePinFor  time.Duration
+		cachePinJSON bool
+		cachePinReq  cachePinRequest
+	)
+	pinCacheCmd := &cobra.Command{
+		Use:   "pin [domain]",
+		Short: "Pin current answers of a domain",
+		Long: `Pin current answers of a domain in running ctrld for a fixed duration.
+
+Until the pin expires or the domain is unpinned, queries for the domain are answered
+with the pinned answers, ignoring upstream changes. This keeps the LAN stable while
+the DNS of a provider is flapping. Answers are resolved like queries sent to the
+listener, so existing policies and cached answers apply. Only queries routed to the
+same upstreams are answered with the pinned answers.
+
+Without domain, current pins are listed.`,
+		Example: `  ctrld cache pin api.example.com --for 2h
+  ctrld cache pin example.com --type A --type MX --for 30m
+  ctrld cache pin`,
+		Args: cobra.MaximumNArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				cachePinReq.Domain = args[0]
+				cachePinReq.Duration = int(cachePinFor.Seconds())
+			}
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			data, _ := json.Marshal(&cachePinReq)
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(cachePinPath, bytes.NewReader(data))
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to send cache pin request to ctrld")
+			}
+			defer resp.Body.Close()
+			var res cachePinResponse
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				mainLog.Load().Fatal().Err(err).Msgf("failed to decode cache pin response, status: %s", resp.Status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				mainLog.Load().Fatal().Msgf("failed to pin answers: %s", res.Error)
+			}
+			if cachePinJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				_ = enc.Encode(&res)
+				return
+			}
+			if len(res.Pins) == 0 {
+				mainLog.Load().Notice().Msg("No pinned answers")
+				return
+			}
+			rows := make([][]string, len(res.Pins))
+			for i, pin := range res.Pins {
+				rows[i] = []string{pin.Domain, pin.Type, strings.Join(pin.Upstreams, ","), pin.Rcode, strings.Join(pin.Answers, "\n"), pin.Expire.Local().Format(time.DateTime)}
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Domain", "Type", "Upstreams", "Rcode", "Answers", "Expire"})
+			table.SetAutoFormatHeaders(false)
+			table.SetAutoWrapText(false)
+			table.AppendBulk(rows)
+			table.Render()
+		},
+	}
+	pinCacheCmd.Flags().DurationVarP(&cachePinFor, "for", "", time.Hour, "Duration which answers are pinned for")
+	pinCacheCmd.Flags().StringSliceVarP(&cachePinReq.Types, "type", "", nil, "Query types to pin answers for (default A and AAAA)")
+	pinCacheCmd.Flags().StringVarP(&cachePinReq.Listener, "listener", "", "0", "Listener number which policies are used for resolving answers")
+	pinCacheCmd.Flags().StringVarP(&cachePinReq.ClientIP, "client-ip", "", "", "Client IP address which answers are resolved for (default 127.0.0.1)")
+	pinCacheCmd.Flags().StringVarP(&cachePinReq.Mac, "mac", "", "", "Client MAC address which answers are resolved for")
+	pinCacheCmd.Flags().BoolVarP(&cachePinJSON, "json", "", false, "Print pins in JSON format")
+	unpinCacheCmd := &cobra.Command{
+		Use:   "unpin [domain]",
+		Short: "Unpin answers",
+		Long: `Unpin answers of running ctrld, so queries are resolved again.
+
+Without domain, all answers are unpinned. Otherwise, only answers of the domain
+and its subdomains are unpinned.`,
+		Args: cobra.MaximumNArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			var req cacheUnpinRequest
+			if len(args) > 0 {
+				req.Domain = args[0]
+			}
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			data, _ := json.Marshal(&req)
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			resp, err := cc.post(cacheUnpinPath, bytes.NewReader(data))
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to send cache unpin request to ctrld")
+			}
+			defer resp.Body.Close()
+			var res cacheUnpinResponse
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				mainLog.Load().Fatal().Err(err).Msgf("failed to decode cache unpin response, status: %s", resp.Status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				mainLog.Load().Fatal().Msgf("failed to unpin answers: %s", res.Error)
+			}
+			mainLog.Load().Notice().Msgf("Unpinned %d answers", res.Unpinned)
+		},
+	}
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage DNS cache",
+		Args:  cobra.OnlyValidArgs,
+		ValidArgs: []string{
+			flushCacheCmd.Use,
+			statsCacheCmd.Use,
+			pinCacheCmd.Use,
+			unpinCacheCmd.Use,
+		},
+	}
+	cacheCmd.AddCommand(flushCacheCmd)
+	cacheCmd.AddCommand(statsCacheCmd)
+	cacheCmd.AddCommand(pinCacheCmd)
+	cacheCmd.AddCommand(unpinCacheCmd)
+	rootCmd.AddCommand(cacheCmd)
+
+	var (
+		testListJSON bool
+		testListTmpl testListRequest
+	)
+	testListCmd := &cobra.Command{
+		Use:   "test-list <file>",
+		Short: "Test a list of domains against running ctrld",
+		Long: `Test a list of domains against the policies and upstreams of running ctrld.
+
+The file contains one domain per line, hosts file format is also accepted. Use "-"
+to read from stdin. Each domain is resolved as an A query, as if it was sent from
+--client-ip to --listener, then its disposition is reported:
+
+  allowed   resolved normally
+  blocked   resolved to unspecified/loopback IP, or refused
+  nxdomain  domain does not exist
+  error     query failed
+  untested  only the policy was evaluated (--no-resolve)`,
+		Example: `  ctrld test-list ./allowlist.txt --client-ip 192.168.1.10`,
+		Args:    cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+			checkHasElevatedPrivilege()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			r := os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					mainLog.Load().Fatal().Err(err).Msg("failed to open domains list")
+				}
+				defer f.Close()
+				r = f
+			}
+			domains, err := readDomainList(r)
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to read domains list")
+			}
+			if len(domains) == 0 {
+				mainLog.Load().Fatal().Msg("no domain found in list")
+			}
+			dir, err := socketDir()
+			if err != nil {
+				mainLog.Load().Fatal().Err(err).Msg("failed to find ctrld home dir")
+			}
+			cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+			var results []*testListResult
+			for _, req := range newTestListRequests(testListTmpl, domains) {
+				data, _ := json.Marshal(req)
+				resp, err := cc.post(testListPath, bytes.NewReader(data))
+				if err != nil {
+					mainLog.Load().Fatal().Err(err).Msg("failed to send test list request to ctrld")
+				}
+				var res testListResponse
+				err = json.NewDecoder(resp.Body).Decode(&res)
+				resp.Body.Close()
+				if err != nil {
+					mainLog.Load().Fatal().Err(err).Msgf("failed to decode test list response, status: %s", resp.Status)
+				}
+				if resp.StatusCode != http.StatusOK {
+					mainLog.Load().Fatal().Msgf("failed to test list: %s", res.Error)
+				}
+				results = append(results, res.Results...)
+			}
+			if testListJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				_ = enc.Encode(results)
+				return
+			}
+			counts := make(map[string]int)
+			data := make([][]string, len(results))
+			for i, res := range results {
+				counts[res.Disposition]++
+				data[i] = []string{
+					res.Domain,
+					res.Disposition,
+					res.Policy,
+					strings.Join(res.Upstreams, ","),
+					res.Upstream,
+					strings.Join(res.Answers, ","),
+				}
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Domain", "Disposition", "Policy", "Upstreams", "Answered By", "Answers"})
+			table.SetAutoFormatHeaders(false)
+			table.AppendBulk(data)
+			table.Render()
+			summary := make([]string, 0, len(counts))
+			for _, d := range []string{dispositionAllowed, dispositionBlocked, dispositionNxdomain, dispositionError, dispositionUntested} {
+				if n := counts[d]; n > 0 {
+					summary = append(summary, fmt.Sprintf("%d %s", n, d))
+				}
+			}
+			fmt.Printf("%d domains: %s\n", len(results), strings.Join(summary, ", "))
+		},
+	}
+	testListCmd.Flags().StringVarP(&testListTmpl.Listener, "listener", "", "0", "Listener number which the queries are sent to")
+	testListCmd.Flags().StringVarP(&testListTmpl.ClientIP, "client-ip", "", "", "Client IP address which the queries are sent from (default 127.0.0.1)")
+	testListCmd.Flags().StringVarP(&testListTmpl.Mac, "mac", "", "", "Client MAC address which the queries are sent from")
+	testListCmd.Flags().BoolVarP(&testListTmpl.NoResolve, "no-resolve", "", false, "Only evaluate the policies, without resolving the domains")
+	testListCmd.Flags().BoolVarP(&testListJSON, "json", "", false, "Print results in JSON format")
+	rootCmd.AddCommand(testListCmd)
+
+	var (
+		deployHosts []string
+		d           deployer
+	)
+	deployCmd := &cobra.Command{
+		Use:   "deploy [flags] [-- start flags]",
+		Short: "Install ctrld on remote routers over SSH",
+		Long: `Install ctrld on remote routers over SSH.
+
+The remote platform is detected automatically, the matching binary is uploaded
+from --binary-dir (named "ctrld-<os>-<arch>", e.g: ctrld-linux-armv7), together
+with the config file if any, then "ctrld start" is run on the remote router.
+Arguments after "--" are passed to "ctrld start" as-is.`,
+		Example: `  ctrld deploy --host root@192.168.1.1 --ssh-key ~/.ssh/id_ed25519 --binary-dir ./dist -- --cd=<resolver_id>`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			initConsoleLogging()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(deployHosts) == 0 {
+				mainLog.Load().Fatal().Msg("no host to deploy, use --host to specify one")
+			}
+			d.startArgs = args
+			failed := 0
+			for _, host := range deployHosts {
+				if err := d.deploy(host); err != nil {
+					mainLog.Load().Error().Err(err).Msgf("%s: failed to deploy", host)
+					failed++
+					continue
+				}
+				mainLog.Load().Notice().Msgf("%s: deployed successfully", host)
+			}
+			if failed > 0 {
+				mainLog.Load().Fatal().Msgf("failed to deploy to %d/%d hosts", failed, len(deployHosts))
+			}
+		},
+	}
+	deployCmd.Flags().StringSliceVarP(&deployHosts, "host", "", nil, "Remote router to deploy, in form [user@]host, can be repeated")
+	deployCmd.Flags().StringVarP(&d.sshKey, "ssh-key", "", "", "Path to SSH private key")
+	deployCmd.Flags().IntVarP(&d.sshPort, "ssh-port", "", 0, "SSH port of remote routers")
+	deployCmd.Flags().StringVarP(&d.binaryDir, "binary-dir", "", "", "Directory containing ctrld binaries for remote platforms")
+	deployCmd.Flags().StringVarP(&d.remoteDir, "remote-dir", "", "", "Install directory on remote routers, auto detected if empty")
+	deployCmd.Flags().StringVarP(&d.config, "config", "c", "", "Path to config file to upload")
+	rootCmd.AddCommand(deployCmd)
+}
+
+// fmtLastQuery returns human-readable format of the last query time of a client.
+func fmtLastQuery(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
 }
 
 // isMobile reports whether the current OS is a mobile platform.
@@ -1071,13 +1682,16 @@ func run(appCallback *AppCallback, stopCh chan struct{}) {
 			rootCertPool = cp
 		}
 		if iface != "" {
+			watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
 			p.onStarted = append(p.onStarted, func() {
 				mainLog.Load().Debug().Msg("router setup on start")
 				if err := p.router.Setup(); err != nil {
 					mainLog.Load().Error().Err(err).Msg("could not configure router")
 				}
+				go router.Watchdog(watchdogCtx, p.router)
 			})
 			p.onStopped = append(p.onStopped, func() {
+				stopWatchdog()
 				mainLog.Load().Debug().Msg("router cleanup on stop")
 				if err := p.router.Cleanup(); err != nil {
 					mainLog.Load().Error().Err(err).Msg("could not cleanup router")
@@ -1100,18 +1714,23 @@ func writeConfigFile() error {
 	} else if configPath != "" {
 		defaultConfigFile = configPath
 	}
-	f, err := os.OpenFile(defaultConfigFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0o644))
+	return writeConfig(defaultConfigFile, &cfg)
+}
+
+// writeConfig writes config c to file at given path.
+func writeConfig(path string, c *ctrld.Config) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0o644))
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if cdUID != "" {
+	if loadCdUID() != "" {
 		if _, err := f.WriteString("# AUTO-GENERATED VIA CD FLAG - DO NOT MODIFY\n\n"); err != nil {
 			return err
 		}
 	}
 	enc := toml.NewEncoder(f).SetIndentTables(true)
-	if err := enc.Encode(&cfg); err != nil {
+	if err := enc.Encode(c); err != nil {
 		return err
 	}
 	if err := f.Close(); err != nil {
@@ -1120,6 +1739,23 @@ func writeConfigFile() error {
 	return nil
 }
 
+// loadConfigFile reads config from file, returning the config and the path of file used.
+func loadConfigFile() (*ctrld.Config, string, error) {
+	newCfg := &ctrld.Config{}
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	ctrld.InitConfig(v, "ctrld")
+	if configPath != "" {
+		v.SetConfigFile(configPath)
+	}
+	if err := v.ReadInConfig(); err != nil {
+		return nil, "", err
+	}
+	if err := v.Unmarshal(&newCfg); err != nil {
+		return nil, "", fmt.Errorf("could not unmarshal config: %w", err)
+	}
+	return newCfg, v.ConfigFileUsed(), nil
+}
+
 // readConfigFile reads in config file.
 //
 // - It writes default config file if config file not found if writeDefaultConfig is true.
@@ -1252,17 +1888,18 @@ func deactivationPinNotSet() bool {
 }
 
 func processCDFlags(cfg *ctrld.Config) error {
+	uid := loadCdUID()
 	logger := mainLog.Load().With().Str("mode", "cd").Logger()
-	logger.Info().Msgf("fetching Controld D configuration from API: %s", cdUID)
+	logger.Info().Msgf("fetching Controld D configuration from API: %s", uid)
 	bo := backoff.NewBackoff("processCDFlags", logf, 30*time.Second)
 	bo.LogLongerThan = 30 * time.Second
 	ctx := context.Background()
-	resolverConfig, err := controld.FetchResolverConfig(cdUID, rootCmd.Version, cdDev)
+	resolverConfig, err := controld.FetchResolverConfig(uid, rootCmd.Version, cdDev)
 	for {
 		if errUrlNetworkError(err) {
 			bo.BackOff(ctx, err)
 			logger.Warn().Msg("could not fetch resolver using bootstrap DNS, retrying...")
-			resolverConfig, err = controld.FetchResolverConfig(cdUID, rootCmd.Version, cdDev)
+			resolverConfig, err = controld.FetchResolverConfig(uid, rootCmd.Version, cdDev)
 			continue
 		}
 		break
@@ -1492,7 +2129,7 @@ func selfCheckStatus(s service.Service) (bool, service.Status, error) {
 			cfg.Upstream = ucChanged
 		}
 		mu.Unlock()
-		lc := cfg.FirstListener()
+		ip, port := listenerAddr(cfg.FirstListener(), interfaceAddrs)
 		domain = cfg.FirstUpstream().VerifyDomain()
 		if domain == "" {
 			continue
@@ -1501,7 +2138,7 @@ func selfCheckStatus(s service.Service) (bool, service.Status, error) {
 		m := new(dns.Msg)
 		m.SetQuestion(domain+".", dns.TypeA)
 		m.RecursionDesired = true
-		r, _, exErr := exchangeContextWithTimeout(c, time.Second, m, net.JoinHostPort(lc.IP, strconv.Itoa(lc.Port)))
+		r, _, exErr := exchangeContextWithTimeout(c, time.Second, m, net.JoinHostPort(ip, strconv.Itoa(port)))
 		if r != nil && r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0 {
 			mainLog.Load().Debug().Msgf("self-check against %q succeeded", domain)
 			return true, status, nil
@@ -1515,8 +2152,8 @@ func selfCheckStatus(s service.Service) (bool, service.Status, error) {
 		bo.BackOff(ctx, fmt.Errorf("ExchangeContext: %w", exErr))
 	}
 	mainLog.Load().Debug().Msgf("self-check against %q failed", domain)
-	lc := cfg.FirstListener()
-	addr := net.JoinHostPort(lc.IP, strconv.Itoa(lc.Port))
+	ip, port := listenerAddr(cfg.FirstListener(), interfaceAddrs)
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
 	marker := strings.Repeat("=", 32)
 	mainLog.Load().Debug().Msg(marker)
 	mainLog.Load().Debug().Msgf("listener address       : %s", addr)
@@ -1684,21 +2321,103 @@ func fieldErrorMsg(fe validator.FieldError) string {
 		return fmt.Sprintf("minimum len: %q", fe.Param())
 	case "gte":
 		return fmt.Sprintf("must be greater than or equal to: %s", fe.Param())
+	case "lte":
+		return fmt.Sprintf("must be less than or equal to: %s", fe.Param())
 	case "cidr":
 		return fmt.Sprintf("invalid value: %s", fe.Value())
 	case "required_unless", "required":
 		return "value is required"
+	case "required_with":
+		return fmt.Sprintf("value is required when %s is set", fe.Param())
+	case "base64":
+		return fmt.Sprintf("invalid base64 value: %s", fe.Value())
 	case "dnsrcode":
 		return fmt.Sprintf("invalid DNS rcode value: %s", fe.Value())
 	case "ipstack":
 		ipStacks := []string{ctrld.IpStackV4, ctrld.IpStackV6, ctrld.IpStackSplit, ctrld.IpStackBoth}
 		return fmt.Sprintf("must be one of: %q", strings.Join(ipStacks, " "))
-	case "iporempty":
+	case "ip", "iporempty":
 		return fmt.Sprintf("invalid IP format: %s", fe.Value())
+	case "ipportorempty":
+		return fmt.Sprintf("invalid IP:port format: %s", fe.Value())
 	case "file":
 		return fmt.Sprintf("filed does not exist: %s", fe.Value())
 	case "http_url":
 		return fmt.Sprintf("invalid http/https url: %s", fe.Value())
+	case "dnscrypt_stamp":
+		return fmt.Sprintf("invalid DNSCrypt stamp: %s", fe.Value())
+	case "dnscrypt_relay":
+		return fmt.Sprintf("invalid DNSCrypt relay stamps, or upstream type is not dnscrypt: %v", fe.Value())
+	case "upstream_proxy":
+		return fmt.Sprintf("invalid proxy url, or upstream type is not doh, dohjson or dot: %v", fe.Value())
+	case "client_cert":
+		return fmt.Sprintf("client certificate is only supported by doh, doh3, dohjson, dot and doq upstreams: %v", fe.Value())
+	case "tls_option":
+		return fmt.Sprintf("%s is only supported by doh, doh3, dohjson, dot and doq upstreams: %v", fe.Field(), fe.Value())
+	case "file_mode":
+		return fmt.Sprintf("invalid permission mode, must be octal like 0660: %v", fe.Value())
+	case "unix_socket":
+		return fmt.Sprintf("invalid unix socket path, must be absolute: %s", fe.Value())
+	case "ip_protocol":
+		return fmt.Sprintf("ip_protocol is only supported by legacy upstreams: %v", fe.Value())
+	case "ip_protocol_tcp_only":
+		return fmt.Sprintf("ip_protocol could not be %v when tcp_only is set", fe.Value())
+	case "doh_method":
+		return fmt.Sprintf("doh_method is only supported by doh and doh3 upstreams: %v", fe.Value())
+	case "doh_headers":
+		return fmt.Sprintf("headers and bearer token are only supported by doh, doh3 and dohjson upstreams: %v", fe.Value())
+	case "upstream_exists":
+		return fmt.Sprintf("upstream does not exist: %v", fe.Value())
+	case "schedule_rule":
+		return fmt.Sprintf("schedule rule is not in any policy rules: %v", fe.Value())
+	case "upstream_group":
+		return fmt.Sprintf("upstream group does not exist: %v", fe.Value())
+	case "upstream_weights":
+		return fmt.Sprintf("weights must be set for every upstream, with at least one positive weight: %v", fe.Value())
+	case "weights_strategy":
+		return fmt.Sprintf("weights are only used by weighted strategy: %v", fe.Value())
+	case "bind":
+		return fmt.Sprintf("bind is only supported by plain dns listeners: %v", fe.Value())
+	case "transparent":
+		return fmt.Sprintf("transparent is only supported by plain dns listeners: %v", fe.Value())
+	case "regex_rule":
+		return fmt.Sprintf("invalid regex rule %q: %s", fe.Value(), fe.Param())
+	case "regex_rules":
+		return fmt.Sprintf("too many regex rules, maximum: %d", ctrld.MaxRegexRules)
+	case "client_pattern":
+		return fmt.Sprintf("invalid client, must be an IP address, a CIDR, a MAC address or a MAC prefix like \"aa:bb:cc:*\": %s", fe.Value())
+	case "schedule_time":
+		return fmt.Sprintf("invalid time of day, must be HH:MM: %s", fe.Value())
+	case "timezone":
+		return fmt.Sprintf("invalid timezone: %s", fe.Value())
+	case "cache_ttl_range":
+		return fmt.Sprintf("must be greater than or equal to the minimum TTL: %v", fe.Value())
+	case "udp_workers":
+		return fmt.Sprintf("udp_workers is only supported by plain dns listeners: %v", fe.Value())
+	case "advertise_rdnss":
+		return fmt.Sprintf("advertise_rdnss requires a plain dns listener on an ipv6 address with port 53: %v", fe.Value())
+	case "proxy_protocol":
+		return fmt.Sprintf("proxy_protocol is only supported by dns, dot and doh listeners: %v", fe.Value())
+	case "acme_domain":
+		return fmt.Sprintf("acme_domain is only supported by doh, dot and doq listeners without tls_cert and tls_key: %v", fe.Value())
+	case "fail_open_upstream":
+		return fmt.Sprintf("fail open upstream must be a defined legacy or os upstream: %v", fe.Value())
+	case "onion_proxy":
+		return fmt.Sprintf("onion endpoint requires tor or proxy: %v", fe.Value())
+	case "url":
+		return fmt.Sprintf("invalid url: %s", fe.Value())
+	case "email":
+		return fmt.Sprintf("invalid email address: %s", fe.Value())
+	case "startswith":
+		return fmt.Sprintf("must start with %q: %s", fe.Param(), fe.Value())
+	case "mac|ip":
+		return fmt.Sprintf("invalid MAC or IP address: %s", fe.Value())
+	case "mac":
+		return fmt.Sprintf("invalid MAC address: %s", fe.Value())
+	case "ipv4":
+		return fmt.Sprintf("invalid IPv4 address: %s", fe.Value())
+	case "hostname_rfc1123":
+		return fmt.Sprintf("invalid domain name: %s", fe.Value())
 	}
 	return ""
 }
@@ -1760,6 +2479,10 @@ func tryUpdateListenerConfig(cfg *ctrld.Config, infoLogger *zerolog.Logger, fata
 	hasLocalDnsServer := windowsHasLocalDnsServerRunning()
 	for n, listener := range cfg.Listener {
 		lcc[n] = &listenerConfigCheck{}
+		// Encrypted DNS listeners, and listeners with bind addresses, are served on their configured addresses only.
+		if !listener.IsPlainDNS() || len(listener.Bind) > 0 {
+			continue
+		}
 		if listener.IP == "" {
 			listener.IP = "0.0.0.0"
 			if hasLocalDnsServer {
@@ -1846,8 +2569,14 @@ func tryUpdateListenerConfig(cfg *ctrld.Config, infoLogger *zerolog.Logger, fata
 	}
 	sort.Ints(listeners)
 
+	// The address to try when port 53 is not available, default to port 5354.
+	fallbackIP, fallbackPort := router.ListenAddress(cfg)
+
 	for _, n := range listeners {
 		listener := cfg.Listener[strconv.Itoa(n)]
+		if !listener.IsPlainDNS() || len(listener.Bind) > 0 {
+			continue
+		}
 		check := lcc[strconv.Itoa(n)]
 		oldIP := listener.IP
 		oldPort := listener.Port
@@ -1855,6 +2584,8 @@ func tryUpdateListenerConfig(cfg *ctrld.Config, infoLogger *zerolog.Logger, fata
 
 		// Check if we could listen on the current IP + Port, if not, try following thing, pick first one success:
 		//    - Try 127.0.0.1:53
+		//    - Try the router listen address (default to current IP with port 5354).
+		//    - Try 0.0.0.0 with router listen port.
 		//    - Pick a random port until success.
 		localhostIP := func(ipStr string) string {
 			if ip := net.ParseIP(ipStr); ip != nil && ip.To4() == nil {
@@ -1867,12 +2598,12 @@ func tryUpdateListenerConfig(cfg *ctrld.Config, infoLogger *zerolog.Logger, fata
 		// config, so we can always listen on localhost port 53, but no traffic could be routed there.
 		tryLocalhost := !isLoopback(listener.IP) && router.CanListenLocalhost()
 		tryAllPort53 := true
-		tryOldIPPort5354 := true
-		tryPort5354 := true
+		tryOldIPFallbackPort := true
+		tryFallbackPort := true
 		if hasLocalDnsServer {
 			tryAllPort53 = false
-			tryOldIPPort5354 = false
-			tryPort5354 = false
+			tryOldIPFallbackPort = false
+			tryFallbackPort = false
 		}
 		attempts := 0
 		maxAttempts := 10
@@ -1918,26 +2649,29 @@ func tryUpdateListenerConfig(cfg *ctrld.Config, infoLogger *zerolog.Logger, fata
 				}
 				continue
 			}
-			if tryOldIPPort5354 {
-				tryOldIPPort5354 = false
+			if tryOldIPFallbackPort {
+				tryOldIPFallbackPort = false
 				if check.IP {
 					listener.IP = oldIP
+					if fallbackIP != "" {
+						listener.IP = fallbackIP
+					}
 				}
 				if check.Port {
-					listener.Port = 5354
+					listener.Port = fallbackPort
 				}
-				logMsg(il.Info(), n, "could not listen on address: %s, trying current ip with port 5354", addr)
+				logMsg(il.Info(), n, "could not listen on address: %s, trying: %s", addr, net.JoinHostPort(listener.IP, strconv.Itoa(listener.Port)))
 				continue
 			}
-			if tryPort5354 {
-				tryPort5354 = false
+			if tryFallbackPort {
+				tryFallbackPort = false
 				if check.IP {
 					listener.IP = "0.0.0.0"
 				}
 				if check.Port {
-					listener.Port = 5354
+					listener.Port = fallbackPort
 				}
-				logMsg(il.Info(), n, "could not listen on address: %s, trying 0.0.0.0:5354", addr)
+				logMsg(il.Info(), n, "could not listen on address: %s, trying: %s", addr, net.JoinHostPort(listener.IP, strconv.Itoa(listener.Port)))
 				continue
 			}
 			if check.IP && !isZeroIP { // for "0.0.0.0" or "::", we only need to try new port.
@@ -0,0 +1,198 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// configDiff represents changes between two configs, applied by a reload.
+type configDiff struct {
+	Service   []string          `json:"service,omitempty"`
+	Listeners configSectionDiff `json:"listeners"`
+	Networks  configSectionDiff `json:"networks"`
+	Upstreams configSectionDiff `json:"upstreams"`
+	Rules     configSectionDiff `json:"rules"`
+	Clients   configSectionDiff `json:"clients"`
+}
+
+// configSectionDiff represents changes of a config section, identified by names.
+type configSectionDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+// empty reports whether there is no changes in section.
+func (sd *configSectionDiff) empty() bool {
+	return len(sd.Added) == 0 && len(sd.Removed) == 0 && len(sd.Changed) == 0
+}
+
+// empty reports whether there is no changes between configs.
+func (d *configDiff) empty() bool {
+	return len(d.Service) == 0 && d.Listeners.empty() && d.Networks.empty() && d.Upstreams.empty() && d.Rules.empty() && d.Clients.empty()
+}
+
+// lines returns human-readable format of d, one change per line.
+func (d *configDiff) lines() []string {
+	var lines []string
+	if len(d.Service) > 0 {
+		lines = append(lines, fmt.Sprintf("~ service: %s", strings.Join(d.Service, ", ")))
+	}
+	for _, s := range []struct {
+		name string
+		sd   *configSectionDiff
+	}{
+		{"listener", &d.Listeners},
+		{"network", &d.Networks},
+		{"upstream", &d.Upstreams},
+		{"rule", &d.Rules},
+		{"client", &d.Clients},
+	} {
+		for _, n := range s.sd.Added {
+			lines = append(lines, fmt.Sprintf("+ %s.%s", s.name, n))
+		}
+		for _, n := range s.sd.Removed {
+			lines = append(lines, fmt.Sprintf("- %s.%s", s.name, n))
+		}
+		for _, n := range s.sd.Changed {
+			lines = append(lines, fmt.Sprintf("~ %s.%s", s.name, n))
+		}
+	}
+	return lines
+}
+
+// printReloadDiff prints config changes from reload response body r.
+// Older ctrld versions do not send changes, so decoding error is ignored.
+func printReloadDiff(r io.Reader) {
+	var diff configDiff
+	if err := json.NewDecoder(r).Decode(&diff); err != nil {
+		return
+	}
+	if diff.empty() {
+		mainLog.Load().Notice().Msg("No config changes")
+		return
+	}
+	mainLog.Load().Notice().Msg("Config changes:")
+	for _, line := range diff.lines() {
+		mainLog.Load().Notice().Msg(line)
+	}
+}
+
+// diffConfig returns changes from prev config to cur config.
+func diffConfig(prev, cur *ctrld.Config) *configDiff {
+	return &configDiff{
+		Service:   changedFields(&prev.Service, &cur.Service),
+		Listeners: diffSection(prev.Listener, cur.Listener),
+		Networks:  diffSection(prev.Network, cur.Network),
+		Upstreams: diffSection(prev.Upstream, cur.Upstream),
+		Rules:     diffSection(policyRules(prev), policyRules(cur)),
+		Clients:   diffSection(prev.Clients, cur.Clients),
+	}
+}
+
+// diffSection returns changes between two config sections.
+func diffSection[V any](prev, cur map[string]V) configSectionDiff {
+	var sd configSectionDiff
+	for n, cv := range cur {
+		pv, ok := prev[n]
+		switch {
+		case !ok:
+			sd.Added = append(sd.Added, n)
+		case len(changedFields(pv, cv)) > 0:
+			sd.Changed = append(sd.Changed, n)
+		}
+	}
+	for n := range prev {
+		if _, ok := cur[n]; !ok {
+			sd.Removed = append(sd.Removed, n)
+		}
+	}
+	sort.Strings(sd.Added)
+	sort.Strings(sd.Removed)
+	sort.Strings(sd.Changed)
+	return sd
+}
+
+// policyRule is a single rule of listener policy, used for diffing.
+type policyRule struct {
+	Upstreams []string
+	Order     int
+}
+
+// policyRules returns all listener policy rules of cfg, keyed by "<listener>.<kind>.<rule>",
+// for example: "0.rules.*.example.com". Rules of client policies are keyed by
+// "<listener>.client_policies.<index>.<kind>.<rule>".
+func policyRules(cfg *ctrld.Config) map[string]policyRule {
+	rules := make(map[string]policyRule)
+	for ln, lc := range cfg.Listener {
+		if lc == nil {
+			continue
+		}
+		if lc.Policy != nil {
+			addPolicyRules(rules, ln, lc.Policy)
+		}
+		for i, policy := range lc.ClientPolicies {
+			if policy != nil {
+				addPolicyRules(rules, fmt.Sprintf("%s.client_policies.%d", ln, i), policy)
+			}
+		}
+	}
+	return rules
+}
+
+// addPolicyRules adds rules of policy to rules, keyed by "<prefix>.<kind>.<rule>".
+func addPolicyRules(rules map[string]policyRule, prefix string, policy *ctrld.ListenerPolicyConfig) {
+	for kind, rs := range map[string][]ctrld.Rule{
+		"networks": policy.Networks,
+		"macs":     policy.Macs,
+		"tags":     policy.Tags,
+		"rules":    policy.Rules,
+	} {
+		for i, r := range rs {
+			for k, v := range r {
+				rules[strings.Join([]string{prefix, kind, k}, ".")] = policyRule{Upstreams: v, Order: i}
+			}
+		}
+	}
+}
+
+// changedFields returns the names of exported fields which differ between prev and cur,
+// which must be structs or pointers to structs of the same type. Field names are taken
+// from "mapstructure" tag, fields which are not part of config (tagged "-") are ignored.
+func changedFields(prev, cur any) []string {
+	ov, nv := reflect.Indirect(reflect.ValueOf(prev)), reflect.Indirect(reflect.ValueOf(cur))
+	if !ov.IsValid() || !nv.IsValid() {
+		if ov.IsValid() != nv.IsValid() {
+			return []string{"*"}
+		}
+		return nil
+	}
+	if ov.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(ov.Interface(), nv.Interface()) {
+			return []string{"*"}
+		}
+		return nil
+	}
+	var fields []string
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_diffConfig(t *testing.T) {
+	prev := &ctrld.Config{
+		Listener: map[string]*ctrld.ListenerConfig{
+			"0": {IP: "127.0.0.1", Port: 53, Policy: &ctrld.ListenerPolicyConfig{
+				Rules: []ctrld.Rule{{"*.example.com": []string{"upstream.0"}}, {"*.foo.com": []string{"upstream.0"}}},
+			}},
+		},
+		Network: map[string]*ctrld.NetworkConfig{
+			"0": {Name: "Everyone", Cidrs: []string{"0.0.0.0/0"}},
+		},
+		Upstream: map[string]*ctrld.UpstreamConfig{
+			"0": {Name: "Control D", Type: ctrld.ResolverTypeDOH, Endpoint: "https://freedns.controld.com/p1"},
+			"1": {Name: "Google", Type: ctrld.ResolverTypeLegacy, Endpoint: "8.8.8.8:53"},
+		},
+	}
+	cur := &ctrld.Config{
+		Listener: map[string]*ctrld.ListenerConfig{
+			"0": {IP: "127.0.0.1", Port: 53, Policy: &ctrld.ListenerPolicyConfig{
+				Rules: []ctrld.Rule{{"*.example.com": []string{"upstream.1"}}, {"*.bar.com": []string{"upstream.0"}}},
+			}},
+		},
+		Network: map[string]*ctrld.NetworkConfig{
+			"0": {Name: "Everyone", Cidrs: []string{"0.0.0.0/0"}},
+		},
+		Upstream: map[string]*ctrld.UpstreamConfig{
+			"0": {Name: "Control D", Type: ctrld.ResolverTypeDOH, Endpoint: "https://freedns.controld.com/p2"},
+			"2": {Name: "Cloudflare", Type: ctrld.ResolverTypeLegacy, Endpoint: "1.1.1.1:53"},
+		},
+	}
+	cur.Service.CacheEnable = true
+	// Runtime only fields must be ignored.
+	cur.Upstream["0"].Domain = "freedns.controld.com"
+
+	diff := diffConfig(prev, cur)
+	assert.Equal(t, []string{"cache_enable"}, diff.Service)
+	assert.Equal(t, configSectionDiff{Added: []string{"2"}, Removed: []string{"1"}, Changed: []string{"0"}}, diff.Upstreams)
+	assert.Equal(t, configSectionDiff{Changed: []string{"0"}}, diff.Listeners)
+	assert.True(t, diff.Networks.empty())
+	assert.Equal(t, configSectionDiff{
+		Added:   []string{"0.rules.*.bar.com"},
+		Removed: []string{"0.rules.*.foo.com"},
+		Changed: []string{"0.rules.*.example.com"},
+	}, diff.Rules)
+	assert.False(t, diff.empty())
+	assert.True(t, diffConfig(prev, prev).empty())
+}
@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// configRenderResponse represents the effective config of running ctrld.
+type configRenderResponse struct {
+	// Config is the effective config, in canonical TOML form.
+	Config string `json:"config,omitempty"`
+	// Error is the reason why config could not be rendered, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// renderConfig returns cfg in canonical TOML form.
+//
+// The output is deterministic, so it could be diffed between routers, or against the intended
+// state kept in version control: tables of listeners, networks, upstreams are sorted by keys,
+// fields are always in the same order, and options which are not set are omitted. Ordered lists,
+// like policy rules, are kept as-is, since their order matters.
+func renderConfig(cfg *ctrld.Config) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf).SetIndentTables(true)
+	if err := enc.Encode(cfg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleConfigRender renders the config which running ctrld is using, after config
+// is fetched from Control D API in cd mode, and reloads are applied.
+func (p *prog) handleConfigRender(w http.ResponseWriter, request *http.Request) {
+	p.mu.Lock()
+	data, err := renderConfig(p.cfg)
+	p.mu.Unlock()
+	if err != nil {
+		mainLog.Load().Err(err).Msg("could not render config")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(&configRenderResponse{Error: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&configRenderResponse{Config: string(data)})
+}
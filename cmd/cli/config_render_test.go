@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_renderConfig(t *testing.T) {
+	newCfg := func() *ctrld.Config {
+		cfg := &ctrld.Config{
+			Listener: map[string]*ctrld.ListenerConfig{
+				"0": {IP: "127.0.0.1", Port: 53, Policy: &ctrld.ListenerPolicyConfig{
+					Rules: []ctrld.Rule{{"*.foo.com": []string{"upstream.1"}}, {"*.bar.com": []string{"upstream.0"}}},
+				}},
+			},
+			Upstream: map[string]*ctrld.UpstreamConfig{},
+		}
+		for _, n := range []string{"2", "0", "1"} {
+			cfg.Upstream[n] = &ctrld.UpstreamConfig{Name: "upstream " + n, Type: ctrld.ResolverTypeLegacy, Endpoint: "192.0.2.1:53"}
+		}
+		cfg.Service.CacheEnable = true
+		return cfg
+	}
+
+	data, err := renderConfig(newCfg())
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		again, err := renderConfig(newCfg())
+		require.NoError(t, err)
+		assert.Equal(t, string(data), string(again))
+	}
+
+	out := string(data)
+	u0, u1, u2 := strings.Index(out, "[upstream.0]"), strings.Index(out, "[upstream.1]"), strings.Index(out, "[upstream.2]")
+	assert.True(t, u0 >= 0 && u0 < u1 && u1 < u2, "upstreams must be sorted by keys")
+	assert.Less(t, strings.Index(out, "*.foo.com"), strings.Index(out, "*.bar.com"), "rules order must be kept")
+	assert.NotContains(t, out, "cache_size", "unset options must be omitted")
+}
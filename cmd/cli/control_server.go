@@ -20,7 +20,18 @@ const (
 	listClientsPath  = "/clients"
 	startedPath      = "/started"
 	reloadPath       = "/reload"
+	reloadDiffPath   = "/reload/diff"
 	deactivationPath = "/deactivation"
+	profilePath      = "/profile"
+	testListPath     = "/test-list"
+	rulesPath        = "/rules"
+	configRenderPath = "/config/render"
+	upstreamsPath    = "/upstreams"
+	ddrPath          = "/ddr"
+	cacheFlushPath   = "/cache/flush"
+	cacheStatsPath   = "/cache/stats"
+	cachePinPath     = "/cache/pin"
+	cacheUnpinPath   = "/cache/unpin"
 )
 
 type controlServer struct {
@@ -108,6 +119,9 @@ func (p *prog) registerControlServerHandler() {
 			listeners[k] = &ctrld.ListenerConfig{
 				IP:   v.IP,
 				Port: v.Port,
+				Type: v.Type,
+				Path: v.Path,
+				Bind: v.Bind,
 			}
 		}
 		oldSvc := p.cfg.Service
@@ -127,29 +141,49 @@ func (p *prog) registerControlServerHandler() {
 		p.mu.Lock()
 		defer p.mu.Unlock()
 
+		// Changes applied by this reload are sent back to client.
+		writeDiff := func(code int) {
+			w.WriteHeader(code)
+			if p.lastReloadDiff != nil {
+				_ = json.NewEncoder(w).Encode(p.lastReloadDiff)
+			}
+		}
+
 		// Checking for cases that we could not do a reload.
 
-		// 1. Listener config ip or port changes.
+		// 1. Listener config ip, port, type, path or bind addresses changes.
 		for k, v := range p.cfg.Listener {
 			l := listeners[k]
-			if l == nil || l.IP != v.IP || l.Port != v.Port {
-				w.WriteHeader(http.StatusCreated)
+			if l == nil || l.IP != v.IP || l.Port != v.Port || l.Type != v.Type || l.Path != v.Path || !reflect.DeepEqual(l.Bind, v.Bind) {
+				writeDiff(http.StatusCreated)
 				return
 			}
 		}
 
 		// 2. Service config changes.
 		if !reflect.DeepEqual(oldSvc, p.cfg.Service) {
-			w.WriteHeader(http.StatusCreated)
+			writeDiff(http.StatusCreated)
 			return
 		}
 
 		// Otherwise, reload is done.
-		w.WriteHeader(http.StatusOK)
+		writeDiff(http.StatusOK)
+	}))
+	p.cs.register(reloadDiffPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		p.mu.Lock()
+		diff := p.lastReloadDiff
+		p.mu.Unlock()
+		if diff == nil {
+			diff = &configDiff{}
+		}
+		if err := json.NewEncoder(w).Encode(diff); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}))
 	p.cs.register(deactivationPath, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
 		// Non-cd mode or pin code not set, always allowing deactivation.
-		if cdUID == "" || deactivationPinNotSet() {
+		if loadCdUID() == "" || deactivationPinNotSet() {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -171,6 +205,16 @@ func (p *prog) registerControlServerHandler() {
 		}
 		w.WriteHeader(code)
 	}))
+	p.cs.register(profilePath, http.HandlerFunc(p.handleProfile))
+	p.cs.register(testListPath, http.HandlerFunc(p.handleTestList))
+	p.cs.register(rulesPath, http.HandlerFunc(p.handleRules))
+	p.cs.register(configRenderPath, http.HandlerFunc(p.handleConfigRender))
+	p.cs.register(upstreamsPath, http.HandlerFunc(p.handleUpstreams))
+	p.cs.register(ddrPath, http.HandlerFunc(p.handleDDR))
+	p.cs.register(cacheFlushPath, http.HandlerFunc(p.handleCacheFlush))
+	p.cs.register(cacheStatsPath, http.HandlerFunc(p.handleCacheStats))
+	p.cs.register(cachePinPath, http.HandlerFunc(p.handleCachePin))
+	p.cs.register(cacheUnpinPath, http.HandlerFunc(p.handleCacheUnpin))
 }
 
 func jsonResponse(next http.Handler) http.Handler {
@@ -0,0 +1,217 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// remoteInstallDirScript prints the directory which ctrld will be installed to on remote router.
+// Persistent storage is preferred, because some routers (Merlin, Ubios, EdgeOS ...) wipe out
+// everything else on reboot/firmware upgrade.
+const remoteInstallDirScript = `for d in /jffs /data /config; do if [ -d "$d" ] && [ -w "$d" ]; then echo "$d/controld"; exit 0; fi; done; echo /etc/controld`
+
+// remoteArchScript prints the OS, machine hardware name, word size and endianness of remote router.
+// The word size and endianness are read from EI_CLASS and EI_DATA bytes of /bin/sh ELF header:
+// EI_CLASS 01 is 32-bit, 02 is 64-bit; EI_DATA 01 is little endian, 02 is big endian.
+const remoteArchScript = `uname -s; uname -m; dd if=/bin/sh bs=1 skip=4 count=2 2>/dev/null | od -An -tx1`
+
+// deployer installs ctrld on remote routers over SSH.
+type deployer struct {
+	sshKey    string
+	sshPort   int
+	binaryDir string
+	remoteDir string
+	config    string
+	startArgs []string
+}
+
+// deploy installs ctrld on the given host. It detects the remote platform, uploads
+// the binary built for that platform and the config file (if any), then runs
+// "ctrld start" on remote host.
+func (d *deployer) deploy(host string) error {
+	out, err := d.ssh(host, remoteArchScript)
+	if err != nil {
+		return fmt.Errorf("detecting remote platform: %w", err)
+	}
+	goos, goarch, err := platformFromUname(out)
+	if err != nil {
+		return err
+	}
+	mainLog.Load().Notice().Msgf("%s: detected platform %s/%s", host, goos, goarch)
+
+	bin, err := d.binaryFor(goos, goarch)
+	if err != nil {
+		return err
+	}
+	remoteDir := d.remoteDir
+	if remoteDir == "" {
+		out, err := d.ssh(host, remoteInstallDirScript)
+		if err != nil {
+			return fmt.Errorf("detecting install directory: %w", err)
+		}
+		remoteDir = strings.TrimSpace(out)
+	}
+	if _, err := d.ssh(host, "mkdir -p "+shellQuote(remoteDir)); err != nil {
+		return fmt.Errorf("creating install directory: %w", err)
+	}
+	remoteBin := remoteDir + "/ctrld"
+	// The binary may be running, and could not be overwritten (ETXTBSY), so upload it
+	// to a temporary file, then rename it to replace the running one.
+	remoteTmpBin := remoteBin + ".new"
+	mainLog.Load().Notice().Msgf("%s: uploading %s to %s", host, bin, remoteBin)
+	if err := d.scp(host, bin, remoteTmpBin); err != nil {
+		return fmt.Errorf("uploading binary: %w", err)
+	}
+	if _, err := d.ssh(host, fmt.Sprintf("chmod +x %s && mv -f %s %s", shellQuote(remoteTmpBin), shellQuote(remoteTmpBin), shellQuote(remoteBin))); err != nil {
+		return fmt.Errorf("installing binary: %w", err)
+	}
+
+	startCmd := []string{shellQuote(remoteBin), "start"}
+	if d.config != "" {
+		remoteConfig := remoteDir + "/" + defaultConfigFile
+		mainLog.Load().Notice().Msgf("%s: uploading %s to %s", host, d.config, remoteConfig)
+		if err := d.scp(host, d.config, remoteConfig); err != nil {
+			return fmt.Errorf("uploading config: %w", err)
+		}
+		startCmd = append(startCmd, "--config="+shellQuote(remoteConfig))
+	}
+	for _, arg := range d.startArgs {
+		startCmd = append(startCmd, shellQuote(arg))
+	}
+	mainLog.Load().Notice().Msgf("%s: running %s", host, strings.Join(startCmd, " "))
+	out, err = d.ssh(host, strings.Join(startCmd, " "))
+	if err != nil {
+		return fmt.Errorf("running install: %w", err)
+	}
+	mainLog.Load().Debug().Msgf("%s: %s", host, out)
+	return nil
+}
+
+// binaryFor returns the path to ctrld binary for the given platform.
+//
+// The binary is looked up in binaryDir as "ctrld-<goos>-<goarch>". If binaryDir is empty,
+// the current executable is used if it is built for the same platform.
+func (d *deployer) binaryFor(goos, goarch string) (string, error) {
+	if d.binaryDir == "" {
+		if goos != runtime.GOOS || goarch != runtimeGoarch() {
+			return "", fmt.Errorf("no binary for %s/%s, use --binary-dir to provide one", goos, goarch)
+		}
+		return os.Executable()
+	}
+	bin := filepath.Join(d.binaryDir, fmt.Sprintf("ctrld-%s-%s", goos, goarch))
+	if _, err := os.Stat(bin); err != nil {
+		return "", fmt.Errorf("no binary for %s/%s: %w", goos, goarch, err)
+	}
+	return bin, nil
+}
+
+// sshArgs returns common arguments for ssh/scp commands.
+func (d *deployer) sshArgs(portFlag string) []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if d.sshKey != "" {
+		args = append(args, "-i", d.sshKey)
+	}
+	if d.sshPort > 0 {
+		args = append(args, portFlag, strconv.Itoa(d.sshPort))
+	}
+	return args
+}
+
+// ssh runs the given command on remote host, returning its output.
+func (d *deployer) ssh(host, command string) (string, error) {
+	args := append(d.sshArgs("-p"), host, command)
+	return runCommand("ssh", args...)
+}
+
+// scp copies local file src to dst on remote host.
+func (d *deployer) scp(host, src, dst string) error {
+	args := append(d.sshArgs("-P"), src, host+":"+dst)
+	_, err := runCommand("scp", args...)
+	return err
+}
+
+func runCommand(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %s: %w", name, strings.TrimSpace(stderr.String()), err)
+	}
+	return stdout.String(), nil
+}
+
+// platformFromUname returns GOOS/GOARCH from remoteArchScript output.
+func platformFromUname(s string) (string, string, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return "", "", fmt.Errorf("unexpected platform info: %q", s)
+	}
+	goos := strings.ToLower(fields[0])
+	switch goos {
+	case "linux", "freebsd":
+	default:
+		return "", "", fmt.Errorf("unsupported OS: %s", fields[0])
+	}
+	is32bit := len(fields) > 2 && fields[2] == "01"
+	littleEndian := len(fields) < 4 || fields[3] == "01"
+	machine := fields[1]
+	switch {
+	case machine == "x86_64" || machine == "amd64":
+		return goos, "amd64", nil
+	case machine == "i386" || machine == "i686":
+		return goos, "386", nil
+	case machine == "aarch64" || machine == "arm64":
+		// 64-bit kernel with 32-bit userland, which is common on routers.
+		if is32bit {
+			return goos, "armv7", nil
+		}
+		return goos, "arm64", nil
+	case strings.HasPrefix(machine, "armv5"):
+		return goos, "armv5", nil
+	case strings.HasPrefix(machine, "armv6"):
+		return goos, "armv6", nil
+	case strings.HasPrefix(machine, "armv7"), strings.HasPrefix(machine, "armv8"):
+		return goos, "armv7", nil
+	case machine == "mips64":
+		if littleEndian {
+			return goos, "mips64le", nil
+		}
+		return goos, "mips64", nil
+	case machine == "mips":
+		if littleEndian {
+			return goos, "mipsle", nil
+		}
+		return goos, "mips", nil
+	}
+	return "", "", errors.New("unsupported architecture: " + machine)
+}
+
+// runtimeGoarch returns the GOARCH of current binary, in the same format with platformFromUname.
+func runtimeGoarch() string {
+	if runtime.GOARCH != "arm" {
+		return runtime.GOARCH
+	}
+	goarm := "7"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "GOARM" && s.Value != "" {
+				goarm = s.Value
+			}
+		}
+	}
+	return "armv" + goarm
+}
+
+// shellQuote quotes s for using as a single argument in remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,42 @@
+package cli
+
+import "testing"
+
+func Test_platformFromUname(t *testing.T) {
+	tests := []struct {
+		name    string
+		uname   string
+		goos    string
+		goarch  string
+		wantErr bool
+	}{
+		{"linux amd64", "Linux\nx86_64\n 02 01\n", "linux", "amd64", false},
+		{"linux arm64", "Linux\naarch64\n 02 01\n", "linux", "arm64", false},
+		{"linux arm64 with 32-bit userland", "Linux\naarch64\n 01 01\n", "linux", "armv7", false},
+		{"linux armv5", "Linux\narmv5tejl\n 01 01\n", "linux", "armv5", false},
+		{"linux armv6", "Linux\narmv6l\n 01 01\n", "linux", "armv6", false},
+		{"linux armv7", "Linux\narmv7l\n 01 01\n", "linux", "armv7", false},
+		{"linux armv8 32-bit", "Linux\narmv8l\n 01 01\n", "linux", "armv7", false},
+		{"linux mipsle", "Linux\nmips\n 01 01\n", "linux", "mipsle", false},
+		{"linux mips", "Linux\nmips\n 01 02\n", "linux", "mips", false},
+		{"linux mips64", "Linux\nmips64\n 02 02\n", "linux", "mips64", false},
+		{"freebsd amd64", "FreeBSD\namd64\n 02 09\n", "freebsd", "amd64", false},
+		{"unsupported os", "Darwin\narm64\n", "", "", true},
+		{"unsupported arch", "Linux\nsparc64\n", "", "", true},
+		{"invalid output", "Linux", "", "", true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			goos, goarch, err := platformFromUname(tc.uname)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if goos != tc.goos || goarch != tc.goarch {
+				t.Errorf("unexpected result, want: %s/%s, got: %s/%s", tc.goos, tc.goarch, goos, goarch)
+			}
+		})
+	}
+}
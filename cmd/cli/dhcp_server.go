@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dhcpserver"
+)
+
+// defaultDHCPLeaseTime is the default lease time of the built-in DHCP server.
+const defaultDHCPLeaseTime = 24 * time.Hour
+
+// startDHCPServers starts the built-in DHCP servers configured in [dhcp_server] sections.
+// Lease files of the servers are added to the client info table, so leased clients are
+// discovered like ones from other DHCP servers.
+func (p *prog) startDHCPServers() {
+	for n, dc := range p.cfg.DHCPServer {
+		cfg, err := newDHCPServerConfig(dc)
+		if err != nil {
+			mainLog.Load().Error().Err(err).Msgf("invalid dhcp_server.%s config", n)
+			continue
+		}
+		cfg.OnFingerprint = func(fp dhcpserver.Fingerprint) {
+			p.ciTable.StoreFingerprint(fp.Mac, fp.Options, fp.VendorClass, fp.Hostname)
+		}
+		s, err := dhcpserver.New(cfg)
+		if err != nil {
+			mainLog.Load().Error().Err(err).Msgf("could not start dhcp_server.%s", n)
+			continue
+		}
+		p.ciTable.AddLeaseFile(cfg.LeaseFile, ctrld.Dnsmasq)
+		mainLog.Load().Notice().Msgf("starting dhcp server on %s, range: %s - %s", cfg.Interface, cfg.RangeStart, cfg.RangeEnd)
+		go func() {
+			<-p.stopCh
+			_ = s.Close()
+		}()
+		go func() {
+			if err := s.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+				mainLog.Load().Error().Err(err).Msgf("dhcp server on %s stopped", cfg.Interface)
+			}
+		}()
+	}
+}
+
+// newDHCPServerConfig returns the DHCP server config from dc. The server IP and subnet mask
+// are the IPv4 address of the interface, which is also the default router and DNS server.
+func newDHCPServerConfig(dc *ctrld.DHCPServerConfig) (*dhcpserver.Config, error) {
+	iface, err := net.InterfaceByName(dc.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ipNet *net.IPNet
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil {
+			ipNet = n
+			break
+		}
+	}
+	if ipNet == nil {
+		return nil, fmt.Errorf("interface %s does not have IPv4 address", dc.Interface)
+	}
+	serverIP, _ := netip.AddrFromSlice(ipNet.IP.To4())
+	cfg := &dhcpserver.Config{
+		Interface:    dc.Interface,
+		ServerIP:     serverIP,
+		SubnetMask:   ipNet.Mask,
+		RangeStart:   netip.MustParseAddr(dc.RangeStart),
+		RangeEnd:     netip.MustParseAddr(dc.RangeEnd),
+		Router:       []net.IP{ipNet.IP.To4()},
+		DNS:          []net.IP{ipNet.IP.To4()},
+		Domain:       dc.Domain,
+		LeaseTime:    defaultDHCPLeaseTime,
+		LeaseFile:    dc.LeaseFile,
+		Reservations: make(map[string]netip.Addr, len(dc.Reservations)),
+	}
+	for _, r := range dc.Reservations {
+		hw, _ := net.ParseMAC(r.Mac)
+		cfg.Reservations[hw.String()] = netip.MustParseAddr(r.IP)
+	}
+	cfgAddrs := []netip.Addr{cfg.RangeStart, cfg.RangeEnd}
+	for _, ip := range cfg.Reservations {
+		cfgAddrs = append(cfgAddrs, ip)
+	}
+	for _, ip := range cfgAddrs {
+		if !ipNet.Contains(ip.AsSlice()) {
+			return nil, fmt.Errorf("%s is not in the subnet of %s: %s", ip, dc.Interface, ipNet)
+		}
+	}
+	if dc.Router != "" {
+		cfg.Router = []net.IP{net.ParseIP(dc.Router)}
+	}
+	if len(dc.DNS) > 0 {
+		cfg.DNS = cfg.DNS[:0]
+		for _, ns := range dc.DNS {
+			cfg.DNS = append(cfg.DNS, net.ParseIP(ns))
+		}
+	}
+	if dc.LeaseTime > 0 {
+		cfg.LeaseTime = time.Duration(dc.LeaseTime) * time.Second
+	}
+	if cfg.LeaseFile == "" {
+		cfg.LeaseFile = absHomeDir(fmt.Sprintf("ctrld-dhcp-%s.leases", dc.Interface))
+	}
+	return cfg, nil
+}
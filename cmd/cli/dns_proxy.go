@@ -1,20 +1,25 @@
 package cli
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/netutil"
 	"golang.org/x/sync/errgroup"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netaddr"
@@ -28,10 +33,29 @@ import (
 const (
 	staleTTL = 60 * time.Second
 	localTTL = 3600 * time.Second
+	// outageTTL is the TTL of answers sent to clients while all upstreams are down,
+	// so clients will retry soon once the connectivity comes back.
+	outageTTL = 10 * time.Second
+	// defaultOfflineMaxStale is the maximum time an answer could be served after it expired,
+	// while all upstreams are unreachable, if not configured.
+	defaultOfflineMaxStale = 24 * time.Hour
+	// staleRefreshTimeout is the maximum time a background refresh of a stale cached answer could take,
+	// so refreshes do not pile up on unresponsive upstreams.
+	staleRefreshTimeout = 5 * time.Second
+	// maxRetryBackoff is the maximum delay before retrying a failed query to an upstream.
+	maxRetryBackoff = 5 * time.Second
+	// deviceTagPrefix is the prefix of implicit client tags for device classes, e.g: "device:printer".
+	deviceTagPrefix = "device:"
+	// defaultLanDomain is the default domain suffix of LAN clients' hostnames.
+	defaultLanDomain = "lan"
 	// EDNS0_OPTION_MAC is dnsmasq EDNS0 code for adding mac option.
 	// https://thekelleys.org.uk/gitweb/?p=dnsmasq.git;a=blob;f=src/dns-protocol.h;h=76ac66a8c28317e9c121a74ab5fd0e20f6237dc8;hb=HEAD#l81
 	// This is also dns.EDNS0LOCALSTART, but define our own constant here for clarification.
 	EDNS0_OPTION_MAC = 0xFDE9
+	// EDNS0_OPTION_NOMDEVICEID is dnsmasq EDNS0 code for adding mac option in base64 or text form.
+	EDNS0_OPTION_NOMDEVICEID = 0xFE31
+	// EDNS0_OPTION_TRACE is ctrld EDNS0 code for requesting the decision path of a query.
+	EDNS0_OPTION_TRACE = 0xFDEA
 )
 
 var osUpstreamConfig = &ctrld.UpstreamConfig{
@@ -51,7 +75,15 @@ type proxyRequest struct {
 	msg            *dns.Msg
 	ci             *ctrld.ClientInfo
 	failoverRcodes []int
-	ufr            *upstreamForResult
+	loadBalance    string
+	// raceUpstreams is the number of upstreams which the query is sent to at once, in race load balancing.
+	raceUpstreams     int
+	raceCacheMissOnly bool
+	ufr               *upstreamForResult
+	// refresh indicates that the request is refreshing a stale cached answer in background.
+	refresh bool
+	// prefetch indicates that the request is refreshing a popular cached answer before it expires.
+	prefetch bool
 }
 
 // proxyResponse contains data for proxying a DNS response from upstream.
@@ -70,6 +102,23 @@ type upstreamForResult struct {
 	matchedRule    string
 	matched        bool
 	srcAddr        string
+	// loadBalance is the load balancing strategy of the upstream group, which the query is sent to.
+	// It takes precedence over the policy one.
+	loadBalance string
+	// policyConfig is the listener policy applied to the query, nil if there is none.
+	policyConfig *ctrld.ListenerPolicyConfig
+}
+
+// policy returns human-readable format of the policy matched by the request,
+// or empty string if no policy was matched.
+func (ur *upstreamForResult) policy() string {
+	if !ur.matched {
+		return ""
+	}
+	if ur.matchedRule != "no rule" {
+		return fmt.Sprintf("%s: %s", ur.matchedPolicy, ur.matchedRule)
+	}
+	return fmt.Sprintf("%s: %s", ur.matchedPolicy, ur.matchedNetwork)
 }
 
 func (p *prog) serveDNS(listenerNum string) error {
@@ -81,6 +130,17 @@ func (p *prog) serveDNS(listenerNum string) error {
 	}
 
 	handler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		if !listenerAllowsClient(listenerConfig, w.RemoteAddr()) {
+			mainLog.Load().Debug().Msgf("query from %s denied by listener.%s acl", w.RemoteAddr(), listenerNum)
+			if listenerConfig.ACLAction == ctrld.ACLActionDrop {
+				_ = w.Close()
+				return
+			}
+			answer := new(dns.Msg)
+			answer.SetRcode(m, dns.RcodeRefused)
+			_ = w.WriteMsg(answer)
+			return
+		}
 		p.sema.acquire()
 		defer p.sema.release()
 		if len(m.Question) == 0 {
@@ -105,14 +165,43 @@ func (p *prog) serveDNS(listenerNum string) error {
 		ci := p.getClientInfo(remoteIP, m)
 		ci.ClientIDPref = p.cfg.Service.ClientIDPref
 		stripClientSubnet(m)
+		// Roaming clients get answers for the home network, like they would on the LAN.
+		wanClientSubnet := listenerConfig.WanClientSubnet != "" && isWanClient(w.RemoteAddr())
+		clientEdns := m.IsEdns0() != nil
+		if wanClientSubnet {
+			setClientSubnet(m, listenerConfig.WanClientSubnet)
+		}
+		if p.cfg.Service.Edns0MacStrip {
+			stripClientMac(m, p.cfg.Service.Edns0MacOptions...)
+		}
 		remoteAddr := spoofRemoteAddr(w.RemoteAddr(), ci)
+		var (
+			trace    *ctrld.QueryTrace
+			traceReq *dns.Msg // The magic trace query, nil if trace was requested by EDNS0 option.
+		)
+		if p.cfg.Service.DebugQuery {
+			if target, ok := parseTraceQuery(m); ok {
+				trace, traceReq = &ctrld.QueryTrace{}, m
+				m = traceTargetMsg(m, target)
+				q = m.Question[0]
+				domain = canonicalName(q.Name)
+			} else if popTraceOption(m) {
+				trace = &ctrld.QueryTrace{}
+			}
+			if trace != nil {
+				ctx = context.WithValue(ctx, ctrld.TraceCtxKey{}, trace)
+				ctrld.Log(ctx, mainLog.Load().Debug(), "client info: ip=%s, mac=%s, hostname=%s", ci.IP, ci.Mac, ci.Hostname)
+			}
+		}
 		fmtSrcToDest := fmtRemoteToLocal(listenerNum, ci.Hostname, remoteAddr.String())
 		t := time.Now()
 		ctrld.Log(ctx, mainLog.Load().Info(), "QUERY: %s: %s %s", fmtSrcToDest, dns.TypeToString[q.Qtype], domain)
+		p.mirror.Load().mirror(m)
 		ur := p.upstreamFor(ctx, listenerNum, listenerConfig, remoteAddr, ci.Mac, domain)
+		p.ciTable.RecordQuery(ci.IP, "listener."+listenerNum, ur.policy())
 
 		labelValues := make([]string, 0, len(statsQueriesCountLabels))
-		labelValues = append(labelValues, net.JoinHostPort(listenerConfig.IP, strconv.Itoa(listenerConfig.Port)))
+		labelValues = append(labelValues, listenerConfig.Addr())
 		labelValues = append(labelValues, ci.IP)
 		labelValues = append(labelValues, ci.Mac)
 		labelValues = append(labelValues, ci.Hostname)
@@ -123,18 +212,36 @@ func (p *prog) serveDNS(listenerNum string) error {
 			answer = new(dns.Msg)
 			answer.SetRcode(m, dns.RcodeRefused)
 			labelValues = append(labelValues, "") // no upstream
+		} else if traceReq != nil && domain == traceDomain {
+			// Nothing to resolve, only client info and policy are traced.
+			ctrld.Log(ctx, mainLog.Load().Debug(), "%s, %s, %s -> %v", ur.matchedPolicy, ur.matchedNetwork, ur.matchedRule, ur.upstreams)
+			answer = new(dns.Msg)
+			answer.SetReply(m)
+			labelValues = append(labelValues, "") // no upstream
 		} else {
 			var failoverRcode []int
-			if listenerConfig.Policy != nil {
-				failoverRcode = listenerConfig.Policy.FailoverRcodeNumbers
+			var loadBalance string
+			var raceUpstreams int
+			var raceCacheMissOnly bool
+			if policy := ur.policyConfig; policy != nil {
+				failoverRcode = policy.FailoverRcodeNumbers
+				loadBalance = policy.LoadBalance
+				raceUpstreams = policy.RaceUpstreams
+				raceCacheMissOnly = policy.RaceCacheMissOnly
 			}
 			pr := p.proxy(ctx, &proxyRequest{
-				msg:            m,
-				ci:             ci,
-				failoverRcodes: failoverRcode,
-				ufr:            ur,
+				msg:               m,
+				ci:                ci,
+				failoverRcodes:    failoverRcode,
+				loadBalance:       loadBalance,
+				raceUpstreams:     raceUpstreams,
+				raceCacheMissOnly: raceCacheMissOnly,
+				ufr:               ur,
 			})
 			answer = pr.answer
+			if ur.policyConfig != nil {
+				answer = stripSvcParams(answer, ur.policyConfig.StripSvcParams)
+			}
 			rtt := time.Since(t)
 			ctrld.Log(ctx, mainLog.Load().Debug(), "received response of %d bytes in %s", answer.Len(), rtt)
 			upstream := pr.upstream
@@ -152,17 +259,45 @@ func (p *prog) serveDNS(listenerNum string) error {
 			p.WithLabelValuesInc(statsQueriesCount, labelValues...)
 			p.WithLabelValuesInc(statsClientQueriesCount, []string{ci.IP, ci.Mac, ci.Hostname}...)
 		}()
+		if wanClientSubnet {
+			// The client subnet was not sent by client, do not leak it back.
+			removeClientSubnet(answer)
+			// Nor the OPT record added for it, see RFC 6891 section 7.
+			if !clientEdns {
+				removeOpt(answer)
+			}
+		}
+		if trace != nil {
+			answer = traceAnswer(traceReq, answer, trace)
+			if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+				answer.Truncate(udpSize(traceReq, m))
+			}
+		}
 		if err := w.WriteMsg(answer); err != nil {
 			ctrld.Log(ctx, mainLog.Load().Error().Err(err), "serveDNS: failed to send DNS response to client")
 		}
 	})
 
+	switch listenerConfig.Type {
+	case ctrld.ListenerTypeDOH:
+		return p.serveDoH(listenerConfig, handler)
+	case ctrld.ListenerTypeDOT:
+		return p.serveDoT(listenerConfig, handler)
+	case ctrld.ListenerTypeDOQ:
+		return p.serveDoQ(listenerConfig, handler)
+	case ctrld.ListenerTypeUnix:
+		return p.serveUnix(listenerConfig, handler)
+	}
+	if len(listenerConfig.Bind) > 0 {
+		return p.serveBind(listenerConfig, handler)
+	}
+
 	g, ctx := errgroup.WithContext(context.Background())
 	for _, proto := range []string{"udp", "tcp"} {
 		proto := proto
 		if needLocalIPv6Listener() {
 			g.Go(func() error {
-				s, errCh := runDNSServer(net.JoinHostPort("::1", strconv.Itoa(listenerConfig.Port)), proto, handler)
+				s, errCh := runListenerDNSServer(listenerConfig, net.JoinHostPort("::1", strconv.Itoa(listenerConfig.Port)), proto, handler)
 				defer s.Shutdown()
 				select {
 				case <-p.stopCh:
@@ -182,7 +317,7 @@ func (p *prog) serveDNS(listenerNum string) error {
 				for _, addr := range ctrld.Rfc1918Addresses() {
 					func() {
 						listenAddr := net.JoinHostPort(addr, strconv.Itoa(listenerConfig.Port))
-						s, errCh := runDNSServer(listenAddr, proto, handler)
+						s, errCh := runListenerDNSServer(listenerConfig, listenAddr, proto, handler)
 						defer s.Shutdown()
 						select {
 						case <-p.stopCh:
@@ -199,7 +334,7 @@ func (p *prog) serveDNS(listenerNum string) error {
 		}
 		g.Go(func() error {
 			addr := net.JoinHostPort(listenerConfig.IP, strconv.Itoa(listenerConfig.Port))
-			s, errCh := runDNSServer(addr, proto, handler)
+			s, errCh := runListenerDNSServer(listenerConfig, addr, proto, handler)
 			defer s.Shutdown()
 			select {
 			case err := <-errCh:
@@ -221,13 +356,17 @@ func (p *prog) serveDNS(listenerNum string) error {
 
 // upstreamFor returns the list of upstreams for resolving the given domain,
 // matching by policies defined in the listener config. The second return value
-// reports whether the domain matches the policy.
+// reports whether the domain matches the policy. The policy is the first client
+// policy matching the client, falling back to the listener policy.
 //
 // Though domain policy has higher priority than network policy, it is still
 // processed later, because policy logging want to know whether a network rule
 // is disregarded in favor of the domain level rule.
 func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *ctrld.ListenerConfig, addr net.Addr, srcMac, domain string) (res *upstreamForResult) {
 	upstreams := []string{upstreamPrefix + defaultUpstreamNum}
+	if lc.UpstreamGroup != "" {
+		upstreams = []string{ctrld.UpstreamGroupPrefix + lc.UpstreamGroup}
+	}
 	matchedPolicy := "no policy"
 	matchedNetwork := "no network"
 	matchedRule := "no rule"
@@ -235,32 +374,35 @@ func (p *prog) upstreamFor(ctx context.Context, defaultUpstreamNum string, lc *c
 	res = &upstreamForResult{srcAddr: addr.String()}
 
 	defer func() {
-		res.upstreams = upstreams
+		res.upstreams, res.loadBalance = p.expandUpstreamGroups(upstreams)
 		res.matched = matched
 		res.matchedPolicy = matchedPolicy
 		res.matchedNetwork = matchedNetwork
 		res.matchedRule = matchedRule
 	}()
 
-	if lc.Policy == nil {
+	var sourceIP net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		sourceIP = addr.IP
+	case *net.TCPAddr:
+		sourceIP = addr.IP
+	}
+	srcIP, _ := netip.AddrFromSlice(sourceIP)
+	policy := lc.PolicyFor(srcIP, srcMac)
+	if policy == nil {
 		return
 	}
+	res.policyConfig = policy
 
 	do := func(policyUpstreams []string) {
 		upstreams = append([]string(nil), policyUpstreams...)
 	}
 
 	var networkTargets []string
-	var sourceIP net.IP
-	switch addr := addr.(type) {
-	case *net.UDPAddr:
-		sourceIP = addr.IP
-	case *net.TCPAddr:
-		sourceIP = addr.IP
-	}
 
 networkRules:
-	for _, rule := range lc.Policy.Networks {
+	for _, rule := range policy.Networks {
 		for source, targets := range rule {
 			networkNum := strings.TrimPrefix(source, "network.")
 			nc := p.cfg.Network[networkNum]
@@ -269,7 +411,7 @@ networkRules:
 			}
 			for _, ipNet := range nc.IPNets {
 				if ipNet.Contains(sourceIP) {
-					matchedPolicy = lc.Policy.Name
+					matchedPolicy = policy.Name
 					matchedNetwork = source
 					networkTargets = targets
 					matched = true
@@ -279,11 +421,37 @@ networkRules:
 		}
 	}
 
+	if len(policy.Tags) > 0 {
+		var ip string
+		if sourceIP != nil {
+			ip = sourceIP.String()
+		}
+		var tags []string
+		if cc := p.cfg.LookupClient(ip, srcMac); cc != nil && cc.Tag != "" {
+			tags = append(tags, cc.Tag)
+		}
+		if class := p.ciTable.LookupDeviceClass(srcMac); class != "" {
+			tags = append(tags, deviceTagPrefix+class)
+		}
+	tagRules:
+		for _, rule := range policy.Tags {
+			for source, targets := range rule {
+				if slices.Contains(tags, source) {
+					matchedPolicy = policy.Name
+					matchedNetwork = source
+					networkTargets = targets
+					matched = true
+					break tagRules
+				}
+			}
+		}
+	}
+
 macRules:
-	for _, rule := range lc.Policy.Macs {
+	for _, rule := range policy.Macs {
 		for source, targets := range rule {
 			if source != "" && strings.EqualFold(source, srcMac) {
-				matchedPolicy = lc.Policy.Name
+				matchedPolicy = policy.Name
 				matchedNetwork = source
 				networkTargets = targets
 				matched = true
@@ -292,11 +460,11 @@ macRules:
 		}
 	}
 
-	for _, rule := range lc.Policy.Rules {
+	if i := p.matchRule(policy, domain); i != -1 {
 		// There's only one entry per rule, config validation ensures this.
-		for source, targets := range rule {
-			if source == domain || wildcardMatches(source, domain) {
-				matchedPolicy = lc.Policy.Name
+		for source, targets := range policy.Rules[i] {
+			if ruleMatches(policy.RuleIndex(), source, domain) {
+				matchedPolicy = policy.Name
 				if len(networkTargets) > 0 {
 					matchedNetwork += " (unenforced)"
 				}
@@ -324,6 +492,10 @@ func (p *prog) proxyPrivatePtrLookup(ctx context.Context, msg *dns.Msg) *dns.Msg
 	}
 	ip := ipFromARPA(cDomainName)
 	if name := p.ciTable.LookupHostname(ip.String(), ""); name != "" {
+		ptr := name
+		if p.cfg.Service.LanRecords && !strings.Contains(name, ".") {
+			ptr = name + "." + p.lanDomain()
+		}
 		answer := new(dns.Msg)
 		answer.SetReply(msg)
 		answer.Compress = true
@@ -333,7 +505,7 @@ func (p *prog) proxyPrivatePtrLookup(ctx context.Context, msg *dns.Msg) *dns.Msg
 				Rrtype: dns.TypePTR,
 				Class:  dns.ClassINET,
 			},
-			Ptr: dns.Fqdn(name),
+			Ptr: dns.Fqdn(ptr),
 		}}
 		ctrld.Log(ctx, mainLog.Load().Info(), "private PTR lookup, using client info table")
 		ctrld.Log(ctx, mainLog.Load().Debug(), "client info: %v", ctrld.ClientInfo{
@@ -354,7 +526,13 @@ func (p *prog) proxyLanHostnameQuery(ctx context.Context, msg *dns.Msg) *dns.Msg
 	if !locked {
 		return nil
 	}
-	if ip := p.ciTable.LookupIPByHostname(hostname, q.Qtype == dns.TypeAAAA); ip != nil {
+	ip := p.ciTable.LookupIPByHostname(hostname, q.Qtype == dns.TypeAAAA)
+	if ip == nil {
+		if name, ok := trimLanDomain(hostname, p.lanDomain()); ok {
+			ip = p.ciTable.LookupIPByHostname(name, q.Qtype == dns.TypeAAAA)
+		}
+	}
+	if ip != nil {
 		answer := new(dns.Msg)
 		answer.SetReply(msg)
 		answer.Compress = true
@@ -391,8 +569,30 @@ func (p *prog) proxyLanHostnameQuery(ctx context.Context, msg *dns.Msg) *dns.Msg
 	return nil
 }
 
+// lanRecordsAnswer returns the answer for a LAN records query using client info table,
+// or nil if msg is not a LAN records query, or the client is unknown.
+func (p *prog) lanRecordsAnswer(ctx context.Context, msg *dns.Msg) *dns.Msg {
+	switch {
+	case isPrivatePtrLookup(msg):
+		return p.proxyPrivatePtrLookup(ctx, msg)
+	case isLanRecordQuery(msg, p.lanDomain()):
+		return p.proxyLanHostnameQuery(ctx, msg)
+	}
+	return nil
+}
+
+// lanDomain returns the domain suffix of LAN clients' hostnames.
+func (p *prog) lanDomain() string {
+	if domain := strings.Trim(p.cfg.Service.LanDomain, "."); domain != "" {
+		return strings.ToLower(domain)
+	}
+	return defaultLanDomain
+}
+
 func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 	var staleAnswer *dns.Msg
+	var staleValue *dnscache.Value
+	var staleExpire time.Time
 	upstreams := req.ufr.upstreams
 	serveStaleCache := p.cache != nil && p.cfg.Service.CacheServeStale
 	upstreamConfigs := p.upstreamConfigsFromUpstreamNumbers(upstreams)
@@ -403,6 +603,14 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 
 	res := &proxyResponse{}
 
+	if p.cfg.Service.LanRecords {
+		if answer := p.lanRecordsAnswer(ctx, req.msg); answer != nil {
+			res.answer = answer
+			res.clientInfo = true
+			return res
+		}
+	}
+
 	// LAN/PTR lookup flow:
 	//
 	// 1. If there's matching rule, follow it.
@@ -410,9 +618,15 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 	// 3. Try private resolver.
 	// 4. Try remote upstream.
 	isLanOrPtrQuery := false
-	if req.ufr.matched {
+	switch {
+	case p.mdnsUpstream != "" && req.ufr.matchedRule == "no rule" && isMDNSQuery(req.msg):
+		// Names in LAN must not leak to remote upstreams, unless a domain rule says so.
+		upstreams = []string{p.mdnsUpstream}
+		upstreamConfigs = p.upstreamConfigsFromUpstreamNumbers(upstreams)
+		ctrld.Log(ctx, mainLog.Load().Debug(), "mDNS query, using upstream: %v", upstreams)
+	case req.ufr.matched:
 		ctrld.Log(ctx, mainLog.Load().Debug(), "%s, %s, %s -> %v", req.ufr.matchedPolicy, req.ufr.matchedNetwork, req.ufr.matchedRule, upstreams)
-	} else {
+	default:
 		switch {
 		case isPrivatePtrLookup(req.msg):
 			isLanOrPtrQuery = true
@@ -437,49 +651,123 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 		}
 	}
 
+	// Pins are looked up for the upstreams the query is routed to, so policies, mDNS and LAN handling still apply.
+	if answer := p.pins.get(req.msg, upstreams, time.Now()); answer != nil {
+		ctrld.Log(ctx, mainLog.Load().Debug(), "serving pinned answer")
+		res.answer = answer
+		res.upstream = "pinned"
+		return res
+	}
+
 	// Inverse query should not be cached: https://www.rfc-editor.org/rfc/rfc1035#section-7.4
-	if p.cache != nil && req.msg.Question[0].Qtype != dns.TypePTR {
+	cacheable := p.cache != nil && req.msg.Question[0].Qtype != dns.TypePTR && !p.bypassCache(req.msg)
+	if cacheable && !req.prefetch {
 		for _, upstream := range upstreams {
-			cachedValue := p.cache.Get(dnscache.NewKey(req.msg, upstream))
+			cachedValue := dnscache.Get(p.cache, req.msg, upstream)
 			if cachedValue == nil {
 				continue
 			}
 			answer := cachedValue.Msg.Copy()
 			answer.SetRcode(req.msg, answer.Rcode)
+			dnscache.EchoClientSubnet(req.msg, answer)
 			now := time.Now()
 			if cachedValue.Expire.After(now) {
 				ctrld.Log(ctx, mainLog.Load().Debug(), "hit cached response")
-				setCachedAnswerTTL(answer, now, cachedValue.Expire)
+				p.setCacheHitTTL(answer, now, cachedValue.Expire)
+				// During outage, do not let clients cache long TTLs obtained just before it.
+				if p.um.allDown(upstreams) && cachedValue.Expire.After(now.Add(outageTTL)) {
+					capAnswerTTL(answer, outageTTL)
+					setOutageEDE(req.msg, answer)
+				}
+				p.prefetchIfPopular(ctx, req, cachedValue, now)
+				p.recordCacheLookup(req.msg, true)
 				res.answer = answer
 				res.cached = true
 				return res
 			}
 			staleAnswer = answer
+			staleValue = cachedValue
+			staleExpire = cachedValue.Expire
+		}
+		// The client lookup which triggered the refresh was already recorded.
+		if !req.refresh {
+			p.recordCacheLookup(req.msg, false)
 		}
 	}
-	resolve1 := func(n int, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) (*dns.Msg, error) {
+	if staleAnswer != nil && p.cacheLatencyBudget() > 0 && !req.refresh && p.withinMaxStale(staleExpire) {
+		return p.proxyWithLatencyBudget(ctx, req, staleValue, staleAnswer)
+	}
+	resolve1 := func(ctx context.Context, n int, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) (*dns.Msg, error) {
 		ctrld.Log(ctx, mainLog.Load().Debug(), "sending query to %s: %s", upstreams[n], upstreamConfig.Name)
 		dnsResolver, err := ctrld.NewResolver(upstreamConfig)
 		if err != nil {
 			ctrld.Log(ctx, mainLog.Load().Error().Err(err), "failed to create resolver")
 			return nil, err
 		}
-		resolveCtx, cancel := context.WithCancel(ctx)
-		defer cancel()
-		if upstreamConfig.Timeout > 0 {
-			timeoutCtx, cancel := context.WithTimeout(resolveCtx, time.Millisecond*time.Duration(upstreamConfig.Timeout))
+		resolveOnce := func() (*dns.Msg, error) {
+			resolveCtx, cancel := context.WithCancel(ctx)
 			defer cancel()
-			resolveCtx = timeoutCtx
+			if upstreamConfig.Timeout > 0 {
+				timeoutCtx, cancel := context.WithTimeout(resolveCtx, time.Millisecond*time.Duration(upstreamConfig.Timeout))
+				defer cancel()
+				resolveCtx = timeoutCtx
+			}
+			return dnsResolver.Resolve(resolveCtx, msg)
+		}
+		for attempt := 0; ; attempt++ {
+			answer, err := resolveOnce()
+			if err == nil || attempt >= upstreamConfig.Retries || ctx.Err() != nil {
+				return answer, err
+			}
+			backoff := retryBackoff(upstreamConfig, attempt)
+			ctrld.Log(ctx, mainLog.Load().Debug().Err(err), "retrying query to %s in %s", upstreams[n], backoff)
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(backoff):
+			}
 		}
-		return dnsResolver.Resolve(resolveCtx, msg)
 	}
-	resolve := func(n int, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) *dns.Msg {
+	resolve := func(ctx context.Context, n int, upstreamConfig *ctrld.UpstreamConfig, msg *dns.Msg) *dns.Msg {
 		if upstreamConfig.UpstreamSendClientInfo() && req.ci != nil {
 			ctrld.Log(ctx, mainLog.Load().Debug(), "including client info with the request")
 			ctx = context.WithValue(ctx, ctrld.ClientInfoCtxKey{}, req.ci)
 		}
-		answer, err := resolve1(n, upstreamConfig, msg)
+		msg, restore := upstreamConfig.RewriteQuery(msg)
+		if restore != nil {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "rewrite query: %s -> %s", req.msg.Question[0].Name, msg.Question[0].Name)
+		}
+		msg = upstreamConfig.LimitMsgSize(msg)
+		var ci *ctrld.ClientInfo
+		if upstreamConfig.UpstreamSendClientInfo() {
+			ci = req.ci
+		}
+		start := time.Now()
+		answer, shared, err := p.qg.do(ctx, queryGroupKey(upstreams[n], msg, ci), func(ctx context.Context) (*dns.Msg, error) {
+			return resolve1(ctx, n, upstreamConfig, msg)
+		})
+		if answer != nil {
+			answer.Id = msg.Id
+		}
+		if restore != nil {
+			restore(answer)
+		}
+		// The upstream health is recorded by the client which sent the query only.
+		if shared {
+			if err != nil {
+				ctrld.Log(ctx, mainLog.Load().Debug().Err(err), "shared query to %s failed", upstreams[n])
+				return nil
+			}
+			ctrld.Log(ctx, mainLog.Load().Debug(), "shared in-flight query to %s", upstreams[n])
+			return answer
+		}
 		if err != nil {
+			// Queries canceled because another upstream answered first are not failures.
+			if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+				return nil
+			}
+			p.um.observeLatency(upstreams[n], latencyFailurePenalty)
+			p.um.recordQuery(upstreams[n], false)
 			ctrld.Log(ctx, mainLog.Load().Error().Err(err), "failed to resolve query")
 			if errNetworkError(err) {
 				p.um.increaseFailureCount(upstreams[n])
@@ -494,8 +782,66 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 			}
 			return nil
 		}
+		p.um.observeLatency(upstreams[n], time.Since(start))
+		p.um.recordQuery(upstreams[n], true)
 		return answer
 	}
+	loadBalance := req.loadBalance
+	if req.ufr.loadBalance != "" {
+		loadBalance = req.ufr.loadBalance
+	}
+	// LAN/PTR lookups must go to local upstreams first, so they are never re-ordered.
+	if loadBalance == ctrld.LoadBalanceLatency && !isLanOrPtrQuery && len(upstreams) > 1 {
+		upstreams, upstreamConfigs = p.um.sortByLatency(upstreams, upstreamConfigs)
+		ctrld.Log(ctx, mainLog.Load().Debug(), "latency load balancing, using upstreams: %v", upstreams)
+	}
+	raceWinner := -1
+	var raced map[int]bool
+	var raceAnswer *dns.Msg
+	if loadBalance == ctrld.LoadBalanceRace && !isLanOrPtrQuery && !(req.raceCacheMissOnly && staleAnswer != nil) {
+		numRace := req.raceUpstreams
+		if numRace == 0 {
+			numRace = defaultRaceUpstreams
+		}
+		var candidates []int
+		for n, upstreamConfig := range upstreamConfigs {
+			if len(candidates) == numRace {
+				break
+			}
+			if upstreamConfig == nil || p.isLoop(upstreamConfig) || p.um.isDown(upstreams[n]) || p.um.isOpen(upstreams[n]) {
+				continue
+			}
+			candidates = append(candidates, n)
+		}
+		if len(candidates) > 1 {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "racing query to %d upstreams", len(candidates))
+			raced = make(map[int]bool, len(candidates))
+			for _, n := range candidates {
+				raced[n] = true
+			}
+			raceWinner, raceAnswer = raceResolve(ctx, candidates, func(ctx context.Context, n int) *dns.Msg {
+				// The probe of a half-open circuit is consumed only when the query is sent.
+				if !p.um.allowQuery(upstreams[n]) {
+					return nil
+				}
+				return resolve(ctx, n, upstreamConfigs[n], req.msg.Copy())
+			}, func(answer *dns.Msg) bool {
+				return answer.Rcode == dns.RcodeSuccess || !containRcode(req.failoverRcodes, answer.Rcode)
+			})
+			if raceWinner != -1 {
+				ctrld.Log(ctx, mainLog.Load().Debug(), "%s won the race", upstreams[raceWinner])
+			} else {
+				// All raced upstreams failed, handle it like the first one failed, so stale answer could be served.
+				raceWinner = candidates[0]
+			}
+		}
+	}
+	// While failing open, the plain DNS upstream is tried after all others.
+	if p.failOpen.isActive() && !isLanOrPtrQuery && !slices.Contains(upstreams, p.failOpen.name) {
+		ctrld.Log(ctx, mainLog.Load().Debug(), "failing open to %s", p.failOpen.name)
+		upstreams = append(slices.Clip(upstreams), p.failOpen.name)
+		upstreamConfigs = append(slices.Clip(upstreamConfigs), p.failOpen.uc)
+	}
 	for n, upstreamConfig := range upstreamConfigs {
 		if upstreamConfig == nil {
 			continue
@@ -508,12 +854,30 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 			ctrld.Log(ctx, mainLog.Load().Warn(), "%s is down", upstreams[n])
 			continue
 		}
-		answer := resolve(n, upstreamConfig, req.msg)
+		var answer *dns.Msg
+		switch {
+		case n == raceWinner:
+			answer = raceAnswer
+		case raced[n]:
+			// Already tried in the race.
+			continue
+		case !p.um.allowQuery(upstreams[n]):
+			ctrld.Log(ctx, mainLog.Load().Debug(), "circuit breaker of %s is open", upstreams[n])
+			continue
+		default:
+			answer = resolve(ctx, n, upstreamConfig, req.msg)
+		}
 		if answer == nil {
-			if serveStaleCache && staleAnswer != nil {
+			if serveStaleCache && staleAnswer != nil && p.withinMaxStale(staleExpire) {
 				ctrld.Log(ctx, mainLog.Load().Debug(), "serving stale cached response")
 				now := time.Now()
-				setCachedAnswerTTL(staleAnswer, now, now.Add(staleTTL))
+				ttl := staleTTL
+				if p.um.allDown(upstreams) {
+					ttl = outageTTL
+					setOutageEDE(req.msg, staleAnswer)
+				}
+				setCachedAnswerTTL(staleAnswer, now, now.Add(ttl))
+				setStaleEDE(req.msg, staleAnswer, "upstream failed")
 				res.answer = staleAnswer
 				res.cached = true
 				return res
@@ -534,15 +898,20 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 		// set compression, as it is not set by default when unpacking
 		answer.Compress = true
 
-		if p.cache != nil && req.msg.Question[0].Qtype != dns.TypePTR {
+		if cacheable && p.cacheNegativeAnswer(req.msg, answer) {
+			p.clampAnswerTTL(req.msg, answer)
 			ttl := ttlFromMsg(answer)
 			now := time.Now()
 			expired := now.Add(time.Duration(ttl) * time.Second)
-			if cachedTTL := p.cfg.Service.CacheTTLOverride; cachedTTL > 0 {
-				expired = now.Add(time.Duration(cachedTTL) * time.Second)
+			// In strict mode, records keep their original TTLs, which are decremented when served from cache.
+			if !p.cfg.Service.CacheStrictTTL {
+				if cachedTTL := p.cacheTTLOverride(req.msg, answer); cachedTTL > 0 {
+					expired = now.Add(time.Duration(cachedTTL) * time.Second)
+				}
+				setCachedAnswerTTL(answer, now, expired)
 			}
-			setCachedAnswerTTL(answer, now, expired)
-			p.cache.Add(dnscache.NewKey(req.msg, upstreams[n]), dnscache.NewValue(answer, expired))
+			// Caching a copy, so changes to the answer sent to this client do not leak to cached one.
+			dnscache.Add(p.cache, req.msg, answer.Copy(), upstreams[n], expired)
 			ctrld.Log(ctx, mainLog.Load().Debug(), "add cached response")
 		}
 		hostname := ""
@@ -555,12 +924,81 @@ func (p *prog) proxy(ctx context.Context, req *proxyRequest) *proxyResponse {
 		return res
 	}
 	ctrld.Log(ctx, mainLog.Load().Error(), "all %v endpoints failed", upstreams)
-	answer := new(dns.Msg)
-	answer.SetRcode(req.msg, dns.RcodeServerFailure)
-	res.answer = answer
+	if p.inStartupGracePeriod(time.Now()) {
+		if answer := p.resolveStartupGrace(ctx, req.msg); answer != nil {
+			res.answer = answer
+			res.upstream = upstreamOS
+			return res
+		}
+	}
+	if staleAnswer != nil && p.cfg.Service.CacheServeOffline {
+		now := time.Now()
+		if now.Sub(staleExpire) <= p.offlineMaxStale() {
+			ctrld.Log(ctx, mainLog.Load().Debug(), "upstreams unreachable, serving stale cached response")
+			setCachedAnswerTTL(staleAnswer, now, now.Add(outageTTL))
+			setStaleEDE(req.msg, staleAnswer, "upstreams unreachable")
+			res.answer = staleAnswer
+			res.cached = true
+			return res
+		}
+		ctrld.Log(ctx, mainLog.Load().Debug(), "cached response expired %s ago, too stale to be served", now.Sub(staleExpire).Truncate(time.Second))
+	}
+	res.answer = outageAnswer(req.msg)
 	return res
 }
 
+// proxyWithLatencyBudget resolves req using upstreams in background. If upstreams do not answer
+// within the cache latency budget, staleAnswer of staleValue is served instead, and the answer from
+// upstreams is cached when it arrives, so next queries get the fresh one. While the refresh is in
+// progress, other queries of staleValue are answered with staleAnswer right away.
+func (p *prog) proxyWithLatencyBudget(ctx context.Context, req *proxyRequest, staleValue *dnscache.Value, staleAnswer *dns.Msg) *proxyResponse {
+	serveStale := func() *proxyResponse {
+		now := time.Now()
+		setCachedAnswerTTL(staleAnswer, now, now.Add(staleTTL))
+		setStaleEDE(req.msg, staleAnswer, "upstreams did not answer in time")
+		return &proxyResponse{answer: staleAnswer, cached: true}
+	}
+	if !staleValue.StartRefresh() {
+		ctrld.Log(ctx, mainLog.Load().Debug(), "stale cached response is being refreshed, serving it")
+		return serveStale()
+	}
+	refreshReq := *req
+	refreshReq.msg = req.msg.Copy()
+	refreshReq.refresh = true
+	resCh := make(chan *proxyResponse, 1)
+	go func() {
+		defer staleValue.FinishRefresh()
+		// The refresh must complete even if the client request is done.
+		refreshCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), staleRefreshTimeout)
+		defer cancel()
+		resCh <- p.proxy(refreshCtx, &refreshReq)
+	}()
+
+	budget := p.cacheLatencyBudget()
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case res := <-resCh:
+		return res
+	case <-timer.C:
+	}
+	ctrld.Log(ctx, mainLog.Load().Debug(), "upstreams did not answer within %s, serving stale cached response", budget)
+	return serveStale()
+}
+
+// cacheLatencyBudget returns the time upstreams have to answer a query with an expired answer
+// in cache, before the expired answer is served, or 0 if expired answers are not served early.
+func (p *prog) cacheLatencyBudget() time.Duration {
+	return time.Duration(p.cfg.Service.CacheLatencyBudget) * time.Millisecond
+}
+
+// withinMaxStale reports whether an answer expired at expire could still be served stale,
+// according to cache_max_stale.
+func (p *prog) withinMaxStale(expire time.Time) bool {
+	n := p.cfg.Service.CacheMaxStale
+	return n == 0 || time.Since(expire) <= time.Duration(n)*time.Second
+}
+
 func (p *prog) upstreamsAndUpstreamConfigForLanAndPtr(upstreams []string, upstreamConfigs []*ctrld.UpstreamConfig) ([]string, []*ctrld.UpstreamConfig) {
 	if len(p.localUpstreams) > 0 {
 		tmp := make([]string, 0, len(p.localUpstreams)+len(upstreams))
@@ -571,6 +1009,16 @@ func (p *prog) upstreamsAndUpstreamConfigForLanAndPtr(upstreams []string, upstre
 	return append([]string{upstreamOS}, upstreams...), append([]*ctrld.UpstreamConfig{privateUpstreamConfig}, upstreamConfigs...)
 }
 
+// retryBackoff returns the delay before retrying a failed query to upstream, after the given
+// number of retries. The delay is doubled after each retry, up to maxRetryBackoff.
+func retryBackoff(uc *ctrld.UpstreamConfig, retries int) time.Duration {
+	backoff := time.Duration(uc.RetryBackoff) * time.Millisecond
+	for i := 0; i < retries && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
+
 func (p *prog) upstreamConfigsFromUpstreamNumbers(upstreams []string) []*ctrld.UpstreamConfig {
 	upstreamConfigs := make([]*ctrld.UpstreamConfig, 0, len(upstreams))
 	for _, upstream := range upstreams {
@@ -590,6 +1038,40 @@ func canonicalName(fqdn string) string {
 	return q
 }
 
+// ruleMatches reports whether domain matches policy rule source, exactly, with a wildcard,
+// or with a regular expression for "re:" rules, compiled when ri was built.
+func ruleMatches(ri *ctrld.RuleIndex, source, domain string) bool {
+	if re := ri.RegexRule(source); re != nil {
+		return re.MatchString(domain)
+	}
+	return source == domain || wildcardMatches(source, domain)
+}
+
+// matchRule returns the index of the first rule of policy matching domain, which is not out of
+// its schedules, or -1 if there's none.
+func (p *prog) matchRule(policy *ctrld.ListenerPolicyConfig, domain string) int {
+	ri := policy.RuleIndex()
+	matches := func(source, domain string) bool {
+		return ruleMatches(ri, source, domain)
+	}
+	i := ri.Match(policy.Rules, domain, matches)
+	if i == -1 || len(p.cfg.Schedule) == 0 {
+		return i
+	}
+	now := time.Now()
+	active := func(source, domain string) bool {
+		return matches(source, domain) && p.cfg.RuleActive(source, now)
+	}
+	if ctrld.MatchRules(policy.Rules[i:i+1], domain, active) != -1 {
+		return i
+	}
+	// The matched rule is out of its schedules, the following rules are evaluated in order.
+	if j := ctrld.MatchRules(policy.Rules[i+1:], domain, active); j != -1 {
+		return i + 1 + j
+	}
+	return -1
+}
+
 func wildcardMatches(wildcard, domain string) bool {
 	// Wildcard match.
 	wildCardParts := strings.Split(wildcard, "*")
@@ -636,12 +1118,8 @@ func containRcode(rcodes []int, rcode int) bool {
 }
 
 func setCachedAnswerTTL(answer *dns.Msg, now, expiredTime time.Time) {
-	ttlSecs := expiredTime.Sub(now).Seconds()
-	if ttlSecs < 0 {
-		return
-	}
-
-	ttl := uint32(ttlSecs)
+	// Never leave the original TTLs of an expired answer.
+	ttl := uint32(max(expiredTime.Sub(now).Seconds(), 0))
 	for _, rr := range answer.Answer {
 		rr.Header().Ttl = ttl
 	}
@@ -655,14 +1133,93 @@ func setCachedAnswerTTL(answer *dns.Msg, now, expiredTime time.Time) {
 	}
 }
 
+// outageAnswer returns a SERVFAIL answer for the given request, used when all upstreams failed.
+//
+// The answer has no records, since ctrld is not authoritative for any zone, so clients are not
+// told to cache the failure. It carries an EDE "Network Error" (RFC 8914) if the client
+// supports EDNS0.
+func outageAnswer(req *dns.Msg) *dns.Msg {
+	answer := new(dns.Msg)
+	answer.SetRcode(req, dns.RcodeServerFailure)
+	setOutageEDE(req, answer)
+	return answer
+}
+
+// offlineMaxStale returns the maximum time an answer could be served after it expired,
+// while all upstreams are unreachable.
+func (p *prog) offlineMaxStale() time.Duration {
+	if n := p.cfg.Service.CacheOfflineMaxStale; n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultOfflineMaxStale
+}
+
+// setStaleEDE adds EDE "Stale Answer", or "Stale NXDOMAIN Answer" for NXDOMAIN answers, to answer
+// which is served from cache after it expired, if the request supports EDNS0.
+func setStaleEDE(req, answer *dns.Msg, text string) {
+	code := dns.ExtendedErrorCodeStaleAnswer
+	if answer.Rcode == dns.RcodeNameError {
+		code = dns.ExtendedErrorCodeStaleNXDOMAINAnswer
+	}
+	setEDE(req, answer, code, text)
+}
+
+// setOutageEDE adds EDE "Network Error" to answer, if the request supports EDNS0.
+func setOutageEDE(req, answer *dns.Msg) {
+	setEDE(req, answer, dns.ExtendedErrorCodeNetworkError, "upstreams unreachable")
+}
+
+// setEDE adds an EDE (RFC 8914) with given info code and text to answer, if the request supports
+// EDNS0, and answer does not have an EDE with the same info code yet.
+func setEDE(req, answer *dns.Msg, code uint16, text string) {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+	opt := answer.IsEdns0()
+	if opt == nil {
+		answer.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = answer.IsEdns0()
+	}
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == code {
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// ttlFromMsg returns the TTL of msg, which is the minimum TTL of records in answer section,
+// or the negative TTL for negative answers, see negativeTTL. For SVCB/HTTPS answers, records
+// in additional section are also counted, since they are address hints of the service targets.
 func ttlFromMsg(msg *dns.Msg) uint32 {
-	for _, rr := range msg.Answer {
-		return rr.Header().Ttl
+	if len(msg.Answer) == 0 {
+		return negativeTTL(msg)
 	}
-	for _, rr := range msg.Ns {
-		return rr.Header().Ttl
+	ttl, _ := minTTL(msg.Answer)
+	if isSvcbMsg(msg) {
+		if extraTTL, ok := minTTL(msg.Extra); ok {
+			ttl = min(ttl, extraTTL)
+		}
+	}
+	return ttl
+}
+
+// minTTL returns the minimum TTL of rrs, OPT records are ignored.
+// It reports false if there is no records.
+func minTTL(rrs []dns.RR) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
 	}
-	return 0
+	return ttl, found
 }
 
 func needLocalIPv6Listener() bool {
@@ -672,14 +1229,15 @@ func needLocalIPv6Listener() bool {
 }
 
 // ipAndMacFromMsg extracts IP and MAC information included in a DNS message, if any.
-func ipAndMacFromMsg(msg *dns.Msg) (string, string) {
+// The macCodes are additional EDNS0 option codes which carry MAC address.
+func ipAndMacFromMsg(msg *dns.Msg, macCodes ...uint16) (string, string) {
 	ip, mac := "", ""
 	if opt := msg.IsEdns0(); opt != nil {
 		for _, s := range opt.Option {
 			switch e := s.(type) {
 			case *dns.EDNS0_LOCAL:
-				if e.Code == EDNS0_OPTION_MAC {
-					mac = net.HardwareAddr(e.Data).String()
+				if isMacOption(e.Code, macCodes) && mac == "" {
+					mac = macFromEdns0(e.Data)
 				}
 			case *dns.EDNS0_SUBNET:
 				if len(e.Address) > 0 && !e.Address.IsLoopback() {
@@ -708,6 +1266,102 @@ func stripClientSubnet(msg *dns.Msg) {
 	}
 }
 
+// setClientSubnet sets EDNS0_SUBNET of DNS message to the given CIDR, replacing the one sent by client, if any.
+// If the message does not have an OPT record, one is added, keeping the client's 512 bytes limit.
+func setClientSubnet(msg *dns.Msg, cidr string) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return
+	}
+	prefix = prefix.Masked()
+	family := uint16(1)
+	if prefix.Addr().Is6() {
+		family = 2
+	}
+	removeClientSubnet(msg)
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.MinMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       prefix.Addr().AsSlice(),
+	})
+}
+
+// removeClientSubnet removes all EDNS0_SUBNET options from DNS message.
+func removeClientSubnet(msg *dns.Msg) {
+	if opt := msg.IsEdns0(); opt != nil {
+		opts := make([]dns.EDNS0, 0, len(opt.Option))
+		for _, s := range opt.Option {
+			if _, ok := s.(*dns.EDNS0_SUBNET); ok {
+				continue
+			}
+			opts = append(opts, s)
+		}
+		opt.Option = opts
+	}
+}
+
+// removeOpt removes the OPT record from DNS message, for answering clients which did not
+// send an OPT record in their query.
+func removeOpt(msg *dns.Msg) {
+	extra := make([]dns.RR, 0, len(msg.Extra))
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	msg.Extra = extra
+}
+
+// stripClientMac removes EDNS0 options which carry client MAC address from DNS message.
+func stripClientMac(msg *dns.Msg, macCodes ...uint16) {
+	if opt := msg.IsEdns0(); opt != nil {
+		opts := make([]dns.EDNS0, 0, len(opt.Option))
+		for _, s := range opt.Option {
+			if e, ok := s.(*dns.EDNS0_LOCAL); ok && isMacOption(e.Code, macCodes) {
+				continue
+			}
+			opts = append(opts, s)
+		}
+		if len(opts) != len(opt.Option) {
+			opt.Option = opts
+		}
+	}
+}
+
+// isMacOption reports whether the EDNS0 option code carries client MAC address.
+func isMacOption(code uint16, macCodes []uint16) bool {
+	return code == EDNS0_OPTION_MAC || code == EDNS0_OPTION_NOMDEVICEID || slices.Contains(macCodes, code)
+}
+
+// macFromEdns0 returns the normalized MAC address from EDNS0 option data, which could be
+// in binary, text or base64 form. It returns empty string if data is not a valid MAC address.
+func macFromEdns0(data []byte) string {
+	var hw net.HardwareAddr
+	switch s := strings.TrimSpace(string(data)); {
+	case len(data) == 6:
+		hw = net.HardwareAddr(data)
+	case len(s) == 12:
+		hw, _ = hex.DecodeString(s)
+	default:
+		if v, err := net.ParseMAC(s); err == nil {
+			hw = v
+		} else if v, err := base64.StdEncoding.DecodeString(s); err == nil {
+			hw = v
+		}
+	}
+	if len(hw) != 6 || bytes.Equal(hw, make(net.HardwareAddr, 6)) {
+		return ""
+	}
+	return hw.String()
+}
+
 func spoofRemoteAddr(addr net.Addr, ci *ctrld.ClientInfo) net.Addr {
 	if ci != nil && ci.IP != "" {
 		switch addr := addr.(type) {
@@ -741,22 +1395,172 @@ func runDNSServer(addr, network string, handler dns.Handler) (*dns.Server, <-cha
 		Net:     network,
 		Handler: handler,
 	}
+	return s, startDNSServer(s)
+}
+
+// listenConfig returns the config of sockets of the listener, with IP_TRANSPARENT set
+// if the listener is transparent, and SO_REUSEPORT set on UDP sockets if the listener
+// has multiple UDP workers.
+func listenConfig(lc *ctrld.ListenerConfig) *net.ListenConfig {
+	transparent, reusePort := lc.Transparent, lc.UDPWorkers > 1
+	if !transparent && !reusePort {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if transparent {
+			if err := transparentControl(network, address, c); err != nil {
+				return err
+			}
+		}
+		if reusePort && strings.HasPrefix(network, "udp") {
+			return reusePortControl(network, address, c)
+		}
+		return nil
+	}}
+}
+
+// listenTCP listens on the TCP address of the listener, accepting at most tcp_max_conns connections
+// at once. If PROXY protocol is enabled, connections from trusted proxies report the client address
+// sent in the PROXY protocol header as remote address.
+func listenTCP(lc *ctrld.ListenerConfig, addr string) (net.Listener, error) {
+	ln, err := listenConfig(lc).Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if lc.TCPMaxConns > 0 {
+		ln = netutil.LimitListener(ln, lc.TCPMaxConns)
+	}
+	if lc.ProxyProtocol {
+		ln = &proxyProtoListener{Listener: ln, trusted: lc.IsTrustedProxy}
+	}
+	return ln, nil
+}
+
+// listenerServer is the DNS server of a listener address. UDP queries are served by udp_workers
+// servers, each reading from its own SO_REUSEPORT socket, so the kernel balances queries across
+// them. The embedded server is the first one.
+type listenerServer struct {
+	*dns.Server
+	workers []*dns.Server
+}
+
+// Shutdown shuts down all servers of s.
+func (s *listenerServer) Shutdown() error {
+	var errs []error
+	for _, w := range s.workers {
+		if err := w.Shutdown(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runListenerDNSServer is like runDNSServer, applying socket settings of the listener: transparent
+// mode, UDP workers, TCP connection limits, timeouts and PROXY protocol.
+func runListenerDNSServer(lc *ctrld.ListenerConfig, addr, network string, handler dns.Handler) (*listenerServer, <-chan error) {
+	workers := 1
+	if network == "udp" && lc.UDPWorkers > 1 {
+		workers = lc.UDPWorkers
+	}
+	ls := &listenerServer{}
+	errChs := make([]<-chan error, 0, workers)
+	for i := 0; i < workers; i++ {
+		s := &dns.Server{Addr: addr, Net: network, Handler: handler}
+		var err error
+		switch {
+		case network == "udp" && (lc.Transparent || workers > 1):
+			s.PacketConn, err = listenConfig(lc).ListenPacket(context.Background(), network, addr)
+		case network == "tcp":
+			setupTCPServer(lc, s)
+			if lc.TCPMaxConns > 0 || lc.ProxyProtocol || lc.Transparent {
+				s.Listener, err = listenTCP(lc, addr)
+			}
+		}
+		if err != nil {
+			mainLog.Load().Error().Err(err).Msgf("could not listen and serve on: %s", addr)
+			_ = ls.Shutdown()
+			if ls.Server == nil {
+				ls.Server = s
+			}
+			errCh := make(chan error, 1)
+			errCh <- err
+			close(errCh)
+			return ls, errCh
+		}
+		if ls.Server == nil {
+			ls.Server = s
+			// Next workers share the port chosen for the first one, if port is 0.
+			if s.PacketConn != nil {
+				addr = s.PacketConn.LocalAddr().String()
+			}
+		}
+		ls.workers = append(ls.workers, s)
+		errChs = append(errChs, startDNSServer(s))
+	}
+	if len(errChs) == 1 {
+		return ls, errChs[0]
+	}
+	return ls, mergeErrChs(errChs)
+}
+
+// mergeErrChs returns a channel receiving errors of all given channels, which is closed
+// once all of them are closed.
+func mergeErrChs(errChs []<-chan error) <-chan error {
+	merged := make(chan error, len(errChs))
+	var wg sync.WaitGroup
+	for _, errCh := range errChs {
+		wg.Add(1)
+		go func(errCh <-chan error) {
+			defer wg.Done()
+			for err := range errCh {
+				merged <- err
+			}
+		}(errCh)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
 
+// setupTCPServer applies timeouts and query limit of TCP connections of the listener to s.
+func setupTCPServer(lc *ctrld.ListenerConfig, s *dns.Server) {
+	if lc.TCPReadTimeout > 0 {
+		s.ReadTimeout = time.Duration(lc.TCPReadTimeout) * time.Second
+	}
+	if lc.TCPIdleTimeout > 0 {
+		idleTimeout := time.Duration(lc.TCPIdleTimeout) * time.Second
+		s.IdleTimeout = func() time.Duration { return idleTimeout }
+	}
+	if lc.TCPMaxQueries > 0 {
+		s.MaxTCPQueries = lc.TCPMaxQueries
+	}
+}
+
+// startDNSServer starts s in background, returning after s is ready to serve queries.
+// The returned channel receives the error if s fails to serve. If s has a listener or
+// packet conn set, it is served on them, otherwise on s.Addr.
+func startDNSServer(s *dns.Server) <-chan error {
 	waitLock := sync.Mutex{}
 	waitLock.Lock()
 	s.NotifyStartedFunc = waitLock.Unlock
 
+	serve := s.ListenAndServe
+	if s.Listener != nil || s.PacketConn != nil {
+		serve = s.ActivateAndServe
+	}
 	errCh := make(chan error)
 	go func() {
 		defer close(errCh)
-		if err := s.ListenAndServe(); err != nil {
+		if err := serve(); err != nil {
 			waitLock.Unlock()
 			mainLog.Load().Error().Err(err).Msgf("could not listen and serve on: %s", s.Addr)
 			errCh <- err
 		}
 	}()
 	waitLock.Lock()
-	return s, errCh
+	return errCh
 }
 
 func (p *prog) getClientInfo(remoteIP string, msg *dns.Msg) *ctrld.ClientInfo {
@@ -768,7 +1572,7 @@ func (p *prog) getClientInfo(remoteIP string, msg *dns.Msg) *ctrld.ClientInfo {
 		ci.Self = true
 		return ci
 	}
-	ci.IP, ci.Mac = ipAndMacFromMsg(msg)
+	ci.IP, ci.Mac = ipAndMacFromMsg(msg, p.cfg.Service.Edns0MacOptions...)
 	switch {
 	case ci.IP != "" && ci.Mac != "":
 		// Nothing to do.
@@ -907,6 +1711,31 @@ func isPrivatePtrLookup(m *dns.Msg) bool {
 	return false
 }
 
+// mdnsDomains are domains which are resolved using multicast DNS: ".local" names, and reverse
+// names of link-local addresses, see RFC 6762 section 3 and section 4.
+var mdnsDomains = []string{
+	"local.",
+	"254.169.in-addr.arpa.",
+	"8.e.f.ip6.arpa.",
+	"9.e.f.ip6.arpa.",
+	"a.e.f.ip6.arpa.",
+	"b.e.f.ip6.arpa.",
+}
+
+// isMDNSQuery reports whether DNS message is a query for a name resolved using multicast DNS.
+func isMDNSQuery(m *dns.Msg) bool {
+	if m == nil || len(m.Question) == 0 {
+		return false
+	}
+	name := m.Question[0].Name
+	for _, domain := range mdnsDomains {
+		if dns.IsSubDomain(domain, name) && name != domain {
+			return true
+		}
+	}
+	return false
+}
+
 // isLanHostnameQuery reports whether DNS message is an A/AAAA query with LAN hostname.
 func isLanHostnameQuery(m *dns.Msg) bool {
 	if m == nil || len(m.Question) == 0 {
@@ -924,6 +1753,43 @@ func isLanHostnameQuery(m *dns.Msg) bool {
 		strings.HasSuffix(name, ".lan")
 }
 
+// isLanRecordQuery reports whether DNS message is an A/AAAA query for a hostname in given LAN domain.
+func isLanRecordQuery(m *dns.Msg, domain string) bool {
+	if m == nil || len(m.Question) == 0 {
+		return false
+	}
+	q := m.Question[0]
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+	default:
+		return false
+	}
+	name, ok := trimLanDomain(strings.TrimSuffix(q.Name, "."), domain)
+	return ok && name != ""
+}
+
+// trimLanDomain returns hostname without the LAN domain suffix, and reports whether
+// hostname is in the LAN domain. The comparison is case-insensitive.
+func trimLanDomain(hostname, domain string) (string, bool) {
+	suffix := "." + domain
+	if len(hostname) <= len(suffix) || !strings.EqualFold(hostname[len(hostname)-len(suffix):], suffix) {
+		return hostname, false
+	}
+	return hostname[:len(hostname)-len(suffix)], true
+}
+
+// listenerAllowsClient reports whether the client at na is allowed by the listener acl.
+func listenerAllowsClient(lc *ctrld.ListenerConfig, na net.Addr) bool {
+	if len(lc.Allow) == 0 && len(lc.Deny) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(na.String())
+	if err != nil {
+		return false
+	}
+	return lc.AllowsClient(ap.Addr())
+}
+
 // isWanClient reports whether the input is a WAN address.
 func isWanClient(na net.Addr) bool {
 	var ip netip.Addr
@@ -3,6 +3,9 @@ package cli
 import (
 	"context"
 	"net"
+	"runtime"
+	"slices"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -43,6 +46,106 @@ func Test_wildcardMatches(t *testing.T) {
 	}
 }
 
+func Test_ruleMatches(t *testing.T) {
+	tests := []struct {
+		source string
+		domain string
+		match  bool
+	}{
+		{"example.com", "example.com", true},
+		{"*.example.com", "www.example.com", true},
+		{`re:^ads?[0-9]*\.`, "ads1.example.com", true},
+		{`re:^ads?[0-9]*\.`, "www.ads.example.com", false},
+		{`re:(^|\.)tracker\.`, "cdn.tracker.example.com", true},
+	}
+	for _, tc := range tests {
+		ri := ctrld.NewRuleIndex([]ctrld.Rule{{tc.source: {"upstream.0"}}})
+		if got := ruleMatches(ri, tc.source, tc.domain); got != tc.match {
+			t.Errorf("unexpected result, source: %s, domain: %s, want: %v, got: %v", tc.source, tc.domain, tc.match, got)
+		}
+	}
+}
+
+func Test_prog_upstreamFor_clientPolicies(t *testing.T) {
+	lc := &ctrld.ListenerConfig{
+		Policy: &ctrld.ListenerPolicyConfig{
+			Name:  "Default",
+			Rules: []ctrld.Rule{{"*.roblox.com": []string{"upstream.1"}}},
+		},
+		ClientPolicies: []*ctrld.ListenerPolicyConfig{
+			{
+				Name:    "Kids",
+				Clients: []string{"aa:bb:cc:*", "192.168.30.0/24"},
+				Rules:   []ctrld.Rule{{"*.roblox.com": []string{"upstream.2"}}},
+			},
+			{
+				Name:    "Admin",
+				Clients: []string{"192.168.1.10"},
+			},
+		},
+	}
+	lc.Init()
+	p := &prog{cfg: &ctrld.Config{}}
+
+	tests := []struct {
+		name      string
+		ip        string
+		mac       string
+		upstreams []string
+		policy    string
+	}{
+		{"mac prefix", "192.168.1.2", "AA:BB:CC:01:02:03", []string{"upstream.2"}, "Kids"},
+		{"subnet", "192.168.30.5", "", []string{"upstream.2"}, "Kids"},
+		{"ip without rules", "192.168.1.10", "", []string{"upstream.0"}, "Admin"},
+		{"default policy", "192.168.1.2", "aa:bb:cd:01:02:03", []string{"upstream.1"}, "Default"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			addr := &net.UDPAddr{IP: net.ParseIP(tc.ip)}
+			ur := p.upstreamFor(context.Background(), "0", lc, addr, tc.mac, "www.roblox.com")
+			assert.Equal(t, tc.upstreams, ur.upstreams)
+			if assert.NotNil(t, ur.policyConfig) {
+				assert.Equal(t, tc.policy, ur.policyConfig.Name)
+			}
+		})
+	}
+}
+
+func Test_prog_matchRule(t *testing.T) {
+	policy := &ctrld.ListenerPolicyConfig{
+		Rules: []ctrld.Rule{
+			{"*.roblox.com": []string{"upstream.1"}},
+			{"games.roblox.com": []string{"upstream.2"}},
+			{"*.fortnite.com": []string{"upstream.1"}},
+			{"*.com": []string{"upstream.0"}},
+		},
+	}
+	lc := &ctrld.ListenerConfig{Policy: policy}
+	lc.Init()
+	// A whole day schedule, on every day but today.
+	var otherDays []string
+	for d, name := range []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} {
+		if time.Weekday(d) != time.Now().Weekday() {
+			otherDays = append(otherDays, name)
+		}
+	}
+	p := &prog{cfg: &ctrld.Config{
+		Schedule: map[string]*ctrld.ScheduleConfig{
+			"inactive": {Days: otherDays, Rules: []string{"*.roblox.com", "games.roblox.com"}},
+			"active":   {Rules: []string{"*.fortnite.com"}},
+		},
+	}}
+
+	assert.Equal(t, 3, p.matchRule(policy, "games.roblox.com"))
+	assert.Equal(t, 3, p.matchRule(policy, "www.roblox.com"))
+	assert.Equal(t, 2, p.matchRule(policy, "www.fortnite.com"))
+	assert.Equal(t, -1, p.matchRule(policy, "example.org"))
+
+	p.cfg.Schedule = nil
+	assert.Equal(t, 0, p.matchRule(policy, "games.roblox.com"))
+}
+
 func Test_canonicalName(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -100,6 +203,9 @@ func Test_prog_upstreamFor(t *testing.T) {
 		{"Policy Macs matches upper", "192.168.0.1:0", "14:45:A0:67:83:0A", "0", p.cfg.Listener["0"], "abc.xyz", []string{"upstream.2"}, true, "14:45:a0:67:83:0a"},
 		{"Policy Macs matches lower", "192.168.0.1:0", "14:54:4a:8e:08:2d", "0", p.cfg.Listener["0"], "abc.xyz", []string{"upstream.2"}, true, "14:54:4a:8e:08:2d"},
 		{"Policy Macs matches case-insensitive", "192.168.0.1:0", "14:54:4A:8E:08:2D", "0", p.cfg.Listener["0"], "abc.xyz", []string{"upstream.2"}, true, "14:54:4a:8e:08:2d"},
+		{"Policy Tags matches by mac", "192.168.0.2:0", "14:45:a0:67:83:0b", "0", p.cfg.Listener["0"], "abc.xyz", []string{"upstream.3"}, true, ""},
+		{"Policy Tags matches by ip", "192.168.1.10:0", "", "0", p.cfg.Listener["0"], "abc.xyz", []string{"upstream.3"}, true, ""},
+		{"Policy Tags client without tag", "192.168.1.11:0", "", "0", p.cfg.Listener["0"], "abc.xyz", []string{"upstream.0"}, true, ""},
 	}
 
 	for _, tc := range tests {
@@ -136,6 +242,7 @@ func Test_prog_upstreamFor(t *testing.T) {
 func TestCache(t *testing.T) {
 	cfg := testhelper.SampleConfig(t)
 	prog := &prog{cfg: cfg}
+	prog.um = newUpstreamMonitor(prog.cfg)
 	for _, nc := range prog.cfg.Network {
 		for _, cidr := range nc.Cidrs {
 			_, ipNet, err := net.ParseCIDR(cidr)
@@ -191,6 +298,414 @@ func TestCache(t *testing.T) {
 	assert.Equal(t, answer2.Rcode, got2.answer.Rcode)
 }
 
+func TestCache_latencyBudget(t *testing.T) {
+	// An upstream which never answers.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+			queries.Add(1)
+		}
+	}()
+
+	cfg := testhelper.SampleConfig(t)
+	cfg.Service.CacheLatencyBudget = 50
+	cfg.Upstream["1"] = &ctrld.UpstreamConfig{
+		Name:     "slow",
+		Type:     ctrld.ResolverTypeLegacy,
+		Endpoint: pc.LocalAddr().String(),
+		Timeout:  500,
+	}
+	cfg.Upstream["1"].Init()
+	prog := &prog{cfg: cfg}
+	prog.um = newUpstreamMonitor(prog.cfg)
+	cacher, err := dnscache.NewLRUCache(4096)
+	require.NoError(t, err)
+	prog.cache = cacher
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	stale := new(dns.Msg)
+	stale.SetRcode(msg, dns.RcodeNameError)
+	prog.cache.Add(dnscache.NewKey(msg, "upstream.1"), dnscache.NewValue(stale, time.Now().Add(-time.Minute)))
+
+	start := time.Now()
+	got := prog.proxy(context.Background(), &proxyRequest{
+		msg: msg,
+		ufr: &upstreamForResult{upstreams: []string{"upstream.1"}},
+	})
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "stale answer must be served within the latency budget")
+	assert.True(t, got.cached)
+	assert.Equal(t, dns.RcodeNameError, got.answer.Rcode)
+
+	// While the refresh is in progress, the stale answer is served right away, without more refreshes.
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		got := prog.proxy(context.Background(), &proxyRequest{
+			msg: msg,
+			ufr: &upstreamForResult{upstreams: []string{"upstream.1"}},
+		})
+		assert.True(t, got.cached)
+	}
+	assert.Less(t, time.Since(start), 250*time.Millisecond, "stale answer must be served without waiting the latency budget")
+	assert.Eventually(t, func() bool { return queries.Load() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Never(t, func() bool { return queries.Load() > 1 }, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestCache_serveOffline(t *testing.T) {
+	tests := []struct {
+		name      string
+		offline   bool
+		maxStale  int
+		expired   time.Duration
+		wantRcode int
+	}{
+		{"disabled", false, 0, time.Hour, dns.RcodeServerFailure},
+		{"stale", true, 0, time.Hour, dns.RcodeNameError},
+		{"too stale", true, 60, time.Hour, dns.RcodeServerFailure},
+		{"too stale by default", true, 0, 48 * time.Hour, dns.RcodeServerFailure},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := testhelper.SampleConfig(t)
+			cfg.Service.CacheServeOffline = tc.offline
+			cfg.Service.CacheOfflineMaxStale = tc.maxStale
+			prog := &prog{cfg: cfg}
+			prog.um = newUpstreamMonitor(prog.cfg)
+			prog.um.down["upstream.1"] = true
+			cacher, err := dnscache.NewLRUCache(4096)
+			require.NoError(t, err)
+			prog.cache = cacher
+
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			msg.SetEdns0(4096, false)
+			stale := new(dns.Msg)
+			stale.SetRcode(msg, dns.RcodeNameError)
+			prog.cache.Add(dnscache.NewKey(msg, "upstream.1"), dnscache.NewValue(stale, time.Now().Add(-tc.expired)))
+
+			got := prog.proxy(context.Background(), &proxyRequest{
+				msg: msg,
+				ufr: &upstreamForResult{upstreams: []string{"upstream.1"}},
+			})
+			require.NotNil(t, got.answer)
+			assert.Equal(t, tc.wantRcode, got.answer.Rcode)
+			if tc.wantRcode == dns.RcodeServerFailure {
+				return
+			}
+			assert.True(t, got.cached)
+			hasEDE := false
+			if opt := got.answer.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeStaleNXDOMAINAnswer {
+						hasEDE = true
+					}
+				}
+			}
+			assert.True(t, hasEDE, "stale answer must have EDE stale nxdomain answer")
+		})
+	}
+}
+
+func TestCache_serveStale(t *testing.T) {
+	// An upstream which refuses queries.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	endpoint := pc.LocalAddr().String()
+	require.NoError(t, pc.Close())
+
+	tests := []struct {
+		name      string
+		maxStale  int
+		expired   time.Duration
+		wantRcode int
+	}{
+		{"stale", 0, time.Hour, dns.RcodeSuccess},
+		{"within max stale", 7200, time.Hour, dns.RcodeSuccess},
+		{"too stale", 60, time.Hour, dns.RcodeServerFailure},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := testhelper.SampleConfig(t)
+			cfg.Service.CacheServeStale = true
+			cfg.Service.CacheMaxStale = tc.maxStale
+			cfg.Upstream["1"] = &ctrld.UpstreamConfig{
+				Name:     "refused",
+				Type:     ctrld.ResolverTypeLegacy,
+				Endpoint: endpoint,
+				Timeout:  500,
+			}
+			cfg.Upstream["1"].Init()
+			prog := &prog{cfg: cfg}
+			prog.um = newUpstreamMonitor(prog.cfg)
+			cacher, err := dnscache.NewLRUCache(4096)
+			require.NoError(t, err)
+			prog.cache = cacher
+
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			msg.SetEdns0(4096, false)
+			stale := new(dns.Msg)
+			stale.SetReply(msg)
+			prog.cache.Add(dnscache.NewKey(msg, "upstream.1"), dnscache.NewValue(stale, time.Now().Add(-tc.expired)))
+
+			got := prog.proxy(context.Background(), &proxyRequest{
+				msg: msg,
+				ufr: &upstreamForResult{upstreams: []string{"upstream.1"}},
+			})
+			require.NotNil(t, got.answer)
+			assert.Equal(t, tc.wantRcode, got.answer.Rcode)
+			if tc.wantRcode == dns.RcodeServerFailure {
+				return
+			}
+			assert.True(t, got.cached)
+			hasEDE := false
+			for _, o := range got.answer.IsEdns0().Option {
+				if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeStaleAnswer {
+					hasEDE = true
+				}
+			}
+			assert.True(t, hasEDE, "stale answer must have EDE stale answer")
+		})
+	}
+}
+
+func TestCache_refreshNotRecorded(t *testing.T) {
+	// An upstream which refuses queries.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	endpoint := pc.LocalAddr().String()
+	require.NoError(t, pc.Close())
+
+	cfg := testhelper.SampleConfig(t)
+	cfg.Upstream["1"] = &ctrld.UpstreamConfig{
+		Name:     "refused",
+		Type:     ctrld.ResolverTypeLegacy,
+		Endpoint: endpoint,
+		Timeout:  500,
+	}
+	cfg.Upstream["1"].Init()
+	prog := &prog{cfg: cfg}
+	prog.um = newUpstreamMonitor(prog.cfg)
+	cacher, err := dnscache.NewLRUCache(4096)
+	require.NoError(t, err)
+	prog.cache = cacher
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	stale := new(dns.Msg)
+	stale.SetReply(msg)
+	prog.cache.Add(dnscache.NewKey(msg, "upstream.1"), dnscache.NewValue(stale, time.Now().Add(-time.Minute)))
+
+	prog.proxy(context.Background(), &proxyRequest{
+		msg:     msg,
+		ufr:     &upstreamForResult{upstreams: []string{"upstream.1"}},
+		refresh: true,
+	})
+	stats := cacher.Stats()
+	assert.Zero(t, stats.Misses, "refresh must not be recorded as a cache miss")
+	assert.Zero(t, stats.Hits)
+
+	prog.proxy(context.Background(), &proxyRequest{
+		msg: msg,
+		ufr: &upstreamForResult{upstreams: []string{"upstream.1"}},
+	})
+	assert.Equal(t, uint64(1), cacher.Stats().Misses)
+}
+
+func TestCache_prefetch(t *testing.T) {
+	// An upstream which answers with a TTL of 300 seconds.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			size, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := new(dns.Msg)
+			if err := query.Unpack(buf[:size]); err != nil {
+				continue
+			}
+			queries.Add(1)
+			answer := new(dns.Msg)
+			answer.SetReply(query)
+			answer.Answer = append(answer.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+			data, _ := answer.Pack()
+			_, _ = pc.WriteTo(data, addr)
+		}
+	}()
+
+	cfg := testhelper.SampleConfig(t)
+	cfg.Service.CachePrefetch = true
+	cfg.Service.CachePrefetchHits = 2
+	cfg.Upstream["1"] = &ctrld.UpstreamConfig{
+		Name:     "upstream",
+		Type:     ctrld.ResolverTypeLegacy,
+		Endpoint: pc.LocalAddr().String(),
+		Timeout:  500,
+	}
+	cfg.Upstream["1"].Init()
+	prog := &prog{cfg: cfg}
+	prog.um = newUpstreamMonitor(prog.cfg)
+	cacher, err := dnscache.NewLRUCache(4096)
+	require.NoError(t, err)
+	prog.cache = cacher
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	cached := new(dns.Msg)
+	cached.SetReply(msg)
+	cached.Answer = append(cached.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	// 5% of the TTL remains.
+	prog.cache.Add(dnscache.NewKey(msg, "upstream.1"), dnscache.NewValue(cached, time.Now().Add(5*time.Second)))
+
+	query := func() *proxyResponse {
+		return prog.proxy(context.Background(), &proxyRequest{
+			msg: msg.Copy(),
+			ufr: &upstreamForResult{upstreams: []string{"upstream.1"}},
+		})
+	}
+	require.True(t, query().cached)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), queries.Load(), "answer must not be prefetched before cache_prefetch_hits")
+
+	require.True(t, query().cached)
+	require.True(t, query().cached)
+	assert.Eventually(t, func() bool {
+		v := dnscache.Get(prog.cache, msg, "upstream.1")
+		return v != nil && time.Until(v.Expire) > time.Minute
+	}, time.Second, 10*time.Millisecond, "popular answer must be prefetched")
+	assert.Equal(t, int32(1), queries.Load(), "answer must be prefetched once")
+}
+
+func TestProxy_retries(t *testing.T) {
+	// An upstream which drops the first query.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for n := 0; ; n++ {
+			size, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n == 0 {
+				continue
+			}
+			query := new(dns.Msg)
+			if err := query.Unpack(buf[:size]); err != nil {
+				continue
+			}
+			answer := new(dns.Msg)
+			answer.SetRcode(query, dns.RcodeNameError)
+			data, _ := answer.Pack()
+			_, _ = pc.WriteTo(data, addr)
+		}
+	}()
+
+	cfg := testhelper.SampleConfig(t)
+	cfg.Upstream["1"] = &ctrld.UpstreamConfig{
+		Name:         "lossy",
+		Type:         ctrld.ResolverTypeLegacy,
+		Endpoint:     pc.LocalAddr().String(),
+		Timeout:      200,
+		Retries:      1,
+		RetryBackoff: 10,
+	}
+	cfg.Upstream["1"].Init()
+	prog := &prog{cfg: cfg}
+	prog.um = newUpstreamMonitor(prog.cfg)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	got := prog.proxy(context.Background(), &proxyRequest{
+		msg: msg,
+		ufr: &upstreamForResult{upstreams: []string{"upstream.1"}},
+	})
+	require.NotNil(t, got.answer)
+	assert.Equal(t, dns.RcodeNameError, got.answer.Rcode)
+}
+
+func Test_retryBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff int
+		retries int
+		want    time.Duration
+	}{
+		{"no backoff", 0, 3, 0},
+		{"first retry", 100, 0, 100 * time.Millisecond},
+		{"third retry", 100, 2, 400 * time.Millisecond},
+		{"capped", 1000, 10, maxRetryBackoff},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			uc := &ctrld.UpstreamConfig{RetryBackoff: tc.backoff}
+			assert.Equal(t, tc.want, retryBackoff(uc, tc.retries))
+		})
+	}
+}
+
+func Test_outageAnswer(t *testing.T) {
+	tests := []struct {
+		name    string
+		edns0   bool
+		wantEDE bool
+	}{
+		{"no edns0", false, false},
+		{"edns0", true, true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			if tc.edns0 {
+				msg.SetEdns0(4096, false)
+			}
+			answer := outageAnswer(msg)
+			assert.Equal(t, dns.RcodeServerFailure, answer.Rcode)
+			assert.Empty(t, answer.Answer)
+			assert.Empty(t, answer.Ns)
+
+			hasEDE := false
+			if opt := answer.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if ede, ok := o.(*dns.EDNS0_EDE); ok {
+						hasEDE = ede.InfoCode == dns.ExtendedErrorCodeNetworkError
+					}
+				}
+			}
+			assert.Equal(t, tc.wantEDE, hasEDE)
+		})
+	}
+}
+
 func Test_ipAndMacFromMsg(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -297,6 +812,57 @@ func Test_ipFromARPA(t *testing.T) {
 	}
 }
 
+func Test_macFromEdns0(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"binary", []byte{0x4c, 0x20, 0xb8, 0xab, 0x87, 0x1b}, "4c:20:b8:ab:87:1b"},
+		{"text", []byte("4C:20:B8:AB:87:1B"), "4c:20:b8:ab:87:1b"},
+		{"text dash", []byte("4c-20-b8-ab-87-1b"), "4c:20:b8:ab:87:1b"},
+		{"text no separator", []byte("4c20b8ab871b"), "4c:20:b8:ab:87:1b"},
+		{"base64", []byte("TCC4q4cb"), "4c:20:b8:ab:87:1b"},
+		{"zero", make([]byte, 6), ""},
+		{"too short", []byte{0x4c, 0x20}, ""},
+		{"invalid text", []byte("not-a-mac"), ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := macFromEdns0(tc.data); got != tc.want {
+				t.Errorf("unexpected result, want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_stripClientMac(t *testing.T) {
+	hw := []byte{0x4c, 0x20, 0xb8, 0xab, 0x87, 0x1b}
+	m := newDnsMsgWithClientIP("1.1.1.1")
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_LOCAL{Code: EDNS0_OPTION_MAC, Data: hw},
+		&dns.EDNS0_LOCAL{Code: EDNS0_OPTION_NOMDEVICEID, Data: []byte("TCC4q4cb")},
+		&dns.EDNS0_LOCAL{Code: 65100, Data: hw},
+		&dns.EDNS0_LOCAL{Code: 65200, Data: hw},
+	)
+
+	if _, mac := ipAndMacFromMsg(m, 65100); mac != "4c:20:b8:ab:87:1b" {
+		t.Errorf("unexpected mac: %q", mac)
+	}
+	stripClientMac(m, 65100)
+	var codes []uint16
+	for _, o := range opt.Option {
+		codes = append(codes, o.Option())
+	}
+	want := []uint16{dns.EDNS0SUBNET, 65200}
+	if !slices.Equal(codes, want) {
+		t.Errorf("unexpected options, want: %v, got: %v", want, codes)
+	}
+}
+
 func newDnsMsgWithClientIP(ip string) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetQuestion("example.com.", dns.TypeA)
@@ -340,6 +906,79 @@ func Test_stripClientSubnet(t *testing.T) {
 	}
 }
 
+func Test_setClientSubnet(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         *dns.Msg
+		cidr        string
+		wantAddr    string
+		wantNetmask uint8
+		wantUDPSize uint16
+	}{
+		{"no edns0", new(dns.Msg), "203.0.113.77/24", "203.0.113.0", 24, dns.MinMsgSize},
+		{"replace client subnet", newDnsMsgWithClientIP("1.1.1.1"), "203.0.113.0/24", "203.0.113.0", 24, 0},
+		{"ipv6", new(dns.Msg), "2001:db8:1234::/48", "2001:db8:1234::", 48, dns.MinMsgSize},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			setClientSubnet(tc.msg, tc.cidr)
+			opt := tc.msg.IsEdns0()
+			if opt == nil {
+				t.Fatal("missing OPT record")
+			}
+			if opt.UDPSize() != tc.wantUDPSize {
+				t.Errorf("unexpected udp size, want: %d, got: %d", tc.wantUDPSize, opt.UDPSize())
+			}
+			var subnets []*dns.EDNS0_SUBNET
+			for _, s := range opt.Option {
+				if e, ok := s.(*dns.EDNS0_SUBNET); ok {
+					subnets = append(subnets, e)
+				}
+			}
+			if len(subnets) != 1 {
+				t.Fatalf("unexpected number of client subnet options: %d", len(subnets))
+			}
+			if got := subnets[0].Address.String(); got != tc.wantAddr {
+				t.Errorf("unexpected address, want: %s, got: %s", tc.wantAddr, got)
+			}
+			if subnets[0].SourceNetmask != tc.wantNetmask {
+				t.Errorf("unexpected netmask, want: %d, got: %d", tc.wantNetmask, subnets[0].SourceNetmask)
+			}
+
+			removeClientSubnet(tc.msg)
+			for _, s := range opt.Option {
+				if _, ok := s.(*dns.EDNS0_SUBNET); ok {
+					t.Error("client subnet option was not removed")
+				}
+			}
+		})
+	}
+}
+
+func Test_removeOpt(t *testing.T) {
+	// Answer to a query from a client without EDNS0, which OPT record was added by setClientSubnet.
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	setClientSubnet(query, "203.0.113.0/24")
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	answer.Extra = append(answer.Extra, query.IsEdns0(), &dns.A{
+		Hdr: dns.RR_Header{Name: "ns.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+
+	removeClientSubnet(answer)
+	removeOpt(answer)
+	if answer.IsEdns0() != nil {
+		t.Error("OPT record must be removed")
+	}
+	if len(answer.Extra) != 1 {
+		t.Errorf("other additional records must be kept, got: %v", answer.Extra)
+	}
+}
+
 func newDnsMsgWithHostname(hostname string, typ uint16) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetQuestion(hostname, typ)
@@ -369,6 +1008,58 @@ func Test_isLanHostnameQuery(t *testing.T) {
 	}
 }
 
+func Test_isMDNSQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         *dns.Msg
+		isMDNSQuery bool
+	}{
+		{"local", newDnsMsgWithHostname("printer.local.", dns.TypeA), true},
+		{"local uppercase", newDnsMsgWithHostname("Printer.LOCAL.", dns.TypeAAAA), true},
+		{"local itself", newDnsMsgWithHostname("local.", dns.TypeSOA), false},
+		{"not local", newDnsMsgWithHostname("printer.localdomain.", dns.TypeA), false},
+		{"IPv4 link-local PTR", newDnsMsgPtr("169.254.1.2", t), true},
+		{"IPv6 link-local PTR", newDnsMsgPtr("fe80::69f6:e16e:8bdb:433f", t), true},
+		{"private PTR", newDnsMsgPtr("192.168.1.2", t), false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := isMDNSQuery(tc.msg); tc.isMDNSQuery != got {
+				t.Errorf("unexpected result, want: %v, got: %v", tc.isMDNSQuery, got)
+			}
+		})
+	}
+}
+
+func Test_isLanRecordQuery(t *testing.T) {
+	tests := []struct {
+		name             string
+		msg              *dns.Msg
+		domain           string
+		isLanRecordQuery bool
+	}{
+		{"A", newDnsMsgWithHostname("foo.lan", dns.TypeA), "lan", true},
+		{"AAAA", newDnsMsgWithHostname("foo.lan", dns.TypeAAAA), "lan", true},
+		{"case insensitive", newDnsMsgWithHostname("Foo.LAN", dns.TypeA), "lan", true},
+		{"custom domain", newDnsMsgWithHostname("foo.home.arpa", dns.TypeA), "home.arpa", true},
+		{"domain only", newDnsMsgWithHostname("lan", dns.TypeA), "lan", false},
+		{"bare hostname", newDnsMsgWithHostname("foo", dns.TypeA), "lan", false},
+		{"other domain", newDnsMsgWithHostname("foo.plan", dns.TypeA), "lan", false},
+		{"Not A or AAAA", newDnsMsgWithHostname("foo.lan", dns.TypeTXT), "lan", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := isLanRecordQuery(tc.msg, tc.domain); tc.isLanRecordQuery != got {
+				t.Errorf("unexpected result, want: %v, got: %v", tc.isLanRecordQuery, got)
+			}
+		})
+	}
+}
+
 func newDnsMsgPtr(ip string, t *testing.T) *dns.Msg {
 	t.Helper()
 	m := new(dns.Msg)
@@ -431,3 +1122,70 @@ func Test_isWanClient(t *testing.T) {
 		})
 	}
 }
+
+func Test_runListenerDNSServer_tcpLimits(t *testing.T) {
+	lc := &ctrld.ListenerConfig{TCPMaxConns: 1, TCPMaxQueries: 1, TCPIdleTimeout: 1}
+	s, errCh := runListenerDNSServer(lc, "127.0.0.1:0", "tcp", dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		answer := new(dns.Msg)
+		answer.SetReply(m)
+		_ = w.WriteMsg(answer)
+	}))
+	defer s.Shutdown()
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	default:
+	}
+	assert.Equal(t, 1, s.MaxTCPQueries)
+	assert.Equal(t, time.Second, s.IdleTimeout())
+
+	addr := s.Listener.Addr().String()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	first, err := dns.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer first.Close()
+	require.NoError(t, first.WriteMsg(msg))
+	_, err = first.ReadMsg()
+	require.NoError(t, err)
+
+	// The connection is closed after answering tcp_max_queries queries, so the next one is accepted.
+	second, err := dns.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer second.Close()
+	require.NoError(t, second.SetDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, second.WriteMsg(msg))
+	_, err = second.ReadMsg()
+	require.NoError(t, err)
+}
+
+func Test_runListenerDNSServer_udpWorkers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported on Windows")
+	}
+	lc := &ctrld.ListenerConfig{UDPWorkers: 4}
+	s, errCh := runListenerDNSServer(lc, "127.0.0.1:0", "udp", dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		answer := new(dns.Msg)
+		answer.SetReply(m)
+		_ = w.WriteMsg(answer)
+	}))
+	defer s.Shutdown()
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	default:
+	}
+	require.Len(t, s.workers, 4)
+	addr := s.PacketConn.LocalAddr().String()
+	for _, w := range s.workers {
+		assert.Equal(t, addr, w.PacketConn.LocalAddr().String())
+	}
+
+	c := &dns.Client{Net: "udp"}
+	for i := 0; i < 8; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		_, _, err := c.Exchange(msg, addr)
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,192 @@
+package cli
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	// dohPath is the standard path of DoH requests, RFC 8484 section 4.1.1.
+	dohPath = "/dns-query"
+	// dohContentType is the media type of DoH requests and responses, RFC 8484 section 6.
+	dohContentType = "application/dns-message"
+	// dohJSONPath is the path of DoH JSON API requests, like https://dns.google/resolve.
+	dohJSONPath = "/resolve"
+	// dohJSONContentType is the media type of DoH JSON API responses.
+	dohJSONContentType = "application/dns-json"
+	// dohIdleTimeout is the time a DoH connection is kept open without requests.
+	dohIdleTimeout = 2 * time.Minute
+)
+
+// serveDoH serves DNS over HTTPS on the listener, until ctrld stops. Queries are answered
+// by handler, so they are processed like queries received by plain DNS listeners.
+// HTTP/1.1 and HTTP/2 are served over TCP, HTTP/3 over UDP on the same port. HTTP/3 is
+// advertised to clients using Alt-Svc response header, RFC 7838.
+func (p *prog) serveDoH(lc *ctrld.ListenerConfig, handler dns.Handler) error {
+	tlsConfig, err := p.listenerTLSConfig(lc)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(lc.IP, strconv.Itoa(lc.Port))
+	ln, err := listenTCP(lc, addr)
+	if err != nil {
+		return err
+	}
+	h := dohHandler(handler)
+	s := &http.Server{
+		Handler:           h,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       dohIdleTimeout,
+	}
+	// HTTP/3 is optional, DoH over TCP still works if the UDP port could not be used.
+	if pc, err := net.ListenPacket("udp", addr); err != nil {
+		mainLog.Load().Warn().Err(err).Msgf("could not serve DoH over HTTP/3 on: %s", addr)
+	} else {
+		defer pc.Close()
+		h3 := &http3.Server{
+			Handler:    h,
+			TLSConfig:  http3.ConfigureTLSConfig(tlsConfig),
+			QuicConfig: &quic.Config{MaxIdleTimeout: dohIdleTimeout},
+		}
+		defer h3.Close()
+		go func() {
+			if err := h3.Serve(pc); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				mainLog.Load().Warn().Err(err).Msgf("could not serve DoH over HTTP/3 on: %s", addr)
+			}
+		}()
+		s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = h3.SetQuicHeaders(w.Header())
+			h.ServeHTTP(w, r)
+		})
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ServeTLS(ln, "", "")
+	}()
+	p.started <- struct{}{}
+	select {
+	case <-p.stopCh:
+		return s.Close()
+	case err := <-errCh:
+		return err
+	}
+}
+
+// dohHandler returns the HTTP handler of DoH requests, RFC 8484. Queries are sent using GET
+// method with the base64url encoded query in "dns" parameter, or POST method with the query
+// as body. The JSON API, like https://cloudflare-dns.com/dns-query and https://dns.google/resolve,
+// is also served, on GET requests with "name" parameter.
+func dohHandler(handler dns.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, func(w http.ResponseWriter, r *http.Request) {
+		var (
+			buf []byte
+			err error
+		)
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Has("name") && !r.URL.Query().Has("dns") {
+				serveDoHJSON(w, r, handler)
+				return
+			}
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohContentType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		msg := new(dns.Msg)
+		if err == nil {
+			err = msg.Unpack(buf)
+		}
+		if err != nil {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+		answer := serveDoHQuery(w, r, handler, msg)
+		if answer == nil {
+			return
+		}
+		data, err := answer.Pack()
+		if err != nil {
+			http.Error(w, "invalid dns answer", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		// HTTP caches must not keep answers longer than their TTLs, RFC 8484 section 5.1.
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttlFromMsg(answer)))
+		_, _ = w.Write(data)
+	})
+	mux.HandleFunc(dohJSONPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		serveDoHJSON(w, r, handler)
+	})
+	return mux
+}
+
+// serveDoHJSON answers the DoH JSON API request.
+func serveDoHJSON(w http.ResponseWriter, r *http.Request, handler dns.Handler) {
+	msg, err := ctrld.NewDoHJSONQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	answer := serveDoHQuery(w, r, handler, msg)
+	if answer == nil {
+		return
+	}
+	data, err := ctrld.MarshalDoHJSON(answer)
+	if err != nil {
+		http.Error(w, "invalid dns answer", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohJSONContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttlFromMsg(answer)))
+	_, _ = w.Write(data)
+}
+
+// serveDoHQuery answers msg using handler. If there's no answer, an error is written to w,
+// and nil is returned.
+func serveDoHQuery(w http.ResponseWriter, r *http.Request, handler dns.Handler, msg *dns.Msg) *dns.Msg {
+	rw := &answerRecorder{remoteAddr: dohRemoteAddr(r)}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		rw.localAddr = addr
+	}
+	handler.ServeDNS(rw, msg)
+	if rw.answer == nil {
+		http.Error(w, "no answer", http.StatusInternalServerError)
+	}
+	return rw.answer
+}
+
+// dohRemoteAddr returns the address of the client which sent the DoH request.
+func dohRemoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_dohHandler(t *testing.T) {
+	handler := dohHandler(dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		answer := new(dns.Msg)
+		answer.SetReply(m)
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+			answer.Rcode = dns.RcodeServerFailure
+		}
+		answer.Answer = append(answer.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		_ = w.WriteMsg(answer)
+	}))
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = 0
+	query, err := msg.Pack()
+	require.NoError(t, err)
+
+	get := func(param string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, dohPath+"?dns="+param, nil)
+	}
+	post := func(contentType string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(query))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+	}{
+		{"get", get(base64.RawURLEncoding.EncodeToString(query)), http.StatusOK},
+		{"post", post(dohContentType), http.StatusOK},
+		{"get invalid query", get("invalid"), http.StatusBadRequest},
+		{"get missing query", get(""), http.StatusBadRequest},
+		{"post unsupported content type", post("text/plain"), http.StatusUnsupportedMediaType},
+		{"unsupported method", httptest.NewRequest(http.MethodPut, dohPath, nil), http.StatusMethodNotAllowed},
+		{"unknown path", httptest.NewRequest(http.MethodGet, "/query", nil), http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, tc.req)
+			require.Equal(t, tc.wantCode, rec.Code)
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, dohContentType, rec.Header().Get("Content-Type"))
+			assert.Equal(t, "max-age=300", rec.Header().Get("Cache-Control"))
+			answer := new(dns.Msg)
+			require.NoError(t, answer.Unpack(rec.Body.Bytes()))
+			assert.Equal(t, dns.RcodeSuccess, answer.Rcode)
+			assert.Len(t, answer.Answer, 1)
+		})
+	}
+}
+
+func Test_dohHandler_json(t *testing.T) {
+	handler := dohHandler(dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		answer := new(dns.Msg)
+		answer.SetReply(m)
+		answer.Answer = append(answer.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		_ = w.WriteMsg(answer)
+	}))
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+	}{
+		{"dns-query", httptest.NewRequest(http.MethodGet, dohPath+"?name=example.com", nil), http.StatusOK},
+		{"resolve", httptest.NewRequest(http.MethodGet, dohJSONPath+"?name=example.com&type=A", nil), http.StatusOK},
+		{"missing name", httptest.NewRequest(http.MethodGet, dohJSONPath, nil), http.StatusBadRequest},
+		{"invalid type", httptest.NewRequest(http.MethodGet, dohJSONPath+"?name=example.com&type=INVALID", nil), http.StatusBadRequest},
+		{"unsupported method", httptest.NewRequest(http.MethodPost, dohJSONPath, nil), http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, tc.req)
+			require.Equal(t, tc.wantCode, rec.Code)
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, dohJSONContentType, rec.Header().Get("Content-Type"))
+			assert.Equal(t, "max-age=300", rec.Header().Get("Cache-Control"))
+			assert.JSONEq(t, `{
+				"Status": 0, "TC": false, "RD": true, "RA": false, "AD": false, "CD": false,
+				"Question": [{"name": "example.com.", "type": 1}],
+				"Answer": [{"name": "example.com.", "type": 1, "TTL": 300, "data": "192.0.2.1"}]
+			}`, rec.Body.String())
+		})
+	}
+}
+
+func Test_serveDoH(t *testing.T) {
+	certFile, keyFile := newTestServerCert(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+
+	lc := &ctrld.ListenerConfig{IP: "127.0.0.1", Port: port, Type: ctrld.ListenerTypeDOH, TLSCert: certFile, TLSKey: keyFile}
+	p := &prog{started: make(chan struct{}, 1), stopCh: make(chan struct{})}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.serveDoH(lc, dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			answer := new(dns.Msg)
+			answer.SetReply(m)
+			_ = w.WriteMsg(answer)
+		}))
+	}()
+	select {
+	case <-p.started:
+	case err := <-errCh:
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = 0
+	query, err := msg.Pack()
+	require.NoError(t, err)
+	url := "https://" + net.JoinHostPort(lc.IP, strconv.Itoa(port)) + dohPath + "?dns=" + base64.RawURLEncoding.EncodeToString(query)
+	tlsConfig := &tls.Config{ServerName: "dns.example.com", RootCAs: testCertPool(t, certFile)}
+
+	// HTTP/3 is advertised once its listener is ready.
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}
+	wantAltSvc := fmt.Sprintf(`h3=":%d"`, port)
+	var altSvc string
+	for i := 0; i < 50 && !strings.Contains(altSvc, wantAltSvc); i++ {
+		resp, err := c.Get(url)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 2, resp.ProtoMajor)
+		altSvc = resp.Header.Get("Alt-Svc")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Contains(t, altSvc, wantAltSvc)
+
+	rt := &http3.RoundTripper{TLSClientConfig: tlsConfig}
+	defer rt.Close()
+	resp, err := (&http.Client{Transport: rt}).Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, resp.ProtoMajor)
+	buf, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	answer := new(dns.Msg)
+	require.NoError(t, answer.Unpack(buf))
+	assert.Equal(t, dns.RcodeSuccess, answer.Rcode)
+
+	close(p.stopCh)
+	require.NoError(t, <-errCh)
+}
@@ -0,0 +1,127 @@
+//go:build !qf
+
+package cli
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// DoQ error codes, RFC 9250 section 4.3. They are used as both connection and stream error codes.
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+)
+
+const (
+	// doqIdleTimeout is the time a DoQ connection is kept open without queries.
+	doqIdleTimeout = 2 * time.Minute
+	// doqReadTimeout is the time a client has to send its query, after opening a stream.
+	doqReadTimeout = 10 * time.Second
+)
+
+// serveDoQ serves DNS over QUIC on the listener, RFC 9250, until ctrld stops. Queries are
+// answered by handler, so they are processed like queries received by plain DNS listeners.
+func (p *prog) serveDoQ(lc *ctrld.ListenerConfig, handler dns.Handler) error {
+	tlsConfig, err := p.listenerTLSConfig(lc)
+	if err != nil {
+		return err
+	}
+	tlsConfig.NextProtos = []string{"doq"}
+	addr := net.JoinHostPort(lc.IP, strconv.Itoa(lc.Port))
+	ln, err := quic.ListenAddr(addr, tlsConfig, &quic.Config{MaxIdleTimeout: doqIdleTimeout})
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	p.started <- struct{}{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveDoQConn(ctx, conn, handler)
+	}
+}
+
+// serveDoQConn answers queries sent over conn, each one on its own stream.
+func serveDoQConn(ctx context.Context, conn quic.Connection, handler dns.Handler) {
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			_ = conn.CloseWithError(doqNoError, "")
+			return
+		}
+		go serveDoQStream(conn, stream, handler)
+	}
+}
+
+// serveDoQStream reads the query from stream, then writes the answer back on the same stream.
+func serveDoQStream(conn quic.Connection, stream quic.Stream, handler dns.Handler) {
+	defer stream.Close()
+	_ = stream.SetReadDeadline(time.Now().Add(doqReadTimeout))
+	buf, err := readDoQMsg(stream)
+	if err != nil {
+		stream.CancelRead(doqNoError)
+		stream.CancelWrite(doqNoError)
+		return
+	}
+	msg := new(dns.Msg)
+	// Malformed queries and non-zero message IDs are protocol errors, RFC 9250 section 4.2.1.
+	if err := msg.Unpack(buf); err != nil || msg.Id != 0 {
+		_ = conn.CloseWithError(doqProtocolError, "invalid query")
+		return
+	}
+
+	rw := &answerRecorder{localAddr: conn.LocalAddr(), remoteAddr: conn.RemoteAddr()}
+	handler.ServeDNS(rw, msg)
+	if rw.answer == nil {
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	buf, err = rw.answer.Pack()
+	if err != nil {
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	out := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+	_, _ = stream.Write(out)
+}
+
+// readDoQMsg reads the DNS message prefixed by its 2 bytes length from r.
+func readDoQMsg(r io.Reader) ([]byte, error) {
+	var msgLen uint16
+	if err := binary.Read(r, binary.BigEndian, &msgLen); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
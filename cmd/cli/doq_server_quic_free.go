@@ -0,0 +1,16 @@
+//go:build qf
+
+package cli
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// serveDoQ returns an error, DoQ listeners are not supported without quic.
+func (p *prog) serveDoQ(lc *ctrld.ListenerConfig, handler dns.Handler) error {
+	return errors.New("DoQ listener is not supported in this build")
+}
@@ -0,0 +1,115 @@
+//go:build !qf
+
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_serveDoQ(t *testing.T) {
+	certFile, keyFile := newTestServerCert(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	_ = pc.Close()
+
+	lc := &ctrld.ListenerConfig{IP: "127.0.0.1", Port: port, Type: ctrld.ListenerTypeDOQ, TLSCert: certFile, TLSKey: keyFile}
+	p := &prog{started: make(chan struct{}, 1), stopCh: make(chan struct{})}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.serveDoQ(lc, dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			answer := new(dns.Msg)
+			answer.SetReply(m)
+			if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+				answer.Rcode = dns.RcodeServerFailure
+			}
+			_ = w.WriteMsg(answer)
+		}))
+	}()
+	select {
+	case <-p.started:
+	case err := <-errCh:
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tlsConfig := &tls.Config{ServerName: "dns.example.com", RootCAs: testCertPool(t, certFile), NextProtos: []string{"doq"}}
+	conn, err := quic.DialAddr(ctx, net.JoinHostPort(lc.IP, strconv.Itoa(port)), tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Multiple queries are sent over the same connection.
+	for i := 0; i < 2; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Id = 0
+		answer, err := exchangeDoQ(ctx, conn, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer.Id != 0 || answer.Rcode != dns.RcodeSuccess {
+			t.Errorf("unexpected answer: %s", answer)
+		}
+	}
+
+	// Non-zero message ID is a protocol error, the connection is closed.
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = 1
+	_, err = exchangeDoQ(ctx, conn, msg)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != doqProtocolError {
+		t.Errorf("want protocol error, got: %v", err)
+	}
+
+	close(p.stopCh)
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// exchangeDoQ sends msg on a new stream of conn, returning the answer.
+func exchangeDoQ(ctx context.Context, conn quic.Connection, msg *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+	if _, err := stream.Write(out); err != nil {
+		return nil, err
+	}
+	_ = stream.Close()
+	var msgLen uint16
+	if err := binary.Read(stream, binary.BigEndian, &msgLen); err != nil {
+		return nil, err
+	}
+	buf = make([]byte, msgLen)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	return answer, answer.Unpack(buf)
+}
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// serveDoT serves DNS over TLS on the listener, until ctrld stops. Queries are answered
+// by handler, so they are processed like queries received by plain DNS listeners.
+func (p *prog) serveDoT(lc *ctrld.ListenerConfig, handler dns.Handler) error {
+	tlsConfig, err := p.listenerTLSConfig(lc)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(lc.IP, strconv.Itoa(lc.Port))
+	ln, err := listenTCP(lc, addr)
+	if err != nil {
+		return err
+	}
+	s := &dns.Server{
+		Addr:      addr,
+		Net:       "tcp-tls",
+		Listener:  tls.NewListener(ln, tlsConfig),
+		TLSConfig: tlsConfig,
+		Handler:   handler,
+		// Clients like Android Private DNS keep the connection open to send queries over.
+		IdleTimeout: func() time.Duration { return 2 * time.Minute },
+	}
+	setupTCPServer(lc, s)
+	errCh := startDNSServer(s)
+	defer s.Shutdown()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(5 * time.Second):
+		p.started <- struct{}{}
+	}
+	select {
+	case <-p.stopCh:
+	case err := <-errCh:
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_serveDoT(t *testing.T) {
+	certFile, keyFile := newTestServerCert(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+
+	lc := &ctrld.ListenerConfig{IP: "127.0.0.1", Port: port, Type: ctrld.ListenerTypeDOT, TLSCert: certFile, TLSKey: keyFile}
+	p := &prog{started: make(chan struct{}, 1), stopCh: make(chan struct{})}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.serveDoT(lc, dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			answer := new(dns.Msg)
+			answer.SetReply(m)
+			_ = w.WriteMsg(answer)
+		}))
+	}()
+	select {
+	case <-p.started:
+	case err := <-errCh:
+		t.Fatal(err)
+	}
+
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: "dns.example.com", RootCAs: testCertPool(t, certFile)}}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	answer, _, err := c.Exchange(msg, net.JoinHostPort(lc.IP, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Id != msg.Id || answer.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected answer: %s", answer)
+	}
+
+	close(p.stopCh)
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// newTestServerCert writes a self-signed certificate for dns.example.com, returning its cert and key files.
+func newTestServerCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.example.com"},
+		DNSNames:              []string{"dns.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// testCertPool returns the cert pool trusting the certificate in certFile.
+func testCertPool(t *testing.T, certFile string) *x509.CertPool {
+	t.Helper()
+	buf, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		t.Fatal("invalid certificate")
+	}
+	return pool
+}
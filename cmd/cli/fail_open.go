@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	// defaultFailOpenAfter is the time all encrypted upstreams must be down before failing open.
+	defaultFailOpenAfter = time.Minute
+	// failOpenCheckInterval is the interval of checking whether encrypted upstreams are down.
+	failOpenCheckInterval = time.Second
+)
+
+// failOpen forwards queries to a plain DNS upstream, e.g: the ISP resolver, while all encrypted
+// upstreams are down, so clients keep having working DNS instead of failing closed. It is opt-in,
+// because queries are then visible on the network.
+type failOpen struct {
+	name      string
+	uc        *ctrld.UpstreamConfig
+	after     time.Duration
+	encrypted []string // Upstreams which must all be down before failing open.
+
+	mu        sync.Mutex
+	downSince time.Time
+	active    bool
+}
+
+// newFailOpen returns a failOpen for the fail open upstream of cfg,
+// or nil if failing open is disabled.
+func newFailOpen(cfg *ctrld.Config) *failOpen {
+	name := cfg.Service.FailOpenUpstream
+	if name == "" {
+		return nil
+	}
+	uc := cfg.Upstream[strings.TrimPrefix(name, upstreamPrefix)]
+	if uc == nil {
+		mainLog.Load().Error().Msgf("fail open upstream %s not found, failing open is disabled", name)
+		return nil
+	}
+	var encrypted []string
+	for n, uc := range cfg.Upstream {
+		switch uc.Type {
+		case ctrld.ResolverTypeDOH, ctrld.ResolverTypeDOH3, ctrld.ResolverTypeDOHJSON,
+			ctrld.ResolverTypeDOT, ctrld.ResolverTypeDOQ, ctrld.ResolverTypeDNSCrypt:
+			encrypted = append(encrypted, upstreamPrefix+n)
+		}
+	}
+	if len(encrypted) == 0 {
+		mainLog.Load().Warn().Msg("no encrypted upstreams, failing open is disabled")
+		return nil
+	}
+	sort.Strings(encrypted)
+	after := defaultFailOpenAfter
+	if cfg.Service.FailOpenAfter > 0 {
+		after = time.Duration(cfg.Service.FailOpenAfter) * time.Second
+	}
+	return &failOpen{name: name, uc: uc, after: after, encrypted: encrypted}
+}
+
+// isActive reports whether queries are being forwarded to the fail open upstream.
+func (f *failOpen) isActive() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// update records whether all encrypted upstreams are down at the given time, and reports
+// whether failing open was activated or deactivated. It is activated once all encrypted
+// upstreams are down for longer than f.after, and deactivated as soon as one of them is up.
+func (f *failOpen) update(allDown bool, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !allDown {
+		f.downSince = time.Time{}
+		if f.active {
+			f.active = false
+			return true
+		}
+		return false
+	}
+	if f.downSince.IsZero() {
+		f.downSince = now
+	}
+	if !f.active && now.Sub(f.downSince) >= f.after {
+		f.active = true
+		return true
+	}
+	return false
+}
+
+// run checks the encrypted upstreams every failOpenCheckInterval until ctx is done,
+// alerting when failing open is activated or deactivated.
+func (f *failOpen) run(ctx context.Context, p *prog) {
+	ticker := time.NewTicker(failOpenCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !f.update(p.um.allDown(f.encrypted), time.Now()) {
+			continue
+		}
+		if f.isActive() {
+			mainLog.Load().Warn().Msgf("all encrypted upstreams are down for %s, failing open to %s", f.after, f.name)
+			p.runHook(hookFailOpen, "CTRLD_FAIL_OPEN=true", "CTRLD_UPSTREAM="+f.name)
+		} else {
+			mainLog.Load().Notice().Msg("encrypted upstreams recovered, stop failing open")
+			p.runHook(hookFailOpen, "CTRLD_FAIL_OPEN=false", "CTRLD_UPSTREAM="+f.name)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_newFailOpen(t *testing.T) {
+	cfg := &ctrld.Config{
+		Service: ctrld.ServiceConfig{FailOpenUpstream: "upstream.isp"},
+		Upstream: map[string]*ctrld.UpstreamConfig{
+			"0":   {Type: ctrld.ResolverTypeDOH},
+			"1":   {Type: ctrld.ResolverTypeDOQ},
+			"os":  {Type: ctrld.ResolverTypeOS},
+			"isp": {Type: ctrld.ResolverTypeLegacy},
+		},
+	}
+	f := newFailOpen(cfg)
+	if f == nil {
+		t.Fatal("fail open must be enabled")
+	}
+	if f.after != defaultFailOpenAfter {
+		t.Errorf("unexpected fail open after, want: %s, got: %s", defaultFailOpenAfter, f.after)
+	}
+	want := []string{"upstream.0", "upstream.1"}
+	if len(f.encrypted) != len(want) || f.encrypted[0] != want[0] || f.encrypted[1] != want[1] {
+		t.Errorf("unexpected encrypted upstreams, want: %v, got: %v", want, f.encrypted)
+	}
+
+	cfg.Service.FailOpenUpstream = ""
+	if newFailOpen(cfg) != nil {
+		t.Error("fail open must be disabled without fail open upstream")
+	}
+}
+
+func Test_failOpen_update(t *testing.T) {
+	f := &failOpen{after: time.Minute}
+	now := time.Now()
+
+	if f.update(true, now) || f.isActive() {
+		t.Fatal("must not fail open as soon as encrypted upstreams are down")
+	}
+	if f.update(false, now.Add(30*time.Second)) {
+		t.Fatal("state must not change while not failing open")
+	}
+	// Down time starts over after encrypted upstreams were up.
+	if f.update(true, now.Add(40*time.Second)) || f.update(true, now.Add(90*time.Second)) {
+		t.Fatal("must not fail open before threshold")
+	}
+	if !f.update(true, now.Add(100*time.Second)) || !f.isActive() {
+		t.Fatal("must fail open after threshold")
+	}
+	if f.update(true, now.Add(110*time.Second)) {
+		t.Fatal("state must not change while encrypted upstreams are still down")
+	}
+	if !f.update(false, now.Add(120*time.Second)) || f.isActive() {
+		t.Fatal("must stop failing open once encrypted upstreams recovered")
+	}
+}
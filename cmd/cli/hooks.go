@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Lifecycle events which hook scripts could be run on.
+const (
+	hookPreStart      = "pre_start"
+	hookPostConfigure = "post_configure"
+	hookUpstreamDown  = "upstream_down"
+	hookReload        = "reload"
+	hookFailOpen      = "fail_open"
+	hookACMEDNS       = "acme_dns"
+)
+
+// defaultHookTimeout is the default time a hook script is allowed to run.
+const defaultHookTimeout = 10 * time.Second
+
+// hookScript returns the hook script configured for the given event, if any.
+func (p *prog) hookScript(event string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cfg == nil {
+		return ""
+	}
+	switch event {
+	case hookPreStart:
+		return p.cfg.Service.HookPreStart
+	case hookPostConfigure:
+		return p.cfg.Service.HookPostConfigure
+	case hookUpstreamDown:
+		return p.cfg.Service.HookUpstreamDown
+	case hookReload:
+		return p.cfg.Service.HookReload
+	case hookFailOpen:
+		return p.cfg.Service.HookFailOpen
+	case hookACMEDNS:
+		return p.cfg.Service.HookACMEDNS
+	}
+	return ""
+}
+
+// hookTimeout returns the time a hook script is allowed to run.
+func (p *prog) hookTimeout() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cfg != nil && p.cfg.Service.HookTimeout > 0 {
+		return time.Duration(p.cfg.Service.HookTimeout) * time.Second
+	}
+	return defaultHookTimeout
+}
+
+// runHook runs the hook script configured for the given event, waiting until it finished
+// or timed out. The event name is passed to the script via CTRLD_EVENT environment variable,
+// together with given env, in form "key=value". Output of the script is written to ctrld log.
+// The returned error is only checked by events whose outcome matters, like acme_dns.
+func (p *prog) runHook(event string, env ...string) error {
+	script := p.hookScript(event)
+	if script == "" {
+		return nil
+	}
+	logger := mainLog.Load().With().Str("hook", event).Str("script", script).Logger()
+	logger.Debug().Msg("running hook script")
+	out, err := runHookScript(script, p.hookTimeout(), append([]string{"CTRLD_EVENT=" + event}, env...))
+	if out := strings.TrimSpace(string(out)); out != "" {
+		logger.Info().Msgf("hook script output: %s", out)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("hook script failed")
+		return err
+	}
+	logger.Debug().Msg("hook script finished")
+	return nil
+}
+
+// runHookScript runs script with additional env, returning its combined output.
+// The script is killed if it does not finish within timeout.
+func runHookScript(script string, timeout time.Duration, env []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = append(os.Environ(), env...)
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	// Do not wait for orphaned children which keep the output pipe open.
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = errors.New("timeout exceeded")
+	}
+	return buf.Bytes(), err
+}
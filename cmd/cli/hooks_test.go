@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_runHookScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script is not supported on Windows")
+	}
+	dir := t.TempDir()
+	writeScript := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+content), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	out, err := runHookScript(writeScript("echo.sh", `echo "$CTRLD_EVENT $CTRLD_UPSTREAM"`), time.Second, []string{"CTRLD_EVENT=" + hookUpstreamDown, "CTRLD_UPSTREAM=upstream.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "upstream_down upstream.0" {
+		t.Errorf("unexpected output: %q", got)
+	}
+
+	if _, err := runHookScript(writeScript("fail.sh", "exit 1"), time.Second, nil); err == nil {
+		t.Error("expected error for failed script")
+	}
+
+	start := time.Now()
+	if _, err := runHookScript(writeScript("sleep.sh", "sleep 10"), 100*time.Millisecond, nil); err == nil {
+		t.Error("expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("script was not killed after timeout: %s", elapsed)
+	}
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	// mirrorQueueSize is the number of queries waiting to be mirrored. Queries
+	// are dropped if the queue is full, so a slow mirror never delays clients.
+	mirrorQueueSize = 256
+	// mirrorWorkers is the number of goroutines sending queries to the mirror.
+	mirrorWorkers = 4
+	// mirrorTimeout is the default timeout for sending a query to the mirror.
+	mirrorTimeout = 2 * time.Second
+)
+
+// queryMirror copies queries to a secondary upstream, e.g: a passive DNS collector.
+// Answers from the mirror are discarded.
+type queryMirror struct {
+	name       string
+	uc         *ctrld.UpstreamConfig
+	sampleRate int // Percentage of queries which are mirrored.
+	queue      chan *dns.Msg
+}
+
+// newQueryMirror returns a queryMirror for the mirror upstream of cfg,
+// or nil if mirroring is disabled.
+func newQueryMirror(cfg *ctrld.Config) *queryMirror {
+	name := cfg.Service.MirrorUpstream
+	if name == "" {
+		return nil
+	}
+	uc := cfg.Upstream[strings.TrimPrefix(name, upstreamPrefix)]
+	if uc == nil {
+		mainLog.Load().Error().Msgf("mirror upstream %s not found, query mirroring is disabled", name)
+		return nil
+	}
+	sampleRate := cfg.Service.MirrorSampleRate
+	if sampleRate <= 0 || sampleRate > 100 {
+		sampleRate = 100
+	}
+	return &queryMirror{
+		name:       name,
+		uc:         uc,
+		sampleRate: sampleRate,
+		queue:      make(chan *dns.Msg, mirrorQueueSize),
+	}
+}
+
+// mirror queues a copy of msg to be sent to the mirror, if it is sampled.
+// It never blocks, the query is dropped if the queue is full.
+func (m *queryMirror) mirror(msg *dns.Msg) {
+	if m == nil || !m.sampled(rand.Intn(100)) {
+		return
+	}
+	select {
+	case m.queue <- msg.Copy():
+	default:
+		mainLog.Load().Debug().Msgf("mirror queue is full, dropping query to %s", m.name)
+	}
+}
+
+// sampled reports whether a query with random number n in [0, 100) is mirrored.
+func (m *queryMirror) sampled(n int) bool {
+	return n < m.sampleRate
+}
+
+// run sends queued queries to the mirror until ctx is done.
+func (m *queryMirror) run(ctx context.Context) {
+	for i := 0; i < mirrorWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg := <-m.queue:
+					m.send(ctx, msg)
+				}
+			}
+		}()
+	}
+	<-ctx.Done()
+}
+
+// send sends msg to the mirror, ignoring the answer.
+func (m *queryMirror) send(ctx context.Context, msg *dns.Msg) {
+	r, err := ctrld.NewResolver(m.uc)
+	if err != nil {
+		mainLog.Load().Debug().Err(err).Msgf("failed to create resolver for mirror %s", m.name)
+		return
+	}
+	timeout := mirrorTimeout
+	if m.uc.Timeout > 0 {
+		timeout = time.Millisecond * time.Duration(m.uc.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := r.Resolve(ctx, msg); err != nil {
+		mainLog.Load().Debug().Err(err).Msgf("failed to mirror query to %s", m.name)
+	}
+}
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_newQueryMirror(t *testing.T) {
+	newCfg := func(upstream string, sampleRate int) *ctrld.Config {
+		cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{
+			"1": {Name: "collector", Type: ctrld.ResolverTypeLegacy, Endpoint: "192.0.2.1:53"},
+		}}
+		cfg.Service.MirrorUpstream = upstream
+		cfg.Service.MirrorSampleRate = sampleRate
+		return cfg
+	}
+
+	assert.Nil(t, newQueryMirror(newCfg("", 0)), "mirroring must be disabled by default")
+	assert.Nil(t, newQueryMirror(newCfg("upstream.2", 0)), "mirroring must be disabled for unknown upstream")
+
+	m := newQueryMirror(newCfg("upstream.1", 0))
+	require.NotNil(t, m)
+	assert.Equal(t, 100, m.sampleRate)
+	assert.True(t, m.sampled(99))
+
+	m = newQueryMirror(newCfg("upstream.1", 10))
+	require.NotNil(t, m)
+	assert.True(t, m.sampled(9))
+	assert.False(t, m.sampled(10))
+}
+
+func Test_queryMirror_mirror(t *testing.T) {
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{
+		"1": {Name: "collector", Type: ctrld.ResolverTypeLegacy, Endpoint: "192.0.2.1:53"},
+	}}
+	cfg.Service.MirrorUpstream = "upstream.1"
+	m := newQueryMirror(cfg)
+	require.NotNil(t, m)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	// Without running workers, queries beyond the queue size are dropped instead of blocking.
+	for i := 0; i < mirrorQueueSize+10; i++ {
+		m.mirror(msg)
+	}
+	assert.Len(t, m.queue, mirrorQueueSize)
+	queued := <-m.queue
+	assert.NotSame(t, msg, queued, "a copy of the query must be mirrored")
+
+	var disabled *queryMirror
+	disabled.mirror(msg)
+}
@@ -25,9 +25,7 @@ func (p *prog) watchLinkState(ctx context.Context) {
 			}
 			if lu.Change&unix.IFF_UP != 0 {
 				mainLog.Load().Debug().Msgf("link state changed, re-bootstrapping")
-				for _, uc := range p.cfg.Upstream {
-					uc.ReBootstrap()
-				}
+				p.handleNetworkChange()
 			}
 		}
 	}
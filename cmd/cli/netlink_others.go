@@ -2,6 +2,30 @@
 
 package cli
 
-import "context"
+import (
+	"context"
 
-func (p *prog) watchLinkState(ctx context.Context) {}
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netmon"
+)
+
+// watchLinkState re-bootstraps upstreams on major network changes, e.g: switching Wi-Fi networks.
+func (p *prog) watchLinkState(ctx context.Context) {
+	mon, err := netmon.New(func(format string, args ...any) {
+		mainLog.Load().Debug().Msgf("netmon: "+format, args...)
+	})
+	if err != nil {
+		mainLog.Load().Warn().Err(err).Msg("could not watch network changes")
+		return
+	}
+	defer mon.Close()
+	mon.RegisterChangeCallback(func(changed bool, _ *interfaces.State) {
+		if !changed {
+			return
+		}
+		mainLog.Load().Debug().Msg("network changed, re-bootstrapping")
+		p.handleNetworkChange()
+	})
+	mon.Start()
+	<-ctx.Done()
+}
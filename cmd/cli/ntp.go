@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/sntp"
+)
+
+const (
+	ntpSyncOffset = "offset"
+	ntpSyncStep   = "step"
+
+	ntpQueryTimeout = 3 * time.Second
+	// ntpRetryInterval is the interval between syncs while NTP servers are unreachable,
+	// for example, WAN is not up yet after router booted.
+	ntpRetryInterval = 30 * time.Second
+	// ntpResyncInterval is the interval between syncs after a successful one, so drift
+	// of local clock is corrected.
+	ntpResyncInterval = time.Hour
+	// ntpStepThreshold is the minimum offset for stepping system clock,
+	// smaller offset is left for the system NTP daemon.
+	ntpStepThreshold = 10 * time.Second
+	// clockStepCheckInterval is the interval for checking whether the system clock was stepped.
+	clockStepCheckInterval = 10 * time.Second
+)
+
+// startClockSync syncs local clock with NTP servers in background, if enabled by config.
+// Syncing is retried while no servers are reachable, then repeated periodically until
+// ctrld stopped. See clockSyncLoop for more details.
+func (p *prog) startClockSync() {
+	mode := p.cfg.Service.NtpSync
+	if mode == "" {
+		return
+	}
+	servers := p.cfg.Service.NtpServers
+	if len(servers) == 0 {
+		servers = sntp.DefaultServers
+	}
+	go p.clockSyncLoop(mode, servers)
+}
+
+// clockSyncLoop syncs local clock every ntpResyncInterval, or every ntpRetryInterval while
+// NTP servers are unreachable. The learned offset is relative to the system clock, so when
+// the system clock is stepped by others, like the system NTP daemon, the offset is reset,
+// and the clock is synced again right away.
+func (p *prog) clockSyncLoop(mode string, servers []string) {
+	ticker := time.NewTicker(clockStepCheckInterval)
+	defer ticker.Stop()
+	next := time.Now()
+	last := next
+	for {
+		if now := time.Now(); !now.Before(next) {
+			next = now.Add(ntpResyncInterval)
+			if err := syncClock(mode, servers); err != nil {
+				next = now.Add(ntpRetryInterval)
+			}
+			// Stepping the clock while syncing must not be reported as stepped by others.
+			last = time.Now()
+		}
+		select {
+		case <-p.stopCh:
+			return
+		case now := <-ticker.C:
+			if step := clockStep(last, now); step >= ntpStepThreshold || step <= -ntpStepThreshold {
+				mainLog.Load().Info().Dur("step", step).Msg("system clock was stepped, resetting clock offset")
+				ctrld.SetClockOffset(0)
+				next = now
+			}
+			last = now
+		}
+	}
+}
+
+// clockStep returns how much the system clock was stepped between last and now, which is
+// the difference between the elapsed wall clock time and the elapsed monotonic time.
+func clockStep(last, now time.Time) time.Duration {
+	return now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+}
+
+// syncClock queries NTP servers for local clock offset. With "step" mode, the system clock
+// is set if it is off by more than ntpStepThreshold. Otherwise, or if the system clock could
+// not be set, the offset is used for verifying TLS certificates of upstreams.
+func syncClock(mode string, servers []string) error {
+	res, server, err := queryNtpServers(servers)
+	if err != nil {
+		mainLog.Load().Warn().Err(err).Msg("could not sync clock with NTP servers")
+		return err
+	}
+	logger := mainLog.Load().With().Str("server", server).Dur("offset", res.Offset).Logger()
+	if mode == ntpSyncStep && (res.Offset >= ntpStepThreshold || res.Offset <= -ntpStepThreshold) {
+		if err := setSystemClock(time.Now().Add(res.Offset)); err == nil {
+			logger.Notice().Msg("system clock was set using NTP server")
+			ctrld.SetClockOffset(0)
+			return nil
+		} else {
+			logger.Warn().Err(err).Msg("could not set system clock, using offset for TLS verification")
+		}
+	}
+	logger.Info().Msg("learned clock offset from NTP server")
+	ctrld.SetClockOffset(res.Offset)
+	return nil
+}
+
+// queryNtpServers queries servers in order, returning the first successful result
+// and the server which answered.
+func queryNtpServers(servers []string) (*sntp.Result, string, error) {
+	var errs []error
+	for _, server := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), ntpQueryTimeout)
+		res, err := sntp.Query(ctx, server, nil)
+		cancel()
+		if err == nil {
+			return res, server, nil
+		}
+		mainLog.Load().Debug().Err(err).Msgf("NTP query to %s failed", server)
+		errs = append(errs, err)
+	}
+	return nil, "", errors.Join(errs...)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package cli
+
+import (
+	"errors"
+	"time"
+)
+
+// setSystemClock sets the system clock to t.
+func setSystemClock(t time.Time) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package cli
+
+import (
+	"syscall"
+	"time"
+)
+
+// setSystemClock sets the system clock to t.
+func setSystemClock(t time.Time) error {
+	tv := syscall.NsecToTimeval(t.UnixNano())
+	return syscall.Settimeofday(&tv)
+}
@@ -0,0 +1,199 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/controld"
+)
+
+// profileRequest represents request for switching Control D profile.
+type profileRequest struct {
+	ID string `json:"id"`
+}
+
+// profileResponse represents result of switching Control D profile.
+type profileResponse struct {
+	// Upstreams is the list of upstreams which were switched to new profile.
+	Upstreams []string `json:"upstreams,omitempty"`
+	// Persistent reports whether the new profile is kept after ctrld restarted.
+	Persistent bool `json:"persistent"`
+	// Error is the reason why profile could not be switched, if any.
+	Error string `json:"error,omitempty"`
+}
+
+var errNoControlDUpstream = errors.New("no Control D upstream found in config")
+
+// cdUIDMu guards cdUID, which may be changed by switchProfile while ctrld is running.
+var cdUIDMu sync.RWMutex
+
+// loadCdUID returns the current Control D resolver uid. Code running after ctrld started
+// must use this instead of reading cdUID directly.
+func loadCdUID() string {
+	cdUIDMu.RLock()
+	defer cdUIDMu.RUnlock()
+	return cdUID
+}
+
+// storeCdUID sets the current Control D resolver uid to uid.
+func storeCdUID(uid string) {
+	cdUIDMu.Lock()
+	defer cdUIDMu.Unlock()
+	cdUID = uid
+}
+
+// switchProfile switches the active Control D profile to the one with given resolver id,
+// then reloads ctrld to apply the change.
+//
+// In cd mode, the new resolver id is used for fetching config from Control D API. This does
+// not change the --cd flag of installed service, so the profile is reverted after restarting.
+//
+// Otherwise, all Control D upstreams in config file are updated to use the new profile. The
+// config file is rewritten from the parsed config, so comments and formatting of the original
+// file are not kept.
+//
+// If the reload fails, the previous resolver id or config file is restored.
+func (p *prog) switchProfile(id string) (*profileResponse, error) {
+	p.rulesMu.Lock()
+	defer p.rulesMu.Unlock()
+
+	res := &profileResponse{}
+	// Validate the profile against Control D API.
+	if _, err := controld.FetchResolverConfig(id, rootCmd.Version, cdDev); err != nil {
+		return nil, fmt.Errorf("invalid profile %q: %w", id, err)
+	}
+	if prevUID := loadCdUID(); prevUID != "" {
+		// Keep the custom client id, if any.
+		if _, clientID := controld.ParseRawUID(prevUID); clientID != "" {
+			id += "/" + clientID
+		}
+		storeCdUID(id)
+		res.Upstreams = []string{"0"}
+		if _, err := p.reloadAndWait(); err != nil {
+			storeCdUID(prevUID)
+			mainLog.Load().Warn().Msgf("profile was restored to %s", prevUID)
+			if err := p.sendReloadSignal(); err != nil {
+				mainLog.Load().Err(err).Msg("could not send reload signal")
+			}
+			return nil, err
+		}
+		return res, nil
+	}
+
+	newCfg, path, err := loadConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	res.Upstreams = switchProfileUpstreams(newCfg, id)
+	if len(res.Upstreams) == 0 {
+		return nil, errNoControlDUpstream
+	}
+	prev, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	if err := writeConfigAtomic(path, newCfg); err != nil {
+		return nil, fmt.Errorf("could not write config file: %w", err)
+	}
+	if _, err := p.reloadAndWait(); err != nil {
+		p.restoreConfigFile(path, prev)
+		return nil, err
+	}
+	res.Persistent = true
+	return res, nil
+}
+
+// switchProfileUpstreams updates endpoints of Control D upstreams in cfg to use the profile
+// with given resolver id, returning the names of updated upstreams.
+func switchProfileUpstreams(cfg *ctrld.Config, id string) []string {
+	var names []string
+	for name, uc := range cfg.Upstream {
+		if endpoint, ok := profileEndpoint(uc, id); ok {
+			uc.Endpoint = endpoint
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileEndpoint returns the endpoint of Control D upstream uc, using the profile with given
+// resolver id. It reports false if uc is not a Control D upstream with a resolver id, for example
+// the free DNS ones.
+//
+// The resolver id is the first path segment for DoH/DoH3 (https://dns.controld.com/<id>), and
+// the first label for DoT/DoQ (<id>.dns.controld.com), which may be followed by a client id
+// (<id>-<client_id>.dns.controld.com).
+func profileEndpoint(uc *ctrld.UpstreamConfig, id string) (string, bool) {
+	switch uc.Type {
+	case ctrld.ResolverTypeDOH, ctrld.ResolverTypeDOH3:
+		u, err := url.Parse(uc.Endpoint)
+		if err != nil || !isControlDProfileHost(u.Hostname()) {
+			return "", false
+		}
+		segments := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+		if segments[0] == "" {
+			return "", false
+		}
+		segments[0] = id
+		u.Path = "/" + strings.Join(segments, "/")
+		return u.String(), true
+	case ctrld.ResolverTypeDOT, ctrld.ResolverTypeDOQ:
+		host, port, err := net.SplitHostPort(uc.Endpoint)
+		if err != nil {
+			host, port = uc.Endpoint, ""
+		}
+		label, parent, ok := strings.Cut(host, ".")
+		if !ok || !isControlDProfileHost(parent) {
+			return "", false
+		}
+		// Keep the client id, if any.
+		if _, clientID, ok := strings.Cut(label, "-"); ok {
+			label = id + "-" + clientID
+		} else {
+			label = id
+		}
+		host = label + "." + parent
+		if port != "" {
+			return net.JoinHostPort(host, port), true
+		}
+		return host, true
+	}
+	return "", false
+}
+
+// isControlDProfileHost reports whether host is a Control D resolver host, which serves
+// resolvers by profile id, like dns.controld.com.
+func isControlDProfileHost(host string) bool {
+	// The endpoint in config file may not be initialized yet, so use the host as Domain here.
+	uc := &ctrld.UpstreamConfig{Domain: host}
+	return strings.HasPrefix(host, "dns.") && uc.IsControlD()
+}
+
+// handleProfile is the control server handler for switching Control D profile.
+func (p *prog) handleProfile(w http.ResponseWriter, request *http.Request) {
+	var req profileRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil || req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&profileResponse{Error: "missing profile id"})
+		return
+	}
+	res, err := p.switchProfile(req.ID)
+	if err != nil {
+		mainLog.Load().Err(err).Msg("could not switch profile")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&profileResponse{Error: err.Error()})
+		return
+	}
+	mainLog.Load().Notice().Msgf("switched to profile %s, upstreams: %v", req.ID, res.Upstreams)
+	_ = json.NewEncoder(w).Encode(res)
+}
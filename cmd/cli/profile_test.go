@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_profileEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		uc       *ctrld.UpstreamConfig
+		want     string
+		switched bool
+	}{
+		{"doh", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOH, Endpoint: "https://dns.controld.com/old"}, "https://dns.controld.com/new", true},
+		{"doh with client id", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOH, Endpoint: "https://dns.controld.com/old/client"}, "https://dns.controld.com/new/client", true},
+		{"doh3", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOH3, Endpoint: "https://dns.controld.com/old"}, "https://dns.controld.com/new", true},
+		{"doh free dns", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOH, Endpoint: "https://freedns.controld.com/p2"}, "", false},
+		{"doh no resolver id", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOH, Endpoint: "https://dns.controld.com"}, "", false},
+		{"doh non controld", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOH, Endpoint: "https://dns.google/dns-query"}, "", false},
+		{"dot", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOT, Endpoint: "old.dns.controld.com"}, "new.dns.controld.com", true},
+		{"dot with port", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOT, Endpoint: "old.dns.controld.com:853"}, "new.dns.controld.com:853", true},
+		{"dot with client id", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOT, Endpoint: "old-kids-devices.dns.controld.com"}, "new-kids-devices.dns.controld.com", true},
+		{"doq", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOQ, Endpoint: "old.dns.controld.com"}, "new.dns.controld.com", true},
+		{"dot free dns", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeDOT, Endpoint: "p2.freedns.controld.com"}, "", false},
+		{"legacy", &ctrld.UpstreamConfig{Type: ctrld.ResolverTypeLegacy, Endpoint: "76.76.2.22"}, "", false},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, switched := profileEndpoint(tc.uc, "new")
+			if switched != tc.switched {
+				t.Fatalf("unexpected switched result, want: %v, got: %v", tc.switched, switched)
+			}
+			if got != tc.want {
+				t.Errorf("unexpected endpoint, want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_cdUIDConcurrent(t *testing.T) {
+	old := loadCdUID()
+	t.Cleanup(func() { storeCdUID(old) })
+
+	var wg sync.WaitGroup
+	for _, uid := range []string{"abcd1234", "efgh5678"} {
+		uid := uid
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			storeCdUID(uid)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = loadCdUID()
+		}()
+	}
+	wg.Wait()
+	if got := loadCdUID(); got != "abcd1234" && got != "efgh5678" {
+		t.Errorf("unexpected uid: %q", got)
+	}
+}
@@ -12,14 +12,16 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/kardianos/service"
-	"github.com/spf13/viper"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
 
@@ -36,6 +38,10 @@ const (
 	upstreamPrefix       = "upstream."
 	upstreamOS           = upstreamPrefix + "os"
 	upstreamPrivate      = upstreamPrefix + "private"
+	// bootstrapStateFile is the file, in ctrld home dir, which remembers working bootstrap resolvers.
+	bootstrapStateFile = "ctrld-bootstrap.json"
+	// reloadWaitTimeout is how long reloadAndWait waits for the reload to be done.
+	reloadWaitTimeout = 5 * time.Second
 )
 
 var logf = func(format string, args ...any) {
@@ -60,13 +66,25 @@ type prog struct {
 	cs           *controlServer
 
 	cfg            *ctrld.Config
+	lastReloadDiff *configDiff
+	reloadWaitMu   sync.Mutex
+	reloadWaiters  []chan *reloadResult
+	rulesMu        sync.Mutex // Serializes rule and profile edits via control server.
 	localUpstreams []string
 	ptrNameservers []string
+	mdnsUpstream   string
 	appCallback    *AppCallback
 	cache          dnscache.Cacher
+	mirror         atomic.Pointer[queryMirror] // Replaced on reload, while queries are served.
+	failOpen       *failOpen
+	acme           *acmeManager
 	sema           semaphore
+	pins           answerPins
+	qg             queryGroup
 	ciTable        *clientinfo.Table
 	um             *upstreamMonitor
+	upstreamGroups map[string]*upstreamGroup
+	cacheRules     *cacheRules
 	router         router.Router
 	ptrLoopGuard   *loopGuard
 	lanLoopGuard   *loopGuard
@@ -74,6 +92,8 @@ type prog struct {
 	loopMu sync.Mutex
 	loop   map[string]bool
 
+	startedAt time.Time // For startup grace period.
+
 	started       chan struct{}
 	onStartedDone chan struct{}
 	onStarted     []func()
@@ -112,31 +132,30 @@ func (p *prog) runWait() {
 			close(reloadCh)
 			return
 		}
+		// Waiters registered from now on wait for the next reload, which reads their changes.
+		waiters := p.takeReloadWaiters()
+		notifyWaiters := func(res *reloadResult) {
+			for _, ch := range waiters {
+				ch <- res
+			}
+		}
 
 		waitOldRunDone := func() {
 			close(reloadCh)
 			<-done
 		}
-		newCfg := &ctrld.Config{}
-		v := viper.NewWithOptions(viper.KeyDelimiter("::"))
-		ctrld.InitConfig(v, "ctrld")
-		if configPath != "" {
-			v.SetConfigFile(configPath)
-		}
-		if err := v.ReadInConfig(); err != nil {
+		newCfg, _, err := loadConfigFile()
+		if err != nil {
 			logger.Err(err).Msg("could not read new config")
 			waitOldRunDone()
+			notifyWaiters(&reloadResult{err: err})
 			continue
 		}
-		if err := v.Unmarshal(&newCfg); err != nil {
-			logger.Err(err).Msg("could not unmarshal new config")
-			waitOldRunDone()
-			continue
-		}
-		if cdUID != "" {
+		if loadCdUID() != "" {
 			if err := processCDFlags(newCfg); err != nil {
 				logger.Err(err).Msg("could not fetch ControlD config")
 				waitOldRunDone()
+				notifyWaiters(&reloadResult{err: err})
 				continue
 			}
 		}
@@ -161,6 +180,7 @@ func (p *prog) runWait() {
 		}
 		if err := validateConfig(newCfg); err != nil {
 			logger.Err(err).Msg("invalid config")
+			notifyWaiters(&reloadResult{err: err})
 			continue
 		}
 
@@ -169,11 +189,21 @@ func (p *prog) runWait() {
 		mainLog.Load().Debug().Msg("setup upstream with new config")
 		p.setupUpstream(newCfg)
 
+		p.ciTable.UpdateClients(newCfg.Clients)
+
 		p.mu.Lock()
+		diff := diffConfig(p.cfg, newCfg)
+		p.lastReloadDiff = diff
 		*p.cfg = *newCfg
 		p.mu.Unlock()
 
-		logger.Notice().Msg("reloading config successfully")
+		if diff.empty() {
+			logger.Notice().Msg("reloading config successfully, no changes")
+		} else {
+			logger.Notice().Interface("diff", diff).Msg("reloading config successfully")
+		}
+		go p.runHook(hookReload)
+		notifyWaiters(&reloadResult{diff: diff})
 		select {
 		case p.reloadDoneCh <- struct{}{}:
 		default:
@@ -181,6 +211,49 @@ func (p *prog) runWait() {
 	}
 }
 
+// reloadResult is the result of a reload, sent to waiters registered by reloadAndWait.
+type reloadResult struct {
+	diff *configDiff
+	err  error
+}
+
+// reloadAndWait sends the reload signal, then waits for the reload which reads the config after
+// the signal was sent, returning the changes it applied. Unlike reloadDoneCh, each caller waits on
+// its own channel, so the result could not be consumed by other reload requests.
+func (p *prog) reloadAndWait() (*configDiff, error) {
+	ch := make(chan *reloadResult, 1)
+	p.reloadWaitMu.Lock()
+	p.reloadWaiters = append(p.reloadWaiters, ch)
+	p.reloadWaitMu.Unlock()
+	if err := p.sendReloadSignal(); err != nil {
+		p.removeReloadWaiter(ch)
+		return nil, fmt.Errorf("could not send reload signal: %w", err)
+	}
+	select {
+	case res := <-ch:
+		return res.diff, res.err
+	case <-time.After(reloadWaitTimeout):
+		p.removeReloadWaiter(ch)
+		return nil, errors.New("timeout waiting for ctrld reload")
+	}
+}
+
+// takeReloadWaiters returns the registered reload waiters, and clears them.
+func (p *prog) takeReloadWaiters() []chan *reloadResult {
+	p.reloadWaitMu.Lock()
+	defer p.reloadWaitMu.Unlock()
+	waiters := p.reloadWaiters
+	p.reloadWaiters = nil
+	return waiters
+}
+
+// removeReloadWaiter removes ch from the reload waiters, if it was not taken by a reload yet.
+func (p *prog) removeReloadWaiter(ch chan *reloadResult) {
+	p.reloadWaitMu.Lock()
+	defer p.reloadWaitMu.Unlock()
+	p.reloadWaiters = slices.DeleteFunc(p.reloadWaiters, func(w chan *reloadResult) bool { return w == ch })
+}
+
 func (p *prog) preRun() {
 	if !service.Interactive() {
 		p.setDNS()
@@ -194,20 +267,42 @@ func (p *prog) preRun() {
 	}
 }
 
+// handleNetworkChange re-bootstraps upstreams after the network changed. Connections established
+// on the previous network are closed, so queries are re-sent over new connections right away,
+// instead of waiting for timeouts.
+func (p *prog) handleNetworkChange() {
+	for _, uc := range p.cfg.Upstream {
+		uc.ReBootstrap()
+		uc.ResetConns()
+		go uc.WarmUpConns()
+	}
+}
+
 func (p *prog) setupUpstream(cfg *ctrld.Config) {
 	localUpstreams := make([]string, 0, len(cfg.Upstream))
 	ptrNameservers := make([]string, 0, len(cfg.Upstream))
+	var mdnsUpstreams []string
 	for n := range cfg.Upstream {
 		uc := cfg.Upstream[n]
+		discoverEncryptedUpstream(n, uc)
 		uc.Init()
-		if uc.BootstrapIP == "" {
+		switch {
+		case uc.Type == ctrld.ResolverTypeUnix:
+			mainLog.Load().Info().Msgf("upstream.%s is unix socket: %s", n, uc.Endpoint)
+		case uc.Type == ctrld.ResolverTypeMDNS:
+			mdnsUpstreams = append(mdnsUpstreams, n)
+		case uc.Proxy != "" && uc.BootstrapIP == "":
+			// Resolving upstream locally would leak outside the proxy, let the proxy do it.
+			mainLog.Load().Info().Msgf("upstream.%s is resolved by proxy", n)
+		case uc.BootstrapIP == "":
 			uc.SetupBootstrapIP()
 			mainLog.Load().Info().Msgf("bootstrap IPs for upstream.%s: %q", n, uc.BootstrapIPs())
-		} else {
+		default:
 			mainLog.Load().Info().Str("bootstrap_ip", uc.BootstrapIP).Msgf("using bootstrap IP for upstream.%s", n)
 		}
 		uc.SetCertPool(rootCertPool)
 		go uc.Ping()
+		go uc.WarmUpConns()
 
 		if canBeLocalUpstream(uc.Domain) {
 			localUpstreams = append(localUpstreams, upstreamPrefix+n)
@@ -218,6 +313,17 @@ func (p *prog) setupUpstream(cfg *ctrld.Config) {
 	}
 	p.localUpstreams = localUpstreams
 	p.ptrNameservers = ptrNameservers
+	// The mdns upstream with the lowest number is used for .local names.
+	p.mdnsUpstream = ""
+	if len(mdnsUpstreams) > 0 {
+		sort.Slice(mdnsUpstreams, func(i, j int) bool {
+			ni, _ := strconv.Atoi(mdnsUpstreams[i])
+			nj, _ := strconv.Atoi(mdnsUpstreams[j])
+			return ni < nj
+		})
+		p.mdnsUpstream = upstreamPrefix + mdnsUpstreams[0]
+		mainLog.Load().Info().Msgf("resolving .local names via mDNS using %s", p.mdnsUpstream)
+	}
 }
 
 // run runs the ctrld main components.
@@ -232,7 +338,22 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 	// Wait the caller to signal that we can do our logic.
 	<-p.waitCh
 	if !reload {
+		p.runHook(hookPreStart)
 		p.preRun()
+		p.startedAt = time.Now()
+		if err := ctrld.LoadBootstrapState(absHomeDir(bootstrapStateFile)); err != nil {
+			mainLog.Load().Warn().Err(err).Msg("could not load bootstrap resolvers state")
+		}
+		if path := p.cfg.Service.DoQSessionCacheFile; path != "" {
+			if err := ctrld.LoadDoQSessionCache(path); err != nil {
+				mainLog.Load().Warn().Err(err).Msg("could not load DoQ session cache")
+			}
+			p.onStopped = append(p.onStopped, func() {
+				if err := ctrld.FlushDoQSessionCache(); err != nil {
+					mainLog.Load().Warn().Err(err).Msg("could not persist DoQ session cache")
+				}
+			})
+		}
 	}
 	numListeners := len(p.cfg.Listener)
 	if !reload {
@@ -242,14 +363,23 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 	p.loop = make(map[string]bool)
 	p.lanLoopGuard = newLoopGuard()
 	p.ptrLoopGuard = newLoopGuard()
+	if reload {
+		// The cache is re-created, keep its entries.
+		p.saveCacheFile()
+	}
 	if p.cfg.Service.CacheEnable {
 		cacher, err := dnscache.NewLRUCache(p.cfg.Service.CacheSize)
 		if err != nil {
 			mainLog.Load().Error().Err(err).Msg("failed to create cacher, caching is disabled")
 		} else {
+			p.loadCacheFile(cacher)
 			p.cache = cacher
 		}
 	}
+	if !reload && p.cfg.Service.CacheFile != "" {
+		go p.persistCache()
+		p.onStopped = append(p.onStopped, p.saveCacheFile)
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(len(p.cfg.Listener))
@@ -266,6 +396,12 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 	}
 
 	p.um = newUpstreamMonitor(p.cfg)
+	p.upstreamGroups = newUpstreamGroups(p.cfg)
+	p.cacheRules = newCacheRules(p.cfg)
+	p.um.onDown = func(upstream string) {
+		mainLog.Load().Warn().Msgf("%s is marked as down", upstream)
+		p.runHook(hookUpstreamDown, "CTRLD_UPSTREAM="+upstream)
+	}
 
 	if !reload {
 		p.sema = &chanSemaphore{ready: make(chan struct{}, defaultSemaphoreCap)}
@@ -277,6 +413,7 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 				p.sema = &chanSemaphore{ready: make(chan struct{}, n)}
 			}
 		}
+		p.startClockSync()
 		p.setupUpstream(p.cfg)
 		p.ciTable = clientinfo.NewTable(&cfg, defaultRouteIP(), cdUID, p.ptrNameservers)
 		if leaseFile := p.cfg.Service.DHCPLeaseFile; leaseFile != "" {
@@ -284,12 +421,44 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 			format := ctrld.LeaseFileFormat(p.cfg.Service.DHCPLeaseFileFormat)
 			p.ciTable.AddLeaseFile(leaseFile, format)
 		}
+		p.startDHCPServers()
+		p.acme = newACMEManager(p.cfg, absHomeDir(acmeDir), &hookDNSProvider{p: p})
 	}
 
 	// context for managing spawn goroutines.
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
+	mirror := newQueryMirror(p.cfg)
+	p.mirror.Store(mirror)
+	if mirror != nil {
+		mainLog.Load().Info().Msgf("mirroring %d%% of queries to %s", mirror.sampleRate, mirror.name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mirror.run(ctx)
+		}()
+	}
+
+	p.failOpen = newFailOpen(p.cfg)
+	if p.failOpen != nil {
+		mainLog.Load().Info().Msgf("failing open to %s if encrypted upstreams are down for %s", p.failOpen.name, p.failOpen.after)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.failOpen.run(ctx, p)
+		}()
+	}
+
+	if p.um.healthCheck.interval > 0 {
+		mainLog.Load().Info().Msgf("checking upstreams health every %s", p.um.healthCheck.interval)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.um.runHealthChecks(ctx)
+		}()
+	}
+
 	// Newer versions of android and iOS denies permission which breaks connectivity.
 	if !isMobile() && !reload {
 		wg.Add(1)
@@ -310,8 +479,7 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 				if upstreamConfig == nil {
 					mainLog.Load().Warn().Msgf("no default upstream for: [listener.%s]", listenerNum)
 				}
-				addr := net.JoinHostPort(listenerConfig.IP, strconv.Itoa(listenerConfig.Port))
-				mainLog.Load().Info().Msgf("starting DNS server on listener.%s: %s", listenerNum, addr)
+				mainLog.Load().Info().Msgf("starting DNS server on listener.%s: %s", listenerNum, listenerConfig.Addr())
 				if err := p.serveDNS(listenerNum); err != nil {
 					mainLog.Load().Fatal().Err(err).Msgf("unable to start dns proxy on listener.%s", listenerNum)
 				}
@@ -337,6 +505,7 @@ func (p *prog) run(reload bool, reloadCh chan struct{}) {
 		for _, f := range p.onStarted {
 			f()
 		}
+		p.runHook(hookPostConfigure)
 	}
 
 	close(p.onStartedDone)
@@ -444,19 +613,19 @@ func (p *prog) setDNS() {
 	}
 
 	logger.Debug().Msg("setting DNS for interface")
-	ns := lc.IP
+	ns, port := listenerAddr(lc, interfaceAddrs)
 	switch {
 	case lc.IsDirectDnsListener():
 		// If ctrld is direct listener, use 127.0.0.1 as nameserver.
 		ns = "127.0.0.1"
-	case lc.Port != 53:
+	case port != 53:
 		ns = "127.0.0.1"
 		if resolver := router.LocalResolverIP(); resolver != "" {
 			ns = resolver
 		}
 	default:
-		// If we ever reach here, it means ctrld is running on lc.IP port 53,
-		// so we could just use lc.IP as nameserver.
+		// If we ever reach here, it means ctrld is running on ns port 53,
+		// so we could just use ns as nameserver.
 	}
 
 	nameservers := []string{ns}
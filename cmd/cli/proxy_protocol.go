@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// proxyProtoV2Sig is the signature of PROXY protocol v2 headers.
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoHeaderTimeout is the time trusted proxies have to send the PROXY protocol header.
+const proxyProtoHeaderTimeout = 5 * time.Second
+
+// proxyProtoListener is a net.Listener accepting PROXY protocol v2 headers from trusted proxies.
+// Connections from other sources are accepted as is.
+type proxyProtoListener struct {
+	net.Listener
+	trusted func(ip netip.Addr) bool
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ap, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil || !l.trusted(ap.Addr()) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn}, nil
+}
+
+// proxyProtoConn is a connection from a trusted proxy. The PROXY protocol header is read on first
+// use of the connection, so a slow proxy does not block accepting other connections.
+type proxyProtoConn struct {
+	net.Conn
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// readHeader reads the PROXY protocol header, closing the connection if it is invalid.
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		readDeadline := c.readDeadline
+		c.mu.Unlock()
+		deadline := time.Now().Add(proxyProtoHeaderTimeout)
+		if !readDeadline.IsZero() && readDeadline.Before(deadline) {
+			deadline = readDeadline
+		}
+		_ = c.Conn.SetReadDeadline(deadline)
+		c.remoteAddr, c.err = readProxyProtoHeader(c.Conn)
+		_ = c.Conn.SetReadDeadline(readDeadline)
+		if c.err != nil {
+			mainLog.Load().Debug().Err(c.err).Msgf("invalid PROXY protocol header from %s", c.Conn.RemoteAddr())
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client address sent by the proxy, or the proxy address if the
+// proxy did not send any, like for its own health checks.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readProxyProtoHeader reads the PROXY protocol v2 header from r, returning the client address.
+// The returned address is nil if the header does not carry an IP address, for LOCAL command,
+// or for UNSPEC and unix socket address families.
+func readProxyProtoHeader(r io.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyProtoV2Sig) {
+		return nil, errors.New("invalid PROXY protocol v2 signature")
+	}
+	if version := hdr[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", version)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch cmd := hdr[12] & 0xf; cmd {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command: %d", cmd)
+	}
+	var ap netip.AddrPort
+	switch family := hdr[13] >> 4; family {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("invalid PROXY protocol IPv4 addresses")
+		}
+		ap = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[0:4])), binary.BigEndian.Uint16(body[8:10]))
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("invalid PROXY protocol IPv6 addresses")
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		ap = netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34]))
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(ap), nil
+}
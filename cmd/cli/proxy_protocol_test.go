@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyProtoV2Header returns the PROXY protocol v2 header of a TCP connection from src to dst.
+func proxyProtoV2Header(cmd byte, src, dst netip.AddrPort) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Sig)
+	buf.WriteByte(0x20 | cmd)
+	var addrs []byte
+	if src.Addr().Is4() {
+		buf.WriteByte(0x11)
+		addrs = append(addrs, src.Addr().AsSlice()...)
+		addrs = append(addrs, dst.Addr().AsSlice()...)
+	} else {
+		buf.WriteByte(0x21)
+		addrs = append(addrs, src.Addr().AsSlice()...)
+		addrs = append(addrs, dst.Addr().AsSlice()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+func Test_readProxyProtoHeader(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.1:53")
+	dst6 := netip.MustParseAddrPort("[2001:db8::1]:53")
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{"ipv4", proxyProtoV2Header(0x1, netip.MustParseAddrPort("198.51.100.7:40000"), dst), "198.51.100.7:40000", false},
+		{"ipv6", proxyProtoV2Header(0x1, netip.MustParseAddrPort("[2001:db8::7]:40000"), dst6), "[2001:db8::7]:40000", false},
+		{"local", proxyProtoV2Header(0x0, netip.MustParseAddrPort("198.51.100.7:40000"), dst), "", false},
+		{"v1", []byte("PROXY TCP4 198.51.100.7 192.0.2.1 40000 53\r\n"), "", true},
+		{"truncated", proxyProtoV2Header(0x1, netip.MustParseAddrPort("198.51.100.7:40000"), dst)[:20], "", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			addr, err := readProxyProtoHeader(bytes.NewReader(tc.header))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tc.want == "" {
+				assert.Nil(t, addr)
+				return
+			}
+			assert.Equal(t, tc.want, addr.String())
+		})
+	}
+}
+
+func Test_proxyProtoListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pln := &proxyProtoListener{Listener: ln, trusted: func(ip netip.Addr) bool { return ip.IsLoopback() }}
+	defer pln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := proxyProtoV2Header(0x1, netip.MustParseAddrPort("198.51.100.7:40000"), netip.MustParseAddrPort("192.0.2.1:53"))
+		_, _ = conn.Write(append(header, "query"...))
+	}()
+
+	conn, err := pln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "198.51.100.7:40000", conn.RemoteAddr().String())
+	buf, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "query", string(buf))
+
+	untrusted := &proxyProtoListener{Listener: ln, trusted: func(netip.Addr) bool { return false }}
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err = untrusted.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	_, ok := conn.(*proxyProtoConn)
+	assert.False(t, ok)
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/dnscache"
+)
+
+// queryGroup coalesces concurrent identical queries to the same upstream, so when a popular
+// record expires, a single query is sent to the upstream, and all clients get its answer.
+type queryGroup struct {
+	mu    sync.Mutex
+	calls map[string]*queryCall
+}
+
+// queryCall is an in-flight upstream query shared by waiters.
+type queryCall struct {
+	done    chan struct{}
+	answer  *dns.Msg
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do calls fn for the query identified by key, unless there is already an in-flight query
+// with the same key, then it waits for its result instead. shared reports whether the result
+// came from another caller's query. Each caller gets its own copy of the answer.
+//
+// The query is only canceled once all waiters gave up, so a client canceling its query,
+// like a loser of an upstream race, does not fail other clients' queries.
+func (g *queryGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (*dns.Msg, error)) (answer *dns.Msg, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*queryCall)
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &queryCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			c.answer, c.err = fn(callCtx)
+			cancel()
+			g.forget(key, c)
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		if c.answer != nil {
+			return c.answer.Copy(), shared, c.err
+		}
+		return nil, shared, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			g.forgetLocked(key, c)
+		}
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// forget removes c from in-flight queries, so next queries with the same key are sent again.
+func (g *queryGroup) forget(key string, c *queryCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.forgetLocked(key, c)
+}
+
+func (g *queryGroup) forgetLocked(key string, c *queryCall) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+// queryGroupKey returns the key of msg sent to upstream, queries with the same key get the
+// same answer: same question, DNSSEC flags and client subnet. If client info is sent to the
+// upstream, queries of different clients are never coalesced.
+func queryGroupKey(upstream string, msg *dns.Msg, ci *ctrld.ClientInfo) string {
+	q := msg.Question[0]
+	var b strings.Builder
+	b.WriteString(upstream)
+	b.WriteByte('|')
+	b.WriteString(strings.ToLower(q.Name))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(q.Qtype)))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(q.Qclass)))
+	b.WriteByte('|')
+	b.WriteString(strconv.FormatBool(msg.CheckingDisabled))
+	if opt := msg.IsEdns0(); opt != nil {
+		b.WriteByte('|')
+		b.WriteString(strconv.FormatBool(opt.Do()))
+	}
+	if ecs := dnscache.ClientSubnet(msg); ecs != nil {
+		b.WriteByte('|')
+		b.WriteString(ecs.String())
+	}
+	if ci != nil {
+		b.WriteByte('|')
+		b.WriteString(ci.IP)
+		b.WriteByte('|')
+		b.WriteString(ci.Mac)
+		b.WriteByte('|')
+		b.WriteString(ci.Hostname)
+	}
+	return b.String()
+}
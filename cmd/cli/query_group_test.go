@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_queryGroup_do(t *testing.T) {
+	var g queryGroup
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*dns.Msg, error) {
+		calls.Add(1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		answer := new(dns.Msg)
+		answer.SetQuestion("example.com.", dns.TypeA)
+		return answer, nil
+	}
+
+	// The first caller gives up, others must still get the answer.
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, _, err := g.do(leaderCtx, "key", fn)
+		leaderDone <- err
+	}()
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+
+	const n = 10
+	var wg sync.WaitGroup
+	answers := make([]*dns.Msg, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			answer, shared, err := g.do(context.Background(), "key", fn)
+			assert.NoError(t, err)
+			assert.True(t, shared)
+			answers[i] = answer
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.calls["key"] != nil && g.calls["key"].waiters == n+1
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-leaderDone, context.Canceled)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for i := range answers {
+		require.NotNil(t, answers[i])
+		if i > 0 {
+			assert.NotSame(t, answers[0], answers[i])
+		}
+	}
+
+	// Once done, the next query is sent again.
+	_, shared, err := g.do(context.Background(), "key", fn)
+	require.NoError(t, err)
+	assert.False(t, shared)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func Test_queryGroupKey(t *testing.T) {
+	newMsg := func(name string, do bool, subnet string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(4096, do)
+		if subnet != "" {
+			_, ipNet, _ := net.ParseCIDR(subnet)
+			ones, _ := ipNet.Mask.Size()
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ipNet.IP})
+		}
+		return msg
+	}
+	key := queryGroupKey("upstream.0", newMsg("example.com.", false, ""), nil)
+	assert.Equal(t, key, queryGroupKey("upstream.0", newMsg("Example.COM.", false, ""), nil))
+	for name, other := range map[string]string{
+		"upstream":  queryGroupKey("upstream.1", newMsg("example.com.", false, ""), nil),
+		"do bit":    queryGroupKey("upstream.0", newMsg("example.com.", true, ""), nil),
+		"subnet":    queryGroupKey("upstream.0", newMsg("example.com.", false, "192.0.2.0/24"), nil),
+		"client":    queryGroupKey("upstream.0", newMsg("example.com.", false, ""), &ctrld.ClientInfo{IP: "192.168.1.10"}),
+		"different": queryGroupKey("upstream.0", newMsg("example.net.", false, ""), nil),
+	} {
+		assert.NotEqual(t, key, other, name)
+	}
+}
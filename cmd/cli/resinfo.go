@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const discoverResolverTimeout = 5 * time.Second
+
+// discoverEncryptedUpstream upgrades the legacy upstream uc to the first encrypted endpoint
+// designated by its resolver. If there's no designated endpoint, uc is left unchanged.
+//
+// This must be called before uc.Init().
+func discoverEncryptedUpstream(name string, uc *ctrld.UpstreamConfig) {
+	if uc.Type != ctrld.ResolverTypeLegacy || !uc.DiscoverEncrypted {
+		return
+	}
+	ip := uc.Endpoint
+	if host, _, err := net.SplitHostPort(uc.Endpoint); err == nil {
+		ip = host
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), discoverResolverTimeout)
+	defer cancel()
+	ri, err := ctrld.DiscoverResolver(ctx, ip)
+	if err != nil {
+		mainLog.Load().Warn().Err(err).Msgf("could not discover encrypted endpoint for upstream.%s, using %s", name, uc.Endpoint)
+		return
+	}
+	ep := ri.Endpoints[0]
+	mainLog.Load().Info().
+		Str("type", ep.Type).
+		Str("endpoint", ep.Endpoint).
+		Strs("ips", ep.IPs).
+		Interface("resinfo", ri.Info).
+		Msgf("upstream.%s: using designated encrypted endpoint of %s", name, ip)
+	uc.Type = ep.Type
+	uc.Endpoint = ep.Endpoint
+	uc.BootstrapIP = ep.IPs[0]
+	uc.DesignatedBy = ip
+}
+
+// handleDDR is the control server handler for discovering designated encrypted endpoints
+// of the network resolvers.
+func (p *prog) handleDDR(w http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), discoverResolverTimeout)
+	defer cancel()
+	if err := json.NewEncoder(w).Encode(ctrld.DiscoverNetworkResolvers(ctx)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package cli
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl returns an error, SO_REUSEPORT is not supported on this platform.
+func reusePortControl(string, string, syscall.RawConn) error {
+	return errors.New("udp_workers is not supported on this platform")
+}
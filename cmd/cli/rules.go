@@ -0,0 +1,258 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// Operations of a rule edit.
+const (
+	ruleOpSet    = "set"
+	ruleOpDelete = "delete"
+)
+
+// Kinds of policy rules, matching the ListenerPolicyConfig fields.
+const (
+	ruleKindRules    = "rules"
+	ruleKindNetworks = "networks"
+	ruleKindMacs     = "macs"
+	ruleKindTags     = "tags"
+)
+
+// ruleOp represents a single edit of listener policy rules.
+type ruleOp struct {
+	Op string `json:"op"`
+	// Listener is the listener number, which policy is edited.
+	Listener string `json:"listener"`
+	// Kind is one of "rules", "networks", "macs", "tags".
+	Kind string `json:"kind"`
+	// Key is the rule source, e.g: a domain, "network.0", a MAC address or a tag.
+	Key string `json:"key"`
+	// Upstreams is the list of upstreams for "set" operation, e.g: ["upstream.0"].
+	Upstreams []string `json:"upstreams,omitempty"`
+}
+
+// rulesRequest represents a batch of rule edits, applied all-or-nothing.
+type rulesRequest struct {
+	Ops []ruleOp `json:"ops"`
+	// DryRun only validates the edits and reports the changes, without applying them.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// rulesResponse represents result of applying a batch of rule edits.
+type rulesResponse struct {
+	Diff  *configDiff `json:"diff,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+var errRulesCdMode = errors.New("rules could not be edited in --cd mode, config is managed by Control D")
+
+// handleRules is the control server handler for applying a batch of rule edits.
+func (p *prog) handleRules(w http.ResponseWriter, request *http.Request) {
+	var req rulesRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil || len(req.Ops) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&rulesResponse{Error: "missing rule operations"})
+		return
+	}
+	diff, err := p.applyRules(&req)
+	if err != nil {
+		mainLog.Load().Err(err).Msg("could not apply rules")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&rulesResponse{Error: err.Error()})
+		return
+	}
+	if !req.DryRun {
+		mainLog.Load().Notice().Msgf("applied %d rule operations", len(req.Ops))
+	}
+	_ = json.NewEncoder(w).Encode(&rulesResponse{Diff: diff})
+}
+
+// applyRules applies all edits in req to config file, then reloads ctrld to use the new rules.
+//
+// Edits are applied to a copy of the config read from file, and the result is validated as
+// a whole before anything is written. The config file is replaced atomically, and the new
+// policies are swapped in by the reload, so queries never observe a partially applied batch.
+// If the reload fails, the previous config file is restored, so a failed batch is not applied
+// by later reloads either.
+//
+// The config file is rewritten from the parsed config, so comments and formatting of the
+// original file are not kept.
+func (p *prog) applyRules(req *rulesRequest) (*configDiff, error) {
+	if loadCdUID() != "" {
+		return nil, errRulesCdMode
+	}
+	p.rulesMu.Lock()
+	defer p.rulesMu.Unlock()
+
+	newCfg, path, err := loadConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := applyRuleOps(newCfg, req.Ops); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(newCfg); err != nil {
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+	if req.DryRun {
+		cur, _, err := loadConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		return diffConfig(cur, newCfg), nil
+	}
+	prev, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	if err := writeConfigAtomic(path, newCfg); err != nil {
+		return nil, fmt.Errorf("could not write config file: %w", err)
+	}
+	diff, err := p.reloadAndWait()
+	if err != nil {
+		p.restoreConfigFile(path, prev)
+		return nil, err
+	}
+	return diff, nil
+}
+
+// restoreConfigFile restores the config file at path to data, after changes written to it
+// could not be applied. ctrld is reloaded again, in case the failed reload is still running.
+func (p *prog) restoreConfigFile(path string, data []byte) {
+	if err := writeFileAtomic(path, data, 0o644); err != nil {
+		mainLog.Load().Err(err).Msg("could not restore config file")
+		return
+	}
+	mainLog.Load().Warn().Msg("config file was restored")
+	if err := p.sendReloadSignal(); err != nil {
+		mainLog.Load().Err(err).Msg("could not send reload signal")
+	}
+}
+
+// applyRuleOps applies ops to listener policies of cfg in order. If any operation is
+// invalid, an error is returned, and cfg must be discarded by the caller.
+//
+// Setting an existing key replaces its upstreams in place, keeping the rule order.
+// New keys are appended, so they have the lowest precedence.
+func applyRuleOps(cfg *ctrld.Config, ops []ruleOp) error {
+	for i, op := range ops {
+		if err := applyRuleOp(cfg, op); err != nil {
+			return fmt.Errorf("operation %d: %s %s.%s %q: %w", i, op.Op, op.Listener, op.Kind, op.Key, err)
+		}
+	}
+	return nil
+}
+
+func applyRuleOp(cfg *ctrld.Config, op ruleOp) error {
+	lc := cfg.Listener[op.Listener]
+	if lc == nil {
+		return fmt.Errorf("listener.%s not found", op.Listener)
+	}
+	if op.Key == "" {
+		return errors.New("missing key")
+	}
+	switch op.Kind {
+	case ruleKindRules, ruleKindMacs, ruleKindTags:
+	case ruleKindNetworks:
+		if cfg.Network[strings.TrimPrefix(op.Key, "network.")] == nil {
+			return fmt.Errorf("%s not found", op.Key)
+		}
+	default:
+		return fmt.Errorf("invalid kind: %q", op.Kind)
+	}
+	if lc.Policy == nil {
+		lc.Policy = &ctrld.ListenerPolicyConfig{}
+	}
+	rules := policyRulesOfKind(lc.Policy, op.Kind)
+	idx := -1
+	for i, rule := range *rules {
+		if _, ok := rule[op.Key]; ok {
+			idx = i
+			break
+		}
+	}
+
+	switch op.Op {
+	case ruleOpSet:
+		if len(op.Upstreams) == 0 {
+			return errors.New("missing upstreams")
+		}
+		for _, upstream := range op.Upstreams {
+			if name, ok := strings.CutPrefix(upstream, ctrld.UpstreamGroupPrefix); ok {
+				if cfg.UpstreamGroup[name] == nil {
+					return fmt.Errorf("%s not found", upstream)
+				}
+				continue
+			}
+			if cfg.Upstream[strings.TrimPrefix(upstream, upstreamPrefix)] == nil {
+				return fmt.Errorf("%s not found", upstream)
+			}
+		}
+		rule := ctrld.Rule{op.Key: op.Upstreams}
+		if idx == -1 {
+			*rules = append(*rules, rule)
+		} else {
+			(*rules)[idx] = rule
+		}
+	case ruleOpDelete:
+		if idx == -1 {
+			return errors.New("rule not found")
+		}
+		*rules = append((*rules)[:idx], (*rules)[idx+1:]...)
+	default:
+		return fmt.Errorf("invalid operation: %q", op.Op)
+	}
+	return nil
+}
+
+// policyRulesOfKind returns the rules list of given kind in policy.
+func policyRulesOfKind(policy *ctrld.ListenerPolicyConfig, kind string) *[]ctrld.Rule {
+	switch kind {
+	case ruleKindNetworks:
+		return &policy.Networks
+	case ruleKindMacs:
+		return &policy.Macs
+	case ruleKindTags:
+		return &policy.Tags
+	}
+	return &policy.Rules
+}
+
+// writeConfigAtomic writes config c to a temporary file, then renames it to path,
+// so readers never see a partially written config file.
+func writeConfigAtomic(path string, c *ctrld.Config) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := writeConfig(tmp, c); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic is like writeConfigAtomic, but writes raw data with given permissions.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	// Remove any leftover, so the temporary file is created with perm.
+	_ = os.Remove(tmp)
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func newRulesTestConfig() *ctrld.Config {
+	return &ctrld.Config{
+		Network:  map[string]*ctrld.NetworkConfig{"0": {Name: "Any"}},
+		Upstream: map[string]*ctrld.UpstreamConfig{"0": {}, "1": {}},
+		UpstreamGroup: map[string]*ctrld.UpstreamGroupConfig{
+			"canary": {Upstreams: []string{"upstream.0", "upstream.1"}},
+		},
+		Listener: map[string]*ctrld.ListenerConfig{
+			"0": {Policy: &ctrld.ListenerPolicyConfig{
+				Rules: []ctrld.Rule{
+					{"a.example.com": []string{"upstream.0"}},
+					{"b.example.com": []string{"upstream.0"}},
+				},
+			}},
+			"1": {},
+		},
+	}
+}
+
+func Test_applyRuleOps(t *testing.T) {
+	cfg := newRulesTestConfig()
+	err := applyRuleOps(cfg, []ruleOp{
+		{Op: ruleOpSet, Listener: "0", Kind: ruleKindRules, Key: "a.example.com", Upstreams: []string{"upstream.1"}},
+		{Op: ruleOpSet, Listener: "0", Kind: ruleKindRules, Key: "c.example.com", Upstreams: []string{"upstream.1"}},
+		{Op: ruleOpSet, Listener: "0", Kind: ruleKindRules, Key: "d.example.com", Upstreams: []string{"upstream_group.canary"}},
+		{Op: ruleOpDelete, Listener: "0", Kind: ruleKindRules, Key: "b.example.com"},
+		{Op: ruleOpSet, Listener: "1", Kind: ruleKindNetworks, Key: "network.0", Upstreams: []string{"upstream.0"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []ctrld.Rule{
+		{"a.example.com": []string{"upstream.1"}},
+		{"c.example.com": []string{"upstream.1"}},
+		{"d.example.com": []string{"upstream_group.canary"}},
+	}, cfg.Listener["0"].Policy.Rules)
+	require.NotNil(t, cfg.Listener["1"].Policy)
+	assert.Equal(t, []ctrld.Rule{{"network.0": []string{"upstream.0"}}}, cfg.Listener["1"].Policy.Networks)
+}
+
+func Test_applyRuleOps_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		op   ruleOp
+	}{
+		{"unknown listener", ruleOp{Op: ruleOpSet, Listener: "2", Kind: ruleKindRules, Key: "example.com", Upstreams: []string{"upstream.0"}}},
+		{"unknown upstream", ruleOp{Op: ruleOpSet, Listener: "0", Kind: ruleKindRules, Key: "example.com", Upstreams: []string{"upstream.2"}}},
+		{"unknown upstream group", ruleOp{Op: ruleOpSet, Listener: "0", Kind: ruleKindRules, Key: "example.com", Upstreams: []string{"upstream_group.foo"}}},
+		{"unknown network", ruleOp{Op: ruleOpSet, Listener: "0", Kind: ruleKindNetworks, Key: "network.1", Upstreams: []string{"upstream.0"}}},
+		{"missing upstreams", ruleOp{Op: ruleOpSet, Listener: "0", Kind: ruleKindRules, Key: "example.com"}},
+		{"missing key", ruleOp{Op: ruleOpSet, Listener: "0", Kind: ruleKindRules, Upstreams: []string{"upstream.0"}}},
+		{"delete not found", ruleOp{Op: ruleOpDelete, Listener: "0", Kind: ruleKindRules, Key: "example.com"}},
+		{"invalid kind", ruleOp{Op: ruleOpSet, Listener: "0", Kind: "domains", Key: "example.com", Upstreams: []string{"upstream.0"}}},
+		{"invalid op", ruleOp{Op: "add", Listener: "0", Kind: ruleKindRules, Key: "example.com", Upstreams: []string{"upstream.0"}}},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := newRulesTestConfig()
+			ops := []ruleOp{
+				{Op: ruleOpDelete, Listener: "0", Kind: ruleKindRules, Key: "a.example.com"},
+				tc.op,
+			}
+			assert.Error(t, applyRuleOps(cfg, ops))
+		})
+	}
+}
+
+func Test_prog_reloadWaiters(t *testing.T) {
+	p := &prog{}
+	ch1, ch2 := make(chan *reloadResult, 1), make(chan *reloadResult, 1)
+	p.reloadWaiters = append(p.reloadWaiters, ch1, ch2)
+	// Timed out waiter must not be notified.
+	p.removeReloadWaiter(ch1)
+	assert.Equal(t, []chan *reloadResult{ch2}, p.takeReloadWaiters())
+	assert.Empty(t, p.takeReloadWaiters(), "waiters must only be notified by a single reload")
+}
+
+func Test_writeFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctrld.toml")
+	require.NoError(t, os.WriteFile(path, []byte("# rules\n"), 0o644))
+	require.NoError(t, writeFileAtomic(path, []byte("# restored\n"), 0o644))
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "# restored\n", string(buf))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary file must be removed")
+}
@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// startupGraceTimeout is the timeout for resolving a query using system nameservers
+// during startup grace period.
+const startupGraceTimeout = 2 * time.Second
+
+// inStartupGracePeriod reports whether now is still within the startup grace period.
+func (p *prog) inStartupGracePeriod(now time.Time) bool {
+	gp := p.cfg.Service.StartupGracePeriod
+	if gp <= 0 || p.startedAt.IsZero() {
+		return false
+	}
+	return now.Sub(p.startedAt) < time.Duration(gp)*time.Second
+}
+
+// resolveStartupGrace resolves msg using the system nameservers, usually provided by DHCP.
+//
+// It is used for answering queries which could not be answered by any configured upstreams
+// during startup grace period. On routers whose WAN comes up slowly, upstreams could not be
+// bootstrapped, or their certificates could not be verified (wrong clock), until some queries
+// are answered, so deferring to system nameservers for a while breaks that loop. The answer
+// TTL is kept short, so clients switch to configured upstreams soon once the period is over.
+//
+// It returns nil if the query could not be resolved.
+func (p *prog) resolveStartupGrace(ctx context.Context, msg *dns.Msg) *dns.Msg {
+	ctx, cancel := context.WithTimeout(ctx, startupGraceTimeout)
+	defer cancel()
+	answer, err := ctrld.NewSystemResolver().Resolve(ctx, msg)
+	if err != nil {
+		ctrld.Log(ctx, mainLog.Load().Warn().Err(err), "startup grace period: could not resolve using system nameservers")
+		return nil
+	}
+	now := time.Now()
+	setCachedAnswerTTL(answer, now, now.Add(outageTTL))
+	ctrld.Log(ctx, mainLog.Load().Notice(), "startup grace period: answered using system nameservers: %s", dns.RcodeToString[answer.Rcode])
+	return answer
+}
@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_prog_inStartupGracePeriod(t *testing.T) {
+	startedAt := time.Now()
+	tests := []struct {
+		name        string
+		gracePeriod int
+		startedAt   time.Time
+		now         time.Time
+		want        bool
+	}{
+		{"disabled", 0, startedAt, startedAt, false},
+		{"not started", 30, time.Time{}, startedAt, false},
+		{"within", 30, startedAt, startedAt.Add(10 * time.Second), true},
+		{"ended", 30, startedAt, startedAt.Add(30 * time.Second), false},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := &prog{cfg: &ctrld.Config{}, startedAt: tc.startedAt}
+			p.cfg.Service.StartupGracePeriod = tc.gracePeriod
+			if got := p.inStartupGracePeriod(tc.now); got != tc.want {
+				t.Errorf("unexpected result, want: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
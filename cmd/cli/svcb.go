@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// svcbRecord returns the SVCB part of rr, or nil if rr is not a SVCB/HTTPS record.
+func svcbRecord(rr dns.RR) *dns.SVCB {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr
+	case *dns.HTTPS:
+		return &rr.SVCB
+	}
+	return nil
+}
+
+// isSvcbMsg reports whether msg is a SVCB/HTTPS query or answer.
+func isSvcbMsg(msg *dns.Msg) bool {
+	if len(msg.Question) == 0 {
+		return false
+	}
+	switch msg.Question[0].Qtype {
+	case dns.TypeSVCB, dns.TypeHTTPS:
+		return true
+	}
+	return false
+}
+
+// stripSvcParams returns answer with the given SvcParams, e.g: "ech", "alpn", removed from
+// its SVCB/HTTPS records. The answer is copied before modifying, because it may be shared
+// with the cache. If answer does not have any params to remove, it is returned as-is.
+//
+// Removed keys are also removed from "mandatory" list, so the records are still valid
+// (RFC 9460, section 8). Removing "alpn" also removes "no-default-alpn", which must not
+// be present without "alpn" (RFC 9460, section 7.1.1).
+func stripSvcParams(answer *dns.Msg, params []string) *dns.Msg {
+	if answer == nil || len(params) == 0 || !isSvcbMsg(answer) {
+		return answer
+	}
+	strip := func(key dns.SVCBKey) bool {
+		if key == dns.SVCB_NO_DEFAULT_ALPN {
+			key = dns.SVCB_ALPN
+		}
+		return slices.Contains(params, key.String())
+	}
+	hasParams := func(rr dns.RR) bool {
+		if svcb := svcbRecord(rr); svcb != nil {
+			for _, kv := range svcb.Value {
+				if strip(kv.Key()) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if !slices.ContainsFunc(answer.Answer, hasParams) {
+		return answer
+	}
+
+	answer = answer.Copy()
+	for _, rr := range answer.Answer {
+		svcb := svcbRecord(rr)
+		if svcb == nil {
+			continue
+		}
+		values := make([]dns.SVCBKeyValue, 0, len(svcb.Value))
+		for _, kv := range svcb.Value {
+			if strip(kv.Key()) {
+				continue
+			}
+			if m, ok := kv.(*dns.SVCBMandatory); ok {
+				codes := slices.DeleteFunc(slices.Clone(m.Code), strip)
+				if len(codes) == 0 {
+					continue
+				}
+				kv = &dns.SVCBMandatory{Code: codes}
+			}
+			values = append(values, kv)
+		}
+		svcb.Value = values
+	}
+	return answer
+}
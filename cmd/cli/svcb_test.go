@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSvcbAnswer(t *testing.T, rrs ...string) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeHTTPS)
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		answer.Answer = append(answer.Answer, rr)
+	}
+	return answer
+}
+
+func Test_stripSvcParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		rr     string
+		params []string
+		want   string
+	}{
+		{
+			"strip ech",
+			"example.com. 300 IN HTTPS 1 . alpn=h2,h3 ech=AAAA",
+			[]string{"ech"},
+			"example.com.\t300\tIN\tHTTPS\t1 . alpn=\"h2,h3\"",
+		},
+		{
+			"strip alpn with no-default-alpn",
+			"example.com. 300 IN HTTPS 1 . alpn=h3 no-default-alpn port=8443",
+			[]string{"alpn"},
+			"example.com.\t300\tIN\tHTTPS\t1 . port=\"8443\"",
+		},
+		{
+			"strip mandatory key",
+			"example.com. 300 IN HTTPS 1 . mandatory=ech,port port=8443 ech=AAAA",
+			[]string{"ech"},
+			"example.com.\t300\tIN\tHTTPS\t1 . mandatory=\"port\" port=\"8443\"",
+		},
+		{
+			"nothing to strip",
+			"example.com. 300 IN HTTPS 1 . alpn=h2",
+			[]string{"ech"},
+			"example.com.\t300\tIN\tHTTPS\t1 . alpn=\"h2\"",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			answer := newSvcbAnswer(t, tc.rr)
+			orig := answer.Answer[0].String()
+			got := stripSvcParams(answer, tc.params)
+			require.Len(t, got.Answer, 1)
+			assert.Equal(t, tc.want, got.Answer[0].String())
+			// The original answer may be shared with cache, it must not be modified.
+			assert.Equal(t, orig, answer.Answer[0].String())
+		})
+	}
+}
+
+func Test_ttlFromMsg_svcb(t *testing.T) {
+	answer := newSvcbAnswer(t,
+		"www.example.com. 300 IN CNAME example.com.",
+		"example.com. 600 IN HTTPS 1 . alpn=h2",
+	)
+	hint, err := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+	require.NoError(t, err)
+	answer.Extra = append(answer.Extra, hint)
+	answer.SetEdns0(4096, false)
+	assert.Equal(t, uint32(60), ttlFromMsg(answer))
+
+	answer.Extra = nil
+	assert.Equal(t, uint32(300), ttlFromMsg(answer))
+}
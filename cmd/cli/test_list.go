@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// testListBatchSize is the number of domains sent to ctrld in a single test list request,
+	// so each request finishes before the control client times out.
+	testListBatchSize = 100
+	// testListConcurrency is the max number of domains resolved concurrently by ctrld.
+	testListConcurrency = 10
+)
+
+// Dispositions of a tested domain.
+const (
+	dispositionAllowed  = "allowed"
+	dispositionBlocked  = "blocked"
+	dispositionNxdomain = "nxdomain"
+	dispositionError    = "error"
+	dispositionUntested = "untested"
+)
+
+// testListRequest represents request for testing a list of domains against running ctrld.
+type testListRequest struct {
+	Domains []string `json:"domains"`
+	// Listener is the listener number which the queries are sent to.
+	Listener string `json:"listener"`
+	// ClientIP and Mac identify the client which the queries are sent from.
+	ClientIP string `json:"client_ip,omitempty"`
+	Mac      string `json:"mac,omitempty"`
+	// NoResolve only evaluates the policy, without resolving the domains.
+	NoResolve bool `json:"no_resolve,omitempty"`
+}
+
+// testListResult represents the disposition of a tested domain.
+type testListResult struct {
+	Domain      string   `json:"domain"`
+	Policy      string   `json:"policy,omitempty"`
+	Upstreams   []string `json:"upstreams,omitempty"`
+	Upstream    string   `json:"upstream,omitempty"`
+	Rcode       string   `json:"rcode,omitempty"`
+	Answers     []string `json:"answers,omitempty"`
+	Disposition string   `json:"disposition"`
+}
+
+// testListResponse represents result of testing a list of domains.
+type testListResponse struct {
+	Results []*testListResult `json:"results,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// handleTestList is the control server handler for testing a list of domains.
+func (p *prog) handleTestList(w http.ResponseWriter, request *http.Request) {
+	var req testListRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&testListResponse{Error: err.Error()})
+		return
+	}
+	results, err := p.testList(request.Context(), &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(&testListResponse{Error: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(&testListResponse{Results: results})
+}
+
+// testList evaluates the domains in req against the current policies, and resolves them
+// using the matched upstreams, unless req.NoResolve is set.
+func (p *prog) testList(ctx context.Context, req *testListRequest) ([]*testListResult, error) {
+	lc := p.cfg.Listener[req.Listener]
+	if lc == nil {
+		return nil, fmt.Errorf("listener.%s not found", req.Listener)
+	}
+	clientIP := req.ClientIP
+	if clientIP == "" {
+		clientIP = "127.0.0.1"
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client ip: %q", req.ClientIP)
+	}
+	addr := &net.UDPAddr{IP: ip}
+
+	results := make([]*testListResult, len(req.Domains))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(testListConcurrency)
+	for i, domain := range req.Domains {
+		i, domain := i, domain
+		g.Go(func() error {
+			msg := new(dns.Msg)
+			msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+			ci := p.getClientInfo(clientIP, msg)
+			if req.Mac != "" {
+				ci.Mac = req.Mac
+			}
+			ur := p.upstreamFor(ctx, req.Listener, lc, addr, ci.Mac, canonicalName(msg.Question[0].Name))
+			res := &testListResult{
+				Domain:      domain,
+				Policy:      ur.policy(),
+				Upstreams:   ur.upstreams,
+				Disposition: dispositionUntested,
+			}
+			results[i] = res
+			if req.NoResolve {
+				return nil
+			}
+			pReq := &proxyRequest{msg: msg, ci: ci, ufr: ur}
+			if policy := ur.policyConfig; policy != nil {
+				pReq.failoverRcodes = policy.FailoverRcodeNumbers
+				pReq.loadBalance = policy.LoadBalance
+				pReq.raceUpstreams = policy.RaceUpstreams
+				pReq.raceCacheMissOnly = policy.RaceCacheMissOnly
+			}
+			pr := p.proxy(ctx, pReq)
+			res.Upstream = pr.upstream
+			switch {
+			case pr.cached:
+				res.Upstream = "cache"
+			case pr.clientInfo:
+				res.Upstream = "client_info_table"
+			}
+			res.Rcode = dns.RcodeToString[pr.answer.Rcode]
+			for _, rr := range pr.answer.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					res.Answers = append(res.Answers, a.A.String())
+				}
+			}
+			res.Disposition = answerDisposition(pr.answer)
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return results, nil
+}
+
+// answerDisposition returns the disposition of a domain using the answer for its A query.
+// A domain is considered blocked if it is resolved to unspecified or loopback IP address, or
+// the query was refused, since that's how blocking resolvers answer blocked domains.
+func answerDisposition(answer *dns.Msg) string {
+	switch answer.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return dispositionNxdomain
+	case dns.RcodeRefused:
+		return dispositionBlocked
+	default:
+		return dispositionError
+	}
+	for _, rr := range answer.Answer {
+		if a, ok := rr.(*dns.A); ok && (a.A.IsUnspecified() || a.A.IsLoopback()) {
+			return dispositionBlocked
+		}
+	}
+	return dispositionAllowed
+}
+
+// readDomainList reads the list of domains from r, one domain per line. Empty lines and
+// comments are ignored. Hosts file format ("0.0.0.0 example.com") is also supported, so
+// existing blocklists could be tested as-is.
+func readDomainList(r io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, field := range fields {
+			domain := strings.TrimSuffix(strings.ToLower(field), ".")
+			if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+				continue
+			}
+			domains = append(domains, domain)
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// newTestListRequests splits the domains into batches of testListBatchSize domains.
+func newTestListRequests(tmpl testListRequest, domains []string) []*testListRequest {
+	var reqs []*testListRequest
+	for len(domains) > 0 {
+		n := min(len(domains), testListBatchSize)
+		req := tmpl
+		req.Domains = domains[:n]
+		reqs = append(reqs, &req)
+		domains = domains[n:]
+	}
+	return reqs
+}
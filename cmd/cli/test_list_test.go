@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readDomainList(t *testing.T) {
+	list := `# comment
+example.com
+Example.NET.
+
+0.0.0.0 ads.example.com tracker.example.com # blocked
+::1 v6.example.com
+bad..domain
+`
+	domains, err := readDomainList(strings.NewReader(list))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "example.net", "ads.example.com", "tracker.example.com", "v6.example.com"}, domains)
+}
+
+func Test_answerDisposition(t *testing.T) {
+	newAnswer := func(rcode int, rrs ...string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		answer := new(dns.Msg)
+		answer.SetRcode(msg, rcode)
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			answer.Answer = append(answer.Answer, rr)
+		}
+		return answer
+	}
+	tests := []struct {
+		name   string
+		answer *dns.Msg
+		want   string
+	}{
+		{"allowed", newAnswer(dns.RcodeSuccess, "example.com. 60 IN A 93.184.216.34"), dispositionAllowed},
+		{"blocked unspecified", newAnswer(dns.RcodeSuccess, "example.com. 60 IN A 0.0.0.0"), dispositionBlocked},
+		{"blocked loopback", newAnswer(dns.RcodeSuccess, "example.com. 60 IN A 127.0.0.1"), dispositionBlocked},
+		{"refused", newAnswer(dns.RcodeRefused), dispositionBlocked},
+		{"nxdomain", newAnswer(dns.RcodeNameError), dispositionNxdomain},
+		{"servfail", newAnswer(dns.RcodeServerFailure), dispositionError},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, answerDisposition(tc.answer))
+		})
+	}
+}
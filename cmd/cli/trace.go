@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// traceDomain is the magic domain for per-query debug tracing.
+const traceDomain = "debug.ctrld"
+
+// parseTraceQuery reports whether msg is a TXT query for the magic trace domain. If so,
+// it also returns the domain being traced, which is traceDomain itself if there is none.
+func parseTraceQuery(msg *dns.Msg) (string, bool) {
+	q := msg.Question[0]
+	if q.Qtype != dns.TypeTXT {
+		return "", false
+	}
+	name := canonicalName(q.Name)
+	if name == traceDomain {
+		return traceDomain, true
+	}
+	if target, ok := strings.CutSuffix(name, "."+traceDomain); ok && target != "" {
+		return target, true
+	}
+	return "", false
+}
+
+// traceTargetMsg returns the A query for target, which is resolved in place of the magic trace query msg.
+func traceTargetMsg(msg *dns.Msg, target string) *dns.Msg {
+	m := msg.Copy()
+	m.Question = []dns.Question{{Name: dns.Fqdn(target), Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	return m
+}
+
+// popTraceOption reports whether msg has the EDNS0 trace option, removing it from msg,
+// so it is not forwarded to upstreams.
+func popTraceOption(msg *dns.Msg) bool {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for i, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_LOCAL); ok && e.Code == EDNS0_OPTION_TRACE {
+			opt.Option = append(opt.Option[:i:i], opt.Option[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// traceAnswer returns the answer with the decision path recorded by trace.
+//
+// If traceReq is not nil, the answer is for the magic trace query, with the decision path and
+// the traced answer as TXT records. Otherwise, a copy of answer is returned, with the decision
+// path as TXT records of traceDomain in the additional section.
+func traceAnswer(traceReq, answer *dns.Msg, trace *ctrld.QueryTrace) *dns.Msg {
+	if traceReq == nil {
+		answer = answer.Copy()
+		answer.Extra = append(answer.Extra, traceTXT(dns.Fqdn(traceDomain), trace.Messages())...)
+		return answer
+	}
+	msgs := trace.Messages()
+	for _, rr := range answer.Answer {
+		msgs = append(msgs, "answer: "+rr.String())
+	}
+	msgs = append(msgs, "rcode: "+dns.RcodeToString[answer.Rcode])
+	resp := new(dns.Msg)
+	resp.SetReply(traceReq)
+	resp.Answer = traceTXT(traceReq.Question[0].Name, msgs)
+	return resp
+}
+
+// traceTXT returns TXT records for the given trace messages, one record per message.
+func traceTXT(name string, msgs []string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(msgs))
+	for _, msg := range msgs {
+		rrs = append(rrs, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: splitTxt(msg),
+		})
+	}
+	return rrs
+}
+
+// splitTxt splits s into chunks, which fit the 255 bytes limit of TXT character-string.
+func splitTxt(s string) []string {
+	const maxLen = 255
+	var chunks []string
+	for len(s) > maxLen {
+		chunks = append(chunks, s[:maxLen])
+		s = s[maxLen:]
+	}
+	return append(chunks, s)
+}
+
+// udpSize returns the maximum UDP payload size of the answer for the query. The magic trace
+// query is used if presents, since the traced query does not come from the client.
+func udpSize(traceReq, msg *dns.Msg) int {
+	if traceReq != nil {
+		msg = traceReq
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
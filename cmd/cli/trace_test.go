@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_parseTraceQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		qname      string
+		qtype      uint16
+		wantTarget string
+		wantOk     bool
+	}{
+		{"magic domain", "debug.ctrld.", dns.TypeTXT, traceDomain, true},
+		{"traced domain", "Example.COM.debug.ctrld.", dns.TypeTXT, "example.com", true},
+		{"not TXT", "example.com.debug.ctrld.", dns.TypeA, "", false},
+		{"normal query", "example.com.", dns.TypeTXT, "", false},
+		{"suffix without dot", "xdebug.ctrld.", dns.TypeTXT, "", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			m := new(dns.Msg)
+			m.SetQuestion(tc.qname, tc.qtype)
+			target, ok := parseTraceQuery(m)
+			if target != tc.wantTarget || ok != tc.wantOk {
+				t.Errorf("unexpected result, want: (%q, %v), got: (%q, %v)", tc.wantTarget, tc.wantOk, target, ok)
+			}
+		})
+	}
+}
+
+func Test_popTraceOption(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	if popTraceOption(m) {
+		t.Fatal("unexpected trace option without EDNS0")
+	}
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_LOCAL{Code: EDNS0_OPTION_TRACE},
+		&dns.EDNS0_LOCAL{Code: EDNS0_OPTION_MAC, Data: []byte{1, 2, 3, 4, 5, 6}},
+	)
+	if !popTraceOption(m) {
+		t.Fatal("trace option not found")
+	}
+	if len(opt.Option) != 1 || opt.Option[0].Option() != EDNS0_OPTION_MAC {
+		t.Errorf("trace option must be removed, other options must be kept, got: %v", opt.Option)
+	}
+	if popTraceOption(m) {
+		t.Error("trace option must be removed")
+	}
+}
+
+func Test_traceAnswer(t *testing.T) {
+	trace := &ctrld.QueryTrace{}
+	ctx := context.WithValue(context.Background(), ctrld.TraceCtxKey{}, trace)
+	ctrld.Log(ctx, mainLog.Load().Debug(), "sending query to %s", "upstream.0")
+	ctrld.Log(ctx, mainLog.Load().Debug(), "%s", strings.Repeat("x", 300))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetReply(req)
+	rr, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	answer.Answer = append(answer.Answer, rr)
+
+	traced := traceAnswer(nil, answer, trace)
+	if len(answer.Extra) != 0 {
+		t.Error("original answer must not be modified")
+	}
+	if len(traced.Answer) != 1 || len(traced.Extra) != 2 {
+		t.Fatalf("unexpected traced answer: %v", traced)
+	}
+	txt := traced.Extra[1].(*dns.TXT)
+	if txt.Hdr.Name != "debug.ctrld." || len(txt.Txt) != 2 || len(txt.Txt[0]) != 255 {
+		t.Errorf("unexpected trace record: %v", txt)
+	}
+
+	magic := new(dns.Msg)
+	magic.SetQuestion("example.com.debug.ctrld.", dns.TypeTXT)
+	resp := traceAnswer(magic, answer, trace)
+	if resp.Id != magic.Id || resp.Question[0].Name != magic.Question[0].Name {
+		t.Errorf("answer must be for the magic query, got: %v", resp.Question)
+	}
+	// 2 trace messages, 1 answer and rcode.
+	if len(resp.Answer) != 4 {
+		t.Fatalf("unexpected number of records: %d", len(resp.Answer))
+	}
+	if got := resp.Answer[2].(*dns.TXT).Txt[0]; !strings.HasPrefix(got, "answer: example.com.") {
+		t.Errorf("unexpected answer record: %q", got)
+	}
+	if got := resp.Answer[3].(*dns.TXT).Txt[0]; got != "rcode: NOERROR" {
+		t.Errorf("unexpected rcode record: %q", got)
+	}
+}
@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// transparentControl sets IP_TRANSPARENT on the socket, so it accepts traffic diverted by
+// iptables TPROXY rules, destined to any address, and answers from the original destination.
+func transparentControl(network, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		switch network {
+		case "tcp6", "udp6":
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			// Dual stack sockets also receive IPv4 traffic.
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		default:
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_runListenerDNSServer_transparent(t *testing.T) {
+	lc := &ctrld.ListenerConfig{Transparent: true}
+	for _, network := range []string{"udp", "tcp"} {
+		s, errCh := runListenerDNSServer(lc, "127.0.0.1:0", network, nil)
+		select {
+		case err := <-errCh:
+			if errors.Is(err, unix.EPERM) {
+				t.Skip("CAP_NET_ADMIN is required")
+			}
+			t.Fatal(err)
+		default:
+		}
+		_ = s.Shutdown()
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package cli
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transparentControl returns an error, transparent listeners are only supported on Linux.
+func transparentControl(string, string, syscall.RawConn) error {
+	return errors.New("transparent listener is only supported on Linux")
+}
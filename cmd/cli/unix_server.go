@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"io/fs"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// unixClientAddr is the address of clients querying over unix socket listeners. They are local
+// processes, so they are treated like clients querying over loopback.
+var unixClientAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// serveUnix serves DNS over TCP framing on the unix socket of the listener, until ctrld stops.
+// Queries are answered by handler, so they are processed like queries received by plain DNS listeners.
+func (p *prog) serveUnix(lc *ctrld.ListenerConfig, handler dns.Handler) error {
+	// The socket file is left behind if ctrld was killed, other files are never removed.
+	if fi, err := os.Lstat(lc.Path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(lc.Path); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("unix", lc.Path)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	// The socket is created with umask permissions, which may not let clients connect.
+	if err := os.Chmod(lc.Path, lc.UnixSocketMode()); err != nil {
+		return err
+	}
+	s := &dns.Server{
+		Net:      "tcp",
+		Listener: &unixListener{ln},
+		Handler:  handler,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ActivateAndServe()
+	}()
+	p.started <- struct{}{}
+	select {
+	case <-p.stopCh:
+		return s.Shutdown()
+	case err := <-errCh:
+		return err
+	}
+}
+
+// unixListener is a net.Listener accepting connections of unix socket clients, with loopback
+// addresses, so client info lookup and policies work like for other listeners.
+type unixListener struct {
+	net.Listener
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixConn{conn}, nil
+}
+
+// unixConn is a connection of a unix socket client.
+type unixConn struct {
+	net.Conn
+}
+
+func (c *unixConn) LocalAddr() net.Addr  { return unixClientAddr }
+func (c *unixConn) RemoteAddr() net.Addr { return unixClientAddr }
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_serveUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket is not supported on Windows")
+	}
+	path := filepath.Join(t.TempDir(), "ctrld.sock")
+	// Stale socket of previous run.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	lc := &ctrld.ListenerConfig{Type: ctrld.ListenerTypeUnix, Path: path, SocketMode: "0660"}
+	p := &prog{started: make(chan struct{}, 1), stopCh: make(chan struct{})}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.serveUnix(lc, dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			answer := new(dns.Msg)
+			answer.SetReply(m)
+			if !w.RemoteAddr().(*net.TCPAddr).IP.IsLoopback() {
+				answer.Rcode = dns.RcodeServerFailure
+			}
+			_ = w.WriteMsg(answer)
+		}))
+	}()
+	select {
+	case <-p.started:
+	case err := <-errCh:
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if perm := fi.Mode().Perm(); perm != 0o660 {
+		t.Errorf("unexpected socket permissions, want: 0660, got: %#o", perm)
+	}
+
+	c := &dns.Client{Net: "unix"}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	answer, _, err := c.Exchange(msg, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Id != msg.Id || answer.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected answer: %s", answer)
+	}
+
+	close(p.stopCh)
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
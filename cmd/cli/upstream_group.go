@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// upstreamGroup orders upstreams of a group for each query, using the group strategy.
+//
+// With weighted strategy, the first upstream is selected using smooth weighted round-robin,
+// so queries are split exactly by weights, and spread evenly over time.
+type upstreamGroup struct {
+	upstreams []string
+	strategy  string
+	weights   []int
+
+	mu      sync.Mutex
+	current []int
+}
+
+// newUpstreamGroups returns the upstream groups of cfg, keyed by their names.
+func newUpstreamGroups(cfg *ctrld.Config) map[string]*upstreamGroup {
+	groups := make(map[string]*upstreamGroup, len(cfg.UpstreamGroup))
+	for name, gc := range cfg.UpstreamGroup {
+		if gc == nil || len(gc.Upstreams) == 0 {
+			continue
+		}
+		groups[name] = newUpstreamGroup(gc)
+	}
+	return groups
+}
+
+// newUpstreamGroup returns an upstreamGroup for given config. Without weights, all upstreams
+// have the same weight.
+func newUpstreamGroup(gc *ctrld.UpstreamGroupConfig) *upstreamGroup {
+	strategy := gc.Strategy
+	if strategy == "" {
+		strategy = ctrld.UpstreamGroupStrategyWeighted
+	}
+	weights := gc.Weights
+	if len(weights) != len(gc.Upstreams) {
+		weights = make([]int, len(gc.Upstreams))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	return &upstreamGroup{
+		upstreams: gc.Upstreams,
+		strategy:  strategy,
+		weights:   weights,
+		current:   make([]int, len(gc.Upstreams)),
+	}
+}
+
+// next returns the group upstreams, ordered for this query. The first one is used,
+// and the others are used for failover.
+func (g *upstreamGroup) next(um *upstreamMonitor) []string {
+	switch g.strategy {
+	case ctrld.LoadBalanceLatency:
+		return um.sortUpstreamsByLatency(g.upstreams)
+	case ctrld.UpstreamGroupStrategyWeighted:
+		return g.nextWeighted()
+	default:
+		return append([]string(nil), g.upstreams...)
+	}
+}
+
+// nextWeighted returns the group upstreams, starting with the one selected by weights,
+// followed by the others in the configured order.
+func (g *upstreamGroup) nextWeighted() []string {
+	g.mu.Lock()
+	selected, total := -1, 0
+	for i, w := range g.weights {
+		g.current[i] += w
+		total += w
+		if w > 0 && (selected == -1 || g.current[i] > g.current[selected]) {
+			selected = i
+		}
+	}
+	if selected != -1 {
+		g.current[selected] -= total
+	}
+	g.mu.Unlock()
+
+	upstreams := make([]string, 0, len(g.upstreams))
+	if selected != -1 {
+		upstreams = append(upstreams, g.upstreams[selected])
+	}
+	for i, upstream := range g.upstreams {
+		if i != selected {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	return upstreams
+}
+
+// expandUpstreamGroups returns upstreams with groups replaced by their upstreams,
+// in the order selected for this query. Duplicated upstreams are removed.
+//
+// If upstreams is a single group, the group strategy is also returned, so it is used as
+// load balancing strategy of the query instead of the policy one. Weighted and ordered
+// strategies are fully applied here, upstreams are then tried in the returned order.
+func (p *prog) expandUpstreamGroups(upstreams []string) ([]string, string) {
+	hasGroup := false
+	for _, upstream := range upstreams {
+		if strings.HasPrefix(upstream, ctrld.UpstreamGroupPrefix) {
+			hasGroup = true
+			break
+		}
+	}
+	if !hasGroup {
+		return upstreams, ""
+	}
+	loadBalance := ""
+	expanded := make([]string, 0, len(upstreams))
+	seen := make(map[string]bool, len(upstreams))
+	add := func(upstream string) {
+		if !seen[upstream] {
+			seen[upstream] = true
+			expanded = append(expanded, upstream)
+		}
+	}
+	for _, upstream := range upstreams {
+		name, ok := strings.CutPrefix(upstream, ctrld.UpstreamGroupPrefix)
+		if !ok {
+			add(upstream)
+			continue
+		}
+		g := p.upstreamGroups[name]
+		if g == nil {
+			mainLog.Load().Warn().Msgf("%s not found", upstream)
+			continue
+		}
+		if len(upstreams) == 1 {
+			loadBalance = g.strategy
+		}
+		for _, member := range g.next(p.um) {
+			add(member)
+		}
+	}
+	return expanded, loadBalance
+}
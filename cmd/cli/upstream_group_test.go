@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_upstreamGroup_nextWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		want    map[string]int
+	}{
+		{"weighted", []int{90, 10, 0}, map[string]int{"upstream.0": 90, "upstream.1": 10}},
+		{"no weights", nil, map[string]int{"upstream.0": 34, "upstream.1": 33, "upstream.2": 33}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			g := newUpstreamGroup(&ctrld.UpstreamGroupConfig{
+				Upstreams: []string{"upstream.0", "upstream.1", "upstream.2"},
+				Weights:   tc.weights,
+			})
+			got := make(map[string]int)
+			for i := 0; i < 100; i++ {
+				upstreams := g.next(nil)
+				if len(upstreams) != 3 {
+					t.Fatalf("all upstreams must be returned for failover, got: %v", upstreams)
+				}
+				got[upstreams[0]]++
+			}
+			if !maps.Equal(got, tc.want) {
+				t.Errorf("unexpected selection, want: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_upstreamGroup_next(t *testing.T) {
+	um := newUpstreamMonitor(&ctrld.Config{})
+	um.observeLatency("upstream.0", 100*time.Millisecond)
+	um.observeLatency("upstream.1", 10*time.Millisecond)
+	upstreams := []string{"upstream.0", "upstream.1"}
+
+	tests := []struct {
+		name     string
+		strategy string
+		want     []string
+	}{
+		{"ordered", ctrld.LoadBalanceOrdered, []string{"upstream.0", "upstream.1"}},
+		{"race", ctrld.LoadBalanceRace, []string{"upstream.0", "upstream.1"}},
+		{"latency", ctrld.LoadBalanceLatency, []string{"upstream.1", "upstream.0"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			g := newUpstreamGroup(&ctrld.UpstreamGroupConfig{Upstreams: upstreams, Strategy: tc.strategy})
+			for i := 0; i < 3; i++ {
+				if got := g.next(um); !slices.Equal(got, tc.want) {
+					t.Fatalf("unexpected upstreams, want: %v, got: %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_prog_expandUpstreamGroups(t *testing.T) {
+	p := &prog{upstreamGroups: map[string]*upstreamGroup{
+		"canary": newUpstreamGroup(&ctrld.UpstreamGroupConfig{
+			Upstreams: []string{"upstream.0", "upstream.1"},
+			Weights:   []int{0, 1},
+		}),
+		"fast": newUpstreamGroup(&ctrld.UpstreamGroupConfig{
+			Upstreams: []string{"upstream.2", "upstream.3"},
+			Strategy:  ctrld.LoadBalanceRace,
+		}),
+	}}
+	tests := []struct {
+		name            string
+		upstreams       []string
+		want            []string
+		wantLoadBalance string
+	}{
+		{"no group", []string{"upstream.0"}, []string{"upstream.0"}, ""},
+		{"group", []string{"upstream_group.canary"}, []string{"upstream.1", "upstream.0"}, ctrld.UpstreamGroupStrategyWeighted},
+		{"group and upstreams", []string{"upstream.0", "upstream_group.canary", "upstream.2"}, []string{"upstream.0", "upstream.1", "upstream.2"}, ""},
+		{"unknown group", []string{"upstream_group.foo", "upstream.2"}, []string{"upstream.2"}, ""},
+		{"race group", []string{"upstream_group.fast"}, []string{"upstream.2", "upstream.3"}, ctrld.LoadBalanceRace},
+		{"race group and upstreams", []string{"upstream_group.fast", "upstream.0"}, []string{"upstream.2", "upstream.3", "upstream.0"}, ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, loadBalance := p.expandUpstreamGroups(tc.upstreams)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("unexpected upstreams, want: %v, got: %v", tc.want, got)
+			}
+			if loadBalance != tc.wantLoadBalance {
+				t.Errorf("unexpected load balance, want: %q, got: %q", tc.wantLoadBalance, loadBalance)
+			}
+		})
+	}
+}
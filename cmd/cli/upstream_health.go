@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	// defaultHealthCheckFall is the number of consecutive failed health checks before an upstream is marked as down.
+	defaultHealthCheckFall = 3
+	// defaultHealthCheckRise is the number of consecutive passed health checks before an upstream is marked as up.
+	defaultHealthCheckRise = 2
+	// defaultHealthCheckTimeout is the timeout of health checks, for upstreams without timeout config.
+	defaultHealthCheckTimeout = 2 * time.Second
+)
+
+// healthCheckConfig specifies active health checking of upstreams.
+type healthCheckConfig struct {
+	interval time.Duration // Zero means disabled.
+	fall     int
+	rise     int
+}
+
+// runHealthChecks periodically sends a query to each upstream, until ctx is done. Upstreams are
+// marked as down after healthCheck.fall consecutive failed checks, and as up again after
+// healthCheck.rise consecutive passed checks, so flapping upstreams do not change state on
+// every check.
+func (um *upstreamMonitor) runHealthChecks(ctx context.Context) {
+	var wg sync.WaitGroup
+	for n, uc := range um.cfg.Upstream {
+		// mDNS resolver only answers .local names.
+		if uc.Type == ctrld.ResolverTypeMDNS {
+			continue
+		}
+		wg.Add(1)
+		go func(upstream string, uc *ctrld.UpstreamConfig) {
+			defer wg.Done()
+			um.healthCheckLoop(ctx, upstream, uc)
+		}(upstreamPrefix+n, uc)
+	}
+	wg.Wait()
+}
+
+// healthCheckLoop checks the upstream health every healthCheck.interval, until ctx is done.
+func (um *upstreamMonitor) healthCheckLoop(ctx context.Context, upstream string, uc *ctrld.UpstreamConfig) {
+	resolver, err := ctrld.NewResolver(uc)
+	if err != nil {
+		mainLog.Load().Warn().Err(err).Msgf("could not check health of %s", upstream)
+		return
+	}
+	timeout := defaultHealthCheckTimeout
+	if uc.Timeout > 0 {
+		timeout = time.Duration(uc.Timeout) * time.Millisecond
+	}
+	ticker := time.NewTicker(um.healthCheck.interval)
+	defer ticker.Stop()
+	for {
+		msg := new(dns.Msg)
+		msg.SetQuestion(".", dns.TypeNS)
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		_, err := resolver.Resolve(checkCtx, msg)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			mainLog.Load().Debug().Err(err).Msgf("health check of %s failed", upstream)
+		} else {
+			// Keep latency of upstreams, which are not receiving queries, up to date,
+			// so latency load balancing could go back to them once they are faster.
+			um.observeLatency(upstream, time.Since(start))
+		}
+		um.recordHealthCheck(upstream, err == nil)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordHealthCheck records the result of a health check, marking the upstream as down or up
+// once the number of consecutive results reaches the threshold.
+func (um *upstreamMonitor) recordHealthCheck(upstream string, passed bool) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if !passed {
+		um.healthPassed[upstream] = 0
+		um.healthFailed[upstream]++
+		if !um.down[upstream] && um.healthFailed[upstream] >= um.healthCheck.fall {
+			um.down[upstream] = true
+			if um.onDown != nil {
+				go um.onDown(upstream)
+			}
+		}
+		return
+	}
+	um.healthFailed[upstream] = 0
+	um.healthPassed[upstream]++
+	if um.down[upstream] && um.healthPassed[upstream] >= um.healthCheck.rise {
+		um.failbackLocked(upstream, um.healthPassed[upstream])
+	}
+}
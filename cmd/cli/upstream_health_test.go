@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_upstreamMonitor_recordHealthCheck(t *testing.T) {
+	um := newUpstreamMonitor(&ctrld.Config{})
+	upstream := upstreamPrefix + "0"
+	downCh := make(chan string, 1)
+	um.onDown = func(upstream string) { downCh <- upstream }
+
+	checks := []struct {
+		passed bool
+		down   bool
+	}{
+		{false, false},
+		{false, false},
+		{true, false}, // Passed check resets the failed count.
+		{false, false},
+		{false, false},
+		{false, true}, // Down after 3 consecutive failed checks.
+		{true, true},
+		{false, true}, // Failed check resets the passed count.
+		{true, true},
+		{true, false}, // Up after 2 consecutive passed checks.
+	}
+	for i, check := range checks {
+		um.recordHealthCheck(upstream, check.passed)
+		if down := um.isDown(upstream); down != check.down {
+			t.Fatalf("unexpected state after check %d, want down: %v, got: %v", i, check.down, down)
+		}
+	}
+	if got := <-downCh; got != upstream {
+		t.Errorf("unexpected down upstream: %s", got)
+	}
+}
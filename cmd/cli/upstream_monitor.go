@@ -2,6 +2,7 @@ package cli
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,16 +16,37 @@ const (
 	maxFailureRequest = 100
 	// checkUpstreamBackoffSleep is the time interval between each upstream checks.
 	checkUpstreamBackoffSleep = 2 * time.Second
+	// latencyEWMAWeight is the weight of the latest response time in upstream latency average.
+	latencyEWMAWeight = 0.3
+	// latencyFailurePenalty is the response time recorded for an upstream when a query to it failed.
+	latencyFailurePenalty = 5 * time.Second
+	// defaultFailbackChecks is the number of consecutive passed checks before a down upstream is used again.
+	defaultFailbackChecks = 1
 )
 
 // upstreamMonitor performs monitoring upstreams health.
 type upstreamMonitor struct {
 	cfg *ctrld.Config
+	// onDown is called when an upstream is marked as down.
+	onDown func(upstream string)
 
 	mu         sync.Mutex
 	checking   map[string]bool
 	down       map[string]bool
 	failureReq map[string]uint64
+	// latency is the exponentially weighted moving average of upstreams response time.
+	latency map[string]time.Duration
+	// healthCheck is the active health checking config, see runHealthChecks.
+	healthCheck healthCheckConfig
+	// healthPassed and healthFailed are numbers of consecutive passed and failed health checks.
+	healthPassed map[string]int
+	healthFailed map[string]int
+	// failbackChecks is the number of consecutive passed checks before a down upstream is used again,
+	// when active health checking is disabled.
+	failbackChecks int
+	// breakers are circuit breakers of upstreams which have them configured.
+	// The map is not modified after creation.
+	breakers map[string]*circuitBreaker
 }
 
 func newUpstreamMonitor(cfg *ctrld.Config) *upstreamMonitor {
@@ -33,10 +55,33 @@ func newUpstreamMonitor(cfg *ctrld.Config) *upstreamMonitor {
 		checking:   make(map[string]bool),
 		down:       make(map[string]bool),
 		failureReq: make(map[string]uint64),
+		latency:    make(map[string]time.Duration),
+		healthCheck: healthCheckConfig{
+			interval: time.Duration(cfg.Service.HealthCheckInterval) * time.Second,
+			fall:     cfg.Service.HealthCheckFall,
+			rise:     cfg.Service.HealthCheckRise,
+		},
+		healthPassed: make(map[string]int),
+		healthFailed: make(map[string]int),
+		breakers:     make(map[string]*circuitBreaker),
 	}
-	for n := range cfg.Upstream {
+	if um.healthCheck.fall == 0 {
+		um.healthCheck.fall = defaultHealthCheckFall
+	}
+	if um.healthCheck.rise == 0 {
+		um.healthCheck.rise = defaultHealthCheckRise
+	}
+	um.failbackChecks = cfg.Service.FailbackChecks
+	if um.failbackChecks == 0 {
+		um.failbackChecks = defaultFailbackChecks
+	}
+	for n, uc := range cfg.Upstream {
 		upstream := upstreamPrefix + n
 		um.reset(upstream)
+		if uc != nil && uc.CircuitBreakerFailures > 0 {
+			cooldown := time.Duration(uc.CircuitBreakerCooldown) * time.Second
+			um.breakers[upstream] = newCircuitBreaker(uc.CircuitBreakerFailures, cooldown)
+		}
 	}
 	um.reset(upstreamOS)
 	return um
@@ -49,7 +94,11 @@ func (um *upstreamMonitor) increaseFailureCount(upstream string) {
 
 	um.failureReq[upstream] += 1
 	failedCount := um.failureReq[upstream]
+	wasDown := um.down[upstream]
 	um.down[upstream] = failedCount >= maxFailureRequest
+	if !wasDown && um.down[upstream] && um.onDown != nil {
+		go um.onDown(upstream)
+	}
 }
 
 // isDown reports whether the given upstream is being marked as down.
@@ -60,6 +109,19 @@ func (um *upstreamMonitor) isDown(upstream string) bool {
 	return um.down[upstream]
 }
 
+// allDown reports whether all the given upstreams are being marked as down.
+func (um *upstreamMonitor) allDown(upstreams []string) bool {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	for _, upstream := range upstreams {
+		if !um.down[upstream] {
+			return false
+		}
+	}
+	return len(upstreams) > 0
+}
+
 // reset marks an upstream as up and set failed queries counter to zero.
 func (um *upstreamMonitor) reset(upstream string) {
 	um.mu.Lock()
@@ -67,11 +129,119 @@ func (um *upstreamMonitor) reset(upstream string) {
 
 	um.failureReq[upstream] = 0
 	um.down[upstream] = false
+	// Forget the latency measured before the upstream went down, so it is measured again.
+	delete(um.latency, upstream)
+}
+
+// failbackLocked marks a down upstream as up again after it passed the given number of consecutive
+// checks, so new queries are sent to it again. The caller must hold um.mu.
+func (um *upstreamMonitor) failbackLocked(upstream string, passed int) {
+	mainLog.Load().Notice().Msgf("%s is marked as up after %d consecutive passed checks, failing back to it", upstream, passed)
+	um.failureReq[upstream] = 0
+	um.down[upstream] = false
+	delete(um.latency, upstream)
+}
+
+// health returns the health of the upstream, reported by status command.
+func (um *upstreamMonitor) health(upstream string) string {
+	if um.isDown(upstream) {
+		return "down"
+	}
+	if cb := um.breakers[upstream]; cb != nil {
+		if state := cb.currentState(); state != circuitClosed {
+			return "circuit " + state.String()
+		}
+	}
+	return "up"
+}
+
+// allowQuery reports whether a query could be sent to the upstream, according to its circuit breaker.
+func (um *upstreamMonitor) allowQuery(upstream string) bool {
+	cb := um.breakers[upstream]
+	return cb == nil || cb.allow(time.Now())
+}
+
+// isOpen reports whether the circuit breaker of the upstream stops queries. Unlike allowQuery,
+// it does not consume the probe of a half-open circuit, which must be consumed by the query sent.
+func (um *upstreamMonitor) isOpen(upstream string) bool {
+	cb := um.breakers[upstream]
+	return cb != nil && cb.isOpen(time.Now())
+}
+
+// recordQuery records the result of a query sent to the upstream in its circuit breaker.
+func (um *upstreamMonitor) recordQuery(upstream string, succeeded bool) {
+	cb := um.breakers[upstream]
+	if cb == nil {
+		return
+	}
+	if state, changed := cb.record(succeeded, time.Now()); changed {
+		mainLog.Load().Warn().Msgf("circuit breaker of %s is %s", upstream, state)
+	}
+}
+
+// observeLatency updates the latency average of an upstream with a new response time.
+func (um *upstreamMonitor) observeLatency(upstream string, rtt time.Duration) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	avg, ok := um.latency[upstream]
+	if !ok {
+		um.latency[upstream] = rtt
+		return
+	}
+	um.latency[upstream] = avg + time.Duration(latencyEWMAWeight*float64(rtt-avg))
+}
+
+// sortByLatency returns copies of upstreams and their configs, ordered by ascending latency average.
+// Upstreams without any measurement are placed first, so they are measured, and down upstreams last.
+// The relative order of upstreams with the same latency is kept.
+func (um *upstreamMonitor) sortByLatency(upstreams []string, upstreamConfigs []*ctrld.UpstreamConfig) ([]string, []*ctrld.UpstreamConfig) {
+	idx := um.latencyOrder(upstreams)
+	sortedUpstreams := make([]string, len(upstreams))
+	sortedConfigs := make([]*ctrld.UpstreamConfig, len(upstreamConfigs))
+	for i, n := range idx {
+		sortedUpstreams[i] = upstreams[n]
+		sortedConfigs[i] = upstreamConfigs[n]
+	}
+	return sortedUpstreams, sortedConfigs
+}
+
+// sortUpstreamsByLatency is like sortByLatency, but for upstreams only.
+func (um *upstreamMonitor) sortUpstreamsByLatency(upstreams []string) []string {
+	idx := um.latencyOrder(upstreams)
+	sorted := make([]string, len(upstreams))
+	for i, n := range idx {
+		sorted[i] = upstreams[n]
+	}
+	return sorted
+}
+
+// latencyOrder returns indexes of upstreams, in the order described by sortByLatency.
+func (um *upstreamMonitor) latencyOrder(upstreams []string) []int {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	idx := make([]int, len(upstreams))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		ui, uj := upstreams[idx[i]], upstreams[idx[j]]
+		if um.down[ui] != um.down[uj] {
+			return !um.down[ui]
+		}
+		return um.latency[ui] < um.latency[uj]
+	})
+	return idx
 }
 
 // checkUpstream checks the given upstream status, periodically sending query to upstream
 // until successfully. An upstream status/counter will be reset once it becomes reachable.
 func (um *upstreamMonitor) checkUpstream(upstream string, uc *ctrld.UpstreamConfig) {
+	// With active health checking, upstreams are only marked as up by health checks.
+	if um.healthCheck.interval > 0 {
+		return
+	}
 	um.mu.Lock()
 	isChecking := um.checking[upstream]
 	if isChecking {
@@ -101,10 +271,15 @@ func (um *upstreamMonitor) checkUpstream(upstream string, uc *ctrld.UpstreamConf
 		_, err := resolver.Resolve(ctx, msg)
 		return err
 	}
+	passed := 0
 	for {
-		if err := check(); err == nil {
+		if err := check(); err != nil {
+			passed = 0
+		} else if passed++; passed >= um.failbackChecks {
 			mainLog.Load().Debug().Msgf("upstream %q is online", uc.Endpoint)
-			um.reset(upstream)
+			um.mu.Lock()
+			um.failbackLocked(upstream, passed)
+			um.mu.Unlock()
 			return
 		}
 		time.Sleep(checkUpstreamBackoffSleep)
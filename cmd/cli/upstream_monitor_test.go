@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_upstreamMonitor_observeLatency(t *testing.T) {
+	um := newUpstreamMonitor(&ctrld.Config{})
+	upstream := upstreamPrefix + "0"
+
+	um.observeLatency(upstream, 100*time.Millisecond)
+	if got := um.latency[upstream]; got != 100*time.Millisecond {
+		t.Errorf("first response time must be used as is, got: %v", got)
+	}
+	um.observeLatency(upstream, 200*time.Millisecond)
+	if got := um.latency[upstream]; got != 130*time.Millisecond {
+		t.Errorf("unexpected latency average, want: 130ms, got: %v", got)
+	}
+	um.reset(upstream)
+	if _, ok := um.latency[upstream]; ok {
+		t.Error("latency must be forgotten after reset")
+	}
+}
+
+func Test_upstreamMonitor_sortByLatency(t *testing.T) {
+	um := newUpstreamMonitor(&ctrld.Config{})
+	upstreams := []string{"upstream.0", "upstream.1", "upstream.2", "upstream.3"}
+	upstreamConfigs := make([]*ctrld.UpstreamConfig, len(upstreams))
+	for i, upstream := range upstreams {
+		upstreamConfigs[i] = &ctrld.UpstreamConfig{Name: upstream}
+	}
+	um.observeLatency("upstream.0", 300*time.Millisecond)
+	um.observeLatency("upstream.1", 10*time.Millisecond)
+	um.observeLatency("upstream.2", 100*time.Millisecond)
+	um.down["upstream.1"] = true
+
+	sorted, sortedConfigs := um.sortByLatency(upstreams, upstreamConfigs)
+	// upstream.3 was never measured, upstream.1 is fastest but down.
+	want := []string{"upstream.3", "upstream.2", "upstream.0", "upstream.1"}
+	for i := range want {
+		if sorted[i] != want[i] {
+			t.Fatalf("unexpected order, want: %v, got: %v", want, sorted)
+		}
+		if sortedConfigs[i].Name != want[i] {
+			t.Fatalf("configs must follow upstreams order, got: %s at %d", sortedConfigs[i].Name, i)
+		}
+	}
+	if upstreams[0] != "upstream.0" {
+		t.Errorf("input upstreams must not be modified, got: %v", upstreams)
+	}
+}
+
+func Test_upstreamMonitor_health(t *testing.T) {
+	um := newUpstreamMonitor(&ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{
+		"0": {},
+		"1": {CircuitBreakerFailures: 1},
+	}})
+	if got := um.health("upstream.0"); got != "up" {
+		t.Errorf("unexpected health, want: up, got: %s", got)
+	}
+	um.recordQuery("upstream.1", false)
+	if got := um.health("upstream.1"); got != "circuit open" {
+		t.Errorf("unexpected health, want: circuit open, got: %s", got)
+	}
+	um.down["upstream.0"] = true
+	if got := um.health("upstream.0"); got != "down" {
+		t.Errorf("unexpected health, want: down, got: %s", got)
+	}
+	um.mu.Lock()
+	um.failbackLocked("upstream.0", 1)
+	um.mu.Unlock()
+	if got := um.health("upstream.0"); got != "up" {
+		t.Errorf("unexpected health after failback, want: up, got: %s", got)
+	}
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRaceUpstreams is the number of upstreams which a query is sent to at once,
+// in race load balancing, if not configured.
+const defaultRaceUpstreams = 2
+
+// raceResolve resolves the query using upstreams at given indexes simultaneously. The first
+// valid answer wins, and queries to other upstreams are canceled. If there is no valid answer,
+// the first answer received is returned. It returns -1 if all upstreams failed.
+func raceResolve(ctx context.Context, candidates []int, resolve func(ctx context.Context, n int) *dns.Msg, valid func(answer *dns.Msg) bool) (int, *dns.Msg) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		n      int
+		answer *dns.Msg
+	}
+	results := make(chan result, len(candidates))
+	for _, n := range candidates {
+		go func(n int) {
+			results <- result{n: n, answer: resolve(ctx, n)}
+		}(n)
+	}
+	winner := -1
+	var answer *dns.Msg
+	for range candidates {
+		r := <-results
+		if r.answer == nil {
+			continue
+		}
+		if valid(r.answer) {
+			return r.n, r.answer
+		}
+		if winner == -1 {
+			winner, answer = r.n, r.answer
+		}
+	}
+	return winner, answer
+}
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_raceResolve(t *testing.T) {
+	answerWith := func(rcode int) *dns.Msg {
+		m := new(dns.Msg)
+		m.Rcode = rcode
+		return m
+	}
+	valid := func(answer *dns.Msg) bool { return answer.Rcode != dns.RcodeServerFailure }
+	tests := []struct {
+		name    string
+		delays  []time.Duration
+		answers []*dns.Msg
+		winner  int
+	}{
+		{"fastest wins", []time.Duration{50 * time.Millisecond, 0}, []*dns.Msg{answerWith(dns.RcodeSuccess), answerWith(dns.RcodeSuccess)}, 1},
+		{"failed upstream", []time.Duration{50 * time.Millisecond, 0}, []*dns.Msg{answerWith(dns.RcodeSuccess), nil}, 0},
+		{"invalid answer", []time.Duration{50 * time.Millisecond, 0}, []*dns.Msg{answerWith(dns.RcodeSuccess), answerWith(dns.RcodeServerFailure)}, 0},
+		{"no valid answer", []time.Duration{50 * time.Millisecond, 0}, []*dns.Msg{answerWith(dns.RcodeServerFailure), answerWith(dns.RcodeServerFailure)}, 1},
+		{"all failed", []time.Duration{0, 0}, []*dns.Msg{nil, nil}, -1},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			canceled := make(chan int, len(tc.answers))
+			resolve := func(ctx context.Context, n int) *dns.Msg {
+				select {
+				case <-time.After(tc.delays[n]):
+					return tc.answers[n]
+				case <-ctx.Done():
+					canceled <- n
+					return nil
+				}
+			}
+			winner, answer := raceResolve(context.Background(), []int{0, 1}, resolve, valid)
+			if winner != tc.winner {
+				t.Fatalf("unexpected winner, want: %d, got: %d", tc.winner, winner)
+			}
+			if winner != -1 && answer != tc.answers[winner] {
+				t.Errorf("unexpected answer: %v", answer)
+			}
+			if tc.winner == 1 && valid(tc.answers[1]) {
+				select {
+				case n := <-canceled:
+					if n != 0 {
+						t.Errorf("unexpected canceled upstream: %d", n)
+					}
+				case <-time.After(5 * time.Second):
+					t.Error("slower upstream was not canceled")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/olekukonko/tablewriter"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// upstreamStatus describes the current state of an upstream, reported by status command.
+type upstreamStatus struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint"`
+	// Transport is the HTTP version used for DoH/DoH3 upstreams, "h2" or "h3".
+	Transport string `json:"transport,omitempty"`
+	// DesignatedBy is the IP of the resolver, which designated the upstream endpoint.
+	DesignatedBy string `json:"designated_by,omitempty"`
+	// Health is "up", "down", or the circuit breaker state if it is not closed.
+	Health string `json:"health,omitempty"`
+}
+
+// upstreamStatuses returns the status of upstreams in cfg, ordered by upstream number.
+func upstreamStatuses(cfg *ctrld.Config) []*upstreamStatus {
+	nums := make([]string, 0, len(cfg.Upstream))
+	for n := range cfg.Upstream {
+		nums = append(nums, n)
+	}
+	sort.Slice(nums, func(i, j int) bool {
+		ni, erri := strconv.Atoi(nums[i])
+		nj, errj := strconv.Atoi(nums[j])
+		if erri != nil || errj != nil {
+			return nums[i] < nums[j]
+		}
+		return ni < nj
+	})
+	statuses := make([]*upstreamStatus, 0, len(nums))
+	for _, n := range nums {
+		uc := cfg.Upstream[n]
+		statuses = append(statuses, &upstreamStatus{
+			Name:         upstreamPrefix + n,
+			Type:         uc.Type,
+			Endpoint:     uc.Endpoint,
+			Transport:    uc.DoHTransport(),
+			DesignatedBy: uc.DesignatedBy,
+		})
+	}
+	return statuses
+}
+
+// handleUpstreams is the control server handler for listing upstreams status.
+func (p *prog) handleUpstreams(w http.ResponseWriter, request *http.Request) {
+	p.mu.Lock()
+	statuses := upstreamStatuses(p.cfg)
+	p.mu.Unlock()
+	if p.um != nil {
+		for _, s := range statuses {
+			s.Health = p.um.health(s.Name)
+		}
+	}
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// printUpstreamsStatus prints upstreams status of the running ctrld service, if available.
+func printUpstreamsStatus() {
+	dir, err := socketDir()
+	if err != nil {
+		return
+	}
+	cc := newControlClient(filepath.Join(dir, ctrldControlUnixSock))
+	resp, err := cc.post(upstreamsPath, nil)
+	if err != nil {
+		mainLog.Load().Debug().Err(err).Msg("could not get upstreams status")
+		return
+	}
+	defer resp.Body.Close()
+	// Older ctrld versions do not serve upstreams status.
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	var statuses []*upstreamStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		mainLog.Load().Debug().Err(err).Msg("failed to decode upstreams status")
+		return
+	}
+	data := make([][]string, len(statuses))
+	for i, s := range statuses {
+		data[i] = []string{s.Name, s.Type, s.Endpoint, s.Health, s.Transport, s.DesignatedBy}
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Upstream", "Type", "Endpoint", "Health", "Transport", "Designated By"})
+	table.SetAutoFormatHeaders(false)
+	table.AppendBulk(data)
+	table.Render()
+}
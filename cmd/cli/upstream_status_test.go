@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func Test_upstreamStatuses(t *testing.T) {
+	cfg := &ctrld.Config{Upstream: map[string]*ctrld.UpstreamConfig{
+		"10": {Type: ctrld.ResolverTypeLegacy, Endpoint: "1.1.1.1:53"},
+		"3":  {Type: ctrld.ResolverTypeDOT, Endpoint: "dns.example.net:853", DesignatedBy: "192.0.2.53"},
+		"2":  {Type: ctrld.ResolverTypeDOH, Endpoint: "https://freedns.controld.com/p2"},
+		"0":  {Type: ctrld.ResolverTypeDOH3, Endpoint: "https://freedns.controld.com/p1"},
+	}}
+	statuses := upstreamStatuses(cfg)
+	want := []upstreamStatus{
+		{Name: "upstream.0", Type: ctrld.ResolverTypeDOH3, Endpoint: "https://freedns.controld.com/p1"},
+		{Name: "upstream.2", Type: ctrld.ResolverTypeDOH, Endpoint: "https://freedns.controld.com/p2", Transport: "h2"},
+		{Name: "upstream.3", Type: ctrld.ResolverTypeDOT, Endpoint: "dns.example.net:853", DesignatedBy: "192.0.2.53"},
+		{Name: "upstream.10", Type: ctrld.ResolverTypeLegacy, Endpoint: "1.1.1.1:53"},
+	}
+	if len(statuses) != len(want) {
+		t.Fatalf("unexpected number of statuses, want: %d, got: %d", len(want), len(statuses))
+	}
+	for i := range want {
+		if *statuses[i] != want[i] {
+			t.Errorf("unexpected status at %d, want: %+v, got: %+v", i, want[i], *statuses[i])
+		}
+	}
+}
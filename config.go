@@ -14,7 +14,9 @@ import (
 	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -46,6 +48,41 @@ const (
 	// depending on the record type of the DNS query.
 	IpStackSplit = "split"
 
+	// UpstreamGroupPrefix is the prefix of upstream groups, when they are targets of policy rules.
+	UpstreamGroupPrefix = "upstream_group."
+
+	// UpstreamGroupStrategyWeighted indicates that queries sent to an upstream group are split
+	// between its upstreams by weights. Other strategies are the same as load balancing ones.
+	UpstreamGroupStrategyWeighted = "weighted"
+
+	// LoadBalanceOrdered indicates that queries are sent to upstreams in the configured order.
+	LoadBalanceOrdered = "ordered"
+	// LoadBalanceLatency indicates that queries are sent to the fastest healthy upstream first.
+	LoadBalanceLatency = "latency"
+	// LoadBalanceRace indicates that queries are sent to multiple upstreams at once, and the first answer is used.
+	LoadBalanceRace = "race"
+
+	// ListenerTypeDNS indicates that the listener serves plain DNS over UDP and TCP.
+	ListenerTypeDNS = "dns"
+	// ListenerTypeDOH indicates that the listener serves DNS over HTTPS.
+	ListenerTypeDOH = "doh"
+	// ListenerTypeDOT indicates that the listener serves DNS over TLS.
+	ListenerTypeDOT = "dot"
+	// ListenerTypeDOQ indicates that the listener serves DNS over QUIC.
+	ListenerTypeDOQ = "doq"
+	// ListenerTypeUnix indicates that the listener serves DNS over TCP framing on a unix socket.
+	ListenerTypeUnix = "unix"
+
+	// ACLActionRefuse indicates that queries denied by listener acl are answered with REFUSED.
+	ACLActionRefuse = "refuse"
+	// ACLActionDrop indicates that queries denied by listener acl are dropped without answer.
+	ACLActionDrop = "drop"
+
+	// ACMEChallengeHTTP01 indicates that ACME domain validation is done by serving a token over HTTP on port 80.
+	ACMEChallengeHTTP01 = "http-01"
+	// ACMEChallengeDNS01 indicates that ACME domain validation is done by creating a TXT record for the domain.
+	ACMEChallengeDNS01 = "dns-01"
+
 	controlDComDomain = "controld.com"
 	controlDNetDomain = "controld.net"
 	controlDDevDomain = "controld.dev"
@@ -122,10 +159,30 @@ func InitConfig(v *viper.Viper, name string) {
 
 // Config represents ctrld supported configuration.
 type Config struct {
-	Service  ServiceConfig              `mapstructure:"service" toml:"service,omitempty"`
-	Listener map[string]*ListenerConfig `mapstructure:"listener" toml:"listener" validate:"min=1,dive"`
-	Network  map[string]*NetworkConfig  `mapstructure:"network" toml:"network" validate:"min=1,dive"`
-	Upstream map[string]*UpstreamConfig `mapstructure:"upstream" toml:"upstream" validate:"min=1,dive"`
+	Service       ServiceConfig                   `mapstructure:"service" toml:"service,omitempty"`
+	Listener      map[string]*ListenerConfig      `mapstructure:"listener" toml:"listener" validate:"min=1,dive"`
+	Network       map[string]*NetworkConfig       `mapstructure:"network" toml:"network" validate:"min=1,dive"`
+	Upstream      map[string]*UpstreamConfig      `mapstructure:"upstream" toml:"upstream" validate:"min=1,dive"`
+	UpstreamGroup map[string]*UpstreamGroupConfig `mapstructure:"upstream_group" toml:"upstream_group,omitempty" validate:"dive"`
+	Clients       map[string]*ClientConfig        `mapstructure:"clients" toml:"clients,omitempty" validate:"dive,keys,mac|ip,endkeys,required"`
+	DHCPServer    map[string]*DHCPServerConfig    `mapstructure:"dhcp_server" toml:"dhcp_server,omitempty" validate:"dive"`
+	CacheRule     map[string]*CacheRuleConfig     `mapstructure:"cache_rule" toml:"cache_rule,omitempty" validate:"dive"`
+	Schedule      map[string]*ScheduleConfig      `mapstructure:"schedule" toml:"schedule,omitempty" validate:"dive"`
+}
+
+// LookupClient returns the static config of client with given IP or MAC address,
+// or nil if there is none. Config for IP address is preferred, the same as client
+// info lookup.
+func (c *Config) LookupClient(ip, mac string) *ClientConfig {
+	if ip != "" {
+		if cc := c.Clients[ip]; cc != nil {
+			return cc
+		}
+	}
+	if mac != "" {
+		return c.Clients[strings.ToLower(mac)]
+	}
+	return nil
 }
 
 // HasUpstreamSendClientInfo reports whether the config has any upstream
@@ -139,7 +196,9 @@ func (c *Config) HasUpstreamSendClientInfo() bool {
 	return false
 }
 
-// FirstListener returns the first listener config of current config. Listeners are sorted numerically.
+// FirstListener returns the first listener config of current config. Listeners are sorted numerically,
+// and plain DNS listeners come first, since only they could be used as system nameserver. Listeners
+// with bind addresses come after other plain DNS listeners, since they do not listen on their IP.
 //
 // It panics if Config has no listeners configured.
 func (c *Config) FirstListener() *ListenerConfig {
@@ -155,6 +214,16 @@ func (c *Config) FirstListener() *ListenerConfig {
 		panic("missing listener config")
 	}
 	sort.Ints(listeners)
+	for _, n := range listeners {
+		if lc := c.Listener[strconv.Itoa(n)]; lc.IsPlainDNS() && len(lc.Bind) == 0 {
+			return lc
+		}
+	}
+	for _, n := range listeners {
+		if lc := c.Listener[strconv.Itoa(n)]; lc.IsPlainDNS() {
+			return lc
+		}
+	}
 	return c.Listener[strconv.Itoa(listeners[0])]
 }
 
@@ -179,26 +248,79 @@ func (c *Config) FirstUpstream() *UpstreamConfig {
 
 // ServiceConfig specifies the general ctrld config.
 type ServiceConfig struct {
-	LogLevel                string `mapstructure:"log_level" toml:"log_level,omitempty"`
-	LogPath                 string `mapstructure:"log_path" toml:"log_path,omitempty"`
-	CacheEnable             bool   `mapstructure:"cache_enable" toml:"cache_enable,omitempty"`
-	CacheSize               int    `mapstructure:"cache_size" toml:"cache_size,omitempty"`
-	CacheTTLOverride        int    `mapstructure:"cache_ttl_override" toml:"cache_ttl_override,omitempty"`
-	CacheServeStale         bool   `mapstructure:"cache_serve_stale" toml:"cache_serve_stale,omitempty"`
-	MaxConcurrentRequests   *int   `mapstructure:"max_concurrent_requests" toml:"max_concurrent_requests,omitempty" validate:"omitempty,gte=0"`
-	DHCPLeaseFile           string `mapstructure:"dhcp_lease_file_path" toml:"dhcp_lease_file_path" validate:"omitempty,file"`
-	DHCPLeaseFileFormat     string `mapstructure:"dhcp_lease_file_format" toml:"dhcp_lease_file_format" validate:"required_unless=DHCPLeaseFile '',omitempty,oneof=dnsmasq isc-dhcp"`
-	DiscoverMDNS            *bool  `mapstructure:"discover_mdns" toml:"discover_mdns,omitempty"`
-	DiscoverARP             *bool  `mapstructure:"discover_arp" toml:"discover_arp,omitempty"`
-	DiscoverDHCP            *bool  `mapstructure:"discover_dhcp" toml:"discover_dhcp,omitempty"`
-	DiscoverPtr             *bool  `mapstructure:"discover_ptr" toml:"discover_ptr,omitempty"`
-	DiscoverHosts           *bool  `mapstructure:"discover_hosts" toml:"discover_hosts,omitempty"`
-	DiscoverRefreshInterval int    `mapstructure:"discover_refresh_interval" toml:"discover_refresh_interval,omitempty"`
-	ClientIDPref            string `mapstructure:"client_id_preference" toml:"client_id_preference,omitempty" validate:"omitempty,oneof=host mac"`
-	MetricsQueryStats       bool   `mapstructure:"metrics_query_stats" toml:"metrics_query_stats,omitempty"`
-	MetricsListener         string `mapstructure:"metrics_listener" toml:"metrics_listener,omitempty"`
-	Daemon                  bool   `mapstructure:"-" toml:"-"`
-	AllocateIP              bool   `mapstructure:"-" toml:"-"`
+	LogLevel                string   `mapstructure:"log_level" toml:"log_level,omitempty"`
+	LogPath                 string   `mapstructure:"log_path" toml:"log_path,omitempty"`
+	CacheEnable             bool     `mapstructure:"cache_enable" toml:"cache_enable,omitempty"`
+	CacheSize               int      `mapstructure:"cache_size" toml:"cache_size,omitempty"`
+	CacheTTLOverride        int      `mapstructure:"cache_ttl_override" toml:"cache_ttl_override,omitempty"`
+	CacheMinTTL             int      `mapstructure:"cache_min_ttl" toml:"cache_min_ttl,omitempty" validate:"gte=0"`
+	CacheMaxTTL             int      `mapstructure:"cache_max_ttl" toml:"cache_max_ttl,omitempty" validate:"gte=0"`
+	CacheServeStale         bool     `mapstructure:"cache_serve_stale" toml:"cache_serve_stale,omitempty"`
+	CacheMaxStale           int      `mapstructure:"cache_max_stale" toml:"cache_max_stale,omitempty" validate:"gte=0"`
+	CacheServeOffline       bool     `mapstructure:"cache_serve_offline" toml:"cache_serve_offline,omitempty"`
+	CacheOfflineMaxStale    int      `mapstructure:"cache_offline_max_stale" toml:"cache_offline_max_stale,omitempty" validate:"gte=0"`
+	CacheMinServeTTL        int      `mapstructure:"cache_min_serve_ttl" toml:"cache_min_serve_ttl,omitempty" validate:"gte=0"`
+	CacheStrictTTL          bool     `mapstructure:"cache_strict_ttl" toml:"cache_strict_ttl,omitempty"`
+	CacheLatencyBudget      int      `mapstructure:"cache_latency_budget" toml:"cache_latency_budget,omitempty" validate:"gte=0"`
+	CacheMaxNegativeTTL     int      `mapstructure:"cache_max_negative_ttl" toml:"cache_max_negative_ttl,omitempty" validate:"gte=0"`
+	CacheNoNegativeDomains  []string `mapstructure:"cache_no_negative_domains" toml:"cache_no_negative_domains,omitempty"`
+	CachePrefetch           bool     `mapstructure:"cache_prefetch" toml:"cache_prefetch,omitempty"`
+	CachePrefetchHits       int      `mapstructure:"cache_prefetch_hits" toml:"cache_prefetch_hits,omitempty" validate:"gte=0"`
+	CachePrefetchPercent    int      `mapstructure:"cache_prefetch_percent" toml:"cache_prefetch_percent,omitempty" validate:"gte=0,lte=100"`
+	CacheFile               string   `mapstructure:"cache_file" toml:"cache_file,omitempty"`
+	CacheFileInterval       int      `mapstructure:"cache_file_interval" toml:"cache_file_interval,omitempty" validate:"gte=0"`
+	MaxConcurrentRequests   *int     `mapstructure:"max_concurrent_requests" toml:"max_concurrent_requests,omitempty" validate:"omitempty,gte=0"`
+	DHCPLeaseFile           string   `mapstructure:"dhcp_lease_file_path" toml:"dhcp_lease_file_path" validate:"omitempty,file"`
+	DHCPLeaseFileFormat     string   `mapstructure:"dhcp_lease_file_format" toml:"dhcp_lease_file_format" validate:"required_unless=DHCPLeaseFile '',omitempty,oneof=dnsmasq isc-dhcp kea-dhcp4 udhcpd"`
+	DiscoverMDNS            *bool    `mapstructure:"discover_mdns" toml:"discover_mdns,omitempty"`
+	DiscoverMDNSActive      bool     `mapstructure:"discover_mdns_active" toml:"discover_mdns_active,omitempty"`
+	DiscoverARP             *bool    `mapstructure:"discover_arp" toml:"discover_arp,omitempty"`
+	DiscoverDHCP            *bool    `mapstructure:"discover_dhcp" toml:"discover_dhcp,omitempty"`
+	DiscoverPtr             *bool    `mapstructure:"discover_ptr" toml:"discover_ptr,omitempty"`
+	DiscoverNetBIOS         bool     `mapstructure:"discover_netbios" toml:"discover_netbios,omitempty"`
+	DiscoverHosts           *bool    `mapstructure:"discover_hosts" toml:"discover_hosts,omitempty"`
+	DiscoverRefreshInterval int      `mapstructure:"discover_refresh_interval" toml:"discover_refresh_interval,omitempty"`
+	DiscoverCacheFile       string   `mapstructure:"discover_cache_file" toml:"discover_cache_file,omitempty"`
+	DiscoverCacheMaxAge     int      `mapstructure:"discover_cache_max_age" toml:"discover_cache_max_age,omitempty" validate:"gte=0"`
+	DiscoverEntryTTL        int      `mapstructure:"discover_entry_ttl" toml:"discover_entry_ttl,omitempty" validate:"gte=0"`
+	LanRecords              bool     `mapstructure:"lan_records" toml:"lan_records,omitempty"`
+	LanDomain               string   `mapstructure:"lan_domain" toml:"lan_domain,omitempty" validate:"omitempty,hostname_rfc1123"`
+	UnifiAPIURL             string   `mapstructure:"unifi_api_url" toml:"unifi_api_url,omitempty" validate:"omitempty,url"`
+	UnifiAPIKey             string   `mapstructure:"unifi_api_key" toml:"unifi_api_key,omitempty"`
+	StartupGracePeriod      int      `mapstructure:"startup_grace_period" toml:"startup_grace_period,omitempty" validate:"gte=0"`
+	DoQSessionCacheFile     string   `mapstructure:"doq_session_cache_file" toml:"doq_session_cache_file,omitempty"`
+	NtpSync                 string   `mapstructure:"ntp_sync" toml:"ntp_sync,omitempty" validate:"omitempty,oneof=offset step"`
+	NtpServers              []string `mapstructure:"ntp_servers" toml:"ntp_servers,omitempty" validate:"dive,ip"`
+	Timezone                string   `mapstructure:"timezone" toml:"timezone,omitempty" validate:"omitempty,timezone"`
+	HookPreStart            string   `mapstructure:"hook_pre_start" toml:"hook_pre_start,omitempty"`
+	HookPostConfigure       string   `mapstructure:"hook_post_configure" toml:"hook_post_configure,omitempty"`
+	HookUpstreamDown        string   `mapstructure:"hook_upstream_down" toml:"hook_upstream_down,omitempty"`
+	HookReload              string   `mapstructure:"hook_reload" toml:"hook_reload,omitempty"`
+	HookFailOpen            string   `mapstructure:"hook_fail_open" toml:"hook_fail_open,omitempty"`
+	HookACMEDNS             string   `mapstructure:"hook_acme_dns" toml:"hook_acme_dns,omitempty"`
+	HookTimeout             int      `mapstructure:"hook_timeout" toml:"hook_timeout,omitempty" validate:"gte=0"`
+	HealthCheckInterval     int      `mapstructure:"health_check_interval" toml:"health_check_interval,omitempty" validate:"gte=0"`
+	HealthCheckFall         int      `mapstructure:"health_check_fall" toml:"health_check_fall,omitempty" validate:"gte=0"`
+	HealthCheckRise         int      `mapstructure:"health_check_rise" toml:"health_check_rise,omitempty" validate:"gte=0"`
+	FailbackChecks          int      `mapstructure:"failback_checks" toml:"failback_checks,omitempty" validate:"gte=0"`
+	FailOpenUpstream        string   `mapstructure:"fail_open_upstream" toml:"fail_open_upstream,omitempty" validate:"omitempty,startswith=upstream."`
+	FailOpenAfter           int      `mapstructure:"fail_open_after" toml:"fail_open_after,omitempty" validate:"gte=0"`
+	ClientIDPref            string   `mapstructure:"client_id_preference" toml:"client_id_preference,omitempty" validate:"omitempty,oneof=host mac"`
+	Edns0MacOptions         []uint16 `mapstructure:"edns0_mac_options" toml:"edns0_mac_options,omitempty" validate:"dive,gt=0"`
+	Edns0MacStrip           bool     `mapstructure:"edns0_mac_strip" toml:"edns0_mac_strip,omitempty"`
+	DebugQuery              bool     `mapstructure:"debug_query" toml:"debug_query,omitempty"`
+	MetricsQueryStats       bool     `mapstructure:"metrics_query_stats" toml:"metrics_query_stats,omitempty"`
+	MetricsListener         string   `mapstructure:"metrics_listener" toml:"metrics_listener,omitempty"`
+	RouterListenAddress     string   `mapstructure:"router_listen_address" toml:"router_listen_address,omitempty" validate:"ipportorempty"`
+	DnsRedirect             bool     `mapstructure:"dns_redirect" toml:"dns_redirect,omitempty"`
+	DnsRedirectBypass       []string `mapstructure:"dns_redirect_bypass" toml:"dns_redirect_bypass,omitempty" validate:"dive,ip|cidr"`
+	MirrorUpstream          string   `mapstructure:"mirror_upstream" toml:"mirror_upstream,omitempty" validate:"omitempty,startswith=upstream."`
+	MirrorSampleRate        int      `mapstructure:"mirror_sample_rate" toml:"mirror_sample_rate,omitempty" validate:"gte=0,lte=100"`
+	ACMEEmail               string   `mapstructure:"acme_email" toml:"acme_email,omitempty" validate:"omitempty,email"`
+	ACMEDirectory           string   `mapstructure:"acme_directory" toml:"acme_directory,omitempty" validate:"omitempty,url"`
+	ACMEChallenge           string   `mapstructure:"acme_challenge" toml:"acme_challenge,omitempty" validate:"omitempty,oneof=http-01 dns-01"`
+	Daemon                  bool     `mapstructure:"-" toml:"-"`
+	AllocateIP              bool     `mapstructure:"-" toml:"-"`
 }
 
 // NetworkConfig specifies configuration for networks where ctrld will handle requests.
@@ -211,18 +333,85 @@ type NetworkConfig struct {
 // UpstreamConfig specifies configuration for upstreams that ctrld will forward requests to.
 type UpstreamConfig struct {
 	Name        string `mapstructure:"name" toml:"name,omitempty"`
-	Type        string `mapstructure:"type" toml:"type,omitempty" validate:"oneof=doh doh3 dot doq os legacy"`
+	Type        string `mapstructure:"type" toml:"type,omitempty" validate:"oneof=doh doh3 dohjson dot doq dnscrypt os legacy unix mdns"`
 	Endpoint    string `mapstructure:"endpoint" toml:"endpoint,omitempty"`
 	BootstrapIP string `mapstructure:"bootstrap_ip" toml:"bootstrap_ip,omitempty"`
 	Domain      string `mapstructure:"-" toml:"-"`
 	IPStack     string `mapstructure:"ip_stack" toml:"ip_stack,omitempty" validate:"ipstack"`
 	Timeout     int    `mapstructure:"timeout" toml:"timeout,omitempty" validate:"gte=0"`
+	// Retries is the number of times a failed query is sent to the upstream again, before failing
+	// over to the next upstream. RetryBackoff is the delay in milliseconds before the first retry,
+	// which is doubled after each retry.
+	Retries      int `mapstructure:"retries" toml:"retries,omitempty" validate:"gte=0"`
+	RetryBackoff int `mapstructure:"retry_backoff" toml:"retry_backoff,omitempty" validate:"gte=0"`
 	// The caller should not access this field directly.
 	// Use UpstreamSendClientInfo instead.
 	SendClientInfo *bool `mapstructure:"send_client_info" toml:"send_client_info,omitempty"`
 	// The caller should not access this field directly.
 	// Use IsDiscoverable instead.
 	Discoverable *bool `mapstructure:"discoverable" toml:"discoverable"`
+	// Rewrite maps a zone to another zone, rewriting query names before
+	// sending to this upstream. Use RewriteQuery to apply the rules.
+	Rewrite map[string]string `mapstructure:"rewrite" toml:"rewrite,omitempty" validate:"dive,keys,fqdn,endkeys,fqdn"`
+	// DiscoverEncrypted makes a legacy upstream use the encrypted endpoint designated
+	// by the resolver, if any. See DiscoverResolver for more details.
+	DiscoverEncrypted bool `mapstructure:"discover_encrypted" toml:"discover_encrypted,omitempty"`
+	// DesignatedBy is the IP of the resolver, which designated the encrypted endpoint
+	// used by this upstream, if it was discovered using DiscoverEncrypted.
+	DesignatedBy string `mapstructure:"-" toml:"-"`
+	// Via is the list of anonymized DNSCrypt relays stamps, which queries to a DNSCrypt
+	// upstream are routed through.
+	Via []string `mapstructure:"via" toml:"via,omitempty"`
+	// TCPOnly makes legacy and DNSCrypt upstreams send queries over TCP only. For legacy upstreams,
+	// IPProtocol "tcp" takes precedence, and IPProtocol "udp" is rejected by validation.
+	TCPOnly bool `mapstructure:"tcp_only" toml:"tcp_only,omitempty"`
+	// IPProtocol is the transport protocol of a legacy upstream, "udp" or "tcp". With "tcp",
+	// queries are pipelined over reused connections, see tcpPipeline for more details.
+	IPProtocol string `mapstructure:"ip_protocol" toml:"ip_protocol,omitempty" validate:"omitempty,oneof=udp tcp"`
+	// MaxMsgSize caps the EDNS0 UDP buffer size advertised in queries sent to this upstream.
+	// Use LimitMsgSize to apply it.
+	MaxMsgSize int `mapstructure:"max_msg_size" toml:"max_msg_size,omitempty" validate:"omitempty,gte=512,lte=65535"`
+	// Proxy is the URL of the SOCKS5 or HTTP CONNECT proxy, which DoH and DoT connections
+	// to this upstream are tunneled through.
+	Proxy string `mapstructure:"proxy" toml:"proxy,omitempty"`
+	// Tor routes DoH and DoT connections to this upstream through Tor, using Proxy as
+	// the Tor SOCKS proxy if set, or defaultTorProxy otherwise.
+	Tor bool `mapstructure:"tor" toml:"tor,omitempty"`
+	// SPKIPins is the list of base64 encoded SHA-256 of SubjectPublicKeyInfo, which the
+	// upstream certificate must match. SPKIPinsOnly skips CA validation, using pins only.
+	SPKIPins     []string `mapstructure:"spki_pins" toml:"spki_pins,omitempty" validate:"dive,base64,len=44"`
+	SPKIPinsOnly bool     `mapstructure:"spki_pins_only" toml:"spki_pins_only,omitempty"`
+	// ClientCert and ClientKey are paths to the PEM encoded certificate and private key, which
+	// ctrld presents to upstreams requiring mutual TLS. See clientCertReloader for more details.
+	ClientCert string `mapstructure:"client_cert" toml:"client_cert,omitempty" validate:"omitempty,file"`
+	ClientKey  string `mapstructure:"client_key" toml:"client_key,omitempty" validate:"omitempty,file"`
+	// TLSServerName overrides the name used for SNI and certificate verification, so the upstream
+	// could be reached by IP, or through a fronting host, while validating a different name.
+	TLSServerName string `mapstructure:"tls_server_name" toml:"tls_server_name,omitempty" validate:"omitempty,hostname_rfc1123"`
+	// ECHConfig is the base64 encoded ECHConfigList, which is used for encrypting the client hello,
+	// including the SNI, of connections to the upstream.
+	ECHConfig string `mapstructure:"ech_config" toml:"ech_config,omitempty" validate:"omitempty,base64"`
+	// BootstrapResolvers is the ordered list of nameservers used for resolving the upstream
+	// domain, instead of the default bootstrap DNS. See bootstrapResolver for more details.
+	BootstrapResolvers []string `mapstructure:"bootstrap_resolvers" toml:"bootstrap_resolvers,omitempty" validate:"dive,ip"`
+	// DoHMethod is the HTTP method of requests to a DoH/DoH3 upstream, "get" or "post".
+	// Defaults to "get", which allows answers to be cached by HTTP caches.
+	DoHMethod string `mapstructure:"doh_method" toml:"doh_method,omitempty" validate:"omitempty,oneof=get post"`
+	// Headers are HTTP headers added to every request sent to a DoH/DoH3 upstream.
+	Headers map[string]string `mapstructure:"headers" toml:"headers,omitempty"`
+	// BearerTokenFile is the path to the file containing the token, which is sent as
+	// bearer token in Authorization header of every request to a DoH/DoH3 upstream.
+	BearerTokenFile string `mapstructure:"bearer_token_file" toml:"bearer_token_file,omitempty" validate:"omitempty,file"`
+	// CircuitBreakerFailures is the number of consecutive failed queries, which stops queries to
+	// the upstream for CircuitBreakerCooldown seconds. Zero disables the circuit breaker.
+	CircuitBreakerFailures int `mapstructure:"circuit_breaker_failures" toml:"circuit_breaker_failures,omitempty" validate:"gte=0"`
+	CircuitBreakerCooldown int `mapstructure:"circuit_breaker_cooldown" toml:"circuit_breaker_cooldown,omitempty" validate:"gte=0"`
+	// MaxConns is the maximum number of connections, busy or idle, kept open to a DoT, DoQ or TCP
+	// legacy upstream, which queries are spread over. IdleTimeout is the time in seconds a connection
+	// is kept open without queries. Prewarm opens connections on startup and network changes, see WarmUpConns.
+	MaxConns    int  `mapstructure:"max_conns" toml:"max_conns,omitempty" validate:"gte=0"`
+	IdleTimeout int  `mapstructure:"idle_timeout" toml:"idle_timeout,omitempty" validate:"gte=0"`
+	Prewarm     bool `mapstructure:"prewarm" toml:"prewarm,omitempty"`
 
 	g                  singleflight.Group
 	rebootstrap        atomic.Bool
@@ -239,15 +428,137 @@ type UpstreamConfig struct {
 	certPool           *x509.CertPool
 	u                  *url.URL
 	uid                string
+	dnscrypt           *dnscryptClient
+	bearerToken        string
+	clientCert         *clientCertReloader
+	tcpPipelinesMu     sync.Mutex
+	tcpPipelines       map[string]*tcpPipeline
+	doqPoolsMu         sync.Mutex
+	doqPools           map[string]*doqPool
+	dohRace            dohRacer
+	echConfigList      []byte
 }
 
 // ListenerConfig specifies the networks configuration that ctrld will run on.
 type ListenerConfig struct {
-	IP              string                `mapstructure:"ip" toml:"ip,omitempty" validate:"iporempty"`
-	Port            int                   `mapstructure:"port" toml:"port,omitempty" validate:"gte=0"`
-	Restricted      bool                  `mapstructure:"restricted" toml:"restricted,omitempty"`
-	AllowWanClients bool                  `mapstructure:"allow_wan_clients" toml:"allow_wan_clients,omitempty"`
-	Policy          *ListenerPolicyConfig `mapstructure:"policy" toml:"policy,omitempty"`
+	IP              string                  `mapstructure:"ip" toml:"ip,omitempty" validate:"iporempty"`
+	Port            int                     `mapstructure:"port" toml:"port,omitempty" validate:"gte=0"`
+	Type            string                  `mapstructure:"type" toml:"type,omitempty" validate:"omitempty,oneof=dns doh dot doq unix"`
+	Path            string                  `mapstructure:"path" toml:"path,omitempty"`
+	SocketMode      string                  `mapstructure:"socket_mode" toml:"socket_mode,omitempty" validate:"omitempty,file_mode"`
+	Bind            []string                `mapstructure:"bind" toml:"bind,omitempty" validate:"dive,required"`
+	Allow           []string                `mapstructure:"allow" toml:"allow,omitempty" validate:"dive,cidr|ip"`
+	Deny            []string                `mapstructure:"deny" toml:"deny,omitempty" validate:"dive,cidr|ip"`
+	ACLAction       string                  `mapstructure:"acl_action" toml:"acl_action,omitempty" validate:"omitempty,oneof=refuse drop"`
+	Transparent     bool                    `mapstructure:"transparent" toml:"transparent,omitempty"`
+	AdvertiseRDNSS  bool                    `mapstructure:"advertise_rdnss" toml:"advertise_rdnss,omitempty"`
+	UDPWorkers      int                     `mapstructure:"udp_workers" toml:"udp_workers,omitempty" validate:"gte=0"`
+	ProxyProtocol   bool                    `mapstructure:"proxy_protocol" toml:"proxy_protocol,omitempty"`
+	TrustedProxies  []string                `mapstructure:"trusted_proxies" toml:"trusted_proxies,omitempty" validate:"dive,cidr|ip"`
+	TCPMaxConns     int                     `mapstructure:"tcp_max_conns" toml:"tcp_max_conns,omitempty" validate:"gte=0"`
+	TCPMaxQueries   int                     `mapstructure:"tcp_max_queries" toml:"tcp_max_queries,omitempty" validate:"gte=0"`
+	TCPReadTimeout  int                     `mapstructure:"tcp_read_timeout" toml:"tcp_read_timeout,omitempty" validate:"gte=0"`
+	TCPIdleTimeout  int                     `mapstructure:"tcp_idle_timeout" toml:"tcp_idle_timeout,omitempty" validate:"gte=0"`
+	TLSCert         string                  `mapstructure:"tls_cert" toml:"tls_cert,omitempty" validate:"omitempty,file"`
+	TLSKey          string                  `mapstructure:"tls_key" toml:"tls_key,omitempty" validate:"omitempty,file"`
+	ACMEDomain      string                  `mapstructure:"acme_domain" toml:"acme_domain,omitempty" validate:"omitempty,hostname_rfc1123"`
+	Restricted      bool                    `mapstructure:"restricted" toml:"restricted,omitempty"`
+	AllowWanClients bool                    `mapstructure:"allow_wan_clients" toml:"allow_wan_clients,omitempty"`
+	WanClientSubnet string                  `mapstructure:"wan_client_subnet" toml:"wan_client_subnet,omitempty" validate:"omitempty,cidr"`
+	UpstreamGroup   string                  `mapstructure:"upstream_group" toml:"upstream_group,omitempty"`
+	Policy          *ListenerPolicyConfig   `mapstructure:"policy" toml:"policy,omitempty"`
+	ClientPolicies  []*ListenerPolicyConfig `mapstructure:"client_policies" toml:"client_policies,omitempty" validate:"dive"`
+
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	trustedProxies []netip.Prefix
+}
+
+// defaultSocketMode is the permissions of unix socket of listeners without socket_mode. Like
+// plain DNS ports, the socket could be queried by any local user.
+const defaultSocketMode = 0o666
+
+// UnixSocketMode returns the permissions of the unix socket served by the listener.
+func (lc *ListenerConfig) UnixSocketMode() os.FileMode {
+	if mode, err := strconv.ParseUint(lc.SocketMode, 8, 32); err == nil {
+		return os.FileMode(mode)
+	}
+	return defaultSocketMode
+}
+
+// IsPlainDNS reports whether the listener serves plain DNS over UDP and TCP.
+func (lc *ListenerConfig) IsPlainDNS() bool {
+	return lc.Type == "" || lc.Type == ListenerTypeDNS
+}
+
+// Addr returns the address the listener is served on, the socket path for unix socket listeners,
+// or bind addresses if set.
+func (lc *ListenerConfig) Addr() string {
+	if lc.Type == ListenerTypeUnix {
+		return lc.Path
+	}
+	if len(lc.Bind) > 0 {
+		return strings.Join(lc.Bind, ",")
+	}
+	return net.JoinHostPort(lc.IP, strconv.Itoa(lc.Port))
+}
+
+// RDNSSAddrs returns IPv6 addresses of the listener advertised to LAN clients in router
+// advertisements RDNSS option, if advertise_rdnss is set. Only addresses served on port 53
+// are returned, zones of link-local addresses are kept, so the interface could be determined.
+func (lc *ListenerConfig) RDNSSAddrs() []netip.Addr {
+	if !lc.AdvertiseRDNSS || !lc.IsPlainDNS() {
+		return nil
+	}
+	var addrs []netip.Addr
+	add := func(ip netip.Addr, port int) {
+		if port == 53 && ip.Is6() && !ip.Is4In6() && !ip.IsUnspecified() && !ip.IsLoopback() {
+			addrs = append(addrs, ip)
+		}
+	}
+	if ip, err := netip.ParseAddr(lc.IP); err == nil && len(lc.Bind) == 0 {
+		add(ip, lc.Port)
+	}
+	for _, b := range lc.Bind {
+		if ap, err := netip.ParseAddrPort(b); err == nil {
+			add(ap.Addr(), int(ap.Port()))
+		} else if ip, err := netip.ParseAddr(b); err == nil {
+			add(ip, lc.Port)
+		}
+	}
+	return addrs
+}
+
+// IsTrustedProxy reports whether connections from ip send PROXY protocol headers.
+func (lc *ListenerConfig) IsTrustedProxy(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range lc.trustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsClient reports whether queries from ip are answered by the listener, according to its
+// allow and deny lists. Denied addresses take precedence, and all addresses are allowed if
+// the allow list is empty.
+func (lc *ListenerConfig) AllowsClient(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range lc.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(lc.allow) == 0 {
+		return true
+	}
+	for _, p := range lc.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // IsDirectDnsListener reports whether ctrld can be a direct listener on port 53.
@@ -255,9 +566,10 @@ type ListenerConfig struct {
 // there's no other software listening on port 53.
 //
 // If someone listening on port 53, or ctrld could only listen on port 53 for a specific
-// interface, ctrld could only be configured as a DNS forwarder.
+// interface, ctrld could only be configured as a DNS forwarder. Listeners with bind addresses
+// only listen on those addresses, so they are never direct listeners.
 func (lc *ListenerConfig) IsDirectDnsListener() bool {
-	if lc == nil || lc.Port != 53 {
+	if lc == nil || lc.Port != 53 || len(lc.Bind) > 0 {
 		return false
 	}
 	switch lc.IP {
@@ -271,11 +583,78 @@ func (lc *ListenerConfig) IsDirectDnsListener() bool {
 // ListenerPolicyConfig specifies the policy rules for ctrld to filter incoming requests.
 type ListenerPolicyConfig struct {
 	Name                 string   `mapstructure:"name" toml:"name,omitempty"`
+	Clients              []string `mapstructure:"clients" toml:"clients,omitempty" validate:"dive,client_pattern"`
 	Networks             []Rule   `mapstructure:"networks" toml:"networks,omitempty,inline,multiline" validate:"dive,len=1"`
 	Rules                []Rule   `mapstructure:"rules" toml:"rules,omitempty,inline,multiline" validate:"dive,len=1"`
 	Macs                 []Rule   `mapstructure:"macs" toml:"macs,omitempty,inline,multiline" validate:"dive,len=1"`
+	Tags                 []Rule   `mapstructure:"tags" toml:"tags,omitempty,inline,multiline" validate:"dive,len=1"`
 	FailoverRcodes       []string `mapstructure:"failover_rcodes" toml:"failover_rcodes,omitempty" validate:"dive,dnsrcode"`
 	FailoverRcodeNumbers []int    `mapstructure:"-" toml:"-"`
+	StripSvcParams       []string `mapstructure:"strip_svc_params" toml:"strip_svc_params,omitempty" validate:"dive,oneof=alpn ech ipv4hint ipv6hint"`
+	LoadBalance          string   `mapstructure:"load_balance" toml:"load_balance,omitempty" validate:"omitempty,oneof=ordered latency race"`
+	RaceUpstreams        int      `mapstructure:"race_upstreams" toml:"race_upstreams,omitempty" validate:"gte=0"`
+	RaceCacheMissOnly    bool     `mapstructure:"race_cache_miss_only" toml:"race_cache_miss_only,omitempty"`
+
+	ruleIndex *RuleIndex
+}
+
+// RuleIndex returns the index of policy rules, or nil if the policy was not initialized.
+func (p *ListenerPolicyConfig) RuleIndex() *RuleIndex {
+	return p.ruleIndex
+}
+
+// UpstreamGroupConfig specifies a named group of upstreams. Queries sent to the group go to
+// its upstreams using the group strategy, by default split using weighted round-robin.
+type UpstreamGroupConfig struct {
+	Upstreams []string `mapstructure:"upstreams" toml:"upstreams,omitempty" validate:"min=1,dive,startswith=upstream."`
+	Strategy  string   `mapstructure:"strategy" toml:"strategy,omitempty" validate:"omitempty,oneof=weighted ordered latency race"`
+	Weights   []int    `mapstructure:"weights" toml:"weights,omitempty" validate:"dive,gte=0"`
+}
+
+// ClientConfig specifies static config of a client, identified by its MAC or IP address.
+type ClientConfig struct {
+	Name string `mapstructure:"name" toml:"name,omitempty" validate:"required"`
+	Tag  string `mapstructure:"tag" toml:"tag,omitempty"`
+}
+
+// DHCPServerConfig specifies config of the built-in DHCPv4 server for a network interface.
+type DHCPServerConfig struct {
+	Interface    string                   `mapstructure:"interface" toml:"interface" validate:"required"`
+	RangeStart   string                   `mapstructure:"range_start" toml:"range_start" validate:"required,ipv4"`
+	RangeEnd     string                   `mapstructure:"range_end" toml:"range_end" validate:"required,ipv4"`
+	Router       string                   `mapstructure:"router" toml:"router,omitempty" validate:"omitempty,ipv4"`
+	DNS          []string                 `mapstructure:"dns" toml:"dns,omitempty" validate:"dive,ipv4"`
+	Domain       string                   `mapstructure:"domain" toml:"domain,omitempty"`
+	LeaseTime    int                      `mapstructure:"lease_time" toml:"lease_time,omitempty" validate:"gte=0"`
+	LeaseFile    string                   `mapstructure:"lease_file" toml:"lease_file,omitempty"`
+	Reservations []*DHCPReservationConfig `mapstructure:"reservations" toml:"reservations,omitempty" validate:"dive"`
+}
+
+// DHCPReservationConfig specifies a static lease of the built-in DHCPv4 server.
+type DHCPReservationConfig struct {
+	Mac string `mapstructure:"mac" toml:"mac" validate:"required,mac"`
+	IP  string `mapstructure:"ip" toml:"ip" validate:"required,ipv4"`
+}
+
+// CacheRuleConfig specifies cache options for queries of Domains, which are matched exactly
+// or with a wildcard like policy rules. Zero values fall back to the options of ServiceConfig.
+// If NoCache is set, queries are always forwarded to upstreams, and their answers never cached.
+type CacheRuleConfig struct {
+	Domains []string `mapstructure:"domains" toml:"domains" validate:"min=1"`
+	NoCache bool     `mapstructure:"no_cache" toml:"no_cache,omitempty"`
+	MinTTL  int      `mapstructure:"min_ttl" toml:"min_ttl,omitempty" validate:"gte=0"`
+	MaxTTL  int      `mapstructure:"max_ttl" toml:"max_ttl,omitempty" validate:"gte=0"`
+}
+
+// ScheduleConfig specifies a weekly time window, in the timezone of ServiceConfig, during which
+// policy rules for Rules domains are active. Outside of the window, queries skip these rules and
+// are matched against the following ones. Days are the days the window starts, every day if empty.
+// A window with End before Start spans midnight, without Start and End, it spans whole days.
+type ScheduleConfig struct {
+	Days  []string `mapstructure:"days" toml:"days,omitempty" validate:"dive,oneof=mon tue wed thu fri sat sun"`
+	Start string   `mapstructure:"start" toml:"start,omitempty" validate:"required_with=End,omitempty,schedule_time"`
+	End   string   `mapstructure:"end" toml:"end,omitempty" validate:"required_with=Start,omitempty,schedule_time"`
+	Rules []string `mapstructure:"rules" toml:"rules" validate:"min=1"`
 }
 
 // Rule is a map from source to list of upstreams.
@@ -286,10 +665,30 @@ type Rule map[string][]string
 // Init initialized necessary values for an UpstreamConfig.
 func (uc *UpstreamConfig) Init() {
 	uc.uid = upstreamUID()
+	if uc.Tor && uc.Proxy == "" {
+		uc.Proxy = defaultTorProxy
+	}
+	if uc.BearerTokenFile != "" {
+		uc.loadBearerToken()
+	}
+	if uc.ClientCert != "" && uc.ClientKey != "" {
+		uc.clientCert = newClientCertReloader(uc.ClientCert, uc.ClientKey)
+	}
+	if uc.ECHConfig != "" {
+		uc.loadECHConfig()
+	}
+	if uc.Type == ResolverTypeDNSCrypt {
+		uc.initDNSCrypt()
+		return
+	}
+	if uc.Type == ResolverTypeUnix || uc.Type == ResolverTypeMDNS {
+		// Endpoint is a socket path or an interface name, there is no domain to bootstrap.
+		return
+	}
 	if u, err := url.Parse(uc.Endpoint); err == nil {
 		uc.Domain = u.Host
 		switch uc.Type {
-		case ResolverTypeDOH, ResolverTypeDOH3:
+		case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeDOHJSON:
 			uc.u = u
 		}
 	}
@@ -305,7 +704,7 @@ func (uc *UpstreamConfig) Init() {
 		}
 	}
 	if uc.IPStack == "" {
-		if uc.isControlD() {
+		if uc.IsControlD() {
 			uc.IPStack = IpStackSplit
 		} else {
 			uc.IPStack = IpStackBoth
@@ -343,7 +742,7 @@ func (uc *UpstreamConfig) UpstreamSendClientInfo() bool {
 	}
 	switch uc.Type {
 	case ResolverTypeDOH, ResolverTypeDOH3:
-		if uc.isControlD() || uc.isNextDNS() {
+		if uc.IsControlD() || uc.isNextDNS() {
 			return true
 		}
 	}
@@ -390,9 +789,13 @@ func (uc *UpstreamConfig) UID() string {
 // The first usable IP will be used as bootstrap IP of the upstream.
 func (uc *UpstreamConfig) setupBootstrapIP(withBootstrapDNS bool) {
 	b := backoff.NewBackoff("setupBootstrapIP", func(format string, args ...any) {}, 10*time.Second)
-	isControlD := uc.isControlD()
+	isControlD := uc.IsControlD()
 	for {
-		uc.bootstrapIPs = lookupIP(uc.Domain, uc.Timeout, withBootstrapDNS)
+		if len(uc.BootstrapResolvers) > 0 {
+			uc.bootstrapIPs = lookupIPWithResolver(uc.Domain, uc.Timeout, &bootstrapResolver{uc: uc})
+		} else {
+			uc.bootstrapIPs = lookupIP(uc.Domain, uc.Timeout, withBootstrapDNS)
+		}
 		// For ControlD upstream, the bootstrap IPs could not be RFC 1918 addresses,
 		// filtering them out here to prevent weird behavior.
 		if isControlD {
@@ -425,7 +828,7 @@ func (uc *UpstreamConfig) setupBootstrapIP(withBootstrapDNS bool) {
 // ReBootstrap re-setup the bootstrap IP and the transport.
 func (uc *UpstreamConfig) ReBootstrap() {
 	switch uc.Type {
-	case ResolverTypeDOH, ResolverTypeDOH3:
+	case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeDOHJSON:
 	default:
 		return
 	}
@@ -438,13 +841,15 @@ func (uc *UpstreamConfig) ReBootstrap() {
 }
 
 // SetupTransport initializes the network transport used to connect to upstream server.
-// For now, only DoH upstream is supported.
+// For now, only DoH upstream is supported. Both HTTP/2 and HTTP/3 transports are set up,
+// see dohRacer for more details.
 func (uc *UpstreamConfig) SetupTransport() {
 	switch uc.Type {
-	case ResolverTypeDOH:
+	case ResolverTypeDOH, ResolverTypeDOH3:
 		uc.setupDOHTransport()
-	case ResolverTypeDOH3:
 		uc.setupDOH3Transport()
+	case ResolverTypeDOHJSON:
+		uc.setupDOHTransport()
 	}
 }
 
@@ -473,14 +878,27 @@ func (uc *UpstreamConfig) newDOHTransport(addrs []string) *http.Transport {
 	transport.TLSClientConfig = &tls.Config{
 		RootCAs:            uc.certPool,
 		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		Time:               Now,
 	}
+	uc.setupTLSConfig(transport.TLSClientConfig)
 
 	dialerTimeoutMs := 2000
 	if uc.Timeout > 0 && uc.Timeout < dialerTimeoutMs {
 		dialerTimeoutMs = uc.Timeout
 	}
 	dialerTimeout := time.Duration(dialerTimeoutMs) * time.Millisecond
+	if uc.Proxy != "" {
+		// Connections are tunneled through the upstream proxy by DialContext below.
+		transport.Proxy = nil
+	}
 	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if uc.Proxy != "" {
+			pd, err := uc.proxyContextDialer()
+			if err != nil {
+				return nil, err
+			}
+			return uc.dialProxy(ctx, pd, addr)
+		}
 		_, port, _ := net.SplitHostPort(addr)
 		if uc.BootstrapIP != "" {
 			dialer := net.Dialer{Timeout: dialerTimeout, KeepAlive: dialerTimeout}
@@ -511,7 +929,7 @@ func (uc *UpstreamConfig) newDOHTransport(addrs []string) *http.Transport {
 // Ping warms up the connection to DoH/DoH3 upstream.
 func (uc *UpstreamConfig) Ping() {
 	switch uc.Type {
-	case ResolverTypeDOH, ResolverTypeDOH3:
+	case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeDOHJSON:
 	default:
 		return
 	}
@@ -523,6 +941,7 @@ func (uc *UpstreamConfig) Ping() {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
 		req, _ := http.NewRequestWithContext(ctx, "HEAD", uc.Endpoint, nil)
+		uc.addCustomHeaders(req.Header)
 		resp, _ := t.RoundTrip(req)
 		if resp == nil {
 			return
@@ -533,7 +952,7 @@ func (uc *UpstreamConfig) Ping() {
 
 	for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
 		switch uc.Type {
-		case ResolverTypeDOH:
+		case ResolverTypeDOH, ResolverTypeDOHJSON:
 			ping(uc.dohTransport(typ))
 		case ResolverTypeDOH3:
 			ping(uc.doh3Transport(typ))
@@ -541,7 +960,17 @@ func (uc *UpstreamConfig) Ping() {
 	}
 }
 
-func (uc *UpstreamConfig) isControlD() bool {
+// IsPlainDNS reports whether the upstream is resolved using plain, unencrypted DNS.
+func (uc *UpstreamConfig) IsPlainDNS() bool {
+	switch uc.Type {
+	case ResolverTypeLegacy, ResolverTypeOS:
+		return true
+	}
+	return false
+}
+
+// IsControlD reports whether the upstream is a Control D resolver.
+func (uc *UpstreamConfig) IsControlD() bool {
 	domain := uc.Domain
 	if domain == "" {
 		if u, err := url.Parse(uc.Endpoint); err == nil {
@@ -633,20 +1062,58 @@ func (uc *UpstreamConfig) netForDNSType(dnsType uint16) (string, string) {
 
 // Init initialized necessary values for an ListenerConfig.
 func (lc *ListenerConfig) Init() {
-	if lc.Policy != nil {
-		lc.Policy.FailoverRcodeNumbers = make([]int, len(lc.Policy.FailoverRcodes))
-		for i, rcode := range lc.Policy.FailoverRcodes {
-			lc.Policy.FailoverRcodeNumbers[i] = dnsrcode.FromString(rcode)
+	if lc.Port == 0 {
+		switch lc.Type {
+		case ListenerTypeDOH:
+			lc.Port = 443
+		case ListenerTypeDOT, ListenerTypeDOQ:
+			lc.Port = 853
+		default:
+			if len(lc.Bind) > 0 {
+				lc.Port = 53
+			}
+		}
+	}
+	lc.allow = parsePrefixes(lc.Allow)
+	lc.deny = parsePrefixes(lc.Deny)
+	lc.trustedProxies = parsePrefixes(lc.TrustedProxies)
+	for _, policy := range lc.Policies() {
+		policy.FailoverRcodeNumbers = make([]int, len(policy.FailoverRcodes))
+		for i, rcode := range policy.FailoverRcodes {
+			policy.FailoverRcodeNumbers[i] = dnsrcode.FromString(rcode)
 		}
+		policy.ruleIndex = NewRuleIndex(policy.Rules)
 	}
 }
 
+// parsePrefixes parses the list of CIDRs or IP addresses, skipping invalid ones.
+func parsePrefixes(ss []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		if ip, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+		}
+	}
+	return prefixes
+}
+
 // ValidateConfig validates the given config.
 func ValidateConfig(validate *validator.Validate, cfg *Config) error {
 	_ = validate.RegisterValidation("dnsrcode", validateDnsRcode)
 	_ = validate.RegisterValidation("ipstack", validateIpStack)
 	_ = validate.RegisterValidation("iporempty", validateIpOrEmpty)
+	_ = validate.RegisterValidation("ipportorempty", validateIpPortOrEmpty)
+	_ = validate.RegisterValidation("schedule_time", validateScheduleTime)
+	_ = validate.RegisterValidation("client_pattern", validateClientPattern)
+	_ = validate.RegisterValidation("file_mode", validateFileMode)
 	validate.RegisterStructValidation(upstreamConfigStructLevelValidation, UpstreamConfig{})
+	validate.RegisterStructValidation(listenerConfigStructLevelValidation, ListenerConfig{})
+	validate.RegisterStructValidation(listenerPolicyConfigStructLevelValidation, ListenerPolicyConfig{})
+	validate.RegisterStructValidation(configStructLevelValidation, Config{})
 	return validate.Struct(cfg)
 }
 
@@ -668,12 +1135,316 @@ func validateIpOrEmpty(fl validator.FieldLevel) bool {
 	if val == "" {
 		return true
 	}
-	return net.ParseIP(val) != nil
+	if net.ParseIP(val) != nil {
+		return true
+	}
+	// Link-local IPv6 addresses need a zone, like "fe80::1%br-lan".
+	ip, err := netip.ParseAddr(val)
+	return err == nil && ip.Zone() != "" && ip.IsLinkLocalUnicast()
+}
+
+func validateIpPortOrEmpty(fl validator.FieldLevel) bool {
+	val := fl.Field().String()
+	if val == "" {
+		return true
+	}
+	host, portStr, err := net.SplitHostPort(val)
+	if err != nil {
+		return false
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	return err == nil && port > 0 && port <= 65535
+}
+
+func validateScheduleTime(fl validator.FieldLevel) bool {
+	_, err := parseClock(fl.Field().String())
+	return err == nil
+}
+
+func validateClientPattern(fl validator.FieldLevel) bool {
+	return validClientPattern(fl.Field().String())
+}
+
+// validateFileMode reports whether the field is an octal permission mode, like "0660".
+func validateFileMode(fl validator.FieldLevel) bool {
+	mode, err := strconv.ParseUint(fl.Field().String(), 8, 32)
+	return err == nil && mode <= 0o777
+}
+
+func configStructLevelValidation(sl validator.StructLevel) {
+	cfg := sl.Current().Addr().Interface().(*Config)
+	for _, g := range cfg.UpstreamGroup {
+		if g == nil {
+			continue
+		}
+		for _, upstream := range g.Upstreams {
+			if cfg.Upstream[strings.TrimPrefix(upstream, "upstream.")] == nil {
+				sl.ReportError(upstream, "upstreams", "Upstreams", "upstream_exists", "")
+				return
+			}
+		}
+		// Weights are optional, but if set, there must be one per upstream, and traffic to send.
+		if len(g.Weights) > 0 && (len(g.Weights) != len(g.Upstreams) || !slices.ContainsFunc(g.Weights, func(w int) bool { return w > 0 })) {
+			sl.ReportError(g.Weights, "weights", "Weights", "upstream_weights", "")
+			return
+		}
+		if len(g.Weights) > 0 && g.Strategy != "" && g.Strategy != UpstreamGroupStrategyWeighted {
+			sl.ReportError(g.Weights, "weights", "Weights", "weights_strategy", "")
+			return
+		}
+	}
+	// Fail open upstream is used when encrypted upstreams are down, so it must be a plain DNS one.
+	if name := cfg.Service.FailOpenUpstream; name != "" {
+		uc := cfg.Upstream[strings.TrimPrefix(name, "upstream.")]
+		if uc == nil || !uc.IsPlainDNS() {
+			sl.ReportError(name, "fail_open_upstream", "FailOpenUpstream", "fail_open_upstream", "")
+			return
+		}
+	}
+	// A maximum TTL lower than the minimum one could not be satisfied.
+	if maxTTL := cfg.Service.CacheMaxTTL; maxTTL > 0 && maxTTL < cfg.Service.CacheMinTTL {
+		sl.ReportError(maxTTL, "cache_max_ttl", "CacheMaxTTL", "cache_ttl_range", "")
+		return
+	}
+	for _, rule := range cfg.CacheRule {
+		if rule != nil && rule.MaxTTL > 0 && rule.MaxTTL < rule.MinTTL {
+			sl.ReportError(rule.MaxTTL, "max_ttl", "MaxTTL", "cache_ttl_range", "")
+			return
+		}
+	}
+	// DNS-01 challenges are fulfilled by the hook script.
+	if cfg.Service.ACMEChallenge == ACMEChallengeDNS01 && cfg.Service.HookACMEDNS == "" {
+		sl.ReportError(cfg.Service.HookACMEDNS, "hook_acme_dns", "HookACMEDNS", "required", "")
+		return
+	}
+	for _, lc := range cfg.Listener {
+		if lc == nil {
+			continue
+		}
+		if lc.UpstreamGroup != "" && cfg.UpstreamGroup[lc.UpstreamGroup] == nil {
+			sl.ReportError(lc.UpstreamGroup, "upstream_group", "UpstreamGroup", "upstream_group", "")
+			return
+		}
+		// Client policies apply to some clients only, they must be set.
+		for _, policy := range lc.ClientPolicies {
+			if policy != nil && len(policy.Clients) == 0 {
+				sl.ReportError(policy.Clients, "clients", "Clients", "required", "")
+				return
+			}
+		}
+		for _, policy := range lc.Policies() {
+			for _, rules := range [][]Rule{policy.Networks, policy.Macs, policy.Tags, policy.Rules} {
+				for _, rule := range rules {
+					for _, targets := range rule {
+						for _, target := range targets {
+							name, ok := strings.CutPrefix(target, UpstreamGroupPrefix)
+							if ok && cfg.UpstreamGroup[name] == nil {
+								sl.ReportError(target, "upstream_group", "UpstreamGroup", "upstream_group", "")
+								return
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	// Schedules are matched against policy rules as written, a rule which is in no policy
+	// would never be scheduled, likely because of a typo.
+	if len(cfg.Schedule) > 0 {
+		policyRules := make(map[string]bool)
+		for _, lc := range cfg.Listener {
+			if lc == nil {
+				continue
+			}
+			for _, policy := range lc.Policies() {
+				for _, rule := range policy.Rules {
+					for source := range rule {
+						policyRules[source] = true
+					}
+				}
+			}
+		}
+		for _, s := range cfg.Schedule {
+			if s == nil {
+				continue
+			}
+			for _, source := range s.Rules {
+				if !policyRules[source] {
+					sl.ReportError(source, "rules", "Rules", "schedule_rule", "")
+					return
+				}
+			}
+		}
+	}
+}
+
+func listenerConfigStructLevelValidation(sl validator.StructLevel) {
+	lc := sl.Current().Addr().Interface().(*ListenerConfig)
+	// PROXY protocol is only supported by TCP based listeners, and only accepted from trusted proxies.
+	if lc.ProxyProtocol {
+		switch {
+		case lc.Type == ListenerTypeDOQ || lc.Type == ListenerTypeUnix:
+			sl.ReportError(lc.ProxyProtocol, "proxy_protocol", "ProxyProtocol", "proxy_protocol", "")
+			return
+		case len(lc.TrustedProxies) == 0:
+			sl.ReportError(lc.TrustedProxies, "trusted_proxies", "TrustedProxies", "required", "")
+			return
+		}
+	}
+	// Unix socket listeners are served on their path only.
+	if lc.Type == ListenerTypeUnix {
+		if lc.Path == "" {
+			sl.ReportError(lc.Path, "path", "Path", "required", "")
+		}
+		return
+	}
+	// Bind addresses are only supported by plain DNS listeners.
+	if len(lc.Bind) > 0 && !lc.IsPlainDNS() {
+		sl.ReportError(lc.Bind, "bind", "Bind", "bind", "")
+		return
+	}
+	// Transparent mode is only supported by plain DNS listeners.
+	if lc.Transparent && !lc.IsPlainDNS() {
+		sl.ReportError(lc.Transparent, "transparent", "Transparent", "transparent", "")
+		return
+	}
+	// UDP workers are only supported by plain DNS listeners.
+	if lc.UDPWorkers > 1 && !lc.IsPlainDNS() {
+		sl.ReportError(lc.UDPWorkers, "udp_workers", "UDPWorkers", "udp_workers", "")
+		return
+	}
+	// Only IPv6 addresses of plain DNS listeners on port 53 could be advertised.
+	if lc.AdvertiseRDNSS && len(lc.RDNSSAddrs()) == 0 {
+		sl.ReportError(lc.AdvertiseRDNSS, "advertise_rdnss", "AdvertiseRDNSS", "advertise_rdnss", "")
+		return
+	}
+	// Certificates are obtained using ACME for encrypted listeners without tls_cert and tls_key only.
+	if lc.ACMEDomain != "" {
+		if lc.IsPlainDNS() || lc.TLSCert != "" || lc.TLSKey != "" {
+			sl.ReportError(lc.ACMEDomain, "acme_domain", "ACMEDomain", "acme_domain", "")
+		}
+		return
+	}
+	// Encrypted listeners need a certificate to serve.
+	if lc.IsPlainDNS() {
+		return
+	}
+	if lc.TLSCert == "" {
+		sl.ReportError(lc.TLSCert, "tls_cert", "TLSCert", "required", "")
+	}
+	if lc.TLSKey == "" {
+		sl.ReportError(lc.TLSKey, "tls_key", "TLSKey", "required", "")
+	}
+}
+
+func listenerPolicyConfigStructLevelValidation(sl validator.StructLevel) {
+	policy := sl.Current().Addr().Interface().(*ListenerPolicyConfig)
+	// Regex rules must compile, and their number and complexity are limited, since they are
+	// evaluated against queries one by one.
+	n := 0
+	for _, rule := range policy.Rules {
+		for source := range rule {
+			expr, ok := strings.CutPrefix(source, RegexRulePrefix)
+			if !ok {
+				continue
+			}
+			if n++; n > MaxRegexRules {
+				sl.ReportError(n, "rules", "Rules", "regex_rules", "")
+				return
+			}
+			if _, err := compileRegexRule(expr); err != nil {
+				sl.ReportError(source, "rules", "Rules", "regex_rule", err.Error())
+				return
+			}
+		}
+	}
 }
 
 func upstreamConfigStructLevelValidation(sl validator.StructLevel) {
 	uc := sl.Current().Addr().Interface().(*UpstreamConfig)
-	if uc.Type == ResolverTypeOS {
+	// Relays are only supported by DNSCrypt upstream.
+	if len(uc.Via) > 0 && uc.Type != ResolverTypeDNSCrypt {
+		sl.ReportError(uc.Via, "via", "Via", "dnscrypt_relay", "")
+		return
+	}
+	// Pins only mode without pins would skip verification entirely.
+	if uc.SPKIPinsOnly && len(uc.SPKIPins) == 0 {
+		sl.ReportError(uc.SPKIPins, "spki_pins", "SPKIPins", "required_with", "spki_pins_only")
+		return
+	}
+	proxyURL := uc.Proxy
+	if uc.Tor && proxyURL == "" {
+		proxyURL = defaultTorProxy
+	}
+	// Proxy only carries TCP, so it is only supported by DoH and DoT upstreams. SOCKS5 UDP
+	// associate for DoQ/DoH3 is not implemented.
+	if proxyURL != "" {
+		if _, err := parseProxyURL(proxyURL); err != nil || (uc.Type != ResolverTypeDOH && uc.Type != ResolverTypeDOHJSON && uc.Type != ResolverTypeDOT) {
+			sl.ReportError(uc.Proxy, "proxy", "Proxy", "upstream_proxy", "")
+			return
+		}
+	}
+	// Client certificate and key must be set together.
+	if uc.ClientCert != "" && uc.ClientKey == "" {
+		sl.ReportError(uc.ClientKey, "client_key", "ClientKey", "required_with", "client_cert")
+		return
+	}
+	if uc.ClientKey != "" && uc.ClientCert == "" {
+		sl.ReportError(uc.ClientCert, "client_cert", "ClientCert", "required_with", "client_key")
+		return
+	}
+	// Client certificate is only used by TLS based upstreams.
+	if uc.ClientCert != "" {
+		switch uc.Type {
+		case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeDOHJSON, ResolverTypeDOT, ResolverTypeDOQ:
+		default:
+			sl.ReportError(uc.ClientCert, "client_cert", "ClientCert", "client_cert", "")
+			return
+		}
+	}
+	// Transport protocol is only configurable for legacy upstreams.
+	if uc.IPProtocol != "" && uc.Type != ResolverTypeLegacy {
+		sl.ReportError(uc.IPProtocol, "ip_protocol", "IPProtocol", "ip_protocol", "")
+		return
+	}
+	// tcp_only could not be used with UDP transport.
+	if uc.TCPOnly && uc.IPProtocol == "udp" {
+		sl.ReportError(uc.IPProtocol, "ip_protocol", "IPProtocol", "ip_protocol_tcp_only", "")
+		return
+	}
+	// Server name and ECH config are only used by TLS based upstreams.
+	if uc.TLSServerName != "" || uc.ECHConfig != "" {
+		switch uc.Type {
+		case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeDOHJSON, ResolverTypeDOT, ResolverTypeDOQ:
+		default:
+			if uc.TLSServerName != "" {
+				sl.ReportError(uc.TLSServerName, "tls_server_name", "TLSServerName", "tls_option", "")
+			} else {
+				sl.ReportError(uc.ECHConfig, "ech_config", "ECHConfig", "tls_option", "")
+			}
+			return
+		}
+	}
+	// HTTP method is only used by HTTP based upstreams.
+	if uc.DoHMethod != "" && uc.Type != ResolverTypeDOH && uc.Type != ResolverTypeDOH3 {
+		sl.ReportError(uc.DoHMethod, "doh_method", "DoHMethod", "doh_method", "")
+		return
+	}
+	// Custom headers are only sent by HTTP based upstreams.
+	if (len(uc.Headers) > 0 || uc.BearerTokenFile != "") && uc.Type != ResolverTypeDOH && uc.Type != ResolverTypeDOH3 && uc.Type != ResolverTypeDOHJSON {
+		sl.ReportError(uc.Headers, "headers", "Headers", "doh_headers", "")
+		return
+	}
+	// Onion services could only be resolved and reached through Tor.
+	if proxyURL == "" && isOnionDomain(uc.endpointHost()) {
+		sl.ReportError(uc.Endpoint, "endpoint", "Endpoint", "onion_proxy", "")
+		return
+	}
+	// Endpoint of mdns resolver is the optional interface name.
+	if uc.Type == ResolverTypeOS || uc.Type == ResolverTypeMDNS {
 		return
 	}
 
@@ -683,8 +1454,31 @@ func upstreamConfigStructLevelValidation(sl validator.StructLevel) {
 		return
 	}
 
-	// DoH/DoH3 requires endpoint is an HTTP url.
-	if uc.Type == ResolverTypeDOH || uc.Type == ResolverTypeDOH3 {
+	// Unix requires endpoint is an absolute socket path.
+	if uc.Type == ResolverTypeUnix {
+		if !filepath.IsAbs(uc.Endpoint) {
+			sl.ReportError(uc.Endpoint, "endpoint", "Endpoint", "unix_socket", "")
+		}
+		return
+	}
+
+	// DNSCrypt requires endpoint is a DNSCrypt stamp.
+	if uc.Type == ResolverTypeDNSCrypt {
+		if _, err := parseDNSCryptStamp(uc.Endpoint); err != nil {
+			sl.ReportError(uc.Endpoint, "endpoint", "Endpoint", "dnscrypt_stamp", "")
+			return
+		}
+		for _, relay := range uc.Via {
+			if _, err := parseDNSCryptRelayStamp(relay); err != nil {
+				sl.ReportError(uc.Via, "via", "Via", "dnscrypt_relay", "")
+				return
+			}
+		}
+		return
+	}
+
+	// DoH/DoH3/DoH JSON requires endpoint is an HTTP url.
+	if uc.Type == ResolverTypeDOH || uc.Type == ResolverTypeDOH3 || uc.Type == ResolverTypeDOHJSON {
 		u, err := url.Parse(uc.Endpoint)
 		if err != nil || u.Host == "" {
 			sl.ReportError(uc.Endpoint, "endpoint", "Endpoint", "http_url", "")
@@ -699,10 +1493,12 @@ func upstreamConfigStructLevelValidation(sl validator.StructLevel) {
 
 func defaultPortFor(typ string) string {
 	switch typ {
-	case ResolverTypeDOH, ResolverTypeDOH3:
+	case ResolverTypeDOH, ResolverTypeDOH3, ResolverTypeDOHJSON:
 		return "443"
 	case ResolverTypeDOQ, ResolverTypeDOT:
 		return "853"
+	case ResolverTypeDNSCrypt:
+		return dnscryptDefaultPort
 	case ResolverTypeLegacy:
 		return "53"
 	}
@@ -715,6 +1511,7 @@ func defaultPortFor(typ string) string {
 // - If endpoint is an IP address ->  ResolverTypeLegacy
 // - If endpoint starts with "https://" -> ResolverTypeDOH
 // - If endpoint starts with "quic://" -> ResolverTypeDOQ
+// - If endpoint starts with "sdns://" -> ResolverTypeDNSCrypt
 // - For anything else -> ResolverTypeDOT
 func ResolverTypeFromEndpoint(endpoint string) string {
 	switch {
@@ -722,6 +1519,8 @@ func ResolverTypeFromEndpoint(endpoint string) string {
 		return ResolverTypeDOH
 	case strings.HasPrefix(endpoint, "quic://"):
 		return ResolverTypeDOQ
+	case strings.HasPrefix(endpoint, dnsStampScheme):
+		return ResolverTypeDNSCrypt
 	}
 	host := endpoint
 	if strings.Contains(endpoint, ":") {
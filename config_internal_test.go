@@ -1,6 +1,7 @@
 package ctrld
 
 import (
+	"net/netip"
 	"net/url"
 	"testing"
 
@@ -337,3 +338,55 @@ func TestUpstreamConfig_IsDiscoverable(t *testing.T) {
 func ptrBool(b bool) *bool {
 	return &b
 }
+
+func TestListenerConfig_AllowsClient(t *testing.T) {
+	lc := &ListenerConfig{
+		Allow: []string{"192.168.1.0/24", "10.0.0.1", "fd00::/8"},
+		Deny:  []string{"192.168.1.100"},
+	}
+	lc.Init()
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.168.1.1", true},
+		{"192.168.1.100", false},
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"::ffff:192.168.1.1", true},
+		{"fd00::1", true},
+		{"8.8.8.8", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.ip, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.allowed, lc.AllowsClient(netip.MustParseAddr(tc.ip)))
+		})
+	}
+
+	denyOnly := &ListenerConfig{Deny: []string{"0.0.0.0/0"}}
+	denyOnly.Init()
+	assert.False(t, denyOnly.AllowsClient(netip.MustParseAddr("192.168.1.1")))
+	assert.True(t, denyOnly.AllowsClient(netip.MustParseAddr("fd00::1")))
+}
+
+func TestListenerConfig_RDNSSAddrs(t *testing.T) {
+	tests := []struct {
+		name string
+		lc   *ListenerConfig
+		want []netip.Addr
+	}{
+		{"disabled", &ListenerConfig{IP: "fd00::1", Port: 53}, nil},
+		{"ip", &ListenerConfig{IP: "fe80::1%br-lan", Port: 53, AdvertiseRDNSS: true}, []netip.Addr{netip.MustParseAddr("fe80::1%br-lan")}},
+		{"unspecified", &ListenerConfig{IP: "::", Port: 53, AdvertiseRDNSS: true}, nil},
+		{"bind", &ListenerConfig{Bind: []string{"192.168.1.1", "fd00::1", "[fd00::2]:5354", "br-lan"}, Port: 53, AdvertiseRDNSS: true}, []netip.Addr{netip.MustParseAddr("fd00::1")}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, tc.lc.RDNSSAddrs())
+		})
+	}
+}
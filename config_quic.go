@@ -35,7 +35,9 @@ func (uc *UpstreamConfig) setupDOH3Transport() {
 
 func (uc *UpstreamConfig) newDOH3Transport(addrs []string) http.RoundTripper {
 	rt := &http3.RoundTripper{}
-	rt.TLSClientConfig = &tls.Config{RootCAs: uc.certPool}
+	// Resuming sessions makes re-dialing after network changes faster, see ResetConns.
+	rt.TLSClientConfig = &tls.Config{RootCAs: uc.certPool, Time: Now, ClientSessionCache: doh3SessionCache}
+	uc.setupTLSConfig(rt.TLSClientConfig)
 	rt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
 		_, port, _ := net.SplitHostPort(addr)
 		// if we have a bootstrap ip set, use it to avoid DNS lookup
@@ -70,7 +72,22 @@ func (uc *UpstreamConfig) newDOH3Transport(addrs []string) http.RoundTripper {
 	return rt
 }
 
+// resetDOH3Conns closes all QUIC connections of the DoH3 transports. The transports re-dial on
+// next requests.
+func (uc *UpstreamConfig) resetDOH3Conns() {
+	for _, rt := range []http.RoundTripper{uc.http3RoundTripper, uc.http3RoundTripper4, uc.http3RoundTripper6} {
+		if rt, ok := rt.(*http3.RoundTripper); ok {
+			_ = rt.Close()
+		}
+	}
+}
+
+// doh3Transport returns the DoH3 transport for the given DNS type, or nil if the upstream uses
+// a proxy, which QUIC connections would bypass.
 func (uc *UpstreamConfig) doh3Transport(dnsType uint16) http.RoundTripper {
+	if uc.Proxy != "" {
+		return nil
+	}
 	uc.transportOnce.Do(func() {
 		uc.SetupTransport()
 	})
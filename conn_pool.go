@@ -0,0 +1,72 @@
+package ctrld
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// warmUpTimeout is the timeout of queries opening connections to upstreams.
+const warmUpTimeout = 2 * time.Second
+
+// hasConnPool reports whether queries to the upstream are sent over pooled connections.
+func (uc *UpstreamConfig) hasConnPool() bool {
+	switch uc.Type {
+	case ResolverTypeDOT, ResolverTypeDOQ:
+		return true
+	case ResolverTypeLegacy:
+		return uc.IPProtocol == "tcp"
+	}
+	return false
+}
+
+// maxConns returns the maximum number of pooled connections to the upstream.
+func (uc *UpstreamConfig) maxConns() int {
+	if uc.MaxConns > 0 {
+		return uc.MaxConns
+	}
+	return 1
+}
+
+// idleTimeout returns the time a pooled connection to the upstream is kept open without queries.
+func (uc *UpstreamConfig) idleTimeout() time.Duration {
+	if uc.IdleTimeout > 0 {
+		return time.Duration(uc.IdleTimeout) * time.Second
+	}
+	return tcpIdleTimeout
+}
+
+// ResetConns closes all connections to the upstream, e.g: after the network changed. Queries in
+// flight are sent again over new connections right away, instead of waiting for their timeout
+// on connections established on a network which is gone. New QUIC connections resume TLS sessions,
+// so they do not need a full handshake.
+func (uc *UpstreamConfig) ResetConns() {
+	uc.resetTCPConns()
+	uc.resetDoQConns()
+	uc.resetDOH3Conns()
+}
+
+// WarmUpConns opens pooled connections to the upstream if Prewarm is set, so the first queries
+// do not wait for the TCP, TLS or QUIC handshake.
+func (uc *UpstreamConfig) WarmUpConns() {
+	if !uc.Prewarm || !uc.hasConnPool() {
+		return
+	}
+	r, err := NewResolver(uc)
+	if err != nil {
+		ProxyLogger.Load().Debug().Err(err).Msgf("could not warm up connections to %s", uc.Name)
+		return
+	}
+	// Connections are dialed per IP version, depending on the query type.
+	for _, typ := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(".", typ)
+		ctx, cancel := context.WithTimeout(context.Background(), warmUpTimeout)
+		_, err := r.Resolve(ctx, msg)
+		cancel()
+		if err != nil {
+			ProxyLogger.Load().Debug().Err(err).Msgf("could not warm up connections to %s", uc.Name)
+		}
+	}
+}
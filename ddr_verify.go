@@ -0,0 +1,117 @@
+package ctrld
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/quic-go/quic-go"
+)
+
+// verifyDesignatedResolver verifies the encrypted endpoint ep designated by the resolver at ip,
+// by connecting to the endpoint and validating its certificate, see RFC 9462 section 4.2.
+//
+// The certificate must be valid for the endpoint domain, and contain the resolver ip in its
+// subjectAltName. If the resolver ip is private, the endpoint could not be verified that way,
+// so the opportunistic discovery is used instead: the endpoint must use the same ip as the
+// resolver, and the resolver ip is not required in the certificate, see RFC 9462 section 4.3.
+func verifyDesignatedResolver(ctx context.Context, ep ResolverEndpoint, ip string, roots *x509.CertPool) error {
+	resolverIP := net.ParseIP(ip)
+	opportunistic := isOpportunisticResolverIP(resolverIP)
+	if opportunistic {
+		for _, epIP := range ep.IPs {
+			if !net.ParseIP(epIP).Equal(resolverIP) {
+				return fmt.Errorf("designated resolver ip %s is not the same as private resolver ip %s", epIP, ip)
+			}
+		}
+	}
+	port, err := designatedResolverPort(ep)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		ServerName: ep.Domain,
+		RootCAs:    roots,
+		NextProtos: designatedResolverAlpn(ep.Type),
+		Time:       Now,
+	}
+	state, err := designatedResolverTLSState(ctx, ep.Type, net.JoinHostPort(ep.IPs[0], port), tlsConfig)
+	if err != nil {
+		return err
+	}
+	if opportunistic {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no peer certificates")
+	}
+	for _, certIP := range state.PeerCertificates[0].IPAddresses {
+		if certIP.Equal(resolverIP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate of %s does not contain resolver ip %s", ep.Domain, ip)
+}
+
+// designatedResolverTLSState performs TLS handshake with the endpoint at addr, returning the
+// connection state. QUIC is used for DoH3 and DoQ endpoints, TCP otherwise.
+func designatedResolverTLSState(ctx context.Context, typ, addr string, tlsConfig *tls.Config) (tls.ConnectionState, error) {
+	switch typ {
+	case ResolverTypeDOH3, ResolverTypeDOQ:
+		conn, err := quic.DialAddr(ctx, addr, tlsConfig, nil)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+		return conn.ConnectionState().TLS, nil
+	}
+	d := &tls.Dialer{Config: tlsConfig}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.(*tls.Conn).ConnectionState(), nil
+}
+
+// designatedResolverPort returns the port of endpoint ep.
+func designatedResolverPort(ep ResolverEndpoint) (string, error) {
+	switch ep.Type {
+	case ResolverTypeDOH, ResolverTypeDOH3:
+		u, err := url.Parse(ep.Endpoint)
+		if err != nil {
+			return "", err
+		}
+		if port := u.Port(); port != "" {
+			return port, nil
+		}
+		return defaultPortFor(ep.Type), nil
+	}
+	_, port, err := net.SplitHostPort(ep.Endpoint)
+	return port, err
+}
+
+// designatedResolverAlpn returns the ALPN protocol ids of given resolver type.
+func designatedResolverAlpn(typ string) []string {
+	switch typ {
+	case ResolverTypeDOH:
+		return []string{"h2", "http/1.1"}
+	case ResolverTypeDOH3:
+		return []string{"h3"}
+	case ResolverTypeDOT:
+		return []string{"dot"}
+	case ResolverTypeDOQ:
+		return []string{"doq"}
+	}
+	return nil
+}
+
+// isOpportunisticResolverIP reports whether the designated resolvers of resolver ip
+// could only be discovered opportunistically, because ip is not globally routable.
+func isOpportunisticResolverIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
@@ -0,0 +1,124 @@
+package ctrld
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestDesignatedResolver starts a TLS server for dns.example.net, whose certificate contains
+// given IPs, returning its port and the pool trusting its certificate.
+func newTestDesignatedResolver(t *testing.T, ips ...string) (string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"dns.example.net"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	for _, ip := range ips {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(ip))
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"dot"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port, pool
+}
+
+func Test_verifyDesignatedResolver(t *testing.T) {
+	tests := []struct {
+		name       string
+		resolverIP string
+		certIPs    []string
+		epIP       string
+		wantErr    bool
+	}{
+		{"verified", "192.0.2.53", []string{"192.0.2.53"}, "127.0.0.1", false},
+		{"resolver ip not in certificate", "192.0.2.53", []string{"198.51.100.53"}, "127.0.0.1", true},
+		{"opportunistic", "127.0.0.1", nil, "127.0.0.1", false},
+		{"opportunistic different ip", "192.168.1.1", nil, "127.0.0.1", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			port, pool := newTestDesignatedResolver(t, tc.certIPs...)
+			ep := ResolverEndpoint{
+				Priority: 1,
+				Type:     ResolverTypeDOT,
+				Endpoint: net.JoinHostPort("dns.example.net", port),
+				Domain:   "dns.example.net",
+				IPs:      []string{tc.epIP},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := verifyDesignatedResolver(ctx, ep, tc.resolverIP, pool)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_designatedResolverPort(t *testing.T) {
+	tests := []struct {
+		ep   ResolverEndpoint
+		want string
+	}{
+		{ResolverEndpoint{Type: ResolverTypeDOH, Endpoint: "https://dns.example.net/dns-query"}, "443"},
+		{ResolverEndpoint{Type: ResolverTypeDOH3, Endpoint: "https://dns.example.net:8443/dns-query"}, "8443"},
+		{ResolverEndpoint{Type: ResolverTypeDOT, Endpoint: "dns.example.net:853"}, "853"},
+	}
+	for _, tc := range tests {
+		got, err := designatedResolverPort(tc.ep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("unexpected port for %s, want: %s, got: %s", tc.ep.Endpoint, tc.want, got)
+		}
+	}
+}
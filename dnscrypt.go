@@ -0,0 +1,637 @@
+package ctrld
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/poly1305"
+)
+
+// DNSCrypt v2 protocol, see: https://dnscrypt.info/protocol
+const (
+	dnsStampScheme            = "sdns://"
+	dnsStampTypeDNSCrypt      = 0x01
+	dnsStampTypeDNSCryptRelay = 0x81
+
+	// Encryption systems of DNSCrypt certificates.
+	dnscryptESXSalsa20Poly1305  = 0x0001
+	dnscryptESXChacha20Poly1305 = 0x0002
+
+	dnscryptCertMinLen   = 124
+	dnscryptNonceSize    = 24
+	dnscryptHalfNonce    = dnscryptNonceSize / 2
+	dnscryptTagSize      = poly1305.TagSize
+	dnscryptQueryHdrLen  = 8 + 32 + dnscryptHalfNonce
+	dnscryptReplyHdrLen  = 8 + dnscryptNonceSize
+	dnscryptDefaultPort  = "443"
+	dnscryptPadBlockSize = 64
+	// dnscryptMinUDPQuerySize is the minimum size of UDP queries. Resolvers must not send
+	// UDP responses larger than the query, so queries are padded generously to avoid
+	// falling back to TCP for common responses.
+	dnscryptMinUDPQuerySize = 512
+	dnscryptMaxMsgSize      = dns.MaxMsgSize
+	// dnscryptCertRefreshInterval is how often certificates are re-fetched, so rotated
+	// certificates are picked up before the current one expires.
+	dnscryptCertRefreshInterval = time.Hour
+)
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+	// dnscryptAnonMagic prefixes queries sent to anonymized DNSCrypt relays,
+	// see: https://github.com/DNSCrypt/dnscrypt-protocol/blob/master/ANONYMIZED-DNSCRYPT.txt
+	dnscryptAnonMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+)
+
+var errInvalidDNSStamp = errors.New("invalid DNS stamp")
+
+// dnsStamp is a parsed DNSCrypt server stamp, see: https://dnscrypt.info/stamps-specifications
+type dnsStamp struct {
+	// serverAddr is the resolver address, in form "ip:port".
+	serverAddr   string
+	providerPk   ed25519.PublicKey
+	providerName string
+}
+
+// parseDNSCryptStamp parses s as a DNSCrypt server stamp "sdns://...".
+func parseDNSCryptStamp(s string) (*dnsStamp, error) {
+	bin, err := decodeDNSStamp(s)
+	if err != nil {
+		return nil, err
+	}
+	if bin[0] != dnsStampTypeDNSCrypt {
+		return nil, fmt.Errorf("%w: not a DNSCrypt stamp", errInvalidDNSStamp)
+	}
+	// Skip stamp type and 8 bytes properties.
+	r := &stampReader{b: bin, pos: 9}
+	addr, err := r.lp()
+	if err != nil {
+		return nil, err
+	}
+	pk, err := r.lp()
+	if err != nil {
+		return nil, err
+	}
+	if len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid provider public key", errInvalidDNSStamp)
+	}
+	providerName, err := r.lp()
+	if err != nil {
+		return nil, err
+	}
+	if len(providerName) == 0 {
+		return nil, fmt.Errorf("%w: missing provider name", errInvalidDNSStamp)
+	}
+	serverAddr, err := stampServerAddr(string(addr))
+	if err != nil {
+		return nil, err
+	}
+	return &dnsStamp{
+		serverAddr:   serverAddr,
+		providerPk:   ed25519.PublicKey(pk),
+		providerName: dns.Fqdn(string(providerName)),
+	}, nil
+}
+
+// parseDNSCryptRelayStamp parses s as an anonymized DNSCrypt relay stamp, returning
+// the relay address in form "ip:port".
+func parseDNSCryptRelayStamp(s string) (string, error) {
+	bin, err := decodeDNSStamp(s)
+	if err != nil {
+		return "", err
+	}
+	if bin[0] != dnsStampTypeDNSCryptRelay {
+		return "", fmt.Errorf("%w: not a DNSCrypt relay stamp", errInvalidDNSStamp)
+	}
+	r := &stampReader{b: bin, pos: 1}
+	addr, err := r.lp()
+	if err != nil {
+		return "", err
+	}
+	return stampServerAddr(string(addr))
+}
+
+// decodeDNSStamp returns the binary content of stamp s.
+func decodeDNSStamp(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, dnsStampScheme) {
+		return nil, fmt.Errorf("%w: missing %s prefix", errInvalidDNSStamp, dnsStampScheme)
+	}
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, dnsStampScheme))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDNSStamp, err)
+	}
+	if len(bin) == 0 {
+		return nil, errInvalidDNSStamp
+	}
+	return bin, nil
+}
+
+// stampServerAddr returns the "ip:port" form of stamp address addr, which may omit the port.
+func stampServerAddr(addr string) (string, error) {
+	host, port := addr, dnscryptDefaultPort
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host, port = h, p
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%w: invalid server address: %q", errInvalidDNSStamp, addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("%w: invalid server port: %q", errInvalidDNSStamp, addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// stampReader reads length-prefixed values of a binary stamp.
+type stampReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *stampReader) lp() ([]byte, error) {
+	if r.pos >= len(r.b) {
+		return nil, fmt.Errorf("%w: stamp is too short", errInvalidDNSStamp)
+	}
+	n := int(r.b[r.pos])
+	r.pos++
+	if r.pos+n > len(r.b) {
+		return nil, fmt.Errorf("%w: stamp is too short", errInvalidDNSStamp)
+	}
+	v := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return v, nil
+}
+
+// dnscryptCert is a verified DNSCrypt resolver certificate, with the client key pair used with it.
+type dnscryptCert struct {
+	esVersion   uint16
+	resolverPk  [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+
+	clientPk  [32]byte
+	sharedKey [32]byte
+}
+
+// parseDNSCryptCert parses the binary certificate bin, verifying its signature with providerPk.
+func parseDNSCryptCert(bin []byte, providerPk ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(bin) < dnscryptCertMinLen || !bytes.Equal(bin[:4], dnscryptCertMagic) {
+		return nil, errors.New("invalid certificate")
+	}
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(bin[4:6])}
+	switch cert.esVersion {
+	case dnscryptESXSalsa20Poly1305, dnscryptESXChacha20Poly1305:
+	default:
+		return nil, fmt.Errorf("unsupported encryption system: %d", cert.esVersion)
+	}
+	if !ed25519.Verify(providerPk, bin[72:], bin[8:72]) {
+		return nil, errors.New("invalid certificate signature")
+	}
+	copy(cert.resolverPk[:], bin[72:104])
+	copy(cert.clientMagic[:], bin[104:112])
+	cert.serial = binary.BigEndian.Uint32(bin[112:116])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(bin[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(bin[120:124])), 0)
+	return cert, nil
+}
+
+// valid reports whether the certificate is valid at t.
+func (c *dnscryptCert) valid(t time.Time) bool {
+	return !t.Before(c.notBefore) && t.Before(c.notAfter)
+}
+
+// setupKeys generates a new client key pair, and computes the shared key with resolver.
+func (c *dnscryptCert) setupKeys() error {
+	var sk [32]byte
+	if _, err := io.ReadFull(crand.Reader, sk[:]); err != nil {
+		return err
+	}
+	pk, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	copy(c.clientPk[:], pk)
+	switch c.esVersion {
+	case dnscryptESXSalsa20Poly1305:
+		box.Precompute(&c.sharedKey, &c.resolverPk, &sk)
+	case dnscryptESXChacha20Poly1305:
+		shared, err := curve25519.X25519(sk[:], c.resolverPk[:])
+		if err != nil {
+			return err
+		}
+		key, err := chacha20.HChaCha20(shared, make([]byte, 16))
+		if err != nil {
+			return err
+		}
+		copy(c.sharedKey[:], key)
+	}
+	return nil
+}
+
+// seal encrypts msg using nonce, returning the tag followed by the ciphertext.
+func (c *dnscryptCert) seal(msg []byte, nonce *[dnscryptNonceSize]byte) []byte {
+	if c.esVersion == dnscryptESXSalsa20Poly1305 {
+		return box.SealAfterPrecomputation(nil, msg, nonce, &c.sharedKey)
+	}
+	// XChaCha20Poly1305, using the same construction as secretbox.
+	stream, _ := chacha20.NewUnauthenticatedCipher(c.sharedKey[:], nonce[:])
+	var polyKey [32]byte
+	stream.XORKeyStream(polyKey[:], polyKey[:])
+	out := make([]byte, dnscryptTagSize+len(msg))
+	stream.XORKeyStream(out[dnscryptTagSize:], msg)
+	mac := poly1305.New(&polyKey)
+	_, _ = mac.Write(out[dnscryptTagSize:])
+	mac.Sum(out[:0])
+	return out
+}
+
+// open decrypts and authenticates sealed using nonce.
+func (c *dnscryptCert) open(sealed []byte, nonce *[dnscryptNonceSize]byte) ([]byte, error) {
+	if len(sealed) < dnscryptTagSize {
+		return nil, errors.New("encrypted message is too short")
+	}
+	if c.esVersion == dnscryptESXSalsa20Poly1305 {
+		msg, ok := box.OpenAfterPrecomputation(nil, sealed, nonce, &c.sharedKey)
+		if !ok {
+			return nil, errors.New("could not decrypt message")
+		}
+		return msg, nil
+	}
+	stream, _ := chacha20.NewUnauthenticatedCipher(c.sharedKey[:], nonce[:])
+	var polyKey [32]byte
+	stream.XORKeyStream(polyKey[:], polyKey[:])
+	mac := poly1305.New(&polyKey)
+	_, _ = mac.Write(sealed[dnscryptTagSize:])
+	if subtle.ConstantTimeCompare(mac.Sum(nil), sealed[:dnscryptTagSize]) != 1 {
+		return nil, errors.New("could not decrypt message")
+	}
+	msg := make([]byte, len(sealed)-dnscryptTagSize)
+	stream.XORKeyStream(msg, sealed[dnscryptTagSize:])
+	return msg, nil
+}
+
+// encryptQuery returns the DNSCrypt query packet of packed query q, and the client nonce used.
+func (c *dnscryptCert) encryptQuery(q []byte, minSize int) ([]byte, []byte, error) {
+	var nonce [dnscryptNonceSize]byte
+	if _, err := io.ReadFull(crand.Reader, nonce[:dnscryptHalfNonce]); err != nil {
+		return nil, nil, err
+	}
+	padded := dnscryptPad(q, minSize)
+	packet := make([]byte, 0, dnscryptQueryHdrLen+dnscryptTagSize+len(padded))
+	packet = append(packet, c.clientMagic[:]...)
+	packet = append(packet, c.clientPk[:]...)
+	packet = append(packet, nonce[:dnscryptHalfNonce]...)
+	packet = append(packet, c.seal(padded, &nonce)...)
+	return packet, nonce[:dnscryptHalfNonce], nil
+}
+
+// decryptResponse returns the packed DNS response of DNSCrypt response packet,
+// checking that it answers the query sent with clientNonce.
+func (c *dnscryptCert) decryptResponse(packet, clientNonce []byte) ([]byte, error) {
+	if len(packet) < dnscryptReplyHdrLen+dnscryptTagSize || !bytes.Equal(packet[:8], dnscryptResolverMagic) {
+		return nil, errors.New("invalid DNSCrypt response")
+	}
+	var nonce [dnscryptNonceSize]byte
+	copy(nonce[:], packet[8:dnscryptReplyHdrLen])
+	if !bytes.Equal(nonce[:dnscryptHalfNonce], clientNonce) {
+		return nil, errors.New("unexpected DNSCrypt response nonce")
+	}
+	padded, err := c.open(packet[dnscryptReplyHdrLen:], &nonce)
+	if err != nil {
+		return nil, err
+	}
+	return dnscryptUnpad(padded)
+}
+
+// dnscryptPad pads msg with 0x80 followed by zeros, so its length is a multiple of
+// the padding block size, and at least minLen.
+func dnscryptPad(msg []byte, minLen int) []byte {
+	n := len(msg) + 1
+	if n < minLen {
+		n = minLen
+	}
+	n = (n + dnscryptPadBlockSize - 1) / dnscryptPadBlockSize * dnscryptPadBlockSize
+	padded := make([]byte, n)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+	return padded
+}
+
+// dnscryptUnpad removes padding added by dnscryptPad.
+func dnscryptUnpad(padded []byte) ([]byte, error) {
+	idx := len(padded) - 1
+	for idx >= 0 && padded[idx] == 0 {
+		idx--
+	}
+	if idx == -1 || padded[idx] != 0x80 {
+		return nil, errors.New("invalid padding")
+	}
+	return padded[:idx], nil
+}
+
+// unescapeTxt converts TXT string s from presentation format back to binary, so binary
+// content like DNSCrypt certificates could be parsed.
+func unescapeTxt(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return nil, errors.New("invalid escape sequence")
+		}
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			n := int(s[i]-'0')*100 + int(s[i+1]-'0')*10 + int(s[i+2]-'0')
+			if n > 255 {
+				return nil, errors.New("invalid escape sequence")
+			}
+			b = append(b, byte(n))
+			i += 2
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return b, nil
+}
+
+// dnscryptClient holds the state of a DNSCrypt upstream, shared between queries.
+type dnscryptClient struct {
+	stamp *dnsStamp
+	// relays is the list of anonymized relays addresses, in form "ip:port". If not empty,
+	// all packets are sent via a random relay, so the resolver never sees the client IP.
+	relays []string
+
+	mu        sync.Mutex
+	cert      *dnscryptCert
+	fetchedAt time.Time
+}
+
+// certificate returns the current certificate of resolver, fetching a new one if necessary.
+func (c *dnscryptClient) certificate(ctx context.Context) (*dnscryptCert, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := Now()
+	if c.cert != nil && c.cert.valid(now) && now.Sub(c.fetchedAt) < dnscryptCertRefreshInterval {
+		return c.cert, nil
+	}
+	cert, err := c.fetchCert(ctx, now)
+	if err != nil {
+		// Keep using the current certificate if it's still valid, the resolver may be
+		// temporarily unreachable.
+		if c.cert != nil && c.cert.valid(now) {
+			ProxyLogger.Load().Warn().Err(err).Msgf("could not refresh DNSCrypt certificate of %s", c.stamp.providerName)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert == nil || c.cert.serial != cert.serial {
+		ProxyLogger.Load().Debug().Msgf("using DNSCrypt certificate of %s, serial: %d, valid until: %s", c.stamp.providerName, cert.serial, cert.notAfter)
+	}
+	c.cert = cert
+	c.fetchedAt = now
+	return cert, nil
+}
+
+// invalidate drops the current certificate, forcing a new one to be fetched for next query.
+func (c *dnscryptClient) invalidate(cert *dnscryptCert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert == cert {
+		c.cert = nil
+	}
+}
+
+// fetchCert retrieves certificates of resolver, returning the valid one with the highest serial.
+func (c *dnscryptClient) fetchCert(ctx context.Context, now time.Time) (*dnscryptCert, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(c.stamp.providerName, dns.TypeTXT)
+	msg.RecursionDesired = true
+	answer, err := c.exchangePlain(ctx, msg, "udp")
+	if err == nil && answer.Truncated {
+		answer, err = c.exchangePlain(ctx, msg, "tcp")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch DNSCrypt certificate: %w", err)
+	}
+	var best *dnscryptCert
+	for _, rr := range answer.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		bin, err := unescapeTxt(strings.Join(txt.Txt, ""))
+		if err != nil {
+			continue
+		}
+		cert, err := parseDNSCryptCert(bin, c.stamp.providerPk)
+		if err != nil {
+			ProxyLogger.Load().Debug().Err(err).Msgf("ignoring DNSCrypt certificate of %s", c.stamp.providerName)
+			continue
+		}
+		if !cert.valid(now) {
+			continue
+		}
+		if best == nil || cert.serial > best.serial || (cert.serial == best.serial && cert.esVersion > best.esVersion) {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no valid DNSCrypt certificate for %s", c.stamp.providerName)
+	}
+	if err := best.setupKeys(); err != nil {
+		return nil, err
+	}
+	return best, nil
+}
+
+// initDNSCrypt initializes a DNSCrypt upstream from its stamp and relays. The resolver address
+// in stamp is always an IP address, so it is used as bootstrap IP, and no bootstrapping
+// is needed.
+func (uc *UpstreamConfig) initDNSCrypt() {
+	stamp, err := parseDNSCryptStamp(uc.Endpoint)
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("invalid DNSCrypt upstream: %s", uc.Name)
+		return
+	}
+	relays := make([]string, 0, len(uc.Via))
+	for _, s := range uc.Via {
+		relay, err := parseDNSCryptRelayStamp(s)
+		if err != nil {
+			// Never fall back to sending queries directly, which would reveal the client IP.
+			ProxyLogger.Load().Error().Err(err).Msgf("invalid DNSCrypt relay of upstream: %s", uc.Name)
+			return
+		}
+		relays = append(relays, relay)
+	}
+	uc.dnscrypt = &dnscryptClient{stamp: stamp, relays: relays}
+	uc.Domain = strings.TrimSuffix(stamp.providerName, ".")
+	uc.BootstrapIP, _, _ = net.SplitHostPort(stamp.serverAddr)
+	if uc.IPStack == "" {
+		uc.IPStack = IpStackBoth
+	}
+}
+
+type dnscryptResolver struct {
+	uc *UpstreamConfig
+}
+
+// Resolve sends msg encrypted using DNSCrypt over UDP, retrying over TCP if the response was truncated.
+// If the upstream is TCP-only, msg is sent over TCP directly.
+func (r *dnscryptResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	c := r.uc.dnscrypt
+	if c == nil {
+		return nil, errInvalidDNSStamp
+	}
+	cert, err := c.certificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	network := "udp"
+	if r.uc.TCPOnly {
+		network = "tcp"
+	}
+	answer, err := c.exchange(ctx, cert, q, network)
+	if err == nil && answer.Truncated && network == "udp" {
+		answer, err = c.exchange(ctx, cert, q, "tcp")
+	}
+	if err != nil {
+		var ne net.Error
+		if !errors.As(err, &ne) {
+			// Not a network error, the resolver may have rotated its keys.
+			c.invalidate(cert)
+		}
+		return nil, err
+	}
+	return answer, nil
+}
+
+// exchange sends packed query q encrypted using cert to resolver, using given network.
+func (c *dnscryptClient) exchange(ctx context.Context, cert *dnscryptCert, q []byte, network string) (*dns.Msg, error) {
+	minSize := 0
+	if network == "udp" {
+		minSize = dnscryptMinUDPQuerySize
+	}
+	packet, clientNonce, err := cert.encryptQuery(q, minSize)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.roundTrip(ctx, network, packet)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := cert.decryptResponse(resp, clientNonce)
+	if err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	if err := answer.Unpack(plain); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// exchangePlain sends unencrypted msg to resolver, using given network. It's used for
+// retrieving certificates, which is the only query a DNSCrypt resolver answers in plain.
+func (c *dnscryptClient) exchangePlain(ctx context.Context, msg *dns.Msg, network string) (*dns.Msg, error) {
+	q, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.roundTrip(ctx, network, q)
+	if err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	if err := answer.Unpack(resp); err != nil {
+		return nil, err
+	}
+	if answer.Id != msg.Id {
+		return nil, dns.ErrId
+	}
+	return answer, nil
+}
+
+// roundTrip sends packet to resolver, directly or via a relay, returning the response packet.
+func (c *dnscryptClient) roundTrip(ctx context.Context, network string, packet []byte) ([]byte, error) {
+	addr := c.stamp.serverAddr
+	if len(c.relays) > 0 {
+		addr = pick(c.relays)
+		packet = c.relayPacket(packet)
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnscryptMaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	buf := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(buf, uint16(len(packet)))
+	copy(buf[2:], packet)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// relayPacket prefixes packet with the anonymized DNSCrypt header, telling the relay
+// which resolver the packet must be forwarded to.
+func (c *dnscryptClient) relayPacket(packet []byte) []byte {
+	host, port, _ := net.SplitHostPort(c.stamp.serverAddr)
+	p, _ := strconv.Atoi(port)
+	b := make([]byte, 0, len(dnscryptAnonMagic)+net.IPv6len+2+len(packet))
+	b = append(b, dnscryptAnonMagic...)
+	b = append(b, net.ParseIP(host).To16()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(p))
+	return append(b, packet...)
+}
@@ -0,0 +1,255 @@
+package ctrld
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testDNSCryptStamp(addr string, pk []byte, providerName string) string {
+	bin := []byte{dnsStampTypeDNSCrypt, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, v := range [][]byte{[]byte(addr), pk, []byte(providerName)} {
+		bin = append(bin, byte(len(v)))
+		bin = append(bin, v...)
+	}
+	return dnsStampScheme + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func Test_parseDNSCryptStamp(t *testing.T) {
+	pk := make([]byte, ed25519.PublicKeySize)
+	tests := []struct {
+		name     string
+		stamp    string
+		wantAddr string
+		wantErr  bool
+	}{
+		{"default port", testDNSCryptStamp("192.0.2.1", pk, "2.dnscrypt-cert.example.com"), "192.0.2.1:443", false},
+		{"port", testDNSCryptStamp("192.0.2.1:8443", pk, "2.dnscrypt-cert.example.com"), "192.0.2.1:8443", false},
+		{"ipv6", testDNSCryptStamp("[2001:db8::1]", pk, "2.dnscrypt-cert.example.com"), "[2001:db8::1]:443", false},
+		{"ipv6 port", testDNSCryptStamp("[2001:db8::1]:8443", pk, "2.dnscrypt-cert.example.com"), "[2001:db8::1]:8443", false},
+		{"hostname", testDNSCryptStamp("dns.example.com", pk, "2.dnscrypt-cert.example.com"), "", true},
+		{"invalid public key", testDNSCryptStamp("192.0.2.1", pk[:16], "2.dnscrypt-cert.example.com"), "", true},
+		{"missing provider name", testDNSCryptStamp("192.0.2.1", pk, ""), "", true},
+		{"not a stamp", "https://dns.example.com", "", true},
+		{"truncated", dnsStampScheme + "AQcAAAAAAAAA", "", true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			stamp, err := parseDNSCryptStamp(tc.stamp)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got: %+v", stamp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stamp.serverAddr != tc.wantAddr {
+				t.Errorf("unexpected server address, want: %q, got: %q", tc.wantAddr, stamp.serverAddr)
+			}
+			if stamp.providerName != "2.dnscrypt-cert.example.com." {
+				t.Errorf("unexpected provider name: %q", stamp.providerName)
+			}
+		})
+	}
+}
+
+func testDNSCryptCert(t *testing.T, sk ed25519.PrivateKey, esVersion uint16, serial uint32, notBefore, notAfter time.Time) []byte {
+	t.Helper()
+	signed := make([]byte, 52)
+	if _, err := crand.Read(signed[:40]); err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(signed[40:44], serial)
+	binary.BigEndian.PutUint32(signed[44:48], uint32(notBefore.Unix()))
+	binary.BigEndian.PutUint32(signed[48:52], uint32(notAfter.Unix()))
+	bin := append([]byte{}, dnscryptCertMagic...)
+	bin = binary.BigEndian.AppendUint16(bin, esVersion)
+	bin = append(bin, 0, 0)
+	bin = append(bin, ed25519.Sign(sk, signed)...)
+	return append(bin, signed...)
+}
+
+func Test_parseDNSCryptCert(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPk, _, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	bin := testDNSCryptCert(t, sk, dnscryptESXChacha20Poly1305, 42, now.Add(-time.Hour), now.Add(time.Hour))
+
+	cert, err := parseDNSCryptCert(bin, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.serial != 42 || cert.esVersion != dnscryptESXChacha20Poly1305 || !cert.valid(now) {
+		t.Errorf("unexpected certificate: %+v", cert)
+	}
+	if cert.valid(now.Add(2 * time.Hour)) {
+		t.Error("expired certificate must not be valid")
+	}
+	if _, err := parseDNSCryptCert(bin, otherPk); err == nil {
+		t.Error("expected error for wrong provider key")
+	}
+	if _, err := parseDNSCryptCert(testDNSCryptCert(t, sk, 3, 42, now, now), pk); err == nil {
+		t.Error("expected error for unsupported encryption system")
+	}
+	if _, err := parseDNSCryptCert(bin[:100], pk); err == nil {
+		t.Error("expected error for truncated certificate")
+	}
+}
+
+func Test_dnscryptPad(t *testing.T) {
+	for _, tc := range []struct {
+		msgLen  int
+		minLen  int
+		wantLen int
+	}{
+		{0, 0, 64},
+		{63, 0, 64},
+		{64, 0, 128},
+		{30, 256, 256},
+		{300, 256, 320},
+	} {
+		msg := bytes.Repeat([]byte{0x80}, tc.msgLen)
+		padded := dnscryptPad(msg, tc.minLen)
+		if len(padded) != tc.wantLen {
+			t.Errorf("unexpected padded length for %d bytes, want: %d, got: %d", tc.msgLen, tc.wantLen, len(padded))
+		}
+		unpadded, err := dnscryptUnpad(padded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, unpadded) {
+			t.Errorf("unexpected unpadded message of %d bytes", tc.msgLen)
+		}
+	}
+	if _, err := dnscryptUnpad(make([]byte, 64)); err == nil {
+		t.Error("expected error for invalid padding")
+	}
+}
+
+func Test_unescapeTxt(t *testing.T) {
+	got, err := unescapeTxt(`DNSC\000\002\"\\a\255`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{'D', 'N', 'S', 'C', 0, 2, '"', '\\', 'a', 255}
+	if !bytes.Equal(got, want) {
+		t.Errorf("unexpected result, want: %v, got: %v", want, got)
+	}
+	for _, s := range []string{`\`, `\256`} {
+		if _, err := unescapeTxt(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func Test_dnscryptCert_exchange(t *testing.T) {
+	for _, esVersion := range []uint16{dnscryptESXSalsa20Poly1305, dnscryptESXChacha20Poly1305} {
+		esVersion := esVersion
+		t.Run(fmt.Sprintf("es_version_%d", esVersion), func(t *testing.T) {
+			t.Parallel()
+			cert := &dnscryptCert{esVersion: esVersion}
+			copy(cert.clientMagic[:], "magic!!!")
+			if _, err := crand.Read(cert.sharedKey[:]); err != nil {
+				t.Fatal(err)
+			}
+			query := []byte("query")
+			packet, clientNonce, err := cert.encryptQuery(query, dnscryptMinUDPQuerySize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := dnscryptQueryHdrLen + dnscryptTagSize + dnscryptMinUDPQuerySize; len(packet) != want {
+				t.Errorf("unexpected query size, want: %d, got: %d", want, len(packet))
+			}
+
+			// Acting as the resolver, which shares the same key.
+			var nonce [dnscryptNonceSize]byte
+			copy(nonce[:], packet[40:dnscryptQueryHdrLen])
+			padded, err := cert.open(packet[dnscryptQueryHdrLen:], &nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := dnscryptUnpad(padded); !bytes.Equal(got, query) {
+				t.Fatalf("unexpected query, want: %q, got: %q", query, got)
+			}
+			copy(nonce[dnscryptHalfNonce:], "server nonce")
+			resp := append([]byte{}, dnscryptResolverMagic...)
+			resp = append(resp, nonce[:]...)
+			resp = append(resp, cert.seal(dnscryptPad([]byte("response"), 0), &nonce)...)
+
+			got, err := cert.decryptResponse(resp, clientNonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "response" {
+				t.Errorf("unexpected response: %q", got)
+			}
+			resp[len(resp)-1] ^= 1
+			if _, err := cert.decryptResponse(resp, clientNonce); err == nil {
+				t.Error("expected error for tampered response")
+			}
+			if _, err := cert.decryptResponse(resp, make([]byte, dnscryptHalfNonce)); err == nil {
+				t.Error("expected error for unexpected nonce")
+			}
+		})
+	}
+}
+
+func Test_parseDNSCryptRelayStamp(t *testing.T) {
+	relayStamp := func(addr string) string {
+		bin := append([]byte{dnsStampTypeDNSCryptRelay, byte(len(addr))}, addr...)
+		return dnsStampScheme + base64.RawURLEncoding.EncodeToString(bin)
+	}
+	tests := []struct {
+		name    string
+		stamp   string
+		want    string
+		wantErr bool
+	}{
+		{"default port", relayStamp("192.0.2.2"), "192.0.2.2:443", false},
+		{"port", relayStamp("[2001:db8::2]:5443"), "[2001:db8::2]:5443", false},
+		{"hostname", relayStamp("relay.example.com"), "", true},
+		{"server stamp", testDNSCryptStamp("192.0.2.1", make([]byte, ed25519.PublicKeySize), "2.dnscrypt-cert.example.com"), "", true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseDNSCryptRelayStamp(tc.stamp)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("unexpected relay address, want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_dnscryptClient_relayPacket(t *testing.T) {
+	c := &dnscryptClient{stamp: &dnsStamp{serverAddr: "192.0.2.1:8443"}}
+	got := c.relayPacket([]byte("packet"))
+	want := append([]byte{}, dnscryptAnonMagic...)
+	want = append(want, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1)
+	want = append(want, 0x20, 0xfb)
+	want = append(want, "packet"...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("unexpected relay packet\nwant: %v\ngot:  %v", want, got)
+	}
+}
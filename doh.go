@@ -1,6 +1,7 @@
 package ctrld
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"strings"
 	"sync"
@@ -24,6 +26,8 @@ const (
 	dohOsHeader           = "x-cd-os"
 	dohClientIDPrefHeader = "x-cd-cpref"
 	headerApplicationDNS  = "application/dns-message"
+
+	dohMethodPost = "post"
 )
 
 // EncodeOsNameMap provides mapping from OS name to a shorter string, used for encoding x-cd-os value.
@@ -91,18 +95,29 @@ type dohResolver struct {
 
 // Resolve performs DNS query with given DNS message using DOH protocol.
 func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
-	data, err := msg.Pack()
+	// Identical queries must be sent as identical requests, so their answers could be
+	// cached by HTTP caches, see RFC 8484 section 4.1.
+	query := msg.Copy()
+	query.Id = 0
+	data, err := query.Pack()
 	if err != nil {
 		return nil, err
 	}
 
-	enc := base64.RawURLEncoding.EncodeToString(data)
-	query := r.endpoint.Query()
-	query.Add("dns", enc)
+	proto := r.uc.dohRace.proto(r.isDoH3, r.uc.Proxy != "")
+	if proto == "" {
+		return r.race(ctx, msg, data)
+	}
+	answer, err := r.exchange(ctx, msg, data, proto)
+	if err != nil {
+		r.uc.dohRace.failed(proto)
+	}
+	return answer, err
+}
 
-	endpoint := *r.endpoint
-	endpoint.RawQuery = query.Encode()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+// exchange sends DNS message data using the given HTTP version, "h2" or "h3".
+func (r *dohResolver) exchange(ctx context.Context, msg *dns.Msg, data []byte, proto string) (*dns.Msg, error) {
+	req, err := r.newRequest(ctx, data)
 	if err != nil {
 		return nil, fmt.Errorf("could not create request: %w", err)
 	}
@@ -112,7 +127,7 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		dnsTyp = msg.Question[0].Qtype
 	}
 	c := http.Client{Transport: r.uc.dohTransport(dnsTyp)}
-	if r.isDoH3 {
+	if proto == dohProtoH3 {
 		transport := r.uc.doh3Transport(dnsTyp)
 		if transport == nil {
 			return nil, errors.New("DoH3 is not supported")
@@ -121,7 +136,8 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 	}
 	resp, err := c.Do(req)
 	if err != nil {
-		if r.isDoH3 {
+		// Request canceled because the other HTTP version won the race is not a transport failure.
+		if proto == dohProtoH3 && ctx.Err() == nil {
 			if closer, ok := c.Transport.(io.Closer); ok {
 				closer.Close()
 			}
@@ -129,6 +145,9 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		return nil, fmt.Errorf("could not perform request: %w", err)
 	}
 	defer resp.Body.Close()
+	if proto == dohProtoH2 && !r.isDoH3 {
+		r.uc.dohRace.observeAltSvc(resp.Header.Get("Alt-Svc"))
+	}
 
 	buf, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -143,9 +162,24 @@ func (r *dohResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 	if err := answer.Unpack(buf); err != nil {
 		return nil, fmt.Errorf("answer.Unpack: %w", err)
 	}
+	answer.Id = msg.Id
 	return answer, nil
 }
 
+// newRequest returns the HTTP request for DNS message data, using the upstream DoH method.
+// GET requests carry data base64url encoded in "dns" query parameter, POST requests carry
+// data in the body.
+func (r *dohResolver) newRequest(ctx context.Context, data []byte) (*http.Request, error) {
+	if r.uc.DoHMethod == dohMethodPost {
+		return http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint.String(), bytes.NewReader(data))
+	}
+	query := r.endpoint.Query()
+	query.Add("dns", base64.RawURLEncoding.EncodeToString(data))
+	endpoint := *r.endpoint
+	endpoint.RawQuery = query.Encode()
+	return http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+}
+
 // addHeader adds necessary HTTP header to request based on upstream config.
 func addHeader(ctx context.Context, req *http.Request, uc *UpstreamConfig) {
 	printed := false
@@ -154,7 +188,7 @@ func addHeader(ctx context.Context, req *http.Request, uc *UpstreamConfig) {
 		if ci, ok := ctx.Value(ClientInfoCtxKey{}).(*ClientInfo); ok && ci != nil {
 			printed = ci.Mac != "" || ci.IP != "" || ci.Hostname != ""
 			switch {
-			case uc.isControlD():
+			case uc.IsControlD():
 				dohHeader = newControlDHeaders(ci)
 			case uc.isNextDNS():
 				dohHeader = newNextDNSHeaders(ci)
@@ -164,11 +198,32 @@ func addHeader(ctx context.Context, req *http.Request, uc *UpstreamConfig) {
 	if printed {
 		Log(ctx, ProxyLogger.Load().Debug(), "sending request header: %v", dohHeader)
 	}
+	uc.addCustomHeaders(dohHeader)
 	dohHeader.Set("Content-Type", headerApplicationDNS)
 	dohHeader.Set("Accept", headerApplicationDNS)
 	req.Header = dohHeader
 }
 
+// addCustomHeaders adds headers and bearer token configured for the upstream to header.
+func (uc *UpstreamConfig) addCustomHeaders(header http.Header) {
+	for k, v := range uc.Headers {
+		header.Set(k, v)
+	}
+	if uc.bearerToken != "" {
+		header.Set("Authorization", "Bearer "+uc.bearerToken)
+	}
+}
+
+// loadBearerToken reads the upstream bearer token from BearerTokenFile.
+func (uc *UpstreamConfig) loadBearerToken() {
+	buf, err := os.ReadFile(uc.BearerTokenFile)
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("could not read bearer token of upstream: %s", uc.Name)
+		return
+	}
+	uc.bearerToken = strings.TrimSpace(string(buf))
+}
+
 // newControlDHeaders returns DoH/Doh3 HTTP request headers for ControlD upstream.
 func newControlDHeaders(ci *ClientInfo) http.Header {
 	header := make(http.Header)
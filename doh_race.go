@@ -0,0 +1,149 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohProtoH2 = "h2"
+	dohProtoH3 = "h3"
+
+	// dohReprobeInterval is how long the HTTP version chosen by racing is used,
+	// before both versions are raced again.
+	dohReprobeInterval = 10 * time.Minute
+)
+
+// dohRacer selects the HTTP version used for sending queries to a DoH/DoH3 upstream, which
+// supports both HTTP/2 and HTTP/3.
+//
+// DoH3 upstreams are assumed to support HTTP/2 as well, while DoH upstreams support HTTP/3
+// if they advertise it in Alt-Svc header of responses. For these upstreams, both versions
+// are raced on first use, and the first one answering is used for next queries, until it
+// fails or dohReprobeInterval passed, then both versions are raced again. This way, queries
+// do not suffer from UDP/443 being blocked, nor miss HTTP/3 being faster when it is not.
+//
+// Upstreams using a proxy never race, HTTP/2 is always used, because the proxy only carries
+// TCP, and HTTP/3 connections would bypass it.
+type dohRacer struct {
+	mu           sync.Mutex
+	h3Advertised bool
+	chosen       string
+	chosenAt     time.Time
+}
+
+// proto returns the HTTP version which queries should be sent using, or empty string if
+// both versions must be raced.
+func (d *dohRacer) proto(isDoH3, proxied bool) string {
+	if proxied {
+		return dohProtoH2
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !isDoH3 && !d.h3Advertised {
+		return dohProtoH2
+	}
+	if d.chosen == "" || time.Since(d.chosenAt) > dohReprobeInterval {
+		return ""
+	}
+	return d.chosen
+}
+
+// choose records proto as the winner of racing.
+func (d *dohRacer) choose(proto string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.chosen = proto
+	d.chosenAt = time.Now()
+}
+
+// failed records that sending query using proto failed, so both versions are raced again.
+func (d *dohRacer) failed(proto string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.chosen == proto {
+		d.chosen = ""
+	}
+}
+
+// observeAltSvc records whether the Alt-Svc header value of a DoH response advertises HTTP/3.
+func (d *dohRacer) observeAltSvc(altSvc string) {
+	if altSvc == "" {
+		return
+	}
+	advertised := false
+	for _, svc := range strings.Split(altSvc, ",") {
+		if strings.HasPrefix(strings.TrimSpace(svc), dohProtoH3+"=") {
+			advertised = true
+			break
+		}
+	}
+	// "clear" means the server withdraws all alternative services, see RFC 7838 section 3.
+	if !advertised && strings.TrimSpace(altSvc) != "clear" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.h3Advertised = advertised
+}
+
+// transport returns the HTTP version chosen by racing, or empty string if none was chosen.
+func (d *dohRacer) transport() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.chosen
+}
+
+// DoHTransport returns the HTTP version used for sending queries to a DoH/DoH3 upstream,
+// "h2" or "h3". It returns empty string for other upstream types, or if the version is not
+// chosen yet. See dohRacer for more details.
+func (uc *UpstreamConfig) DoHTransport() string {
+	switch uc.Type {
+	case ResolverTypeDOH, ResolverTypeDOH3:
+	default:
+		return ""
+	}
+	if proto := uc.dohRace.proto(uc.Type == ResolverTypeDOH3, uc.Proxy != ""); proto != "" {
+		return proto
+	}
+	return uc.dohRace.transport()
+}
+
+type dohRaceResult struct {
+	proto  string
+	answer *dns.Msg
+	err    error
+}
+
+// race sends DNS message data using both HTTP/2 and HTTP/3, returning the first answer.
+// The HTTP version which answered first is used for next queries.
+func (r *dohResolver) race(ctx context.Context, msg *dns.Msg, data []byte) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	protos := []string{dohProtoH3, dohProtoH2}
+	ch := make(chan *dohRaceResult, len(protos))
+	for _, proto := range protos {
+		go func(proto string) {
+			answer, err := r.exchange(ctx, msg, data, proto)
+			ch <- &dohRaceResult{proto: proto, answer: answer, err: err}
+		}(proto)
+	}
+
+	errs := make([]error, 0, len(protos))
+	for range protos {
+		res := <-ch
+		if res.err == nil {
+			r.uc.dohRace.choose(res.proto)
+			Log(ctx, ProxyLogger.Load().Debug(), "%s won the race to upstream: %s", res.proto, r.uc.Name)
+			return res.answer, nil
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,132 @@
+package ctrld
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_dohRacer_proto(t *testing.T) {
+	tests := []struct {
+		name    string
+		isDoH3  bool
+		proxied bool
+		altSvc  string
+		want    string
+	}{
+		{"doh", false, false, "", dohProtoH2},
+		{"doh h3 advertised", false, false, `h3=":443"; ma=86400, h2=":443"`, ""},
+		{"doh other alt svc", false, false, `h2=":8443"`, dohProtoH2},
+		{"doh3", true, false, "", ""},
+		{"doh h3 advertised proxied", false, true, `h3=":443"`, dohProtoH2},
+		{"doh3 proxied", true, true, "", dohProtoH2},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			d := &dohRacer{}
+			d.observeAltSvc(tc.altSvc)
+			if got := d.proto(tc.isDoH3, tc.proxied); got != tc.want {
+				t.Errorf("unexpected proto, want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_dohRacer_choose(t *testing.T) {
+	d := &dohRacer{}
+	d.observeAltSvc(`h3=":443"`)
+	d.choose(dohProtoH3)
+	if got := d.proto(false, false); got != dohProtoH3 {
+		t.Errorf("chosen proto must be used, got: %q", got)
+	}
+
+	// Failure of other proto does not affect the chosen one.
+	d.failed(dohProtoH2)
+	if got := d.proto(false, false); got != dohProtoH3 {
+		t.Errorf("chosen proto must be used, got: %q", got)
+	}
+	d.failed(dohProtoH3)
+	if got := d.proto(false, false); got != "" {
+		t.Errorf("protos must be raced after failure, got: %q", got)
+	}
+
+	d.choose(dohProtoH2)
+	d.chosenAt = time.Now().Add(-dohReprobeInterval - time.Second)
+	if got := d.proto(false, false); got != "" {
+		t.Errorf("protos must be re-probed, got: %q", got)
+	}
+	if got := d.transport(); got != dohProtoH2 {
+		t.Errorf("last chosen proto must be reported, got: %q", got)
+	}
+
+	d.observeAltSvc("clear")
+	if got := d.proto(false, false); got != dohProtoH2 {
+		t.Errorf("h2 must be used after alt svc cleared, got: %q", got)
+	}
+}
+
+// countingRoundTripper answers DoH requests with an empty answer, counting requests.
+type countingRoundTripper struct {
+	requests atomic.Int32
+}
+
+func (c *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	answer := new(dns.Msg)
+	answer.SetQuestion("example.com.", dns.TypeA)
+	answer.Response = true
+	buf, err := answer.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewReader(buf)),
+		Request:    req,
+	}, nil
+}
+
+func Test_dohResolver_proxiedNoH3(t *testing.T) {
+	h2, h3 := &countingRoundTripper{}, &countingRoundTripper{}
+	uc := &UpstreamConfig{
+		Type:     ResolverTypeDOH,
+		Endpoint: "https://dns.example.com/dns-query",
+		Proxy:    "socks5://127.0.0.1:9050",
+		IPStack:  IpStackBoth,
+	}
+	uc.u, _ = url.Parse(uc.Endpoint)
+	uc.transportOnce.Do(func() {})
+	uc.transport = &http.Transport{}
+	uc.transport.RegisterProtocol("https", h2)
+	uc.http3RoundTripper = h3
+	// The upstream advertises HTTP/3, which would be raced without a proxy.
+	uc.dohRace.observeAltSvc(`h3=":443"`)
+
+	r := newDohResolver(uc)
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		if _, err := r.Resolve(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := h3.requests.Load(); n != 0 {
+		t.Errorf("h3 exchange must not be attempted with a proxy, got: %d requests", n)
+	}
+	if n := h2.requests.Load(); n != 3 {
+		t.Errorf("unexpected number of h2 requests, want: 3, got: %d", n)
+	}
+	if got := uc.doh3Transport(dns.TypeA); got != nil {
+		t.Errorf("doh3 transport must not be used with a proxy, got: %v", got)
+	}
+}
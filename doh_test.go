@@ -1,8 +1,17 @@
 package ctrld
 
 import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func Test_dohOsHeaderValue(t *testing.T) {
@@ -21,3 +30,82 @@ func Test_dohOsHeaderValue(t *testing.T) {
 		t.Fatalf("missing decoding value for: %q", runtime.GOOS)
 	}
 }
+
+func Test_addHeader_custom(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	uc := &UpstreamConfig{
+		Name:            "custom headers",
+		Type:            ResolverTypeDOH,
+		Endpoint:        "https://dns.example.com/dns-query",
+		Headers:         map[string]string{"x-api-key": "abcd", "content-type": "text/plain"},
+		BearerTokenFile: tokenFile,
+	}
+	uc.Init()
+
+	req := httptest.NewRequest(http.MethodGet, uc.Endpoint, nil)
+	addHeader(context.Background(), req, uc)
+	for k, want := range map[string]string{
+		"X-Api-Key":     "abcd",
+		"Authorization": "Bearer secret-token",
+		"Content-Type":  headerApplicationDNS,
+		"Accept":        headerApplicationDNS,
+	} {
+		if got := req.Header.Get(k); got != want {
+			t.Errorf("unexpected %s header, want: %q, got: %q", k, want, got)
+		}
+	}
+}
+
+func Test_dohResolver_newRequest(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = 0
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		wantMethod string
+	}{
+		{"default", "", http.MethodGet},
+		{"get", "get", http.MethodGet},
+		{"post", "post", http.MethodPost},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			uc := &UpstreamConfig{Type: ResolverTypeDOH, Endpoint: "https://dns.example.com/dns-query?id=1", DoHMethod: tc.method}
+			uc.Init()
+			r := newDohResolver(uc)
+			req, err := r.newRequest(context.Background(), data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Method != tc.wantMethod {
+				t.Errorf("unexpected method, want: %s, got: %s", tc.wantMethod, req.Method)
+			}
+			if got := req.URL.Query().Get("id"); got != "1" {
+				t.Errorf("endpoint query parameter is lost: %s", req.URL)
+			}
+			var got []byte
+			if req.Method == http.MethodGet {
+				got, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+			} else {
+				got, err = io.ReadAll(req.Body)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(data) {
+				t.Errorf("unexpected request data: %x", got)
+			}
+		})
+	}
+}
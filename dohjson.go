@@ -0,0 +1,254 @@
+package ctrld
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const headerApplicationDNSJSON = "application/dns-json"
+
+// dohJSONResolver sends queries using the JSON API of DoH servers, like https://dns.google/resolve
+// or https://cloudflare-dns.com/dns-query. Queries are converted to GET requests with parameters,
+// and JSON responses are converted back to DNS messages.
+type dohJSONResolver struct {
+	uc *UpstreamConfig
+}
+
+// dohJSONResponse is the response of DoH JSON API.
+type dohJSONResponse struct {
+	Status     int               `json:"Status"`
+	TC         bool              `json:"TC"`
+	RD         bool              `json:"RD"`
+	RA         bool              `json:"RA"`
+	AD         bool              `json:"AD"`
+	CD         bool              `json:"CD"`
+	Question   []dohJSONQuestion `json:"Question,omitempty"`
+	Answer     []dohJSONRR       `json:"Answer,omitempty"`
+	Authority  []dohJSONRR       `json:"Authority,omitempty"`
+	Additional []dohJSONRR       `json:"Additional,omitempty"`
+}
+
+// dohJSONQuestion is the question in DoH JSON API response.
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONRR is a resource record in DoH JSON API response, with data in presentation format.
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// Resolve performs DNS query with given DNS message using DoH JSON API.
+func (r *dohJSONResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) == 0 {
+		return nil, errors.New("no question in query")
+	}
+	req, err := r.newRequest(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	c := http.Client{Transport: r.uc.dohTransport(msg.Question[0].Qtype)}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read message from response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("wrong response from DOH JSON server, got: %s, status: %d", string(buf), resp.StatusCode)
+	}
+
+	var res dohJSONResponse
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+	return res.msg(ctx, msg), nil
+}
+
+// newRequest returns the HTTP GET request for query msg. The query name and type are sent in
+// "name" and "type" parameters, DNSSEC bits in "do" and "cd", and the client subnet, if any,
+// in "edns_client_subnet".
+func (r *dohJSONResolver) newRequest(ctx context.Context, msg *dns.Msg) (*http.Request, error) {
+	q := msg.Question[0]
+	query := r.uc.u.Query()
+	query.Set("name", q.Name)
+	query.Set("type", strconv.Itoa(int(q.Qtype)))
+	if msg.CheckingDisabled {
+		query.Set("cd", "1")
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		if opt.Do() {
+			query.Set("do", "1")
+		}
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				query.Set("edns_client_subnet", fmt.Sprintf("%s/%d", e.Address, e.SourceNetmask))
+			}
+		}
+	}
+	endpoint := *r.uc.u
+	endpoint.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	r.uc.addCustomHeaders(req.Header)
+	req.Header.Set("Accept", headerApplicationDNSJSON)
+	return req, nil
+}
+
+// msg converts the response to the DNS message answering query.
+func (res *dohJSONResponse) msg(ctx context.Context, query *dns.Msg) *dns.Msg {
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	answer.Rcode = res.Status
+	answer.Truncated = res.TC
+	answer.RecursionDesired = res.RD
+	answer.RecursionAvailable = res.RA
+	answer.AuthenticatedData = res.AD
+	answer.CheckingDisabled = res.CD
+	answer.Answer = dohJSONRRs(ctx, res.Answer)
+	answer.Ns = dohJSONRRs(ctx, res.Authority)
+	answer.Extra = dohJSONRRs(ctx, res.Additional)
+	return answer
+}
+
+// dohJSONRRs converts DoH JSON API records to resource records. Records which could not be
+// parsed are skipped.
+func dohJSONRRs(ctx context.Context, records []dohJSONRR) []dns.RR {
+	if len(records) == 0 {
+		return nil
+	}
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := record.rr()
+		if err != nil {
+			Log(ctx, ProxyLogger.Load().Debug().Err(err), "skipping doh json record: %v", record)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// rr parses the record using its presentation format.
+func (record dohJSONRR) rr() (dns.RR, error) {
+	typ, ok := dns.TypeToString[record.Type]
+	if !ok {
+		typ = "TYPE" + strconv.Itoa(int(record.Type))
+	}
+	data := record.Data
+	// Some servers send TXT data unquoted.
+	if (record.Type == dns.TypeTXT || record.Type == dns.TypeSPF) && !strings.HasPrefix(data, `"`) {
+		data = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(data) + `"`
+	}
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(record.Name), record.TTL, typ, data))
+}
+
+// NewDoHJSONQuery returns the query of a DoH JSON API request, with parameters: "name", "type"
+// as number or name, A by default, "cd" and "do" DNSSEC bits, and "edns_client_subnet".
+func NewDoHJSONQuery(params url.Values) (*dns.Msg, error) {
+	name := params.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return nil, fmt.Errorf("invalid name: %q", name)
+	}
+	qtype := dns.TypeA
+	if t := params.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			return nil, fmt.Errorf("invalid type: %q", t)
+		}
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.CheckingDisabled = dohJSONBool(params.Get("cd"))
+	do := dohJSONBool(params.Get("do"))
+	ecs := params.Get("edns_client_subnet")
+	if !do && ecs == "" {
+		return msg, nil
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	opt.SetDo(do)
+	if ecs != "" {
+		prefix, err := netip.ParsePrefix(ecs)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(ecs)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid edns_client_subnet: %q", ecs)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(prefix.Bits()), Address: prefix.Masked().Addr().AsSlice()}
+		if prefix.Addr().Is6() {
+			e.Family = 2
+		}
+		opt.Option = append(opt.Option, e)
+	}
+	msg.Extra = append(msg.Extra, opt)
+	return msg, nil
+}
+
+// dohJSONBool reports whether the DoH JSON API boolean parameter is set.
+func dohJSONBool(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
+
+// MarshalDoHJSON returns the DoH JSON API response of answer.
+func MarshalDoHJSON(answer *dns.Msg) ([]byte, error) {
+	res := dohJSONResponse{
+		Status:     answer.Rcode,
+		TC:         answer.Truncated,
+		RD:         answer.RecursionDesired,
+		RA:         answer.RecursionAvailable,
+		AD:         answer.AuthenticatedData,
+		CD:         answer.CheckingDisabled,
+		Answer:     newDoHJSONRRs(answer.Answer),
+		Authority:  newDoHJSONRRs(answer.Ns),
+		Additional: newDoHJSONRRs(answer.Extra),
+	}
+	for _, q := range answer.Question {
+		res.Question = append(res.Question, dohJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	return json.Marshal(res)
+}
+
+// newDoHJSONRRs converts resource records to DoH JSON API records, with data in presentation
+// format. OPT records are skipped, they are not part of DoH JSON API.
+func newDoHJSONRRs(rrs []dns.RR) []dohJSONRR {
+	var records []dohJSONRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		records = append(records, dohJSONRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return records
+}
@@ -0,0 +1,164 @@
+package ctrld
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_dohJSONResolver_newRequest(t *testing.T) {
+	u, _ := url.Parse("https://dns.google/resolve?ct=application/dns-json")
+	r := &dohJSONResolver{uc: &UpstreamConfig{u: u, Headers: map[string]string{"X-Custom": "value"}}}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeAAAA)
+	msg.CheckingDisabled = true
+	msg.SetEdns0(4096, true)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("192.0.2.0").To4(),
+	})
+
+	req, err := r.newRequest(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := req.URL.Query()
+	want := map[string]string{
+		"ct":                 "application/dns-json",
+		"name":               "example.com.",
+		"type":               "28",
+		"cd":                 "1",
+		"do":                 "1",
+		"edns_client_subnet": "192.0.2.0/24",
+	}
+	for k, v := range want {
+		if got := query.Get(k); got != v {
+			t.Errorf("unexpected %q parameter, want: %q, got: %q", k, v, got)
+		}
+	}
+	if got := req.Header.Get("Accept"); got != headerApplicationDNSJSON {
+		t.Errorf("unexpected Accept header: %q", got)
+	}
+	if got := req.Header.Get("X-Custom"); got != "value" {
+		t.Errorf("unexpected custom header: %q", got)
+	}
+}
+
+func Test_dohJSONResponse_msg(t *testing.T) {
+	body := `{
+  "Status": 0, "TC": false, "RD": true, "RA": true, "AD": true, "CD": false,
+  "Question": [{"name": "www.example.com.", "type": 16}],
+  "Answer": [
+    {"name": "www.example.com.", "type": 5, "TTL": 300, "data": "example.com."},
+    {"name": "example.com", "type": 1, "TTL": 60, "data": "192.0.2.1"},
+    {"name": "example.com.", "type": 16, "TTL": 60, "data": "v=spf1 -all"},
+    {"name": "example.com.", "type": 16, "TTL": 60, "data": "\"quoted\""},
+    {"name": "example.com.", "type": 1, "TTL": 60, "data": "not an ip"}
+  ]
+}`
+	var res dohJSONResponse
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeTXT)
+	answer := res.msg(context.Background(), query)
+
+	if answer.Id != query.Id || !answer.Response || answer.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected answer header: %v", answer.MsgHdr)
+	}
+	if !answer.RecursionAvailable || !answer.AuthenticatedData {
+		t.Errorf("unexpected answer flags: %v", answer.MsgHdr)
+	}
+	if len(answer.Answer) != 4 {
+		t.Fatalf("unexpected answer records: %v", answer.Answer)
+	}
+	if cname, ok := answer.Answer[0].(*dns.CNAME); !ok || cname.Target != "example.com." {
+		t.Errorf("unexpected CNAME record: %v", answer.Answer[0])
+	}
+	if a, ok := answer.Answer[1].(*dns.A); !ok || a.Hdr.Name != "example.com." || a.Hdr.Ttl != 60 || !a.A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("unexpected A record: %v", answer.Answer[1])
+	}
+	for i, want := range []string{"v=spf1 -all", "quoted"} {
+		txt, ok := answer.Answer[2+i].(*dns.TXT)
+		if !ok || len(txt.Txt) != 1 || txt.Txt[0] != want {
+			t.Errorf("unexpected TXT record, want: %q, got: %v", want, answer.Answer[2+i])
+		}
+	}
+}
+
+func TestNewDoHJSONQuery(t *testing.T) {
+	params := url.Values{}
+	params.Set("name", "example.com")
+	params.Set("type", "aaaa")
+	params.Set("cd", "true")
+	params.Set("do", "1")
+	params.Set("edns_client_subnet", "192.0.2.1/24")
+	msg, err := NewDoHJSONQuery(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := msg.Question[0]; q.Name != "example.com." || q.Qtype != dns.TypeAAAA {
+		t.Errorf("unexpected question: %v", q)
+	}
+	if !msg.CheckingDisabled {
+		t.Error("cd bit is not set")
+	}
+	opt := msg.IsEdns0()
+	if opt == nil || !opt.Do() {
+		t.Fatalf("do bit is not set: %v", opt)
+	}
+	e, ok := opt.Option[0].(*dns.EDNS0_SUBNET)
+	if !ok || e.SourceNetmask != 24 || !e.Address.Equal(net.ParseIP("192.0.2.0")) {
+		t.Errorf("unexpected client subnet: %v", opt.Option)
+	}
+
+	for _, query := range []string{"", "type=A", "name=example.com&type=INVALID", "name=example.com&edns_client_subnet=invalid"} {
+		params, _ := url.ParseQuery(query)
+		if _, err := NewDoHJSONQuery(params); err == nil {
+			t.Errorf("expected error for query: %q", query)
+		}
+	}
+}
+
+func TestMarshalDoHJSON(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeTXT)
+	query.SetEdns0(4096, false)
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	answer.RecursionAvailable = true
+	answer.Answer = append(answer.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{"v=spf1 -all"},
+	})
+	answer.Extra = append(answer.Extra, query.IsEdns0())
+
+	buf, err := MarshalDoHJSON(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res dohJSONResponse
+	if err := json.Unmarshal(buf, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.RD || !res.RA || len(res.Question) != 1 || res.Question[0].Type != dns.TypeTXT {
+		t.Errorf("unexpected response: %s", buf)
+	}
+	if len(res.Additional) != 0 {
+		t.Errorf("unexpected OPT record in response: %s", buf)
+	}
+	// Round trip through the resolver conversion.
+	msg := res.msg(context.Background(), query)
+	if len(msg.Answer) != 1 || msg.Answer[0].String() != answer.Answer[0].String() {
+		t.Errorf("unexpected answer: %v", msg.Answer)
+	}
+}
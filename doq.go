@@ -5,8 +5,11 @@ package ctrld
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,7 +22,8 @@ type doqResolver struct {
 
 func (r *doqResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	endpoint := r.uc.Endpoint
-	tlsConfig := &tls.Config{NextProtos: []string{"doq"}}
+	tlsConfig := &tls.Config{NextProtos: []string{"doq"}, Time: Now, ClientSessionCache: doqSessionCache}
+	r.uc.setupTLSConfig(tlsConfig)
 	ip := r.uc.BootstrapIP
 	if ip == "" {
 		dnsTyp := uint16(0)
@@ -28,41 +32,57 @@ func (r *doqResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		}
 		ip = r.uc.bootstrapIPForDNSType(dnsTyp)
 	}
-	tlsConfig.ServerName = r.uc.Domain
+	tlsConfig.ServerName = r.uc.tlsServerName()
 	_, port, _ := net.SplitHostPort(endpoint)
 	endpoint = net.JoinHostPort(ip, port)
-	return resolve(ctx, msg, endpoint, tlsConfig)
+	return resolve(ctx, msg, r.uc.doqPool(endpoint), tlsConfig)
 }
 
-func resolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tls.Config) (*dns.Msg, error) {
+func resolve(ctx context.Context, msg *dns.Msg, pool *doqPool, tlsConfig *tls.Config) (*dns.Msg, error) {
+	// Early data could be replayed by an attacker, so only standard queries,
+	// which are idempotent, are sent as 0-RTT data.
+	early := msg.Opcode == dns.OpcodeQuery
 	// DoQ quic-go server returns io.EOF error after running for a long time,
 	// even for a good stream. So retrying the query for 5 times before giving up.
 	for i := 0; i < 5; i++ {
-		answer, err := doResolve(ctx, msg, endpoint, tlsConfig)
+		dc, fresh, err := pool.getConn(ctx, tlsConfig, early)
+		if err != nil {
+			return nil, err
+		}
+		answer, err := doResolve(ctx, msg, dc.conn)
+		pool.release(dc, err)
 		if err == io.EOF {
 			continue
 		}
+		// The server rejected early data (e.g: its ticket keys were rotated),
+		// so re-send the query after a full handshake.
+		if errors.Is(err, quic.Err0RTTRejected) {
+			early = false
+			continue
+		}
+		// A reused connection may have been closed by the server, or lost, re-send the query
+		// using a new connection.
+		if err != nil && !fresh && ctx.Err() == nil {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+		if fresh && dc.conn.ConnectionState().Used0RTT {
+			ProxyLogger.Load().Debug().Msgf("DoQ query to %s sent as 0-RTT data", pool.endpoint)
+		}
 		return answer, nil
 	}
 	return nil, &quic.ApplicationError{ErrorCode: quic.ApplicationErrorCode(quic.InternalError), ErrorMessage: quic.InternalError.Message()}
 }
 
-func doResolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tls.Config) (*dns.Msg, error) {
-	session, err := quic.DialAddr(ctx, endpoint, tlsConfig, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer session.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
-
+func doResolve(ctx context.Context, msg *dns.Msg, conn quic.Connection) (*dns.Msg, error) {
 	msgBytes, err := msg.Pack()
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := session.OpenStream()
+	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -105,3 +125,171 @@ func doResolve(ctx context.Context, msg *dns.Msg, endpoint string, tlsConfig *tl
 	answer.SetReply(msg)
 	return answer, nil
 }
+
+// doqPool returns the connection pool for sending queries to endpoint, creating one if necessary.
+func (uc *UpstreamConfig) doqPool(endpoint string) *doqPool {
+	uc.doqPoolsMu.Lock()
+	defer uc.doqPoolsMu.Unlock()
+	p := uc.doqPools[endpoint]
+	if p == nil {
+		if uc.doqPools == nil {
+			uc.doqPools = make(map[string]*doqPool)
+		}
+		p = &doqPool{endpoint: endpoint}
+		uc.doqPools[endpoint] = p
+	}
+	p.mu.Lock()
+	p.maxConns = uc.maxConns()
+	p.idleTimeout = uc.idleTimeout()
+	p.mu.Unlock()
+	return p
+}
+
+// resetDoQConns closes all QUIC connections of the upstream.
+func (uc *UpstreamConfig) resetDoQConns() {
+	uc.doqPoolsMu.Lock()
+	defer uc.doqPoolsMu.Unlock()
+	for _, p := range uc.doqPools {
+		p.reset()
+	}
+}
+
+// doqPool keeps QUIC connections to a DoQ server, each query is sent on a new stream of
+// a pooled connection, so it does not wait for a new handshake.
+//
+// Like tcpPipeline, an idle connection is used if there is one. Otherwise, a new connection
+// is dialed, until the pool has maxConns connections, including the ones being dialed. New
+// connections are dialed without holding the pool lock, so a slow handshake does not block
+// queries using other connections. Connections are closed by QUIC after being idle for
+// idleTimeout, or the idle timeout of the server, if it is shorter.
+type doqPool struct {
+	endpoint string
+
+	mu          sync.Mutex
+	maxConns    int
+	idleTimeout time.Duration
+	conns       []*doqConn
+	dialing     int           // Number of connections being dialed.
+	dialDone    chan struct{} // Closed when a dial is done, if someone waits for it.
+}
+
+// doqConn is a pooled QUIC connection.
+type doqConn struct {
+	conn     quic.Connection
+	inflight int // Guarded by doqPool.mu.
+}
+
+// getConn returns a connection of the pool for a new query, dialing a new one if there is
+// no idle connection, and the pool is not full. The returned boolean reports whether the
+// connection was just dialed. The connection must be released after use.
+func (p *doqPool) getConn(ctx context.Context, tlsConfig *tls.Config, early bool) (*doqConn, bool, error) {
+	p.mu.Lock()
+	for {
+		var best *doqConn
+		conns := p.conns[:0]
+		for _, dc := range p.conns {
+			if dc.conn.Context().Err() != nil {
+				continue
+			}
+			conns = append(conns, dc)
+			if best == nil || dc.inflight < best.inflight {
+				best = dc
+			}
+		}
+		clear(p.conns[len(conns):])
+		p.conns = conns
+		full := len(p.conns)+p.dialing >= max(p.maxConns, 1)
+		if best != nil && (best.inflight == 0 || full) {
+			best.inflight++
+			p.mu.Unlock()
+			return best, false, nil
+		}
+		if !full {
+			break
+		}
+		// All connections are being dialed, wait for one of them.
+		if p.dialDone == nil {
+			p.dialDone = make(chan struct{})
+		}
+		done := p.dialDone
+		p.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		p.mu.Lock()
+	}
+	// Reserve a slot for the new connection, then dial it without holding the lock.
+	p.dialing++
+	idleTimeout := p.idleTimeout
+	p.mu.Unlock()
+	conn, err := dialDoQ(ctx, p.endpoint, tlsConfig, &quic.Config{MaxIdleTimeout: idleTimeout}, early)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if p.dialDone != nil {
+		close(p.dialDone)
+		p.dialDone = nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	dc := &doqConn{conn: conn, inflight: 1}
+	p.conns = append(p.conns, dc)
+	return dc, true, nil
+}
+
+// release releases a connection returned by getConn. The connection is closed if the query
+// failed because of the connection, errors of the query stream only, like the query deadline
+// being exceeded, do not affect other queries in flight on the connection.
+func (p *doqPool) release(dc *doqConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dc.inflight--
+	if err == nil || (dc.conn.Context().Err() == nil && !isDoQConnError(err)) {
+		return
+	}
+	_ = dc.conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+	p.conns = slices.DeleteFunc(p.conns, func(c *doqConn) bool { return c == dc })
+}
+
+// isDoQConnError reports whether err returned by a query means its QUIC connection is unusable.
+// io.EOF is returned by some servers on connections which were open for a long time, see resolve.
+func isDoQConnError(err error) bool {
+	var (
+		appErr       *quic.ApplicationError
+		transportErr *quic.TransportError
+		idleErr      *quic.IdleTimeoutError
+		resetErr     *quic.StatelessResetError
+		handshakeErr *quic.HandshakeTimeoutError
+		versionErr   *quic.VersionNegotiationError
+	)
+	return errors.Is(err, io.EOF) || errors.Is(err, quic.Err0RTTRejected) ||
+		errors.As(err, &appErr) || errors.As(err, &transportErr) || errors.As(err, &idleErr) ||
+		errors.As(err, &resetErr) || errors.As(err, &handshakeErr) || errors.As(err, &versionErr)
+}
+
+// reset closes all connections of the pool. Queries in flight on reused connections are
+// sent again using new connections, which resume TLS sessions from the session cache,
+// so they are sent as 0-RTT data, without waiting for a handshake.
+func (p *doqPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, dc := range p.conns {
+		_ = dc.conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+	}
+	clear(p.conns)
+	p.conns = p.conns[:0]
+}
+
+// dialDoQ dials a QUIC connection to endpoint. If early is true, the connection is returned
+// before the handshake completes, so the query could be sent as 0-RTT data when resuming
+// a session from tlsConfig.ClientSessionCache.
+func dialDoQ(ctx context.Context, endpoint string, tlsConfig *tls.Config, config *quic.Config, early bool) (quic.Connection, error) {
+	if early {
+		return quic.DialAddrEarly(ctx, endpoint, tlsConfig, config)
+	}
+	return quic.DialAddr(ctx, endpoint, tlsConfig, config)
+}
@@ -16,3 +16,8 @@ type doqResolver struct {
 func (r *doqResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	return nil, errors.New("DoQ is not supported")
 }
+
+// doqPool is not used without QUIC support.
+type doqPool struct{}
+
+func (uc *UpstreamConfig) resetDoQConns() {}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -18,7 +19,7 @@ func (r *dotResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 	// dns.controld.dev first. By using a dialer with custom resolver,
 	// we ensure that we can always resolve the bootstrap domain
 	// regardless of the machine DNS status.
-	dialer := newDialer(net.JoinHostPort(bootstrapDNS, "53"))
+	dialer := r.uc.bootstrapDialer()
 	dnsTyp := uint16(0)
 	if msg != nil && len(msg.Question) > 0 {
 		dnsTyp = msg.Question[0].Qtype
@@ -28,16 +29,58 @@ func (r *dotResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 	dnsClient := &dns.Client{
 		Net:       tcpNet,
 		Dialer:    dialer,
-		TLSConfig: &tls.Config{RootCAs: r.uc.certPool},
+		TLSConfig: &tls.Config{RootCAs: r.uc.certPool, Time: Now},
 	}
+	r.uc.setupTLSConfig(dnsClient.TLSConfig)
 	endpoint := r.uc.Endpoint
+	if r.uc.Proxy != "" {
+		return r.resolveProxy(ctx, dnsClient, msg)
+	}
 	if r.uc.BootstrapIP != "" {
-		dnsClient.TLSConfig.ServerName = r.uc.Domain
+		dnsClient.TLSConfig.ServerName = r.uc.tlsServerName()
 		dnsClient.Net = "tcp-tls"
 		_, port, _ := net.SplitHostPort(endpoint)
 		endpoint = net.JoinHostPort(r.uc.BootstrapIP, port)
 	}
 
-	answer, _, err := dnsClient.ExchangeContext(ctx, msg, endpoint)
+	p := r.uc.tcpPipeline(dnsClient.Net+"://"+endpoint, func(ctx context.Context) (net.Conn, error) {
+		return dialTLS(ctx, dialer, strings.TrimSuffix(dnsClient.Net, "-tls"), endpoint, dnsClient.TLSConfig)
+	})
+	return p.Exchange(ctx, msg)
+}
+
+// dialTLS connects to the address on the named network, then performs TLS handshake using config.
+func dialTLS(ctx context.Context, dialer *net.Dialer, network, address string, config *tls.Config) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(address)
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// resolveProxy resolves msg using a TLS connection tunneled through the upstream proxy.
+func (r *dotResolver) resolveProxy(ctx context.Context, dnsClient *dns.Client, msg *dns.Msg) (*dns.Msg, error) {
+	pd, err := r.uc.proxyContextDialer()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := r.uc.dialProxy(ctx, pd, r.uc.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	dnsClient.TLSConfig.ServerName = r.uc.tlsServerName()
+	co := &dns.Conn{Conn: tls.Client(conn, dnsClient.TLSConfig)}
+	defer co.Close()
+	answer, _, err := dnsClient.ExchangeWithConnContext(ctx, msg, co)
 	return answer, err
 }
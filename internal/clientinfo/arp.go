@@ -1,10 +1,30 @@
 package clientinfo
 
-import "sync"
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func init() {
+	registerProvider("ARP", priorityARP, func(t *Table) (Provider, error) {
+		if !t.discoverARP() {
+			return nil, nil
+		}
+		t.arp = &arpDiscover{}
+		ctrld.ProxyLogger.Load().Debug().Msg("start arp discovery")
+		return t.arp, t.arp.refresh()
+	})
+}
 
 type arpDiscover struct {
-	mac sync.Map // ip  => mac
-	ip  sync.Map // mac => ip
+	mac      sync.Map // ip  => mac
+	ip       sync.Map // mac => ip
+	lastSeen sync.Map // ip  => time.Time
 }
 
 func (a *arpDiscover) refresh() error {
@@ -12,6 +32,31 @@ func (a *arpDiscover) refresh() error {
 	return nil
 }
 
+// store saves the given ARP entry. If the IP was used by another device before,
+// the association of that device with the IP is invalidated.
+func (a *arpDiscover) store(ip, mac string) {
+	if oldMac, ok := a.mac.Swap(ip, mac); ok && oldMac != mac {
+		a.ip.CompareAndDelete(oldMac, ip)
+	}
+	a.ip.Store(mac, ip)
+	a.lastSeen.Store(ip, time.Now())
+}
+
+// expire removes ARP entries which were last seen before the given time.
+func (a *arpDiscover) expire(before time.Time) {
+	a.lastSeen.Range(func(key, value any) bool {
+		if !value.(time.Time).Before(before) {
+			return true
+		}
+		ip := key.(string)
+		a.lastSeen.Delete(ip)
+		if mac, ok := a.mac.LoadAndDelete(ip); ok {
+			a.ip.CompareAndDelete(mac, ip)
+		}
+		return true
+	})
+}
+
 func (a *arpDiscover) LookupIP(mac string) string {
 	val, ok := a.ip.Load(mac)
 	if !ok {
@@ -47,3 +92,27 @@ func (a *arpDiscover) List() []string {
 	})
 	return ips
 }
+
+// normalizeArpMac returns the MAC address from ARP table entry in canonical form,
+// or empty string if the entry is not a valid unicast MAC address.
+//
+// On BSD/Darwin, "arp -an" output omits leading zeros, e.g: "0:1:2:a:b:c".
+func normalizeArpMac(s string) string {
+	parts := strings.Split(s, ":")
+	if len(parts) == 6 {
+		for i, p := range parts {
+			if len(p) == 1 {
+				parts[i] = "0" + p
+			}
+		}
+	}
+	hw, err := net.ParseMAC(strings.Join(parts, ":"))
+	if err != nil || len(hw) != 6 {
+		return ""
+	}
+	// Zero and multicast/broadcast addresses are not clients.
+	if bytes.Equal(hw, make(net.HardwareAddr, 6)) || hw[0]&0x01 != 0 {
+		return ""
+	}
+	return hw.String()
+}
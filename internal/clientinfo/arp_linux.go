@@ -2,13 +2,38 @@ package clientinfo
 
 import (
 	"bufio"
+	"bytes"
+	"net"
 	"os"
 	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/Control-D-Inc/ctrld"
 )
 
 const procNetArpFile = "/proc/net/arp"
 
+// scan populates ARP table using the kernel neighbor table, falling back
+// to /proc/net/arp if netlink is not available.
 func (a *arpDiscover) scan() {
+	neighs, err := netlink.NeighList(0, netlink.FAMILY_V4)
+	if err != nil {
+		ctrld.ProxyLogger.Load().Debug().Err(err).Msg("could not get neigh list, reading from " + procNetArpFile)
+		a.scanProcNetArp()
+		return
+	}
+	for _, n := range neighs {
+		if !validNeigh(n) {
+			continue
+		}
+		ip := n.IP.String()
+		mac := n.HardwareAddr.String()
+		a.store(ip, mac)
+	}
+}
+
+func (a *arpDiscover) scanProcNetArp() {
 	f, err := os.Open(procNetArpFile)
 	if err != nil {
 		return
@@ -20,9 +45,26 @@ func (a *arpDiscover) scan() {
 	for s.Scan() {
 		line := s.Text()
 		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		// Flags 0x0 means the entry is incomplete.
+		if fields[2] == "0x0" {
+			continue
+		}
 		ip := fields[0]
-		mac := fields[3]
-		a.mac.Store(ip, mac)
-		a.ip.Store(mac, ip)
+		mac := normalizeArpMac(fields[3])
+		if mac == "" {
+			continue
+		}
+		a.store(ip, mac)
+	}
+}
+
+// validNeigh reports whether n is a reachable neighbor with valid MAC address.
+func validNeigh(n netlink.Neigh) bool {
+	if n.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED|netlink.NUD_NOARP) != 0 {
+		return false
 	}
+	return len(n.HardwareAddr) == 6 && !bytes.Equal(n.HardwareAddr, make(net.HardwareAddr, 6))
 }
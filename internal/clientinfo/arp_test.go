@@ -3,6 +3,7 @@ package clientinfo
 import (
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestArpScan(t *testing.T) {
@@ -21,3 +22,53 @@ func TestArpScan(t *testing.T) {
 		}
 	}
 }
+
+func Test_arpDiscover_expire(t *testing.T) {
+	a := &arpDiscover{}
+	a.store("192.168.1.10", "00:00:00:00:00:01")
+	a.store("192.168.1.11", "00:00:00:00:00:02")
+	a.lastSeen.Store("192.168.1.10", time.Now().Add(-2*time.Hour))
+	// IP reused by another device.
+	a.store("192.168.1.11", "00:00:00:00:00:03")
+
+	a.expire(time.Now().Add(-time.Hour))
+
+	if got := a.LookupMac("192.168.1.10"); got != "" {
+		t.Errorf("expired entry must be removed, got: %q", got)
+	}
+	if got := a.LookupIP("00:00:00:00:00:01"); got != "" {
+		t.Errorf("expired entry must be removed, got: %q", got)
+	}
+	if got := a.LookupIP("00:00:00:00:00:02"); got != "" {
+		t.Errorf("old device must not have reused ip, got: %q", got)
+	}
+	if got := a.LookupMac("192.168.1.11"); got != "00:00:00:00:00:03" {
+		t.Errorf("unexpected mac, want: 00:00:00:00:00:03, got: %q", got)
+	}
+}
+
+func Test_normalizeArpMac(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"canonical", "e6:20:59:b8:c1:6d", "e6:20:59:b8:c1:6d"},
+		{"upper case", "E6:20:59:B8:C1:6D", "e6:20:59:b8:c1:6d"},
+		{"bsd omitted leading zeros", "0:1:2:a:b:c", "00:01:02:0a:0b:0c"},
+		{"incomplete", "(incomplete)", ""},
+		{"zero", "00:00:00:00:00:00", ""},
+		{"broadcast", "ff:ff:ff:ff:ff:ff", ""},
+		{"multicast", "01:00:5e:00:00:fb", ""},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := normalizeArpMac(tc.in); got != tc.want {
+				t.Errorf("unexpected result, want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
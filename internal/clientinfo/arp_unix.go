@@ -23,8 +23,11 @@ func (a *arpDiscover) scan() {
 		ip := strings.ReplaceAll(fields[1], "(", "")
 		ip = strings.ReplaceAll(ip, ")", "")
 
-		mac := fields[3]
-		a.mac.Store(ip, mac)
-		a.ip.Store(mac, ip)
+		// Incomplete entries have "(incomplete)" as mac address.
+		mac := normalizeArpMac(fields[3])
+		if mac == "" {
+			continue
+		}
+		a.store(ip, mac)
 	}
 }
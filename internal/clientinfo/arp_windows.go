@@ -31,8 +31,10 @@ func (a *arpDiscover) scan() {
 		}
 
 		ip := fields[0]
-		mac := strings.ReplaceAll(fields[1], "-", ":")
-		a.mac.Store(ip, mac)
-		a.ip.Store(mac, ip)
+		mac := normalizeArpMac(strings.ReplaceAll(fields[1], "-", ":"))
+		if mac == "" {
+			continue
+		}
+		a.store(ip, mac)
 	}
 }
@@ -3,15 +3,14 @@ package clientinfo
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/netip"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Control-D-Inc/ctrld"
 	"github.com/Control-D-Inc/ctrld/internal/controld"
+	"github.com/Control-D-Inc/ctrld/internal/router"
 )
 
 // IpResolver is the interface for retrieving IP from Mac.
@@ -51,6 +50,11 @@ type refresher interface {
 	refresh() error
 }
 
+type expirer interface {
+	// expire removes entries which were last seen before the given time.
+	expire(before time.Time)
+}
+
 type ipLister interface {
 	fmt.Stringer
 	// List returns list of ip known by the resolver.
@@ -64,15 +68,41 @@ type Client struct {
 	Source            map[string]struct{}
 	QueryCount        int64
 	IncludeQueryCount bool
+	// LastQuery is the time of the last query from the client, zero if not queried yet.
+	LastQuery time.Time
+	// Listener and Policy are the listener and policy which the last query hit.
+	Listener string
+	Policy   string
+	// DeviceClass is the device type classified by DHCP fingerprint, e.g: "iphone", "printer".
+	DeviceClass string
+}
+
+// queryRecord records the last query from a client.
+type queryRecord struct {
+	time     time.Time
+	listener string
+	policy   string
 }
 
+// maxQueryRecordAge is the age after which a query record is removed.
+const maxQueryRecordAge = 24 * time.Hour
+
+// defaultEntryTTL is the default age after which a discovered entry, which is not seen anymore, is expired.
+const defaultEntryTTL = 24 * time.Hour
+
 type Table struct {
 	ipResolvers       []IpResolver
 	macResolvers      []MacResolver
 	hostnameResolvers []HostnameResolver
 	refreshers        []refresher
+	expirers          []expirer
+	ipListers         []ipLister
+	ipFinders         []ipFinder
 	initOnce          sync.Once
 	refreshInterval   int
+	entryTTL          time.Duration
+	queries           sync.Map // ip => *queryRecord
+	fingerprints      sync.Map // mac => *fingerprint
 
 	dhcp           *dhcp
 	merlin         *merlinDiscover
@@ -81,9 +111,15 @@ type Table struct {
 	ndp            *ndpDiscover
 	ptr            *ptrDiscover
 	mdns           *mdns
+	netbios        *netbiosDiscover
+	unifi          *unifiDiscover
+	persist        *persistDiscover
+	static         *staticClients
 	hf             *hostsFile
 	vni            *virtualNetworkIface
+	prefixes       *prefixTracker
 	svcCfg         ctrld.ServiceConfig
+	clients        map[string]*ctrld.ClientConfig
 	quitCh         chan struct{}
 	selfIP         string
 	cdUID          string
@@ -95,13 +131,19 @@ func NewTable(cfg *ctrld.Config, selfIP, cdUID string, ns []string) *Table {
 	if refreshInterval <= 0 {
 		refreshInterval = 2 * 60 // 2 minutes
 	}
+	entryTTL := defaultEntryTTL
+	if cfg.Service.DiscoverEntryTTL > 0 {
+		entryTTL = time.Duration(cfg.Service.DiscoverEntryTTL) * time.Second
+	}
 	return &Table{
 		svcCfg:          cfg.Service,
+		clients:         cfg.Clients,
 		quitCh:          make(chan struct{}),
 		selfIP:          selfIP,
 		cdUID:           cdUID,
 		ptrNameservers:  ns,
 		refreshInterval: refreshInterval,
+		entryTTL:        entryTTL,
 	}
 }
 
@@ -122,6 +164,9 @@ func (t *Table) RefreshLoop(ctx context.Context) {
 			for _, r := range t.refreshers {
 				_ = r.refresh()
 			}
+			t.expireEntries(time.Now())
+			t.pruneQueries(time.Now())
+			t.prefixes.refresh()
 		case <-ctx.Done():
 			close(t.quitCh)
 			return
@@ -134,143 +179,24 @@ func (t *Table) Init() {
 }
 
 func (t *Table) init() {
+	// On routers, track delegated IPv6 prefixes, so LAN records are still served
+	// after the ISP rotates the prefix.
+	if router.Name() != "" {
+		t.prefixes = newPrefixTracker()
+		t.prefixes.refresh()
+	}
 	// Custom client ID presents, use it as the only source.
 	if _, clientID := controld.ParseRawUID(t.cdUID); clientID != "" {
 		ctrld.ProxyLogger.Load().Debug().Msg("start self discovery")
 		t.dhcp = &dhcp{selfIP: t.selfIP}
 		t.dhcp.addSelf()
-		t.ipResolvers = append(t.ipResolvers, t.dhcp)
-		t.macResolvers = append(t.macResolvers, t.dhcp)
-		t.hostnameResolvers = append(t.hostnameResolvers, t.dhcp)
+		t.addProvider(t.dhcp)
 		return
 	}
 
-	// Otherwise, process all possible sources in order, that means
+	// Otherwise, process all registered providers in priority order, that means
 	// the first result of IP/MAC/Hostname lookup will be used.
-	//
-	// Routers custom clients:
-	//  - Merlin
-	//  - Ubios
-	if t.discoverDHCP() || t.discoverARP() {
-		t.merlin = &merlinDiscover{}
-		t.ubios = &ubiosDiscover{}
-		discovers := map[string]interface {
-			refresher
-			HostnameResolver
-		}{
-			"Merlin": t.merlin,
-			"Ubios":  t.ubios,
-		}
-		for platform, discover := range discovers {
-			if err := discover.refresh(); err != nil {
-				ctrld.ProxyLogger.Load().Error().Err(err).Msgf("could not init %s discover", platform)
-			} else {
-				t.hostnameResolvers = append(t.hostnameResolvers, discover)
-				t.refreshers = append(t.refreshers, discover)
-			}
-		}
-	}
-	// Hosts file mapping.
-	if t.discoverHosts() {
-		t.hf = &hostsFile{}
-		ctrld.ProxyLogger.Load().Debug().Msg("start hosts file discovery")
-		if err := t.hf.init(); err != nil {
-			ctrld.ProxyLogger.Load().Error().Err(err).Msg("could not init hosts file discover")
-		} else {
-			t.hostnameResolvers = append(t.hostnameResolvers, t.hf)
-			t.refreshers = append(t.refreshers, t.hf)
-		}
-		go t.hf.watchChanges()
-	}
-	// DHCP lease files.
-	if t.discoverDHCP() {
-		t.dhcp = &dhcp{selfIP: t.selfIP}
-		ctrld.ProxyLogger.Load().Debug().Msg("start dhcp discovery")
-		if err := t.dhcp.init(); err != nil {
-			ctrld.ProxyLogger.Load().Error().Err(err).Msg("could not init DHCP discover")
-		} else {
-			t.ipResolvers = append(t.ipResolvers, t.dhcp)
-			t.macResolvers = append(t.macResolvers, t.dhcp)
-			t.hostnameResolvers = append(t.hostnameResolvers, t.dhcp)
-		}
-		go t.dhcp.watchChanges()
-	}
-	// ARP/NDP table.
-	if t.discoverARP() {
-		t.arp = &arpDiscover{}
-		t.ndp = &ndpDiscover{}
-		ctrld.ProxyLogger.Load().Debug().Msg("start arp discovery")
-		discovers := map[string]interface {
-			refresher
-			IpResolver
-			MacResolver
-		}{
-			"ARP": t.arp,
-			"NDP": t.ndp,
-		}
-
-		for protocol, discover := range discovers {
-			if err := discover.refresh(); err != nil {
-				ctrld.ProxyLogger.Load().Error().Err(err).Msgf("could not init %s discover", protocol)
-			} else {
-				t.ipResolvers = append(t.ipResolvers, discover)
-				t.macResolvers = append(t.macResolvers, discover)
-				t.refreshers = append(t.refreshers, discover)
-			}
-		}
-		ctx, cancel := context.WithCancel(context.Background())
-		go func() {
-			<-t.quitCh
-			cancel()
-		}()
-		go t.ndp.listen(ctx)
-	}
-	// PTR lookup.
-	if t.discoverPTR() {
-		t.ptr = &ptrDiscover{resolver: ctrld.NewPrivateResolver()}
-		if len(t.ptrNameservers) > 0 {
-			nss := make([]string, 0, len(t.ptrNameservers))
-			for _, ns := range t.ptrNameservers {
-				host, port := ns, "53"
-				if h, p, err := net.SplitHostPort(ns); err == nil {
-					host, port = h, p
-				}
-				// Only use valid ip:port pair.
-				if _, portErr := strconv.Atoi(port); portErr == nil && port != "0" && net.ParseIP(host) != nil {
-					nss = append(nss, net.JoinHostPort(host, port))
-				} else {
-					ctrld.ProxyLogger.Load().Warn().Msgf("ignoring invalid nameserver for ptr discover: %q", ns)
-				}
-			}
-			if len(nss) > 0 {
-				t.ptr.resolver = ctrld.NewResolverWithNameserver(nss)
-				ctrld.ProxyLogger.Load().Debug().Msgf("using nameservers %v for ptr discovery", nss)
-			}
-
-		}
-		ctrld.ProxyLogger.Load().Debug().Msg("start ptr discovery")
-		if err := t.ptr.refresh(); err != nil {
-			ctrld.ProxyLogger.Load().Error().Err(err).Msg("could not init PTR discover")
-		} else {
-			t.hostnameResolvers = append(t.hostnameResolvers, t.ptr)
-			t.refreshers = append(t.refreshers, t.ptr)
-		}
-	}
-	// mdns.
-	if t.discoverMDNS() {
-		t.mdns = &mdns{}
-		ctrld.ProxyLogger.Load().Debug().Msg("start mdns discovery")
-		if err := t.mdns.init(t.quitCh); err != nil {
-			ctrld.ProxyLogger.Load().Error().Err(err).Msg("could not init mDNS discover")
-		} else {
-			t.hostnameResolvers = append(t.hostnameResolvers, t.mdns)
-		}
-	}
-	// VPN clients.
-	if t.discoverDHCP() || t.discoverARP() {
-		t.vni = &virtualNetworkIface{}
-		t.hostnameResolvers = append(t.hostnameResolvers, t.vni)
-	}
+	t.initProviders()
 }
 
 func (t *Table) LookupIP(mac string) string {
@@ -295,6 +221,19 @@ func (t *Table) LookupMac(ip string) string {
 
 func (t *Table) LookupHostname(ip, mac string) string {
 	t.initOnce.Do(t.init)
+	if name := t.lookupHostname(ip, mac); name != "" {
+		return name
+	}
+	// The client may be only known by its address in a previous delegated prefix.
+	for _, addr := range t.prefixes.previous(ip) {
+		if name := t.lookupHostname(addr, ""); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+func (t *Table) lookupHostname(ip, mac string) string {
 	for _, r := range t.hostnameResolvers {
 		if name := r.LookupHostnameByIP(ip); name != "" {
 			return name
@@ -369,8 +308,7 @@ func (t *Table) ListClients() []*Client {
 		_ = r.refresh()
 	}
 	ipMap := make(map[string]*Client)
-	il := []ipLister{t.dhcp, t.arp, t.ndp, t.ptr, t.mdns, t.vni}
-	for _, ir := range il {
+	for _, ir := range t.ipListers {
 		for _, ip := range ir.List() {
 			c, ok := ipMap[ip]
 			if !ok {
@@ -384,6 +322,17 @@ func (t *Table) ListClients() []*Client {
 			}
 		}
 	}
+	// Clients which queried ctrld, but are not discovered by any sources.
+	t.queries.Range(func(key, value any) bool {
+		ip := key.(string)
+		if _, ok := ipMap[ip]; ok {
+			return true
+		}
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			ipMap[ip] = &Client{IP: addr, Source: map[string]struct{}{}}
+		}
+		return true
+	})
 	clientsByMAC := make(map[string]*Client)
 	for ip := range ipMap {
 		c := ipMap[ip]
@@ -412,11 +361,51 @@ func (t *Table) ListClients() []*Client {
 		if cFromMac := clientsByMAC[c.Mac]; cFromMac != nil && c.Hostname == "" {
 			c.Hostname = cFromMac.Hostname
 		}
+		if v, ok := t.queries.Load(c.IP.String()); ok {
+			qr := v.(*queryRecord)
+			c.LastQuery, c.Listener, c.Policy = qr.time, qr.listener, qr.policy
+		}
+		c.DeviceClass = t.LookupDeviceClass(c.Mac)
 		clients = append(clients, c)
 	}
 	return clients
 }
 
+// RecordQuery records a query from client with given ip, which hit the given listener and policy.
+func (t *Table) RecordQuery(ip, listener, policy string) {
+	if t == nil || ip == "" {
+		return
+	}
+	t.queries.Store(ip, &queryRecord{time: time.Now(), listener: listener, policy: policy})
+}
+
+// expireEntries removes entries of providers which are not seen for longer than entry TTL.
+func (t *Table) expireEntries(now time.Time) {
+	before := now.Add(-t.entryTTL)
+	for _, e := range t.expirers {
+		e.expire(before)
+	}
+}
+
+// pruneQueries removes query records which are older than maxQueryRecordAge.
+func (t *Table) pruneQueries(now time.Time) {
+	t.queries.Range(func(key, value any) bool {
+		if now.Sub(value.(*queryRecord).time) > maxQueryRecordAge {
+			t.queries.Delete(key)
+		}
+		return true
+	})
+}
+
+// listIPs returns all IPs known by client info providers.
+func (t *Table) listIPs() []string {
+	var ips []string
+	for _, l := range t.ipListers {
+		ips = append(ips, l.List()...)
+	}
+	return ips
+}
+
 // StoreVPNClient stores client info for VPN clients.
 func (t *Table) StoreVPNClient(ci *ctrld.ClientInfo) {
 	if ci == nil || t.vni == nil {
@@ -437,9 +426,10 @@ func (t *Table) LookupIPByHostname(hostname string, v6 bool) *netip.Addr {
 	if t == nil {
 		return nil
 	}
-	for _, finder := range []ipFinder{t.hf, t.ptr, t.mdns, t.dhcp} {
+	for _, finder := range t.ipFinders {
 		if addr := finder.lookupIPByHostname(hostname, v6); addr != "" {
 			if ip, err := netip.ParseAddr(addr); err == nil {
+				ip = t.prefixes.toCurrent(ip)
 				return &ip
 			}
 		}
@@ -468,6 +458,14 @@ func (t *Table) discoverMDNS() bool {
 	return *t.svcCfg.DiscoverMDNS
 }
 
+func (t *Table) discoverMDNSActive() bool {
+	return t.svcCfg.DiscoverMDNSActive
+}
+
+func (t *Table) discoverNetBIOS() bool {
+	return t.svcCfg.DiscoverNetBIOS
+}
+
 func (t *Table) discoverPTR() bool {
 	if t.svcCfg.DiscoverPtr == nil {
 		return true
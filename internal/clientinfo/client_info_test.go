@@ -2,6 +2,7 @@ package clientinfo
 
 import (
 	"testing"
+	"time"
 )
 
 func Test_normalizeIP(t *testing.T) {
@@ -65,6 +66,7 @@ func TestTable_ListClients(t *testing.T) {
 	table.mdns = &mdns{}
 	table.mdns.name.Store(ipv6_2, hostname)
 	table.hostnameResolvers = append(table.hostnameResolvers, table.mdns)
+	table.ipListers = append(table.ipListers, table.ndp, table.mdns)
 
 	for _, c := range table.ListClients() {
 		if c.Hostname != hostname {
@@ -72,3 +74,38 @@ func TestTable_ListClients(t *testing.T) {
 		}
 	}
 }
+
+func TestTable_RecordQuery(t *testing.T) {
+	known := "192.168.1.2"
+	unknown := "192.168.1.3"
+	table := &Table{}
+	table.mdns = &mdns{}
+	table.mdns.name.Store(known, "foo")
+	table.hostnameResolvers = append(table.hostnameResolvers, table.mdns)
+	table.ipListers = append(table.ipListers, table.mdns)
+
+	table.RecordQuery(known, "listener.0", "My Policy: network.0")
+	table.RecordQuery(unknown, "listener.1", "")
+
+	clients := make(map[string]*Client)
+	for _, c := range table.ListClients() {
+		clients[c.IP.String()] = c
+	}
+	if len(clients) != 2 {
+		t.Fatalf("unexpected clients: %v", clients)
+	}
+	c := clients[known]
+	if c.LastQuery.IsZero() || c.Listener != "listener.0" || c.Policy != "My Policy: network.0" {
+		t.Errorf("unexpected query record for known client: %+v", c)
+	}
+	if c := clients[unknown]; c.Listener != "listener.1" || len(c.Source) != 0 {
+		t.Errorf("unexpected undiscovered client: %+v", c)
+	}
+
+	table.pruneQueries(time.Now().Add(maxQueryRecordAge + time.Minute))
+	for _, c := range table.ListClients() {
+		if !c.LastQuery.IsZero() {
+			t.Errorf("query record was not pruned: %+v", c)
+		}
+	}
+}
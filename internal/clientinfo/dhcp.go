@@ -6,12 +6,15 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/netip"
 	"os"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"tailscale.com/net/interfaces"
@@ -21,14 +24,31 @@ import (
 	"github.com/Control-D-Inc/ctrld/internal/router"
 )
 
+func init() {
+	registerProvider("DHCP", priorityDHCP, func(t *Table) (Provider, error) {
+		if !t.discoverDHCP() {
+			return nil, nil
+		}
+		t.dhcp = &dhcp{selfIP: t.selfIP}
+		ctrld.ProxyLogger.Load().Debug().Msg("start dhcp discovery")
+		err := t.dhcp.init()
+		go t.dhcp.watchChanges()
+		return t.dhcp, err
+	})
+}
+
 type dhcp struct {
 	mac2name sync.Map // mac => name
 	ip2name  sync.Map // ip  => name
 	ip       sync.Map // mac => ip
 	mac      sync.Map // ip  => mac
+	lastSeen sync.Map // ip  => time.Time, only for entries read from lease files.
+	vendor   sync.Map // mac => vendor class identifier, only for ISC dhcpd lease files.
 
-	watcher *fsnotify.Watcher
-	selfIP  string
+	mu         sync.Mutex // guards leaseFiles, and serializes updating lease entries.
+	leaseFiles map[string]ctrld.LeaseFileFormat
+	watcher    *fsnotify.Watcher
+	selfIP     string
 }
 
 func (d *dhcp) init() error {
@@ -69,6 +89,12 @@ func (d *dhcp) watchChanges() {
 				continue
 			}
 			if event.Has(fsnotify.Write) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Chmod) || event.Has(fsnotify.Remove) {
+				// The file may be replaced by renaming a new one over it, which drops the watch.
+				if event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove) {
+					if _, err := os.Stat(event.Name); err == nil {
+						_ = d.watcher.Add(event.Name)
+					}
+				}
 				format := clientInfoFiles[event.Name]
 				if err := d.readLeaseFile(event.Name, format); err != nil && !os.IsNotExist(err) {
 					ctrld.ProxyLogger.Load().Err(err).Str("file", event.Name).Msg("leases file changed but failed to update client info")
@@ -178,6 +204,12 @@ func (d *dhcp) addLeaseFile(name string, format ctrld.LeaseFileFormat) error {
 		return fmt.Errorf("could not read lease file: %w", err)
 	}
 	clientInfoFiles[name] = format
+	d.mu.Lock()
+	if d.leaseFiles == nil {
+		d.leaseFiles = make(map[string]ctrld.LeaseFileFormat)
+	}
+	d.leaseFiles[name] = format
+	d.mu.Unlock()
 	return d.watcher.Add(name)
 }
 
@@ -190,6 +222,8 @@ func (d *dhcp) readLeaseFile(name string, format ctrld.LeaseFileFormat) error {
 		return d.iscDHCPReadClientInfoFile(name)
 	case ctrld.KeaDHCP4:
 		return d.keaDhcp4ReadClientInfoFile(name)
+	case ctrld.Udhcpd:
+		return d.udhcpdReadClientInfoFile(name)
 	}
 	return fmt.Errorf("unsupported format: %s, file: %s", format, name)
 }
@@ -224,16 +258,7 @@ func (d *dhcp) dnsmasqReadClientInfoReader(reader io.Reader) error {
 			ctrld.ProxyLogger.Load().Warn().Msgf("invalid ip address entry: %q", ip)
 			ip = ""
 		}
-
-		d.mac.Store(ip, mac)
-		d.ip.Store(mac, ip)
-		hostname := string(fields[3])
-		if hostname == "*" {
-			return nil
-		}
-		name := normalizeHostname(hostname)
-		d.mac2name.Store(mac, name)
-		d.ip2name.Store(ip, name)
+		d.storeLease(ip, mac, string(fields[3]))
 		return nil
 	})
 }
@@ -252,18 +277,20 @@ func (d *dhcp) iscDHCPReadClientInfoFile(name string) error {
 // but by reading from an io.Reader instead of file.
 func (d *dhcp) iscDHCPReadClientInfoReader(reader io.Reader) error {
 	s := bufio.NewScanner(reader)
-	var ip, mac, hostname string
+	var ip, mac, hostname, vendor string
+	active := true
 	for s.Scan() {
-		line := s.Text()
+		line := strings.TrimSpace(s.Text())
 		if strings.HasPrefix(line, "}") {
-			d.mac.Store(ip, mac)
-			d.ip.Store(mac, ip)
-			if hostname != "" && hostname != "*" {
-				name := normalizeHostname(hostname)
-				d.mac2name.Store(mac, name)
-				d.ip2name.Store(ip, hostname)
-				ip, mac, hostname = "", "", ""
+			// The lease file is append only, a lease for the same IP may be recorded
+			// multiple times, so only taking active leases into account.
+			if ip != "" && mac != "" && active {
+				d.storeLease(ip, mac, hostname)
+				if vendor != "" {
+					d.vendor.Store(mac, vendor)
+				}
 			}
+			ip, mac, hostname, vendor, active = "", "", "", "", true
 			continue
 		}
 		fields := strings.Fields(line)
@@ -277,6 +304,11 @@ func (d *dhcp) iscDHCPReadClientInfoReader(reader io.Reader) error {
 				ctrld.ProxyLogger.Load().Warn().Msgf("invalid ip address entry: %q", ip)
 				ip = ""
 			}
+		case "binding":
+			// binding state active;
+			if len(fields) >= 3 && fields[1] == "state" {
+				active = strings.TrimRight(fields[2], ";") == "active"
+			}
 		case "hardware":
 			if len(fields) >= 3 {
 				mac = strings.ToLower(strings.TrimRight(fields[2], ";"))
@@ -287,9 +319,16 @@ func (d *dhcp) iscDHCPReadClientInfoReader(reader io.Reader) error {
 			}
 		case "client-hostname":
 			hostname = strings.Trim(fields[1], `";`)
+		case "set":
+			// set vendor-class-identifier = "MSFT 5.0";
+			if fields[1] == "vendor-class-identifier" {
+				if _, v, ok := strings.Cut(line, "="); ok {
+					vendor = strings.Trim(strings.TrimSpace(v), `";`)
+				}
+			}
 		}
 	}
-	return nil
+	return s.Err()
 }
 
 // keaDhcp4ReadClientInfoFile populates dhcp table with client info reading from kea dhcp4 lease file.
@@ -321,6 +360,10 @@ func (d *dhcp) keaDhcp4ReadClientInfoReader(r io.Reader) error {
 		if record[0] == "address" {
 			continue // skip header.
 		}
+		// State is at 10th field, 0 is default (active) state, others are declined/expired-reclaimed.
+		if len(record) >= 10 && record[9] != "" && record[9] != "0" {
+			continue
+		}
 		mac := record[1]
 		if _, err := net.ParseMAC(mac); err != nil { // skip invalid MAC
 			continue
@@ -330,20 +373,182 @@ func (d *dhcp) keaDhcp4ReadClientInfoReader(r io.Reader) error {
 			ctrld.ProxyLogger.Load().Warn().Msgf("invalid ip address entry: %q", ip)
 			ip = ""
 		}
+		d.storeLease(ip, mac, record[8])
+	}
+	return nil
+}
+
+// udhcpdLeaseSize is the size of a lease record in busybox udhcpd lease file.
+//
+//	struct dyn_lease {
+//		uint32_t expires;
+//		uint32_t lease_nip;
+//		uint8_t lease_mac[6];
+//		char hostname[20];
+//		uint8_t pad[2];
+//	}
+const udhcpdLeaseSize = 36
+
+// udhcpdReadClientInfoFile populates dhcp table with client info reading from busybox udhcpd lease file.
+func (d *dhcp) udhcpdReadClientInfoFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return d.udhcpdReadClientInfoReader(f)
+}
 
-		d.mac.Store(ip, mac)
-		d.ip.Store(mac, ip)
-		hostname := record[8]
-		if hostname == "*" {
+// udhcpdReadClientInfoReader performs the same task as udhcpdReadClientInfoFile,
+// but by reading from an io.Reader instead of file.
+//
+// Both the binary lease file written by udhcpd and the text output of "dumpleases" are supported.
+func (d *dhcp) udhcpdReadClientInfoReader(r io.Reader) error {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// Binary lease file always contains NUL bytes, in padding or hostname.
+	if bytes.IndexByte(buf, 0) == -1 {
+		return d.udhcpdDumpLeasesReadClientInfoReader(bytes.NewReader(buf))
+	}
+	// Since busybox 1.15, the lease file starts with 8 bytes timestamp.
+	if len(buf)%udhcpdLeaseSize == 8 {
+		buf = buf[8:]
+	}
+	for ; len(buf) >= udhcpdLeaseSize; buf = buf[udhcpdLeaseSize:] {
+		ip := net.IP(buf[4:8])
+		mac := net.HardwareAddr(buf[8:14])
+		if ip.IsUnspecified() || bytes.Equal(mac, make([]byte, 6)) {
 			continue
 		}
-		name := normalizeHostname(hostname)
-		d.mac2name.Store(mac, name)
-		d.ip2name.Store(ip, name)
+		hostname, _, _ := bytes.Cut(buf[14:34], []byte{0})
+		d.storeLease(ip.String(), mac.String(), string(hostname))
 	}
 	return nil
 }
 
+// udhcpdExpiresRe matches the "Expires in" column of "dumpleases" output, with whitespaces collapsed:
+// "expired", remaining time like "1 days 02:03:04" or "expires in 1 days 02:03:04", or absolute time
+// like "Wed Jun 30 21:49:08 1993" with "-a".
+var udhcpdExpiresRe = regexp.MustCompile(`^(expired|(expires in )?(\d+ days )?\d+:\d{2}:\d{2}|\w{3} \w{3} \d{1,2} \d{2}:\d{2}:\d{2} \d{4})$`)
+
+// udhcpdDumpLeasesReadClientInfoReader reads client info from "dumpleases" output:
+//
+//	Mac Address       IP Address      Host Name           Expires in
+//	00:11:22:33:44:55 192.168.1.100   host1               23:59:59
+//
+// The MAC and IP address are matched by their format, because the host name is
+// empty for some clients, and the expire time may span several fields.
+func (d *dhcp) udhcpdDumpLeasesReadClientInfoReader(r io.Reader) error {
+	return lineread.Reader(r, func(line []byte) error {
+		fields := strings.Fields(string(line))
+		macIdx := -1
+		for i, field := range fields {
+			if _, err := net.ParseMAC(field); err == nil {
+				macIdx = i
+				break
+			}
+		}
+		if macIdx == -1 {
+			// Header or invalid line, skip.
+			return nil
+		}
+		ipIdx := -1
+		for i := macIdx + 1; i < len(fields); i++ {
+			if net.ParseIP(normalizeIP(fields[i])) != nil {
+				ipIdx = i
+				break
+			}
+		}
+		if ipIdx == -1 {
+			ctrld.ProxyLogger.Load().Warn().Msgf("invalid lease entry: %q", line)
+			return nil
+		}
+		mac := strings.ToLower(fields[macIdx])
+		ip := normalizeIP(fields[ipIdx])
+		hostname := ""
+		// Host name is empty if only the expire time follows the IP address.
+		if rest := fields[ipIdx+1:]; len(rest) > 0 && !udhcpdExpiresRe.MatchString(strings.Join(rest, " ")) {
+			hostname = rest[0]
+		}
+		d.storeLease(ip, mac, hostname)
+		return nil
+	})
+}
+
+// storeLease saves the given lease to dhcp table. If the IP was leased to another
+// device before, the association of that device with the IP is invalidated.
+func (d *dhcp) storeLease(ip, mac, hostname string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if oldMac, ok := d.mac.Swap(ip, mac); ok && oldMac != mac {
+		d.ip.CompareAndDelete(oldMac, ip)
+		d.ip2name.Delete(ip)
+	}
+	d.ip.Store(mac, ip)
+	if ip != "" {
+		d.lastSeen.Store(ip, time.Now())
+	}
+	if hostname == "" || hostname == "*" {
+		return
+	}
+	name := normalizeHostname(hostname)
+	d.mac2name.Store(mac, name)
+	d.ip2name.Store(ip, name)
+}
+
+// expire removes lease entries which were last seen before the given time. Lease files
+// are read again before expiring, so active leases are kept even if lease files did not
+// change since the last read.
+func (d *dhcp) expire(before time.Time) {
+	if !d.hasExpired(before) {
+		return
+	}
+	d.mu.Lock()
+	files := maps.Clone(d.leaseFiles)
+	d.mu.Unlock()
+	for name, format := range files {
+		if err := d.readLeaseFile(name, format); err != nil && !os.IsNotExist(err) {
+			ctrld.ProxyLogger.Load().Err(err).Str("file", name).Msg("could not read lease file")
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastSeen.Range(func(key, value any) bool {
+		if !value.(time.Time).Before(before) {
+			return true
+		}
+		ip := key.(string)
+		d.lastSeen.Delete(ip)
+		d.ip2name.Delete(ip)
+		if mac, ok := d.mac.LoadAndDelete(ip); ok && d.ip.CompareAndDelete(mac, ip) {
+			d.mac2name.Delete(mac)
+			d.vendor.Delete(mac)
+		}
+		return true
+	})
+}
+
+// lookupVendorClass returns the vendor class identifier of the device with given mac.
+func (d *dhcp) lookupVendorClass(mac string) string {
+	if v, ok := d.vendor.Load(mac); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// hasExpired reports whether there is any lease entry which was last seen before the given time.
+func (d *dhcp) hasExpired(before time.Time) bool {
+	expired := false
+	d.lastSeen.Range(func(key, value any) bool {
+		expired = value.(time.Time).Before(before)
+		return !expired
+	})
+	return expired
+}
+
 // addSelf populates current host info to dhcp, so queries from
 // the host itself can be attached with proper client info.
 func (d *dhcp) addSelf() {
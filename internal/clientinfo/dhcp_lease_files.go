@@ -16,4 +16,11 @@ var clientInfoFiles = map[string]ctrld.LeaseFileFormat{
 	"/var/dhcpd/var/db/dhcpd.leases":           ctrld.IscDhcpd, // Pfsense
 	"/home/pi/.router/run/dhcp/dnsmasq.leases": ctrld.Dnsmasq,  // Firewalla
 	"/var/lib/kea/dhcp4.leases":                ctrld.KeaDHCP4, // Pfsense
+	"/config/dhcpd.leases":                     ctrld.IscDhcpd, // VyOS 1.3
+	"/config/dhcp/dhcp4-leases.csv":            ctrld.KeaDHCP4, // VyOS 1.4
+	"/var/lib/dhcp/dhcpd.leases":               ctrld.IscDhcpd, // Debian/Ubuntu isc-dhcp-server
+	"/var/lib/dhcpd/dhcpd.leases":              ctrld.IscDhcpd, // RHEL/Fedora dhcp-server
+	"/var/db/dhcpd.leases":                     ctrld.IscDhcpd, // FreeBSD isc-dhcp-server
+	"/var/lib/kea/kea-leases4.csv":             ctrld.KeaDHCP4, // Kea default memfile
+	"/var/lib/misc/udhcpd.leases":              ctrld.Udhcpd,   // busybox udhcpd
 }
@@ -2,8 +2,10 @@ package clientinfo
 
 import (
 	"io"
+	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test_readClientInfoReader(t *testing.T) {
@@ -60,6 +62,39 @@ lease 192.168.1.2 {
 			"00:00:00:00:00:02",
 			"host-2",
 		},
+		{
+			"isc-dhcpd free lease",
+			`lease 192.168.1.3 {
+  starts 4 2023/12/21 10:00:00;
+  binding state active;
+  next binding state free;
+  hardware ethernet 00:00:00:00:00:03;
+  client-hostname "host-3";
+}
+lease 192.168.1.4 {
+  binding state free;
+  hardware ethernet 00:00:00:00:00:06;
+  client-hostname "host-4";
+}
+`,
+			d.iscDHCPReadClientInfoReader,
+			"00:00:00:00:00:06",
+			"*",
+		},
+		{
+			"isc-dhcpd active lease",
+			`lease 192.168.1.3 {
+  starts 4 2023/12/21 10:00:00;
+  binding state active;
+  next binding state free;
+  hardware ethernet 00:00:00:00:00:03;
+  client-hostname "host-3.lan";
+}
+`,
+			d.iscDHCPReadClientInfoReader,
+			"00:00:00:00:00:03",
+			"host-3",
+		},
 		{
 			"",
 			`1685794060 00:00:00:00:00:04 192.168.0.209 example 00:00:00:00:00:04 9`,
@@ -92,6 +127,15 @@ lease 192.168.1.2 {
 			"00:00:00:00:00:05",
 			"*",
 		},
+		{
+			"kea-dhcp4 expired-reclaimed",
+			`address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id
+192.168.0.125,00:00:00:00:00:07,00:00:00:00:00:07,7200,1703290639,1,0,0,bar,2,,0
+`,
+			d.keaDhcp4ReadClientInfoReader,
+			"00:00:00:00:00:07",
+			"*",
+		},
 		{
 			"kea-dhcp4 bad",
 			`address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id
@@ -102,6 +146,75 @@ lease 192.168.1.2 {
 			"00:00:00:00:00:05",
 			"foo",
 		},
+		{
+			"udhcpd binary",
+			udhcpdLeaseFile(t, false, "192.168.1.10", "00:00:00:00:00:08", "host-8"),
+			d.udhcpdReadClientInfoReader,
+			"00:00:00:00:00:08",
+			"host-8",
+		},
+		{
+			"udhcpd binary with timestamp",
+			udhcpdLeaseFile(t, true, "192.168.1.11", "00:00:00:00:00:09", "host-9.lan"),
+			d.udhcpdReadClientInfoReader,
+			"00:00:00:00:00:09",
+			"host-9",
+		},
+		{
+			"udhcpd dumpleases",
+			`Mac Address       IP Address      Host Name           Expires in
+00:00:00:00:00:0a 192.168.1.12    host-10             23:59:59
+00:00:00:00:00:0b 192.168.1.13                        23:59:59
+`,
+			d.udhcpdReadClientInfoReader,
+			"00:00:00:00:00:0a",
+			"host-10",
+		},
+		{
+			"udhcpd dumpleases no hostname",
+			`Mac Address       IP Address      Host Name           Expires in
+00:00:00:00:00:0b 192.168.1.13                        23:59:59
+`,
+			d.udhcpdReadClientInfoReader,
+			"00:00:00:00:00:0b",
+			"*",
+		},
+		{
+			"udhcpd dumpleases multi-word expires",
+			`Mac Address       IP Address      Host Name           Expires in
+00:00:00:00:00:0c 192.168.1.14    host-12             expires in 1 days 02:03:04
+`,
+			d.udhcpdReadClientInfoReader,
+			"00:00:00:00:00:0c",
+			"host-12",
+		},
+		{
+			"udhcpd dumpleases no hostname multi-word expires",
+			`Mac Address       IP Address      Host Name           Expires in
+00:00:00:00:00:0d 192.168.1.15                        expires in 1 days 02:03:04
+`,
+			d.udhcpdReadClientInfoReader,
+			"00:00:00:00:00:0d",
+			"*",
+		},
+		{
+			"udhcpd dumpleases no hostname absolute expires",
+			`Mac Address       IP Address      Host Name           Expires in
+00:00:00:00:00:0e 192.168.1.16                        Wed Jun 30 21:49:08 1993
+`,
+			d.udhcpdReadClientInfoReader,
+			"00:00:00:00:00:0e",
+			"*",
+		},
+		{
+			"udhcpd dumpleases empty hostname expired",
+			`Mac Address       IP Address      Host Name           Expires in
+00:00:00:00:00:0f 192.168.1.17                        expired
+`,
+			d.udhcpdReadClientInfoReader,
+			"00:00:00:00:00:0f",
+			"*",
+		},
 	}
 
 	for _, tc := range tests {
@@ -139,3 +252,66 @@ func Test_dhcp_lookupIPByHostname(t *testing.T) {
 		t.Fatalf("unexpected result, want: %s, got: %s", want, got)
 	}
 }
+
+func Test_dhcp_storeLease_reassigned(t *testing.T) {
+	d := &dhcp{}
+	d.storeLease("192.168.1.10", "00:00:00:00:00:01", "host-1")
+	d.storeLease("192.168.1.10", "00:00:00:00:00:02", "")
+
+	if got := d.LookupMac("192.168.1.10"); got != "00:00:00:00:00:02" {
+		t.Errorf("unexpected mac, want: 00:00:00:00:00:02, got: %q", got)
+	}
+	if got := d.LookupIP("00:00:00:00:00:01"); got != "" {
+		t.Errorf("old device must not have reassigned ip, got: %q", got)
+	}
+	if got := d.LookupHostnameByIP("192.168.1.10"); got != "" {
+		t.Errorf("old hostname must be invalidated, got: %q", got)
+	}
+	if got := d.LookupHostnameByMac("00:00:00:00:00:01"); got != "host-1" {
+		t.Errorf("old device hostname must be kept, got: %q", got)
+	}
+}
+
+func Test_dhcp_expire(t *testing.T) {
+	d := &dhcp{}
+	d.addSelf()
+	d.storeLease("192.168.1.10", "00:00:00:00:00:01", "host-1")
+	d.storeLease("192.168.1.11", "00:00:00:00:00:02", "host-2")
+	d.lastSeen.Store("192.168.1.10", time.Now().Add(-2*time.Hour))
+
+	d.expire(time.Now().Add(-time.Hour))
+
+	if got := d.LookupMac("192.168.1.10"); got != "" {
+		t.Errorf("expired entry must be removed, got mac: %q", got)
+	}
+	if got := d.LookupHostnameByMac("00:00:00:00:00:01"); got != "" {
+		t.Errorf("expired entry must be removed, got hostname: %q", got)
+	}
+	if got := d.LookupHostnameByIP("192.168.1.11"); got != "host-2" {
+		t.Errorf("fresh entry must be kept, got hostname: %q", got)
+	}
+	if got := d.LookupHostnameByIP("127.0.0.1"); got == "" {
+		t.Error("self entry must not be expired")
+	}
+}
+
+// udhcpdLeaseFile returns content of busybox udhcpd lease file with a single lease.
+func udhcpdLeaseFile(t *testing.T, withTimestamp bool, ip, mac, hostname string) string {
+	t.Helper()
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b []byte
+	if withTimestamp {
+		b = append(b, 0, 0, 0, 0, 0x65, 0x85, 0x5f, 0x00)
+	}
+	b = append(b, 0, 0, 0x0e, 0x10) // expires
+	b = append(b, net.ParseIP(ip).To4()...)
+	b = append(b, hw...)
+	name := make([]byte, 20)
+	copy(name, hostname)
+	b = append(b, name...)
+	b = append(b, 0, 0) // pad
+	return string(b)
+}
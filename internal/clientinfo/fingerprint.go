@@ -0,0 +1,122 @@
+package clientinfo
+
+import (
+	"strings"
+)
+
+// fingerprint is the DHCP fingerprint of a device.
+type fingerprint struct {
+	// options is the parameter request list (option 55), in request order, e.g: "1,3,6,15".
+	options string
+	// vendorClass is the vendor class identifier (option 60).
+	vendorClass string
+	hostname    string
+}
+
+// deviceClassRule classifies a device as class if all non-empty fields match its fingerprint.
+type deviceClassRule struct {
+	class string
+	// options is matched exactly.
+	options string
+	// vendorClass is matched as a case-insensitive prefix.
+	vendorClass string
+	// hostname is matched as a case-insensitive substring, any of them.
+	hostname []string
+	// hostnamePrefix is matched as a case-insensitive prefix, any of them.
+	hostnamePrefix []string
+}
+
+// deviceClassRules is the list of known device fingerprints, first match wins. Hostname
+// hints come first, since they are the most specific, then vendor classes, then option lists.
+var deviceClassRules = []deviceClassRule{
+	{class: "ipad", hostname: []string{"ipad"}},
+	{class: "iphone", hostname: []string{"iphone"}},
+	{class: "tv", hostname: []string{"appletv", "apple-tv", "webostv", "bravia", "roku", "chromecast", "firetv", "[tv]"}},
+	{class: "mac", hostname: []string{"macbook", "imac", "mac-mini", "macmini"}},
+	{class: "console", hostname: []string{"xbox", "playstation", "nintendo"}, hostnamePrefix: []string{"ps4-", "ps5-"}},
+	{class: "printer", hostnamePrefix: []string{"npi", "brn", "brw", "epson", "canon", "xerox", "lexmark", "kyocera"}},
+	{class: "printer", vendorClass: "hewlett-packard jetdirect"},
+	{class: "android", vendorClass: "android-dhcp"},
+	{class: "windows", vendorClass: "msft"},
+	{class: "tv", vendorClass: "udhcp", hostname: []string{"samsung", "tizen"}},
+	{class: "chromeos", vendorClass: "dhcpcd", hostname: []string{"chromebook"}},
+	{class: "linux", vendorClass: "dhcpcd"},
+	{class: "mac", options: "1,121,3,6,15,119,252,95,44,46"},
+	{class: "mac", options: "1,121,3,6,15,108,114,119,162,252,95,44,46"},
+	{class: "iphone", options: "1,121,3,6,15,119,252"},
+	{class: "iphone", options: "1,121,3,6,15,108,114,119,252"},
+	{class: "windows", options: "1,3,6,15,31,33,43,44,46,47,119,121,249,252"},
+	{class: "android", options: "1,3,6,15,26,28,51,58,59,43"},
+	{class: "android", options: "1,3,6,15,26,28,51,58,59,43,114,108"},
+}
+
+// matches reports whether fp matches the rule.
+func (r *deviceClassRule) matches(fp *fingerprint) bool {
+	if r.options != "" && r.options != fp.options {
+		return false
+	}
+	if r.vendorClass != "" && !strings.HasPrefix(strings.ToLower(fp.vendorClass), r.vendorClass) {
+		return false
+	}
+	if len(r.hostname) == 0 && len(r.hostnamePrefix) == 0 {
+		return true
+	}
+	hostname := strings.ToLower(fp.hostname)
+	for _, h := range r.hostname {
+		if strings.Contains(hostname, h) {
+			return true
+		}
+	}
+	for _, h := range r.hostnamePrefix {
+		if strings.HasPrefix(hostname, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyDevice returns the device class of fp, or empty string if unknown.
+func classifyDevice(fp *fingerprint) string {
+	if fp.options == "" && fp.vendorClass == "" && fp.hostname == "" {
+		return ""
+	}
+	for i := range deviceClassRules {
+		if deviceClassRules[i].matches(fp) {
+			return deviceClassRules[i].class
+		}
+	}
+	return ""
+}
+
+// StoreFingerprint stores the DHCP fingerprint of the device with given mac, which
+// is used for classifying the device.
+func (t *Table) StoreFingerprint(mac, options, vendorClass, hostname string) {
+	if t == nil || mac == "" {
+		return
+	}
+	t.fingerprints.Store(strings.ToLower(mac), &fingerprint{
+		options:     options,
+		vendorClass: vendorClass,
+		hostname:    hostname,
+	})
+}
+
+// LookupDeviceClass returns the class of the device with given mac, e.g: "iphone", "tv",
+// "printer", using its DHCP fingerprint, or hostname if no fingerprint was seen.
+// It returns empty string if the device could not be classified.
+func (t *Table) LookupDeviceClass(mac string) string {
+	if t == nil || mac == "" {
+		return ""
+	}
+	mac = strings.ToLower(mac)
+	fp := &fingerprint{}
+	if v, ok := t.fingerprints.Load(mac); ok {
+		*fp = *v.(*fingerprint)
+	} else if t.dhcp != nil {
+		fp.vendorClass = t.dhcp.lookupVendorClass(mac)
+	}
+	if fp.hostname == "" {
+		fp.hostname = t.LookupHostname("", mac)
+	}
+	return classifyDevice(fp)
+}
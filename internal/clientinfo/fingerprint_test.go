@@ -0,0 +1,67 @@
+package clientinfo
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_classifyDevice(t *testing.T) {
+	tests := []struct {
+		name string
+		fp   *fingerprint
+		want string
+	}{
+		{"empty", &fingerprint{}, ""},
+		{"iphone hostname", &fingerprint{hostname: "Johns-iPhone", options: "1,121,3,6,15,108,114,119,252"}, "iphone"},
+		{"ipad hostname with iphone options", &fingerprint{hostname: "Kids-iPad", options: "1,121,3,6,15,119,252"}, "ipad"},
+		{"ios options", &fingerprint{options: "1,121,3,6,15,119,252"}, "iphone"},
+		{"macos options", &fingerprint{options: "1,121,3,6,15,119,252,95,44,46"}, "mac"},
+		{"android vendor", &fingerprint{vendorClass: "android-dhcp-13", hostname: "Galaxy-S23"}, "android"},
+		{"windows vendor", &fingerprint{vendorClass: "MSFT 5.0", hostname: "DESKTOP-1234"}, "windows"},
+		{"samsung tv", &fingerprint{vendorClass: "udhcp 1.30.1", hostname: "Samsung"}, "tv"},
+		{"udhcp unknown", &fingerprint{vendorClass: "udhcp 1.30.1", hostname: "camera"}, ""},
+		{"lg tv", &fingerprint{hostname: "LGwebOSTV"}, "tv"},
+		{"brother printer", &fingerprint{hostname: "BRN3C2AF4123456"}, "printer"},
+		{"not printer", &fingerprint{hostname: "osborne-laptop"}, ""},
+		{"jetdirect", &fingerprint{vendorClass: "Hewlett-Packard JetDirect"}, "printer"},
+		{"playstation", &fingerprint{hostname: "PS5-123"}, "console"},
+		{"chromebook", &fingerprint{vendorClass: "dhcpcd-9.4.1:Linux", hostname: "Chromebook"}, "chromeos"},
+		{"linux", &fingerprint{vendorClass: "dhcpcd-9.4.1:Linux", hostname: "raspberrypi"}, "linux"},
+		{"unknown", &fingerprint{options: "1,3,6", hostname: "thermostat"}, ""},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := classifyDevice(tc.fp); got != tc.want {
+				t.Errorf("unexpected device class, want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_dhcp_iscVendorClass(t *testing.T) {
+	d := &dhcp{}
+	leases := `lease 192.168.1.5 {
+  binding state active;
+  hardware ethernet 00:00:00:00:00:05;
+  set vendor-class-identifier = "MSFT 5.0";
+  client-hostname "desktop";
+}
+lease 192.168.1.6 {
+  binding state active;
+  hardware ethernet 00:00:00:00:00:06;
+  client-hostname "no-vendor";
+}
+`
+	if err := d.iscDHCPReadClientInfoReader(strings.NewReader(leases)); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.lookupVendorClass("00:00:00:00:00:05"); got != "MSFT 5.0" {
+		t.Errorf("unexpected vendor class, want: %q, got: %q", "MSFT 5.0", got)
+	}
+	if got := d.lookupVendorClass("00:00:00:00:00:06"); got != "" {
+		t.Errorf("unexpected vendor class, want empty, got: %q", got)
+	}
+}
@@ -22,6 +22,19 @@ const (
 	hostEntriesConfPath = "/var/unbound/host_entries.conf"
 )
 
+func init() {
+	registerProvider("hosts file", priorityHosts, func(t *Table) (Provider, error) {
+		if !t.discoverHosts() {
+			return nil, nil
+		}
+		t.hf = &hostsFile{}
+		ctrld.ProxyLogger.Load().Debug().Msg("start hosts file discovery")
+		err := t.hf.init()
+		go t.hf.watchChanges()
+		return t.hf, err
+	})
+}
+
 // hostsFile provides client discovery functionality using system hosts file.
 type hostsFile struct {
 	watcher *fsnotify.Watcher
@@ -33,8 +33,31 @@ var (
 	}
 )
 
+func init() {
+	registerProvider("mDNS", priorityMDNS, func(t *Table) (Provider, error) {
+		if !t.discoverMDNS() {
+			return nil, nil
+		}
+		t.mdns = &mdns{}
+		if t.discoverMDNSActive() {
+			t.mdns.resolveIPs = t.listIPs
+		}
+		ctrld.ProxyLogger.Load().Debug().Msg("start mdns discovery")
+		return t.mdns, t.mdns.init(t.quitCh)
+	})
+}
+
+// maxReverseQuestions is the maximum number of reverse PTR questions in a single mdns query.
+const maxReverseQuestions = 16
+
 type mdns struct {
 	name sync.Map // ip => hostname
+
+	// If resolveIPs is set, hostnames of returned IPs, which are not known yet, are resolved
+	// actively by querying their reverse PTR records via mdns on every refresh.
+	resolveIPs func() []string
+	v4Conns    []*net.UDPConn
+	v6Conns    []*net.UDPConn
 }
 
 func (m *mdns) LookupHostnameByIP(ip string) string {
@@ -110,6 +133,7 @@ func (m *mdns) init(quitCh chan struct{}) error {
 		}
 	}
 
+	m.v4Conns, m.v6Conns = v4ConnList, v6ConnList
 	go m.probeLoop(v4ConnList, mdnsV4Addr, quitCh)
 	go m.probeLoop(v6ConnList, mdnsV6Addr, quitCh)
 	go m.getDataFromAvahiDaemonCache()
@@ -163,31 +187,40 @@ func (m *mdns) readLoop(conn *net.UDPConn) {
 		if err := msg.Unpack(buf[:n]); err != nil {
 			continue
 		}
+		m.storeDataFromMsg(&msg)
+	}
+}
 
-		var ip, name string
-		rrs := make([]dns.RR, 0, len(msg.Answer)+len(msg.Extra))
-		rrs = append(rrs, msg.Answer...)
-		rrs = append(rrs, msg.Extra...)
-		for _, rr := range rrs {
-			switch ar := rr.(type) {
-			case *dns.A:
-				ip, name = ar.A.String(), ar.Hdr.Name
-			case *dns.AAAA:
-				ip, name = ar.AAAA.String(), ar.Hdr.Name
+// storeDataFromMsg saves/updates any hostnames found in mdns message.
+func (m *mdns) storeDataFromMsg(msg *dns.Msg) {
+	var ip, name string
+	rrs := make([]dns.RR, 0, len(msg.Answer)+len(msg.Extra))
+	rrs = append(rrs, msg.Answer...)
+	rrs = append(rrs, msg.Extra...)
+	for _, rr := range rrs {
+		switch ar := rr.(type) {
+		case *dns.A:
+			ip, name = ar.A.String(), ar.Hdr.Name
+		case *dns.AAAA:
+			ip, name = ar.AAAA.String(), ar.Hdr.Name
+		case *dns.PTR:
+			// Answer for reverse lookup, like "123.1.168.192.in-addr.arpa. PTR Foo-2.local."
+			if addr := ipFromReverseName(ar.Hdr.Name); addr != "" {
+				ip, name = addr, ar.Ptr
 			}
-			if ip != "" && name != "" {
-				name = normalizeHostname(name)
-				if val, loaded := m.name.LoadOrStore(ip, name); !loaded {
-					ctrld.ProxyLogger.Load().Debug().Msgf("found hostname: %q, ip: %q via mdns", name, ip)
-				} else {
-					old := val.(string)
-					if old != name {
-						ctrld.ProxyLogger.Load().Debug().Msgf("update hostname: %q, ip: %q, old: %q via mdns", name, ip, old)
-						m.name.Store(ip, name)
-					}
+		}
+		if ip != "" && name != "" {
+			name = normalizeHostname(name)
+			if val, loaded := m.name.LoadOrStore(ip, name); !loaded {
+				ctrld.ProxyLogger.Load().Debug().Msgf("found hostname: %q, ip: %q via mdns", name, ip)
+			} else {
+				old := val.(string)
+				if old != name {
+					ctrld.ProxyLogger.Load().Debug().Msgf("update hostname: %q, ip: %q, old: %q via mdns", name, ip, old)
+					m.name.Store(ip, name)
 				}
-				ip, name = "", ""
 			}
+			ip, name = "", ""
 		}
 	}
 }
@@ -205,6 +238,69 @@ func (m *mdns) probe(conns []*net.UDPConn, remoteAddr net.Addr) error {
 		}
 	}
 
+	return m.send(conns, remoteAddr, msg)
+}
+
+// refresh resolves hostnames of unknown IPs actively, if enabled.
+// The answers are handled by readLoop, so refresh does not wait for them.
+func (m *mdns) refresh() error {
+	if m.resolveIPs == nil {
+		return nil
+	}
+	var v4, v6 []string
+	seen := make(map[string]struct{})
+	for _, ip := range m.resolveIPs() {
+		if _, ok := seen[ip]; ok {
+			continue
+		}
+		seen[ip] = struct{}{}
+		if _, ok := m.name.Load(ip); ok {
+			continue
+		}
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || addr.IsLoopback() {
+			continue
+		}
+		if addr.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if err := m.resolve(m.v4Conns, mdnsV4Addr, v4); err != nil {
+		return err
+	}
+	return m.resolve(m.v6Conns, mdnsV6Addr, v6)
+}
+
+// resolve performs mdns reverse PTR queries for given IPs.
+func (m *mdns) resolve(conns []*net.UDPConn, remoteAddr net.Addr, ips []string) error {
+	for len(ips) > 0 {
+		n := min(len(ips), maxReverseQuestions)
+		msg := new(dns.Msg)
+		msg.Question = make([]dns.Question, 0, n)
+		msg.Compress = true
+		for _, ip := range ips[:n] {
+			name, err := dns.ReverseAddr(ip)
+			if err != nil {
+				continue
+			}
+			msg.Question = append(msg.Question, dns.Question{
+				Name:   name,
+				Qtype:  dns.TypePTR,
+				Qclass: dns.ClassINET,
+			})
+		}
+		ips = ips[n:]
+		if err := m.send(conns, remoteAddr, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends msg to remoteAddr using all given connections.
+func (m *mdns) send(conns []*net.UDPConn, remoteAddr net.Addr, msg *dns.Msg) error {
 	buf, err := msg.Pack()
 	if err != nil {
 		return err
@@ -280,3 +376,41 @@ func isErrNetUnreachableOrInvalid(err error) bool {
 	}
 	return false
 }
+
+// ipFromReverseName returns the IP address of the given reverse lookup name,
+// or empty string if name is not a valid "in-addr.arpa." or "ip6.arpa." name.
+func ipFromReverseName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var s string
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return ""
+		}
+		s = strings.Join([]string{labels[3], labels[2], labels[1], labels[0]}, ".")
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 32 {
+			return ""
+		}
+		var sb strings.Builder
+		for i := len(labels) - 1; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return ""
+			}
+			sb.WriteString(labels[i])
+			if i > 0 && i%4 == 0 {
+				sb.WriteByte(':')
+			}
+		}
+		s = sb.String()
+	default:
+		return ""
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -3,6 +3,8 @@ package clientinfo
 import (
 	"strings"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func Test_mdns_storeDataFromAvahiBrowseOutput(t *testing.T) {
@@ -25,3 +27,53 @@ func Test_mdns_storeDataFromAvahiBrowseOutput(t *testing.T) {
 		t.Fatalf("unexpected hostname, want: %q, got: %q", wantHostname, hostname)
 	}
 }
+
+func Test_ipFromReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"v4", "123.1.168.192.in-addr.arpa.", "192.168.1.123"},
+		{"v4 without trailing dot", "123.1.168.192.in-addr.arpa", "192.168.1.123"},
+		{"v6", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", "fe80::1"},
+		{"v4 invalid", "1.168.192.in-addr.arpa.", ""},
+		{"v6 invalid", "1.0.0.0.ip6.arpa.", ""},
+		{"not reverse", "Foo-2.local.", ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := ipFromReverseName(tc.in); got != tc.want {
+				t.Errorf("ipFromReverseName() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func Test_mdns_storeDataFromMsg(t *testing.T) {
+	msg := new(dns.Msg)
+	for _, s := range []string{
+		"123.1.168.192.in-addr.arpa. 120 IN PTR Foo-2.local.",
+		"_companion-link._tcp.local. 4500 IN PTR Foo._companion-link._tcp.local.",
+		"Bar.local. 120 IN A 192.168.1.124",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	m := &mdns{}
+	m.storeDataFromMsg(msg)
+
+	for ip, want := range map[string]string{"192.168.1.123": "Foo-2", "192.168.1.124": "Bar"} {
+		if got := m.LookupHostnameByIP(ip); got != want {
+			t.Errorf("unexpected hostname for %s, want: %q, got: %q", ip, want, got)
+		}
+	}
+	if ips := m.List(); len(ips) != 2 {
+		t.Errorf("unexpected IPs: %v", ips)
+	}
+}
@@ -13,6 +13,16 @@ import (
 
 const merlinNvramCustomClientListKey = "custom_clientlist"
 
+func init() {
+	registerProvider("Merlin", priorityRouter, func(t *Table) (Provider, error) {
+		if !t.discoverDHCP() && !t.discoverARP() {
+			return nil, nil
+		}
+		t.merlin = &merlinDiscover{}
+		return t.merlin, t.merlin.refresh()
+	})
+}
+
 type merlinDiscover struct {
 	hostname sync.Map // mac => hostname
 }
@@ -17,6 +17,23 @@ import (
 	"github.com/Control-D-Inc/ctrld"
 )
 
+func init() {
+	registerProvider("NDP", priorityNDP, func(t *Table) (Provider, error) {
+		if !t.discoverARP() {
+			return nil, nil
+		}
+		t.ndp = &ndpDiscover{}
+		ctrld.ProxyLogger.Load().Debug().Msg("start ndp discovery")
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-t.quitCh
+			cancel()
+		}()
+		go t.ndp.listen(ctx)
+		return t.ndp, t.ndp.refresh()
+	})
+}
+
 // ndpDiscover provides client discovery functionality using NDP protocol.
 type ndpDiscover struct {
 	mac sync.Map // ip  => mac
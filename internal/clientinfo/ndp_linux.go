@@ -15,6 +15,9 @@ func (nd *ndpDiscover) scan() {
 	}
 
 	for _, n := range neighs {
+		if !validNeigh(n) {
+			continue
+		}
 		ip := n.IP.String()
 		mac := n.HardwareAddr.String()
 		nd.mac.Store(ip, mac)
@@ -0,0 +1,280 @@
+package clientinfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	nbnsPort  = "137"
+	llmnrPort = "5355"
+
+	// netbiosQueryTimeout is the timeout for waiting a single NBNS/LLMNR answer.
+	netbiosQueryTimeout = 500 * time.Millisecond
+	// netbiosMaxQueries is the maximum number of IPs which are queried in a refresh.
+	netbiosMaxQueries = 16
+	// netbiosRetryInterval is the minimum interval between two queries for the same IP.
+	netbiosRetryInterval = 10 * time.Minute
+)
+
+func init() {
+	registerProvider("NetBIOS", priorityNetBIOS, func(t *Table) (Provider, error) {
+		if !t.discoverNetBIOS() {
+			return nil, nil
+		}
+		t.netbios = &netbiosDiscover{resolveIPs: t.listIPs}
+		ctrld.ProxyLogger.Load().Debug().Msg("start netbios discovery")
+		return t.netbios, nil
+	})
+}
+
+// netbiosDiscover provides client discovery functionality using NetBIOS name service (NBNS)
+// and Link-Local Multicast Name Resolution (LLMNR), which are answered by Windows machines
+// even when they do not register any hostname with DHCP server.
+type netbiosDiscover struct {
+	name      sync.Map // ip => hostname
+	lastQuery sync.Map // ip => time.Time
+	running   atomic.Bool
+
+	resolveIPs func() []string
+	lookup     func(ip string) string
+}
+
+func (n *netbiosDiscover) LookupHostnameByIP(ip string) string {
+	val, ok := n.name.Load(ip)
+	if !ok {
+		return ""
+	}
+	return val.(string)
+}
+
+func (n *netbiosDiscover) LookupHostnameByMac(mac string) string {
+	return ""
+}
+
+func (n *netbiosDiscover) String() string {
+	return "netbios"
+}
+
+func (n *netbiosDiscover) List() []string {
+	if n == nil {
+		return nil
+	}
+	var ips []string
+	n.name.Range(func(key, value any) bool {
+		ips = append(ips, key.(string))
+		return true
+	})
+	return ips
+}
+
+// refresh looks up hostnames of unknown IPs in background. To prevent spamming the LAN,
+// at most netbiosMaxQueries IPs are queried each time, and an IP which did not answer
+// is not queried again until netbiosRetryInterval passed.
+func (n *netbiosDiscover) refresh() error {
+	if !n.running.CompareAndSwap(false, true) {
+		return nil
+	}
+	ips := n.pendingIPs(time.Now())
+	if len(ips) == 0 {
+		n.running.Store(false)
+		return nil
+	}
+	go func() {
+		defer n.running.Store(false)
+		for _, ip := range ips {
+			n.resolve(ip)
+		}
+	}()
+	return nil
+}
+
+// pendingIPs returns IPs which need to be queried at the given time.
+func (n *netbiosDiscover) pendingIPs(now time.Time) []string {
+	if n.resolveIPs == nil {
+		return nil
+	}
+	var ips []string
+	seen := make(map[string]struct{})
+	for _, ip := range n.resolveIPs() {
+		if len(ips) == netbiosMaxQueries {
+			break
+		}
+		if _, ok := seen[ip]; ok {
+			continue
+		}
+		seen[ip] = struct{}{}
+		if _, ok := n.name.Load(ip); ok {
+			continue
+		}
+		if addr, err := netip.ParseAddr(ip); err != nil || addr.IsLoopback() || addr.IsMulticast() {
+			continue
+		}
+		if val, ok := n.lastQuery.Load(ip); ok && now.Sub(val.(time.Time)) < netbiosRetryInterval {
+			continue
+		}
+		n.lastQuery.Store(ip, now)
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// resolve looks up hostname of the given IP, saving the result if found.
+func (n *netbiosDiscover) resolve(ip string) {
+	lookup := n.lookup
+	if lookup == nil {
+		lookup = netbiosLookup
+	}
+	name := lookup(ip)
+	if name == "" {
+		return
+	}
+	name = normalizeHostname(name)
+	n.name.Store(ip, name)
+	ctrld.ProxyLogger.Load().Debug().Msgf("found hostname: %q, ip: %q via netbios", name, ip)
+}
+
+// netbiosLookup returns hostname of the given IP using NBNS node status query (IPv4 only),
+// then LLMNR reverse query.
+func netbiosLookup(ip string) string {
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Is4() {
+		if name, err := nbnsNodeStatus(ip); err == nil && name != "" {
+			return name
+		}
+	}
+	name, _ := llmnrReverseLookup(ip)
+	return name
+}
+
+// nbnsNodeStatus sends NBNS node status request to the given IP, returning its workstation name.
+func nbnsNodeStatus(ip string) (string, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(ip, nbnsPort), netbiosQueryTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(netbiosQueryTimeout))
+	id := uint16(rand.Intn(1 << 16))
+	if _, err := conn.Write(nbnsNodeStatusRequest(id)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		if n < 2 || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		return parseNbnsNodeStatusResponse(buf[:n])
+	}
+}
+
+// nbnsNodeStatusRequest returns NBNS node status request packet with the given transaction ID,
+// asking for the wildcard name "*". See RFC 1002, section 4.2.17.
+func nbnsNodeStatusRequest(id uint16) []byte {
+	b := make([]byte, 0, 50)
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = append(b,
+		0x00, 0x00, // Flags.
+		0x00, 0x01, // QDCOUNT.
+		0x00, 0x00, // ANCOUNT.
+		0x00, 0x00, // NSCOUNT.
+		0x00, 0x00, // ARCOUNT.
+	)
+	// First level encoded name, "*" padded with NUL to 16 bytes.
+	name := make([]byte, 16)
+	name[0] = '*'
+	b = append(b, 32)
+	for _, c := range name {
+		b = append(b, 'A'+(c>>4), 'A'+(c&0x0f))
+	}
+	b = append(b, 0x00)
+	b = append(b,
+		0x00, 0x21, // QTYPE: NBSTAT.
+		0x00, 0x01, // QCLASS: IN.
+	)
+	return b
+}
+
+var errInvalidNbnsResponse = errors.New("invalid nbns response")
+
+// parseNbnsNodeStatusResponse returns the workstation name (unique name with suffix 0x00)
+// from NBNS node status response. See RFC 1002, section 4.2.18.
+func parseNbnsNodeStatusResponse(b []byte) (string, error) {
+	if len(b) < 12 || binary.BigEndian.Uint16(b[6:8]) == 0 {
+		return "", errInvalidNbnsResponse
+	}
+	off := 12
+	// Skip RR_NAME, which could be a compression pointer.
+	for {
+		if off >= len(b) {
+			return "", errInvalidNbnsResponse
+		}
+		l := int(b[off])
+		if l&0xc0 == 0xc0 {
+			off += 2
+			break
+		}
+		off++
+		if l == 0 {
+			break
+		}
+		off += l
+	}
+	// RR_TYPE, RR_CLASS, TTL, RDLENGTH.
+	off += 10
+	if off >= len(b) {
+		return "", errInvalidNbnsResponse
+	}
+	num := int(b[off])
+	off++
+	for i := 0; i < num; i++ {
+		if off+18 > len(b) {
+			return "", errInvalidNbnsResponse
+		}
+		entry := b[off : off+18]
+		off += 18
+		suffix := entry[15]
+		group := binary.BigEndian.Uint16(entry[16:18])&0x8000 != 0
+		if suffix == 0x00 && !group {
+			return strings.TrimRight(string(entry[:15]), " \x00"), nil
+		}
+	}
+	return "", nil
+}
+
+// llmnrReverseLookup sends LLMNR reverse lookup query to the given IP, returning its hostname.
+// See RFC 4795, section 2.4.
+func llmnrReverseLookup(ip string) (string, error) {
+	name, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return "", err
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypePTR)
+	msg.RecursionDesired = false
+	c := &dns.Client{Net: "udp", Timeout: netbiosQueryTimeout}
+	answer, _, err := c.Exchange(msg, net.JoinHostPort(ip, llmnrPort))
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range answer.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			return ptr.Ptr, nil
+		}
+	}
+	return "", nil
+}
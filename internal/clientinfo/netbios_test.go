@@ -0,0 +1,103 @@
+package clientinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_nbnsNodeStatusRequest(t *testing.T) {
+	b := nbnsNodeStatusRequest(0x1234)
+	if len(b) != 50 {
+		t.Fatalf("unexpected length: %d", len(b))
+	}
+	if binary.BigEndian.Uint16(b) != 0x1234 {
+		t.Errorf("unexpected transaction id: %x", b[:2])
+	}
+	// "*" is encoded as "CK", NUL padding as "AA".
+	wantName := append([]byte{32, 'C', 'K'}, bytes.Repeat([]byte("AA"), 15)...)
+	if !bytes.Equal(b[12:45], wantName) {
+		t.Errorf("unexpected name: %q", b[12:45])
+	}
+}
+
+func nbnsEntry(name string, suffix byte, flags uint16) []byte {
+	b := make([]byte, 18)
+	copy(b, name+"               ")
+	b[15] = suffix
+	binary.BigEndian.PutUint16(b[16:], flags)
+	return b
+}
+
+func Test_parseNbnsNodeStatusResponse(t *testing.T) {
+	header := []byte{0x12, 0x34, 0x84, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+	rr := append([]byte{0xc0, 0x0c}, 0x00, 0x21, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	tests := []struct {
+		name    string
+		entries [][]byte
+		want    string
+		wantErr bool
+	}{
+		{
+			"workstation name",
+			[][]byte{nbnsEntry("WORKGROUP", 0x00, 0x8400), nbnsEntry("DESKTOP-FOO", 0x20, 0x0400), nbnsEntry("DESKTOP-FOO", 0x00, 0x0400)},
+			"DESKTOP-FOO",
+			false,
+		},
+		{"only group names", [][]byte{nbnsEntry("WORKGROUP", 0x00, 0x8400)}, "", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			b := append(append([]byte{}, header...), rr...)
+			b = append(b, byte(len(tc.entries)))
+			for _, e := range tc.entries {
+				b = append(b, e...)
+			}
+			got, err := parseNbnsNodeStatusResponse(b)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("unexpected name, want: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := parseNbnsNodeStatusResponse(append(header, rr...)); err == nil {
+		t.Error("expected error for truncated response")
+	}
+}
+
+func Test_netbiosDiscover_pendingIPs(t *testing.T) {
+	n := &netbiosDiscover{resolveIPs: func() []string {
+		return []string{"192.168.1.2", "192.168.1.2", "192.168.1.3", "127.0.0.1", "invalid"}
+	}}
+	n.name.Store("192.168.1.3", "foo")
+
+	now := time.Now()
+	if got := n.pendingIPs(now); len(got) != 1 || got[0] != "192.168.1.2" {
+		t.Fatalf("unexpected pending IPs: %v", got)
+	}
+	if got := n.pendingIPs(now.Add(time.Minute)); len(got) != 0 {
+		t.Fatalf("IP is queried again before retry interval: %v", got)
+	}
+	if got := n.pendingIPs(now.Add(netbiosRetryInterval)); len(got) != 1 {
+		t.Fatalf("IP is not queried again after retry interval: %v", got)
+	}
+
+	var ips []string
+	for i := 0; i < netbiosMaxQueries*2; i++ {
+		ips = append(ips, fmt.Sprintf("192.168.2.%d", i+1))
+	}
+	n = &netbiosDiscover{resolveIPs: func() []string { return ips }}
+	if got := n.pendingIPs(now); len(got) != netbiosMaxQueries {
+		t.Fatalf("unexpected number of pending IPs, want: %d, got: %d", netbiosMaxQueries, len(got))
+	}
+	if got := n.pendingIPs(now); len(got) != netbiosMaxQueries {
+		t.Fatalf("remaining IPs are not queried, got: %d", len(got))
+	}
+}
@@ -0,0 +1,278 @@
+package clientinfo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	// defaultPersistMaxAge is the default age after which a persisted client is expired.
+	defaultPersistMaxAge = 7 * 24 * time.Hour
+	// persistFlushInterval is the minimum interval between two writes of the persisted table.
+	persistFlushInterval = 5 * time.Minute
+)
+
+func init() {
+	registerProvider("Persisted", priorityPersisted, func(t *Table) (Provider, error) {
+		if t.svcCfg.DiscoverCacheFile == "" {
+			return nil, nil
+		}
+		maxAge := defaultPersistMaxAge
+		if t.svcCfg.DiscoverCacheMaxAge > 0 {
+			maxAge = time.Duration(t.svcCfg.DiscoverCacheMaxAge) * time.Second
+		}
+		t.persist = newPersistDiscover(t.svcCfg.DiscoverCacheFile, maxAge, t.snapshotClients)
+		ctrld.ProxyLogger.Load().Debug().Msgf("loading persisted clients from: %s", t.persist.path)
+		if err := t.persist.load(); err != nil && !os.IsNotExist(err) {
+			ctrld.ProxyLogger.Load().Warn().Err(err).Msg("could not load persisted clients")
+		}
+		go func() {
+			<-t.quitCh
+			if err := t.persist.flush(); err != nil {
+				ctrld.ProxyLogger.Load().Warn().Err(err).Msg("could not persist clients")
+			}
+		}()
+		return t.persist, nil
+	})
+}
+
+// persistedClient is a client saved to the persisted table.
+type persistedClient struct {
+	IP       string    `json:"ip"`
+	Mac      string    `json:"mac,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// persistDiscover provides client info saved from previous runs of ctrld, so clients are
+// known right after ctrld (re)started, while other sources are still warming up. It has
+// the lowest priority, thus data from live sources always wins.
+type persistDiscover struct {
+	path     string
+	maxAge   time.Duration
+	snapshot func() []*persistedClient
+	now      func() time.Time
+
+	mu        sync.RWMutex
+	byIP      map[string]*persistedClient
+	byMac     map[string]*persistedClient
+	lastFlush time.Time
+}
+
+// newPersistDiscover returns new persistDiscover using the file at given path. Clients
+// which are not seen for longer than maxAge are expired. The snapshot function returns
+// clients currently known by live sources.
+func newPersistDiscover(path string, maxAge time.Duration, snapshot func() []*persistedClient) *persistDiscover {
+	return &persistDiscover{
+		path:     path,
+		maxAge:   maxAge,
+		snapshot: snapshot,
+		now:      time.Now,
+		byIP:     make(map[string]*persistedClient),
+		byMac:    make(map[string]*persistedClient),
+	}
+}
+
+// load reads persisted clients from file, skipping expired ones.
+func (p *persistDiscover) load() error {
+	buf, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var clients []*persistedClient
+	if err := json.Unmarshal(buf, &clients); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastFlush = p.now()
+	for _, c := range clients {
+		p.storeLocked(c)
+	}
+	p.expireLocked()
+	return nil
+}
+
+// refresh merges clients from live sources into the table, then flushes it to file if
+// persistFlushInterval passed since the last flush.
+func (p *persistDiscover) refresh() error {
+	p.merge()
+	p.mu.RLock()
+	due := p.now().Sub(p.lastFlush) >= persistFlushInterval
+	p.mu.RUnlock()
+	if !due {
+		return nil
+	}
+	return p.flush()
+}
+
+// merge stores clients from live sources, marking them as seen now, then removes expired ones.
+func (p *persistDiscover) merge() {
+	if p.snapshot == nil {
+		return
+	}
+	clients := p.snapshot()
+	now := p.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range clients {
+		c.LastSeen = now
+		p.storeLocked(c)
+	}
+	p.expireLocked()
+}
+
+// flush writes the table to file. The file is replaced atomically, so a crash during
+// writing does not corrupt the previous content.
+func (p *persistDiscover) flush() error {
+	p.mu.Lock()
+	clients := make([]*persistedClient, 0, len(p.byIP))
+	for _, c := range p.byIP {
+		clients = append(clients, c)
+	}
+	p.lastFlush = p.now()
+	p.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].IP < clients[j].IP })
+	buf, err := json.Marshal(clients)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0750); err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// storeLocked stores c to the table, keeping existing mac/hostname if c does not have one.
+// The caller must hold p.mu.
+func (p *persistDiscover) storeLocked(c *persistedClient) {
+	if c.IP == "" {
+		return
+	}
+	if old := p.byIP[c.IP]; old != nil {
+		if c.Mac == "" {
+			c.Mac = old.Mac
+		}
+		if c.Hostname == "" {
+			c.Hostname = old.Hostname
+		}
+		if old.LastSeen.After(c.LastSeen) {
+			c.LastSeen = old.LastSeen
+		}
+		if old.Mac != "" && p.byMac[old.Mac] == old {
+			delete(p.byMac, old.Mac)
+		}
+	}
+	p.byIP[c.IP] = c
+	if c.Mac != "" {
+		if old := p.byMac[c.Mac]; old == nil || !old.LastSeen.After(c.LastSeen) {
+			p.byMac[c.Mac] = c
+		}
+	}
+}
+
+// expireLocked removes clients which are not seen for longer than p.maxAge.
+// The caller must hold p.mu.
+func (p *persistDiscover) expireLocked() {
+	now := p.now()
+	for ip, c := range p.byIP {
+		if now.Sub(c.LastSeen) <= p.maxAge {
+			continue
+		}
+		delete(p.byIP, ip)
+		if p.byMac[c.Mac] == c {
+			delete(p.byMac, c.Mac)
+		}
+	}
+}
+
+func (p *persistDiscover) lookupByIP(ip string) *persistedClient {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.byIP[ip]
+}
+
+func (p *persistDiscover) lookupByMac(mac string) *persistedClient {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.byMac[mac]
+}
+
+// LookupIP returns the IP of client with given MAC address.
+func (p *persistDiscover) LookupIP(mac string) string {
+	if c := p.lookupByMac(mac); c != nil {
+		return c.IP
+	}
+	return ""
+}
+
+// LookupMac returns the MAC address of client with given IP.
+func (p *persistDiscover) LookupMac(ip string) string {
+	if c := p.lookupByIP(ip); c != nil {
+		return c.Mac
+	}
+	return ""
+}
+
+// LookupHostnameByIP returns the hostname of client with given IP.
+func (p *persistDiscover) LookupHostnameByIP(ip string) string {
+	if c := p.lookupByIP(ip); c != nil {
+		return c.Hostname
+	}
+	return ""
+}
+
+// LookupHostnameByMac returns the hostname of client with given MAC address.
+func (p *persistDiscover) LookupHostnameByMac(mac string) string {
+	if c := p.lookupByMac(mac); c != nil {
+		return c.Hostname
+	}
+	return ""
+}
+
+// String returns human-readable format of persistDiscover.
+func (p *persistDiscover) String() string {
+	return "persisted"
+}
+
+// snapshotClients returns clients currently known by live sources, excluding the persisted table.
+func (t *Table) snapshotClients() []*persistedClient {
+	var clients []*persistedClient
+	seen := make(map[string]struct{})
+	for _, l := range t.ipListers {
+		for _, ip := range l.List() {
+			if _, ok := seen[ip]; ok {
+				continue
+			}
+			seen[ip] = struct{}{}
+			c := &persistedClient{IP: ip}
+			for _, e := range t.lookupMacAll(ip) {
+				if e.mac != "" && e.src != t.persist.String() {
+					c.Mac = e.mac
+					break
+				}
+			}
+			for _, e := range t.lookupHostnameAll(ip, c.Mac) {
+				if e.name != "" && e.src != t.persist.String() {
+					c.Hostname = e.name
+					break
+				}
+			}
+			if c.Mac == "" && c.Hostname == "" {
+				continue
+			}
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,84 @@
+package clientinfo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_persistDiscover(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "clients.json")
+	var live []*persistedClient
+	snapshot := func() []*persistedClient {
+		clients := make([]*persistedClient, 0, len(live))
+		for _, c := range live {
+			cc := *c
+			clients = append(clients, &cc)
+		}
+		return clients
+	}
+
+	p := newPersistDiscover(path, time.Hour, snapshot)
+	p.now = func() time.Time { return now }
+	live = []*persistedClient{
+		{IP: "192.168.1.2", Mac: "aa:bb:cc:dd:ee:ff", Hostname: "laptop"},
+		{IP: "192.168.1.3", Mac: "11:22:33:44:55:66", Hostname: "phone"},
+	}
+	if err := p.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("persisted file was not written: %v", err)
+	}
+
+	// Phone goes offline, laptop is still seen later.
+	now = now.Add(30 * time.Minute)
+	live = live[:1]
+	if err := p.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate restart after 45 minutes: phone was last seen 75 minutes ago, thus expired.
+	now = now.Add(45 * time.Minute)
+	restarted := newPersistDiscover(path, time.Hour, nil)
+	restarted.now = func() time.Time { return now }
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.LookupHostnameByIP("192.168.1.2"); got != "laptop" {
+		t.Errorf("unexpected hostname, want: %q, got: %q", "laptop", got)
+	}
+	if got := restarted.LookupMac("192.168.1.2"); got != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("unexpected mac, want: %q, got: %q", "aa:bb:cc:dd:ee:ff", got)
+	}
+	if got := restarted.LookupIP("aa:bb:cc:dd:ee:ff"); got != "192.168.1.2" {
+		t.Errorf("unexpected ip, want: %q, got: %q", "192.168.1.2", got)
+	}
+	if got := restarted.LookupHostnameByMac("11:22:33:44:55:66"); got != "" {
+		t.Errorf("expired client is still known: %q", got)
+	}
+	if got := restarted.LookupHostnameByIP("192.168.1.3"); got != "" {
+		t.Errorf("expired client is still known: %q", got)
+	}
+}
+
+func Test_persistDiscover_storeKeepsKnownInfo(t *testing.T) {
+	now := time.Now()
+	p := newPersistDiscover("", time.Hour, nil)
+	p.storeLocked(&persistedClient{IP: "192.168.1.2", Mac: "aa:bb:cc:dd:ee:ff", Hostname: "laptop", LastSeen: now})
+	// A source only knows the mac, hostname must not be lost.
+	p.storeLocked(&persistedClient{IP: "192.168.1.2", Mac: "aa:bb:cc:dd:ee:ff", LastSeen: now})
+	if got := p.LookupHostnameByIP("192.168.1.2"); got != "laptop" {
+		t.Errorf("unexpected hostname, want: %q, got: %q", "laptop", got)
+	}
+	// The IP now belongs to other device.
+	p.storeLocked(&persistedClient{IP: "192.168.1.2", Mac: "11:22:33:44:55:66", Hostname: "phone", LastSeen: now})
+	if got := p.LookupHostnameByMac("aa:bb:cc:dd:ee:ff"); got != "" {
+		t.Errorf("stale mac is still known: %q", got)
+	}
+	if got := p.LookupHostnameByMac("11:22:33:44:55:66"); got != "phone" {
+		t.Errorf("unexpected hostname, want: %q, got: %q", "phone", got)
+	}
+}
@@ -0,0 +1,163 @@
+package clientinfo
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// delegatedPrefixLen is the length of IPv6 prefixes assigned to LAN interfaces from
+// the prefix delegated by the ISP. The low 64 bits of a client address are kept when
+// the delegated prefix changes.
+const delegatedPrefixLen = 64
+
+// prefixTracker tracks IPv6 prefixes of LAN interfaces, so client addresses which were
+// discovered in a previous delegated prefix could be translated to the current one.
+type prefixTracker struct {
+	mu      sync.Mutex
+	current map[string][]netip.Prefix     // interface name => current prefixes.
+	renamed map[netip.Prefix]netip.Prefix // old prefix => current prefix.
+}
+
+func newPrefixTracker() *prefixTracker {
+	return &prefixTracker{
+		current: make(map[string][]netip.Prefix),
+		renamed: make(map[netip.Prefix]netip.Prefix),
+	}
+}
+
+// refresh updates the tracker with current prefixes of LAN interfaces.
+func (pt *prefixTracker) refresh() {
+	if pt == nil {
+		return
+	}
+	pt.update(lanPrefixes())
+}
+
+// update records prefixes as the current prefixes of interfaces.
+//
+// A prefix which is gone from an interface is considered renamed to the new prefix of
+// that interface. If it is ambiguous which prefix is the new one, the old prefix is dropped.
+func (pt *prefixTracker) update(prefixes map[string][]netip.Prefix) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for iface, newPrefixes := range prefixes {
+		oldPrefixes, seen := pt.current[iface]
+		pt.current[iface] = newPrefixes
+		if !seen {
+			continue
+		}
+		added := prefixesDiff(newPrefixes, oldPrefixes)
+		for _, p := range prefixesDiff(oldPrefixes, newPrefixes) {
+			switch {
+			case len(added) == 1:
+				pt.rename(iface, p, added[0])
+			case len(newPrefixes) == 1:
+				// The new prefix was seen along with the old one before the old one expired.
+				pt.rename(iface, p, newPrefixes[0])
+			default:
+				ctrld.ProxyLogger.Load().Debug().Msgf("IPv6 prefix %s of %s is gone, could not determine new prefix", p, iface)
+			}
+		}
+	}
+}
+
+// rename records that prefix from is replaced by prefix to.
+func (pt *prefixTracker) rename(iface string, from, to netip.Prefix) {
+	ctrld.ProxyLogger.Load().Info().Msgf("IPv6 prefix of %s changed: %s -> %s", iface, from, to)
+	for old, cur := range pt.renamed {
+		if cur == from {
+			pt.renamed[old] = to
+		}
+	}
+	pt.renamed[from] = to
+	// The prefix may come back after being replaced.
+	delete(pt.renamed, to)
+}
+
+// toCurrent returns ip in the current prefix, if ip belongs to a replaced prefix.
+// Otherwise, ip is returned as-is.
+func (pt *prefixTracker) toCurrent(ip netip.Addr) netip.Addr {
+	if pt == nil || !ip.Is6() {
+		return ip
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if cur, ok := pt.renamed[netip.PrefixFrom(ip, delegatedPrefixLen).Masked()]; ok {
+		return replacePrefix(ip, cur)
+	}
+	return ip
+}
+
+// previous returns addresses of ip in prefixes which were replaced by the prefix of ip.
+func (pt *prefixTracker) previous(ip string) []string {
+	if pt == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() {
+		return nil
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	var addrs []string
+	for old, cur := range pt.renamed {
+		if cur.Contains(addr) {
+			addrs = append(addrs, replacePrefix(addr, old).String())
+		}
+	}
+	return addrs
+}
+
+// replacePrefix returns ip with its first delegatedPrefixLen bits replaced by prefix p.
+func replacePrefix(ip netip.Addr, p netip.Prefix) netip.Addr {
+	a, b := ip.As16(), p.Addr().As16()
+	copy(a[:delegatedPrefixLen/8], b[:delegatedPrefixLen/8])
+	return netip.AddrFrom16(a)
+}
+
+// prefixesDiff returns prefixes in a which are not in b.
+func prefixesDiff(a, b []netip.Prefix) []netip.Prefix {
+	var diff []netip.Prefix
+	for _, p := range a {
+		if !slices.Contains(b, p) {
+			diff = append(diff, p)
+		}
+	}
+	return diff
+}
+
+// lanPrefixes returns global unicast IPv6 prefixes of all up interfaces.
+func lanPrefixes() map[string][]netip.Prefix {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		ctrld.ProxyLogger.Load().Debug().Err(err).Msg("could not list interfaces for IPv6 prefixes")
+		return nil
+	}
+	prefixes := make(map[string][]netip.Prefix)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipNet.IP)
+			// ULA prefixes are stable, only global prefixes are delegated by ISP.
+			if !ok || !ip.Is6() || ip.Is4In6() || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+				continue
+			}
+			p := netip.PrefixFrom(ip, delegatedPrefixLen).Masked()
+			if !slices.Contains(prefixes[iface.Name], p) {
+				prefixes[iface.Name] = append(prefixes[iface.Name], p)
+			}
+		}
+	}
+	return prefixes
+}
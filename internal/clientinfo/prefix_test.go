@@ -0,0 +1,62 @@
+package clientinfo
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func Test_prefixTracker(t *testing.T) {
+	p1 := netip.MustParsePrefix("2001:db8:1:1::/64")
+	p2 := netip.MustParsePrefix("2001:db8:2:1::/64")
+	p3 := netip.MustParsePrefix("2001:db8:3:1::/64")
+	oldIP := netip.MustParseAddr("2001:db8:1:1::abcd")
+
+	pt := newPrefixTracker()
+	pt.update(map[string][]netip.Prefix{"br0": {p1}})
+	if got := pt.toCurrent(oldIP); got != oldIP {
+		t.Fatalf("unexpected address before prefix change: %s", got)
+	}
+
+	// New prefix is seen along with the old one, then the old one expires.
+	pt.update(map[string][]netip.Prefix{"br0": {p1, p2}})
+	if got := pt.toCurrent(oldIP); got != oldIP {
+		t.Fatalf("address must not be rewritten while old prefix is still present: %s", got)
+	}
+	pt.update(map[string][]netip.Prefix{"br0": {p2}})
+	want := netip.MustParseAddr("2001:db8:2:1::abcd")
+	if got := pt.toCurrent(oldIP); got != want {
+		t.Errorf("unexpected address, want: %s, got: %s", want, got)
+	}
+	if got := pt.previous(want.String()); len(got) != 1 || got[0] != oldIP.String() {
+		t.Errorf("unexpected previous addresses: %v", got)
+	}
+
+	// Prefix changes again, addresses in all previous prefixes must be rewritten.
+	pt.update(map[string][]netip.Prefix{"br0": {p3}})
+	want = netip.MustParseAddr("2001:db8:3:1::abcd")
+	if got := pt.toCurrent(oldIP); got != want {
+		t.Errorf("unexpected address, want: %s, got: %s", want, got)
+	}
+	if got := pt.previous(want.String()); len(got) != 2 {
+		t.Errorf("unexpected previous addresses: %v", got)
+	}
+
+	// Old prefix comes back.
+	pt.update(map[string][]netip.Prefix{"br0": {p1}})
+	if got := pt.toCurrent(oldIP); got != oldIP {
+		t.Errorf("address in current prefix must not be rewritten: %s", got)
+	}
+
+	// IPv4 and addresses of unknown prefixes are returned as-is.
+	for _, s := range []string{"192.168.1.2", "2001:db8:ffff::1"} {
+		ip := netip.MustParseAddr(s)
+		if got := pt.toCurrent(ip); got != ip {
+			t.Errorf("unexpected address, want: %s, got: %s", ip, got)
+		}
+	}
+
+	var disabled *prefixTracker
+	if got := disabled.toCurrent(oldIP); got != oldIP {
+		t.Errorf("unexpected address: %s", got)
+	}
+}
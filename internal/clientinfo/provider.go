@@ -0,0 +1,118 @@
+package clientinfo
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// Priorities of built-in providers. Providers with lower priority are queried first.
+const (
+	priorityStatic  = 1  // Clients configured by users, always take precedence.
+	priorityUnifi   = 5  // UniFi Network API, which has richer data than other router sources.
+	priorityRouter  = 10 // Routers custom clients (Merlin, Ubios ...).
+	priorityHosts   = 20
+	priorityDHCP    = 30
+	priorityARP     = 40
+	priorityNDP     = 41
+	priorityPTR     = 50
+	priorityNetBIOS = 55
+	priorityMDNS    = 60
+	priorityVirtual = 70
+	// Clients persisted from previous runs, only used until live sources know them.
+	priorityPersisted = 80
+)
+
+// Provider is a source of client info.
+//
+// Besides fmt.Stringer, a Provider should implement one or more of IpResolver, MacResolver
+// and HostnameResolver, which are used for looking up client info. Optionally, it could
+// implement:
+//
+//   - refresher: refreshed periodically, and before listing clients.
+//   - expirer: entries which are not seen for longer than entry TTL are removed periodically.
+//   - ipLister: its known IPs are included when listing clients.
+//   - ipFinder: used for looking up IP by hostname.
+//
+// Merge semantics: for each lookup, providers are queried in priority order, the first
+// non-empty result wins. When listing clients, IPs from all providers are merged, each
+// client has MAC/hostname from the first provider which knows it, and all providers
+// which know the client are recorded as its sources.
+type Provider interface {
+	fmt.Stringer
+}
+
+// providerFunc creates a Provider for the given Table.
+// It returns a nil Provider if the provider is disabled by current config.
+type providerFunc func(t *Table) (Provider, error)
+
+type providerEntry struct {
+	name     string
+	priority int
+	newFunc  providerFunc
+}
+
+var (
+	providersMu sync.Mutex
+	providers   []providerEntry
+)
+
+// registerProvider registers a client info provider with given name and priority.
+// It is meant to be called from init functions of source files.
+func registerProvider(name string, priority int, newFunc providerFunc) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers = append(providers, providerEntry{name: name, priority: priority, newFunc: newFunc})
+	sort.SliceStable(providers, func(i, j int) bool {
+		return providers[i].priority < providers[j].priority
+	})
+}
+
+// registeredProviders returns all registered providers, sorted by priority.
+func registeredProviders() []providerEntry {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	return append([]providerEntry(nil), providers...)
+}
+
+// initProviders creates and adds all registered providers to the table.
+func (t *Table) initProviders() {
+	for _, pe := range registeredProviders() {
+		p, err := pe.newFunc(t)
+		if err != nil {
+			ctrld.ProxyLogger.Load().Error().Err(err).Msgf("could not init %s discover", pe.name)
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		t.addProvider(p)
+	}
+}
+
+// addProvider adds p to the table, using it for all kinds of lookup that it implements.
+func (t *Table) addProvider(p Provider) {
+	if r, ok := p.(IpResolver); ok {
+		t.ipResolvers = append(t.ipResolvers, r)
+	}
+	if r, ok := p.(MacResolver); ok {
+		t.macResolvers = append(t.macResolvers, r)
+	}
+	if r, ok := p.(HostnameResolver); ok {
+		t.hostnameResolvers = append(t.hostnameResolvers, r)
+	}
+	if r, ok := p.(refresher); ok {
+		t.refreshers = append(t.refreshers, r)
+	}
+	if e, ok := p.(expirer); ok {
+		t.expirers = append(t.expirers, e)
+	}
+	if l, ok := p.(ipLister); ok {
+		t.ipListers = append(t.ipListers, l)
+	}
+	if f, ok := p.(ipFinder); ok {
+		t.ipFinders = append(t.ipFinders, f)
+	}
+}
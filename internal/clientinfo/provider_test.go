@@ -0,0 +1,69 @@
+package clientinfo
+
+import (
+	"testing"
+)
+
+type fakeProvider struct {
+	name  string
+	names map[string]string // ip => hostname
+}
+
+func (f *fakeProvider) String() string { return f.name }
+
+func (f *fakeProvider) LookupHostnameByIP(ip string) string { return f.names[ip] }
+
+func (f *fakeProvider) LookupHostnameByMac(mac string) string { return "" }
+
+func (f *fakeProvider) List() []string {
+	ips := make([]string, 0, len(f.names))
+	for ip := range f.names {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func Test_registerProvider(t *testing.T) {
+	providersMu.Lock()
+	prev := providers
+	providers = nil
+	providersMu.Unlock()
+	t.Cleanup(func() {
+		providersMu.Lock()
+		defer providersMu.Unlock()
+		providers = prev
+	})
+
+	low := &fakeProvider{name: "low", names: map[string]string{"192.168.1.2": "low"}}
+	high := &fakeProvider{name: "high", names: map[string]string{"192.168.1.2": "high", "192.168.1.3": "other"}}
+	registerProvider("low", 20, func(t *Table) (Provider, error) { return low, nil })
+	registerProvider("disabled", 5, func(t *Table) (Provider, error) { return nil, nil })
+	registerProvider("high", 10, func(t *Table) (Provider, error) { return high, nil })
+
+	table := &Table{}
+	table.initOnce.Do(table.initProviders)
+
+	if len(table.hostnameResolvers) != 2 || len(table.ipListers) != 2 {
+		t.Fatalf("unexpected providers, resolvers: %v, listers: %v", table.hostnameResolvers, table.ipListers)
+	}
+	if got := table.LookupHostname("192.168.1.2", ""); got != "high" {
+		t.Errorf("unexpected hostname, want: %q, got: %q", "high", got)
+	}
+
+	clients := make(map[string]*Client)
+	for _, c := range table.ListClients() {
+		clients[c.IP.String()] = c
+	}
+	if len(clients) != 2 {
+		t.Fatalf("unexpected clients: %v", clients)
+	}
+	c := clients["192.168.1.2"]
+	if c.Hostname != "high" {
+		t.Errorf("unexpected hostname, want: %q, got: %q", "high", c.Hostname)
+	}
+	for _, src := range []string{"low", "high"} {
+		if _, ok := c.Source[src]; !ok {
+			t.Errorf("missing source %q: %v", src, c.Source)
+		}
+	}
+}
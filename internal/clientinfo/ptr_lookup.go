@@ -2,7 +2,9 @@ package clientinfo
 
 import (
 	"context"
+	"net"
 	"net/netip"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +15,37 @@ import (
 	"github.com/Control-D-Inc/ctrld"
 )
 
+func init() {
+	registerProvider("PTR", priorityPTR, func(t *Table) (Provider, error) {
+		if !t.discoverPTR() {
+			return nil, nil
+		}
+		t.ptr = &ptrDiscover{resolver: ctrld.NewPrivateResolver()}
+		if len(t.ptrNameservers) > 0 {
+			nss := make([]string, 0, len(t.ptrNameservers))
+			for _, ns := range t.ptrNameservers {
+				host, port := ns, "53"
+				if h, p, err := net.SplitHostPort(ns); err == nil {
+					host, port = h, p
+				}
+				// Only use valid ip:port pair.
+				if _, portErr := strconv.Atoi(port); portErr == nil && port != "0" && net.ParseIP(host) != nil {
+					nss = append(nss, net.JoinHostPort(host, port))
+				} else {
+					ctrld.ProxyLogger.Load().Warn().Msgf("ignoring invalid nameserver for ptr discover: %q", ns)
+				}
+			}
+			if len(nss) > 0 {
+				t.ptr.resolver = ctrld.NewResolverWithNameserver(nss)
+				ctrld.ProxyLogger.Load().Debug().Msgf("using nameservers %v for ptr discovery", nss)
+			}
+
+		}
+		ctrld.ProxyLogger.Load().Debug().Msg("start ptr discovery")
+		return t.ptr, t.ptr.refresh()
+	})
+}
+
 type ptrDiscover struct {
 	hostname   sync.Map // ip => hostname
 	resolver   ctrld.Resolver
@@ -0,0 +1,66 @@
+package clientinfo
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+func init() {
+	registerProvider("Static", priorityStatic, func(t *Table) (Provider, error) {
+		t.static = &staticClients{}
+		t.static.update(t.clients)
+		return t.static, nil
+	})
+}
+
+// staticClients provides client names configured by users in [clients] config section.
+type staticClients struct {
+	clients atomic.Pointer[map[string]*ctrld.ClientConfig]
+}
+
+// update replaces configured clients with the given ones.
+func (s *staticClients) update(clients map[string]*ctrld.ClientConfig) {
+	m := make(map[string]*ctrld.ClientConfig, len(clients))
+	for k, v := range clients {
+		m[strings.ToLower(k)] = v
+	}
+	s.clients.Store(&m)
+}
+
+func (s *staticClients) lookup(key string) *ctrld.ClientConfig {
+	m := s.clients.Load()
+	if m == nil || key == "" {
+		return nil
+	}
+	return (*m)[strings.ToLower(key)]
+}
+
+// LookupHostnameByIP returns the configured name of client with given IP.
+func (s *staticClients) LookupHostnameByIP(ip string) string {
+	if c := s.lookup(ip); c != nil {
+		return c.Name
+	}
+	return ""
+}
+
+// LookupHostnameByMac returns the configured name of client with given MAC address.
+func (s *staticClients) LookupHostnameByMac(mac string) string {
+	if c := s.lookup(mac); c != nil {
+		return c.Name
+	}
+	return ""
+}
+
+// String returns human-readable format of staticClients.
+func (s *staticClients) String() string {
+	return "static"
+}
+
+// UpdateClients updates static clients config of the table, used after config reloaded.
+func (t *Table) UpdateClients(clients map[string]*ctrld.ClientConfig) {
+	if t != nil && t.static != nil {
+		t.static.update(clients)
+	}
+}
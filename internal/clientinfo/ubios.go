@@ -12,6 +12,16 @@ import (
 	"github.com/Control-D-Inc/ctrld/internal/router/ubios"
 )
 
+func init() {
+	registerProvider("Ubios", priorityRouter, func(t *Table) (Provider, error) {
+		if !t.discoverDHCP() && !t.discoverARP() {
+			return nil, nil
+		}
+		t.ubios = &ubiosDiscover{}
+		return t.ubios, t.ubios.refresh()
+	})
+}
+
 // ubiosDiscover provides client discovery functionality on Ubios routers.
 type ubiosDiscover struct {
 	hostname sync.Map // mac => hostname
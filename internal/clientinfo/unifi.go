@@ -0,0 +1,249 @@
+package clientinfo
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+const (
+	// defaultUnifiAPIURL is the UniFi OS console local address.
+	defaultUnifiAPIURL = "https://127.0.0.1"
+	// unifiClientsPath is the path of UniFi Network API listing active clients of default site.
+	unifiClientsPath = "/proxy/network/api/s/default/stat/sta"
+	unifiAPITimeout  = 5 * time.Second
+)
+
+func init() {
+	registerProvider("UniFi", priorityUnifi, func(t *Table) (Provider, error) {
+		if t.svcCfg.UnifiAPIKey == "" && !strings.HasPrefix(t.svcCfg.UnifiAPIURL, "unix://") {
+			return nil, nil
+		}
+		if !t.discoverDHCP() && !t.discoverARP() {
+			return nil, nil
+		}
+		u, err := newUnifiDiscover(t.svcCfg.UnifiAPIURL, t.svcCfg.UnifiAPIKey)
+		if err != nil {
+			return nil, err
+		}
+		t.unifi = u
+		ctrld.ProxyLogger.Load().Debug().Msg("start unifi discovery")
+		// The controller may not be ready yet at boot, periodic refresh will recover.
+		if err := t.unifi.refresh(); err != nil {
+			ctrld.ProxyLogger.Load().Warn().Err(err).Msg("could not refresh unifi clients")
+		}
+		return t.unifi, nil
+	})
+}
+
+// unifiClient is a client returned by UniFi Network API.
+type unifiClient struct {
+	Mac      string `json:"mac"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	Name     string `json:"name"`    // Alias set by user in UniFi Network UI.
+	Network  string `json:"network"` // Name of the network which the client connected to.
+}
+
+// unifiClients is the client list, indexed by MAC and IP.
+type unifiClients struct {
+	byMac map[string]*unifiClient
+	byIP  map[string]*unifiClient
+}
+
+// unifiDiscover provides client discovery functionality using local UniFi Network API,
+// which knows every client's MAC, IP, hostname, and the network it connected to.
+type unifiDiscover struct {
+	url    string
+	apiKey string
+	client *http.Client
+
+	mu      sync.RWMutex
+	clients *unifiClients
+}
+
+// newUnifiDiscover returns new unifiDiscover using the API at given URL. The URL could be
+// either a http(s) URL, or a unix socket in form "unix:///path/to/socket".
+func newUnifiDiscover(apiURL, apiKey string) (*unifiDiscover, error) {
+	if apiURL == "" {
+		apiURL = defaultUnifiAPIURL
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unifi api url: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		apiURL = "http://unix"
+	case "http", "https":
+		// UniFi OS console uses self-signed certificate, only skip verification for local address.
+		if ip, err := netip.ParseAddr(u.Hostname()); err == nil && ip.IsLoopback() {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported unifi api url scheme: %q", u.Scheme)
+	}
+	return &unifiDiscover{
+		url:     strings.TrimSuffix(apiURL, "/") + unifiClientsPath,
+		apiKey:  apiKey,
+		client:  &http.Client{Transport: transport, Timeout: unifiAPITimeout},
+		clients: &unifiClients{},
+	}, nil
+}
+
+// refresh reloads client list from UniFi Network API. Clients which are no longer
+// active are removed, so stale entries are not kept after lease turnover.
+func (u *unifiDiscover) refresh() error {
+	req, err := http.NewRequest(http.MethodGet, u.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if u.apiKey != "" {
+		req.Header.Set("X-API-KEY", u.apiKey)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unifi api: unexpected status: %s", resp.Status)
+	}
+	clients, err := parseUnifiClients(resp.Body)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.clients = clients
+	u.mu.Unlock()
+	return nil
+}
+
+// parseUnifiClients parses clients from UniFi Network API response.
+func parseUnifiClients(r io.Reader) (*unifiClients, error) {
+	var res struct {
+		Meta struct {
+			RC  string `json:"rc"`
+			Msg string `json:"msg"`
+		} `json:"meta"`
+		Data []*unifiClient `json:"data"`
+	}
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, fmt.Errorf("unifi api: invalid response: %w", err)
+	}
+	if res.Meta.RC != "" && res.Meta.RC != "ok" {
+		return nil, fmt.Errorf("unifi api: %s", res.Meta.Msg)
+	}
+	clients := &unifiClients{
+		byMac: make(map[string]*unifiClient, len(res.Data)),
+		byIP:  make(map[string]*unifiClient, len(res.Data)),
+	}
+	for _, c := range res.Data {
+		if c.Mac == "" {
+			continue
+		}
+		c.Mac = strings.ToLower(c.Mac)
+		clients.byMac[c.Mac] = c
+		if c.IP != "" {
+			clients.byIP[c.IP] = c
+		}
+	}
+	return clients, nil
+}
+
+// hostname returns the name of client, user's alias is preferred.
+func (c *unifiClient) hostname() string {
+	if c.Name != "" {
+		return normalizeHostname(c.Name)
+	}
+	return normalizeHostname(c.Hostname)
+}
+
+func (u *unifiDiscover) load() *unifiClients {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.clients
+}
+
+// LookupIP returns the IP of client with given MAC address.
+func (u *unifiDiscover) LookupIP(mac string) string {
+	if c := u.load().byMac[mac]; c != nil {
+		return c.IP
+	}
+	return ""
+}
+
+// LookupMac returns the MAC address of client with given IP.
+func (u *unifiDiscover) LookupMac(ip string) string {
+	if c := u.load().byIP[ip]; c != nil {
+		return c.Mac
+	}
+	return ""
+}
+
+// LookupHostnameByIP returns the hostname of client with given IP.
+func (u *unifiDiscover) LookupHostnameByIP(ip string) string {
+	if c := u.load().byIP[ip]; c != nil {
+		return c.hostname()
+	}
+	return ""
+}
+
+// LookupHostnameByMac returns the hostname of client with given MAC address.
+func (u *unifiDiscover) LookupHostnameByMac(mac string) string {
+	if c := u.load().byMac[mac]; c != nil {
+		return c.hostname()
+	}
+	return ""
+}
+
+// String returns human-readable format of unifiDiscover.
+func (u *unifiDiscover) String() string {
+	return "unifi"
+}
+
+// List returns all known IP addresses.
+func (u *unifiDiscover) List() []string {
+	if u == nil {
+		return nil
+	}
+	clients := u.load()
+	ips := make([]string, 0, len(clients.byIP))
+	for ip := range clients.byIP {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func (u *unifiDiscover) lookupIPByHostname(name string, v6 bool) string {
+	if u == nil {
+		return ""
+	}
+	for ip, c := range u.load().byIP {
+		if c.hostname() != name {
+			continue
+		}
+		if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() == v6 {
+			return addr.String()
+		}
+	}
+	return ""
+}
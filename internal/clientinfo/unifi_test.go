@@ -0,0 +1,76 @@
+package clientinfo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const unifiClientsResponse = `{
+  "meta": {"rc": "ok"},
+  "data": [
+    {"mac": "00:00:00:00:00:01", "ip": "192.168.1.10", "hostname": "iPhone", "name": "Alice iPhone", "network": "Default"},
+    {"mac": "00:00:00:00:00:02", "ip": "192.168.20.10", "hostname": "DESKTOP-FOO", "network": "IoT"},
+    {"mac": "00:00:00:00:00:03", "hostname": "no-ip"},
+    {"ip": "192.168.1.99", "hostname": "no-mac"}
+  ]
+}`
+
+func Test_unifiDiscover(t *testing.T) {
+	response := unifiClientsResponse
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != unifiClientsPath || r.Header.Get("X-API-KEY") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(response))
+	}))
+	defer srv.Close()
+
+	u, err := newUnifiDiscover(srv.URL, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		mac      string
+		hostname string
+	}{
+		{"alias preferred", "192.168.1.10", "00:00:00:00:00:01", "Alice iPhone"},
+		{"hostname", "192.168.20.10", "00:00:00:00:00:02", "DESKTOP-FOO"},
+		{"no mac", "192.168.1.99", "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := u.LookupMac(tc.ip); got != tc.mac {
+				t.Errorf("unexpected mac, want: %q, got: %q", tc.mac, got)
+			}
+			if got := u.LookupHostnameByIP(tc.ip); got != tc.hostname {
+				t.Errorf("unexpected hostname, want: %q, got: %q", tc.hostname, got)
+			}
+		})
+	}
+	if got := u.LookupHostnameByMac("00:00:00:00:00:03"); got != "no-ip" {
+		t.Errorf("unexpected hostname, want: %q, got: %q", "no-ip", got)
+	}
+
+	// Clients which are gone must be removed.
+	response = `{"meta": {"rc": "ok"}, "data": []}`
+	if err := u.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if ips := u.List(); len(ips) != 0 {
+		t.Errorf("stale clients: %v", ips)
+	}
+
+	// Invalid API key.
+	u.apiKey = "invalid"
+	if err := u.refresh(); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
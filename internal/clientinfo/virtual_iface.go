@@ -4,6 +4,16 @@ import (
 	"sync"
 )
 
+func init() {
+	registerProvider("VPN clients", priorityVirtual, func(t *Table) (Provider, error) {
+		if !t.discoverDHCP() && !t.discoverARP() {
+			return nil, nil
+		}
+		t.vni = &virtualNetworkIface{}
+		return t.vni, nil
+	})
+}
+
 // virtualNetworkIface is the manager for clients from virtual network interface.
 type virtualNetworkIface struct {
 	ip2name sync.Map // ip  => name
@@ -121,8 +121,9 @@ func postUtilityAPI(version string, cdDev bool, body io.Reader) (*ResolverConfig
 		return d.DialContext(ctx, network, addrs)
 	}
 
+	transport.TLSClientConfig = &tls.Config{Time: ctrld.Now}
 	if router.Name() == ddwrt.Name || runtime.GOOS == "android" {
-		transport.TLSClientConfig = &tls.Config{RootCAs: certs.CACertPool()}
+		transport.TLSClientConfig.RootCAs = certs.CACertPool()
 	}
 	client := http.Client{
 		Timeout:   10 * time.Second,
@@ -0,0 +1,278 @@
+package dhcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// offerHoldTime is the time an offered address is held for the client, waiting for its request.
+const offerHoldTime = time.Minute
+
+// Lease is an address leased to a client.
+type Lease struct {
+	MAC      string
+	IP       netip.Addr
+	Hostname string
+	Expiry   time.Time
+
+	// offered reports whether the address was only offered, not yet acknowledged.
+	offered bool
+}
+
+// leaseDB is the lease database of a DHCP server. Leases are saved to a file in dnsmasq lease
+// file format, so the file could be read by other tools, and by client info table of ctrld.
+type leaseDB struct {
+	path     string
+	start    netip.Addr
+	end      netip.Addr
+	serverIP netip.Addr
+	reserved map[string]netip.Addr // mac => ip
+	ipOwner  map[netip.Addr]string // ip  => mac, of reserved addresses.
+
+	mu     sync.Mutex
+	leases map[netip.Addr]*Lease
+}
+
+// newLeaseDB returns new leaseDB, which leases addresses in range [start, end], and the reserved ones.
+func newLeaseDB(path string, start, end, serverIP netip.Addr, reserved map[string]netip.Addr) *leaseDB {
+	db := &leaseDB{
+		path:     path,
+		start:    start,
+		end:      end,
+		serverIP: serverIP,
+		reserved: make(map[string]netip.Addr, len(reserved)),
+		ipOwner:  make(map[netip.Addr]string, len(reserved)),
+		leases:   make(map[netip.Addr]*Lease),
+	}
+	for mac, ip := range reserved {
+		mac = strings.ToLower(mac)
+		db.reserved[mac] = ip
+		db.ipOwner[ip] = mac
+	}
+	return db
+}
+
+// inRange reports whether ip is in the dynamic range of the database.
+func (db *leaseDB) inRange(ip netip.Addr) bool {
+	return db.start.Compare(ip) <= 0 && ip.Compare(db.end) <= 0
+}
+
+// available reports whether ip could be leased to the client with given mac.
+func (db *leaseDB) available(mac string, ip netip.Addr, now time.Time) bool {
+	if !ip.IsValid() || ip == db.serverIP {
+		return false
+	}
+	if owner, ok := db.ipOwner[ip]; ok && owner != mac {
+		return false
+	}
+	if !db.inRange(ip) && db.reserved[mac] != ip {
+		return false
+	}
+	l := db.leases[ip]
+	return l == nil || l.MAC == mac || !l.Expiry.After(now)
+}
+
+// leaseOf returns the lease of client with given mac, or nil if there is none.
+func (db *leaseDB) leaseOf(mac string) *Lease {
+	for _, l := range db.leases {
+		if l.MAC == mac {
+			return l
+		}
+	}
+	return nil
+}
+
+// offer returns the address offered to the client with given mac, preferring its reserved
+// address, its current lease, then the requested address. The address is held for the
+// client for offerHoldTime. It reports false if there is no available address.
+func (db *leaseDB) offer(mac string, requested netip.Addr, now time.Time) (netip.Addr, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ip, ok := db.selectAddr(mac, requested, now)
+	if !ok {
+		return ip, false
+	}
+	if l := db.leases[ip]; l == nil || l.MAC != mac || l.Expiry.Before(now.Add(offerHoldTime)) {
+		db.leases[ip] = &Lease{MAC: mac, IP: ip, Expiry: now.Add(offerHoldTime), offered: true}
+	}
+	return ip, true
+}
+
+func (db *leaseDB) selectAddr(mac string, requested netip.Addr, now time.Time) (netip.Addr, bool) {
+	if ip, ok := db.reserved[mac]; ok && db.available(mac, ip, now) {
+		return ip, true
+	}
+	if l := db.leaseOf(mac); l != nil && db.available(mac, l.IP, now) {
+		return l.IP, true
+	}
+	if db.available(mac, requested, now) {
+		return requested, true
+	}
+	// Prefer addresses which were never leased, so expired leases could be
+	// given back to their clients as long as possible.
+	var expired netip.Addr
+	for ip := db.start; ip.IsValid() && ip.Compare(db.end) <= 0; ip = ip.Next() {
+		if !db.available(mac, ip, now) {
+			continue
+		}
+		if db.leases[ip] == nil {
+			return ip, true
+		}
+		if !expired.IsValid() {
+			expired = ip
+		}
+	}
+	return expired, expired.IsValid()
+}
+
+// commit leases ip to the client with given mac for leaseTime. It reports false if ip
+// could not be leased to the client.
+func (db *leaseDB) commit(mac string, ip netip.Addr, hostname string, leaseTime time.Duration, now time.Time) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.available(mac, ip, now) {
+		return false
+	}
+	// A client holds only one lease.
+	for addr, l := range db.leases {
+		if l.MAC == mac && addr != ip {
+			delete(db.leases, addr)
+		}
+	}
+	db.leases[ip] = &Lease{MAC: mac, IP: ip, Hostname: hostname, Expiry: now.Add(leaseTime)}
+	return true
+}
+
+// release removes the lease of ip, if it is leased to the client with given mac.
+// It reports whether the lease was removed.
+func (db *leaseDB) release(mac string, ip netip.Addr) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if l := db.leases[ip]; l != nil && l.MAC == mac {
+		delete(db.leases, ip)
+		return true
+	}
+	return false
+}
+
+// decline marks ip as being used by another device, so it is not leased for the given duration.
+func (db *leaseDB) decline(mac string, ip netip.Addr, d time.Duration, now time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if l := db.leases[ip]; l != nil && l.MAC == mac {
+		db.leases[ip] = &Lease{IP: ip, Expiry: now.Add(d)}
+	}
+}
+
+// activeLeases returns leases which are acknowledged and not expired, sorted by IP.
+func (db *leaseDB) activeLeases(now time.Time) []Lease {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	leases := make([]Lease, 0, len(db.leases))
+	for _, l := range db.leases {
+		if l.MAC == "" || l.offered || !l.Expiry.After(now) {
+			continue
+		}
+		leases = append(leases, *l)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].IP.Less(leases[j].IP)
+	})
+	return leases
+}
+
+// save writes active leases to the lease file in dnsmasq format:
+//
+//	<expiry> <mac> <ip> <hostname> <client id>
+//
+// The leases are written to a temporary file, which then replaces the lease file, so a crash
+// or power loss never leaves a truncated lease file behind.
+func (db *leaseDB) save(now time.Time) error {
+	var buf bytes.Buffer
+	for _, l := range db.activeLeases(now) {
+		hostname := l.Hostname
+		if hostname == "" {
+			hostname = "*"
+		}
+		fmt.Fprintf(&buf, "%d %s %s %s *\n", l.Expiry.Unix(), l.MAC, l.IP, hostname)
+	}
+	f, err := os.CreateTemp(filepath.Dir(db.path), "."+filepath.Base(db.path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, db.path)
+}
+
+// load reads leases from the lease file, expired leases are kept, so they could be given
+// back to their clients.
+func (db *leaseDB) load() error {
+	f, err := os.Open(db.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		hw, err := net.ParseMAC(fields[1])
+		if err != nil {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[2])
+		if err != nil || !ip.Is4() {
+			continue
+		}
+		hostname := fields[3]
+		if hostname == "*" {
+			hostname = ""
+		}
+		db.leases[ip] = &Lease{MAC: hw.String(), IP: ip, Hostname: hostname, Expiry: time.Unix(expiry, 0)}
+	}
+	return s.Err()
+}
+
+// sanitizeHostname returns hostname which is safe to be written to lease file.
+func sanitizeHostname(hostname string) string {
+	return strings.Join(strings.Fields(hostname), "-")
+}
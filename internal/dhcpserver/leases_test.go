@@ -0,0 +1,146 @@
+package dhcpserver
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	mac1 = "00:00:00:00:00:01"
+	mac2 = "00:00:00:00:00:02"
+	mac3 = "00:00:00:00:00:03"
+)
+
+func newTestLeaseDB(t *testing.T) *leaseDB {
+	t.Helper()
+	return newLeaseDB(
+		filepath.Join(t.TempDir(), "leases"),
+		netip.MustParseAddr("192.168.1.100"),
+		netip.MustParseAddr("192.168.1.101"),
+		netip.MustParseAddr("192.168.1.1"),
+		map[string]netip.Addr{mac3: netip.MustParseAddr("192.168.1.10")},
+	)
+}
+
+func Test_leaseDB_offer(t *testing.T) {
+	db := newTestLeaseDB(t)
+	now := time.Now()
+
+	ip1, ok := db.offer(mac1, netip.Addr{}, now)
+	if !ok || ip1 != netip.MustParseAddr("192.168.1.100") {
+		t.Fatalf("unexpected offer: %v, %v", ip1, ok)
+	}
+	// Offered address is held for the client.
+	if ip, _ := db.offer(mac2, ip1, now); ip == ip1 {
+		t.Errorf("held address must not be offered to another client")
+	}
+	// Reserved address is always offered to its client.
+	if ip, _ := db.offer(mac3, netip.Addr{}, now); ip != netip.MustParseAddr("192.168.1.10") {
+		t.Errorf("unexpected offer for reserved client: %v", ip)
+	}
+	// Pool is exhausted.
+	if _, ok := db.offer("00:00:00:00:00:04", netip.Addr{}, now); ok {
+		t.Error("unexpected offer when pool is exhausted")
+	}
+	// Held address is released after offerHoldTime.
+	if ip, ok := db.offer("00:00:00:00:00:04", netip.Addr{}, now.Add(2*offerHoldTime)); !ok || !db.inRange(ip) {
+		t.Errorf("unexpected offer after hold time: %v, %v", ip, ok)
+	}
+}
+
+func Test_leaseDB_commit(t *testing.T) {
+	db := newTestLeaseDB(t)
+	now := time.Now()
+	ip1 := netip.MustParseAddr("192.168.1.100")
+	ip2 := netip.MustParseAddr("192.168.1.101")
+
+	if !db.commit(mac1, ip1, "host1", time.Hour, now) {
+		t.Fatal("commit failed")
+	}
+	if db.commit(mac2, ip1, "host2", time.Hour, now) {
+		t.Error("leased address must not be committed to another client")
+	}
+	if db.commit(mac2, netip.MustParseAddr("192.168.1.10"), "host2", time.Hour, now) {
+		t.Error("reserved address must not be committed to another client")
+	}
+	if db.commit(mac2, netip.MustParseAddr("192.168.1.200"), "host2", time.Hour, now) {
+		t.Error("address out of range must not be committed")
+	}
+	// A client holds only one lease.
+	if !db.commit(mac1, ip2, "host1", time.Hour, now) {
+		t.Fatal("commit failed")
+	}
+	if leases := db.activeLeases(now); len(leases) != 1 || leases[0].IP != ip2 {
+		t.Errorf("unexpected leases: %v", leases)
+	}
+	// Expired lease could be reused.
+	if !db.commit(mac2, ip2, "host2", time.Hour, now.Add(2*time.Hour)) {
+		t.Error("expired lease must be reusable")
+	}
+	// Expired lease is given back to its client first.
+	if ip, _ := db.offer(mac2, netip.Addr{}, now.Add(4*time.Hour)); ip != ip2 {
+		t.Errorf("expired lease must be offered to its client, got: %v", ip)
+	}
+}
+
+func Test_leaseDB_release(t *testing.T) {
+	db := newTestLeaseDB(t)
+	now := time.Now()
+	ip := netip.MustParseAddr("192.168.1.100")
+	db.commit(mac1, ip, "", time.Hour, now)
+
+	if db.release(mac2, ip) {
+		t.Error("lease must not be released by another client")
+	}
+	if !db.release(mac1, ip) {
+		t.Error("lease must be released by its client")
+	}
+	db.commit(mac1, ip, "", time.Hour, now)
+	db.decline(mac1, ip, time.Hour, now)
+	if db.available(mac2, ip, now) {
+		t.Error("declined address must not be available")
+	}
+}
+
+func Test_leaseDB_saveLoad(t *testing.T) {
+	db := newTestLeaseDB(t)
+	now := time.Now()
+	db.commit(mac1, netip.MustParseAddr("192.168.1.100"), "host1", time.Hour, now)
+	db.commit(mac3, netip.MustParseAddr("192.168.1.10"), "", time.Hour, now)
+	db.offer(mac2, netip.Addr{}, now)
+	if err := db.save(now); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(db.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary lease file must be removed, got: %v", entries)
+	}
+	content, err := os.ReadFile(db.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("offered lease must not be saved, got: %q", content)
+	}
+	if fields := strings.Fields(lines[0]); len(fields) != 5 || fields[1] != mac3 || fields[3] != "*" {
+		t.Errorf("unexpected lease line: %q", lines[0])
+	}
+
+	loaded := newTestLeaseDB(t)
+	loaded.path = db.path
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	leases := loaded.activeLeases(now)
+	if len(leases) != 2 || leases[1].Hostname != "host1" || leases[1].MAC != mac1 {
+		t.Errorf("unexpected loaded leases: %v", leases)
+	}
+}
@@ -0,0 +1,232 @@
+// Package dhcpserver implements a lightweight DHCPv4 server, for routers where ctrld
+// replaces dnsmasq entirely, so DHCP service is not lost.
+package dhcpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// Config is the config of a DHCP server.
+type Config struct {
+	// Interface is the network interface to serve.
+	Interface string
+	// ServerIP and SubnetMask are the address and mask of the interface.
+	ServerIP   netip.Addr
+	SubnetMask net.IPMask
+	// RangeStart and RangeEnd are the first and last address of the dynamic pool.
+	RangeStart netip.Addr
+	RangeEnd   netip.Addr
+	// Router and DNS are the gateway (option 3) and DNS servers (option 6) sent to clients.
+	Router []net.IP
+	DNS    []net.IP
+	// Domain is the domain name (option 15) sent to clients, if not empty.
+	Domain    string
+	LeaseTime time.Duration
+	// Reservations are static leases, mac => ip.
+	Reservations map[string]netip.Addr
+	// LeaseFile is the path to lease database file.
+	LeaseFile string
+	// OnFingerprint, if set, is called with the fingerprint of clients which were leased an address.
+	OnFingerprint func(fp Fingerprint)
+}
+
+// Fingerprint is the DHCP fingerprint of a client, used for classifying devices.
+type Fingerprint struct {
+	Mac      string
+	Hostname string
+	// Options is the parameter request list (option 55) in request order, e.g: "1,3,6,15".
+	Options string
+	// VendorClass is the vendor class identifier (option 60).
+	VendorClass string
+}
+
+// Server is a DHCPv4 server serving a single network interface.
+type Server struct {
+	cfg *Config
+	db  *leaseDB
+	srv *server4.Server
+}
+
+// New returns new Server with given config. Leases are loaded from the lease file, which is
+// created if not existed, so it could be watched by others right after New returns.
+func New(cfg *Config) (*Server, error) {
+	if !cfg.ServerIP.Is4() || !cfg.RangeStart.Is4() || !cfg.RangeEnd.Is4() {
+		return nil, errors.New("dhcp server: IPv4 addresses are required")
+	}
+	if cfg.RangeEnd.Less(cfg.RangeStart) {
+		return nil, fmt.Errorf("dhcp server: invalid range: %s - %s", cfg.RangeStart, cfg.RangeEnd)
+	}
+	s := &Server{
+		cfg: cfg,
+		db:  newLeaseDB(cfg.LeaseFile, cfg.RangeStart, cfg.RangeEnd, cfg.ServerIP, cfg.Reservations),
+	}
+	if err := s.db.load(); err != nil && !os.IsNotExist(err) {
+		ctrld.ProxyLogger.Load().Warn().Err(err).Msgf("could not load dhcp leases from: %s", cfg.LeaseFile)
+	}
+	if err := s.db.save(time.Now()); err != nil {
+		return nil, fmt.Errorf("dhcp server: could not write lease file: %w", err)
+	}
+	laddr := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}
+	srv, err := server4.NewServer(cfg.Interface, laddr, s.handle)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp server: %w", err)
+	}
+	s.srv = srv
+	return s, nil
+}
+
+// Serve serves DHCP requests until the server is closed.
+func (s *Server) Serve() error {
+	return s.srv.Serve()
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+func (s *Server) handle(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		return
+	}
+	resp, err := s.reply(req, time.Now())
+	if err != nil {
+		ctrld.ProxyLogger.Load().Error().Err(err).Msg("could not create dhcp reply")
+		return
+	}
+	if resp == nil {
+		return
+	}
+	ctrld.ProxyLogger.Load().Debug().Msgf("dhcp %s: %s -> %s", s.cfg.Interface, req.MessageType(), resp.MessageType())
+	if _, err := conn.WriteTo(resp.ToBytes(), replyAddr(req, resp)); err != nil {
+		ctrld.ProxyLogger.Load().Error().Err(err).Msg("could not send dhcp reply")
+	}
+}
+
+// reply returns the reply for req, or nil if there is nothing to reply.
+func (s *Server) reply(req *dhcpv4.DHCPv4, now time.Time) (*dhcpv4.DHCPv4, error) {
+	mac := req.ClientHWAddr.String()
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		ip, ok := s.db.offer(mac, addrFromIP(req.RequestedIPAddress()), now)
+		if !ok {
+			ctrld.ProxyLogger.Load().Warn().Msgf("dhcp %s: no free address for: %s", s.cfg.Interface, mac)
+			return nil, nil
+		}
+		return s.newReply(req, dhcpv4.MessageTypeOffer, ip)
+	case dhcpv4.MessageTypeRequest:
+		if sid := req.ServerIdentifier(); sid != nil && !sid.Equal(s.cfg.ServerIP.AsSlice()) {
+			// The client selected another server.
+			return nil, nil
+		}
+		ip := addrFromIP(req.RequestedIPAddress())
+		if !ip.IsValid() {
+			ip = addrFromIP(req.ClientIPAddr)
+		}
+		if !s.db.commit(mac, ip, sanitizeHostname(req.HostName()), s.cfg.LeaseTime, now) {
+			return dhcpv4.NewReplyFromRequest(req,
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.cfg.ServerIP.AsSlice())),
+			)
+		}
+		s.saveLeases(now)
+		if s.cfg.OnFingerprint != nil {
+			s.cfg.OnFingerprint(fingerprintOf(req))
+		}
+		return s.newReply(req, dhcpv4.MessageTypeAck, ip)
+	case dhcpv4.MessageTypeRelease:
+		if s.db.release(mac, addrFromIP(req.ClientIPAddr)) {
+			s.saveLeases(now)
+		}
+	case dhcpv4.MessageTypeDecline:
+		s.db.decline(mac, addrFromIP(req.RequestedIPAddress()), s.cfg.LeaseTime, now)
+		s.saveLeases(now)
+	case dhcpv4.MessageTypeInform:
+		// The client already has an address, only configuration is sent.
+		return s.newReply(req, dhcpv4.MessageTypeAck, netip.Addr{})
+	}
+	return nil, nil
+}
+
+// newReply returns the reply for req with given message type, leasing ip if it is valid.
+func (s *Server) newReply(req *dhcpv4.DHCPv4, typ dhcpv4.MessageType, ip netip.Addr) (*dhcpv4.DHCPv4, error) {
+	mods := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(typ),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.cfg.ServerIP.AsSlice())),
+		dhcpv4.WithNetmask(s.cfg.SubnetMask),
+	}
+	if len(s.cfg.Router) > 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRouter(s.cfg.Router...)))
+	}
+	if len(s.cfg.DNS) > 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptDNS(s.cfg.DNS...)))
+	}
+	if s.cfg.Domain != "" {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptDomainName(s.cfg.Domain)))
+	}
+	if ip.IsValid() {
+		mods = append(mods,
+			dhcpv4.WithYourIP(ip.AsSlice()),
+			dhcpv4.WithLeaseTime(uint32(s.cfg.LeaseTime.Seconds())),
+		)
+	}
+	return dhcpv4.NewReplyFromRequest(req, mods...)
+}
+
+func (s *Server) saveLeases(now time.Time) {
+	if err := s.db.save(now); err != nil {
+		ctrld.ProxyLogger.Load().Error().Err(err).Msg("could not save dhcp leases")
+	}
+}
+
+// fingerprintOf returns the fingerprint of the client sending req.
+func fingerprintOf(req *dhcpv4.DHCPv4) Fingerprint {
+	prl := req.ParameterRequestList()
+	codes := make([]string, len(prl))
+	for i, code := range prl {
+		codes[i] = strconv.Itoa(int(code.Code()))
+	}
+	return Fingerprint{
+		Mac:         req.ClientHWAddr.String(),
+		Hostname:    req.HostName(),
+		Options:     strings.Join(codes, ","),
+		VendorClass: req.ClassIdentifier(),
+	}
+}
+
+// replyAddr returns the address where resp should be sent to (RFC 2131, section 4.1).
+func replyAddr(req, resp *dhcpv4.DHCPv4) net.Addr {
+	switch {
+	case req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified():
+		return &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	case resp.MessageType() == dhcpv4.MessageTypeNak:
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	case req.ClientIPAddr != nil && !req.ClientIPAddr.IsUnspecified():
+		return &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}
+	}
+	// The client does not have an address yet, and unicast without ARP entry is not
+	// possible with UDP socket, so always broadcast.
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+}
+
+// addrFromIP converts ip to netip.Addr, returning zero Addr if ip is not a valid IPv4 address.
+func addrFromIP(ip net.IP) netip.Addr {
+	ip4 := ip.To4()
+	if ip4 == nil || ip4.IsUnspecified() {
+		return netip.Addr{}
+	}
+	addr, _ := netip.AddrFromSlice(ip4)
+	return addr
+}
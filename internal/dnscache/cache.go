@@ -1,7 +1,9 @@
 package dnscache
 
 import (
+	"hash/maphash"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -20,33 +22,167 @@ type Key struct {
 	Qclass   uint16
 	Name     string
 	Upstream string
+	// Subnet is the client subnet which the answer is scoped to, empty for answers of all clients.
+	Subnet string
 }
 
 type Value struct {
 	Expire time.Time
 	Msg    *dns.Msg
+	// Scopes is the list of scope prefix lengths of answers cached per client subnet.
+	// If not empty, Msg is nil, the answers must be looked up using keys with Subnet set.
+	Scopes []uint8
+
+	hits       atomic.Uint32
+	prefetched atomic.Bool
+	refreshing atomic.Bool
+}
+
+// Hit records a cache hit of v, returning the number of hits so far.
+func (v *Value) Hit() uint32 {
+	return v.hits.Add(1)
+}
+
+// Hits returns the number of hits of v.
+func (v *Value) Hits() uint32 {
+	return v.hits.Load()
+}
+
+// StartPrefetch reports whether the caller should prefetch v, it returns true for the first caller only,
+// so a popular answer is refreshed once.
+func (v *Value) StartPrefetch() bool {
+	return v.prefetched.CompareAndSwap(false, true)
+}
+
+// StartRefresh reports whether the caller should refresh expired v, it returns true for the first caller only,
+// until FinishRefresh is called, so concurrent queries of a stale answer send a single query to upstreams.
+func (v *Value) StartRefresh() bool {
+	return v.refreshing.CompareAndSwap(false, true)
+}
+
+// FinishRefresh marks the refresh started by StartRefresh done, so v could be refreshed again if it failed.
+func (v *Value) FinishRefresh() {
+	v.refreshing.Store(false)
 }
 
 var _ Cacher = (*LRUCache)(nil)
 
+const (
+	// maxShards is the maximum number of shards of LRUCache.
+	maxShards = 16
+	// minShardSize is the minimum number of entries of a shard. Small caches have fewer shards,
+	// so entries of a busy shard are not evicted while other shards are almost empty.
+	minShardSize = 256
+)
+
 // LRUCache implements Cacher interface.
+//
+// Entries are spread over shards by hash of their name and type. Each shard has its own lock,
+// so concurrent queries of different names do not wait for each other.
 type LRUCache struct {
-	cacher *lru.ARCCache[Key, *Value]
+	shards []*shard
+	seed   maphash.Seed
+	size   int
+	stats  counters
+}
+
+// shard is an ARC cache holding a part of LRUCache entries.
+type shard struct {
+	*lru.ARCCache[Key, *Value]
+	size int
 }
 
 func (l *LRUCache) Get(key Key) *Value {
-	v, _ := l.cacher.Get(key)
+	v, _ := l.shardFor(key).Get(key)
 	return v
 }
 
 func (l *LRUCache) Add(key Key, value *Value) {
-	l.cacher.Add(key, value)
+	s := l.shardFor(key)
+	if s.Len() >= s.size && !s.Contains(key) {
+		l.stats.evictions.Add(1)
+	}
+	s.Add(key, value)
+}
+
+// Len returns the number of entries of l.
+func (l *LRUCache) Len() int {
+	n := 0
+	for _, s := range l.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// Purge removes entries of name and its subdomains from l, or all entries if name is empty,
+// returning the number of removed entries.
+func (l *LRUCache) Purge(name string) int {
+	if name != "" {
+		name = normalizeQname(dns.Fqdn(name))
+	}
+	n := 0
+	for _, s := range l.shards {
+		if name == "" {
+			n += s.Len()
+			s.Purge()
+			continue
+		}
+		for _, key := range s.Keys() {
+			if key.Name == name || dns.IsSubDomain(name, key.Name) {
+				s.Remove(key)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// each calls f for all entries of l, without changing their recentness.
+func (l *LRUCache) each(f func(key Key, v *Value)) {
+	for _, s := range l.shards {
+		for _, key := range s.Keys() {
+			if v, ok := s.Peek(key); ok {
+				f(key, v)
+			}
+		}
+	}
+}
+
+// shardFor returns the shard of key. Keys with the same name and type, but different upstreams
+// or client subnets, are in the same shard.
+func (l *LRUCache) shardFor(key Key) *shard {
+	if len(l.shards) == 1 {
+		return l.shards[0]
+	}
+	h := maphash.String(l.seed, key.Name) ^ uint64(key.Qtype)*0x9e3779b97f4a7c15
+	return l.shards[h&uint64(len(l.shards)-1)]
 }
 
 // NewLRUCache creates a new LRUCache instance with given size.
 func NewLRUCache(size int) (*LRUCache, error) {
-	cacher, err := lru.NewARC[Key, *Value](size)
-	return &LRUCache{cacher: cacher}, err
+	n := 1
+	for n < maxShards && size/(n*2) >= minShardSize {
+		n *= 2
+	}
+	return newLRUCache(size, n)
+}
+
+// newLRUCache creates a new LRUCache instance with given size, split into n shards,
+// n must be a power of two.
+func newLRUCache(size, n int) (*LRUCache, error) {
+	l := &LRUCache{shards: make([]*shard, n), seed: maphash.MakeSeed(), size: size}
+	for i := range l.shards {
+		shardSize := size / n
+		if i < size%n {
+			shardSize++
+		}
+		cacher, err := lru.NewARC[Key, *Value](shardSize)
+		if err != nil {
+			return nil, err
+		}
+		l.shards[i] = &shard{ARCCache: cacher, size: shardSize}
+	}
+	return l, nil
 }
 
 // NewKey creates a new cache key for given DNS message.
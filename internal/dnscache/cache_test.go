@@ -0,0 +1,148 @@
+package dnscache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLRUCache_Purge(t *testing.T) {
+	names := []string{"example.com.", "www.example.com.", "WWW.Sub.Example.com.", "notexample.com.", "example.net."}
+	tests := []struct {
+		name       string
+		purge      string
+		wantPurged int
+	}{
+		{"all", "", 5},
+		{"subtree", "Example.com", 3},
+		{"name", "www.example.com.", 1},
+		{"none", "example.org", 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewLRUCache(16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range names {
+				msg := new(dns.Msg)
+				msg.SetQuestion(name, dns.TypeA)
+				c.Add(NewKey(msg, "upstream.0"), NewValue(msg, time.Now().Add(time.Minute)))
+			}
+			if n := c.Purge(tc.purge); n != tc.wantPurged {
+				t.Errorf("unexpected number of purged entries, want: %d, got: %d", tc.wantPurged, n)
+			}
+			if n := c.Len(); n != len(names)-tc.wantPurged {
+				t.Errorf("unexpected number of remaining entries, want: %d, got: %d", len(names)-tc.wantPurged, n)
+			}
+		})
+	}
+}
+
+func TestNewLRUCache_shards(t *testing.T) {
+	tests := []struct {
+		size       int
+		wantShards int
+	}{
+		{16, 1},
+		{1000, 2},
+		{4096, 16},
+		{100000, 16},
+	}
+	for _, tc := range tests {
+		c, err := NewLRUCache(tc.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.shards) != tc.wantShards {
+			t.Errorf("unexpected number of shards for size %d, want: %d, got: %d", tc.size, tc.wantShards, len(c.shards))
+		}
+		capacity := 0
+		for _, s := range c.shards {
+			capacity += s.size
+		}
+		if capacity != tc.size {
+			t.Errorf("unexpected capacity for size %d, got: %d", tc.size, capacity)
+		}
+	}
+
+	c, err := NewLRUCache(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion(fmt.Sprintf("host-%d.example.com.", i), dns.TypeA)
+		c.Add(NewKey(msg, "upstream.0"), NewValue(msg, time.Now().Add(time.Minute)))
+	}
+	if n := c.Len(); n != 1000 {
+		t.Errorf("unexpected number of entries, want: 1000, got: %d", n)
+	}
+	for _, s := range c.shards {
+		if s.Len() == 0 {
+			t.Error("entries are not spread over all shards")
+		}
+	}
+}
+
+func TestValue_StartRefresh(t *testing.T) {
+	v := NewValue(new(dns.Msg), time.Now())
+	if !v.StartRefresh() {
+		t.Fatal("first refresh must be started")
+	}
+	if v.StartRefresh() {
+		t.Error("refresh must not be started while another one is in progress")
+	}
+	v.FinishRefresh()
+	if !v.StartRefresh() {
+		t.Error("refresh must be started again after the previous one finished")
+	}
+}
+
+// BenchmarkLRUCache measures concurrent lookups of a busy cache, run it with -cpu 1,2,4,8
+// to compare the scalability of a single shard and a sharded cache.
+func BenchmarkLRUCache(b *testing.B) {
+	const names = 10000
+	msgs := make([]*dns.Msg, names)
+	for i := range msgs {
+		msgs[i] = new(dns.Msg)
+		msgs[i].SetQuestion(fmt.Sprintf("host-%d.example.com.", i), dns.TypeA)
+	}
+	for _, bc := range []struct {
+		name   string
+		shards int
+	}{
+		{"single shard", 1},
+		{"sharded", maxShards},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			// Room for all names, so lookups do not miss because of uneven shards.
+			c, err := newLRUCache(2*names, bc.shards)
+			if err != nil {
+				b.Fatal(err)
+			}
+			expire := time.Now().Add(time.Hour)
+			for _, msg := range msgs {
+				c.Add(NewKey(msg, "upstream.0"), NewValue(msg, expire))
+			}
+			var seq atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seq.Add(1)) * 7919
+				for pb.Next() {
+					msg := msgs[i%names]
+					// One write per ten lookups, like answers of expired entries being cached again.
+					if i%10 == 0 {
+						c.Add(NewKey(msg, "upstream.0"), NewValue(msg, expire))
+					} else {
+						Get(c, msg, "upstream.0")
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package dnscache
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Get returns the cached answer of msg from given upstream, or nil if not found.
+//
+// If msg carries an EDNS Client Subnet option, answers which were scoped to a client
+// subnet by upstream are only returned for clients within the same subnet, see RFC 7871,
+// section 7.3.
+func Get(c Cacher, msg *dns.Msg, upstream string) *Value {
+	key := NewKey(msg, upstream)
+	v := c.Get(key)
+	if v == nil || len(v.Scopes) == 0 {
+		return v
+	}
+	ecs := ClientSubnet(msg)
+	if ecs == nil {
+		return nil
+	}
+	for _, scope := range v.Scopes {
+		if scope > ecs.SourceNetmask {
+			continue
+		}
+		if sk, ok := key.withSubnet(ecs, scope); ok {
+			if sv := c.Get(sk); sv != nil {
+				return sv
+			}
+		}
+	}
+	return nil
+}
+
+// Add adds answer of msg from given upstream to cache, expired at given time.
+//
+// If answer carries an EDNS Client Subnet option with non-zero scope prefix length,
+// it is cached for the client subnet only, otherwise, it is cached for all clients.
+func Add(c Cacher, msg, answer *dns.Msg, upstream string, expire time.Time) {
+	key := NewKey(msg, upstream)
+	value := NewValue(answer, expire)
+	ecs, scope := ClientSubnet(msg), answerScope(answer)
+	if ecs == nil || scope == 0 {
+		c.Add(key, value)
+		return
+	}
+	scope = min(scope, ecs.SourceNetmask)
+	sk, ok := key.withSubnet(ecs, scope)
+	if !ok {
+		// Could not determine client subnet, do not cache to prevent serving the answer to wrong clients.
+		return
+	}
+	c.Add(sk, value)
+
+	// Record the scope, so Get knows which subnet keys to look for.
+	scopes := []uint8{scope}
+	if v := c.Get(key); v != nil && len(v.Scopes) > 0 {
+		for _, s := range v.Scopes {
+			if s != scope {
+				scopes = append(scopes, s)
+			}
+		}
+		if v.Expire.After(expire) {
+			expire = v.Expire
+		}
+	}
+	// Most specific scope first.
+	sort.Slice(scopes, func(i, j int) bool { return scopes[i] > scopes[j] })
+	c.Add(key, &Value{Expire: expire, Scopes: scopes})
+}
+
+// ClientSubnet returns the EDNS Client Subnet option of msg, or nil if not present.
+func ClientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// EchoClientSubnet sets the address and source prefix length of answer's EDNS Client Subnet option
+// to ones of msg, so a cached answer could be sent to other clients within the same subnet.
+func EchoClientSubnet(msg, answer *dns.Msg) {
+	ecs, aecs := ClientSubnet(msg), ClientSubnet(answer)
+	if ecs == nil || aecs == nil {
+		return
+	}
+	aecs.Family = ecs.Family
+	aecs.Address = ecs.Address
+	aecs.SourceNetmask = ecs.SourceNetmask
+}
+
+// answerScope returns the scope prefix length of answer's EDNS Client Subnet option.
+func answerScope(answer *dns.Msg) uint8 {
+	if ecs := ClientSubnet(answer); ecs != nil {
+		return ecs.SourceScope
+	}
+	return 0
+}
+
+// withSubnet returns a copy of k, keyed by client subnet from ecs with given prefix length.
+// It reports false if ecs does not contain a valid client subnet.
+func (k Key) withSubnet(ecs *dns.EDNS0_SUBNET, bits uint8) (Key, bool) {
+	addr, ok := netip.AddrFromSlice(ecs.Address)
+	if !ok {
+		return k, false
+	}
+	if ecs.Family == 1 {
+		addr = addr.Unmap()
+	}
+	prefix, err := addr.Prefix(int(bits))
+	if err != nil {
+		return k, false
+	}
+	k.Subnet = prefix.String()
+	return k, true
+}
@@ -0,0 +1,91 @@
+package dnscache
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type mapCache map[Key]*Value
+
+func (m mapCache) Get(k Key) *Value { return m[k] }
+
+func (m mapCache) Add(k Key, v *Value) { m[k] = v }
+
+func newECSMsg(ip string, source, scope uint8) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if ip == "" {
+		return msg
+	}
+	msg.SetEdns0(4096, false)
+	opt := msg.IsEdns0()
+	family := uint16(1)
+	if net.ParseIP(ip).To4() == nil {
+		family = 2
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: source,
+		SourceScope:   scope,
+		Address:       net.ParseIP(ip),
+	})
+	return msg
+}
+
+func TestGetAdd_clientSubnet(t *testing.T) {
+	const upstream = "upstream.0"
+	expire := time.Now().Add(time.Minute)
+	c := mapCache{}
+
+	// Answer scoped to 192.0.2.0/24.
+	Add(c, newECSMsg("192.0.2.1", 24, 0), newECSMsg("192.0.2.1", 24, 24), upstream, expire)
+	// Answer scoped to 198.51.100.0/16.
+	Add(c, newECSMsg("198.51.100.1", 24, 0), newECSMsg("198.51.100.1", 24, 16), upstream, expire)
+
+	tests := []struct {
+		name  string
+		msg   *dns.Msg
+		found bool
+	}{
+		{"same subnet", newECSMsg("192.0.2.100", 24, 0), true},
+		{"same /16 subnet", newECSMsg("198.51.1.1", 24, 0), true},
+		{"different subnet", newECSMsg("203.0.113.1", 24, 0), false},
+		{"source prefix shorter than scope", newECSMsg("192.0.2.100", 16, 0), false},
+		{"no client subnet", newECSMsg("", 0, 0), false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := Get(c, tc.msg, upstream); (got != nil) != tc.found {
+				t.Errorf("unexpected result, want found: %v, got: %v", tc.found, got)
+			}
+		})
+	}
+}
+
+func TestGetAdd_globalScope(t *testing.T) {
+	const upstream = "upstream.0"
+	c := mapCache{}
+	Add(c, newECSMsg("192.0.2.1", 24, 0), newECSMsg("192.0.2.1", 24, 0), upstream, time.Now().Add(time.Minute))
+
+	for _, msg := range []*dns.Msg{newECSMsg("203.0.113.1", 24, 0), newECSMsg("", 0, 0)} {
+		if Get(c, msg, upstream) == nil {
+			t.Errorf("answer with zero scope must be cached for all clients")
+		}
+	}
+}
+
+func TestEchoClientSubnet(t *testing.T) {
+	msg := newECSMsg("192.0.2.100", 24, 0)
+	answer := newECSMsg("192.0.2.1", 24, 24)
+	EchoClientSubnet(msg, answer)
+	ecs := ClientSubnet(answer)
+	if !ecs.Address.Equal(net.ParseIP("192.0.2.100")) || ecs.SourceScope != 24 {
+		t.Errorf("unexpected client subnet: %v", ecs)
+	}
+}
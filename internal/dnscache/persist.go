@@ -0,0 +1,93 @@
+package dnscache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// persistedCache is the cache saved to file.
+type persistedCache struct {
+	SavedAt time.Time         `json:"saved_at"`
+	Entries []*persistedEntry `json:"entries"`
+}
+
+// persistedEntry is a cache entry saved to file. TTL is the remaining lifetime of the entry
+// when the cache was saved, negative if it already expired.
+type persistedEntry struct {
+	Key    Key     `json:"key"`
+	TTL    int64   `json:"ttl"`
+	Msg    []byte  `json:"msg,omitempty"`
+	Scopes []uint8 `json:"scopes,omitempty"`
+}
+
+// Save writes entries of l to file at path, so they could be loaded by next runs of ctrld.
+// The file is replaced atomically, so a crash during writing does not corrupt the previous content.
+func (l *LRUCache) Save(path string) error {
+	now := time.Now()
+	pc := &persistedCache{SavedAt: now}
+	l.each(func(key Key, v *Value) {
+		e := &persistedEntry{Key: key, TTL: int64(v.Expire.Sub(now) / time.Second), Scopes: v.Scopes}
+		if v.Msg != nil {
+			buf, err := v.Msg.Pack()
+			if err != nil {
+				return
+			}
+			e.Msg = buf
+		}
+		pc.Entries = append(pc.Entries, e)
+	})
+	buf, err := json.Marshal(pc)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load adds entries saved to file at path to l, returning the number of loaded entries.
+//
+// Lifetimes of entries are decremented by the time elapsed since they were saved. Routers without
+// RTC may boot with a clock earlier than the saving time, the elapsed time is unknown then, so
+// lifetimes are kept as is. Entries expired longer than maxStale ago are skipped.
+func (l *LRUCache) Load(path string, maxStale time.Duration) (int, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var pc persistedCache
+	if err := json.Unmarshal(buf, &pc); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	elapsed := max(now.Sub(pc.SavedAt), 0)
+	n := 0
+	for _, e := range pc.Entries {
+		expire := now.Add(time.Duration(e.TTL)*time.Second - elapsed)
+		if now.Sub(expire) > maxStale {
+			continue
+		}
+		v := &Value{Expire: expire, Scopes: e.Scopes}
+		if len(e.Msg) > 0 {
+			msg := new(dns.Msg)
+			if err := msg.Unpack(e.Msg); err != nil {
+				continue
+			}
+			v.Msg = msg
+		} else if len(e.Scopes) == 0 {
+			continue
+		}
+		l.shardFor(e.Key).Add(e.Key, v)
+		n++
+	}
+	return n, nil
+}
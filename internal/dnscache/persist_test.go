@@ -0,0 +1,87 @@
+package dnscache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLRUCache_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	c, err := NewLRUCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	fresh, expired := new(dns.Msg), new(dns.Msg)
+	fresh.SetQuestion("fresh.example.com.", dns.TypeA)
+	expired.SetQuestion("expired.example.com.", dns.TypeA)
+	c.Add(NewKey(fresh, "upstream.0"), NewValue(fresh, now.Add(100*time.Second)))
+	c.Add(NewKey(expired, "upstream.0"), NewValue(expired, now.Add(-100*time.Second)))
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		savedAgo  time.Duration
+		maxStale  time.Duration
+		wantTTL   time.Duration
+		wantStale bool
+	}{
+		{"elapsed", 30 * time.Second, 0, 70 * time.Second, false},
+		{"clock behind", -time.Hour, 0, 100 * time.Second, false},
+		{"stale", 30 * time.Second, time.Hour, 70 * time.Second, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rewriteSavedAt(t, path, time.Now().Add(-tc.savedAgo))
+			c, err := NewLRUCache(16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := c.Load(path, tc.maxStale)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := Get(c, fresh, "upstream.0")
+			if v == nil || v.Msg.Question[0].Name != "fresh.example.com." {
+				t.Fatalf("missing fresh answer: %v", v)
+			}
+			if ttl := time.Until(v.Expire); ttl > tc.wantTTL || ttl < tc.wantTTL-5*time.Second {
+				t.Errorf("unexpected remaining ttl, want: %s, got: %s", tc.wantTTL, ttl)
+			}
+			if stale := Get(c, expired, "upstream.0") != nil; stale != tc.wantStale {
+				t.Errorf("unexpected stale answer loaded, want: %v, got: %v", tc.wantStale, stale)
+			}
+			if want := map[bool]int{true: 2, false: 1}[tc.wantStale]; n != want {
+				t.Errorf("unexpected number of loaded answers, want: %d, got: %d", want, n)
+			}
+		})
+	}
+}
+
+// rewriteSavedAt changes the saving time of cache file at path.
+func rewriteSavedAt(t *testing.T, path string, savedAt time.Time) {
+	t.Helper()
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pc persistedCache
+	if err := json.Unmarshal(buf, &pc); err != nil {
+		t.Fatal(err)
+	}
+	pc.SavedAt = savedAt
+	buf, err = json.Marshal(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
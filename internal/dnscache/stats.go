@@ -0,0 +1,139 @@
+package dnscache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// entryOverhead is the estimated memory used by a cache entry, besides its answer.
+const entryOverhead = 200
+
+// counters records lookups and evictions of LRUCache. They are updated by every query,
+// so they are lock free, not to serialize queries of different shards.
+type counters struct {
+	evictions atomic.Uint64
+	qtypes    sync.Map // uint16 -> *qtypeCounters
+}
+
+type qtypeCounters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// Stats is the statistics of LRUCache.
+type Stats struct {
+	// Entries is the number of cached entries, Capacity is the maximum one.
+	Entries  int    `json:"entries"`
+	Capacity int    `json:"capacity"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	// Evictions is the number of entries removed to make room for new ones.
+	Evictions uint64 `json:"evictions"`
+	// Bytes is the estimated memory used by cached entries.
+	Bytes  int                    `json:"bytes"`
+	Qtypes map[string]*QtypeStats `json:"qtypes,omitempty"`
+}
+
+// HitRatio returns the ratio of lookups answered from cache.
+func (s *Stats) HitRatio() float64 {
+	if total := s.Hits + s.Misses; total > 0 {
+		return float64(s.Hits) / float64(total)
+	}
+	return 0
+}
+
+// QtypeStats is the statistics of cached entries of a query type.
+type QtypeStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// TopEntry is a cached entry, reported by LRUCache.Top.
+type TopEntry struct {
+	Name     string `json:"name"`
+	Qtype    string `json:"qtype"`
+	Upstream string `json:"upstream"`
+	Subnet   string `json:"subnet,omitempty"`
+	Hits     uint32 `json:"hits"`
+	// TTL is the remaining lifetime of the entry in seconds, negative if it expired.
+	TTL int64 `json:"ttl"`
+}
+
+// RecordLookup records a cache lookup of a query with given type, hit reports whether
+// the query was answered from cache.
+func (l *LRUCache) RecordLookup(qtype uint16, hit bool) {
+	v, ok := l.stats.qtypes.Load(qtype)
+	if !ok {
+		v, _ = l.stats.qtypes.LoadOrStore(qtype, &qtypeCounters{})
+	}
+	c := v.(*qtypeCounters)
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// Stats returns the statistics of l.
+func (l *LRUCache) Stats() *Stats {
+	s := &Stats{
+		Capacity:  l.size,
+		Evictions: l.stats.evictions.Load(),
+		Qtypes:    make(map[string]*QtypeStats),
+	}
+	qtypeStats := func(qtype uint16) *QtypeStats {
+		name := dns.Type(qtype).String()
+		qs := s.Qtypes[name]
+		if qs == nil {
+			qs = &QtypeStats{}
+			s.Qtypes[name] = qs
+		}
+		return qs
+	}
+	l.each(func(key Key, v *Value) {
+		s.Entries++
+		s.Bytes += entryOverhead + len(key.Name) + len(key.Upstream) + len(key.Subnet)
+		if v.Msg != nil {
+			s.Bytes += v.Msg.Len()
+		}
+		qtypeStats(key.Qtype).Entries++
+	})
+	l.stats.qtypes.Range(func(k, v any) bool {
+		c := v.(*qtypeCounters)
+		qs := qtypeStats(k.(uint16))
+		qs.Hits, qs.Misses = c.hits.Load(), c.misses.Load()
+		s.Hits += qs.Hits
+		s.Misses += qs.Misses
+		return true
+	})
+	return s
+}
+
+// Top returns the n most hit entries of l, most hit first.
+func (l *LRUCache) Top(n int) []*TopEntry {
+	now := time.Now()
+	var entries []*TopEntry
+	l.each(func(key Key, v *Value) {
+		if v.Msg == nil {
+			return
+		}
+		entries = append(entries, &TopEntry{
+			Name:     key.Name,
+			Qtype:    dns.Type(key.Qtype).String(),
+			Upstream: key.Upstream,
+			Subnet:   key.Subnet,
+			Hits:     v.Hits(),
+			TTL:      int64(v.Expire.Sub(now) / time.Second),
+		})
+	})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Hits > entries[j].Hits })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
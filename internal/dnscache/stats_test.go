@@ -0,0 +1,55 @@
+package dnscache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLRUCache_Stats(t *testing.T) {
+	c, err := NewLRUCache(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(name string, qtype uint16) *Value {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		v := NewValue(msg, time.Now().Add(time.Minute))
+		c.Add(NewKey(msg, "upstream.0"), v)
+		return v
+	}
+	add("a.example.com.", dns.TypeA)
+	add("b.example.com.", dns.TypeAAAA)
+	// Replacing an entry is not an eviction.
+	popular := add("b.example.com.", dns.TypeAAAA)
+	popular.Hit()
+	popular.Hit()
+	add("c.example.com.", dns.TypeA)
+	c.RecordLookup(dns.TypeA, true)
+	c.RecordLookup(dns.TypeA, false)
+	c.RecordLookup(dns.TypeAAAA, true)
+	c.RecordLookup(dns.TypeAAAA, true)
+
+	s := c.Stats()
+	if s.Entries != 2 || s.Capacity != 2 {
+		t.Errorf("unexpected entries, want: 2/2, got: %d/%d", s.Entries, s.Capacity)
+	}
+	if s.Evictions != 1 {
+		t.Errorf("unexpected evictions, want: 1, got: %d", s.Evictions)
+	}
+	if s.Hits != 3 || s.Misses != 1 || s.HitRatio() != 0.75 {
+		t.Errorf("unexpected hits/misses: %d/%d", s.Hits, s.Misses)
+	}
+	if qs := s.Qtypes["AAAA"]; qs == nil || qs.Entries != 1 || qs.Hits != 2 || qs.Misses != 0 {
+		t.Errorf("unexpected AAAA stats: %+v", qs)
+	}
+	if s.Bytes <= 0 {
+		t.Errorf("unexpected bytes: %d", s.Bytes)
+	}
+
+	top := c.Top(1)
+	if len(top) != 1 || top[0].Name != "b.example.com." || top[0].Qtype != "AAAA" || top[0].Hits != 2 {
+		t.Errorf("unexpected top entries: %+v", top)
+	}
+}
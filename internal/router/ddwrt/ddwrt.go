@@ -104,6 +104,35 @@ func (d *Ddwrt) Cleanup() error {
 	return nil
 }
 
+// Verify reports an error if the DNS forwarding state set up by Setup was changed.
+func (d *Ddwrt) Verify() error {
+	if d.cfg.FirstListener().IsDirectDnsListener() {
+		return nil
+	}
+	data, err := dnsmasq.ConfTmpl(dnsmasq.ConfigContentTmpl, d.cfg)
+	if err != nil {
+		return err
+	}
+	nvramKvMap["dnsmasq_options"] = data
+	return nvram.Verify(nvramKvMap, nvram.CtrldSetupKey)
+}
+
+// Repair sets nvram values changed after Setup back, then restarts dnsmasq.
+func (d *Ddwrt) Repair() error {
+	if d.cfg.FirstListener().IsDirectDnsListener() {
+		return nil
+	}
+	data, err := dnsmasq.ConfTmpl(dnsmasq.ConfigContentTmpl, d.cfg)
+	if err != nil {
+		return err
+	}
+	nvramKvMap["dnsmasq_options"] = data
+	if err := nvram.Repair(nvramKvMap, nvram.CtrldSetupKey); err != nil {
+		return err
+	}
+	return restartDNSMasq()
+}
+
 func restartDNSMasq() error {
 	if out, err := exec.Command("restart_dns").CombinedOutput(); err != nil {
 		return fmt.Errorf("restart_dns: %s, %w", string(out), err)
@@ -2,12 +2,13 @@ package dnsmasq
 
 import (
 	"errors"
-	"html/template"
 	"net"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
 )
 
 const ConfigContentTmpl = `# GENERATED BY ctrld - DO NOT MODIFY
@@ -17,6 +18,9 @@ server={{ .IP }}#{{ .Port }}
 {{- end}}
 add-mac
 add-subnet=32,128
+{{- range .RDNSS}}
+dhcp-option=option6:dns-server,[{{ . }}]
+{{- end}}
 {{- if .CacheDisabled}}
 cache-size=0
 {{- else}}
@@ -46,6 +50,12 @@ if [ -n "$pid" ] && [ -f "/proc/${pid}/cmdline" ]; then
   pc_delete "add-subnet" "$config_file"
   pc_append "add-mac" "$config_file"                # add client mac
   pc_append "add-subnet=32,128" "$config_file"      # add client ip
+  {{- if .RDNSS}}
+  pc_delete "dhcp-option=option6:dns-server" "$config_file"
+  {{- end}}
+  {{- range .RDNSS}}
+  pc_append "dhcp-option=option6:dns-server,[{{ . }}]" "$config_file" # advertise ctrld in RA RDNSS
+  {{- end}}
   pc_delete "dnssec" "$config_file"                 # disable DNSSEC
   pc_delete "trust-anchor=" "$config_file"          # disable DNSSEC
   pc_delete "cache-size=" "$config_file"
@@ -88,33 +98,47 @@ func ConfTmplWithCacheDisabled(tmplText string, cfg *ctrld.Config, cacheDisabled
 		ip = "127.0.0.1"
 	}
 	upstreams := []Upstream{{IP: ip, Port: listener.Port}}
-	return confTmpl(tmplText, upstreams, cacheDisabled)
+	return confTmpl(tmplText, upstreams, rdnss(cfg), cacheDisabled)
 }
 
 // FirewallaConfTmpl generates dnsmasq config for Firewalla routers.
 func FirewallaConfTmpl(tmplText string, cfg *ctrld.Config) (string, error) {
 	// If ctrld listen on all interfaces, generating config for all of them.
 	if lc := cfg.FirstListener(); lc != nil && (lc.IP == "0.0.0.0" || lc.IP == "") {
-		return confTmpl(tmplText, firewallaUpstreams(lc.Port), false)
+		return confTmpl(tmplText, firewallaUpstreams(lc.Port), rdnss(cfg), false)
 	}
 	// Otherwise, generating config for the specific listener from ctrld's config.
 	return ConfTmplWithCacheDisabled(tmplText, cfg, false)
 }
 
-func confTmpl(tmplText string, upstreams []Upstream, cacheDisabled bool) (string, error) {
-	tmpl := template.Must(template.New("").Parse(tmplText))
+func confTmpl(tmplText string, upstreams []Upstream, rdnss []string, cacheDisabled bool) (string, error) {
 	var to = &struct {
 		Upstreams     []Upstream
+		RDNSS         []string
 		CacheDisabled bool
 	}{
 		Upstreams:     upstreams,
+		RDNSS:         rdnss,
 		CacheDisabled: cacheDisabled,
 	}
-	var sb strings.Builder
-	if err := tmpl.Execute(&sb, to); err != nil {
-		return "", err
+	return tmpl.Render(tmplText, to)
+}
+
+// rdnss returns IPv6 addresses of listeners advertised in router advertisements, without zones.
+// dnsmasq sends DHCPv6 dns-server option addresses in RDNSS option of its router advertisements.
+func rdnss(cfg *ctrld.Config) []string {
+	keys := make([]string, 0, len(cfg.Listener))
+	for k := range cfg.Listener {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var addrs []string
+	for _, k := range keys {
+		for _, ip := range cfg.Listener[k].RDNSSAddrs() {
+			addrs = append(addrs, ip.WithZone("").String())
+		}
 	}
-	return sb.String(), nil
+	return addrs
 }
 
 func firewallaUpstreams(port int) []Upstream {
@@ -0,0 +1,53 @@
+package dnsmasq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/testhelper"
+)
+
+func TestConfTmpl_golden(t *testing.T) {
+	cfg := &ctrld.Config{
+		Listener: map[string]*ctrld.ListenerConfig{"0": {IP: "0.0.0.0", Port: 5354}},
+	}
+	tests := []struct {
+		name          string
+		tmplText      string
+		cacheDisabled bool
+	}{
+		{"dnsmasq_conf", ConfigContentTmpl, true},
+		{"dnsmasq_conf_cache_enabled", ConfigContentTmpl, false},
+		{"merlin_postconf", MerlinPostConfTmpl, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ConfTmplWithCacheDisabled(tc.tmplText, cfg, tc.cacheDisabled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testhelper.AssertGolden(t, tc.name, got)
+		})
+	}
+}
+
+func TestConfTmpl_rdnss(t *testing.T) {
+	cfg := &ctrld.Config{
+		Listener: map[string]*ctrld.ListenerConfig{
+			"0": {IP: "127.0.0.1", Port: 5354},
+			"1": {IP: "fe80::1%br-lan", Port: 53, AdvertiseRDNSS: true},
+		},
+	}
+	for _, tmplText := range []string{ConfigContentTmpl, MerlinPostConfTmpl} {
+		got, err := ConfTmpl(tmplText, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(got, "dhcp-option=option6:dns-server,[fe80::1]") {
+			t.Errorf("missing RDNSS address in config:\n%s", got)
+		}
+	}
+}
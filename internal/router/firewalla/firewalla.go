@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strings"
 
 	"github.com/Control-D-Inc/ctrld/internal/router/dnsmasq"
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
 
 	"github.com/Control-D-Inc/ctrld"
 	"github.com/kardianos/service"
@@ -100,11 +100,26 @@ func writeFirewallStartupScript() error {
 	}
 	// This is called when "ctrld start ..." runs, so recording
 	// the same command line arguments to use in startup script.
-	argStr := strings.Join(os.Args[1:], " ")
-	script := fmt.Sprintf("#!/bin/bash\n\nsudo %q %s\n", exe, argStr)
+	script, err := startupScript(exe, os.Args[1:])
+	if err != nil {
+		return err
+	}
 	return os.WriteFile(firewallaCtrldInitScriptPath, []byte(script), 0755)
 }
 
+const startupScriptTmpl = `#!/bin/bash
+
+sudo {{printf "%q" .Path}}{{range .Arguments}} {{.}}{{end}}
+`
+
+// startupScript returns the script starting ctrld, which is at path, with args.
+func startupScript(path string, args []string) (string, error) {
+	return tmpl.Render(startupScriptTmpl, &struct {
+		Path      string
+		Arguments []string
+	}{path, args})
+}
+
 func restartDNSMasq() error {
 	return exec.Command("systemctl", "restart", "firerouter_dns").Run()
 }
@@ -0,0 +1,15 @@
+package firewalla
+
+import (
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld/testhelper"
+)
+
+func Test_startupScript(t *testing.T) {
+	script, err := startupScript("/home/pi/.firewalla/run/ctrld", []string{"start", "--cd", "abcd1234", "--router"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelper.AssertGolden(t, "startup_script", script)
+}
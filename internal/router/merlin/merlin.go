@@ -15,9 +15,13 @@ import (
 	"github.com/Control-D-Inc/ctrld/internal/router/dnsmasq"
 	"github.com/Control-D-Inc/ctrld/internal/router/ntp"
 	"github.com/Control-D-Inc/ctrld/internal/router/nvram"
+	"github.com/Control-D-Inc/ctrld/internal/router/watchdog"
 )
 
-const Name = "merlin"
+const (
+	Name           = "merlin"
+	resolvConfPath = "/etc/resolv.conf"
+)
 
 var nvramKvMap = map[string]string{
 	"dnspriv_enable": "0", // Ensure Merlin native DoT disabled.
@@ -81,20 +85,7 @@ func (m *Merlin) Setup() error {
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-
-	data, err := dnsmasq.ConfTmpl(dnsmasq.MerlinPostConfTmpl, m.cfg)
-	if err != nil {
-		return err
-	}
-	data = strings.Join([]string{
-		data,
-		"\n",
-		dnsmasq.MerlinPostConfMarker,
-		"\n",
-		string(buf),
-	}, "\n")
-	// Write dnsmasq post conf file.
-	if err := os.WriteFile(dnsmasq.MerlinPostConfPath, []byte(data), 0750); err != nil {
+	if err := m.writePostConf(buf); err != nil {
 		return err
 	}
 	// Restart dnsmasq service.
@@ -137,6 +128,83 @@ func (m *Merlin) Cleanup() error {
 	return nil
 }
 
+// Verify reports an error if the DNS forwarding state set up by Setup was changed.
+func (m *Merlin) Verify() error {
+	if m.cfg.FirstListener().IsDirectDnsListener() {
+		return nil
+	}
+	if err := nvram.Verify(nvramKvMap, nvram.CtrldSetupKey); err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(dnsmasq.MerlinPostConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !bytes.Contains(buf, []byte(dnsmasq.MerlinPostConfMarker)) {
+		return fmt.Errorf("%s: ctrld config not found", dnsmasq.MerlinPostConfPath)
+	}
+	// The post conf script changes /etc/resolv.conf, see dnsmasq.MerlinPostConfTmpl.
+	buf, err = os.ReadFile(resolvConfPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(buf, []byte("nameserver 127.0.0.1")) {
+		return fmt.Errorf("%s: nameserver was changed", resolvConfPath)
+	}
+	return nil
+}
+
+// Repair sets nvram values and dnsmasq post conf file changed after Setup back, then restarts dnsmasq,
+// which runs the post conf script, setting /etc/resolv.conf back too.
+func (m *Merlin) Repair() error {
+	if m.cfg.FirstListener().IsDirectDnsListener() {
+		return nil
+	}
+	if err := nvram.Repair(nvramKvMap, nvram.CtrldSetupKey); err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(dnsmasq.MerlinPostConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !bytes.Contains(buf, []byte(dnsmasq.MerlinPostConfMarker)) {
+		if err := m.writePostConf(buf); err != nil {
+			return err
+		}
+	}
+	return restartDNSMasq()
+}
+
+// writePostConf writes ctrld config to dnsmasq post conf file, followed by its current content buf.
+func (m *Merlin) writePostConf(buf []byte) error {
+	data, err := dnsmasq.ConfTmpl(dnsmasq.MerlinPostConfTmpl, m.cfg)
+	if err != nil {
+		return err
+	}
+	data = strings.Join([]string{
+		data,
+		"\n",
+		dnsmasq.MerlinPostConfMarker,
+		"\n",
+		string(buf),
+	}, "\n")
+	return os.WriteFile(dnsmasq.MerlinPostConfPath, []byte(data), 0750)
+}
+
+// InstallWatchdog implements router.WatchdogInstaller, using cron job.
+func (m *Merlin) InstallWatchdog() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return watchdog.InstallCru(exe + ".startup restart")
+}
+
+// RemoveWatchdog implements router.WatchdogInstaller.
+func (m *Merlin) RemoveWatchdog() error {
+	return watchdog.RemoveCru()
+}
+
 func restartDNSMasq() error {
 	if out, err := exec.Command("service", "restart_dnsmasq").CombinedOutput(); err != nil {
 		return fmt.Errorf("restart_dnsmasq: %s, %w", string(out), err)
@@ -87,3 +87,46 @@ func Restore(m map[string]string, setupKey string) error {
 	}
 	return nil
 }
+
+// Repair sets the key/value from map m, which were changed after SetKV, back to the given values.
+// Unlike SetKV, the backup of old values is kept. If setupKey was unset, SetKV is used instead.
+func Repair(m map[string]string, setupKey string) error {
+	if val, _ := Run("get", setupKey); val != "1" {
+		return SetKV(m, setupKey)
+	}
+	changed := false
+	for key, value := range m {
+		if val, _ := Run("get", key); val == value {
+			continue
+		}
+		if out, err := Run("set", key+"="+value); err != nil {
+			return fmt.Errorf("%s: %w", out, err)
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	// Commit.
+	if out, err := Run("commit"); err != nil {
+		return fmt.Errorf("%s: %w", out, err)
+	}
+	return nil
+}
+
+// Verify reports an error if the key/value from map m set by SetKV were changed.
+func Verify(m map[string]string, setupKey string) error {
+	if val, _ := Run("get", setupKey); val != "1" {
+		return fmt.Errorf("nvram %s is not set", setupKey)
+	}
+	for key, value := range m {
+		val, err := Run("get", key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", val, err)
+		}
+		if val != value {
+			return fmt.Errorf("nvram %s was changed: %q", key, val)
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
@@ -12,11 +13,13 @@ import (
 
 	"github.com/Control-D-Inc/ctrld"
 	"github.com/Control-D-Inc/ctrld/internal/router/dnsmasq"
+	"github.com/Control-D-Inc/ctrld/internal/router/watchdog"
 )
 
 const (
 	Name                     = "openwrt"
 	openwrtDNSMasqConfigPath = "/tmp/dnsmasq.d/ctrld.conf"
+	odhcpdInitScript         = "/etc/init.d/odhcpd"
 )
 
 type Openwrt struct {
@@ -47,6 +50,9 @@ func (o *Openwrt) PreRun() error {
 }
 
 func (o *Openwrt) Setup() error {
+	if err := o.updateRDNSS("add_list"); err != nil {
+		return err
+	}
 	if o.cfg.FirstListener().IsDirectDnsListener() {
 		return nil
 	}
@@ -78,6 +84,9 @@ func (o *Openwrt) Setup() error {
 }
 
 func (o *Openwrt) Cleanup() error {
+	if err := o.updateRDNSS("del_list"); err != nil {
+		return err
+	}
 	if o.cfg.FirstListener().IsDirectDnsListener() {
 		return nil
 	}
@@ -104,6 +113,81 @@ func (o *Openwrt) Cleanup() error {
 	return nil
 }
 
+// InstallWatchdog implements router.WatchdogInstaller. procd already respawns ctrld if it died,
+// the cron job handles the case where ctrld is running but could not answer queries.
+func (o *Openwrt) InstallWatchdog() error {
+	return watchdog.InstallCrontab("/etc/init.d/ctrld restart")
+}
+
+// RemoveWatchdog implements router.WatchdogInstaller.
+func (o *Openwrt) RemoveWatchdog() error {
+	return watchdog.RemoveCrontab()
+}
+
+// updateRDNSS adds or removes, depending on uci op, listener addresses advertised in RDNSS option
+// of router advertisements, which are sent by odhcpd on OpenWrt. Link-local addresses are only
+// advertised on their interface, global ones on all DHCP interfaces.
+func (o *Openwrt) updateRDNSS(op string) error {
+	var addrs []netip.Addr
+	for _, lc := range o.cfg.Listener {
+		addrs = append(addrs, lc.RDNSSAddrs()...)
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(odhcpdInitScript); err != nil {
+		ctrld.ProxyLogger.Load().Warn().Msg("odhcpd is not available, RDNSS addresses are not advertised")
+		return nil
+	}
+	out, err := uci("show", "dhcp")
+	if err != nil {
+		return err
+	}
+	for section, iface := range dhcpInterfaces(out) {
+		device, _ := uci("get", fmt.Sprintf("network.%s.device", iface))
+		for _, ip := range addrs {
+			if ip.Zone() != "" && ip.Zone() != device {
+				continue
+			}
+			opt := fmt.Sprintf("dhcp.%s.dns=%s", section, ip.WithZone(""))
+			// The address is always deleted first, so repeated setups do not add duplicates.
+			if _, err := uci("del_list", opt); err != nil && !errors.Is(err, errUCIEntryNotFound) {
+				return err
+			}
+			if op == "add_list" {
+				if _, err := uci(op, opt); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if _, err := uci("commit", "dhcp"); err != nil {
+		return err
+	}
+	if out, err := exec.Command(odhcpdInitScript, "reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w", string(out), err)
+	}
+	return nil
+}
+
+// dhcpInterfaces returns network interfaces of DHCP sections, keyed by section name,
+// from "uci show dhcp" output.
+func dhcpInterfaces(out string) map[string]string {
+	m := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		section, ok := strings.CutSuffix(strings.TrimPrefix(key, "dhcp."), ".interface")
+		if !ok || strings.Contains(section, ".") {
+			continue
+		}
+		m[section] = strings.Trim(value, "'")
+	}
+	return m
+}
+
 func restartDNSMasq() error {
 	if out, err := exec.Command("/etc/init.d/dnsmasq", "restart").CombinedOutput(); err != nil {
 		return fmt.Errorf("%s: %w", string(out), err)
@@ -7,11 +7,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"text/template"
 
 	"github.com/kardianos/service"
 
 	"github.com/Control-D-Inc/ctrld"
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
 )
 
 const (
@@ -40,21 +40,19 @@ func (or *osRouter) ConfigureService(svc *service.Config) error {
 	svc.Option["SysvScript"] = bsdInitScript
 	or.svcName = svc.Name
 	rcFile := filepath.Join(rcConfPath, or.svcName)
-	var to = &struct {
-		Name string
-	}{
-		or.svcName,
-	}
-
-	f, err := os.Create(rcFile)
+	rcConf, err := renderRcConf(or.svcName)
 	if err != nil {
-		return fmt.Errorf("os.Create: %w", err)
-	}
-	defer f.Close()
-	if err := template.Must(template.New("").Parse(rcConfTmpl)).Execute(f, to); err != nil {
 		return err
 	}
-	return f.Close()
+	if err := os.WriteFile(rcFile, []byte(rcConf), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+	return nil
+}
+
+// renderRcConf returns the rc.conf file enabling service with given name.
+func renderRcConf(name string) (string, error) {
+	return tmpl.Render(rcConfTmpl, &struct{ Name string }{name})
 }
 
 func (or *osRouter) Install(_ *service.Config) error {
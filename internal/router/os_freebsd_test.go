@@ -0,0 +1,15 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld/testhelper"
+)
+
+func Test_renderRcConf(t *testing.T) {
+	rcConf, err := renderRcConf("ctrld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelper.AssertGolden(t, "freebsd_rc_conf", rcConf)
+}
@@ -0,0 +1,367 @@
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
+)
+
+const (
+	// chainName is the name of iptables chain/nftables table/pf anchor created by ctrld.
+	chainName = "CTRLD_DNS"
+	// nftTable is the nftables table name created by ctrld.
+	nftTable = "ctrld"
+	// pfRdrAnchor is the pf anchor used for redirect rules. On pfSense, the
+	// main ruleset already evaluates all anchors under "natrules/".
+	pfRdrAnchor = "natrules/ctrld"
+	// pfFilterAnchor is the pf anchor used for filter rules. On pfSense, the
+	// main ruleset already evaluates all anchors under "userrules/".
+	pfFilterAnchor = "userrules/ctrld"
+)
+
+// Rules represents the firewall rules redirecting all LAN DNS traffic to ctrld.
+//
+// Plain DNS traffic (port 53) is redirected to the given IP and port. DNS over TLS
+// traffic (port 853) is rejected, so clients will fall back to plain DNS, which will
+// be redirected then.
+//
+// Traffic from the router itself is not affected, because the rules are only applied
+// to incoming traffic. Traffic from bypass hosts is also left untouched.
+type Rules struct {
+	// IP is the address that DNS traffic is redirected to. If empty, DNS traffic
+	// is redirected to the router address of the incoming interface.
+	IP string
+	// Port is the port that DNS traffic is redirected to.
+	Port int
+	// Bypass is the list of IPs/CIDRs which DNS traffic won't be redirected.
+	Bypass []string
+}
+
+// Install installs redirect rules using the firewall available on the router.
+func (r *Rules) Install() error {
+	if r.IP != "" && net.ParseIP(r.IP) == nil {
+		return fmt.Errorf("invalid redirect IP: %q", r.IP)
+	}
+	// Removing old rules, if any, to prevent duplicated rules.
+	_ = r.Remove()
+	switch firewall() {
+	case "pf":
+		return r.installPf()
+	case "nft":
+		return r.installNft()
+	default:
+		return r.installIptables()
+	}
+}
+
+// Remove removes redirect rules installed by Install.
+// It is safe to call Remove even if the rules were not installed.
+func (r *Rules) Remove() error {
+	switch firewall() {
+	case "pf":
+		return r.removePf()
+	case "nft":
+		return r.removeNft()
+	default:
+		return r.removeIptables()
+	}
+}
+
+// firewall returns the firewall program to use on current router.
+func firewall() string {
+	if runtime.GOOS == "freebsd" {
+		return "pf"
+	}
+	// Newer Openwrt versions (fw4) use nftables only.
+	if _, err := exec.LookPath("iptables"); err != nil {
+		if _, err := exec.LookPath("nft"); err == nil {
+			return "nft"
+		}
+	}
+	return "iptables"
+}
+
+// ipv4Only reports whether the rules could only be applied to IPv4 traffic.
+func (r *Rules) ipv4Only() bool {
+	ip := net.ParseIP(r.IP)
+	return ip != nil && ip.To4() != nil
+}
+
+// ipv6Only reports whether the rules could only be applied to IPv6 traffic.
+func (r *Rules) ipv6Only() bool {
+	ip := net.ParseIP(r.IP)
+	return ip != nil && ip.To4() == nil
+}
+
+// bypassHosts returns bypass hosts with the given IP family.
+func (r *Rules) bypassHosts(v6 bool) []string {
+	hosts := make([]string, 0, len(r.Bypass))
+	for _, host := range r.Bypass {
+		var ip net.IP
+		if _, ipNet, err := net.ParseCIDR(host); err == nil {
+			ip = ipNet.IP
+		} else {
+			ip = net.ParseIP(host)
+		}
+		if ip == nil || (ip.To4() == nil) != v6 {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// iptablesRules returns list of arguments for creating iptables rules in ctrld chain.
+// DNAT does not work across IP families, so an error is returned if IP is not of the
+// given family.
+func (r *Rules) iptablesRules(v6 bool) ([][]string, error) {
+	if v6 && r.ipv4Only() {
+		return nil, fmt.Errorf("could not redirect IPv6 traffic to IPv4 address %s", r.IP)
+	}
+	if !v6 && r.ipv6Only() {
+		return nil, fmt.Errorf("could not redirect IPv4 traffic to IPv6 address %s", r.IP)
+	}
+	var rules [][]string
+	for _, host := range r.bypassHosts(v6) {
+		rules = append(rules, []string{"-s", host, "-j", "RETURN"})
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		rule := []string{"-p", proto, "--dport", "53"}
+		if r.IP != "" {
+			rule = append(rule, "-j", "DNAT", "--to-destination", net.JoinHostPort(r.IP, strconv.Itoa(r.Port)))
+		} else {
+			rule = append(rule, "-j", "REDIRECT", "--to-ports", strconv.Itoa(r.Port))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// iptablesDotRule returns arguments for rejecting DNS over TLS traffic.
+func (r *Rules) iptablesDotRule() []string {
+	return []string{"-p", "tcp", "--dport", "853", "-j", "REJECT", "--reject-with", "tcp-reset"}
+}
+
+// iptablesBinaries returns the iptables binaries for IP families the rules are applied to.
+// If IP is set, only the binary of its family is used, traffic of the other family is not
+// redirected. ip6tables reports whether ip6tables is available.
+func (r *Rules) iptablesBinaries(ip6tables bool) []string {
+	switch {
+	case r.ipv4Only():
+		return []string{"iptables"}
+	case r.ipv6Only():
+		return []string{"ip6tables"}
+	case ip6tables:
+		return []string{"iptables", "ip6tables"}
+	}
+	return []string{"iptables"}
+}
+
+// iptablesCmds returns the commands for installing the rules using given iptables binaries.
+func (r *Rules) iptablesCmds(binaries []string) ([][]string, error) {
+	var cmds [][]string
+	for _, bin := range binaries {
+		v6 := bin == "ip6tables"
+		rules, err := r.iptablesRules(v6)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", bin, err)
+		}
+		cmds = append(cmds, []string{bin, "-t", "nat", "-N", chainName})
+		for _, rule := range rules {
+			cmds = append(cmds, append([]string{bin, "-t", "nat", "-A", chainName}, rule...))
+		}
+		cmds = append(cmds, []string{bin, "-t", "nat", "-I", "PREROUTING", "-j", chainName})
+		cmds = append(cmds, []string{bin, "-N", chainName})
+		for _, host := range r.bypassHosts(v6) {
+			cmds = append(cmds, []string{bin, "-A", chainName, "-s", host, "-j", "RETURN"})
+		}
+		cmds = append(cmds, append([]string{bin, "-A", chainName}, r.iptablesDotRule()...))
+		cmds = append(cmds, []string{bin, "-I", "FORWARD", "-j", chainName})
+	}
+	return cmds, nil
+}
+
+func (r *Rules) installIptables() error {
+	_, lookErr := exec.LookPath("ip6tables")
+	cmds, err := r.iptablesCmds(r.iptablesBinaries(lookErr == nil))
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := run(cmd[0], cmd[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rules) removeIptables() error {
+	var errs []error
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			continue
+		}
+		for _, table := range []string{"nat", "filter"} {
+			parent := "PREROUTING"
+			if table == "filter" {
+				parent = "FORWARD"
+			}
+			// Chain does not exist, nothing to do.
+			if err := exec.Command(cmd, "-t", table, "-L", chainName).Run(); err != nil {
+				continue
+			}
+			for exec.Command(cmd, "-t", table, "-D", parent, "-j", chainName).Run() == nil {
+			}
+			if err := run(cmd, "-t", table, "-F", chainName); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if err := run(cmd, "-t", table, "-X", chainName); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+const nftRulesetTmpl = `table inet {{.Table}} {
+	chain dns_redirect {
+		type nat hook prerouting priority dstnat; policy accept;
+{{- template "bypass" .}}
+{{- range .Protos}}
+{{- if eq $.IP ""}}
+		{{.}} dport 53 redirect to :{{$.Port}}
+{{- else if $.IPv4Only}}
+		meta nfproto ipv4 {{.}} dport 53 dnat ip to {{$.Target}}
+{{- else}}
+		meta nfproto ipv6 {{.}} dport 53 dnat ip6 to {{$.Target}}
+{{- end}}
+{{- end}}
+	}
+	chain dot_reject {
+		type filter hook forward priority filter; policy accept;
+{{- template "bypass" .}}
+		tcp dport 853 reject with tcp reset
+	}
+}
+{{define "bypass"}}
+{{- with .Bypass4}}
+		ip saddr { {{join . ", "}} } return
+{{- end}}
+{{- with .Bypass6}}
+		ip6 saddr { {{join . ", "}} } return
+{{- end}}
+{{- end}}`
+
+// nftRuleset returns the nftables ruleset for redirecting DNS traffic.
+func (r *Rules) nftRuleset() (string, error) {
+	return tmpl.Render(nftRulesetTmpl, &struct {
+		*Rules
+		Table    string
+		Protos   []string
+		Bypass4  []string
+		Bypass6  []string
+		IPv4Only bool
+		Target   string
+	}{
+		Rules:    r,
+		Table:    nftTable,
+		Protos:   []string{"udp", "tcp"},
+		Bypass4:  r.bypassHosts(false),
+		Bypass6:  r.bypassHosts(true),
+		IPv4Only: r.ipv4Only(),
+		Target:   net.JoinHostPort(r.IP, strconv.Itoa(r.Port)),
+	})
+}
+
+func (r *Rules) installNft() error {
+	ruleset, err := r.nftRuleset()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+func (r *Rules) removeNft() error {
+	// Table does not exist, nothing to do.
+	if err := exec.Command("nft", "list", "table", "inet", nftTable).Run(); err != nil {
+		return nil
+	}
+	return run("nft", "delete", "table", "inet", nftTable)
+}
+
+const pfRdrRulesTmpl = `{{with .Bypass}}no rdr on ! lo0 proto { udp tcp } from { {{join . " "}} } to any port 53
+{{end}}rdr pass on ! lo0 proto { udp tcp } from ! (self) to any port 53 -> {{or .IP "127.0.0.1"}} port {{.Port}}
+`
+
+const pfFilterRulesTmpl = `{{with .Bypass}}pass quick proto tcp from { {{join . " "}} } to any port 853
+{{end}}block return quick proto tcp from ! (self) to any port 853
+`
+
+// pfRdrRules returns pf redirect rules for pfRdrAnchor.
+func (r *Rules) pfRdrRules() (string, error) {
+	return tmpl.Render(pfRdrRulesTmpl, r)
+}
+
+// pfFilterRules returns pf filter rules for pfFilterAnchor.
+func (r *Rules) pfFilterRules() (string, error) {
+	return tmpl.Render(pfFilterRulesTmpl, r)
+}
+
+func (r *Rules) installPf() error {
+	rdrRules, err := r.pfRdrRules()
+	if err != nil {
+		return err
+	}
+	filterRules, err := r.pfFilterRules()
+	if err != nil {
+		return err
+	}
+	for anchor, rules := range map[string]string{
+		pfRdrAnchor:    rdrRules,
+		pfFilterAnchor: filterRules,
+	} {
+		cmd := exec.Command("pfctl", "-a", anchor, "-f", "-")
+		cmd.Stdin = strings.NewReader(rules)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("pfctl: %s: %w", string(out), err)
+		}
+	}
+	return nil
+}
+
+func (r *Rules) removePf() error {
+	if _, err := exec.LookPath("pfctl"); err != nil {
+		return nil
+	}
+	var errs []error
+	for _, anchor := range []string{pfRdrAnchor, pfFilterAnchor} {
+		// Anchor does not have any rules, nothing to do.
+		out, _ := exec.Command("pfctl", "-a", anchor, "-s", "all").Output()
+		if len(strings.TrimSpace(string(out))) == 0 {
+			continue
+		}
+		if err := run("pfctl", "-a", anchor, "-F", "all"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func run(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %s: %w", name, strings.Join(args, " "), string(out), err)
+	}
+	return nil
+}
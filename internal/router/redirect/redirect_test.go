@@ -0,0 +1,181 @@
+package redirect
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld/testhelper"
+)
+
+func TestRules_iptablesRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules *Rules
+		v6    bool
+		want  [][]string
+	}{
+		{
+			"redirect",
+			&Rules{Port: 53},
+			false,
+			[][]string{
+				{"-p", "udp", "--dport", "53", "-j", "REDIRECT", "--to-ports", "53"},
+				{"-p", "tcp", "--dport", "53", "-j", "REDIRECT", "--to-ports", "53"},
+			},
+		},
+		{
+			"dnat with bypass",
+			&Rules{IP: "192.168.1.1", Port: 5354, Bypass: []string{"192.168.1.10", "192.168.2.0/24", "fd00::1"}},
+			false,
+			[][]string{
+				{"-s", "192.168.1.10", "-j", "RETURN"},
+				{"-s", "192.168.2.0/24", "-j", "RETURN"},
+				{"-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "192.168.1.1:5354"},
+				{"-p", "tcp", "--dport", "53", "-j", "DNAT", "--to-destination", "192.168.1.1:5354"},
+			},
+		},
+		{
+			"ipv6 bypass",
+			&Rules{Port: 53, Bypass: []string{"192.168.1.10", "fd00::1"}},
+			true,
+			[][]string{
+				{"-s", "fd00::1", "-j", "RETURN"},
+				{"-p", "udp", "--dport", "53", "-j", "REDIRECT", "--to-ports", "53"},
+				{"-p", "tcp", "--dport", "53", "-j", "REDIRECT", "--to-ports", "53"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := tc.rules.iptablesRules(tc.v6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected rules, want: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRules_iptablesFamilyMismatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules *Rules
+		v6    bool
+	}{
+		{"ipv4 target with ip6tables", &Rules{IP: "192.168.1.1", Port: 53}, true},
+		{"ipv6 target with iptables", &Rules{IP: "fd00::1", Port: 53}, false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := tc.rules.iptablesRules(tc.v6); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestRules_iptablesBinaries(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     *Rules
+		ip6tables bool
+		want      []string
+	}{
+		{"redirect", &Rules{Port: 53}, true, []string{"iptables", "ip6tables"}},
+		{"redirect without ip6tables", &Rules{Port: 53}, false, []string{"iptables"}},
+		{"dnat ipv4", &Rules{IP: "192.168.1.1", Port: 53}, true, []string{"iptables"}},
+		{"dnat ipv6", &Rules{IP: "fd00::1", Port: 53}, true, []string{"ip6tables"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := tc.rules.iptablesBinaries(tc.ip6tables); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected binaries, want: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRules_nftRuleset(t *testing.T) {
+	r := &Rules{IP: "192.168.1.1", Port: 5354, Bypass: []string{"192.168.1.10", "fd00::1"}}
+	ruleset, err := r.nftRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"table inet ctrld {",
+		"ip saddr { 192.168.1.10 } return",
+		"ip6 saddr { fd00::1 } return",
+		"meta nfproto ipv4 udp dport 53 dnat ip to 192.168.1.1:5354",
+		"meta nfproto ipv4 tcp dport 53 dnat ip to 192.168.1.1:5354",
+		"tcp dport 853 reject with tcp reset",
+	} {
+		if !strings.Contains(ruleset, want) {
+			t.Errorf("missing rule %q in ruleset:\n%s", want, ruleset)
+		}
+	}
+}
+
+func TestRules_pfRdrRules(t *testing.T) {
+	r := &Rules{Port: 53, Bypass: []string{"192.168.1.10"}}
+	want := `no rdr on ! lo0 proto { udp tcp } from { 192.168.1.10 } to any port 53
+rdr pass on ! lo0 proto { udp tcp } from ! (self) to any port 53 -> 127.0.0.1 port 53
+`
+	got, err := r.pfRdrRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("unexpected rules, want: %q, got: %q", want, got)
+	}
+}
+
+func TestRules_golden(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules *Rules
+	}{
+		{"redirect", &Rules{Port: 53}},
+		{"dnat_ipv4_bypass", &Rules{IP: "192.168.1.1", Port: 5354, Bypass: []string{"192.168.1.10", "192.168.2.0/24", "fd00::1"}}},
+		{"dnat_ipv6", &Rules{IP: "fd00::1", Port: 53, Bypass: []string{"fd00::10"}}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			iptablesCmds, err := tc.rules.iptablesCmds(tc.rules.iptablesBinaries(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cmds []string
+			for _, cmd := range iptablesCmds {
+				cmds = append(cmds, strings.Join(cmd, " "))
+			}
+			testhelper.AssertGolden(t, tc.name+".iptables", strings.Join(cmds, "\n")+"\n")
+
+			nft, err := tc.rules.nftRuleset()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testhelper.AssertGolden(t, tc.name+".nft", nft)
+
+			rdr, err := tc.rules.pfRdrRules()
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter, err := tc.rules.pfFilterRules()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testhelper.AssertGolden(t, tc.name+".pf", rdr+filter)
+		})
+	}
+}
@@ -3,10 +3,12 @@ package router
 import (
 	"bytes"
 	"crypto/x509"
+	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"sync/atomic"
 
 	"github.com/kardianos/service"
@@ -19,6 +21,7 @@ import (
 	"github.com/Control-D-Inc/ctrld/internal/router/firewalla"
 	"github.com/Control-D-Inc/ctrld/internal/router/merlin"
 	"github.com/Control-D-Inc/ctrld/internal/router/openwrt"
+	"github.com/Control-D-Inc/ctrld/internal/router/redirect"
 	"github.com/Control-D-Inc/ctrld/internal/router/synology"
 	"github.com/Control-D-Inc/ctrld/internal/router/tomato"
 	"github.com/Control-D-Inc/ctrld/internal/router/ubios"
@@ -49,6 +52,10 @@ type Router interface {
 
 // New returns new Router interface.
 func New(cfg *ctrld.Config, cdMode bool) Router {
+	return &redirectRouter{Router: newRouter(cfg, cdMode), cfg: cfg}
+}
+
+func newRouter(cfg *ctrld.Config, cdMode bool) Router {
 	switch Name() {
 	case ddwrt.Name:
 		return ddwrt.New(cfg)
@@ -70,6 +77,84 @@ func New(cfg *ctrld.Config, cdMode bool) Router {
 	return newOsRouter(cfg, cdMode)
 }
 
+// redirectRouter wraps a Router, installing DNS redirect rules after setup if
+// "dns_redirect" is enabled, and removing them on cleanup.
+type redirectRouter struct {
+	Router
+	cfg *ctrld.Config
+}
+
+// Setup implements Router.Setup.
+func (r *redirectRouter) Setup() error {
+	if err := r.Router.Setup(); err != nil {
+		return err
+	}
+	if wi, ok := r.Router.(WatchdogInstaller); ok {
+		if err := wi.InstallWatchdog(); err != nil {
+			ctrld.ProxyLogger.Load().Warn().Err(err).Msg("could not install watchdog")
+		}
+	}
+	if !r.cfg.Service.DnsRedirect {
+		return nil
+	}
+	if err := r.redirectRules().Install(); err != nil {
+		return fmt.Errorf("installing DNS redirect rules: %w", err)
+	}
+	return nil
+}
+
+// Cleanup implements Router.Cleanup.
+func (r *redirectRouter) Cleanup() error {
+	// Always removing rules, so left over rules are removed even if
+	// "dns_redirect" was disabled.
+	if err := r.redirectRules().Remove(); err != nil {
+		ctrld.ProxyLogger.Load().Warn().Err(err).Msg("could not remove DNS redirect rules")
+	}
+	if wi, ok := r.Router.(WatchdogInstaller); ok {
+		if err := wi.RemoveWatchdog(); err != nil {
+			ctrld.ProxyLogger.Load().Warn().Err(err).Msg("could not remove watchdog")
+		}
+	}
+	return r.Router.Cleanup()
+}
+
+// Verify implements Verifier.Verify, if the wrapped Router is a Verifier.
+func (r *redirectRouter) Verify() error {
+	if v, ok := r.Router.(Verifier); ok {
+		return v.Verify()
+	}
+	return nil
+}
+
+// Repair implements Verifier.Repair, if the wrapped Router is a Verifier. Only the wrapped
+// Router state is repaired, DNS redirect rules and the watchdog job are kept.
+func (r *redirectRouter) Repair() error {
+	if v, ok := r.Router.(Verifier); ok {
+		return v.Repair()
+	}
+	return nil
+}
+
+// redirectRules returns the DNS redirect rules for current config.
+func (r *redirectRouter) redirectRules() *redirect.Rules {
+	rules := &redirect.Rules{Bypass: r.cfg.Service.DnsRedirectBypass}
+	lc := r.cfg.FirstListener()
+	ip := net.ParseIP(lc.IP)
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		// ctrld listens on all interfaces, redirect to the incoming interface.
+		rules.Port = lc.Port
+	case ip.IsLoopback():
+		// ctrld is an upstream of the router DNS server, redirect to it,
+		// so the router DNS server could add client info to queries.
+		rules.Port = 53
+	default:
+		rules.IP = lc.IP
+		rules.Port = lc.Port
+	}
+	return rules
+}
+
 // IsGLiNet reports whether the router is an GL.iNet router.
 func IsGLiNet() bool {
 	if Name() != openwrt.Name {
@@ -142,6 +227,31 @@ func LocalResolverIP() string {
 	return ""
 }
 
+// defaultListenPort is the port ctrld falls back to when port 53 is not available,
+// which is the common case on routers, where port 53 is owned by dnsmasq.
+const defaultListenPort = 5354
+
+// ListenAddress returns the IP and port that ctrld should listen on when it could not
+// use port 53. The address could be configured using "router_listen_address" in the
+// [service] section, so routers could bind ctrld on a LAN IP, or use another port if
+// 5354 is already used by other services (e.g: mDNS responders on Synology).
+//
+// An empty IP means the caller should keep the IP that it's going to listen on.
+func ListenAddress(cfg *ctrld.Config) (string, int) {
+	if cfg == nil || cfg.Service.RouterListenAddress == "" {
+		return "", defaultListenPort
+	}
+	host, portStr, err := net.SplitHostPort(cfg.Service.RouterListenAddress)
+	if err != nil {
+		return "", defaultListenPort
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 {
+		return "", defaultListenPort
+	}
+	return host, port
+}
+
 // HomeDir returns the home directory of ctrld on current router.
 func HomeDir() (string, error) {
 	switch Name() {
@@ -186,7 +296,7 @@ func SelfInterfaces() []*net.Interface {
 // LeaseFilesDir is the directory which contains lease files.
 func LeaseFilesDir() string {
 	if Name() == edgeos.Name {
-		edgeos.LeaseFileDir()
+		return edgeos.LeaseFileDir()
 	}
 	return ""
 }
@@ -87,6 +87,13 @@ func (sc linuxSystemService) New(i service.Interface, c *service.Config) (servic
 	return sc.new(i, sc.String(), c)
 }
 
+// svcScriptData is the data for rendering service scripts.
+type svcScriptData struct {
+	*service.Config
+	Path            string
+	DnsMasqConfPath string
+}
+
 func isInteractive() (bool, error) {
 	ppid := os.Getppid()
 	if ppid == 1 {
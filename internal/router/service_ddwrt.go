@@ -9,11 +9,11 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
-	"text/template"
 
 	"github.com/kardianos/service"
 
 	"github.com/Control-D-Inc/ctrld/internal/router/nvram"
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
 )
 
 type ddwrtSvc struct {
@@ -50,8 +50,14 @@ func (s *ddwrtSvc) configPath() string {
 	return fmt.Sprintf("/jffs/etc/config/%s.startup", s.Config.Name)
 }
 
-func (s *ddwrtSvc) template() *template.Template {
-	return template.Must(template.New("").Parse(ddwrtSvcScript))
+// script returns the startup script of ctrld, which is at path.
+func (s *ddwrtSvc) script(path string) (string, error) {
+	return tmpl.Render(ddwrtSvcScript, &svcScriptData{Config: s.Config, Path: path})
+}
+
+// startupCmd returns the command for starting ctrld, which is at path, on boot.
+func (s *ddwrtSvc) startupCmd(path string) (string, error) {
+	return tmpl.Render(ddwrtStartupCmd, &svcScriptData{Config: s.Config, Path: path})
 }
 
 func (s *ddwrtSvc) Install() error {
@@ -69,12 +75,9 @@ func (s *ddwrtSvc) Install() error {
 		return errors.New("could not install service outside /jffs")
 	}
 
-	var to = &struct {
-		*service.Config
-		Path string
-	}{
-		s.Config,
-		path,
+	script, err := s.script(path)
+	if err != nil {
+		return err
 	}
 
 	f, err := os.Create(confPath)
@@ -83,7 +86,7 @@ func (s *ddwrtSvc) Install() error {
 	}
 	defer f.Close()
 
-	if err := s.template().Execute(f, to); err != nil {
+	if _, err := f.WriteString(script); err != nil {
 		return err
 	}
 
@@ -91,11 +94,10 @@ func (s *ddwrtSvc) Install() error {
 		return err
 	}
 
-	var sb strings.Builder
-	if err := template.Must(template.New("").Parse(ddwrtStartupCmd)).Execute(&sb, to); err != nil {
+	s.rcStartup, err = s.startupCmd(path)
+	if err != nil {
 		return err
 	}
-	s.rcStartup = sb.String()
 	curVal, err := nvram.Run("get", nvram.RCStartupKey)
 	if err != nil {
 		return err
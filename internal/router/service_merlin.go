@@ -10,11 +10,11 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
-	"text/template"
 
 	"github.com/kardianos/service"
 
 	"github.com/Control-D-Inc/ctrld/internal/router/nvram"
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
 )
 
 const (
@@ -56,8 +56,9 @@ func (s *merlinSvc) configPath() string {
 	return path + ".startup"
 }
 
-func (s *merlinSvc) template() *template.Template {
-	return template.Must(template.New("").Parse(merlinSvcScript))
+// script returns the startup script of ctrld, which is at path.
+func (s *merlinSvc) script(path string) (string, error) {
+	return tmpl.Render(merlinSvcScript, &svcScriptData{Config: s.Config, Path: path})
 }
 
 func (s *merlinSvc) Install() error {
@@ -81,12 +82,9 @@ func (s *merlinSvc) Install() error {
 		return fmt.Errorf("already installed: %s", confPath)
 	}
 
-	var to = &struct {
-		*service.Config
-		Path string
-	}{
-		s.Config,
-		exePath,
+	script, err := s.script(exePath)
+	if err != nil {
+		return fmt.Errorf("s.script: %w", err)
 	}
 
 	f, err := os.Create(confPath)
@@ -95,8 +93,8 @@ func (s *merlinSvc) Install() error {
 	}
 	defer f.Close()
 
-	if err := s.template().Execute(f, to); err != nil {
-		return fmt.Errorf("s.template.Execute: %w", err)
+	if _, err := f.WriteString(script); err != nil {
+		return fmt.Errorf("f.WriteString: %w", err)
 	}
 
 	if err = os.Chmod(confPath, 0755); err != nil {
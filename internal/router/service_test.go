@@ -0,0 +1,44 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/kardianos/service"
+
+	"github.com/Control-D-Inc/ctrld/testhelper"
+)
+
+var testSvcConfig = &service.Config{
+	Name:        "ctrld",
+	DisplayName: "Control-D Helper Service",
+	Description: "A highly configurable, multi-protocol DNS forwarding proxy",
+	Arguments:   []string{"run", "--config", "/jffs/controld/ctrld config.toml"},
+}
+
+func Test_svcScripts_golden(t *testing.T) {
+	const path = "/jffs/controld/ctrld"
+	tests := []struct {
+		name   string
+		render func() (string, error)
+	}{
+		{"merlin", func() (string, error) { return (&merlinSvc{Config: testSvcConfig}).script(path) }},
+		{"tomato", func() (string, error) { return (&tomatoSvc{Config: testSvcConfig}).script(path) }},
+		{"ddwrt", func() (string, error) { return (&ddwrtSvc{Config: testSvcConfig}).script(path) }},
+		{"ddwrt_startup", func() (string, error) { return (&ddwrtSvc{Config: testSvcConfig}).startupCmd(path) }},
+		{"ubios", func() (string, error) { return (&ubiosSvc{Config: testSvcConfig}).script(path) }},
+		{"ubios_boot_service", func() (string, error) {
+			return (&ubiosSvc{Config: testSvcConfig}).bootService(path, []string{"start", "--cd", "abcd1234"})
+		}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := tc.render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testhelper.AssertGolden(t, tc.name, got)
+		})
+	}
+}
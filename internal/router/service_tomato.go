@@ -9,11 +9,11 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
-	"text/template"
 
 	"github.com/kardianos/service"
 
 	"github.com/Control-D-Inc/ctrld/internal/router/nvram"
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
 )
 
 const tomatoNvramScriptWanupKey = "script_wanup"
@@ -52,8 +52,9 @@ func (s *tomatoSvc) configPath() string {
 	return path + ".startup"
 }
 
-func (s *tomatoSvc) template() *template.Template {
-	return template.Must(template.New("").Parse(tomatoSvcScript))
+// script returns the startup script of ctrld, which is at path.
+func (s *tomatoSvc) script(path string) (string, error) {
+	return tmpl.Render(tomatoSvcScript, &svcScriptData{Config: s.Config, Path: path})
 }
 
 func (s *tomatoSvc) Install() error {
@@ -77,12 +78,9 @@ func (s *tomatoSvc) Install() error {
 		return fmt.Errorf("already installed: %s", confPath)
 	}
 
-	var to = &struct {
-		*service.Config
-		Path string
-	}{
-		s.Config,
-		exePath,
+	script, err := s.script(exePath)
+	if err != nil {
+		return fmt.Errorf("s.script: %w", err)
 	}
 
 	f, err := os.Create(confPath)
@@ -91,8 +89,8 @@ func (s *tomatoSvc) Install() error {
 	}
 	defer f.Close()
 
-	if err := s.template().Execute(f, to); err != nil {
-		return fmt.Errorf("s.template.Execute: %w", err)
+	if _, err := f.WriteString(script); err != nil {
+		return fmt.Errorf("f.WriteString: %w", err)
 	}
 
 	if err = os.Chmod(confPath, 0755); err != nil {
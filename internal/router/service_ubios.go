@@ -7,12 +7,12 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
-	"text/template"
 	"time"
 
 	"github.com/kardianos/service"
+
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
 )
 
 // This is a copy of https://github.com/kardianos/service/blob/v1.2.1/service_sysv_linux.go,
@@ -58,8 +58,16 @@ func (s *ubiosSvc) execPath() (string, error) {
 	return os.Executable()
 }
 
-func (s *ubiosSvc) template() *template.Template {
-	return template.Must(template.New("").Funcs(tf).Parse(ubiosSvcScript))
+// script returns the init script of ctrld, which is at path.
+func (s *ubiosSvc) script(path string) (string, error) {
+	return tmpl.Render(ubiosSvcScript, &svcScriptData{Config: s.Config, Path: path, DnsMasqConfPath: ubiosDNSMasqConfigPath})
+}
+
+// bootService returns the systemd service, which starts ctrld, which is at path, with args on boot.
+func (s *ubiosSvc) bootService(path string, args []string) (string, error) {
+	svcConfig := *s.Config
+	svcConfig.Arguments = args
+	return tmpl.Render(ubiosBootSystemdService, &svcScriptData{Config: &svcConfig, Path: path, DnsMasqConfPath: ubiosDNSMasqConfigPath})
 }
 
 func (s *ubiosSvc) Install() error {
@@ -79,17 +87,11 @@ func (s *ubiosSvc) Install() error {
 		return fmt.Errorf("failed to get exec path: %w", err)
 	}
 
-	var to = &struct {
-		*service.Config
-		Path            string
-		DnsMasqConfPath string
-	}{
-		s.Config,
-		path,
-		ubiosDNSMasqConfigPath,
+	initScript, err := s.script(path)
+	if err != nil {
+		return fmt.Errorf("failed to create init script: %w", err)
 	}
-
-	if err := s.template().Execute(f, to); err != nil {
+	if _, err := f.WriteString(initScript); err != nil {
 		return fmt.Errorf("failed to create init script: %w", err)
 	}
 
@@ -108,10 +110,11 @@ func (s *ubiosSvc) Install() error {
 	}
 	defer script.Close()
 
-	svcConfig := *to.Config
-	svcConfig.Arguments = os.Args[1:]
-	to.Config = &svcConfig
-	if err := template.Must(template.New("").Funcs(tf).Parse(ubiosBootSystemdService)).Execute(script, &to); err != nil {
+	bootService, err := s.bootService(path, os.Args[1:])
+	if err != nil {
+		return fmt.Errorf("failed to create boot service file: %w", err)
+	}
+	if _, err := script.WriteString(bootService); err != nil {
 		return fmt.Errorf("failed to create boot service file: %w", err)
 	}
 	if err := script.Close(); err != nil {
@@ -328,12 +331,3 @@ case "$1" in
 esac
 exit 0
 `
-
-var tf = map[string]interface{}{
-	"cmd": func(s string) string {
-		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
-	},
-	"cmdEscape": func(s string) string {
-		return strings.Replace(s, " ", `\x20`, -1)
-	},
-}
@@ -0,0 +1,38 @@
+// Package tmpl renders scripts, config files and firewall rules, which ctrld generates for
+// router platforms.
+//
+// Generated artifacts are covered by golden file tests in testdata directory of packages
+// which generate them. After changing a template, run the tests with -update flag, then
+// review the changes of golden files.
+package tmpl
+
+import (
+	"strings"
+	"text/template"
+)
+
+// Funcs are functions available to all templates.
+var Funcs = template.FuncMap{
+	"join": strings.Join,
+	// cmd quotes s as a shell argument, same as the "cmd" function of kardianos/service.
+	"cmd": func(s string) string {
+		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+	},
+	// cmdEscape escapes spaces in s, same as the "cmdEscape" function of kardianos/service.
+	"cmdEscape": func(s string) string {
+		return strings.Replace(s, " ", `\x20`, -1)
+	},
+}
+
+// Render renders template text with data.
+func Render(text string, data any) (string, error) {
+	t, err := template.New("").Funcs(Funcs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
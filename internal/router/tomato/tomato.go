@@ -2,12 +2,14 @@ package tomato
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 
 	"github.com/Control-D-Inc/ctrld"
 	"github.com/Control-D-Inc/ctrld/internal/router/dnsmasq"
 	"github.com/Control-D-Inc/ctrld/internal/router/ntp"
 	"github.com/Control-D-Inc/ctrld/internal/router/nvram"
+	"github.com/Control-D-Inc/ctrld/internal/router/watchdog"
 	"github.com/kardianos/service"
 )
 
@@ -114,6 +116,20 @@ func (f *FreshTomato) Cleanup() error {
 	return nil
 }
 
+// InstallWatchdog implements router.WatchdogInstaller, using cron job.
+func (f *FreshTomato) InstallWatchdog() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return watchdog.InstallCru(exe + ".startup restart")
+}
+
+// RemoveWatchdog implements router.WatchdogInstaller.
+func (f *FreshTomato) RemoveWatchdog() error {
+	return watchdog.RemoveCru()
+}
+
 func tomatoRestartService(name string) error {
 	return tomatoRestartServiceWithKill(name, false)
 }
@@ -2,6 +2,7 @@ package ubios
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"strconv"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/Control-D-Inc/ctrld"
 	"github.com/Control-D-Inc/ctrld/internal/router/dnsmasq"
 	"github.com/Control-D-Inc/ctrld/internal/router/edgeos"
+	"github.com/Control-D-Inc/ctrld/internal/router/watchdog"
 )
 
 const (
@@ -84,6 +86,40 @@ func (u *Ubios) Cleanup() error {
 	return nil
 }
 
+// Verify reports an error if the DNS forwarding state set up by Setup was changed.
+func (u *Ubios) Verify() error {
+	if u.cfg.FirstListener().IsDirectDnsListener() {
+		return nil
+	}
+	data, err := dnsmasq.ConfTmplWithCacheDisabled(dnsmasq.ConfigContentTmpl, u.cfg, false)
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(ubiosDNSMasqConfigPath)
+	if err != nil {
+		return err
+	}
+	if string(buf) != data {
+		return fmt.Errorf("%s: ctrld config was changed", ubiosDNSMasqConfigPath)
+	}
+	return nil
+}
+
+// Repair writes the dnsmasq config changed after Setup back, then restarts dnsmasq.
+func (u *Ubios) Repair() error {
+	return u.Setup()
+}
+
+// InstallWatchdog implements router.WatchdogInstaller, using systemd timer.
+func (u *Ubios) InstallWatchdog() error {
+	return watchdog.InstallSystemdTimer("/etc/init.d/ctrld restart")
+}
+
+// RemoveWatchdog implements router.WatchdogInstaller.
+func (u *Ubios) RemoveWatchdog() error {
+	return watchdog.RemoveSystemdTimer()
+}
+
 func restartDNSMasq() error {
 	buf, err := os.ReadFile("/run/dnsmasq.pid")
 	if err != nil {
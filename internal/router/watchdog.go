@@ -0,0 +1,69 @@
+package router
+
+import (
+	"context"
+	"time"
+
+	"github.com/Control-D-Inc/ctrld"
+)
+
+// watchdogInterval is the interval between each DNS forwarding state checks.
+const watchdogInterval = time.Minute
+
+// Verifier is implemented by routers which could verify and repair the DNS forwarding state set up by ctrld.
+type Verifier interface {
+	// Verify reports an error if the DNS forwarding state was changed after Setup.
+	Verify() error
+	// Repair re-applies the DNS forwarding state changed after Setup. Unlike Cleanup then Setup,
+	// the rest of the state set up by ctrld, e.g: DNS redirect rules, watchdog job, is kept as is,
+	// so DNS is not left unredirected while repairing.
+	Repair() error
+}
+
+// WatchdogInstaller is implemented by routers which could install a scheduled job, checking
+// ctrld process and DNS path even when ctrld is not running. See package watchdog for details.
+type WatchdogInstaller interface {
+	// InstallWatchdog installs the watchdog job.
+	InstallWatchdog() error
+	// RemoveWatchdog removes the watchdog job installed by InstallWatchdog.
+	RemoveWatchdog() error
+}
+
+// Watchdog periodically verifies the DNS forwarding state set up by r, and re-applies it if broken.
+// Firmware updates or UI changes on some routers (Merlin, Ubios ...) may revert nvram/dnsmasq
+// settings long after ctrld was installed, leaving the LAN without ctrld.
+//
+// Watchdog blocks until ctx is canceled, every repair is logged as a notice event.
+func Watchdog(ctx context.Context, r Router) {
+	watchdog(ctx, r, watchdogInterval)
+}
+
+func watchdog(ctx context.Context, r Router, interval time.Duration) {
+	v, ok := r.(Verifier)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := v.Verify()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+		logger := ctrld.ProxyLogger.Load()
+		logger.Warn().Err(err).Msg("router watchdog: DNS forwarding state is broken, repairing")
+		if err := v.Repair(); err != nil {
+			logger.Error().Err(err).Msg("router watchdog: could not repair DNS forwarding state")
+			continue
+		}
+		logger.Notice().Msg("router watchdog: DNS forwarding state repaired")
+	}
+}
@@ -0,0 +1,248 @@
+// Package watchdog installs a platform scheduled job which checks ctrld process and DNS path
+// every few minutes, restarting ctrld if it is broken. It complements router.Watchdog, which
+// runs inside ctrld process, thus could not help when ctrld itself crashed or hung.
+package watchdog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Control-D-Inc/ctrld/internal/router/tmpl"
+)
+
+const (
+	// Name is the name of the scheduled job, also used as marker in crontab.
+	Name = "ctrld_watchdog"
+	// Schedule is the cron schedule of the watchdog.
+	Schedule = "*/5 * * * *"
+
+	openwrtCrontabPath     = "/etc/crontabs/root"
+	systemdUnitDir         = "/etc/systemd/system"
+	systemdServiceUnitName = "ctrld-watchdog.service"
+	systemdTimerUnitName   = "ctrld-watchdog.timer"
+
+	// checkDomain is the domain used for checking DNS path.
+	checkDomain = "controld.com"
+	// checkNameserver is used for checking whether the network is up, keep in sync with ctrld.bootstrapDNS.
+	checkNameserver = "76.76.2.22"
+)
+
+// scriptTmpl is the watchdog script. ctrld is restarted if its process is gone, or DNS lookup via
+// the router fails while the network is up. The latter condition prevents restarting ctrld over
+// and over while WAN is down.
+const scriptTmpl = `#!/bin/sh
+# {{.Name}}: installed by ctrld, do not edit.
+if ! pidof {{.Process}} >/dev/null 2>&1; then
+  logger -t {{.Name}} "ctrld is not running, restarting"
+  {{.RestartCmd}}
+  exit 0
+fi
+if ! nslookup {{.Domain}} 127.0.0.1 >/dev/null 2>&1 && nslookup {{.Domain}} {{.Nameserver}} >/dev/null 2>&1; then
+  logger -t {{.Name}} "DNS lookup via ctrld failed, restarting"
+  {{.RestartCmd}}
+fi
+`
+
+const systemdServiceTmpl = `[Unit]
+Description=ctrld watchdog
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh {{.Script}}
+`
+
+const systemdTimerTmpl = `[Unit]
+Description=Run ctrld watchdog every 5 minutes
+
+[Timer]
+OnBootSec=5min
+OnUnitActiveSec=5min
+
+[Install]
+WantedBy=timers.target
+`
+
+// Script returns the watchdog script content, restartCmd is used for (re)starting ctrld.
+func Script(process, restartCmd string) (string, error) {
+	return tmpl.Render(scriptTmpl, map[string]string{
+		"Name":       Name,
+		"Process":    process,
+		"RestartCmd": restartCmd,
+		"Domain":     checkDomain,
+		"Nameserver": checkNameserver,
+	})
+}
+
+// systemdService returns the systemd service unit running the watchdog script at given path.
+func systemdService(script string) (string, error) {
+	return tmpl.Render(systemdServiceTmpl, map[string]string{"Script": script})
+}
+
+// InstallCru installs the watchdog using "cru", which is available on Merlin/Tomato.
+func InstallCru(restartCmd string) error {
+	script, err := writeScript(restartCmd)
+	if err != nil {
+		return err
+	}
+	// "cru a" replaces existed job with the same name.
+	return run("cru", "a", Name, Schedule+" "+script)
+}
+
+// RemoveCru removes the watchdog installed by InstallCru.
+func RemoveCru() error {
+	if err := run("cru", "d", Name); err != nil {
+		return err
+	}
+	return removeScript()
+}
+
+// InstallCrontab installs the watchdog to root crontab, which is used by Openwrt.
+func InstallCrontab(restartCmd string) error {
+	script, err := writeScript(restartCmd)
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(openwrtCrontabPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	content := AddCronJob(string(buf), Schedule+" "+script)
+	if err := os.WriteFile(openwrtCrontabPath, []byte(content), 0600); err != nil {
+		return err
+	}
+	return run("/etc/init.d/cron", "restart")
+}
+
+// RemoveCrontab removes the watchdog installed by InstallCrontab.
+func RemoveCrontab() error {
+	buf, err := os.ReadFile(openwrtCrontabPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if bytes.Contains(buf, []byte(Name)) {
+		if err := os.WriteFile(openwrtCrontabPath, []byte(RemoveCronJob(string(buf))), 0600); err != nil {
+			return err
+		}
+		if err := run("/etc/init.d/cron", "restart"); err != nil {
+			return err
+		}
+	}
+	return removeScript()
+}
+
+// InstallSystemdTimer installs the watchdog as a systemd timer, which is used by Ubios.
+func InstallSystemdTimer(restartCmd string) error {
+	script, err := writeScript(restartCmd)
+	if err != nil {
+		return err
+	}
+	svc, err := systemdService(script)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(systemdUnitDir, systemdServiceUnitName), []byte(svc), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(systemdUnitDir, systemdTimerUnitName), []byte(systemdTimerTmpl), 0644); err != nil {
+		return err
+	}
+	if err := run("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return run("systemctl", "enable", "--now", systemdTimerUnitName)
+}
+
+// RemoveSystemdTimer removes the watchdog installed by InstallSystemdTimer.
+func RemoveSystemdTimer() error {
+	timer := filepath.Join(systemdUnitDir, systemdTimerUnitName)
+	if _, err := os.Stat(timer); err == nil {
+		if err := run("systemctl", "disable", "--now", systemdTimerUnitName); err != nil {
+			return err
+		}
+	}
+	for _, f := range []string{timer, filepath.Join(systemdUnitDir, systemdServiceUnitName)} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := run("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return removeScript()
+}
+
+// AddCronJob returns crontab content with the watchdog job line added,
+// replacing any existed watchdog job.
+func AddCronJob(content, job string) string {
+	content = RemoveCronJob(content)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + job + " # " + Name + "\n"
+}
+
+// RemoveCronJob returns crontab content with the watchdog job line removed.
+func RemoveCronJob(content string) string {
+	if content == "" {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.HasSuffix(line, "# "+Name) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return strings.Join(kept, "\n") + "\n"
+}
+
+// scriptPath returns the path to watchdog script and the process name of ctrld. The script
+// is placed next to ctrld binary, because that's where the persistent storage is on routers.
+func scriptPath() (string, string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(filepath.Dir(exe), Name+".sh"), filepath.Base(exe), nil
+}
+
+func writeScript(restartCmd string) (string, error) {
+	path, process, err := scriptPath()
+	if err != nil {
+		return "", err
+	}
+	content, err := Script(process, restartCmd)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func removeScript() error {
+	path, _, err := scriptPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func run(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %s, %w", name, strings.Join(args, " "), string(out), err)
+	}
+	return nil
+}
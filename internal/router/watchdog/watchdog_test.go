@@ -0,0 +1,59 @@
+package watchdog
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Control-D-Inc/ctrld/testhelper"
+)
+
+func TestAddRemoveCronJob(t *testing.T) {
+	const job = "*/5 * * * * /jffs/controld/ctrld_watchdog.sh"
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"empty", "", job + " # ctrld_watchdog\n"},
+		{"existing jobs", "0 3 * * * reboot", "0 3 * * * reboot\n" + job + " # ctrld_watchdog\n"},
+		{"replace old job", "0 3 * * * reboot\n*/5 * * * * /old/ctrld_watchdog.sh # ctrld_watchdog\n", "0 3 * * * reboot\n" + job + " # ctrld_watchdog\n"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got := AddCronJob(tc.content, job)
+			if got != tc.want {
+				t.Fatalf("unexpected content, want: %q, got: %q", tc.want, got)
+			}
+			if removed := RemoveCronJob(got); strings.Contains(removed, Name) {
+				t.Fatalf("watchdog job was not removed: %q", removed)
+			}
+		})
+	}
+}
+
+func TestScript(t *testing.T) {
+	s, err := Script("ctrld", "/jffs/controld/ctrld.startup restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"pidof ctrld",
+		"/jffs/controld/ctrld.startup restart",
+		"nslookup controld.com 127.0.0.1",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %q in script:\n%s", want, s)
+		}
+	}
+	testhelper.AssertGolden(t, "script", s)
+}
+
+func Test_systemdService(t *testing.T) {
+	svc, err := systemdService("/data/ctrld/ctrld_watchdog.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelper.AssertGolden(t, "systemd_service", svc)
+}
@@ -0,0 +1,93 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVerifierRouter is a Router whose DNS forwarding state is broken at the given Verify calls.
+type fakeVerifierRouter struct {
+	Router
+	mu       sync.Mutex
+	broken   map[int]bool
+	verifies int
+	repairs  int
+	// cancelAt is the Verify call which cancels the watchdog.
+	cancelAt int
+	cancel   context.CancelFunc
+}
+
+func (f *fakeVerifierRouter) Verify() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.verifies++
+	if f.verifies == f.cancelAt {
+		f.cancel()
+	}
+	if f.broken[f.verifies] {
+		return errors.New("broken")
+	}
+	return nil
+}
+
+func (f *fakeVerifierRouter) Repair() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.repairs++
+	return nil
+}
+
+func (f *fakeVerifierRouter) Setup() error {
+	panic("watchdog must not set up router again")
+}
+
+func (f *fakeVerifierRouter) Cleanup() error {
+	panic("watchdog must not clean up router")
+}
+
+func Test_watchdog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &fakeVerifierRouter{
+		broken:   map[int]bool{2: true, 3: true, 5: true},
+		cancelAt: 6,
+		cancel:   cancel,
+	}
+	done := make(chan struct{})
+	go func() {
+		watchdog(ctx, r, time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not stop after context was canceled")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.repairs != 3 {
+		t.Errorf("unexpected number of repairs, want: 3, got: %d", r.repairs)
+	}
+	if r.verifies != r.cancelAt {
+		t.Errorf("unexpected number of verifies, want: %d, got: %d", r.cancelAt, r.verifies)
+	}
+}
+
+func Test_watchdog_brokenWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The state is broken at the Verify call which cancels the watchdog, it must not be repaired.
+	r := &fakeVerifierRouter{
+		broken:   map[int]bool{1: true},
+		cancelAt: 1,
+		cancel:   cancel,
+	}
+	watchdog(ctx, r, time.Millisecond)
+	if r.repairs != 0 {
+		t.Errorf("repair must not run after context was canceled, got: %d repairs", r.repairs)
+	}
+}
@@ -0,0 +1,132 @@
+// Package sntp implements a minimal SNTP client (RFC 4330), used for learning the clock
+// offset on devices which boot without a correct clock, like routers without RTC.
+package sntp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	packetSize = 48
+	// ntpEpochOffset is the number of seconds between NTP epoch (1900) and Unix epoch (1970).
+	ntpEpochOffset = 2208988800
+
+	modeClient = 3
+	modeServer = 4
+	version    = 4
+)
+
+// DefaultServers are well-known public NTP servers, used by IP addresses, because
+// DNS may not work yet while the clock is wrong.
+var DefaultServers = []string{
+	"162.159.200.1",   // time.cloudflare.com
+	"162.159.200.123", // time.cloudflare.com
+	"216.239.35.0",    // time.google.com
+	"216.239.35.4",    // time.google.com
+}
+
+var (
+	errInvalidResponse = errors.New("sntp: invalid response")
+	errKissOfDeath     = errors.New("sntp: kiss-o'-death response")
+)
+
+// Result is the result of a SNTP query.
+type Result struct {
+	// Offset is the offset of local clock from server clock, add it to local time to get the server time.
+	Offset time.Duration
+	// RTT is the round trip time of the query.
+	RTT time.Duration
+}
+
+// Query sends a SNTP request to the server at addr, which is "host" or "host:port",
+// returning the local clock offset. now is used for reading local clock, time.Now is
+// used if it is nil.
+func Query(ctx context.Context, addr string, now func() time.Time) (*Result, error) {
+	if now == nil {
+		now = time.Now
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "123")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, packetSize)
+	req[0] = version<<3 | modeClient
+	t1 := now()
+	// Server copies transmit timestamp of request to origin timestamp of response,
+	// which is used for matching the response.
+	origin := toNtpTime(t1)
+	binary.BigEndian.PutUint64(req[40:], origin)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, packetSize)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		t4 := now()
+		if n < packetSize || binary.BigEndian.Uint64(resp[24:]) != origin {
+			continue
+		}
+		return parseResponse(resp, t1, t4)
+	}
+}
+
+// parseResponse parses SNTP response, t1 and t4 are the local time when the request
+// was sent and the response was received.
+func parseResponse(resp []byte, t1, t4 time.Time) (*Result, error) {
+	if len(resp) < packetSize {
+		return nil, errInvalidResponse
+	}
+	if mode := resp[0] & 0x07; mode != modeServer {
+		return nil, fmt.Errorf("%w: unexpected mode %d", errInvalidResponse, mode)
+	}
+	if li := resp[0] >> 6; li == 3 {
+		return nil, fmt.Errorf("%w: server clock is not synchronized", errInvalidResponse)
+	}
+	if stratum := resp[1]; stratum == 0 {
+		return nil, errKissOfDeath
+	}
+	t2 := fromNtpTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNtpTime(binary.BigEndian.Uint64(resp[40:]))
+	if t3.IsZero() {
+		return nil, fmt.Errorf("%w: zero transmit timestamp", errInvalidResponse)
+	}
+	// See RFC 4330, section 5.
+	return &Result{
+		Offset: (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		RTT:    t4.Sub(t1) - t3.Sub(t2),
+	}, nil
+}
+
+// toNtpTime converts t to NTP timestamp format.
+func toNtpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// fromNtpTime converts NTP timestamp to time.Time, zero timestamp is converted to zero time.
+func fromNtpTime(ts uint64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	secs := int64(ts>>32) - ntpEpochOffset
+	nsecs := (ts & 0xffffffff) * uint64(time.Second) >> 32
+	return time.Unix(secs, int64(nsecs))
+}
@@ -0,0 +1,95 @@
+package sntp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_ntpTime(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	got := fromNtpTime(toNtpTime(now))
+	if d := got.Sub(now); d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("unexpected time, want: %v, got: %v", now, got)
+	}
+	if !fromNtpTime(0).IsZero() {
+		t.Error("zero timestamp must be converted to zero time")
+	}
+}
+
+// serveSNTP runs a fake SNTP server, which clock is ahead of local clock by offset.
+func serveSNTP(t *testing.T, offset time.Duration, stratum byte) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, packetSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < packetSize {
+				continue
+			}
+			resp := make([]byte, packetSize)
+			resp[0] = version<<3 | modeServer
+			resp[1] = stratum
+			copy(resp[24:32], buf[40:48])
+			ts := toNtpTime(time.Now().Add(offset))
+			binary.BigEndian.PutUint64(resp[32:], ts)
+			binary.BigEndian.PutUint64(resp[40:], ts)
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestQuery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	offset := 3 * time.Hour
+	res, err := Query(ctx, serveSNTP(t, offset, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := res.Offset - offset; d < -time.Second || d > time.Second {
+		t.Errorf("unexpected offset, want: %v, got: %v", offset, res.Offset)
+	}
+
+	if _, err := Query(ctx, serveSNTP(t, offset, 0), nil); err == nil {
+		t.Error("expected error for kiss-o'-death response")
+	}
+}
+
+func Test_parseResponse(t *testing.T) {
+	t1 := time.Unix(1700000000, 0)
+	t4 := t1.Add(100 * time.Millisecond)
+	resp := make([]byte, packetSize)
+	resp[0] = version<<3 | modeServer
+	resp[1] = 2
+	// Server is 10s ahead, processing takes 20ms.
+	binary.BigEndian.PutUint64(resp[32:], toNtpTime(t1.Add(10*time.Second+40*time.Millisecond)))
+	binary.BigEndian.PutUint64(resp[40:], toNtpTime(t1.Add(10*time.Second+60*time.Millisecond)))
+	res, err := parseResponse(resp, t1, t4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := res.Offset - 10*time.Second; d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("unexpected offset: %v", res.Offset)
+	}
+	if d := res.RTT - 80*time.Millisecond; d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("unexpected rtt: %v", res.RTT)
+	}
+
+	resp[0] = version<<3 | modeClient
+	if _, err := parseResponse(resp, t1, t4); err == nil {
+		t.Error("expected error for invalid mode")
+	}
+}
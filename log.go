@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 	"sync/atomic"
 
 	"github.com/rs/zerolog"
@@ -25,9 +26,42 @@ var ProxyLogger atomic.Pointer[zerolog.Logger]
 // ReqIdCtxKey is the context.Context key for a request id.
 type ReqIdCtxKey struct{}
 
+// TraceCtxKey is the context.Context key for a *QueryTrace.
+type TraceCtxKey struct{}
+
+// maxQueryTraceMessages is the maximum number of messages recorded by a QueryTrace.
+const maxQueryTraceMessages = 100
+
+// QueryTrace records log messages of a single query regardless of the log level,
+// so the decision path of the query could be returned to the client.
+type QueryTrace struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+// Add appends msg to the trace.
+func (t *QueryTrace) Add(msg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.msgs) < maxQueryTraceMessages {
+		t.msgs = append(t.msgs, msg)
+	}
+}
+
+// Messages returns messages recorded by the trace.
+func (t *QueryTrace) Messages() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.msgs...)
+}
+
 // Log emits the logs for a particular zerolog event.
 // The request id associated with the context will be included if presents.
+// If the context has a *QueryTrace, the message is also recorded to the trace.
 func Log(ctx context.Context, e *zerolog.Event, format string, v ...any) {
+	if t, ok := ctx.Value(TraceCtxKey{}).(*QueryTrace); ok {
+		t.Add(fmt.Sprintf(format, v...))
+	}
 	id, ok := ctx.Value(ReqIdCtxKey{}).(string)
 	if !ok {
 		e.Msgf(format, v...)
@@ -0,0 +1,133 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mdnsAddr is the IPv4 multicast address of mDNS, see RFC 6762.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsTimeout is how long mdnsResolver waits for responders, if the query has no deadline.
+const mdnsTimeout = time.Second
+
+// mdnsResolver resolves queries using multicast DNS on LAN interfaces.
+//
+// Queries are sent from an ephemeral port, so responders answer them with unicast, as one-shot
+// queries of RFC 6762 section 5.1. If no responder answers before the deadline, the name is
+// considered not existing on the LAN.
+type mdnsResolver struct {
+	uc *UpstreamConfig
+}
+
+func (r *mdnsResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	srcIPs, err := mdnsSourceIPs(r.uc.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(srcIPs) == 0 {
+		return nil, errors.New("no interfaces available for mDNS")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mdnsTimeout)
+		defer cancel()
+	}
+
+	query := msg.Copy()
+	query.RecursionDesired = false
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *dns.Msg, len(srcIPs))
+	errs := make([]error, 0, len(srcIPs))
+	for _, ip := range srcIPs {
+		// Binding to the interface address makes the query sent on that interface.
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		defer conn.Close()
+		if _, err := conn.WriteTo(buf, mdnsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("sending mDNS query from %s: %w", ip, err))
+			continue
+		}
+		go readMDNSAnswer(conn, query.Id, ch)
+	}
+	if len(errs) == len(srcIPs) {
+		return nil, errors.Join(errs...)
+	}
+
+	answer := new(dns.Msg)
+	answer.SetReply(msg)
+	select {
+	case res := <-ch:
+		answer.Authoritative = true
+		answer.Answer = res.Answer
+	case <-ctx.Done():
+		answer.Rcode = dns.RcodeNameError
+	}
+	return answer, nil
+}
+
+// readMDNSAnswer reads responses from conn, sending the first one which answers query with given id to ch.
+func readMDNSAnswer(conn *net.UDPConn, id uint16, ch chan<- *dns.Msg) {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		res := new(dns.Msg)
+		if err := res.Unpack(buf[:n]); err != nil || !res.Response || res.Id != id || len(res.Answer) == 0 {
+			continue
+		}
+		for _, rr := range res.Answer {
+			// The top bit of class is the mDNS cache-flush bit, which is not meaningful to unicast DNS.
+			rr.Header().Class &^= 1 << 15
+		}
+		ch <- res
+		return
+	}
+}
+
+// mdnsSourceIPs returns IPv4 addresses which mDNS queries are sent from, one per interface. If ifaceName
+// is empty, all up multicast interfaces are used, except loopback ones.
+func mdnsSourceIPs(ifaceName string) ([]net.IP, error) {
+	var ifaces []net.Interface
+	if ifaceName != "" {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = append(ifaces, *iface)
+	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range all {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, iface)
+			}
+		}
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP.To4())
+				break
+			}
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,74 @@
+package ctrld
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_readMDNSAnswer(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	responder, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("printer.local.", dns.TypeA)
+	ch := make(chan *dns.Msg, 1)
+	go readMDNSAnswer(conn, query.Id, ch)
+
+	send := func(id uint16) {
+		res := new(dns.Msg)
+		res.SetReply(query)
+		res.Id = id
+		res.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET | 1<<15, Ttl: 10},
+			A:   net.IPv4(192, 168, 1, 10),
+		}}
+		buf, err := res.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := responder.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Response to other query must be ignored.
+	send(query.Id + 1)
+	send(query.Id)
+
+	select {
+	case res := <-ch:
+		if res.Id != query.Id {
+			t.Fatalf("unexpected response id: %d", res.Id)
+		}
+		if len(res.Answer) != 1 || res.Answer[0].Header().Class != dns.ClassINET {
+			t.Errorf("unexpected answer: %v", res.Answer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for mDNS answer")
+	}
+}
+
+func Test_mdnsSourceIPs(t *testing.T) {
+	if _, err := mdnsSourceIPs("non-existed-interface0"); err == nil {
+		t.Error("expected error for non existed interface")
+	}
+	ips, err := mdnsSourceIPs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range ips {
+		if ip.To4() == nil || ip.IsLoopback() {
+			t.Errorf("unexpected source IP: %s", ip)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package ctrld
+
+import (
+	"github.com/miekg/dns"
+)
+
+// LimitMsgSize caps the EDNS0 UDP buffer size advertised in msg to the upstream "max_msg_size".
+//
+// If the advertised size exceeds the limit, a copy of msg with the capped size is returned,
+// so the original query is kept intact for other upstreams. Otherwise, msg is returned as-is.
+func (uc *UpstreamConfig) LimitMsgSize(msg *dns.Msg) *dns.Msg {
+	if uc.MaxMsgSize <= 0 {
+		return msg
+	}
+	opt := msg.IsEdns0()
+	if opt == nil || int(opt.UDPSize()) <= uc.MaxMsgSize {
+		return msg
+	}
+	limited := msg.Copy()
+	limited.IsEdns0().SetUDPSize(uint16(uc.MaxMsgSize))
+	return limited
+}
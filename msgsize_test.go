@@ -0,0 +1,45 @@
+package ctrld
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamConfig_LimitMsgSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxMsgSize int
+		udpSize    uint16
+		want       uint16
+	}{
+		{"no limit", 0, 4096, 4096},
+		{"capped", 1232, 4096, 1232},
+		{"below limit", 1232, 1200, 1200},
+		{"no edns0", 1232, 0, 0},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			if tc.udpSize > 0 {
+				msg.SetEdns0(tc.udpSize, false)
+			}
+			uc := &UpstreamConfig{MaxMsgSize: tc.maxMsgSize}
+			got := uc.LimitMsgSize(msg)
+			var size uint16
+			if opt := got.IsEdns0(); opt != nil {
+				size = opt.UDPSize()
+			}
+			if size != tc.want {
+				t.Errorf("unexpected udp size, want: %d, got: %d", tc.want, size)
+			}
+			if opt := msg.IsEdns0(); opt != nil && opt.UDPSize() != tc.udpSize {
+				t.Errorf("original query must not be modified, got udp size: %d", opt.UDPSize())
+			}
+		})
+	}
+}
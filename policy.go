@@ -0,0 +1,90 @@
+package ctrld
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Policies returns all policies of the listener, client policies first, in the order they are
+// matched against queries.
+func (lc *ListenerConfig) Policies() []*ListenerPolicyConfig {
+	policies := make([]*ListenerPolicyConfig, 0, len(lc.ClientPolicies)+1)
+	for _, policy := range lc.ClientPolicies {
+		if policy != nil {
+			policies = append(policies, policy)
+		}
+	}
+	if lc.Policy != nil {
+		policies = append(policies, lc.Policy)
+	}
+	return policies
+}
+
+// PolicyFor returns the policy applied to queries of client with given IP and MAC address,
+// that's the first client policy matching the client, then the listener policy. It returns
+// nil if there's no such policy.
+func (lc *ListenerConfig) PolicyFor(ip netip.Addr, mac string) *ListenerPolicyConfig {
+	for _, policy := range lc.ClientPolicies {
+		if policy != nil && policy.MatchesClient(ip, mac) {
+			return policy
+		}
+	}
+	if lc.Policy != nil && lc.Policy.MatchesClient(ip, mac) {
+		return lc.Policy
+	}
+	return nil
+}
+
+// MatchesClient reports whether the policy applies to client with given IP and MAC address,
+// that's either the policy has no clients, or one of them matches the client.
+func (p *ListenerPolicyConfig) MatchesClient(ip netip.Addr, mac string) bool {
+	if len(p.Clients) == 0 {
+		return true
+	}
+	for _, pattern := range p.Clients {
+		if ClientMatches(pattern, ip, mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientMatches reports whether pattern matches client with given IP and MAC address. Pattern is
+// either an IP address, a subnet in CIDR notation, a MAC address, or a MAC address prefix ending
+// with a wildcard, like "aa:bb:cc:*". MAC addresses are case-insensitive.
+func ClientMatches(pattern string, ip netip.Addr, mac string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return len(mac) >= len(prefix) && strings.EqualFold(mac[:len(prefix)], prefix)
+	}
+	ip = ip.Unmap().WithZone("")
+	if strings.Contains(pattern, "/") {
+		p, err := netip.ParsePrefix(pattern)
+		return err == nil && ip.IsValid() && p.Contains(ip)
+	}
+	if addr, err := netip.ParseAddr(pattern); err == nil {
+		return addr.Unmap() == ip
+	}
+	return mac != "" && strings.EqualFold(pattern, mac)
+}
+
+// validClientPattern reports whether s is a valid client pattern of policies.
+func validClientPattern(s string) bool {
+	if prefix, ok := strings.CutSuffix(s, ":*"); ok {
+		// Complete the prefix to a MAC address, the parser validates its octets.
+		octets := strings.Count(prefix, ":") + 1
+		if octets >= 6 {
+			return false
+		}
+		_, err := net.ParseMAC(prefix + strings.Repeat(":00", 6-octets))
+		return err == nil
+	}
+	if _, err := netip.ParsePrefix(s); err == nil {
+		return true
+	}
+	if _, err := netip.ParseAddr(s); err == nil {
+		return true
+	}
+	hw, err := net.ParseMAC(s)
+	return err == nil && len(hw) == 6
+}
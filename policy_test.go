@@ -0,0 +1,62 @@
+package ctrld
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		ip      string
+		mac     string
+		match   bool
+	}{
+		{"ip", "192.168.1.10", "192.168.1.10", "", true},
+		{"other ip", "192.168.1.10", "192.168.1.11", "", false},
+		{"ipv4 mapped ip", "192.168.1.10", "::ffff:192.168.1.10", "", true},
+		{"subnet", "192.168.30.0/24", "192.168.30.5", "", true},
+		{"other subnet", "192.168.30.0/24", "192.168.31.5", "", false},
+		{"ipv6 subnet", "2001:db8::/32", "2001:db8::1", "", true},
+		{"mac", "aa:bb:cc:dd:ee:ff", "192.168.1.2", "AA:BB:CC:DD:EE:FF", true},
+		{"other mac", "aa:bb:cc:dd:ee:ff", "192.168.1.2", "aa:bb:cc:dd:ee:00", false},
+		{"mac prefix", "aa:bb:cc:*", "192.168.1.2", "aa:bb:cc:dd:ee:ff", true},
+		{"other mac prefix", "aa:bb:cc:*", "192.168.1.2", "aa:bb:cd:dd:ee:ff", false},
+		{"unknown mac", "aa:bb:cc:*", "192.168.1.2", "", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ip := netip.MustParseAddr(tc.ip)
+			assert.Equal(t, tc.match, ClientMatches(tc.pattern, ip, tc.mac))
+		})
+	}
+}
+
+func Test_validClientPattern(t *testing.T) {
+	for _, s := range []string{"192.168.1.10", "192.168.30.0/24", "2001:db8::/32", "aa:bb:cc:dd:ee:ff", "AA:BB:CC:*", "aa:*"} {
+		assert.True(t, validClientPattern(s), s)
+	}
+	for _, s := range []string{"", "*", ":*", "aa:bb:cc:dd:ee:ff:*", "aa:bb:zz:*", "192.168.*", "example.com"} {
+		assert.False(t, validClientPattern(s), s)
+	}
+}
+
+func TestListenerConfig_PolicyFor(t *testing.T) {
+	kids := &ListenerPolicyConfig{Name: "Kids", Clients: []string{"aa:bb:cc:*"}}
+	iot := &ListenerPolicyConfig{Name: "IoT", Clients: []string{"192.168.30.0/24"}}
+	lc := &ListenerConfig{ClientPolicies: []*ListenerPolicyConfig{kids, iot}}
+	ip := netip.MustParseAddr("192.168.30.5")
+
+	assert.Same(t, kids, lc.PolicyFor(ip, "aa:bb:cc:dd:ee:ff"))
+	assert.Same(t, iot, lc.PolicyFor(ip, ""))
+	assert.Nil(t, lc.PolicyFor(netip.MustParseAddr("192.168.1.2"), ""))
+
+	lc.Policy = &ListenerPolicyConfig{Name: "Default"}
+	assert.Same(t, lc.Policy, lc.PolicyFor(netip.MustParseAddr("192.168.1.2"), ""))
+	assert.Equal(t, []*ListenerPolicyConfig{kids, iot, lc.Policy}, lc.Policies())
+}
@@ -0,0 +1,207 @@
+package ctrld
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	ctrldnet "github.com/Control-D-Inc/ctrld/internal/net"
+)
+
+const (
+	// proxyDialTimeout is the timeout for connecting to upstream through proxy,
+	// including connecting to the proxy and the proxy handshake.
+	proxyDialTimeout = 5 * time.Second
+	// defaultTorProxy is the default SOCKS proxy of Tor, used by upstreams with Tor enabled.
+	defaultTorProxy = "socks5h://127.0.0.1:9050"
+)
+
+// parseProxyURL parses the proxy URL of an upstream, filling the default port if missing.
+// Supported schemes are "socks5" ("socks5h" is accepted as an alias), and "http" for
+// HTTP CONNECT proxies.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing proxy host")
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if port == "" {
+			port = "1080"
+		}
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), port)
+	return u, nil
+}
+
+// proxyContextDialer returns the dialer which tunnels connections to the upstream through
+// its proxy, or nil if no proxy is configured.
+//
+// The proxy is always given the upstream hostname, unless a bootstrap IP is configured, so
+// the upstream is resolved by the proxy, and no bootstrap query leaks outside the tunnel.
+func (uc *UpstreamConfig) proxyContextDialer() (proxy.ContextDialer, error) {
+	if uc.Proxy == "" {
+		return nil, nil
+	}
+	u, err := parseProxyURL(uc.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	forward := &proxyForwardDialer{timeout: uc.Timeout}
+	forward.Timeout = proxyDialTimeout
+	switch u.Scheme {
+	case "http":
+		return &httpConnectDialer{proxyAddr: u.Host, user: u.User, forward: forward}, nil
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("socks5 dialer does not support context")
+	}
+	return cd, nil
+}
+
+// dialProxy connects to addr through the upstream proxy. If a bootstrap IP is configured,
+// it is used instead of the host of addr.
+func (uc *UpstreamConfig) dialProxy(ctx context.Context, d proxy.ContextDialer, addr string) (net.Conn, error) {
+	if uc.BootstrapIP != "" {
+		_, port, _ := net.SplitHostPort(addr)
+		addr = net.JoinHostPort(uc.BootstrapIP, port)
+	}
+	ctx, cancel := context.WithTimeout(ctx, proxyDialTimeout)
+	defer cancel()
+	Log(ctx, ProxyLogger.Load().Debug(), "connecting to %s through proxy", addr)
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// endpointHost returns the host of the upstream endpoint.
+func (uc *UpstreamConfig) endpointHost() string {
+	if u, err := url.Parse(uc.Endpoint); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(uc.Endpoint); err == nil {
+		return host
+	}
+	return uc.Endpoint
+}
+
+// isOnionDomain reports whether domain is a Tor onion service.
+func isOnionDomain(domain string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(domain, ".")), ".onion")
+}
+
+// proxyForwardDialer connects to the proxy server. If the proxy is specified by hostname,
+// it is resolved using system nameservers, because the machine resolver could be ctrld itself.
+type proxyForwardDialer struct {
+	net.Dialer
+	timeout int
+}
+
+func (d *proxyForwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *proxyForwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+	ips := lookupIP(host, d.timeout, false)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("could not resolve proxy host: %s", host)
+	}
+	addrs := make([]string, len(ips))
+	for i := range ips {
+		addrs[i] = net.JoinHostPort(ips[i], port)
+	}
+	pd := &ctrldnet.ParallelDialer{Dialer: d.Dialer}
+	return pd.DialContext(ctx, network, addrs)
+}
+
+// httpConnectDialer connects to the target address through an HTTP proxy using CONNECT method.
+type httpConnectDialer struct {
+	proxyAddr string
+	user      *url.Userinfo
+	forward   proxy.ContextDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	// The response body of a successful CONNECT is the tunnel itself, so it must not be read.
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn which reads data already buffered by r first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,257 @@
+package ctrld
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TypeRESINFO is the RESINFO record type (RFC 9606), which is not known by miekg/dns yet.
+const TypeRESINFO = 261
+
+// resolverArpa is the special use domain name for discovering the designated
+// resolvers of a resolver which is known by IP address only (RFC 9462, section 4).
+const resolverArpa = "_dns.resolver.arpa."
+
+const defaultDohPath = "/dns-query"
+
+// ResolverEndpoint describes an encrypted endpoint designated by a resolver.
+type ResolverEndpoint struct {
+	Priority uint16   `json:"priority"`
+	Type     string   `json:"type"`
+	Endpoint string   `json:"endpoint"`
+	Domain   string   `json:"domain"`
+	IPs      []string `json:"ips"`
+}
+
+// ResolverInfo is the result of discovering encrypted endpoints of a resolver.
+type ResolverInfo struct {
+	// Endpoints is the list of designated encrypted endpoints, ordered by priority.
+	Endpoints []ResolverEndpoint `json:"endpoints"`
+	// Info is the resolver information published via RESINFO record, e.g:
+	// "qnamemin" => "", "exterr" => "15-17", "infourl" => "https://example.com/".
+	Info map[string]string `json:"info,omitempty"`
+}
+
+// DiscoverResolver queries the resolver at given IP for its designated encrypted
+// endpoints, using SVCB records of "_dns.resolver.arpa", then looks up the capabilities
+// published via RESINFO record of the first endpoint.
+//
+// Endpoints use the resolver IP as bootstrap IP, unless the SVCB records provide IP hints.
+// Endpoints which could not be verified are discarded, see verifyDesignatedResolver.
+func DiscoverResolver(ctx context.Context, ip string) (*ResolverInfo, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("invalid resolver ip: %q", ip)
+	}
+	server := net.JoinHostPort(ip, "53")
+	answer, err := exchangeResolverInfo(ctx, server, resolverArpa, dns.TypeSVCB)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := resolverEndpointsFromMsg(answer, ip)
+	if len(endpoints) == 0 {
+		return nil, errors.New("no designated resolver found")
+	}
+	ri := &ResolverInfo{}
+	for _, ep := range endpoints {
+		if err := verifyDesignatedResolver(ctx, ep, ip, nil); err != nil {
+			ProxyLogger.Load().Debug().Err(err).Msgf("could not verify designated resolver: %s", ep.Endpoint)
+			continue
+		}
+		ri.Endpoints = append(ri.Endpoints, ep)
+	}
+	if len(ri.Endpoints) == 0 {
+		return nil, errors.New("no verified designated resolver found")
+	}
+	if answer, err := exchangeResolverInfo(ctx, server, dns.Fqdn(ri.Endpoints[0].Domain), TypeRESINFO); err == nil {
+		ri.Info = resolverInfoFromMsg(answer)
+	} else {
+		ProxyLogger.Load().Debug().Err(err).Msgf("could not get resolver info for: %s", ri.Endpoints[0].Domain)
+	}
+	return ri, nil
+}
+
+// NetworkResolverInfo is the result of discovering encrypted endpoints of a network resolver.
+type NetworkResolverInfo struct {
+	IP    string        `json:"ip"`
+	Info  *ResolverInfo `json:"info,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// DiscoverNetworkResolvers discovers the designated encrypted endpoints of the resolvers
+// provided by the network, which are the OS nameservers. Loopback nameservers are skipped,
+// since they are local forwarders, like ctrld itself.
+func DiscoverNetworkResolvers(ctx context.Context) []*NetworkResolverInfo {
+	var (
+		wg      sync.WaitGroup
+		results []*NetworkResolverInfo
+	)
+	for _, ns := range nameservers() {
+		host, _, _ := net.SplitHostPort(ns)
+		if ip := net.ParseIP(host); ip == nil || ip.IsLoopback() {
+			continue
+		}
+		nri := &NetworkResolverInfo{IP: host}
+		results = append(results, nri)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ri, err := DiscoverResolver(ctx, nri.IP)
+			if err != nil {
+				nri.Error = err.Error()
+				return
+			}
+			nri.Info = ri
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func exchangeResolverInfo(ctx context.Context, server, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.SetEdns0(4096, false)
+	c := &dns.Client{Timeout: 2 * time.Second}
+	answer, _, err := c.ExchangeContext(ctx, msg, server)
+	if err == nil && answer.Truncated {
+		c.Net = "tcp"
+		answer, _, err = c.ExchangeContext(ctx, msg, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if answer.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[answer.Rcode])
+	}
+	return answer, nil
+}
+
+// resolverEndpointsFromMsg returns the encrypted endpoints found in SVCB records of answer.
+// Alias mode records and records with unsupported protocols are ignored.
+func resolverEndpointsFromMsg(answer *dns.Msg, ip string) []ResolverEndpoint {
+	var endpoints []ResolverEndpoint
+	for _, rr := range answer.Answer {
+		svcb, ok := rr.(*dns.SVCB)
+		if !ok || svcb.Priority == 0 || svcb.Target == "." {
+			continue
+		}
+		host := strings.TrimSuffix(svcb.Target, ".")
+		var (
+			alpn    []string
+			port    string
+			dohPath = defaultDohPath
+			ips     []string
+		)
+		for _, kv := range svcb.Value {
+			switch v := kv.(type) {
+			case *dns.SVCBAlpn:
+				alpn = v.Alpn
+			case *dns.SVCBPort:
+				port = strconv.Itoa(int(v.Port))
+			case *dns.SVCBDoHPath:
+				if p, _, _ := strings.Cut(v.Template, "{"); p != "" {
+					dohPath = p
+				}
+			case *dns.SVCBIPv4Hint:
+				for _, hint := range v.Hint {
+					ips = append(ips, hint.String())
+				}
+			case *dns.SVCBIPv6Hint:
+				for _, hint := range v.Hint {
+					ips = append(ips, hint.String())
+				}
+			}
+		}
+		if len(ips) == 0 {
+			ips = []string{ip}
+		}
+		for _, proto := range alpn {
+			typ := resolverTypeFromAlpn(proto)
+			if typ == "" {
+				continue
+			}
+			p := port
+			if p == "" {
+				p = defaultPortFor(typ)
+			}
+			hostPort := net.JoinHostPort(host, p)
+			endpoint := hostPort
+			switch typ {
+			case ResolverTypeDOH, ResolverTypeDOH3:
+				if p == "443" {
+					hostPort = host
+				}
+				endpoint = (&url.URL{Scheme: "https", Host: hostPort, Path: dohPath}).String()
+			}
+			endpoints = append(endpoints, ResolverEndpoint{
+				Priority: svcb.Priority,
+				Type:     typ,
+				Endpoint: endpoint,
+				Domain:   host,
+				IPs:      ips,
+			})
+		}
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].Priority < endpoints[j].Priority
+	})
+	return endpoints
+}
+
+// resolverTypeFromAlpn returns the resolver type for given ALPN protocol id,
+// or empty string if the protocol is not supported.
+func resolverTypeFromAlpn(alpn string) string {
+	switch alpn {
+	case "h2", "http/1.1":
+		return ResolverTypeDOH
+	case "h3":
+		return ResolverTypeDOH3
+	case "dot":
+		return ResolverTypeDOT
+	case "doq":
+		return ResolverTypeDOQ
+	}
+	return ""
+}
+
+// resolverInfoFromMsg parses RESINFO records of answer. The RDATA of RESINFO has the
+// same format as TXT, each character string is a key or a key=value pair.
+func resolverInfoFromMsg(answer *dns.Msg) map[string]string {
+	info := make(map[string]string)
+	for _, rr := range answer.Answer {
+		if rr.Header().Rrtype != TypeRESINFO {
+			continue
+		}
+		rfc3597, ok := rr.(*dns.RFC3597)
+		if !ok {
+			continue
+		}
+		rdata, err := hex.DecodeString(rfc3597.Rdata)
+		if err != nil {
+			continue
+		}
+		for len(rdata) > 0 {
+			n := int(rdata[0])
+			if n+1 > len(rdata) {
+				break
+			}
+			key, value, _ := strings.Cut(string(rdata[1:n+1]), "=")
+			if key != "" {
+				info[strings.ToLower(key)] = value
+			}
+			rdata = rdata[n+1:]
+		}
+	}
+	return info
+}
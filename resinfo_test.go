@@ -0,0 +1,52 @@
+package ctrld
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_resolverEndpointsFromMsg(t *testing.T) {
+	answer := new(dns.Msg)
+	answer.SetQuestion(resolverArpa, dns.TypeSVCB)
+	for _, s := range []string{
+		`_dns.resolver.arpa. 300 IN SVCB 0 dns.example.net.`,
+		`_dns.resolver.arpa. 300 IN SVCB 2 dns.example.net. alpn=dot,doq port=8853`,
+		`_dns.resolver.arpa. 300 IN SVCB 1 dns.example.net. alpn=h2,foo ipv4hint=192.0.2.1 dohpath=/q{?dns}`,
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer.Answer = append(answer.Answer, rr)
+	}
+
+	want := []ResolverEndpoint{
+		{Priority: 1, Type: ResolverTypeDOH, Endpoint: "https://dns.example.net/q", Domain: "dns.example.net", IPs: []string{"192.0.2.1"}},
+		{Priority: 2, Type: ResolverTypeDOT, Endpoint: "dns.example.net:8853", Domain: "dns.example.net", IPs: []string{"192.168.1.1"}},
+		{Priority: 2, Type: ResolverTypeDOQ, Endpoint: "dns.example.net:8853", Domain: "dns.example.net", IPs: []string{"192.168.1.1"}},
+	}
+	if got := resolverEndpointsFromMsg(answer, "192.168.1.1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected endpoints\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
+
+func Test_resolverInfoFromMsg(t *testing.T) {
+	var rdata []byte
+	for _, s := range []string{"qnamemin", "exterr=15-17", "infourl=https://example.net/"} {
+		rdata = append(rdata, byte(len(s)))
+		rdata = append(rdata, s...)
+	}
+	answer := new(dns.Msg)
+	answer.Answer = append(answer.Answer, &dns.RFC3597{
+		Hdr:   dns.RR_Header{Name: "dns.example.net.", Rrtype: TypeRESINFO, Class: dns.ClassINET},
+		Rdata: hex.EncodeToString(rdata),
+	})
+
+	want := map[string]string{"qnamemin": "", "exterr": "15-17", "infourl": "https://example.net/"}
+	if got := resolverInfoFromMsg(answer); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected resolver info, want: %v, got: %v", want, got)
+	}
+}
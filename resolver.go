@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,16 +19,24 @@ const (
 	ResolverTypeDOH = "doh"
 	// ResolverTypeDOH3 specifies DoH3 resolver.
 	ResolverTypeDOH3 = "doh3"
+	// ResolverTypeDOHJSON specifies DoH resolver using JSON API (application/dns-json).
+	ResolverTypeDOHJSON = "dohjson"
 	// ResolverTypeDOT specifies DoT resolver.
 	ResolverTypeDOT = "dot"
 	// ResolverTypeDOQ specifies DoQ resolver.
 	ResolverTypeDOQ = "doq"
+	// ResolverTypeDNSCrypt specifies DNSCrypt resolver.
+	ResolverTypeDNSCrypt = "dnscrypt"
 	// ResolverTypeOS specifies OS resolver.
 	ResolverTypeOS = "os"
 	// ResolverTypeLegacy specifies legacy resolver.
 	ResolverTypeLegacy = "legacy"
 	// ResolverTypePrivate is like ResolverTypeOS, but use for local resolver only.
 	ResolverTypePrivate = "private"
+	// ResolverTypeUnix specifies resolver listening on a unix domain socket.
+	ResolverTypeUnix = "unix"
+	// ResolverTypeMDNS specifies multicast DNS resolver, for resolving names in LAN.
+	ResolverTypeMDNS = "mdns"
 )
 
 const bootstrapDNS = "76.76.2.22"
@@ -57,16 +66,24 @@ func NewResolver(uc *UpstreamConfig) (Resolver, error) {
 	switch typ {
 	case ResolverTypeDOH, ResolverTypeDOH3:
 		return newDohResolver(uc), nil
+	case ResolverTypeDOHJSON:
+		return &dohJSONResolver{uc: uc}, nil
 	case ResolverTypeDOT:
 		return &dotResolver{uc: uc}, nil
 	case ResolverTypeDOQ:
 		return &doqResolver{uc: uc}, nil
+	case ResolverTypeDNSCrypt:
+		return &dnscryptResolver{uc: uc}, nil
 	case ResolverTypeOS:
 		return or, nil
 	case ResolverTypeLegacy:
 		return &legacyResolver{uc: uc}, nil
 	case ResolverTypePrivate:
 		return NewPrivateResolver(), nil
+	case ResolverTypeUnix:
+		return &unixResolver{uc: uc}, nil
+	case ResolverTypeMDNS:
+		return &mdnsResolver{uc: uc}, nil
 	}
 	return nil, fmt.Errorf("%w: %s", errUnknownResolver, typ)
 }
@@ -125,7 +142,7 @@ type legacyResolver struct {
 
 func (r *legacyResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	// See comment in (*dotResolver).resolve method.
-	dialer := newDialer(net.JoinHostPort(bootstrapDNS, "53"))
+	dialer := r.uc.bootstrapDialer()
 	dnsTyp := uint16(0)
 	if msg != nil && len(msg.Question) > 0 {
 		dnsTyp = msg.Question[0].Qtype
@@ -135,17 +152,43 @@ func (r *legacyResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, e
 		Net:    udpNet,
 		Dialer: dialer,
 	}
+	if r.uc.TCPOnly {
+		// "udp4" -> "tcp4", and so on.
+		dnsClient.Net = "tcp" + strings.TrimPrefix(udpNet, "udp")
+	}
 	endpoint := r.uc.Endpoint
 	if r.uc.BootstrapIP != "" {
 		dnsClient.Net = "udp"
+		if r.uc.TCPOnly {
+			dnsClient.Net = "tcp"
+		}
 		_, port, _ := net.SplitHostPort(endpoint)
 		endpoint = net.JoinHostPort(r.uc.BootstrapIP, port)
 	}
+	if r.uc.IPProtocol == "tcp" {
+		network := strings.Replace(dnsClient.Net, "udp", "tcp", 1)
+		p := r.uc.tcpPipeline(network+"://"+endpoint, func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, endpoint)
+		})
+		return p.Exchange(ctx, msg)
+	}
 
 	answer, _, err := dnsClient.ExchangeContext(ctx, msg, endpoint)
 	return answer, err
 }
 
+// unixResolver sends queries to a local resolver listening on a unix domain socket,
+// using DNS over TCP framing.
+type unixResolver struct {
+	uc *UpstreamConfig
+}
+
+func (r *unixResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	dnsClient := &dns.Client{Net: "unix"}
+	answer, _, err := dnsClient.ExchangeContext(ctx, msg, r.uc.Endpoint)
+	return answer, err
+}
+
 type dummyResolver struct{}
 
 func (d dummyResolver) Resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
@@ -166,6 +209,11 @@ func lookupIP(domain string, timeout int, withBootstrapDNS bool) (ips []string)
 		resolver.nameservers = append([]string{net.JoinHostPort(bootstrapDNS, "53")}, resolver.nameservers...)
 	}
 	ProxyLogger.Load().Debug().Msgf("resolving %q using bootstrap DNS %q", domain, resolver.nameservers)
+	return lookupIPWithResolver(domain, timeout, resolver)
+}
+
+// lookupIPWithResolver returns all A, AAAA records of domain, resolved using resolver.
+func lookupIPWithResolver(domain string, timeout int, resolver Resolver) (ips []string) {
 	timeoutMs := 2000
 	if timeout > 0 && timeout < timeoutMs {
 		timeoutMs = timeout
@@ -283,6 +331,34 @@ func NewPrivateResolver() Resolver {
 	return NewResolverWithNameserver(nss)
 }
 
+// NewSystemResolver returns an OS resolver, which uses the current nameservers of the system,
+// usually provided by DHCP, excluding:
+//
+// - Loopback addresses.
+// - Local interfaces addresses.
+//
+// Unlike the OS resolver returned by NewResolver, the nameservers are re-discovered on every
+// call, so nameservers which become available after ctrld started are included. If there is
+// no usable nameserver, the returned resolver always fails.
+func NewSystemResolver() Resolver {
+	nss := nameservers()
+	localAddrs := Rfc1918Addresses()
+	n := 0
+	for _, ns := range nss {
+		host, _, _ := net.SplitHostPort(ns)
+		// The nameserver may be ctrld itself, or a local forwarder which uses ctrld as upstream.
+		if sliceContains(localAddrs, host) {
+			continue
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			continue
+		}
+		nss[n] = ns
+		n++
+	}
+	return &osResolver{nameservers: nss[:n]}
+}
+
 // NewResolverWithNameserver returns an OS resolver which uses the given nameservers
 // for resolving DNS queries. If nameservers is empty, a dummy resolver will be returned.
 //
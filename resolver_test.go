@@ -2,6 +2,9 @@ package ctrld
 
 import (
 	"context"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -37,6 +40,7 @@ func Test_upstreamTypeFromEndpoint(t *testing.T) {
 		{"doh", "https://freedns.controld.com/p2", ResolverTypeDOH},
 		{"doq", "quic://p2.freedns.controld.com", ResolverTypeDOQ},
 		{"dot", "p2.freedns.controld.com", ResolverTypeDOT},
+		{"dnscrypt", "sdns://AQcAAAAAAAAA", ResolverTypeDNSCrypt},
 		{"legacy", "8.8.8.8:53", ResolverTypeLegacy},
 		{"legacy ipv6", "[2404:6800:4005:809::200e]:53", ResolverTypeLegacy},
 	}
@@ -51,3 +55,52 @@ func Test_upstreamTypeFromEndpoint(t *testing.T) {
 		})
 	}
 }
+
+func Test_unixResolver_Resolve(t *testing.T) {
+	// Use a short directory, unix socket paths are limited to ~100 bytes.
+	dir, err := os.MkdirTemp("", "ctrld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "dns.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix socket is not supported: %v", err)
+	}
+	srv := &dns.Server{
+		Listener: ln,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(msg)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	uc := &UpstreamConfig{Type: ResolverTypeUnix, Endpoint: sock}
+	uc.Init()
+	if uc.Endpoint != sock {
+		t.Fatalf("unix socket endpoint must not be changed, got: %s", uc.Endpoint)
+	}
+	r, err := NewResolver(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	answer, err := r.Resolve(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Answer) != 1 || answer.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("unexpected answer: %v", answer)
+	}
+}
@@ -0,0 +1,68 @@
+package ctrld
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RewriteQuery rewrites the question name of msg according to the upstream "rewrite" rules.
+//
+// If the question name matches a rule, a rewritten copy of msg is returned, along with a function
+// which un-rewrites the answer from upstream, so clients see names from their original query.
+// Otherwise, msg is returned as-is with a nil function.
+func (uc *UpstreamConfig) RewriteQuery(msg *dns.Msg) (*dns.Msg, func(answer *dns.Msg)) {
+	if len(uc.Rewrite) == 0 || len(msg.Question) == 0 {
+		return msg, nil
+	}
+	from, to := uc.rewriteRule(msg.Question[0].Name)
+	if from == "" {
+		return msg, nil
+	}
+	rewritten := msg.Copy()
+	rewritten.Question[0].Name = replaceZone(rewritten.Question[0].Name, from, to)
+	restore := func(answer *dns.Msg) {
+		if answer == nil {
+			return
+		}
+		answer.Question = append([]dns.Question(nil), msg.Question...)
+		for _, rrs := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+			for _, rr := range rrs {
+				hdr := rr.Header()
+				hdr.Name = replaceZone(hdr.Name, to, from)
+				switch rr := rr.(type) {
+				case *dns.CNAME:
+					rr.Target = replaceZone(rr.Target, to, from)
+				case *dns.DNAME:
+					rr.Target = replaceZone(rr.Target, to, from)
+				}
+			}
+		}
+	}
+	return rewritten, restore
+}
+
+// rewriteRule returns the longest zone in rewrite rules which contains name,
+// and the zone it is rewritten to, both in canonical form.
+func (uc *UpstreamConfig) rewriteRule(name string) (string, string) {
+	name = dns.CanonicalName(name)
+	var from, to string
+	for src, dst := range uc.Rewrite {
+		src = dns.CanonicalName(src)
+		if !dns.IsSubDomain(src, name) || len(src) <= len(from) {
+			continue
+		}
+		from, to = src, dns.CanonicalName(dst)
+	}
+	return from, to
+}
+
+// replaceZone replaces zone "from" in name with zone "to". If name is not in zone "from",
+// it is returned as-is. Both from and to must be in canonical form.
+func replaceZone(name, from, to string) string {
+	canonical := dns.CanonicalName(name)
+	if !dns.IsSubDomain(from, canonical) {
+		return name
+	}
+	return strings.TrimSuffix(canonical, from) + to
+}
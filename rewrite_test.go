@@ -0,0 +1,68 @@
+package ctrld
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamConfig_RewriteQuery(t *testing.T) {
+	uc := &UpstreamConfig{
+		Rewrite: map[string]string{
+			"internal.example.com":     "example.internal.corp",
+			"foo.internal.example.com": "foo.corp",
+		},
+	}
+	tests := []struct {
+		name      string
+		qname     string
+		rewritten string
+	}{
+		{"zone apex", "internal.example.com.", "example.internal.corp."},
+		{"sub domain", "host.internal.example.com.", "host.example.internal.corp."},
+		{"case insensitive", "Host.Internal.Example.Com.", "host.example.internal.corp."},
+		{"longest zone match", "bar.foo.internal.example.com.", "bar.foo.corp."},
+		{"not matched", "example.com.", ""},
+		{"not matched suffix", "myinternal.example.com.", ""},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			msg := new(dns.Msg)
+			msg.SetQuestion(tc.qname, dns.TypeA)
+			rewritten, restore := uc.RewriteQuery(msg)
+			if tc.rewritten == "" {
+				if restore != nil || rewritten != msg {
+					t.Fatalf("unexpected rewrite: %s", rewritten.Question[0].Name)
+				}
+				return
+			}
+			if got := rewritten.Question[0].Name; got != tc.rewritten {
+				t.Fatalf("unexpected rewritten name, want: %s, got: %s", tc.rewritten, got)
+			}
+			if msg.Question[0].Name != tc.qname {
+				t.Fatalf("original query must not be changed, got: %s", msg.Question[0].Name)
+			}
+
+			answer := new(dns.Msg)
+			answer.SetReply(rewritten)
+			answer.Answer = append(answer.Answer,
+				&dns.CNAME{Hdr: dns.RR_Header{Name: tc.rewritten, Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "www." + tc.rewritten},
+				&dns.A{Hdr: dns.RR_Header{Name: "www." + tc.rewritten, Rrtype: dns.TypeA, Class: dns.ClassINET}},
+			)
+			restore(answer)
+			if got := answer.Question[0].Name; got != tc.qname {
+				t.Errorf("unexpected question name, want: %s, got: %s", tc.qname, got)
+			}
+			cname := answer.Answer[0].(*dns.CNAME)
+			if want := dns.CanonicalName(tc.qname); cname.Hdr.Name != want {
+				t.Errorf("unexpected cname owner, want: %s, got: %s", want, cname.Hdr.Name)
+			}
+			if want := "www." + dns.CanonicalName(tc.qname); cname.Target != want || answer.Answer[1].Header().Name != want {
+				t.Errorf("unexpected cname target, want: %s, got: %s", want, cname.Target)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package ctrld
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// RegexRulePrefix is the prefix of policy rules matching domains with a regular expression,
+// e.g: "re:^ads?[0-9]*\.".
+const RegexRulePrefix = "re:"
+
+const (
+	// MaxRegexRules is the maximum number of regex rules of a policy. Unlike other rules,
+	// every regex rule is evaluated against queries which do not match earlier rules.
+	MaxRegexRules = 100
+	// MaxRegexRuleLength is the maximum length of a regex rule expression.
+	MaxRegexRuleLength = 256
+	// maxRegexRuleInsts is the maximum number of instructions of a compiled regex rule. Go regular
+	// expressions are matched in linear time of the input, this caps the cost per input byte.
+	maxRegexRuleInsts = 2000
+)
+
+// RegexRule returns the compiled regular expression of source, or nil if source is not a valid
+// regex rule. Domains are matched in canonical form: lower case, without the trailing dot.
+//
+// The expression is compiled on every call, use RuleIndex.RegexRule for rules of a policy.
+func RegexRule(source string) *regexp.Regexp {
+	expr, ok := strings.CutPrefix(source, RegexRulePrefix)
+	if !ok {
+		return nil
+	}
+	re, err := compileRegexRule(expr)
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// compileRegexRule compiles expr, returning an error if it is invalid or too complex.
+func compileRegexRule(expr string) (*regexp.Regexp, error) {
+	if len(expr) > MaxRegexRuleLength {
+		return nil, fmt.Errorf("regex is longer than %d characters", MaxRegexRuleLength)
+	}
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	if len(prog.Inst) > maxRegexRuleInsts {
+		return nil, fmt.Errorf("regex is too complex: %d instructions, maximum: %d", len(prog.Inst), maxRegexRuleInsts)
+	}
+	return regexp.Compile(expr)
+}
+
+// RuleIndex indexes policy rules, so the first rule matching a domain is found in O(labels)
+// time for exact and "*.<domain>" rules, whatever the number of rules. Other rules, which
+// can't be indexed, are evaluated in order, until a rule before them matches.
+type RuleIndex struct {
+	// exact maps domains to the index of the first rule matching them exactly.
+	exact map[string]int
+	// subdomain maps domains to the index of the first "*.<domain>" rule.
+	subdomain map[string]int
+	// other is the sorted indexes of rules which must be evaluated one by one.
+	other []int
+	// regexps maps regex rule sources to their compiled expressions. They are owned by the
+	// policy, so they are released with it when config is reloaded.
+	regexps map[string]*regexp.Regexp
+}
+
+// NewRuleIndex returns a RuleIndex for rules.
+func NewRuleIndex(rules []Rule) *RuleIndex {
+	ri := &RuleIndex{
+		exact:     make(map[string]int),
+		subdomain: make(map[string]int),
+		regexps:   make(map[string]*regexp.Regexp),
+	}
+	for i, rule := range rules {
+		indexed := true
+		for source := range rule {
+			switch {
+			case strings.HasPrefix(source, RegexRulePrefix):
+				indexed = false
+				if re := RegexRule(source); re != nil {
+					ri.regexps[source] = re
+				}
+			case !strings.Contains(source, "*"):
+				if _, ok := ri.exact[source]; !ok {
+					ri.exact[source] = i
+				}
+			default:
+				parent, ok := strings.CutPrefix(source, "*.")
+				if !ok || parent == "" || strings.Contains(parent, "*") {
+					indexed = false
+					continue
+				}
+				if _, ok := ri.subdomain[parent]; !ok {
+					ri.subdomain[parent] = i
+				}
+			}
+		}
+		if !indexed {
+			ri.other = append(ri.other, i)
+		}
+	}
+	return ri
+}
+
+// RegexRule is like the RegexRule function, but returns the expression compiled when ri was
+// built if source is one of its rules, so matching queries does not compile it again.
+func (ri *RuleIndex) RegexRule(source string) *regexp.Regexp {
+	if ri != nil {
+		if re, ok := ri.regexps[source]; ok {
+			return re
+		}
+	}
+	return RegexRule(source)
+}
+
+// Match returns the index of the first rule of rules matching domain, or -1 if there's none.
+// rules must be the ones ri was built from, match reports whether a rule source which is not
+// indexed matches domain. A nil RuleIndex evaluates all rules in order.
+func (ri *RuleIndex) Match(rules []Rule, domain string, match func(source, domain string) bool) int {
+	if ri == nil {
+		return MatchRules(rules, domain, match)
+	}
+	first := -1
+	if i, ok := ri.exact[domain]; ok {
+		first = i
+	}
+	for parent := domain; ; {
+		_, after, ok := strings.Cut(parent, ".")
+		if !ok {
+			break
+		}
+		parent = after
+		if i, ok := ri.subdomain[parent]; ok && (first == -1 || i < first) {
+			first = i
+		}
+	}
+	for _, i := range ri.other {
+		if first != -1 && i > first {
+			break
+		}
+		if MatchRules(rules[i:i+1], domain, match) != -1 {
+			return i
+		}
+	}
+	return first
+}
+
+// MatchRules returns the index of the first rule of rules matching domain, or -1 if there's none,
+// evaluating rules one by one.
+func MatchRules(rules []Rule, domain string, match func(source, domain string) bool) int {
+	for i, rule := range rules {
+		for source := range rule {
+			if match(source, domain) {
+				return i
+			}
+		}
+	}
+	return -1
+}
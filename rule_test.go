@@ -0,0 +1,145 @@
+package ctrld
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegexRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		domain  string
+		valid   bool
+		matches bool
+	}{
+		{"match", `re:^ads?[0-9]*\.`, "ads1.example.com", true, true},
+		{"no match", `re:^ads?[0-9]*\.`, "www.ads.example.com", true, false},
+		{"not a regex rule", "*.example.com", "www.example.com", false, false},
+		{"invalid", "re:[a-", "a", false, false},
+		{"too long", "re:" + strings.Repeat("a", MaxRegexRuleLength+1), "a", false, false},
+		{"too complex", "re:(a{1,100}){1,100}", "a", false, false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			re := RegexRule(tc.source)
+			if !tc.valid {
+				assert.Nil(t, re)
+				return
+			}
+			if assert.NotNil(t, re) {
+				assert.Equal(t, tc.matches, re.MatchString(tc.domain))
+				ri := NewRuleIndex([]Rule{{tc.source: {"upstream.0"}}})
+				assert.Same(t, ri.RegexRule(tc.source), ri.RegexRule(tc.source))
+			}
+		})
+	}
+}
+
+// testRuleMatches mirrors policy rule matching of ctrld cli.
+func testRuleMatches(source, domain string) bool {
+	if re := RegexRule(source); re != nil {
+		return re.MatchString(domain)
+	}
+	prefix, suffix, ok := strings.Cut(source, "*")
+	if !ok {
+		return source == domain
+	}
+	if strings.Contains(suffix, "*") || prefix == "" && suffix == "" {
+		return false
+	}
+	return strings.HasPrefix(domain, prefix) && strings.HasSuffix(domain, suffix)
+}
+
+func TestRuleIndex_Match(t *testing.T) {
+	rules := []Rule{
+		{"*.ads.example.com": {"upstream.0"}},
+		{"www.example.com": {"upstream.1"}},
+		{`re:^ads?[0-9]*\.`: {"upstream.2"}},
+		{"*.example.com": {"upstream.3"}},
+		{"ads.example.com": {"upstream.4"}},
+		{"tracker.*": {"upstream.5"}},
+		{"*.org": {"upstream.6"}},
+		{"www.example.com": {"upstream.7"}},
+		{"*example.net": {"upstream.8"}},
+	}
+	tests := []struct {
+		domain string
+		want   int
+	}{
+		{"a.ads.example.com", 0},
+		{"www.example.com", 1},
+		{"ads1.example.com", 2},
+		{"ad.example.org", 2},
+		{"mail.example.com", 3},
+		{"ads.example.com", 2},
+		{"tracker.example.org", 5},
+		{"www.example.org", 6},
+		{"badexample.net", 8},
+		{"example.com", -1},
+		{"com", -1},
+		{"", -1},
+	}
+	ri := NewRuleIndex(rules)
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.domain, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, ri.Match(rules, tc.domain, testRuleMatches))
+			var nilIndex *RuleIndex
+			assert.Equal(t, tc.want, nilIndex.Match(rules, tc.domain, testRuleMatches))
+		})
+	}
+}
+
+// benchmarkRules returns n exact and "*.<domain>" rules.
+func benchmarkRules(n int) []Rule {
+	rules := make([]Rule, n)
+	for i := range rules {
+		source := fmt.Sprintf("domain%d.example%d.com", i, i%100)
+		if i%2 == 0 {
+			source = "*." + source
+		}
+		rules[i] = Rule{source: {"upstream.0"}}
+	}
+	return rules
+}
+
+func BenchmarkNewRuleIndex(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		rules := benchmarkRules(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				NewRuleIndex(rules)
+			}
+		})
+	}
+}
+
+func BenchmarkRuleIndex_Match(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		rules := benchmarkRules(n)
+		ri := NewRuleIndex(rules)
+		// Domain does not match any rules, the worst case of linear matching.
+		domain := "www.domain.example.com"
+		b.Run(fmt.Sprintf("index/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ri.Match(rules, domain, testRuleMatches)
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			var linear *RuleIndex
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				linear.Match(rules, domain, testRuleMatches)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package ctrld
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// scheduleDays maps days of ScheduleConfig to weekdays.
+var scheduleDays = map[time.Weekday]string{
+	time.Sunday:    "sun",
+	time.Monday:    "mon",
+	time.Tuesday:   "tue",
+	time.Wednesday: "wed",
+	time.Thursday:  "thu",
+	time.Friday:    "fri",
+	time.Saturday:  "sat",
+}
+
+// locations caches loaded timezones by name.
+var locations sync.Map
+
+// Location returns the timezone of schedules, or the local timezone if Timezone is not set or invalid.
+func (sc *ServiceConfig) Location() *time.Location {
+	if sc.Timezone == "" {
+		return time.Local
+	}
+	if loc, ok := locations.Load(sc.Timezone); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(sc.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	locations.Store(sc.Timezone, loc)
+	return loc
+}
+
+// RuleActive reports whether policy rule source is active at t, that's either it is not in any
+// schedules, or one of its schedules is active.
+func (c *Config) RuleActive(source string, t time.Time) bool {
+	scheduled := false
+	for _, s := range c.Schedule {
+		if s == nil || !slices.Contains(s.Rules, source) {
+			continue
+		}
+		if !scheduled {
+			t = t.In(c.Service.Location())
+			scheduled = true
+		}
+		if s.Active(t) {
+			return true
+		}
+	}
+	return !scheduled
+}
+
+// Active reports whether t is within the schedule window. t must be in the schedule timezone.
+func (s *ScheduleConfig) Active(t time.Time) bool {
+	// Config validation ensures that both start and end are either valid or empty.
+	start, _ := parseClock(s.Start)
+	end, _ := parseClock(s.End)
+	now := t.Hour()*60 + t.Minute()
+	switch {
+	case start == end:
+		return s.onDay(t.Weekday())
+	case start < end:
+		return start <= now && now < end && s.onDay(t.Weekday())
+	default:
+		// The window spans midnight, early hours belong to the window of the day before.
+		return now >= start && s.onDay(t.Weekday()) || now < end && s.onDay((t.Weekday()+6)%7)
+	}
+}
+
+// onDay reports whether the schedule window starts on day d.
+func (s *ScheduleConfig) onDay(d time.Weekday) bool {
+	return len(s.Days) == 0 || slices.Contains(s.Days, scheduleDays[d])
+}
+
+// parseClock parses "HH:MM" time of day, returning the number of minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
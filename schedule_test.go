@@ -0,0 +1,76 @@
+package ctrld
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleConfig_Active(t *testing.T) {
+	weekNights := &ScheduleConfig{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "22:00", End: "07:00"}
+	schoolHours := &ScheduleConfig{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "15:30"}
+	weekend := &ScheduleConfig{Days: []string{"sat", "sun"}}
+	everyNight := &ScheduleConfig{Start: "23:00", End: "06:00"}
+	tests := []struct {
+		name     string
+		schedule *ScheduleConfig
+		time     string
+		active   bool
+	}{
+		{"week night start", weekNights, "2024-01-01T22:00", true},
+		{"week night before start", weekNights, "2024-01-01T21:59", false},
+		{"week night after midnight", weekNights, "2024-01-02T03:00", true},
+		{"week night end", weekNights, "2024-01-02T07:00", false},
+		{"friday night spans into saturday", weekNights, "2024-01-06T06:59", true},
+		{"saturday night", weekNights, "2024-01-06T23:00", false},
+		{"sunday night spans into monday", weekNights, "2024-01-08T03:00", false},
+		{"school hours", schoolHours, "2024-01-03T10:00", true},
+		{"after school", schoolHours, "2024-01-03T15:30", false},
+		{"school hours on weekend", schoolHours, "2024-01-06T10:00", false},
+		{"weekend", weekend, "2024-01-07T12:00", true},
+		{"weekend on monday", weekend, "2024-01-08T00:00", false},
+		{"every night", everyNight, "2024-01-06T05:00", true},
+		{"every night during the day", everyNight, "2024-01-06T12:00", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			now, err := time.Parse("2006-01-02T15:04", tc.time)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tc.active, tc.schedule.Active(now))
+		})
+	}
+}
+
+func TestConfig_RuleActive(t *testing.T) {
+	cfg := &Config{
+		Service: ServiceConfig{Timezone: "Asia/Ho_Chi_Minh"},
+		Schedule: map[string]*ScheduleConfig{
+			"morning": {Start: "06:00", End: "12:00", Rules: []string{"*.roblox.com", "*.fortnite.com"}},
+			"evening": {Start: "18:00", End: "22:00", Rules: []string{"*.roblox.com"}},
+		},
+	}
+	// 01:00 UTC is 08:00 in Asia/Ho_Chi_Minh.
+	morning := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	afternoon := morning.Add(7 * time.Hour)
+	evening := morning.Add(12 * time.Hour)
+
+	assert.True(t, cfg.RuleActive("*.roblox.com", morning))
+	assert.False(t, cfg.RuleActive("*.roblox.com", afternoon))
+	assert.True(t, cfg.RuleActive("*.roblox.com", evening))
+	assert.True(t, cfg.RuleActive("*.fortnite.com", morning))
+	assert.False(t, cfg.RuleActive("*.fortnite.com", evening))
+	assert.True(t, cfg.RuleActive("*.example.com", afternoon))
+}
+
+func TestServiceConfig_Location(t *testing.T) {
+	assert.Equal(t, time.Local, (&ServiceConfig{}).Location())
+	assert.Equal(t, time.Local, (&ServiceConfig{Timezone: "Mars/Olympus_Mons"}).Location())
+	sc := &ServiceConfig{Timezone: "Europe/Berlin"}
+	assert.Equal(t, "Europe/Berlin", sc.Location().String())
+	assert.Same(t, sc.Location(), sc.Location())
+}
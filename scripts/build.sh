@@ -96,8 +96,8 @@ case $1 in
       goos=${os_arch%/*}
       goarch=${os_arch#*/}
 
-      case goarch in
-        arm)
+      case $os_arch in
+        linux/arm | freebsd/arm)
 
           echo "Building $goos/$goarch ARM5..."
           build "$goos" "$goarch" "5"
@@ -0,0 +1,190 @@
+package ctrld
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// doqSessionCacheSize is the maximum number of TLS sessions kept for DoQ upstreams.
+	doqSessionCacheSize = 64
+	// doh3SessionCacheSize is the maximum number of TLS sessions kept for DoH3 upstreams.
+	doh3SessionCacheSize = 64
+	// sessionCacheFlushDelay is the delay between a session change and writing the cache to file,
+	// so sessions changed in a burst of new connections are written once.
+	sessionCacheFlushDelay = time.Minute
+)
+
+// doqSessionCache is the TLS client session cache shared by all DoQ upstreams. Sessions are keyed
+// by server name, so upstreams with the same server share the same sessions.
+var doqSessionCache = newSessionCache(doqSessionCacheSize)
+
+// doh3SessionCache is the TLS client session cache shared by all DoH3 upstreams, it is not persisted.
+var doh3SessionCache = newSessionCache(doh3SessionCacheSize)
+
+// LoadDoQSessionCache loads DoQ TLS sessions saved by previous runs of ctrld from file at path,
+// and keeps the file updated when sessions change, so DoQ upstreams could resume sessions, and
+// send queries as 0-RTT early data right after ctrld (re)started.
+func LoadDoQSessionCache(path string) error {
+	return doqSessionCache.setPath(path)
+}
+
+// FlushDoQSessionCache writes DoQ TLS sessions to file, if persistence is enabled.
+func FlushDoQSessionCache() error {
+	return doqSessionCache.flush()
+}
+
+// persistedSession is a TLS session saved to file.
+type persistedSession struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// sessionCache is an in-memory tls.ClientSessionCache, which is optionally persisted to file.
+type sessionCache struct {
+	size int
+
+	mu       sync.Mutex
+	sessions map[string]*tls.ClientSessionState
+	added    map[string]time.Time
+	path     string
+	timer    *time.Timer
+}
+
+var _ tls.ClientSessionCache = (*sessionCache)(nil)
+
+func newSessionCache(size int) *sessionCache {
+	return &sessionCache{
+		size:     size,
+		sessions: make(map[string]*tls.ClientSessionState),
+		added:    make(map[string]time.Time),
+	}
+}
+
+// Get returns the session of given key, if any.
+func (c *sessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs, ok := c.sessions[key]
+	return cs, ok
+}
+
+// Put stores the session of given key, or removes it if cs is nil. If the cache is full,
+// the oldest session is evicted.
+func (c *sessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cs == nil {
+		delete(c.sessions, key)
+		delete(c.added, key)
+	} else {
+		if _, ok := c.sessions[key]; !ok && len(c.sessions) >= c.size {
+			c.evictOldestLocked()
+		}
+		c.sessions[key] = cs
+		c.added[key] = time.Now()
+	}
+	c.scheduleFlushLocked()
+}
+
+// evictOldestLocked removes the oldest session. The caller must hold c.mu.
+func (c *sessionCache) evictOldestLocked() {
+	oldest := ""
+	for key, t := range c.added {
+		if oldest == "" || t.Before(c.added[oldest]) {
+			oldest = key
+		}
+	}
+	delete(c.sessions, oldest)
+	delete(c.added, oldest)
+}
+
+// scheduleFlushLocked schedules writing the cache to file, if persistence is enabled.
+// The caller must hold c.mu.
+func (c *sessionCache) scheduleFlushLocked() {
+	if c.path == "" || c.timer != nil {
+		return
+	}
+	c.timer = time.AfterFunc(sessionCacheFlushDelay, func() {
+		if err := c.flush(); err != nil {
+			ProxyLogger.Load().Warn().Err(err).Msg("could not persist TLS sessions")
+		}
+	})
+}
+
+// setPath enables persistence of the cache to file at path, loading sessions saved in it.
+func (c *sessionCache) setPath(path string) error {
+	c.mu.Lock()
+	c.path = path
+	c.mu.Unlock()
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var sessions map[string]*persistedSession
+	if err := json.Unmarshal(buf, &sessions); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, s := range sessions {
+		if len(c.sessions) >= c.size {
+			break
+		}
+		state, err := tls.ParseSessionState(s.State)
+		if err != nil {
+			continue
+		}
+		cs, err := tls.NewResumptionState(s.Ticket, state)
+		if err != nil {
+			continue
+		}
+		c.sessions[key] = cs
+		c.added[key] = now
+	}
+	return nil
+}
+
+// flush writes the cache to file, if persistence is enabled. The file is replaced atomically,
+// so a crash during writing does not corrupt the previous content.
+func (c *sessionCache) flush() error {
+	c.mu.Lock()
+	path := c.path
+	c.timer = nil
+	sessions := make(map[string]*persistedSession, len(c.sessions))
+	for key, cs := range c.sessions {
+		ticket, state, err := cs.ResumptionState()
+		if err != nil || state == nil {
+			continue
+		}
+		b, err := state.Bytes()
+		if err != nil {
+			continue
+		}
+		sessions[key] = &persistedSession{Ticket: ticket, State: b}
+	}
+	c.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	buf, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,78 @@
+package ctrld
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func testTLSGet(t *testing.T, srv *httptest.Server, cache tls.ClientSessionCache) *tls.ConnectionState {
+	t.Helper()
+	client := srv.Client()
+	tr := client.Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.ClientSessionCache = cache
+	tr.DisableKeepAlives = true
+	client.Transport = tr
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.TLS
+}
+
+func Test_sessionCache_persist(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	c := newSessionCache(doqSessionCacheSize)
+	if err := c.setPath(path); err != nil {
+		t.Fatal(err)
+	}
+	if state := testTLSGet(t, srv, c); state.DidResume {
+		t.Fatal("first connection must not resume session")
+	}
+	if len(c.sessions) != 1 {
+		t.Fatalf("unexpected number of sessions: %d", len(c.sessions))
+	}
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Acting as ctrld restarted.
+	restored := newSessionCache(doqSessionCacheSize)
+	if err := restored.setPath(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.sessions) != 1 {
+		t.Fatalf("unexpected number of restored sessions: %d", len(restored.sessions))
+	}
+	if state := testTLSGet(t, srv, restored); !state.DidResume {
+		t.Error("connection must resume restored session")
+	}
+}
+
+func Test_sessionCache_evict(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	c := newSessionCache(1)
+	testTLSGet(t, srv, c)
+	var cs *tls.ClientSessionState
+	for _, v := range c.sessions {
+		cs = v
+	}
+	c.Put("other", cs)
+	if len(c.sessions) != 1 {
+		t.Fatalf("unexpected number of sessions: %d", len(c.sessions))
+	}
+	if _, ok := c.Get("other"); !ok {
+		t.Error("newest session must be kept")
+	}
+	c.Put("other", nil)
+	if len(c.sessions) != 0 {
+		t.Errorf("session must be removed")
+	}
+}
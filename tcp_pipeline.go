@@ -0,0 +1,359 @@
+package ctrld
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tcpIdleTimeout is how long a pipelined TCP connection is kept open without queries, if not configured.
+const tcpIdleTimeout = 10 * time.Second
+
+// errConnClosed is returned when a pipelined connection is closed before answering a query.
+var errConnClosed = errors.New("connection closed")
+
+// tcpPipeline returns the pipeline for sending queries to the server identified by key, creating
+// one if necessary. New connections of the pipeline are established using dial, so they always
+// use the current settings of the upstream.
+func (uc *UpstreamConfig) tcpPipeline(key string, dial func(ctx context.Context) (net.Conn, error)) *tcpPipeline {
+	uc.tcpPipelinesMu.Lock()
+	p := uc.tcpPipelines[key]
+	if p == nil {
+		if uc.tcpPipelines == nil {
+			uc.tcpPipelines = make(map[string]*tcpPipeline)
+		}
+		p = &tcpPipeline{}
+		uc.tcpPipelines[key] = p
+	}
+	uc.tcpPipelinesMu.Unlock()
+
+	p.mu.Lock()
+	p.dial = dial
+	p.maxConns = uc.maxConns()
+	p.idleTimeout = uc.idleTimeout()
+	p.mu.Unlock()
+	return p
+}
+
+// resetTCPConns closes all pipelined connections of the upstream.
+func (uc *UpstreamConfig) resetTCPConns() {
+	uc.tcpPipelinesMu.Lock()
+	defer uc.tcpPipelinesMu.Unlock()
+	for _, p := range uc.tcpPipelines {
+		p.reset()
+	}
+}
+
+// tcpPipeline sends queries to a DNS server over a pool of reused TCP connections. Queries are
+// pipelined, and answers are matched to queries by message ID, see RFC 7766 section 6.2.1.
+//
+// Queries are sent using an idle connection if there is one. Otherwise, a new connection is
+// dialed, until the pool has maxConns connections, including the ones being dialed, so bursts
+// of queries are spread over many connections. Once the pool is full, the connection with the
+// fewest queries in flight is used.
+//
+// Connections are closed after being idle for idleTimeout, or the idle timeout advertised
+// by the server using the edns-tcp-keepalive option, see RFC 7828.
+type tcpPipeline struct {
+	mu          sync.Mutex
+	dial        func(ctx context.Context) (net.Conn, error)
+	maxConns    int           // Zero means one connection.
+	idleTimeout time.Duration // Zero means tcpIdleTimeout.
+	conns       []*pipelinedConn
+	dialing     int           // Number of connections being dialed.
+	dialDone    chan struct{} // Closed when a dial is done, if someone waits for it.
+}
+
+// Exchange sends msg and returns its answer. If a reused connection was closed by the server
+// before answering, msg is sent again using a new connection.
+func (p *tcpPipeline) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	for {
+		pc, fresh, err := p.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		answer, err := pc.exchange(ctx, msg)
+		if errors.Is(err, errConnClosed) && !fresh {
+			continue
+		}
+		return answer, err
+	}
+}
+
+// getConn returns a connection of the pool, dialing a new one if there is no idle connection,
+// and the pool is not full. The returned boolean reports whether the connection was just dialed.
+//
+// A slot of the pool is reserved for the new connection, which is dialed without holding the
+// pool lock, so a slow handshake does not block queries using other connections.
+func (p *tcpPipeline) getConn(ctx context.Context) (*pipelinedConn, bool, error) {
+	p.mu.Lock()
+	for {
+		var (
+			best        *pipelinedConn
+			bestPending int
+		)
+		conns := p.conns[:0]
+		for _, pc := range p.conns {
+			pending, closed := pc.numPending()
+			if closed {
+				continue
+			}
+			conns = append(conns, pc)
+			if best == nil || pending < bestPending {
+				best, bestPending = pc, pending
+			}
+		}
+		clear(p.conns[len(conns):])
+		p.conns = conns
+		full := len(p.conns)+p.dialing >= max(p.maxConns, 1)
+		if best != nil && (bestPending == 0 || full) {
+			p.mu.Unlock()
+			return best, false, nil
+		}
+		if !full {
+			break
+		}
+		// All connections are being dialed, wait for one of them.
+		if p.dialDone == nil {
+			p.dialDone = make(chan struct{})
+		}
+		done := p.dialDone
+		p.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		p.mu.Lock()
+	}
+	p.dialing++
+	dial := p.dial
+	idleTimeout := p.idleTimeout
+	p.mu.Unlock()
+	conn, err := dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if p.dialDone != nil {
+		close(p.dialDone)
+		p.dialDone = nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = tcpIdleTimeout
+	}
+	pc := newPipelinedConn(conn, idleTimeout)
+	p.conns = append(p.conns, pc)
+	return pc, true, nil
+}
+
+// reset closes all connections of the pool. Queries in flight on reused connections are
+// sent again using new connections, see Exchange.
+func (p *tcpPipeline) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns {
+		pc.close(errors.New("connection reset"))
+	}
+	clear(p.conns)
+	p.conns = p.conns[:0]
+}
+
+// pipelinedConn is a TCP connection which many queries are in flight on.
+type pipelinedConn struct {
+	conn    *dns.Conn
+	writeMu sync.Mutex
+	done    chan struct{}
+
+	mu          sync.Mutex
+	pending     map[uint16]chan *dns.Msg
+	err         error
+	idle        *time.Timer
+	idleTimeout time.Duration
+}
+
+func newPipelinedConn(conn net.Conn, idleTimeout time.Duration) *pipelinedConn {
+	pc := &pipelinedConn{
+		conn:        &dns.Conn{Conn: conn},
+		done:        make(chan struct{}),
+		idleTimeout: idleTimeout,
+		pending:     make(map[uint16]chan *dns.Msg),
+	}
+	pc.mu.Lock()
+	pc.idle = time.AfterFunc(idleTimeout, func() { pc.close(errors.New("idle timeout")) })
+	pc.mu.Unlock()
+	go pc.readLoop()
+	return pc
+}
+
+func (pc *pipelinedConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	query := msg.Copy()
+	addedOpt := setTCPKeepalive(query)
+	ch := make(chan *dns.Msg, 1)
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return nil, fmt.Errorf("%w: %v", errConnClosed, pc.err)
+	}
+	for {
+		query.Id = dns.Id()
+		if _, ok := pc.pending[query.Id]; !ok {
+			break
+		}
+	}
+	pc.pending[query.Id] = ch
+	pc.idle.Stop()
+	pc.mu.Unlock()
+	defer pc.remove(query.Id)
+
+	pc.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = pc.conn.SetWriteDeadline(deadline)
+	err := pc.conn.WriteMsg(query)
+	pc.writeMu.Unlock()
+	if err != nil {
+		pc.close(err)
+		return nil, fmt.Errorf("%w: %v", errConnClosed, err)
+	}
+
+	select {
+	case answer := <-ch:
+		return pc.handleAnswer(answer, msg.Id, addedOpt), nil
+	case <-pc.done:
+		// The answer may have been read right before the connection was closed.
+		select {
+		case answer := <-ch:
+			return pc.handleAnswer(answer, msg.Id, addedOpt), nil
+		default:
+		}
+		return nil, fmt.Errorf("%w: %v", errConnClosed, pc.closeErr())
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handleAnswer restores the answer to match the original query, applying the idle timeout
+// advertised by the server, if any.
+func (pc *pipelinedConn) handleAnswer(answer *dns.Msg, id uint16, addedOpt bool) *dns.Msg {
+	answer.Id = id
+	if timeout, ok := takeTCPKeepalive(answer, addedOpt); ok {
+		pc.mu.Lock()
+		pc.idleTimeout = timeout
+		pc.mu.Unlock()
+	}
+	return answer
+}
+
+// remove removes pending query with given id, restarting the idle timer if there are no pending queries.
+func (pc *pipelinedConn) remove(id uint16) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.pending, id)
+	if len(pc.pending) == 0 && pc.err == nil {
+		pc.idle.Reset(pc.idleTimeout)
+	}
+}
+
+func (pc *pipelinedConn) readLoop() {
+	for {
+		answer, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.close(err)
+			return
+		}
+		pc.mu.Lock()
+		ch := pc.pending[answer.Id]
+		delete(pc.pending, answer.Id)
+		pc.mu.Unlock()
+		if ch != nil {
+			ch <- answer
+		}
+	}
+}
+
+// close closes the connection, failing all pending queries with err.
+func (pc *pipelinedConn) close(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err != nil {
+		return
+	}
+	pc.err = err
+	pc.idle.Stop()
+	close(pc.done)
+	pc.conn.Close()
+}
+
+// numPending returns the number of queries in flight, and whether the connection is closed.
+func (pc *pipelinedConn) numPending() (int, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending), pc.err != nil
+}
+
+func (pc *pipelinedConn) closeErr() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err
+}
+
+// setTCPKeepalive adds the edns-tcp-keepalive option to msg, replacing the one sent by client,
+// if any. The returned boolean reports whether the OPT record was added to msg.
+func setTCPKeepalive(msg *dns.Msg) bool {
+	addedOpt := false
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.MinMsgSize, false)
+		opt = msg.IsEdns0()
+		addedOpt = true
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, o)
+		}
+	}
+	// Clients must not set the timeout, see RFC 7828 section 3.2.1.
+	opt.Option = append(options, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	return addedOpt
+}
+
+// takeTCPKeepalive removes the edns-tcp-keepalive option from answer, returning the idle timeout
+// advertised by the server, if any. The option is hop-by-hop, so it must not be forwarded to
+// clients. If removeOpt is true, the whole OPT record is removed, because the client did not
+// send one in its query.
+func takeTCPKeepalive(answer *dns.Msg, removeOpt bool) (time.Duration, bool) {
+	var (
+		timeout time.Duration
+		found   bool
+	)
+	for i, rr := range answer.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+		options := opt.Option[:0]
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				// The timeout is specified in units of 100 milliseconds.
+				timeout, found = time.Duration(e.Timeout)*100*time.Millisecond, true
+				continue
+			}
+			options = append(options, o)
+		}
+		opt.Option = options
+		if removeOpt {
+			answer.Extra = append(answer.Extra[:i], answer.Extra[i+1:]...)
+		}
+		break
+	}
+	return timeout, found
+}
@@ -0,0 +1,328 @@
+package ctrld
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testTCPServer answers A queries with 192.0.2.1, in random order. If closeAfter is positive,
+// the connection is closed after answering that many queries. If keepalive is not negative,
+// it is advertised as idle timeout to queries with edns-tcp-keepalive option.
+type testTCPServer struct {
+	ln         net.Listener
+	closeAfter int
+	keepalive  int
+	conns      atomic.Int32
+}
+
+func newTestTCPServer(t *testing.T, closeAfter, keepalive int) *testTCPServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &testTCPServer{ln: ln, closeAfter: closeAfter, keepalive: keepalive}
+	go s.serve()
+	return s
+}
+
+func (s *testTCPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.conns.Add(1)
+		go s.handle(&dns.Conn{Conn: conn})
+	}
+}
+
+func (s *testTCPServer) handle(conn *dns.Conn) {
+	defer conn.Close()
+	var (
+		wg      sync.WaitGroup
+		writeMu sync.Mutex
+	)
+	for n := 1; ; n++ {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+			m := new(dns.Msg)
+			m.SetReply(msg)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+			if opt := msg.IsEdns0(); opt != nil && s.keepalive >= 0 {
+				for _, o := range opt.Option {
+					if o.Option() == dns.EDNS0TCPKEEPALIVE {
+						m.SetEdns0(opt.UDPSize(), false)
+						m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(s.keepalive)}}
+					}
+				}
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_ = conn.WriteMsg(m)
+		}()
+		if n == s.closeAfter {
+			break
+		}
+	}
+	wg.Wait()
+}
+
+func (s *testTCPServer) pipeline() *tcpPipeline {
+	return &tcpPipeline{
+		dial: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", s.ln.Addr().String())
+		},
+	}
+}
+
+func exchangeTest(t *testing.T, p *tcpPipeline, name string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	answer, err := p.Exchange(ctx, msg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if answer.Id != msg.Id {
+		t.Errorf("unexpected answer id, want: %d, got: %d", msg.Id, answer.Id)
+	}
+	if len(answer.Answer) != 1 || answer.Answer[0].Header().Name != name {
+		t.Errorf("unexpected answer for %s: %v", name, answer.Answer)
+	}
+	if answer.IsEdns0() != nil {
+		t.Errorf("answer must not have opt, got: %v", answer.IsEdns0())
+	}
+}
+
+func Test_tcpPipeline_Exchange(t *testing.T) {
+	s := newTestTCPServer(t, 0, -1)
+	p := s.pipeline()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			exchangeTest(t, p, dns.Fqdn(string(rune('a'+i%26))+".example.com"))
+		}(i)
+	}
+	wg.Wait()
+	exchangeTest(t, p, "example.com.")
+	if n := s.conns.Load(); n != 1 {
+		t.Errorf("queries must be pipelined over one connection, got: %d connections", n)
+	}
+}
+
+func Test_tcpPipeline_ExchangeServerClosed(t *testing.T) {
+	s := newTestTCPServer(t, 1, -1)
+	p := s.pipeline()
+
+	exchangeTest(t, p, "example.com.")
+	// The connection was closed by the server, either before or after the query was sent.
+	exchangeTest(t, p, "example.org.")
+	if n := s.conns.Load(); n != 2 {
+		t.Errorf("query must be sent using new connection, got: %d connections", n)
+	}
+}
+
+func Test_tcpPipeline_pool(t *testing.T) {
+	s := newTestTCPServer(t, 0, -1)
+	p := s.pipeline()
+	p.maxConns = 2
+	ctx := context.Background()
+
+	// busy adds a query in flight to pc.
+	busy := func(pc *pipelinedConn) {
+		pc.mu.Lock()
+		pc.pending[uint16(len(pc.pending))] = make(chan *dns.Msg, 1)
+		pc.mu.Unlock()
+	}
+	pc1, fresh, err := p.getConn(ctx)
+	if err != nil || !fresh {
+		t.Fatalf("first connection must be dialed, fresh: %v, err: %v", fresh, err)
+	}
+	if pc, _, _ := p.getConn(ctx); pc != pc1 {
+		t.Fatal("idle connection must be reused")
+	}
+	busy(pc1)
+	pc2, fresh, err := p.getConn(ctx)
+	if err != nil || !fresh {
+		t.Fatalf("new connection must be dialed while others are busy, fresh: %v, err: %v", fresh, err)
+	}
+	busy(pc2)
+	busy(pc2)
+	if pc, fresh, _ := p.getConn(ctx); fresh || pc != pc1 {
+		t.Fatal("least busy connection must be used once the pool is full")
+	}
+
+	p.reset()
+	for _, pc := range []*pipelinedConn{pc1, pc2} {
+		if _, closed := pc.numPending(); !closed {
+			t.Error("all connections must be closed after reset")
+		}
+	}
+	if _, fresh, _ := p.getConn(ctx); !fresh {
+		t.Error("new connection must be dialed after reset")
+	}
+}
+
+func Test_tcpPipeline_slowDial(t *testing.T) {
+	s := newTestTCPServer(t, 0, -1)
+	p := s.pipeline()
+	p.maxConns = 2
+	dial := p.dial
+	unblock := make(chan struct{})
+	var dials atomic.Int32
+	p.dial = func(ctx context.Context) (net.Conn, error) {
+		// The first dial is slow, like a handshake with a lossy network.
+		if dials.Add(1) == 1 {
+			<-unblock
+		}
+		return dial(ctx)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	slow := make(chan *pipelinedConn)
+	go func() {
+		pc, _, _ := p.getConn(ctx)
+		slow <- pc
+	}()
+	for dials.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	pc1, fresh, err := p.getConn(ctx)
+	if err != nil || !fresh {
+		t.Fatalf("new connection must be dialed while another one is being dialed, fresh: %v, err: %v", fresh, err)
+	}
+	// The pool is full, including the connection being dialed.
+	if pc, fresh, _ := p.getConn(ctx); fresh || pc != pc1 {
+		t.Error("connection being dialed must count for the pool size")
+	}
+	close(unblock)
+	if pc := <-slow; pc == nil || pc == pc1 {
+		t.Error("slow dial must return its own connection")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("unexpected number of dials, want: 2, got: %d", n)
+	}
+}
+
+func Test_pipelinedConn_idleTimeout(t *testing.T) {
+	s := newTestTCPServer(t, 0, -1)
+	conn, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := newPipelinedConn(conn, 50*time.Millisecond)
+	select {
+	case <-pc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+func Test_tcpPipeline_ExchangeKeepalive(t *testing.T) {
+	// Server asks for closing the connection after being idle for 100ms.
+	s := newTestTCPServer(t, 0, 1)
+	p := s.pipeline()
+
+	exchangeTest(t, p, "example.com.")
+	p.mu.Lock()
+	pc := p.conns[0]
+	p.mu.Unlock()
+	select {
+	case <-pc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed after server idle timeout")
+	}
+	exchangeTest(t, p, "example.org.")
+	if n := s.conns.Load(); n != 2 {
+		t.Errorf("query must be sent using new connection, got: %d connections", n)
+	}
+}
+
+func Test_setTCPKeepalive(t *testing.T) {
+	tests := []struct {
+		name     string
+		edns0    bool
+		addedOpt bool
+	}{
+		{"edns0", true, false},
+		{"no edns0", false, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			if tc.edns0 {
+				msg.SetEdns0(4096, false)
+				opt := msg.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 100})
+			}
+			if addedOpt := setTCPKeepalive(msg); addedOpt != tc.addedOpt {
+				t.Errorf("unexpected added opt, want: %v, got: %v", tc.addedOpt, addedOpt)
+			}
+			opt := msg.IsEdns0()
+			if opt == nil || len(opt.Option) != 1 {
+				t.Fatalf("unexpected opt: %v", opt)
+			}
+			if e, ok := opt.Option[0].(*dns.EDNS0_TCP_KEEPALIVE); !ok || e.Timeout != 0 {
+				t.Errorf("unexpected option: %v", opt.Option[0])
+			}
+		})
+	}
+}
+
+func Test_takeTCPKeepalive(t *testing.T) {
+	answer := new(dns.Msg)
+	answer.SetQuestion("example.com.", dns.TypeA)
+	answer.SetEdns0(4096, false)
+	opt := answer.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 50},
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther},
+	)
+
+	timeout, ok := takeTCPKeepalive(answer.Copy(), false)
+	if !ok || timeout != 5*time.Second {
+		t.Errorf("unexpected timeout, want: 5s, got: %v, %v", timeout, ok)
+	}
+	keep := answer.Copy()
+	takeTCPKeepalive(keep, false)
+	if opt := keep.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0EDE {
+		t.Errorf("only keepalive option must be removed, got: %v", opt)
+	}
+	remove := answer.Copy()
+	takeTCPKeepalive(remove, true)
+	if remove.IsEdns0() != nil {
+		t.Errorf("opt must be removed, got: %v", remove.IsEdns0())
+	}
+	if _, ok := takeTCPKeepalive(new(dns.Msg), false); ok {
+		t.Error("unexpected timeout for answer without opt")
+	}
+}
@@ -86,4 +86,12 @@ macs = [
     {"14:45:A0:67:83:0A" = ["upstream.2"]},
     {"14:54:4a:8e:08:2d" = ["upstream.2"]},
 ]
+tags = [
+    {"kids" = ["upstream.3"]},
+]
+
+[clients]
+"14:45:A0:67:83:0B" = { name = "Kids-iPad", tag = "kids" }
+"192.168.1.10" = { name = "Kids-Laptop", tag = "kids" }
+"192.168.1.11" = { name = "NAS" }
 `
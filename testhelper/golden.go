@@ -0,0 +1,27 @@
+package testhelper
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata directory")
+
+// AssertGolden checks that got equals the content of golden file testdata/<name>.golden.
+// Run tests with -update flag to write got to the golden file instead.
+func AssertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(got), 0644))
+		return
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err, "missing golden file, run tests with -update flag to create it")
+	require.Equal(t, string(want), got, "%s is outdated, run tests with -update flag if the change is expected", path)
+}
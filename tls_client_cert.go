@@ -0,0 +1,97 @@
+package ctrld
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// setupTLSConfig applies TLS settings of the upstream to c.
+func (uc *UpstreamConfig) setupTLSConfig(c *tls.Config) {
+	if uc.TLSServerName != "" {
+		c.ServerName = uc.TLSServerName
+	}
+	uc.setupECH(c)
+	uc.setupSPKIPins(c)
+	if uc.clientCert != nil {
+		c.GetClientCertificate = uc.clientCert.getClientCertificate
+	}
+}
+
+// clientCertReloader provides the client certificate of an upstream for mutual TLS, or
+// the certificate of an encrypted DNS listener.
+//
+// The certificate is reloaded when its cert or key file changes, so it could be rotated
+// without restarting ctrld. If the new files could not be loaded, for example the cert
+// was replaced but the key was not yet, the current certificate is kept.
+type clientCertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newClientCertReloader(certFile, keyFile string) *clientCertReloader {
+	return &clientCertReloader{certFile: certFile, keyFile: keyFile}
+}
+
+// getClientCertificate implements tls.Config.GetClientCertificate.
+func (r *clientCertReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// certificate returns the current certificate, reloading it if its files changed.
+func (r *clientCertReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	certMod, keyMod, err := r.modTimes()
+	if err == nil {
+		if r.cert != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+			return r.cert, nil
+		}
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err == nil {
+			r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+			return r.cert, nil
+		}
+	}
+	if r.cert != nil {
+		ProxyLogger.Load().Warn().Err(err).Msgf("could not reload certificate %s, using current one", r.certFile)
+		return r.cert, nil
+	}
+	return nil, fmt.Errorf("could not load certificate: %w", err)
+}
+
+// modTimes returns modification times of the cert and key files.
+func (r *clientCertReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// ServerTLSConfig returns the TLS config of an encrypted DNS listener. Like client certificates
+// of upstreams, the certificate is reloaded when its files change, so it could be renewed
+// without restarting ctrld.
+func (lc *ListenerConfig) ServerTLSConfig() (*tls.Config, error) {
+	r := newClientCertReloader(lc.TLSCert, lc.TLSKey)
+	if _, err := r.certificate(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.certificate()
+		},
+	}, nil
+}
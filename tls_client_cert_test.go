@@ -0,0 +1,115 @@
+package ctrld
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_clientCertReloader(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	uc := &UpstreamConfig{ClientCert: certFile, ClientKey: keyFile}
+	uc.clientCert = newClientCertReloader(certFile, keyFile)
+	clientName := func() (string, error) {
+		c := &tls.Config{InsecureSkipVerify: true}
+		uc.setupTLSConfig(c)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: c, DisableKeepAlives: true}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		return string(buf), err
+	}
+
+	if _, err := clientName(); err == nil {
+		t.Fatal("expected error with missing client certificate")
+	}
+
+	modTime := time.Now()
+	writeClientCert := func(name string, writeKey bool) {
+		t.Helper()
+		certPEM, keyPEM := newTestClientCert(t, name)
+		modTime = modTime.Add(time.Hour)
+		files := map[string][]byte{certFile: certPEM}
+		if writeKey {
+			files[keyFile] = keyPEM
+		}
+		for file, content := range files {
+			if err := os.WriteFile(file, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, tc := range []struct {
+		name     string
+		writeKey bool
+		want     string
+	}{
+		{"client-1", true, "client-1"},
+		{"client-2", true, "client-2"},
+		// Mismatched cert and key, the current certificate is kept.
+		{"client-3", false, "client-2"},
+	} {
+		writeClientCert(tc.name, tc.writeKey)
+		got, err := clientName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("unexpected client certificate, want: %q, got: %q", tc.want, got)
+		}
+	}
+}
+
+// newTestClientCert returns PEM encoded self-signed client certificate and key with given common name.
+func newTestClientCert(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
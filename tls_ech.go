@@ -0,0 +1,12 @@
+//go:build go1.23
+
+package ctrld
+
+import "crypto/tls"
+
+// setupECH makes c encrypt the client hello using the upstream ECH config, if any.
+func (uc *UpstreamConfig) setupECH(c *tls.Config) {
+	if len(uc.echConfigList) > 0 {
+		c.EncryptedClientHelloConfigList = uc.echConfigList
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !go1.23
+
+package ctrld
+
+import "crypto/tls"
+
+// setupECH is a no-op, encrypted client hello requires go1.23 or later.
+func (uc *UpstreamConfig) setupECH(c *tls.Config) {}
@@ -0,0 +1,52 @@
+package ctrld
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// setupSPKIPins makes c verify the SPKI pins of the upstream during TLS handshake, if any.
+//
+// By default, pins are verified in addition to CA validation, and any certificate of the
+// verified chain could match a pin. With SPKIPinsOnly, CA validation is skipped, which allows
+// self-hosted upstreams using a private CA, then the leaf certificate must match a pin.
+func (uc *UpstreamConfig) setupSPKIPins(c *tls.Config) {
+	if len(uc.SPKIPins) == 0 {
+		return
+	}
+	if uc.SPKIPinsOnly {
+		c.InsecureSkipVerify = true
+	}
+	c.VerifyConnection = uc.verifySPKIPins
+}
+
+// verifySPKIPins reports an error if no certificates of cs match the SPKI pins of the upstream.
+func (uc *UpstreamConfig) verifySPKIPins(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificates")
+	}
+	var certs []*x509.Certificate
+	if uc.SPKIPinsOnly {
+		certs = cs.PeerCertificates[:1]
+	} else {
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+	for _, cert := range certs {
+		if sliceContains(uc.SPKIPins, spkiPin(cert)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate of %s does not match any SPKI pins", cs.ServerName)
+}
+
+// spkiPin returns the base64 encoded SHA-256 of the SubjectPublicKeyInfo of cert.
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
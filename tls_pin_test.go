@@ -0,0 +1,50 @@
+package ctrld
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_setupSPKIPins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+	pin := spkiPin(srv.Certificate())
+	otherPin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name     string
+		pins     []string
+		pinsOnly bool
+		rootCAs  *x509.CertPool
+		wantErr  bool
+	}{
+		{"no pins", nil, false, pool, false},
+		{"pin matched", []string{otherPin, pin}, false, pool, false},
+		{"pin mismatched", []string{otherPin}, false, pool, true},
+		{"pin matched, untrusted CA", []string{pin}, false, x509.NewCertPool(), true},
+		{"pins only matched", []string{pin}, true, x509.NewCertPool(), false},
+		{"pins only mismatched", []string{otherPin}, true, x509.NewCertPool(), true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			uc := &UpstreamConfig{SPKIPins: tc.pins, SPKIPinsOnly: tc.pinsOnly}
+			c := &tls.Config{RootCAs: tc.rootCAs, ServerName: "example.com"}
+			uc.setupSPKIPins(c)
+			conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), c)
+			if conn != nil {
+				conn.Close()
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package ctrld
+
+import (
+	"encoding/base64"
+)
+
+// tlsServerName returns the name used for SNI and certificate verification of connections
+// to the upstream, which is TLSServerName if set, or the upstream domain otherwise.
+func (uc *UpstreamConfig) tlsServerName() string {
+	if uc.TLSServerName != "" {
+		return uc.TLSServerName
+	}
+	return uc.Domain
+}
+
+// loadECHConfig decodes the upstream ECHConfig. Invalid value was rejected by validation,
+// so the error is only logged here.
+func (uc *UpstreamConfig) loadECHConfig() {
+	buf, err := base64.StdEncoding.DecodeString(uc.ECHConfig)
+	if err != nil {
+		ProxyLogger.Load().Error().Err(err).Msgf("could not decode ech config of upstream: %s", uc.Name)
+		return
+	}
+	uc.echConfigList = buf
+}
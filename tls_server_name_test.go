@@ -0,0 +1,67 @@
+package ctrld
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_setupTLSConfig_serverName(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.ServerName)
+	}))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name       string
+		serverName string
+		wantErr    bool
+	}{
+		{"no override", "", false},
+		{"override", "example.com", false},
+		{"override mismatch", "dns.example.net", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			uc := &UpstreamConfig{TLSServerName: tc.serverName}
+			c := &tls.Config{RootCAs: pool}
+			uc.setupTLSConfig(c)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: c, DisableKeepAlives: true}}
+			resp, err := client.Get(srv.URL)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			buf, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Go does not send IP address as SNI.
+			if got := string(buf); got != tc.serverName {
+				t.Errorf("unexpected server name, want: %q, got: %q", tc.serverName, got)
+			}
+		})
+	}
+}
+
+func Test_tlsServerName(t *testing.T) {
+	uc := &UpstreamConfig{Domain: "1.1.1.1"}
+	if got := uc.tlsServerName(); got != "1.1.1.1" {
+		t.Errorf("unexpected server name, want: 1.1.1.1, got: %s", got)
+	}
+	uc.TLSServerName = "one.one.one.one"
+	if got := uc.tlsServerName(); got != "one.one.one.one" {
+		t.Errorf("unexpected server name, want: one.one.one.one, got: %s", got)
+	}
+}